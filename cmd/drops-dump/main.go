@@ -0,0 +1,100 @@
+// drops-dump saves the full state of a drops server (stations, their
+// metadata, metric history and run statistics) to a file that drops-load can
+// load into another server.
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/silversupreme/drops/pkg/client"
+)
+
+var (
+	addr = flag.String("addr", "localhost:19406", "drops server to dump")
+	out  = flag.String("out", "-", "file to write the dump to (- for stdout)")
+
+	// ssl options; the certificate must belong to one of the server's admins.
+	caCert  = flag.String("caCert", "ca.crt", "CA the server's certificate is signed with")
+	sslCert = flag.String("sslCert", "admin.crt", "SSL certificate to present to the server")
+	sslKey  = flag.String("sslKey", "admin.key", "SSL private key to load")
+)
+
+func main() {
+	flag.Parse()
+
+	config, err := client.LoadTLSConfig(*caCert, *sslCert, *sslKey)
+	if err != nil {
+		glog.Fatalf("couldn't set up ssl: %v", err)
+	}
+
+	conn, err := tls.Dial("tcp", *addr, config)
+	if err != nil {
+		glog.Fatalf("couldn't connect to the drops server: %v", err)
+	}
+	defer conn.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			glog.Fatalf("couldn't create dump: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	n, err := dump(conn, w)
+	if err != nil {
+		glog.Fatalf("couldn't dump server: %v", err)
+	}
+
+	glog.Infof("dumped %d records from %s", n, *addr)
+	glog.Flush()
+}
+
+// dump asks the server on conn for its state, and writes each record to w as
+// a line of JSON.
+func dump(conn io.ReadWriter, w io.Writer) (int, error) {
+	if _, err := fmt.Fprintf(conn, "dump DUMP\n"); err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	scanner := bufio.NewScanner(conn)
+
+	n := 0
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) < 2 || fields[0] != "dump" {
+			continue
+		}
+
+		switch fields[1] {
+		case "STATE":
+			if len(fields) != 3 {
+				return n, fmt.Errorf("bad line from server: %q", scanner.Text())
+			}
+			bw.WriteString(fields[2] + "\n")
+			n++
+		case "DUMP":
+			if len(fields) != 3 || fields[2] != fmt.Sprint(n) {
+				return n, fmt.Errorf("server sent %d records but ended with %q", n, scanner.Text())
+			}
+			return n, bw.Flush()
+		default:
+			return n, fmt.Errorf("server refused to dump (is this certificate an admin?): %s", scanner.Text())
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return n, err
+	}
+	return n, io.ErrUnexpectedEOF
+}
@@ -0,0 +1,56 @@
+// drops-load loads a file written by drops-dump into a drops server, merging
+// it with whatever state the server already has.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/silversupreme/drops/pkg/client"
+)
+
+var (
+	addr = flag.String("addr", "localhost:19406", "drops server to load into")
+	in   = flag.String("in", "-", "dump to load (- for stdin)")
+
+	// ssl options; the certificate must belong to one of the server's admins.
+	caCert  = flag.String("caCert", "ca.crt", "CA the server's certificate is signed with")
+	sslCert = flag.String("sslCert", "admin.crt", "SSL certificate to present to the server")
+	sslKey  = flag.String("sslKey", "admin.key", "SSL private key to load")
+)
+
+func main() {
+	flag.Parse()
+
+	config, err := client.LoadTLSConfig(*caCert, *sslCert, *sslKey)
+	if err != nil {
+		glog.Fatalf("couldn't set up ssl: %v", err)
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			glog.Fatalf("couldn't open dump: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	conn, err := tls.Dial("tcp", *addr, config)
+	if err != nil {
+		glog.Fatalf("couldn't connect to the drops server: %v", err)
+	}
+	defer conn.Close()
+
+	n, err := client.LoadState(conn, r, "load")
+	if err != nil {
+		glog.Fatalf("couldn't load dump after %d records: %v", n, err)
+	}
+
+	glog.Infof("loaded %d records into %s", n, *addr)
+	glog.Flush()
+}
@@ -0,0 +1,97 @@
+// drops-restore checks a backup taken by a drops server started with
+// -backupDir, and restores it: either its state, loaded into a running
+// server like drops-load does, or its metric store, written out for a new
+// server to be started with.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/silversupreme/drops/pkg/client"
+	"github.com/silversupreme/drops/pkg/server"
+)
+
+var (
+	from   = flag.String("from", "", "backup to restore, a directory under the server's -backupDir")
+	verify = flag.Bool("verify", false, "only check the backup, without restoring it")
+	store  = flag.String("store", "", "write the backed-up metric store to this file, for a server to be started with, instead of loading the state into -addr")
+
+	addr = flag.String("addr", "localhost:19406", "drops server to load the state into")
+
+	// ssl options, for loading the state; only admins can LOAD.
+	caCert  = flag.String("caCert", "ca.crt", "CA the server's certificate is signed with")
+	sslCert = flag.String("sslCert", "admin.crt", "SSL certificate to present to the server")
+	sslKey  = flag.String("sslKey", "admin.key", "SSL private key to load")
+)
+
+func main() {
+	flag.Parse()
+
+	if *from == "" {
+		glog.Fatalf("-from is required")
+	}
+
+	// backups are always checked, so a bad one is never half restored.
+	sink, name := server.DirSink(filepath.Dir(*from)), filepath.Base(*from)
+	if err := server.VerifyBackup(sink, name); err != nil {
+		glog.Fatalf("backup %s is bad: %v", *from, err)
+	}
+	if *verify {
+		fmt.Printf("backup %s is good\n", *from)
+		return
+	}
+
+	if *store != "" {
+		data, err := sink.Open(name + "/store")
+		if err != nil {
+			glog.Fatalf("backup %s has no metric store: %v", *from, err)
+		}
+		// never overwrite a store a server may still be using.
+		f, err := os.OpenFile(*store, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			glog.Fatalf("couldn't create %s: %v", *store, err)
+		}
+		defer data.Close()
+		if _, err := io.Copy(f, data); err != nil {
+			glog.Fatalf("couldn't write %s: %v", *store, err)
+		}
+		if err := f.Close(); err != nil {
+			glog.Fatalf("couldn't write %s: %v", *store, err)
+		}
+
+		glog.Infof("restored the metric store of %s to %s", *from, *store)
+		glog.Flush()
+		return
+	}
+
+	state, err := sink.Get(name + "/state.jsonl")
+	if err != nil {
+		glog.Fatalf("couldn't read backup: %v", err)
+	}
+
+	config, err := client.LoadTLSConfig(*caCert, *sslCert, *sslKey)
+	if err != nil {
+		glog.Fatalf("couldn't set up ssl: %v", err)
+	}
+
+	conn, err := tls.Dial("tcp", *addr, config)
+	if err != nil {
+		glog.Fatalf("couldn't connect to the drops server: %v", err)
+	}
+	defer conn.Close()
+
+	n, err := client.LoadState(conn, bytes.NewReader(state), "restore")
+	if err != nil {
+		glog.Fatalf("couldn't restore backup after %d records: %v", n, err)
+	}
+
+	glog.Infof("restored %d records from %s into %s", n, *from, *addr)
+	glog.Flush()
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/benbjohnson/clock"
 	"github.com/golang/glog"
@@ -14,54 +23,708 @@ import (
 var (
 	listenAddr = flag.String("listenAddr", ":19406", "TCP address to listen on")
 	maxMetrics = flag.Int("maxMetrics", 100, "max metric data points to keep for each metric from each station")
+	maxLogs    = flag.Int("maxLogs", 100, "max LOG lines to keep for each station")
 
 	// ssl options
 	caCert  = flag.String("caCert", "ca.crt", "Only clients signed with this CA will be accepted")
 	sslCert = flag.String("sslCert", "server.crt", "SSL certificate to present to clients")
 	sslKey  = flag.String("sslKey", "server.key", "SSL private key to load")
+
+	certCheckEvery = flag.Duration("certCheckEvery", time.Minute, "how often to check -caCert, -sslCert, -sslKey and -crl for changes, reloading them for new connections (0 to only reload on SIGHUP)")
+
+	crl = flag.String("crl", "", "file of CRLs signed by -caCert, in PEM or DER, whose revoked client certificates are rejected and disconnected (empty to not check revocations)")
+
+	// access control
+	admins    = flag.String("admins", "", "comma-separated certificate common names allowed to run admin commands")
+	blocklist = flag.String("blocklist", "", "file of SHA-256 certificate fingerprints to reject, one per line")
+	denyAfter = flag.Int("denyAfter", 0, "temporarily deny addresses after this many failed handshakes or garbage commands (0 to never deny)")
+	denyFor   = flag.Duration("denyFor", 15*time.Minute, "how long -denyAfter denies an address for")
+
+	roles = flag.String("roles", "", "JSON file of the commands each role may send, and which certificates have which role besides their OU (empty to let certificates send anything)")
+
+	bindNames  = flag.Bool("bindNames", false, "only let stations REGISTER as the common name or a DNS name on their certificate")
+	nameGrants = flag.String("nameGrants", "", "comma-separated identity=pattern pairs letting a certificate's common name REGISTER as any matching name, with -bindNames, e.g. gateway=greenhouse-*")
+
+	stationTypes = flag.String("stationTypes", "", "JSON file of station types, with the metrics, functions and SLOs expected of each (empty to accept any type)")
+
+	telemetryEvery = flag.Duration("telemetryEvery", 0, "how often the server reports on itself as the metrics of the _server station (0 to not report)")
+
+	modbus = flag.String("modbus", "", "JSON file of Modbus TCP/RTU devices to poll as virtual stations, with the registers to read as each one's metrics (empty to poll none)")
+
+	ingest = flag.String("ingest", "", "JSON file of third-party sources to take pushes from at -httpAddr's /api/ingest/[source], with the paths of their payloads to map to virtual stations' metrics (empty to take none)")
+
+	locations = flag.String("locations", "", "file of station locations, one `[name] [lat],[lon]` per line")
+	httpAddr  = flag.String("httpAddr", "", "TCP address to serve the HTTP API on, over the same SSL setup (empty to disable)")
+
+	wsOrigins listFlag
+
+	metricsAddr = flag.String("metricsAddr", "", "TCP address to serve just /metrics on for Prometheus, over plain HTTP (empty to disable)")
+
+	slos listFlag
+
+	banner listFlag
+
+	environment = flag.String("environment", "", "environment the server is part of, like prod or staging, which clients check before running functions (empty to leave it unlabelled)")
+
+	virtual listFlag
+
+	thresholds listFlag
+
+	pointLog      = flag.String("pointLog", "", "file to persist metric points to (empty to keep them in memory only)")
+	pointBatch    = flag.Int("pointBatch", 256, "max metric points written to -pointLog with a single fsync")
+	pointInterval = flag.Duration("pointInterval", 100*time.Millisecond, "max time a metric point waits for -pointLog to be synced")
+	boltDB        = flag.String("boltDB", "", "BoltDB file to persist metric points to, instead of -pointLog")
+	sqliteDB      = flag.String("sqlite", "", "SQLite database to persist metric points, stations and notes to, instead of -pointLog")
+
+	queryCacheTTL = flag.Duration("queryCacheTTL", time.Second, "how long to cache fleet-wide queries like TOP for (0 to disable)")
+
+	exportDir = flag.String("exportDir", "", "directory to export hourly Parquet files of every station's metric points to (empty to disable)")
+
+	backupDir   = flag.String("backupDir", "", "directory to back up the server's state and metric store to, for drops-restore (empty to disable)")
+	backupEvery = flag.Duration("backupEvery", 24*time.Hour, "how often to back up to -backupDir")
+	backupKeep  = flag.Int("backupKeep", 14, "how many backups to keep in -backupDir, removing older ones (0 to keep them all)")
+
+	reclaimAfter = flag.Duration("reclaimAfter", 0, "forget the logs, run statistics and history of stations offline for this long (0 to keep them forever)")
+	sweepEvery   = flag.Duration("sweepEvery", 10*time.Minute, "how often to look for stations to forget with -reclaimAfter")
+
+	reapAfter = flag.Duration("reapAfter", 0, "take stations offline that haven't sent a PING or METRIC for this long (0 to wait for their connection to drop)")
+	reapEvery = flag.Duration("reapEvery", 15*time.Second, "how often to look for stations to take offline with -reapAfter")
+
+	retention   = flag.Duration("retention", 0, "drop metric points older than this, in memory and in the metric store (0 to keep them regardless of age)")
+	expireEvery = flag.Duration("expireEvery", time.Minute, "how often to drop points older than -retention")
+
+	webhooks        listFlag
+	webhookQueue    = flag.String("webhookQueue", "", "file to queue undelivered -webhook notifications in, so they survive restarts, with .2, .3, ... appended for the second webhook on (empty to queue them in memory only)")
+	webhookMaxQueue = flag.Int("webhookMaxQueue", 10000, "most notifications queued for each -webhook, dropping the oldest once there are more")
+	webhookEvents   = flag.String("webhookEvents", "register,disconnect,run.err", "comma-separated kinds of journal events to POST to -webhook too, besides notifications (empty to POST only notifications)")
+
+	alertReminders = flag.Duration("alertReminders", 0, "notify again about open alerts nobody has acknowledged this often (0 to notify once)")
+
+	reports  = flag.String("reports", "", "comma-separated reports on the fleet to send through the notification sinks, daily and/or weekly (empty to send none)")
+	reportTZ = flag.String("reportTZ", "Local", "time zone whose midnight -reports go out at")
+
+	staleAfter = flag.Duration("staleAfter", 15*time.Minute, "how long a metric can go without a new point before it counts against its station's health")
+
+	durableBacklog = flag.Int("durableBacklog", 10000, "max uncommitted points kept for each durable subscription")
+
+	redeliveryWindow = flag.Duration("redeliveryWindow", 0, "how long to hold idempotent runs of a disconnected station for redelivery (0 to fail them immediately)")
+	runTimeout       = flag.Duration("runTimeout", 0, "fail runs a station hasn't answered within this long with ERR TIMEOUT (0 to wait forever)")
+
+	slowCommand = flag.Duration("slowCommand", 0, "log commands that take this long or longer to handle (0 to never log them)")
+
+	watchdog = flag.String("watchdog", "", "limits on the server's own runtime to notify about, like goroutines=10000,mutexWait=1s,gcPause=100ms[,every=30s][,profiles=dir] (empty to disable)")
+
+	deadMan = flag.String("deadMan", "", "alert when no station has reported a metric point for a while, like silence=10m[,every=1m][,url=https://hc-ping.com/uuid] to also ping a monitor while points come in, and url/fail once they stop (empty to disable)")
+
+	heartbeat      = flag.String("heartbeat", "", "URL to POST the server's status to every -heartbeatEvery, for a monitor to notice when it's down (empty to disable)")
+	heartbeatEvery = flag.Duration("heartbeatEvery", time.Minute, "how often to send a -heartbeat")
+
+	crashDir = flag.String("crashDir", "", "directory to write a report to when the server crashes, with recent commands and goroutine stacks (empty to disable)")
+
+	logFile        = flag.String("logFile", "", "file to write the server's logs to, rotated by the server itself (empty to log to stderr)")
+	logMaxSize     = flag.Int64("logMaxSize", 10, "rotate -logFile once it gets this many megabytes big (0 for no limit)")
+	logRotateEvery = flag.Duration("logRotateEvery", 24*time.Hour, "rotate -logFile this often regardless of its size (0 to only rotate by size)")
+	logKeep        = flag.Int("logKeep", 7, "how many rotated -logFile files to keep (0 to keep them all)")
+	logCompress    = flag.Bool("logCompress", true, "gzip rotated -logFile files")
+
+	auditLog         = flag.String("auditLog", "", "file to record every command sent to the server to, as JSON lines rotated like -logFile (empty to not audit commands)")
+	auditMaxSize     = flag.Int64("auditMaxSize", 100, "rotate -auditLog once it gets this many megabytes big (0 for no limit)")
+	auditRotateEvery = flag.Duration("auditRotateEvery", 24*time.Hour, "rotate -auditLog this often regardless of its size (0 to only rotate by size)")
+	auditKeep        = flag.Int("auditKeep", 0, "how many rotated -auditLog files to keep (0 to keep them all)")
+
+	dedupWindow = flag.Duration("dedupWindow", 30*time.Second, "how long to answer writes resent under the same uid from memory, rather than carrying them out again (0 to always carry them out)")
+
+	catchUpRate = flag.Int("catchUpRate", 0, "how many backfilled points a second stations catching up on a backlog can send between them (0 for no limit)")
+
+	metricRate  = flag.Float64("metricRate", 0, "how many points a second each station can send before the rest are rejected with ERR RATE_LIMITED (0 for no limit)")
+	metricBurst = flag.Int("metricBurst", 10, "how many points each station can send at once before -metricRate kicks in")
+
+	simClock = flag.String("simClock", "", "run on a simulated clock starting at this RFC 3339 time, which only moves on when an admin sends ADVANCE (empty to run on the system clock)")
+
+	chaos = flag.Bool("chaos", false, "let admins inject latency, dropped answers and disconnects with CHAOS, to rehearse failures (test deployments only)")
+
+	coapAddr           = flag.String("coapAddr", "", "UDP address to answer CoAP requests from constrained stations on, in plaintext, with -coapInsecure (empty to disable)")
+	coapInsecure       = flag.Bool("coapInsecure", false, "allow -coapAddr, though anyone who can reach it can register as a station and send metrics unauthenticated")
+	coapSessionTimeout = flag.Duration("coapSessionTimeout", time.Hour, "end the session of a CoAP station that sends nothing for this long")
+
+	maxConns = flag.Int("maxConns", 0, "how many connections to handle at once, answering any more with BUSY (0 for no limit)")
+
+	idleTimeout        = flag.Duration("idleTimeout", 0, "disconnect clients that send nothing for this long (0 to never disconnect them)")
+	stationIdleTimeout = flag.Duration("stationIdleTimeout", 0, "disconnect registered stations that send nothing for this long, usually longer than -idleTimeout (0 to never disconnect them)")
+
+	shutdownTimeout = flag.Duration("shutdownTimeout", 30*time.Second, "how long to wait on SIGINT or SIGTERM for the commands being handled to finish before closing connections outright")
+
+	strict = flag.Bool("strict", false, "answer rejected commands with an error code and the offending token, like ERR E_BADARG pos=3 token=abc")
 )
 
 func init() {
 	flag.Set("alsologtostderr", "true")
+	flag.Var(&virtual, "virtual", "virtual station metric computed from other stations', like reservoir.level=sum(tank*.level) (repeatable)")
+	flag.Var(&banner, "banner", "line to send every client as it connects, like the environment's name or a maintenance notice (repeatable)")
+	flag.Var(&webhooks, "webhook", "URL to POST notifications like SLO alerts and events like disconnects to as JSON (repeatable)")
+	flag.Var(&thresholds, "threshold", "rule alerting on a metric past a value, like 'low_water=*.water.level < 10 for 5m' (repeatable)")
+	flag.Var(&wsOrigins, "wsOrigin", "origin of a browser dashboard allowed to open WebSockets to -httpAddr's /ws, like https://dashboard.example.com, besides the server's own (repeatable)")
+	flag.Var(&slos, "slo", "run success objective like fn=read_level,target=99,within=5s,window=1h[,burn=1][,min=10][,station=water] (repeatable)")
+}
+
+// reloader is something loaded from files that can be loaded again, like
+// certificates.
+type reloader interface {
+	Reload() error
+}
+
+// listFlag collects every use of a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
 }
 
 func main() {
 	flag.Parse()
 
-	// setup the ssl socket
-	// Load the certificates from disk
-	certificate, err := tls.LoadX509KeyPair(*sslCert, *sslKey)
-	if err != nil {
-		glog.Fatalf("could not load server key pair: %s", err)
+	clk := clock.New()
+	if *simClock != "" {
+		start, err := time.Parse(time.RFC3339, *simClock)
+		if err != nil {
+			glog.Fatalf("bad -simClock: %v", err)
+		}
+		mock := clock.NewMock()
+		mock.Set(start)
+		clk = mock
 	}
 
-	// Create a certificate pool from the certificate authority
-	certPool := x509.NewCertPool()
-	ca, err := ioutil.ReadFile(*caCert)
-	if err != nil {
-		glog.Fatalf("could not read ca certificate: %s", err)
+	if *logFile != "" {
+		closeLog, err := logToFile(clk)
+		if err != nil {
+			glog.Fatalf("couldn't log to %s: %v", *logFile, err)
+		}
+		defer closeLog()
 	}
 
-	// Append the client certificates from the CA
-	if ok := certPool.AppendCertsFromPEM(ca); !ok {
-		glog.Fatalf("failed to append client certs")
-	}
-
-	// Create the TLS credentials
-	creds := &tls.Config{
+	// setup the ssl socket, with certificates that can be reloaded while
+	// the server's running.
+	base := &tls.Config{
 		ClientAuth:               tls.RequireAndVerifyClientCert,
-		Certificates:             []tls.Certificate{certificate},
-		ClientCAs:                certPool,
 		PreferServerCipherSuites: true,
 		MinVersion:               tls.VersionTLS12,
 	}
+	var revocations *server.Revocations
+	if *crl != "" {
+		var err error
+		if revocations, err = server.NewRevocations(*crl, *caCert); err != nil {
+			glog.Fatalf("could not load CRLs: %s", err)
+		}
+		revocations.SetLogger(glogLogger{})
+		base.VerifyPeerCertificate = revocations.VerifyPeerCertificate
+	}
+
+	certs, err := server.NewCertReloader(base, *sslCert, *sslKey, *caCert)
+	if err != nil {
+		glog.Fatalf("could not load certificates: %s", err)
+	}
+	certs.SetLogger(glogLogger{})
+	if *certCheckEvery > 0 {
+		// files change in real time, even on a -simClock.
+		certs.Watch(clock.New(), *certCheckEvery)
+		if revocations != nil {
+			revocations.Watch(clock.New(), *certCheckEvery)
+		}
+	}
+	reloaders := []reloader{certs}
+	if revocations != nil {
+		reloaders = append(reloaders, revocations)
+	}
+	reloadOnSignal(reloaders...)
+	creds := certs.TLSConfig()
 
 	ln, err := tls.Listen("tcp", *listenAddr, creds)
 	if err != nil {
 		glog.Fatalf("couldn't listen on %s: %v", *listenAddr, err)
 	}
 
+	opts := []server.Option{server.WithLogger(glogLogger{}), server.WithLogLines(*maxLogs), server.WithBye()}
+	if *admins != "" {
+		opts = append(opts, server.WithAdmins(strings.Split(*admins, ",")...))
+	}
+	if revocations != nil {
+		opts = append(opts, server.WithRevocations(revocations))
+	}
+	if *roles != "" {
+		f, err := os.Open(*roles)
+		if err != nil {
+			glog.Fatalf("could not read roles: %v", err)
+		}
+
+		r, err := server.ParseRoles(f)
+		f.Close()
+		if err != nil {
+			glog.Fatalf("could not read roles: %v", err)
+		}
+		opts = append(opts, server.WithRoles(r))
+	}
+	if *bindNames {
+		grants := map[string][]string{}
+		if *nameGrants != "" {
+			var err error
+			if grants, err = server.ParseNameGrants(*nameGrants); err != nil {
+				glog.Fatalf("bad -nameGrants flag: %v", err)
+			}
+		}
+		opts = append(opts, server.WithBoundNames(grants))
+	}
+	if *blocklist != "" {
+		fps, err := readLines(*blocklist)
+		if err != nil {
+			glog.Fatalf("could not read blocklist: %v", err)
+		}
+		opts = append(opts, server.WithBlocklist(fps...))
+	}
+	if *denyAfter > 0 {
+		opts = append(opts, server.WithProbeDenylist(*denyAfter, *denyFor))
+	}
+
+	if *locations != "" {
+		lines, err := readLines(*locations)
+		if err != nil {
+			glog.Fatalf("could not read locations: %v", err)
+		}
+
+		locs := map[string]server.Location{}
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				glog.Fatalf("bad line in locations: %q", line)
+			}
+
+			l, err := server.ParseLocation(fields[1])
+			if err != nil {
+				glog.Fatalf("bad line in locations: %v", err)
+			}
+			locs[fields[0]] = l
+		}
+		opts = append(opts, server.WithLocations(locs))
+	}
+
+	if *stationTypes != "" {
+		f, err := os.Open(*stationTypes)
+		if err != nil {
+			glog.Fatalf("could not read station types: %v", err)
+		}
+
+		types, err := server.ParseStationTypes(f)
+		f.Close()
+		if err != nil {
+			glog.Fatalf("could not read station types: %v", err)
+		}
+		opts = append(opts, server.WithStationTypes(types...))
+	}
+
+	for _, spec := range slos {
+		o, err := server.ParseSLO(spec)
+		if err != nil {
+			glog.Fatalf("bad -slo: %v", err)
+		}
+		opts = append(opts, server.WithSLOs(o))
+	}
+
+	for _, spec := range virtual {
+		v, err := server.ParseVirtualMetric(spec)
+		if err != nil {
+			glog.Fatalf("bad -virtual: %v", err)
+		}
+		opts = append(opts, server.WithVirtualMetrics(v))
+	}
+
+	if len(wsOrigins) > 0 {
+		opts = append(opts, server.WithWebSocketOrigins(wsOrigins...))
+	}
+
+	for _, spec := range thresholds {
+		t, err := server.ParseThreshold(spec)
+		if err != nil {
+			glog.Fatalf("bad -threshold: %v", err)
+		}
+		opts = append(opts, server.WithThresholds(t))
+	}
+
+	if *modbus != "" {
+		f, err := os.Open(*modbus)
+		if err != nil {
+			glog.Fatalf("could not read modbus devices: %v", err)
+		}
+
+		devices, err := server.ParseModbus(f)
+		f.Close()
+		if err != nil {
+			glog.Fatalf("could not read modbus devices: %v", err)
+		}
+		opts = append(opts, server.WithModbus(devices...))
+	}
+
+	if *ingest != "" {
+		f, err := os.Open(*ingest)
+		if err != nil {
+			glog.Fatalf("could not read ingest sources: %v", err)
+		}
+
+		sources, err := server.ParseIngest(f)
+		f.Close()
+		if err != nil {
+			glog.Fatalf("could not read ingest sources: %v", err)
+		}
+		opts = append(opts, server.WithIngest(sources...))
+	}
+
+	if *telemetryEvery > 0 {
+		opts = append(opts, server.WithTelemetry(*telemetryEvery))
+	}
+
+	stores := 0
+	for _, path := range []string{*pointLog, *boltDB, *sqliteDB} {
+		if path != "" {
+			stores++
+		}
+	}
+	switch {
+	case stores > 1:
+		glog.Fatalf("only one of -pointLog, -boltDB and -sqlite can be used")
+	case *pointLog != "":
+		points, err := server.OpenPointLog(*pointLog, *maxMetrics, *pointBatch, *pointInterval, clk)
+		if err != nil {
+			glog.Fatalf("could not open point log: %v", err)
+		}
+		points.SetLogger(glogLogger{})
+		defer points.Close()
+
+		opts = append(opts, server.WithMetricStore(points))
+	case *boltDB != "":
+		store, err := server.OpenBoltStore(*boltDB, *maxMetrics)
+		if err != nil {
+			glog.Fatalf("could not open bolt store: %v", err)
+		}
+		defer store.Close()
+
+		opts = append(opts, server.WithMetricStore(store))
+	case *sqliteDB != "":
+		store, err := server.OpenSQLiteStore(*sqliteDB, *maxMetrics)
+		if err != nil {
+			glog.Fatalf("could not open sqlite store: %v", err)
+		}
+		defer store.Close()
+
+		opts = append(opts, server.WithMetricStore(store))
+	}
+
+	if *queryCacheTTL > 0 {
+		opts = append(opts, server.WithQueryCache(*queryCacheTTL))
+	}
+
+	if *exportDir != "" {
+		opts = append(opts, server.WithExport(server.DirSink(*exportDir)))
+	}
+
+	if *backupDir != "" {
+		opts = append(opts, server.WithBackups(server.DirSink(*backupDir), *backupEvery), server.WithBackupKeep(*backupKeep))
+	}
+
+	if *reclaimAfter > 0 {
+		opts = append(opts, server.WithJanitor(*reclaimAfter, *sweepEvery))
+	}
+
+	if *reapAfter > 0 {
+		opts = append(opts, server.WithReaper(*reapAfter, *reapEvery))
+	}
+
+	if *retention > 0 {
+		opts = append(opts, server.WithRetention(*retention, *expireEvery))
+	}
+
+	opts = append(opts, server.WithDurableBacklog(*durableBacklog))
+	opts = append(opts, server.WithStaleAfter(*staleAfter))
+
+	if *reports != "" {
+		loc, err := time.LoadLocation(*reportTZ)
+		if err != nil {
+			glog.Fatalf("bad -reportTZ: %v", err)
+		}
+
+		var periods []server.ReportPeriod
+		for _, v := range strings.Split(*reports, ",") {
+			p, err := server.ParseReportPeriod(v)
+			if err != nil {
+				glog.Fatalf("bad -reports: %v", err)
+			}
+			periods = append(periods, p)
+		}
+		opts = append(opts, server.WithReports(loc, periods...))
+	}
+
+	for i, url := range webhooks {
+		queue := *webhookQueue
+		if queue != "" && i > 0 {
+			queue += fmt.Sprintf(".%d", i+1)
+		}
+		wh, err := server.NewWebhook(url, queue, clk)
+		if err != nil {
+			glog.Fatalf("could not start webhook: %v", err)
+		}
+		wh.SetLogger(glogLogger{})
+		wh.SetMaxQueued(*webhookMaxQueue)
+		defer wh.Close()
+
+		opts = append(opts, server.WithNotifier(wh))
+		if *webhookEvents != "" {
+			opts = append(opts, server.WithEventNotifier(wh, strings.Split(*webhookEvents, ",")...))
+		}
+	}
+
+	if *redeliveryWindow > 0 {
+		opts = append(opts, server.WithRedelivery(*redeliveryWindow))
+	}
+
+	if *runTimeout > 0 {
+		opts = append(opts, server.WithRunTimeout(*runTimeout))
+	}
+
+	if *slowCommand > 0 {
+		opts = append(opts, server.WithSlowCommands(*slowCommand))
+	}
+
+	if *watchdog != "" {
+		w, err := server.ParseWatchdog(*watchdog)
+		if err != nil {
+			glog.Fatalf("bad -watchdog: %v", err)
+		}
+		opts = append(opts, server.WithWatchdog(w))
+	}
+
+	if *deadMan != "" {
+		d, err := server.ParseDeadMan(*deadMan)
+		if err != nil {
+			glog.Fatalf("bad -deadMan: %v", err)
+		}
+		opts = append(opts, server.WithDeadMan(d))
+	}
+
+	if *heartbeat != "" {
+		opts = append(opts, server.WithHeartbeat(*heartbeat, *heartbeatEvery))
+	}
+
+	if *alertReminders > 0 {
+		opts = append(opts, server.WithAlertReminders(*alertReminders))
+	}
+
+	if *crashDir != "" {
+		opts = append(opts, server.WithCrashReports(*crashDir))
+	}
+
+	if *dedupWindow > 0 {
+		opts = append(opts, server.WithDedup(*dedupWindow))
+	}
+
+	if *catchUpRate > 0 {
+		opts = append(opts, server.WithCatchUp(*catchUpRate))
+	}
+
+	if *metricRate > 0 {
+		opts = append(opts, server.WithRateLimit(*metricRate, *metricBurst))
+	}
+
+	if *auditLog != "" {
+		lf, err := server.OpenLogFile(*auditLog, server.LogRotation{
+			MaxSize:  *auditMaxSize << 20,
+			Every:    *auditRotateEvery,
+			Keep:     *auditKeep,
+			Compress: true,
+		}, clk)
+		if err != nil {
+			glog.Fatalf("couldn't audit to %s: %v", *auditLog, err)
+		}
+		lf.SetLogger(glogLogger{})
+		defer lf.Close()
+		opts = append(opts, server.WithAuditor(server.NewAuditLog(lf)))
+	}
+
+	if *strict {
+		opts = append(opts, server.WithStrictProtocol())
+	}
+
+	if *chaos {
+		glog.Warningf("chaos mode is on: admins can make stations and clients misbehave")
+		opts = append(opts, server.WithChaos())
+	}
+
+	if *coapAddr != "" {
+		// CoAP stations have no certificate, so they can't be told apart.
+		if !*coapInsecure {
+			glog.Fatalf("-coapAddr takes unauthenticated plaintext requests from anyone; pass -coapInsecure to allow it")
+		}
+		glog.Warningf("the CoAP gateway is on: anyone who can reach %s can register as a station", *coapAddr)
+		opts = append(opts, server.WithCoAP(*coapSessionTimeout))
+	}
+
+	if *maxConns > 0 {
+		opts = append(opts, server.WithMaxConns(*maxConns))
+	}
+
+	if *idleTimeout > 0 || *stationIdleTimeout > 0 {
+		opts = append(opts, server.WithIdleTimeout(*idleTimeout, *stationIdleTimeout))
+	}
+
+	if *environment != "" {
+		opts = append(opts, server.WithEnvironment(*environment))
+	}
+
+	if len(banner) > 0 {
+		opts = append(opts, server.WithBanner(banner...))
+	}
+
 	glog.Infof("Starting SSL server on %s.", *listenAddr)
-	s := server.New(ln, *maxMetrics, clock.New())
-	s.Serve()
+	s := server.New(ln, *maxMetrics, clk, opts...)
+	dumpOnSignal(s)
+
+	if *httpAddr != "" {
+		httpLn, err := tls.Listen("tcp", *httpAddr, creds)
+		if err != nil {
+			glog.Fatalf("couldn't listen on %s: %v", *httpAddr, err)
+		}
+
+		glog.Infof("Starting HTTP API on %s.", *httpAddr)
+		go func() {
+			glog.Fatal(http.Serve(httpLn, s.HTTPHandler()))
+		}()
+	}
+
+	if *coapAddr != "" {
+		pc, err := net.ListenPacket("udp", *coapAddr)
+		if err != nil {
+			glog.Fatalf("couldn't listen on %s: %v", *coapAddr, err)
+		}
+
+		glog.Infof("Starting CoAP gateway on %s.", *coapAddr)
+		go func() {
+			glog.Fatal(s.ServeCoAP(context.Background(), pc))
+		}()
+	}
+
+	if *metricsAddr != "" {
+		metricsLn, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			glog.Fatalf("couldn't listen on %s: %v", *metricsAddr, err)
+		}
+
+		glog.Infof("Serving Prometheus metrics on %s.", *metricsAddr)
+		go func() {
+			glog.Fatal(http.Serve(metricsLn, s.MetricsHandler()))
+		}()
+	}
+
+	stopped := shutdownOnSignal(s)
+	if err := s.Serve(context.Background()); err != server.ErrServerClosed {
+		glog.Fatalf("couldn't serve: %v", err)
+	}
+	<-stopped
+}
+
+// shutdownOnSignal shuts the server down gracefully on SIGINT or SIGTERM.
+// The returned channel is closed once it's done.
+func shutdownOnSignal(s *server.Server) <-chan struct{} {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		sig := <-c
+		glog.Infof("Got %s, shutting down.", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			glog.Errorf("couldn't shut down gracefully: %v", err)
+		}
+	}()
+	return stopped
+}
+
+// readLines reads the non-blank lines of a file, skipping # comments.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
+
+// glogLogger is where the server logs to: glog, so that its flags work as
+// they always have.
+type glogLogger struct{}
+
+func (glogLogger) Infof(format string, args ...interface{}) {
+	glog.InfoDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (glogLogger) Errorf(format string, args ...interface{}) {
+	glog.ErrorDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (glogLogger) Flush() {
+	glog.Flush()
+}
+
+// logToFile sends glog's output to -logFile instead of stderr, and returns a
+// function that flushes and closes it. glog only writes to os.Stderr or its
+// own unrotated files, so os.Stderr is swapped for a pipe into the file.
+func logToFile(clk clock.Clock) (func(), error) {
+	lf, err := server.OpenLogFile(*logFile, server.LogRotation{
+		MaxSize:  *logMaxSize << 20,
+		Every:    *logRotateEvery,
+		Keep:     *logKeep,
+		Compress: *logCompress,
+	}, clk)
+	if err != nil {
+		return nil, err
+	}
+	lf.SetLogger(glogLogger{})
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		lf.Close()
+		return nil, err
+	}
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		io.Copy(lf, r)
+	}()
+
+	os.Stderr = w
+	flag.Set("logtostderr", "true")
+
+	return func() {
+		glog.Flush()
+		w.Close()
+		<-copied
+		lf.Close()
+	}, nil
 }
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "github.com/silversupreme/drops/pkg/server"
+
+// dumpOnSignal does nothing where there's no SIGUSR1.
+func dumpOnSignal(*server.Server) {}
+
+// reloadOnSignal does nothing where there's no SIGHUP.
+func reloadOnSignal(...reloader) {}
@@ -0,0 +1,49 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/silversupreme/drops/pkg/server"
+)
+
+// dumpOnSignal logs a summary of the server's state on every SIGUSR1, for
+// when it looks hung.
+func dumpOnSignal(s *server.Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+
+	go func() {
+		for range c {
+			var buf bytes.Buffer
+			s.WriteSummary(&buf)
+			for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+				glog.Info(line)
+			}
+		}
+	}()
+}
+
+// reloadOnSignal reloads the server's certificates and CRLs on every
+// SIGHUP.
+func reloadOnSignal(reloaders ...reloader) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	go func() {
+		for range c {
+			for _, r := range reloaders {
+				if err := r.Reload(); err != nil {
+					glog.Errorf("couldn't reload on SIGHUP, keeping what was loaded before: %v", err)
+				}
+			}
+			glog.Infof("reloaded certificates on SIGHUP")
+		}
+	}()
+}
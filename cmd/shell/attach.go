@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// attach [uid]
+//
+// Follows a RUN started from this shell until the station finishes it with
+// DONE or ERR. PROGRESS lines are displayed as they arrive. The first Ctrl-C
+// asks the station to CANCEL the run, and a second one detaches without
+// waiting for it.
+func cmdAttach(s *session, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: attach [uid]")
+	}
+	uid := args[0]
+
+	lines := s.watch(uid)
+	defer s.unwatch(uid)
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	fmt.Printf("attached to %s, Ctrl-C to cancel\n", uid)
+
+	cancelled := false
+	for {
+		select {
+		case line := <-lines:
+			parts := strings.Split(line, " ")
+			if len(parts) < 2 {
+				continue
+			}
+
+			switch parts[1] {
+			case "DONE", "ERR":
+				// an ERR to our own CANCEL just means the server didn't
+				// know about the run.
+				return nil
+			}
+		case <-interrupts:
+			if cancelled {
+				fmt.Printf("detached from %s\n", uid)
+				return nil
+			}
+
+			cancelled = true
+			if _, err := fmt.Fprintf(s.conn, "%s CANCEL\n", uid); err != nil {
+				return err
+			}
+			fmt.Printf("cancelling %s, Ctrl-C again to detach\n", uid)
+		}
+	}
+}
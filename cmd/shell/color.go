@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// theme controls how the shell decorates the prompt and server responses.
+type theme struct {
+	prompt         string
+	responsePrefix string
+
+	// SGR parameters (e.g. "1;32") for each element, only used when color
+	// is enabled.
+	promptColor   string
+	responseColor string
+
+	color    bool
+	terminal bool
+}
+
+// isTerminal reports whether f is attached to a character device.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// useColor resolves the -color flag against the environment. NO_COLOR
+// (https://no-color.org) only disables color in auto mode, since an explicit
+// "always" is the user asking for it.
+func useColor(mode string, terminal bool) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		if _, ok := os.LookupEnv("NO_COLOR"); ok {
+			return false, nil
+		}
+		return terminal, nil
+	}
+
+	return false, fmt.Errorf("unknown color mode %q, expected auto, always or never", mode)
+}
+
+func (t *theme) paint(sgr, s string) string {
+	if !t.color || sgr == "" {
+		return s
+	}
+	return "\033[" + sgr + "m" + s + "\033[0m"
+}
+
+// renderPrompt renders the input prompt.
+func (t *theme) renderPrompt() string {
+	return t.paint(t.promptColor, t.prompt)
+}
+
+// renderResponse renders a line received from the server, followed by a fresh
+// prompt. On a terminal this overwrites the prompt that was already drawn,
+// which gives a sane REPL while still showing asynchronous server messages.
+func (t *theme) renderResponse(line string) string {
+	out := t.paint(t.responseColor, t.responsePrefix+line) + "\n" + t.renderPrompt()
+	if t.terminal {
+		return "\r\n\033[1A\r" + out
+	}
+	return out
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	doctorTimeout = 5 * time.Second
+
+	// certificates expiring sooner than this are flagged, so they can be
+	// rotated before devices start dropping off.
+	expiryWarning = 30 * 24 * time.Hour
+)
+
+// diagnosis is the outcome of a single doctor check.
+type diagnosis struct {
+	warning string
+	err     error
+	hint    string
+}
+
+func ok() diagnosis { return diagnosis{} }
+
+func fail(err error, hint string) diagnosis { return diagnosis{err: err, hint: hint} }
+
+// doctor runs through everything needed to talk to a drops server, in the
+// order it happens, and explains the first thing that goes wrong. It returns
+// the process exit code.
+func doctor() int {
+	var (
+		host     string
+		leaf     *x509.Certificate
+		cert     tls.Certificate
+		pool     *x509.CertPool
+		conn     *tls.Conn
+		failures int
+	)
+
+	checks := []struct {
+		name string
+		fn   func() diagnosis
+	}{
+		{"resolve server address", func() diagnosis {
+			var err error
+			host, _, err = net.SplitHostPort(*addr)
+			if err != nil {
+				return fail(err, "-addr must look like host:port, e.g. localhost:19406")
+			}
+
+			if _, err := net.LookupHost(host); err != nil {
+				return fail(err, "check the hostname in -addr and this machine's DNS settings")
+			}
+			return ok()
+		}},
+		{"reach server over TCP", func() diagnosis {
+			c, err := net.DialTimeout("tcp", *addr, doctorTimeout)
+			if err != nil {
+				return fail(err, "is the server running, and is its port open in any firewalls in between?")
+			}
+			c.Close()
+			return ok()
+		}},
+		{"load client certificate", func() diagnosis {
+			var err error
+			cert, err = tls.LoadX509KeyPair(*sslCert, *sslKey)
+			if err != nil {
+				return fail(err, "-sslCert and -sslKey must be a matching PEM certificate and private key")
+			}
+
+			leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return fail(err, "-sslCert does not contain a valid X.509 certificate")
+			}
+			return validity("client certificate "+*sslCert, leaf)
+		}},
+		{"load CA certificate", func() diagnosis {
+			pemBytes, err := ioutil.ReadFile(*caCert)
+			if err != nil {
+				return fail(err, "-caCert must point at the CA bundle the server's certificate was signed with")
+			}
+
+			pool = x509.NewCertPool()
+			var d diagnosis
+			for block, rest := pem.Decode(pemBytes); block != nil; block, rest = pem.Decode(rest) {
+				ca, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return fail(err, "-caCert contains a PEM block that isn't a certificate")
+				}
+				pool.AddCert(ca)
+
+				if v := validity("CA certificate "+ca.Subject.CommonName, ca); v.err != nil || v.warning != "" {
+					d = v
+				}
+			}
+
+			if len(pool.Subjects()) == 0 {
+				return fail(fmt.Errorf("no certificates found in %s", *caCert), "-caCert must be a PEM encoded certificate")
+			}
+			return d
+		}},
+		{"client certificate is signed by the CA", func() diagnosis {
+			_, err := leaf.Verify(x509.VerifyOptions{
+				Roots:     pool,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+			if err != nil {
+				return fail(err, "the server will reject this certificate; re-issue it from the CA in -caCert")
+			}
+			return ok()
+		}},
+		{"TLS handshake", func() diagnosis {
+			var err error
+			conn, err = tls.DialWithDialer(&net.Dialer{Timeout: doctorTimeout}, "tcp", *addr, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				RootCAs:      pool,
+				MinVersion:   tls.VersionTLS12,
+			})
+			if err == nil {
+				return ok()
+			}
+
+			msg := err.Error()
+			switch {
+			case strings.Contains(msg, "unknown authority"):
+				return fail(err, "the server's certificate isn't signed by -caCert; you may be pointed at the wrong server or CA")
+			case strings.Contains(msg, "not valid for"):
+				return fail(err, fmt.Sprintf("the server's certificate doesn't name %q; connect using a name it was issued for", host))
+			case strings.Contains(msg, "bad certificate"), strings.Contains(msg, "unknown certificate"):
+				return fail(err, "the server rejected our client certificate; it was probably issued by a different CA than the server trusts")
+			}
+			return fail(err, "the server accepted the TCP connection but not the TLS session; is something else listening on this port?")
+		}},
+		{"server certificate", func() diagnosis {
+			peers := conn.ConnectionState().PeerCertificates
+			if len(peers) == 0 {
+				return fail(fmt.Errorf("server presented no certificate"), "check the server's -sslCert")
+			}
+			return validity("server certificate "+peers[0].Subject.CommonName, peers[0])
+		}},
+		{"protocol handshake", func() diagnosis {
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(doctorTimeout))
+			if _, err := fmt.Fprintf(conn, "doctor LIST\n"); err != nil {
+				return fail(err, "the connection dropped right after the handshake; check the server logs")
+			}
+
+			return handshake(bufio.NewReader(conn))
+		}},
+	}
+
+	for _, c := range checks {
+		d := c.fn()
+		switch {
+		case d.err != nil:
+			fmt.Printf("FAIL  %s: %v\n      %s\n", c.name, d.err, d.hint)
+			failures++
+		case d.warning != "":
+			fmt.Printf("WARN  %s: %s\n", c.name, d.warning)
+		default:
+			fmt.Printf("ok    %s\n", c.name)
+		}
+
+		// every check relies on the ones before it.
+		if d.err != nil {
+			break
+		}
+	}
+
+	if failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+// handshake checks the server answers the doctor's LIST like a drops server,
+// past the banner it may send first.
+func handshake(r *bufio.Reader) diagnosis {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fail(err, "the server didn't answer LIST; check the server logs")
+		}
+
+		switch {
+		case strings.HasPrefix(line, "motd MOTD"):
+			continue
+		case !strings.HasPrefix(line, "doctor LIST"):
+			return fail(fmt.Errorf("unexpected response %q", strings.TrimSpace(line)), "this doesn't look like a drops server")
+		}
+		return ok()
+	}
+}
+
+// validity checks that a certificate is within its validity window, and
+// warns when it's about to leave it.
+func validity(what string, cert *x509.Certificate) diagnosis {
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		return fail(fmt.Errorf("%s is not valid until %s", what, cert.NotBefore.Format(time.RFC3339)),
+			"check this machine's clock, or wait for the certificate to become valid")
+	case now.After(cert.NotAfter):
+		return fail(fmt.Errorf("%s expired on %s", what, cert.NotAfter.Format(time.RFC3339)),
+			"issue a new certificate")
+	case cert.NotAfter.Sub(now) < expiryWarning:
+		return diagnosis{warning: fmt.Sprintf("%s expires on %s", what, cert.NotAfter.Format(time.RFC3339))}
+	}
+	return ok()
+}
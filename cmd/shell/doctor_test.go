@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	"github.com/silversupreme/drops/pkg/server"
+)
+
+func TestHandshake(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(listener, 4, clock.NewMock(), server.WithBanner("environment: staging"))
+	go s.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the banner comes before LIST's answer.
+	fmt.Fprintf(conn, "doctor LIST\n")
+	if d := handshake(bufio.NewReader(conn)); d.err != nil {
+		t.Fatalf("expected a server with a banner to pass, got %v", d.err)
+	}
+
+	if d := handshake(bufio.NewReader(strings.NewReader("HTTP/1.1 400 Bad Request\r\n"))); d.err == nil {
+		t.Fatal("expected something other than a drops server to fail")
+	}
+}
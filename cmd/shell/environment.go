@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/silversupreme/drops/pkg/client"
+)
+
+// hello asks the server which environment it's in, returning "" if it
+// doesn't say or doesn't answer in time.
+func hello(s *session) string {
+	envs := make(chan string, 1)
+	err := s.send(func(line string) string {
+		// shellN HELLO [environment]
+		parts := strings.Split(line, " ")
+		if len(parts) == 3 && parts[1] == "HELLO" && parts[2] != "-" {
+			envs <- parts[2]
+		} else {
+			envs <- ""
+		}
+		return ""
+	}, "HELLO")
+	if err != nil {
+		return ""
+	}
+
+	select {
+	case env := <-envs:
+		return env
+	case <-time.After(5 * time.Second):
+		return ""
+	}
+}
+
+// checkRun refuses input that would RUN a function in an environment the
+// shell wasn't cleared for with -allowProd or -environment.
+func (s *session) checkRun(input string) error {
+	fields := strings.Fields(input)
+	if len(fields) < 2 || fields[1] != "RUN" {
+		return nil
+	}
+
+	switch {
+	case *environment != "":
+		if s.environment != *environment {
+			return fmt.Errorf("refusing to RUN: server is in %q, not %q", s.environment, *environment)
+		}
+	case client.IsProd(s.environment) && !*allowProd:
+		return fmt.Errorf("refusing to RUN in %s without -allowProd", s.environment)
+	}
+	return nil
+}
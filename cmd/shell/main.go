@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/golang/glog"
 )
@@ -19,11 +20,57 @@ var (
 	caCert  = flag.String("caCert", "ca.crt", "Only clients signed with this CA will be accepted")
 	sslCert = flag.String("sslCert", "server.crt", "SSL certificate to present to clients")
 	sslKey  = flag.String("sslKey", "server.key", "SSL private key to load")
+
+	// output options
+	limit = flag.Int("limit", 0, "only display the first N items of long responses (0 for all)")
+	tail  = flag.Int("tail", 0, "only display the last N items of long responses (0 for all)")
+	pager = flag.String("pager", defaultPager(), "pager used by `more` to view truncated responses")
+
+	// display options
+	colorMode      = flag.String("color", "auto", "colorize output: auto, always or never (auto honors NO_COLOR)")
+	prompt         = flag.String("prompt", "> ", "input prompt")
+	responsePrefix = flag.String("responsePrefix", "< ", "prefix for lines received from the server")
+	promptColor    = flag.String("promptColor", "", "SGR color parameters for the prompt, e.g. 1;34")
+	responseColor  = flag.String("responseColor", "1;32", "SGR color parameters for server responses")
+
+	transcriptFile = flag.String("transcript", "", "append a timestamped transcript of the session to this file")
+
+	// safety options
+	allowProd   = flag.Bool("allowProd", false, "allow RUN on servers in prod")
+	environment = flag.String("environment", "", "only allow RUN on servers in this environment")
 )
 
+func defaultPager() string {
+	if p := os.Getenv("PAGER"); p != "" {
+		return p
+	}
+	return "less"
+}
+
 func main() {
 	flag.Parse()
 
+	// `shell doctor` diagnoses connection problems instead of starting a REPL.
+	if flag.Arg(0) == "doctor" {
+		os.Exit(doctor())
+	}
+
+	terminal := isTerminal(os.Stdout)
+	color, err := useColor(*colorMode, terminal)
+	if err != nil {
+		glog.Fatalf("bad -color flag: %v", err)
+	}
+
+	t := &theme{
+		prompt:         *prompt,
+		responsePrefix: *responsePrefix,
+		promptColor:    *promptColor,
+		responseColor:  *responseColor,
+
+		color:    color,
+		terminal: terminal,
+	}
+
 	// setup the ssl socket
 	// Load the certificates from disk
 	certificate, err := tls.LoadX509KeyPair(*sslCert, *sslKey)
@@ -58,9 +105,22 @@ func main() {
 	}
 	defer conn.Close()
 
+	var record *transcript
+	if *transcriptFile != "" {
+		f, err := os.OpenFile(*transcriptFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			glog.Fatalf("couldn't open transcript: %v", err)
+		}
+		defer f.Close()
+
+		record = &transcript{w: f}
+	}
+
 	stdinReader := bufio.NewReader(os.Stdin)
 	connReader := bufio.NewReader(conn)
 
+	s := newSession(conn, t)
+
 	go func() {
 		for {
 			output, err := connReader.ReadString('\n')
@@ -68,22 +128,30 @@ func main() {
 				glog.Fatalf("couldn't read from conn: %v", err)
 			}
 
-			// this very complicated string here gives us a sane interaction
-			// REPL pattern while still allowing us to asynchronously
-			// receive information from the server and have it displayed.
-			//
+			output = strings.TrimRight(output, "\n")
+			record.record("<", output)
+
 			// it's still a work in progress, since it needs to adequately
 			// preserve the already-typed text from the user.
-			os.Stdout.Write([]byte("\r\n\033[1A\r\033[1;32m< " + output + "\033[0m> "))
+			if out := s.format(output); out != "" {
+				os.Stdout.Write([]byte(t.renderResponse(out)))
+			}
 		}
 	}()
 
+	// the prompt shows which environment the server is in, so prod is hard
+	// to mistake for anything else.
+	s.environment = hello(s)
+	if s.environment != "" {
+		t.prompt = "[" + s.environment + "] " + t.prompt
+	}
+
 	// TODO(silversupreme): lock the display if the user is typing
 	// so that async messages received from the server don't overwrite
 	// the display the user is seeing and confusing them.
 
 	for {
-		fmt.Printf("> ")
+		fmt.Print(t.renderPrompt())
 
 		// interactive REPL for drops commands
 		output, err := stdinReader.ReadString('\n')
@@ -91,6 +159,22 @@ func main() {
 			glog.Fatalf("couldn't read from conn: %v", err)
 		}
 
-		fmt.Fprintf(conn, output)
+		record.record(">", strings.TrimRight(output, "\n"))
+
+		// some commands are handled by the shell itself.
+		handled, err := s.local(output)
+		if err != nil {
+			fmt.Println(err)
+		}
+		if handled {
+			continue
+		}
+
+		if err := s.checkRun(output); err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		fmt.Fprint(conn, output)
 	}
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	mapWidth  = 60
+	mapHeight = 20
+)
+
+type located struct {
+	name     string
+	lat, lon float64
+}
+
+// map
+//
+// Draws every station with a known location on a grid, north up. The
+// station list comes from LIST, and each station's location from INFO.
+func cmdMap(s *session, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: map")
+	}
+
+	return s.send(func(line string) string {
+		parts := strings.Split(line, " ")
+		if len(parts) < 2 || parts[1] != "LIST" {
+			return line
+		}
+
+		names := []string{}
+		for _, item := range parts[2:] {
+			names = append(names, strings.SplitN(item, ":", 2)[0])
+		}
+		if len(names) == 0 {
+			return "no stations registered"
+		}
+
+		var (
+			stations []located
+			missing  []string
+			waiting  = len(names)
+		)
+		for _, name := range names {
+			name := name
+			err := s.send(func(line string) string {
+				waiting--
+
+				if l, ok := parseInfoLocation(line); ok {
+					l.name = name
+					stations = append(stations, l)
+				} else {
+					missing = append(missing, name)
+				}
+
+				if waiting > 0 {
+					return ""
+				}
+				return renderMap(stations, missing)
+			}, "INFO %s", name)
+			if err != nil {
+				return fmt.Sprintf("couldn't request station info: %v", err)
+			}
+		}
+
+		return ""
+	}, "LIST")
+}
+
+// parseInfoLocation pulls location=[lat],[lon] out of an INFO response.
+func parseInfoLocation(line string) (located, bool) {
+	for _, field := range strings.Fields(line) {
+		if !strings.HasPrefix(field, "location=") {
+			continue
+		}
+
+		parts := strings.Split(strings.TrimPrefix(field, "location="), ",")
+		if len(parts) != 2 {
+			return located{}, false
+		}
+
+		lat, err1 := strconv.ParseFloat(parts[0], 64)
+		lon, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil {
+			return located{}, false
+		}
+		return located{lat: lat, lon: lon}, true
+	}
+
+	return located{}, false
+}
+
+// renderMap plots stations on a grid, labelling each with a letter that's
+// explained in the legend below it.
+func renderMap(stations []located, missing []string) string {
+	sort.Slice(stations, func(i, j int) bool { return stations[i].name < stations[j].name })
+	sort.Strings(missing)
+
+	buf := &bytes.Buffer{}
+	if len(stations) > 0 {
+		minLat, maxLat := math.Inf(1), math.Inf(-1)
+		minLon, maxLon := math.Inf(1), math.Inf(-1)
+		for _, st := range stations {
+			minLat, maxLat = math.Min(minLat, st.lat), math.Max(maxLat, st.lat)
+			minLon, maxLon = math.Min(minLon, st.lon), math.Max(maxLon, st.lon)
+		}
+
+		grid := make([][]byte, mapHeight)
+		for row := range grid {
+			grid[row] = bytes.Repeat([]byte("."), mapWidth)
+		}
+
+		for i, st := range stations {
+			col, row := mapWidth/2, mapHeight/2
+			if maxLon > minLon {
+				col = int(math.Round((st.lon - minLon) / (maxLon - minLon) * (mapWidth - 1)))
+			}
+			if maxLat > minLat {
+				row = int(math.Round((maxLat - st.lat) / (maxLat - minLat) * (mapHeight - 1)))
+			}
+
+			label := byte('?')
+			if i < 26 {
+				label = byte('a' + i)
+			}
+			// overlapping stations are marked, since only one label fits.
+			if grid[row][col] != '.' {
+				label = '*'
+			}
+			grid[row][col] = label
+		}
+
+		buf.WriteString(fmt.Sprintf("%.4f,%.4f\n", maxLat, minLon))
+		for _, row := range grid {
+			buf.Write(row)
+			buf.WriteString("\n")
+		}
+		buf.WriteString(fmt.Sprintf("%*s\n", mapWidth, fmt.Sprintf("%.4f,%.4f", minLat, maxLon)))
+
+		for i, st := range stations {
+			label := "?"
+			if i < 26 {
+				label = string(rune('a' + i))
+			}
+			buf.WriteString(fmt.Sprintf("%s  %s (%.4f,%.4f)\n", label, st.name, st.lat, st.lon))
+		}
+	}
+
+	if len(missing) > 0 {
+		buf.WriteString(fmt.Sprintf("no location: %s\n", strings.Join(missing, " ")))
+	}
+
+	return strings.TrimRight(buf.String(), "\n")
+}
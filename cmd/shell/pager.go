@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// pagedResponse remembers the last response that was too long to display
+// inline, so the user can bring it up in their pager with `more`.
+type pagedResponse struct {
+	m    sync.Mutex
+	line string
+}
+
+func (p *pagedResponse) set(line string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.line = line
+}
+
+func (p *pagedResponse) get() string {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return p.line
+}
+
+// headerLen reports how many leading tokens of a response are the header
+// (uid, command and arguments), as opposed to the list of items after it.
+func headerLen(parts []string) int {
+	if len(parts) < 2 {
+		return len(parts)
+	}
+
+	switch parts[1] {
+	case "LIST":
+		return 2
+	case "METRICS":
+		// METRICS [name] [metric] ... vs. METRICS [name] [metric] [ts]:[value] ...
+		if len(parts) > 4 && strings.Contains(parts[4], ":") {
+			return 4
+		}
+		return 3
+	}
+
+	return len(parts)
+}
+
+// truncate trims the items of a long response down to the first `limit` or
+// the last `tail` of them. It returns the line to display and the number of
+// items that were hidden.
+func truncate(line string, limit, tail int) (string, int) {
+	parts := strings.Split(line, " ")
+	h := headerLen(parts)
+	header, items := parts[:h], parts[h:]
+
+	hidden := 0
+	switch {
+	case tail > 0 && len(items) > tail:
+		hidden = len(items) - tail
+		items = items[hidden:]
+	case limit > 0 && len(items) > limit:
+		hidden = len(items) - limit
+		items = items[:limit]
+	}
+
+	return strings.Join(append(header, items...), " "), hidden
+}
+
+// page shows a response in the user's pager, one item per line.
+func page(pager, line string) error {
+	parts := strings.Split(line, " ")
+	h := headerLen(parts)
+
+	text := strings.Join(parts[:h], " ") + "\n" + strings.Join(parts[h:], "\n") + "\n"
+
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
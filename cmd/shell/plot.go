@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type point struct {
+	ts    time.Time
+	value float64
+}
+
+// parsePoints reads the [ts]:[value] items of a METRICS response.
+func parsePoints(items []string) ([]point, error) {
+	points := make([]point, 0, len(items))
+	for _, item := range items {
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad data point %q", item)
+		}
+
+		ts, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad timestamp in %q: %v", item, err)
+		}
+
+		value, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad value in %q: %v", item, err)
+		}
+
+		points = append(points, point{ts: time.Unix(ts, 0), value: value})
+	}
+
+	return points, nil
+}
+
+// plot [station] [metric] [--window 1h] [--width 60] [--height 10]
+func cmdPlot(s *session, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: plot [station] [metric] [--window 1h] [--width 60] [--height 10]")
+	}
+
+	station, metric := args[0], args[1]
+
+	fs := flag.NewFlagSet("plot", flag.ContinueOnError)
+	window := fs.Duration("window", 0, "only plot points this recent (0 for all)")
+	width := fs.Int("width", 60, "chart width in columns")
+	height := fs.Int("height", 10, "chart height in rows")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+
+	if *width < 1 || *height < 2 {
+		return fmt.Errorf("chart must be at least 1 column wide and 2 rows high")
+	}
+
+	return s.send(func(line string) string {
+		parts := strings.Split(line, " ")
+		if len(parts) < 2 || parts[1] != "METRICS" {
+			return line
+		}
+
+		points, err := parsePoints(parts[headerLen(parts):])
+		if err != nil {
+			return fmt.Sprintf("couldn't plot %s %s: %v", station, metric, err)
+		}
+
+		// the window is measured back from the newest point rather than
+		// from our own clock, so skew between us and the server doesn't
+		// empty the chart.
+		if *window > 0 && len(points) > 0 {
+			cutoff := points[len(points)-1].ts.Add(-*window)
+			for len(points) > 0 && points[0].ts.Before(cutoff) {
+				points = points[1:]
+			}
+		}
+
+		return renderPlot(fmt.Sprintf("%s %s", station, metric), points, *width, *height)
+	}, "METRICS %s %s", station, metric)
+}
+
+// renderPlot draws points as an ASCII chart. Points are bucketed by time
+// into columns, and each column shows the average of its bucket.
+func renderPlot(title string, points []point, width, height int) string {
+	if len(points) == 0 {
+		return fmt.Sprintf("%s: no data points", title)
+	}
+
+	start, end := points[0].ts, points[len(points)-1].ts
+	span := end.Sub(start)
+	if len(points) < width {
+		width = len(points)
+	}
+
+	sums := make([]float64, width)
+	counts := make([]int, width)
+	for _, p := range points {
+		col := 0
+		if span > 0 {
+			col = int(float64(p.ts.Sub(start)) / float64(span) * float64(width-1))
+		}
+		sums[col] += p.value
+		counts[col]++
+	}
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for col := range sums {
+		if counts[col] == 0 {
+			continue
+		}
+		sums[col] /= float64(counts[col])
+		lo, hi = math.Min(lo, sums[col]), math.Max(hi, sums[col])
+	}
+
+	rows := make([][]byte, height)
+	for row := range rows {
+		rows[row] = bytes.Repeat([]byte(" "), width)
+	}
+	for col := range sums {
+		if counts[col] == 0 {
+			continue
+		}
+
+		row := 0
+		if hi > lo {
+			row = int(math.Round((sums[col] - lo) / (hi - lo) * float64(height-1)))
+		}
+		rows[height-1-row][col] = '*'
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf("%s (%d points, %s to %s)\n",
+		title, len(points), start.Format(time.Kitchen), end.Format(time.Kitchen)))
+
+	labelWidth := len(fmt.Sprintf("%.2f", hi))
+	if l := len(fmt.Sprintf("%.2f", lo)); l > labelWidth {
+		labelWidth = l
+	}
+
+	for row := range rows {
+		label := ""
+		switch row {
+		case 0:
+			label = fmt.Sprintf("%.2f", hi)
+		case height - 1:
+			label = fmt.Sprintf("%.2f", lo)
+		}
+		buf.WriteString(fmt.Sprintf("%*s |%s\n", labelWidth, label, rows[row]))
+	}
+	buf.WriteString(fmt.Sprintf("%*s +%s", labelWidth, "", strings.Repeat("-", width)))
+
+	return buf.String()
+}
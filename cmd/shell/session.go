@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// localCmd is a command implemented by the shell itself rather than sent
+// to the server as-is.
+type localCmd func(s *session, args []string) error
+
+var localCmds = map[string]localCmd{
+	"attach": cmdAttach,
+	"map":    cmdMap,
+	"more":   cmdMore,
+	"plot":   cmdPlot,
+}
+
+// responseFunc turns a server response into what should be displayed. An
+// empty string displays nothing.
+type responseFunc func(line string) string
+
+// session holds the state shared between the REPL and the goroutine reading
+// from the server connection.
+type session struct {
+	conn  io.Writer
+	t     *theme
+	paged pagedResponse
+
+	// the environment the server says it's in, if any.
+	environment string
+
+	m       sync.Mutex
+	seq     int
+	pending map[string]responseFunc
+	watches map[string]chan string
+}
+
+func newSession(conn io.Writer, t *theme) *session {
+	return &session{
+		conn: conn,
+		t:    t,
+
+		pending: map[string]responseFunc{},
+		watches: map[string]chan string{},
+	}
+}
+
+// send issues a command to the server under a shell-generated uid, and
+// arranges for fn to format the response to it.
+func (s *session) send(fn responseFunc, format string, args ...interface{}) error {
+	s.m.Lock()
+	s.seq++
+	uid := fmt.Sprintf("shell%d", s.seq)
+	s.pending[uid] = fn
+	s.m.Unlock()
+
+	_, err := fmt.Fprintf(s.conn, "%s %s\n", uid, fmt.Sprintf(format, args...))
+	return err
+}
+
+// format renders a line received from the server. Responses to commands
+// issued by local commands are handed to their responseFunc; everything else
+// is displayed (and possibly truncated) as-is.
+func (s *session) format(line string) string {
+	uid := strings.SplitN(line, " ", 2)[0]
+
+	// the server's banner, like which environment it is, stands out.
+	if uid == "motd" {
+		return "*** " + strings.TrimPrefix(line, "motd MOTD ")
+	}
+
+	s.m.Lock()
+	fn, ok := s.pending[uid]
+	delete(s.pending, uid)
+	if w, watched := s.watches[uid]; watched {
+		select {
+		case w <- line:
+		default:
+		}
+	}
+	s.m.Unlock()
+
+	if ok {
+		return fn(line)
+	}
+
+	// long responses (METRICS on a long history, mostly) are cut
+	// down so they don't flood the terminal. the full text can be
+	// viewed with `more`.
+	out, hidden := truncate(line, *limit, *tail)
+	if hidden > 0 {
+		s.paged.set(line)
+		out += fmt.Sprintf(" ... (%d more, type `more` to page)", hidden)
+	}
+	return out
+}
+
+// watch delivers every line received for uid on the returned channel, until
+// unwatch is called.
+func (s *session) watch(uid string) <-chan string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	w := make(chan string, 16)
+	s.watches[uid] = w
+	return w
+}
+
+func (s *session) unwatch(uid string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.watches, uid)
+}
+
+// local runs input as a local command, if it names one.
+func (s *session) local(input string) (bool, error) {
+	fields := strings.Fields(input)
+	if len(fields) == 0 {
+		return false, nil
+	}
+
+	fn, ok := localCmds[fields[0]]
+	if !ok {
+		return false, nil
+	}
+
+	return true, fn(s, fields[1:])
+}
+
+// more shows the last truncated response in the pager.
+func cmdMore(s *session, args []string) error {
+	last := s.paged.get()
+	if last == "" {
+		return fmt.Errorf("nothing to page")
+	}
+
+	return page(*pager, last)
+}
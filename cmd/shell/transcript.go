@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// transcript records a timestamped log of everything sent to and received
+// from the server, so a session can be attached to an incident ticket.
+type transcript struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+// record writes a single line to the transcript. dir is ">" for input typed
+// by the user and "<" for lines received from the server. A nil transcript
+// records nothing.
+func (t *transcript) record(dir, line string) {
+	if t == nil {
+		return
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	fmt.Fprintf(t.w, "%s %s %s\n", time.Now().UTC().Format(time.RFC3339Nano), dir, line)
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRunFailed is returned when a station reports that a run didn't
+// complete.
+var ErrRunFailed = errors.New("run failed")
+
+// Station is a station online on the server.
+type Station struct {
+	Name string
+	Type string
+	// Health is the station's health score, out of 100.
+	Health int
+	// Deviating is set if the station is out of line with its type.
+	Deviating bool
+	// Outdated is set if the station runs older firmware than the latest
+	// for its type.
+	Outdated bool
+}
+
+// List returns the stations online on the server.
+func (c *Client) List(ctx context.Context) ([]Station, error) {
+	resp, err := c.do(ctx, "LIST")
+	if err != nil {
+		return nil, err
+	}
+
+	// LIST [name]:[type][!][^]:[health] ...
+	fields := strings.Split(resp, " ")
+	if fields[0] != "LIST" {
+		return nil, errors.Wrapf(ErrMalformed, "unexpected response %q", resp)
+	}
+
+	stations := make([]Station, 0, len(fields)-1)
+	for _, token := range fields[1:] {
+		parts := strings.Split(token, ":")
+		if len(parts) != 3 {
+			return nil, errors.Wrapf(ErrMalformed, "station %q is not [name]:[type]:[health]", token)
+		}
+
+		health, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, errors.Wrapf(ErrMalformed, "bad health in station %q", token)
+		}
+		tipe := parts[1]
+		outdated := strings.HasSuffix(tipe, "^")
+		tipe = strings.TrimSuffix(tipe, "^")
+		deviating := strings.HasSuffix(tipe, "!")
+		tipe = strings.TrimSuffix(tipe, "!")
+
+		stations = append(stations, Station{
+			Name:      parts[0],
+			Type:      tipe,
+			Health:    health,
+			Deviating: deviating,
+			Outdated:  outdated,
+		})
+	}
+	return stations, nil
+}
+
+// Metrics returns the points the server kept of a station's metric, oldest
+// first. Modifiers like "from=1h" or "unit=C" are passed along to the server
+// as is. A response that isn't a list of [ts]:[value] points, oldest first,
+// for the station and metric asked about fails with ErrMalformed.
+func (c *Client) Metrics(ctx context.Context, station, metric string, modifiers ...string) ([]Point, error) {
+	line := strings.Join(append([]string{"METRICS", station, metric}, modifiers...), " ")
+	resp, err := c.do(ctx, line)
+	if err != nil {
+		return nil, err
+	}
+
+	// METRICS [station] [metric] [ts]:[value] ...
+	fields := strings.Split(resp, " ")
+	if len(fields) < 3 || fields[0] != "METRICS" || fields[1] != station || fields[2] != metric {
+		return nil, errors.Wrapf(ErrMalformed, "unexpected response %q", resp)
+	}
+
+	points := make([]Point, 0, len(fields)-3)
+	for _, token := range fields[3:] {
+		p, err := parsePoint(station, metric, token)
+		if err != nil {
+			return nil, errors.Wrap(ErrMalformed, err.Error())
+		}
+		if n := len(points); n > 0 && p.Ts.Before(points[n-1].Ts) {
+			return nil, errors.Wrapf(ErrMalformed, "point %q is older than the one before it", token)
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+// Run runs a function on a station, and returns its result once the station
+// is done. If ctx is done first, the run is cancelled. Progress the station
+// reports along the way is passed to progress, if it isn't nil.
+//
+// Unless the client was given AllowProd, Run first checks the server isn't
+// in prod, or, if given WithEnvironment, that it's in the environment
+// expected, and fails with ErrEnvironment otherwise.
+func (c *Client) Run(ctx context.Context, station, fn, param string, progress func(string)) (string, error) {
+	if err := c.checkEnvironment(ctx); err != nil {
+		return "", err
+	}
+
+	line := fmt.Sprintf("RUN %s %s", station, fn)
+	if param != "" {
+		line += " " + param
+	}
+
+	conn, err := c.shared(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	uid := c.uid()
+	call, err := conn.send(uid, line)
+	if err != nil {
+		return "", err
+	}
+	defer conn.end(uid)
+
+	resp, err := conn.next(ctx, uid, call)
+	if err != nil {
+		return "", err
+	}
+	if rejected(resp) {
+		return "", errors.Wrap(ErrRejected, line)
+	}
+	if resp != "ACK" {
+		return "", errors.Wrapf(ErrMalformed, "unexpected response %q", resp)
+	}
+
+	for {
+		resp, err := conn.next(ctx, uid, call)
+		if ctx.Err() != nil {
+			// the station is told, but there's no waiting to hear back.
+			conn.write(uid, "CANCEL")
+			return "", ctx.Err()
+		}
+		if err != nil {
+			return "", err
+		}
+
+		verb, rest, _ := strings.Cut(resp, " ")
+		switch verb {
+		case "PROGRESS":
+			if progress != nil {
+				progress(rest)
+			}
+		case "DONE":
+			return rest, nil
+		case "ERR":
+			return "", errors.Wrapf(ErrRunFailed, "%s on %s: %s", fn, station, rest)
+		default:
+			return "", errors.Wrapf(ErrMalformed, "unexpected response %q", resp)
+		}
+	}
+}
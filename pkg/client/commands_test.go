@@ -0,0 +1,269 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// runner registers a station that answers runs of echo with their
+// parameter, after a little while so that runs overlap, and passes every
+// other line it gets to lines.
+func runner(t *testing.T, addr, name string, lines chan<- string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "1 REGISTER %s source\n2 METRIC level 1\n", name)
+	for _, want := range []string{"1 ACK\n", "2 ACK\n"} {
+		if resp, err := reader.ReadString('\n'); err != nil || resp != want {
+			t.Fatalf("setting up %s: got %q, %v", name, resp, err)
+		}
+	}
+
+	var writeM sync.Mutex
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			// [uid] RUN echo [param]
+			fields := strings.Fields(line)
+			if len(fields) != 4 || fields[1] != "RUN" || fields[2] != "echo" {
+				if lines != nil {
+					lines <- strings.TrimSpace(line)
+				}
+				continue
+			}
+			go func() {
+				time.Sleep(time.Millisecond)
+				writeM.Lock()
+				defer writeM.Unlock()
+				fmt.Fprintf(conn, "%s PROGRESS half\n%s DONE %s\n", fields[0], fields[0], fields[3])
+			}()
+		}
+	}()
+}
+
+func TestConcurrentCommands(t *testing.T) {
+	addr := serve(t)
+	runner(t, addr, "water", nil)
+
+	c := New(addr, nil)
+	defer c.Close()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 60)
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			param := fmt.Sprintf("p%d", i)
+			progressed := false
+			result, err := c.Run(ctx, "water", "echo", param, func(p string) { progressed = p == "half" })
+			switch {
+			case err != nil:
+				errs <- err
+			case result != param || !progressed:
+				errs <- errors.Errorf("run %d: got %q, progress %t", i, result, progressed)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			stations, err := c.List(ctx)
+			switch {
+			case err != nil:
+				errs <- err
+			case len(stations) != 1 || stations[0].Name != "water" || stations[0].Type != "source":
+				errs <- errors.Errorf("unexpected stations %+v", stations)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			points, err := c.Metrics(ctx, "water", "level")
+			switch {
+			case err != nil:
+				errs <- err
+			case len(points) != 1 || points[0].Value != 1:
+				errs <- errors.Errorf("unexpected points %+v", points)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCommandRejected(t *testing.T) {
+	addr := serve(t)
+
+	c := New(addr, nil)
+	defer c.Close()
+	ctx := context.Background()
+
+	if _, err := c.Metrics(ctx, "ghost", "level"); errors.Cause(err) != ErrRejected {
+		t.Fatalf("expected ErrRejected, got %v", err)
+	}
+	if _, err := c.Run(ctx, "ghost", "echo", "", nil); errors.Cause(err) != ErrRejected {
+		t.Fatalf("expected ErrRejected, got %v", err)
+	}
+
+	// the connection is still good afterwards.
+	if _, err := c.List(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	addr := serve(t)
+	lines := make(chan string, 10)
+	runner(t, addr, "water", lines)
+
+	c := New(addr, nil)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := c.Run(ctx, "water", "sleep", "", nil)
+		done <- err
+	}()
+
+	expect := func(want string) {
+		select {
+		case line := <-lines:
+			if !strings.HasSuffix(line, " "+want) {
+				t.Fatalf("expected %s, got %q", want, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+
+	// the station gets the run, and then its cancellation.
+	expect("RUN sleep")
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected the run to be cancelled, got %v", err)
+	}
+	expect("CANCEL")
+}
+
+func TestCommandsReconnect(t *testing.T) {
+	addr := serve(t)
+	runner(t, addr, "water", nil)
+
+	p, proxied := newProxy(t, addr)
+	c := New(proxied, nil)
+	defer c.Close()
+	ctx := context.Background()
+
+	if _, err := c.List(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a command waiting when the connection drops fails, and the next one
+	// connects again.
+	done := make(chan error)
+	go func() {
+		_, err := c.Run(ctx, "water", "sleep", "", nil)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.cut(false)
+	if err := <-done; err == nil {
+		t.Fatalf("expected the run to fail")
+	}
+
+	if _, err := c.List(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fake answers every command with resp, as a misbehaving server would.
+func fake(t *testing.T, resp string) string {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					uid, _, _ := strings.Cut(scanner.Text(), " ")
+					fmt.Fprintf(conn, "%s %s\n", uid, resp)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestMetrics(t *testing.T) {
+	c := New(fake(t, "METRICS water level 60:1.5 120:-2 120:3e2"), nil)
+	defer c.Close()
+
+	points, err := c.Metrics(context.Background(), "water", "level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Point{
+		{Station: "water", Metric: "level", Ts: time.Unix(60, 0), Value: 1.5},
+		{Station: "water", Metric: "level", Ts: time.Unix(120, 0), Value: -2},
+		{Station: "water", Metric: "level", Ts: time.Unix(120, 0), Value: 300},
+	}
+	if len(points) != len(want) {
+		t.Fatalf("expected %d points, got %+v", len(want), points)
+	}
+	for i := range want {
+		if points[i] != want[i] {
+			t.Fatalf("point %d: expected %+v, got %+v", i, want[i], points[i])
+		}
+	}
+}
+
+func TestMetricsMalformed(t *testing.T) {
+	for _, resp := range []string{
+		"METRICS water level 60",
+		"METRICS water level 60:1:2",
+		"METRICS water level soon:1",
+		"METRICS water level 60:lots",
+		"METRICS water level 60:1e999",
+		"METRICS water level 120:1 60:2",
+		"METRICS air level 60:1",
+		"METRICS water",
+		"ACK",
+	} {
+		c := New(fake(t, resp), nil)
+		_, err := c.Metrics(context.Background(), "water", "level")
+		if errors.Cause(err) != ErrMalformed {
+			t.Errorf("%q: expected ErrMalformed, got %v", resp, err)
+		}
+		c.Close()
+	}
+}
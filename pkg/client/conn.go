@@ -0,0 +1,216 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// errClosed is the cause of errors about commands whose connection went away
+// before they were answered.
+var errClosed = errors.New("connection closed")
+
+// conn is a connection commands share. Responses are matched up with their
+// commands by uid, so any number of goroutines can have commands in flight
+// on it at once.
+type conn struct {
+	nc net.Conn
+
+	// held to write a command, so commands aren't interleaved.
+	writeM sync.Mutex
+
+	m     sync.Mutex
+	calls map[string]*call
+	// why the connection is done, once it is.
+	err error
+
+	closed chan struct{}
+}
+
+// call is a command waiting on its responses.
+type call struct {
+	lines chan string
+	// closed once nothing's waiting on the call anymore.
+	done chan struct{}
+}
+
+func newConn(nc net.Conn) *conn {
+	c := &conn{
+		nc:     nc,
+		calls:  map[string]*call{},
+		closed: make(chan struct{}),
+	}
+	go c.read()
+	return c
+}
+
+// read hands each line to the call it's for, until the connection drops.
+// Lines no call is waiting on, like responses to abandoned commands, are
+// dropped.
+func (c *conn) read() {
+	scanner := bufio.NewScanner(c.nc)
+	for scanner.Scan() {
+		line := scanner.Text()
+		uid, _, _ := strings.Cut(line, " ")
+
+		c.m.Lock()
+		call, ok := c.calls[uid]
+		c.m.Unlock()
+		if !ok {
+			continue
+		}
+
+		select {
+		case call.lines <- line:
+		case <-call.done:
+		}
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = errClosed
+	}
+	c.close(err)
+}
+
+// close closes the connection, failing the calls on it with err.
+func (c *conn) close(err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.nc.Close()
+	close(c.closed)
+}
+
+// failed returns why the connection is done, or nil if it isn't.
+func (c *conn) failed() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.err
+}
+
+// send sends a command under uid, and returns the call its responses come
+// to. The call must be ended once done with.
+func (c *conn) send(uid, line string) (*call, error) {
+	call := &call{lines: make(chan string), done: make(chan struct{})}
+
+	c.m.Lock()
+	if c.err != nil {
+		c.m.Unlock()
+		return nil, c.err
+	}
+	c.calls[uid] = call
+	c.m.Unlock()
+
+	if err := c.write(uid, line); err != nil {
+		c.end(uid)
+		return nil, err
+	}
+	return call, nil
+}
+
+// write sends a command under uid without waiting on a response.
+func (c *conn) write(uid, line string) error {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+
+	if _, err := fmt.Fprintf(c.nc, "%s %s\n", uid, line); err != nil {
+		c.close(err)
+		return err
+	}
+	return nil
+}
+
+// next waits for the call's next response, without its uid.
+func (c *conn) next(ctx context.Context, uid string, call *call) (string, error) {
+	select {
+	case line := <-call.lines:
+		return strings.TrimPrefix(line, uid+" "), nil
+	case <-c.closed:
+		return "", errors.Wrap(c.failed(), "waiting for a response")
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// end stops waiting on uid's responses.
+func (c *conn) end(uid string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if call, ok := c.calls[uid]; ok {
+		close(call.done)
+		delete(c.calls, uid)
+	}
+}
+
+// shared returns the connection commands share, connecting if there isn't
+// one or it has dropped.
+func (c *Client) shared(ctx context.Context) (*conn, error) {
+	c.connM.Lock()
+	defer c.connM.Unlock()
+
+	if c.conn != nil && c.conn.failed() == nil {
+		return c.conn, nil
+	}
+
+	nc, err := c.Dial(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting")
+	}
+	c.conn = newConn(nc)
+	return c.conn, nil
+}
+
+// do sends a command answered with a single response, and returns the
+// response without its uid.
+func (c *Client) do(ctx context.Context, line string) (string, error) {
+	conn, err := c.shared(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	uid := c.uid()
+	call, err := conn.send(uid, line)
+	if err != nil {
+		return "", err
+	}
+	defer conn.end(uid)
+
+	resp, err := conn.next(ctx, uid, call)
+	if err != nil {
+		return "", err
+	}
+	if rejected(resp) {
+		return "", errors.Wrap(ErrRejected, line)
+	}
+	return resp, nil
+}
+
+// rejected reports whether a response is an ERR, which strict servers
+// follow with why.
+func rejected(resp string) bool {
+	return resp == "ERR" || strings.HasPrefix(resp, "ERR ")
+}
+
+// Close closes the connection commands share. Commands still waiting on it
+// fail, and commands sent afterwards connect again.
+func (c *Client) Close() error {
+	c.connM.Lock()
+	defer c.connM.Unlock()
+
+	if c.conn != nil {
+		c.conn.close(errClosed)
+		c.conn = nil
+	}
+	return nil
+}
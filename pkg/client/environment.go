@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrEnvironment is returned by Run when the server is in an environment
+// the client isn't cleared to run functions in.
+var ErrEnvironment = errors.New("wrong environment")
+
+// WithEnvironment has Run refuse to run functions unless the server says
+// it's part of env, like staging.
+func WithEnvironment(env string) Option {
+	return func(c *Client) {
+		c.environment = env
+	}
+}
+
+// AllowProd lets Run run functions on servers that say they're part of prod
+// or production, which it otherwise refuses to.
+func AllowProd() Option {
+	return func(c *Client) {
+		c.allowProd = true
+	}
+}
+
+// IsProd reports whether an environment is production.
+func IsProd(env string) bool {
+	env = strings.ToLower(env)
+	return env == "prod" || env == "production"
+}
+
+// Environment returns the environment the server says it's part of, like
+// prod or staging, or "" if it doesn't say.
+func (c *Client) Environment(ctx context.Context) (string, error) {
+	resp, err := c.do(ctx, "HELLO")
+	if errors.Cause(err) == ErrRejected {
+		// servers from before environments don't know HELLO.
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// HELLO [environment]
+	fields := strings.Split(resp, " ")
+	if len(fields) != 2 || fields[0] != "HELLO" {
+		return "", errors.Wrapf(ErrMalformed, "unexpected response %q", resp)
+	}
+	if fields[1] == "-" {
+		return "", nil
+	}
+	return fields[1], nil
+}
+
+// checkEnvironment fails with ErrEnvironment if functions can't be run in
+// the server's environment.
+func (c *Client) checkEnvironment(ctx context.Context) error {
+	if c.environment == "" && c.allowProd {
+		return nil
+	}
+
+	env, err := c.Environment(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c.environment != "":
+		if env != c.environment {
+			return errors.Wrapf(ErrEnvironment, "server is in %q, not %q", env, c.environment)
+		}
+	case IsProd(env):
+		return errors.Wrapf(ErrEnvironment, "server is in %s, and running functions there needs AllowProd", env)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+	"github.com/silversupreme/drops/pkg/server"
+)
+
+func TestEnvironment(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.New(listener, 4, clock.NewMock(), server.WithEnvironment("prod"))
+	go s.Serve(context.Background())
+	addr := listener.Addr().String()
+	ctx := context.Background()
+
+	c := New(addr, nil)
+	defer c.Close()
+	if env, err := c.Environment(ctx); err != nil || env != "prod" {
+		t.Fatalf("expected prod, got %q, %v", env, err)
+	}
+
+	// the station doesn't exist, so getting past the check means being
+	// rejected by the server instead.
+	for _, in := range []struct {
+		opts   []Option
+		expect error
+	}{
+		{nil, ErrEnvironment},
+		{[]Option{AllowProd()}, ErrRejected},
+		{[]Option{WithEnvironment("staging")}, ErrEnvironment},
+		{[]Option{WithEnvironment("staging"), AllowProd()}, ErrEnvironment},
+		{[]Option{WithEnvironment("prod")}, ErrRejected},
+	} {
+		c := New(addr, nil, in.opts...)
+		if _, err := c.Run(ctx, "ghost", "echo", "", nil); errors.Cause(err) != in.expect {
+			t.Errorf("%d options: expected %v, got %v", len(in.opts), in.expect, err)
+		}
+		c.Close()
+	}
+}
+
+func TestEnvironmentUnset(t *testing.T) {
+	c := New(serve(t), nil)
+	defer c.Close()
+
+	if env, err := c.Environment(context.Background()); err != nil || env != "" {
+		t.Fatalf("expected no environment, got %q, %v", env, err)
+	}
+}
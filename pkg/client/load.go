@@ -0,0 +1,45 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// LoadState sends every record in r, like the lines drops-dump writes, to
+// the server on conn, one LOAD at a time, and returns how many the server
+// accepted. Each LOAD is sent under prefix and the record's number, so the
+// server's logs show where it came from. The connection's certificate must
+// belong to one of the server's admins.
+func LoadState(conn io.ReadWriter, r io.Reader, prefix string) (int, error) {
+	records := bufio.NewScanner(r)
+	records.Buffer(make([]byte, 64*1024), 1024*1024)
+	responses := bufio.NewScanner(conn)
+
+	n := 0
+	for records.Scan() {
+		record := strings.TrimSpace(records.Text())
+		if record == "" {
+			continue
+		}
+
+		uid := fmt.Sprintf("%s%d", prefix, n+1)
+		if _, err := fmt.Fprintf(conn, "%s LOAD %s\n", uid, record); err != nil {
+			return n, err
+		}
+
+		if !responses.Scan() {
+			if err := responses.Err(); err != nil {
+				return n, err
+			}
+			return n, io.ErrUnexpectedEOF
+		}
+		if resp := responses.Text(); resp != uid+" ACK" {
+			return n, fmt.Errorf("server refused record %d (is this certificate an admin?): %s", n+1, resp)
+		}
+		n++
+	}
+
+	return n, records.Err()
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLoadState(t *testing.T) {
+	conn, server := net.Pipe()
+	defer conn.Close()
+
+	// a server taking two records, and refusing the third.
+	go func() {
+		defer server.Close()
+		lines := bufio.NewScanner(server)
+		for i := 0; lines.Scan(); i++ {
+			uid := strings.Fields(lines.Text())[0]
+			if i < 2 {
+				fmt.Fprintf(server, "%s ACK\n", uid)
+			} else {
+				fmt.Fprintf(server, "%s ERR not an admin\n", uid)
+			}
+		}
+	}()
+
+	records := `{"kind":"station","station":"water"}
+
+{"kind":"station","station":"air"}
+{"kind":"station","station":"pump1"}
+`
+	n, err := LoadState(conn, strings.NewReader(records), "test")
+	if n != 2 || err == nil {
+		t.Fatalf("expected 2 records loaded and an error, got %d, %v", n, err)
+	}
+	if !strings.Contains(err.Error(), "test3 ERR") {
+		t.Errorf("expected the refusal to be passed along, got %v", err)
+	}
+}
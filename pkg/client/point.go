@@ -0,0 +1,44 @@
+package client
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Point is one measurement of a station's metric.
+type Point struct {
+	Station string
+	Metric  string
+	Ts      time.Time
+	Value   float64
+
+	// Replay is set on points a subscription was sent from the history kept
+	// before it started, rather than as they were reported.
+	Replay bool
+
+	// Offset is the point's place in a durable subscription.
+	Offset int64
+}
+
+// parsePoint reads a point in the server's [ts]:[value] form.
+func parsePoint(station, metric, token string) (Point, error) {
+	parts := strings.Split(token, ":")
+	if len(parts) != 2 {
+		return Point{}, errors.Errorf("point %q is not [ts]:[value]", token)
+	}
+
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Point{}, errors.Wrapf(err, "bad timestamp in point %q", token)
+	}
+
+	value, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return Point{}, errors.Wrapf(err, "bad value in point %q", token)
+	}
+
+	return Point{Station: station, Metric: metric, Ts: time.Unix(ts, 0), Value: value}, nil
+}
@@ -0,0 +1,273 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Many industrial networks only let traffic out through a proxy, so the
+// client can connect through an HTTP proxy (with CONNECT) or a SOCKS5 one.
+// Unless told otherwise, it uses the proxy set in the environment, like most
+// tools do.
+
+// DialFunc opens a network connection, like net.Dialer's DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyFromEnvironment returns the proxy to reach addr through, from
+// HTTPS_PROXY or ALL_PROXY, or nil to connect directly. Hosts listed in
+// NO_PROXY are reached directly. Lowercase names work too.
+func proxyFromEnvironment(addr string) (*url.URL, error) {
+	var raw string
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy"} {
+		if raw = os.Getenv(name); raw != "" {
+			break
+		}
+	}
+	if raw == "" || noProxy(addr) {
+		return nil, nil
+	}
+
+	// like curl, a proxy without a scheme is an HTTP one.
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	proxy, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad proxy %q", raw)
+	}
+	return proxy, nil
+}
+
+// noProxy reports whether NO_PROXY says addr is reached directly. Entries
+// match the host and its subdomains, and * matches every host.
+func noProxy(addr string) bool {
+	list := os.Getenv("NO_PROXY")
+	if list == "" {
+		list = os.Getenv("no_proxy")
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimPrefix(strings.TrimSpace(entry), ".")
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case entry == "":
+		case entry == "*", host == entry, strings.HasSuffix(host, "."+entry):
+			return true
+		}
+	}
+	return false
+}
+
+// dialProxy connects to addr through a proxy.
+func dialProxy(ctx context.Context, dial DialFunc, proxy *url.URL, addr string) (net.Conn, error) {
+	var handshake func(net.Conn) (net.Conn, error)
+	switch proxy.Scheme {
+	case "http":
+		handshake = func(conn net.Conn) (net.Conn, error) { return httpConnect(conn, proxy, addr) }
+	case "socks5", "socks5h":
+		handshake = func(conn net.Conn) (net.Conn, error) { return socks5Connect(conn, proxy, addr) }
+	default:
+		return nil, errors.Errorf("unsupported proxy scheme %s", proxy.Scheme)
+	}
+
+	hostport := proxy.Host
+	if proxy.Port() == "" {
+		port := "1080"
+		if proxy.Scheme == "http" {
+			port = "80"
+		}
+		hostport = net.JoinHostPort(proxy.Hostname(), port)
+	}
+
+	conn, err := dial(ctx, "tcp", hostport)
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to proxy %s", hostport)
+	}
+
+	// the handshake gives up when ctx does.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	tunnel, err := handshake(conn)
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "connecting to %s through proxy %s", addr, hostport)
+	}
+	return tunnel, nil
+}
+
+// httpConnect asks an HTTP proxy for a tunnel to addr.
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		req.SetBasicAuth(u.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		delete(req.Header, "Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("proxy refused the tunnel: %s", resp.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		// whatever came through the tunnel with the response isn't lost.
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection some of which has already been read.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// socks5Replies are why a SOCKS5 proxy can refuse to connect, by reply code.
+var socks5Replies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Connect asks a SOCKS5 proxy (RFC 1928) to connect to addr, logging
+// in (RFC 1929) if the proxy's URL has a user.
+func socks5Connect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad port in %s", addr)
+	}
+
+	methods := []byte{0}
+	if proxy.User != nil {
+		methods = []byte{2}
+	}
+	if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != 5 || reply[1] != methods[0] {
+		return nil, errors.Errorf("proxy doesn't accept the authentication method")
+	}
+
+	if proxy.User != nil {
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return nil, errors.Errorf("proxy user or password too long")
+		}
+
+		login := append([]byte{1, byte(len(user))}, user...)
+		login = append(append(login, byte(len(password))), password...)
+		if _, err := conn.Write(login); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0 {
+			return nil, errors.Errorf("proxy refused the login")
+		}
+	}
+
+	req := []byte{5, 1, 0}
+	switch ip := net.ParseIP(host); {
+	case ip.To4() != nil:
+		req = append(append(req, 1), ip.To4()...)
+	case ip != nil:
+		req = append(append(req, 4), ip.To16()...)
+	case len(host) > 255:
+		return nil, errors.Errorf("host %s too long", host)
+	default:
+		// the proxy resolves names.
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	// [version] [reply] [reserved] [address type] [address] [port]
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+	if head[1] != 0 {
+		why, ok := socks5Replies[head[1]]
+		if !ok {
+			why = fmt.Sprintf("reply %d", head[1])
+		}
+		return nil, errors.Errorf("proxy couldn't connect: %s", why)
+	}
+
+	var skip int
+	switch head[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return nil, err
+		}
+		skip = int(n[0])
+	default:
+		return nil, errors.Errorf("proxy replied with unknown address type %d", head[3])
+	}
+	if _, err := io.CopyN(io.Discard, conn, int64(skip+2)); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tunnel starts a proxy that tunnels connections with handshake, which
+// returns where to, and returns its address and how many tunnels it opened.
+func tunnel(t *testing.T, handshake func(net.Conn, *bufio.Reader) (string, error)) (string, *int32) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var tunnels int32
+	go func() {
+		for {
+			in, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer in.Close()
+				reader := bufio.NewReader(in)
+				addr, err := handshake(in, reader)
+				if err != nil {
+					return
+				}
+				out, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer out.Close()
+				atomic.AddInt32(&tunnels, 1)
+
+				go io.Copy(out, reader)
+				io.Copy(in, out)
+			}()
+		}
+	}()
+	return listener.Addr().String(), &tunnels
+}
+
+// httpProxy starts an HTTP proxy that wants user:secret.
+func httpProxy(t *testing.T) (string, *int32) {
+	return tunnel(t, func(conn net.Conn, reader *bufio.Reader) (string, error) {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return "", err
+		}
+		if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", io.EOF
+		}
+		_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, err
+	})
+}
+
+// socks5Proxy starts a SOCKS5 proxy that wants user:secret, and to be given
+// host names.
+func socks5Proxy(t *testing.T) (string, *int32) {
+	return tunnel(t, func(conn net.Conn, reader *bufio.Reader) (string, error) {
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(reader, greeting); err != nil || greeting[2] != 2 {
+			return "", io.EOF
+		}
+		conn.Write([]byte{5, 2})
+
+		// [version] [length] [user] [length] [password]
+		head := make([]byte, 2)
+		io.ReadFull(reader, head)
+		user := make([]byte, head[1]+1)
+		io.ReadFull(reader, user)
+		password := make([]byte, user[len(user)-1])
+		io.ReadFull(reader, password)
+		if string(user[:len(user)-1]) != "user" || string(password) != "secret" {
+			conn.Write([]byte{1, 1})
+			return "", io.EOF
+		}
+		conn.Write([]byte{1, 0})
+
+		// [version] [command] [reserved] [address type] [length] [host] [port]
+		req := make([]byte, 5)
+		if _, err := io.ReadFull(reader, req); err != nil || req[1] != 1 || req[3] != 3 {
+			return "", io.EOF
+		}
+		host := make([]byte, req[4]+2)
+		if _, err := io.ReadFull(reader, host); err != nil {
+			return "", err
+		}
+		port := binary.BigEndian.Uint16(host[len(host)-2:])
+
+		_, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		return net.JoinHostPort(string(host[:len(host)-2]), strconv.Itoa(int(port))), err
+	})
+}
+
+// byName returns addr with the host as localhost.
+func byName(t *testing.T, addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+func TestProxies(t *testing.T) {
+	addr := byName(t, serve(t))
+
+	for _, tc := range []struct {
+		scheme string
+		start  func(*testing.T) (string, *int32)
+	}{
+		{"http", httpProxy},
+		{"socks5", socks5Proxy},
+	} {
+		proxied, tunnels := tc.start(t)
+		proxy, err := url.Parse(tc.scheme + "://user:secret@" + proxied)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := New(addr, nil, WithProxy(proxy))
+		if _, err := c.List(context.Background()); err != nil {
+			t.Fatalf("%s: %v", tc.scheme, err)
+		}
+		c.Close()
+		if atomic.LoadInt32(tunnels) != 1 {
+			t.Fatalf("%s: expected to go through the proxy", tc.scheme)
+		}
+
+		// the wrong password gets nowhere.
+		proxy.User = url.UserPassword("user", "guess")
+		c = New(addr, nil, WithProxy(proxy))
+		if _, err := c.List(context.Background()); err == nil {
+			t.Fatalf("%s: expected the proxy to turn the client away", tc.scheme)
+		}
+		c.Close()
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	addr := byName(t, serve(t))
+	proxied, tunnels := httpProxy(t)
+
+	t.Setenv("HTTPS_PROXY", "user:secret@"+proxied)
+	t.Setenv("NO_PROXY", "")
+	c := New(addr, nil)
+	if _, err := c.List(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if atomic.LoadInt32(tunnels) != 1 {
+		t.Fatalf("expected to go through the proxy")
+	}
+
+	t.Setenv("NO_PROXY", "example.com,localhost")
+	c = New(addr, nil)
+	if _, err := c.List(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if atomic.LoadInt32(tunnels) != 1 {
+		t.Fatalf("expected to connect directly")
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("no_proxy", ".example.com, 10.0.0.1:19406")
+	for addr, direct := range map[string]bool{
+		"example.com:19406":       true,
+		"drops.example.com:19406": true,
+		"10.0.0.1:19406":          true,
+		"drops.example.org:19406": false,
+		"notexample.com:19406":    false,
+		"10.0.0.10:19406":         false,
+	} {
+		if got := noProxy(addr); got != direct {
+			t.Errorf("%s: expected %t, got %t", addr, direct, got)
+		}
+	}
+}
+
+func TestDialer(t *testing.T) {
+	addr := serve(t)
+
+	var dialed int32
+	var d net.Dialer
+	c := New("drops:19406", nil, WithProxy(nil), WithDialer(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		return d.DialContext(ctx, network, addr)
+	}))
+	defer c.Close()
+
+	if _, err := c.List(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&dialed) != 1 {
+		t.Fatalf("expected the dialer to be used")
+	}
+}
+
+func TestProxyGivesUp(t *testing.T) {
+	// a proxy that never answers.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	proxy := &url.URL{Scheme: "http", Host: listener.Addr().String()}
+	c := New("drops:19406", nil, WithProxy(proxy))
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.List(ctx); errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+}
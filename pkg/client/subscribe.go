@@ -0,0 +1,230 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/silversupreme/drops/pkg/retry"
+)
+
+// Subscribe calls fn with each new point of a station's metric until ctx is
+// done, when it returns ctx's error. The station may be "*" for every
+// station and the metric a pattern, and modifiers like "every=10s" are passed
+// along to the server as is. With "since=1h", fn is first called with the
+// points kept from the last hour, marked as Replay.
+//
+// Subscriptions have a connection of their own. When it drops, Subscribe
+// reconnects with exponential backoff and subscribes again, asking the server
+// to replay what was missed in the meantime, as far as the server kept it.
+// Points that were already delivered aren't delivered again. It returns
+// early if the server rejects the subscription (ErrRejected), or sends
+// points it can't make sense of (ErrMalformed).
+//
+// With "durable=[name]", the server keeps the subscription's points while
+// it's disconnected instead, and each point's Offset is committed once fn
+// returns. Points whose commit didn't make it before the connection dropped
+// are sent again, but aren't delivered twice.
+func (c *Client) Subscribe(ctx context.Context, station, metric string, fn func(Point), modifiers ...string) error {
+	var durable string
+	for _, m := range modifiers {
+		if strings.HasPrefix(m, "durable=") {
+			durable = strings.TrimPrefix(m, "durable=")
+		}
+	}
+
+	seen := &seenPoints{latest: map[series]time.Time{}, values: map[series][]float64{}}
+	var offset int64
+	deliver := func(p Point) {
+		switch {
+		case durable != "" && p.Offset > offset:
+			offset = p.Offset
+			fn(p)
+		case durable == "" && seen.add(p):
+			fn(p)
+		}
+	}
+
+	var wait time.Duration
+	attached := false
+	for {
+		resumed := modifiers
+		if durable == "" {
+			resumed = seen.resume(modifiers)
+		}
+
+		line := strings.Join(append([]string{"SUBSCRIBE", station, metric}, resumed...), " ")
+		established, err := c.subscribe(ctx, line, durable, deliver)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// the server may not have noticed a durable subscription's last
+		// connection is gone yet, and turn the new one away for a while.
+		busy := durable != "" && attached && !established
+		if (errors.Cause(err) == ErrRejected && !busy) || errors.Cause(err) == ErrMalformed {
+			return err
+		}
+
+		if established {
+			attached = true
+			wait = 0
+		}
+		wait = retry.Backoff(wait, c.minBackoff, c.maxBackoff)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.clock.After(wait):
+		}
+	}
+}
+
+type series struct {
+	station string
+	metric  string
+}
+
+// seenPoints keeps track of the points a subscription has delivered, so a
+// renewed subscription can pick up where the last one left off.
+type seenPoints struct {
+	latest map[series]time.Time
+	// the values delivered at the latest time, since timestamps on the wire
+	// are only to the second.
+	values map[series][]float64
+}
+
+// add reports whether a point is new, and records it if it is.
+func (s *seenPoints) add(p Point) bool {
+	key := series{p.Station, p.Metric}
+	latest, ok := s.latest[key]
+
+	switch {
+	case !ok || p.Ts.After(latest):
+		s.latest[key] = p.Ts
+		s.values[key] = []float64{p.Value}
+		return true
+	case p.Replay && p.Ts.Before(latest):
+		return false
+	case p.Replay:
+		for _, v := range s.values[key] {
+			if v == p.Value {
+				return false
+			}
+		}
+	}
+
+	if p.Ts.Equal(latest) {
+		s.values[key] = append(s.values[key], p.Value)
+	}
+	return true
+}
+
+// resume returns the modifiers for renewing a subscription, replaying from
+// the oldest of the latest points delivered, if there were any.
+func (s *seenPoints) resume(modifiers []string) []string {
+	if len(s.latest) == 0 {
+		return modifiers
+	}
+
+	var since time.Time
+	for _, ts := range s.latest {
+		if since.IsZero() || ts.Before(since) {
+			since = ts
+		}
+	}
+
+	resumed := []string{fmt.Sprintf("since=%d", since.Unix())}
+	for _, m := range modifiers {
+		if !strings.HasPrefix(m, "since=") {
+			resumed = append(resumed, m)
+		}
+	}
+	return resumed
+}
+
+// subscribe runs a single subscription until its connection drops or ctx is
+// done, and reports whether the server accepted it. Points of durable
+// subscriptions are committed once fn returns.
+func (c *Client) subscribe(ctx context.Context, line, durable string, fn func(Point)) (bool, error) {
+	conn, err := c.Dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	uid := c.uid()
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// let the server know, then give up on the connection.
+			fmt.Fprintf(conn, "%s CANCEL\n", uid)
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if _, err := fmt.Fprintf(conn, "%s %s\n", uid, line); err != nil {
+		return false, err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		return false, errors.Wrap(scanner.Err(), "waiting for the server to accept the subscription")
+	}
+	switch text := scanner.Text(); {
+	case text == uid+" ACK":
+	case text == uid+" ERR" || strings.HasPrefix(text, uid+" ERR "):
+		// strict servers say why.
+		return false, errors.Wrap(ErrRejected, line)
+	default:
+		return false, errors.Wrapf(ErrMalformed, "unexpected response %q", scanner.Text())
+	}
+
+	commits := c.uid()
+	for scanner.Scan() {
+		// [uid] METRIC|REPLAY [station] [metric] [ts]:[value] [offset]
+		fields := strings.Split(scanner.Text(), " ")
+		if fields[0] != uid {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "ERR" {
+			return true, errors.Wrapf(ErrRejected, "%s ended", line)
+		}
+
+		points := 5
+		if durable != "" {
+			points = 6
+		}
+		if len(fields) != points || (fields[1] != "METRIC" && fields[1] != "REPLAY") {
+			return true, errors.Wrapf(ErrMalformed, "unexpected line %q", scanner.Text())
+		}
+
+		p, err := parsePoint(fields[2], fields[3], fields[4])
+		if err != nil {
+			return true, errors.Wrap(ErrMalformed, err.Error())
+		}
+		p.Replay = fields[1] == "REPLAY"
+
+		if durable == "" {
+			fn(p)
+			continue
+		}
+
+		p.Offset, err = strconv.ParseInt(fields[5], 10, 64)
+		if err != nil {
+			return true, errors.Wrapf(ErrMalformed, "bad offset in %q", scanner.Text())
+		}
+		fn(p)
+		fmt.Fprintf(conn, "%s CURSOR %s %d\n", commits, durable, p.Offset)
+	}
+
+	return true, scanner.Err()
+}
@@ -0,0 +1,321 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/silversupreme/drops/pkg/server"
+)
+
+// serve starts a server on a random port, and returns its address.
+func serve(t *testing.T) string {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.New(listener, 4, clock.NewMock())
+	go s.Serve(context.Background())
+
+	return listener.Addr().String()
+}
+
+// proxy forwards connections to addr until they're cut.
+type proxy struct {
+	addr string
+
+	m     sync.Mutex
+	conns []net.Conn
+	down  bool
+}
+
+func newProxy(t *testing.T, addr string) (*proxy, string) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &proxy{addr: addr}
+	go func() {
+		for {
+			in, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			p.m.Lock()
+			down := p.down
+			p.m.Unlock()
+
+			out, err := net.Dial("tcp", addr)
+			if err != nil || down {
+				in.Close()
+				continue
+			}
+
+			p.m.Lock()
+			p.conns = append(p.conns, in, out)
+			p.m.Unlock()
+
+			go io.Copy(in, out)
+			go io.Copy(out, in)
+		}
+	}()
+
+	return p, listener.Addr().String()
+}
+
+// cut drops every connection through the proxy, and refuses new ones while
+// down.
+func (p *proxy) cut(down bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+	p.down = down
+}
+
+// station registers a station with the server, and returns a function that
+// reports a metric from it.
+func station(t *testing.T, addr, name string) func(metric string, value float64) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	reader := bufio.NewReader(conn)
+	send := func(line string) {
+		fmt.Fprintf(conn, "1 %s\n", line)
+		if resp, err := reader.ReadString('\n'); err != nil || resp != "1 ACK\n" {
+			t.Fatalf("%s: got %q, %v", line, resp, err)
+		}
+	}
+
+	send("REGISTER " + name + " source")
+	return func(metric string, value float64) {
+		send(fmt.Sprintf("METRIC %s %g", metric, value))
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	addr := serve(t)
+	report := station(t, addr, "water")
+
+	p, proxied := newProxy(t, addr)
+	c := New(proxied, nil)
+	c.minBackoff = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	points := make(chan Point, 100)
+	done := make(chan error)
+	go func() {
+		done <- c.Subscribe(ctx, "water", "level", func(p Point) { points <- p })
+	}()
+
+	// keeps reporting until the subscription picks a point up, since it may
+	// not be set up yet. Each point is a little different, since the server
+	// doesn't store (or publish) the same point twice.
+	expect := func(value float64) Point {
+		deadline := time.After(5 * time.Second)
+		for i := 0; ; i++ {
+			report("level", value+float64(i)/100)
+
+			select {
+			case p := <-points:
+				if p.Station != "water" || p.Metric != "level" || p.Value < value || p.Value >= value+1 {
+					t.Fatalf("unexpected point %+v", p)
+				}
+				return p
+			case <-time.After(10 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("never got a point with value %g", value)
+			}
+		}
+	}
+
+	first := expect(1)
+
+	// the subscription survives its connection dropping, and catches up on
+	// what it missed in the meantime.
+	p.cut(true)
+	for len(points) > 0 {
+		<-points
+	}
+	report("level", 5)
+	p.cut(false)
+
+	// points reported in the same second as the last one delivered, before
+	// the subscription started, are replayed too; the last one isn't.
+	for missed := false; !missed; {
+		select {
+		case p := <-points:
+			if !p.Replay || p.Value == first.Value {
+				t.Fatalf("unexpected point %+v", p)
+			}
+			missed = p.Value == 5
+		case <-time.After(5 * time.Second):
+			t.Fatal("never got the missed point")
+		}
+	}
+	expect(6)
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected the subscription to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscribe didn't return once cancelled")
+	}
+}
+
+func TestSubscribeBackoffClock(t *testing.T) {
+	addr := serve(t)
+	report := station(t, addr, "water")
+
+	p, proxied := newProxy(t, addr)
+	mock := clock.NewMock()
+	c := New(proxied, nil, WithClock(mock))
+	c.minBackoff = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	points := make(chan Point, 100)
+	go c.Subscribe(ctx, "water", "level", func(p Point) { points <- p })
+
+	// reports until a point comes through, moving the clock along so the
+	// client can get on with reconnecting.
+	expect := func(value float64, advance time.Duration) {
+		deadline := time.After(5 * time.Second)
+		for {
+			report("level", value)
+			value += 0.01
+			mock.Add(advance)
+
+			select {
+			case <-points:
+				return
+			case <-time.After(10 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("never got a point")
+			}
+		}
+	}
+	expect(1, 0)
+
+	p.cut(false)
+	for len(points) > 0 {
+		<-points
+	}
+
+	// the client waits out its backoff by the mock clock, not the real one.
+	time.Sleep(100 * time.Millisecond)
+	p.m.Lock()
+	reconnected := len(p.conns) > 0
+	p.m.Unlock()
+	if reconnected {
+		t.Fatal("the client reconnected before its backoff passed")
+	}
+
+	expect(2, time.Minute)
+}
+
+func TestSubscribeRejected(t *testing.T) {
+	c := New(serve(t), nil)
+
+	err := c.Subscribe(context.Background(), "water", "level", func(Point) {}, "every=never")
+	if err == nil || err.Error() != "SUBSCRIBE water level every=never: server rejected the command" {
+		t.Fatalf("expected the subscription to be rejected, got %v", err)
+	}
+}
+
+func TestParsePoint(t *testing.T) {
+	p, err := parsePoint("water", "level", "60:1.50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Ts.Equal(time.Unix(60, 0)) || p.Value != 1.5 {
+		t.Fatalf("unexpected point %+v", p)
+	}
+
+	for _, bad := range []string{"60", "a:1", "60:b", "60:1:2"} {
+		if _, err := parsePoint("water", "level", bad); err == nil {
+			t.Errorf("expected an error parsing %s", bad)
+		}
+	}
+}
+
+func TestSubscribeDurable(t *testing.T) {
+	addr := serve(t)
+	report := station(t, addr, "water")
+
+	p, proxied := newProxy(t, addr)
+	c := New(proxied, nil)
+	c.minBackoff = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	points := make(chan Point, 100)
+	go c.Subscribe(ctx, "water", "level", func(p Point) { points <- p }, "durable=export")
+
+	next := func() Point {
+		select {
+		case p := <-points:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("never got a point")
+		}
+		return Point{}
+	}
+
+	// the durable subscription exists from when it's first set up, so wait
+	// for that before reporting anything.
+	for c := New(addr, nil); ; time.Sleep(time.Millisecond) {
+		conn, err := c.Dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "1 CURSOR export\n")
+		resp, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if resp == "1 CURSOR export 0 0\n" {
+			break
+		}
+	}
+
+	report("level", 1)
+	if p := next(); p.Value != 1 || p.Offset != 1 {
+		t.Fatalf("unexpected point %+v", p)
+	}
+
+	// points reported while the consumer is away are delivered once it's
+	// back, and nothing it already had is.
+	p.cut(true)
+	report("level", 2)
+	report("level", 3)
+	p.cut(false)
+
+	for _, want := range []Point{{Value: 2, Offset: 2}, {Value: 3, Offset: 3}} {
+		if p := next(); p.Value != want.Value || p.Offset != want.Offset {
+			t.Fatalf("expected %+v, got %+v", want, p)
+		}
+	}
+
+	report("level", 4)
+	if p := next(); p.Value != 4 || p.Offset != 4 {
+		t.Fatalf("unexpected point %+v", p)
+	}
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// LoadTLSConfig returns a config for New from PEM files: the CA the server's
+// certificate is signed with, and the certificate and key to present to the
+// server, which checks them against its own CA.
+func LoadTLSConfig(caCert, sslCert, sslKey string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(sslCert, sslKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading key pair")
+	}
+
+	ca, err := ioutil.ReadFile(caCert)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading ca certificate")
+	}
+	return tlsConfig(certificate, ca, caCert)
+}
+
+// ParseTLSConfig is LoadTLSConfig for PEM blocks already in memory, like
+// ones an app keeps in its platform's keystore rather than in files.
+func ParseTLSConfig(caPEM, certPEM, keyPEM []byte) (*tls.Config, error) {
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing key pair")
+	}
+	return tlsConfig(certificate, caPEM, "the ca certificate")
+}
+
+// tlsConfig returns a config presenting certificate, and trusting the CA in
+// ca, which is read from where.
+func tlsConfig(certificate tls.Certificate, ca []byte, where string) (*tls.Config, error) {
+	certPool := x509.NewCertPool()
+	if ok := certPool.AppendCertsFromPEM(ca); !ok {
+		return nil, errors.Errorf("no certificates in %s", where)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      certPool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
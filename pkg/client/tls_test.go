@@ -0,0 +1,53 @@
+package client
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLoadTLSConfig(t *testing.T) {
+	const dir = "../../ssl/insecure/"
+
+	config, err := LoadTLSConfig(dir+"ca.crt", dir+"server.crt", dir+"server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Certificates) != 1 || config.RootCAs == nil {
+		t.Errorf("expected a certificate and a CA, got %+v", config)
+	}
+
+	// a key isn't a CA.
+	if _, err := LoadTLSConfig(dir+"server.key", dir+"server.crt", dir+"server.key"); err == nil {
+		t.Error("expected an error for a CA file without certificates")
+	}
+	if _, err := LoadTLSConfig(dir+"ca.crt", dir+"missing.crt", dir+"server.key"); err == nil {
+		t.Error("expected an error for a missing certificate")
+	}
+}
+
+func TestParseTLSConfig(t *testing.T) {
+	const dir = "../../ssl/insecure/"
+
+	var pems [3][]byte
+	for i, name := range []string{"ca.crt", "server.crt", "server.key"} {
+		var err error
+		if pems[i], err = os.ReadFile(dir + name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config, err := ParseTLSConfig(pems[0], pems[1], pems[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Certificates) != 1 || config.RootCAs == nil {
+		t.Errorf("expected a certificate and a CA, got %+v", config)
+	}
+
+	if _, err := ParseTLSConfig(pems[2], pems[1], pems[2]); err == nil {
+		t.Error("expected an error for a CA without certificates")
+	}
+	if _, err := ParseTLSConfig(pems[0], pems[0], pems[2]); err == nil {
+		t.Error("expected an error for a certificate that doesn't match the key")
+	}
+}
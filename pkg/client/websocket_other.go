@@ -0,0 +1,16 @@
+//go:build !(js && wasm)
+
+package client
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// dialWebSocket only works in the browser, where the client has no other
+// way to reach the server.
+func dialWebSocket(ctx context.Context, addr string) (net.Conn, error) {
+	return nil, errors.Errorf("can't connect to %s: WebSockets are only supported in the browser", addr)
+}
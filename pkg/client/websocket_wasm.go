@@ -0,0 +1,184 @@
+//go:build js && wasm
+
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// wsConn is a browser WebSocket, as a net.Conn carrying the line protocol.
+// The server reads what's sent on it as one stream, however it's split into
+// messages, and writes to it the same way.
+type wsConn struct {
+	ws   js.Value
+	addr wsAddr
+
+	// the listeners added to ws, to remove and release on Close.
+	listeners []wsListener
+
+	m sync.Mutex
+	// what's been received and not read yet.
+	buf []byte
+	// why the socket closed, once it has.
+	err error
+	// signalled whenever buf or err change.
+	ready chan struct{}
+
+	closeOnce sync.Once
+}
+
+type wsListener struct {
+	event string
+	fn    js.Func
+}
+
+// wsAddr is the URL a WebSocket was opened to.
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+// dialWebSocket opens a WebSocket to the server's /ws URL.
+func dialWebSocket(ctx context.Context, addr string) (net.Conn, error) {
+	c := &wsConn{
+		ws:    js.Global().Get("WebSocket").New(addr),
+		addr:  wsAddr(addr),
+		ready: make(chan struct{}, 1),
+	}
+	c.ws.Set("binaryType", "arraybuffer")
+
+	// listeners run on the browser's event loop, so they can't block.
+	opened := make(chan struct{})
+	c.listen("open", func(js.Value) {
+		close(opened)
+	})
+	c.listen("message", func(ev js.Value) {
+		data := ev.Get("data")
+		var b []byte
+		if data.Type() == js.TypeString {
+			b = []byte(data.String())
+		} else {
+			arr := js.Global().Get("Uint8Array").New(data)
+			b = make([]byte, arr.Length())
+			js.CopyBytesToGo(b, arr)
+		}
+
+		c.m.Lock()
+		c.buf = append(c.buf, b...)
+		c.m.Unlock()
+		c.signal()
+	})
+	c.listen("close", func(ev js.Value) {
+		err := io.EOF
+		if code := ev.Get("code").Int(); code != 1000 {
+			err = errors.Errorf("websocket to %s closed with %d %s", addr, code, ev.Get("reason").String())
+		}
+		c.fail(err)
+	})
+
+	select {
+	case <-opened:
+		return c, nil
+	case <-c.ready:
+		// closed before it opened; browsers don't say why.
+		c.Close()
+		return nil, errors.Errorf("couldn't open websocket to %s", addr)
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// listen calls fn with each of the socket's events of a kind.
+func (c *wsConn) listen(event string, fn func(ev js.Value)) {
+	l := wsListener{event: event, fn: js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		fn(args[0])
+		return nil
+	})}
+	c.listeners = append(c.listeners, l)
+	c.ws.Call("addEventListener", event, l.fn)
+}
+
+func (c *wsConn) signal() {
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// fail ends the connection with err, unless it's already ended.
+func (c *wsConn) fail(err error) {
+	c.m.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.m.Unlock()
+	c.signal()
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		c.m.Lock()
+		if len(c.buf) > 0 {
+			n := copy(p, c.buf)
+			c.buf = c.buf[n:]
+			c.m.Unlock()
+			return n, nil
+		}
+		err := c.err
+		c.m.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		<-c.ready
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.m.Lock()
+	err := c.err
+	c.m.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	arr := js.Global().Get("Uint8Array").New(len(p))
+	js.CopyBytesToJS(arr, p)
+	c.ws.Call("send", arr)
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.fail(net.ErrClosed)
+		c.ws.Call("close")
+		for _, l := range c.listeners {
+			c.ws.Call("removeEventListener", l.event, l.fn)
+			l.fn.Release()
+		}
+	})
+	return nil
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.addr }
+func (c *wsConn) RemoteAddr() net.Addr { return c.addr }
+
+// the browser doesn't give WebSockets deadlines, and the client doesn't set
+// any.
+func (c *wsConn) SetDeadline(time.Time) error {
+	return errors.New("websockets don't support deadlines")
+}
+func (c *wsConn) SetReadDeadline(time.Time) error {
+	return errors.New("websockets don't support deadlines")
+}
+func (c *wsConn) SetWriteDeadline(time.Time) error {
+	return errors.New("websockets don't support deadlines")
+}
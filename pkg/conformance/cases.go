@@ -0,0 +1,210 @@
+package conformance
+
+// Cases are the exchanges the suite runs, by what they check.
+var Cases = []Case{
+	{
+		Name: "ListTakesNoArgs",
+		Steps: []Step{
+			{Send: "1 LIST SOMETHING", Expect: []string{"1 ERR"}},
+		},
+	},
+	{
+		Name: "UnknownCommand",
+		Steps: []Step{
+			{Send: "1 DOODLE", Expect: []string{"1 ERR"}},
+		},
+	},
+	{
+		Name: "MissingCommand",
+		Steps: []Step{
+			{Send: "1", Expect: []string{"FATAL"}},
+		},
+	},
+	{
+		Name: "Ping",
+		Steps: []Step{
+			{Send: "1 PING", Expect: []string{"1 PONG"}},
+		},
+	},
+	{
+		Name: "Register",
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source", Expect: []string{"1 ACK"}},
+			{Send: "2 INFO {water}", Expect: []string{"2 INFO {water} type=source health=100"}},
+		},
+	},
+	{
+		Name: "RegisterRequiresType",
+		Steps: []Step{
+			{Send: "1 REGISTER {water}", Expect: []string{"1 ERR"}},
+		},
+	},
+	{
+		Name: "RegisterWithLocation",
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source location=45.5,-122.6", Expect: []string{"1 ACK"}},
+			{Send: "2 INFO {water}", Expect: []string{"2 INFO {water} type=source health=100 location=45.500000,-122.600000"}},
+		},
+	},
+	{
+		Name: "RegisterBadLocation",
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source location=91,0", Expect: []string{"1 ERR"}},
+			{Send: "2 REGISTER {water} source somewhere", Expect: []string{"2 ERR"}},
+		},
+	},
+	{
+		Name:  "DoubleRegistrationFails",
+		Conns: 2,
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source", Expect: []string{"1 ACK"}},
+			{Send: "2 REGISTER {water} barrel", Expect: []string{"2 ERR"}},
+			{Conn: 1, Send: "1 REGISTER {water} source", Expect: []string{"1 ERR"}},
+		},
+	},
+	{
+		Name: "Unregister",
+		Steps: []Step{
+			{Send: "1 UNREGISTER", Expect: []string{"1 ERR"}},
+			{Send: "2 REGISTER {water} source", Expect: []string{"2 ACK"}},
+			{Send: "3 UNREGISTER", Expect: []string{"3 ACK"}},
+			{Send: "4 METRIC level 1", Expect: []string{"4 ERR"}},
+		},
+	},
+	{
+		Name: "InfoUnknownStation",
+		Steps: []Step{
+			{Send: "1 INFO {nowhere}", Expect: []string{"1 ERR"}},
+		},
+	},
+	{
+		Name: "MetricRequiresRegistration",
+		Steps: []Step{
+			{Send: "1 METRIC level 1", Expect: []string{"1 ERR"}},
+		},
+	},
+	{
+		Name: "MetricRequiresNumber",
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source", Expect: []string{"1 ACK"}},
+			{Send: "2 METRIC level something", Expect: []string{"2 ERR"}},
+		},
+	},
+	{
+		Name: "MetricNames",
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source", Expect: []string{"1 ACK"}},
+			{Send: "2 METRIC pump.* 1", Expect: []string{"2 ERR"}},
+			{Send: "3 METRIC pump..rpm 1", Expect: []string{"3 ERR"}},
+			{Send: "4 METRIC pump.motor.temp 1", Expect: []string{"4 ACK"}},
+			{Send: "5 METRICS {water} pump.motor.temp", Expect: []string{"5 METRICS {water} pump.motor.temp {ts}:1.00"}},
+		},
+	},
+	{
+		Name: "Metrics",
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source", Expect: []string{"1 ACK"}},
+			{Send: "2 METRIC level 1", Expect: []string{"2 ACK"}},
+			{Send: "3 METRIC level 2", Expect: []string{"3 ACK"}},
+			{Send: "4 METRICS {water}", Expect: []string{"4 METRICS {water} level"}},
+			{Send: "5 METRICS {water} level", Expect: []string{"5 METRICS {water} level {ts}:1.00 {ts}:2.00"}},
+			{Send: "6 METRICS {water} pressure", Expect: []string{"6 ERR"}},
+		},
+	},
+	{
+		Name: "MetricsLastAcrossStations",
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source", Expect: []string{"1 ACK"}},
+			{Send: "2 METRIC {level} 1", Expect: []string{"2 ACK"}},
+			{Send: "3 METRICS * {level} LAST", Expect: []string{"3 METRICS * {level} LAST {water}:{ts}:1.00"}},
+			{Send: "4 METRICS * {level}", Expect: []string{"4 ERR"}},
+			{Send: "5 REGISTER * source", Expect: []string{"5 ERR"}},
+		},
+	},
+	{
+		Name: "MetricBackfill",
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source", Expect: []string{"1 ACK"}},
+			{Send: "2 METRIC level 3", Expect: []string{"2 ACK"}},
+			{Send: "3 METRIC level 1 -20", Expect: []string{"3 ACK"}},
+			{Send: "4 METRIC level 2 -10", Expect: []string{"4 ACK"}},
+			{Send: "5 METRICS {water} level", Expect: []string{"5 METRICS {water} level {ts}:1.00 {ts}:2.00 {ts}:3.00"}},
+			{Send: "6 METRIC level 1 99999999999", Expect: []string{"6 ERR"}},
+			{Send: "7 METRIC level 1 soon", Expect: []string{"7 ERR"}},
+		},
+	},
+	{
+		Name: "LogRequiresRegistration",
+		Steps: []Step{
+			{Send: "1 LOG info hello", Expect: []string{"1 ERR"}},
+		},
+	},
+	{
+		Name: "LogRequiresLevel",
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source", Expect: []string{"1 ACK"}},
+			{Send: "2 LOG loud hello", Expect: []string{"2 ERR"}},
+			{Send: "3 LOG info", Expect: []string{"3 ERR"}},
+		},
+	},
+	{
+		Name:  "Run",
+		Conns: 2,
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source", Expect: []string{"1 ACK"}},
+			{Conn: 1, Send: "2 RUN {water} fill 60", Expect: []string{"2 ACK"}},
+			{Expect: []string{"2 RUN fill 60"}},
+			{Send: "2 PROGRESS 50%", Expect: []string{"2 ACK"}},
+			{Conn: 1, Expect: []string{"2 PROGRESS 50%"}},
+			{Send: "2 DONE 0", Expect: []string{"2 ACK"}},
+			{Conn: 1, Expect: []string{"2 DONE 0"}},
+		},
+	},
+	{
+		Name:  "RunFails",
+		Conns: 2,
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source", Expect: []string{"1 ACK"}},
+			{Conn: 1, Send: "2 RUN {water} fill 60", Expect: []string{"2 ACK"}},
+			{Expect: []string{"2 RUN fill 60"}},
+			{Send: "2 ERR", Expect: []string{"2 ACK"}},
+			{Conn: 1, Expect: []string{"2 ERR"}},
+		},
+	},
+	{
+		Name: "RunUnknownStation",
+		Steps: []Step{
+			{Send: "1 RUN {nowhere} fill 60", Expect: []string{"1 ERR"}},
+		},
+	},
+	{
+		Name:  "Cancel",
+		Conns: 3,
+		Steps: []Step{
+			{Send: "1 REGISTER {water} source", Expect: []string{"1 ACK"}},
+			{Conn: 1, Send: "2 RUN {water} fill 60", Expect: []string{"2 ACK"}},
+			{Expect: []string{"2 RUN fill 60"}},
+			// only the client that started a run can cancel it.
+			{Conn: 2, Send: "2 CANCEL", Expect: []string{"2 ERR"}},
+			{Conn: 1, Send: "2 CANCEL", Expect: []string{"2 ACK"}},
+			{Expect: []string{"2 CANCEL"}},
+			{Send: "2 ERR", Expect: []string{"2 ACK"}},
+			{Conn: 1, Expect: []string{"2 ERR"}},
+			{Conn: 1, Send: "2 CANCEL", Expect: []string{"2 ERR"}},
+		},
+	},
+	{
+		Name: "Batch",
+		Steps: []Step{
+			{Send: "1 BEGIN", Expect: []string{"1 ACK"}},
+			// nothing in a batch is answered until it's committed.
+			{Send: "2 REGISTER {water} source"},
+			{Send: "3 METRIC level 1"},
+			{Send: "4 COMMIT", Expect: []string{"2 ACK", "3 ACK", "4 COMMIT 2"}},
+			{Send: "5 BEGIN", Expect: []string{"5 ACK"}},
+			{Send: "6 METRIC level 2"},
+			{Send: "7 ABORT", Expect: []string{"7 ACK"}},
+			{Send: "8 METRICS {water} level", Expect: []string{"8 METRICS {water} level {ts}:1.00"}},
+		},
+	},
+}
@@ -0,0 +1,170 @@
+// Package conformance checks that a server speaks the drops line protocol,
+// as described in PROTOCOL.md. It's for other implementations of the server
+// to test themselves against, and keeps the reference server honest too:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, "localhost:19406")
+//	}
+//
+// Stations are given names no other run uses, so the suite can be run
+// against a server that's already in use. Admin commands, and anything that
+// depends on how the server is configured (like how many points it keeps),
+// are left out.
+package conformance
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Case is a scripted exchange with a server, over one or more connections.
+type Case struct {
+	Name string
+	// Conns is how many connections the case needs (at least 1).
+	Conns int
+	Steps []Step
+}
+
+// Step sends a line on one of a case's connections, and expects lines back
+// on it. Either may be left out, to wait for a line sent on behalf of
+// another connection, or to send a line that isn't answered right away.
+//
+// In both, {name} stands for a name unique to the run of the case, like
+// {water} for a station's.
+// In expected lines, {ts} stands for any timestamp, and a line of just ERR
+// also matches an ERR with a reason after it, since strict servers give one.
+type Step struct {
+	Conn   int
+	Send   string
+	Expect []string
+}
+
+// Option configures a run of the suite.
+type Option func(*runner)
+
+// WithTLS connects to the server over TLS, with config.
+func WithTLS(config *tls.Config) Option {
+	return func(r *runner) {
+		r.config = config
+	}
+}
+
+// WithTimeout is how long to wait for each expected line, 5 seconds by
+// default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *runner) {
+		r.timeout = timeout
+	}
+}
+
+type runner struct {
+	addr    string
+	config  *tls.Config
+	timeout time.Duration
+}
+
+// runs tells apart the stations of every run in the process.
+var runs uint64
+
+// Run runs every case in Cases against the server at addr, each as a
+// subtest.
+func Run(t *testing.T, addr string, opts ...Option) {
+	r := &runner{addr: addr, timeout: 5 * time.Second}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	for _, c := range Cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			suffix := fmt.Sprintf("-%x-%d", time.Now().UnixNano(), atomic.AddUint64(&runs, 1))
+			if err := r.run(c, suffix); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// run plays a case out on fresh connections.
+func (r *runner) run(c Case, suffix string) error {
+	conns := make([]net.Conn, max(c.Conns, 1))
+	readers := make([]*bufio.Reader, len(conns))
+	for i := range conns {
+		conn, err := r.dial()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conns[i], readers[i] = conn, bufio.NewReader(conn)
+	}
+
+	for _, step := range c.Steps {
+		if step.Conn >= len(conns) {
+			return fmt.Errorf("step on connection %d of %d", step.Conn, len(conns))
+		}
+		conn, reader := conns[step.Conn], readers[step.Conn]
+
+		if step.Send != "" {
+			line := named(step.Send, suffix)
+			if _, err := fmt.Fprintf(conn, "%s\n", line); err != nil {
+				return fmt.Errorf("sending `%s`: %v", line, err)
+			}
+		}
+
+		for _, want := range step.Expect {
+			conn.SetReadDeadline(time.Now().Add(r.timeout))
+			got, err := reader.ReadString('\n')
+			if err != nil {
+				return fmt.Errorf("after `%s`, expected `%s` on connection %d: %v", named(step.Send, suffix), named(want, suffix), step.Conn, err)
+			}
+			got = strings.TrimRight(got, "\r\n")
+			if !matches(named(want, suffix), got) {
+				return fmt.Errorf("after `%s`, expected `%s` on connection %d, got `%s`", named(step.Send, suffix), named(want, suffix), step.Conn, got)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *runner) dial() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	if r.config != nil {
+		d := tls.Dialer{Config: r.config}
+		return d.DialContext(ctx, "tcp", r.addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", r.addr)
+}
+
+// placeholder is {name}, other than {ts}.
+var placeholder = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// named gives the stations in a line their names for a run.
+func named(line, suffix string) string {
+	return placeholder.ReplaceAllStringFunc(line, func(p string) string {
+		if p == "{ts}" {
+			return p
+		}
+		return strings.Trim(p, "{}") + suffix
+	})
+}
+
+// matches reports whether a line received matches the one expected.
+func matches(want, got string) bool {
+	pattern := regexp.QuoteMeta(want)
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta("{ts}"), `-?[0-9]+`)
+	if strings.HasSuffix(want, " ERR") || want == "ERR" {
+		pattern += `( .*)?`
+	}
+	return regexp.MustCompile("^" + pattern + "$").MatchString(got)
+}
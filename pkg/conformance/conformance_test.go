@@ -0,0 +1,55 @@
+package conformance
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	"github.com/silversupreme/drops/pkg/server"
+)
+
+func serve(t *testing.T, opts ...server.Option) string {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.New(listener, 4, clock.New(), opts...)
+	go s.Serve(context.Background())
+
+	return listener.Addr().String()
+}
+
+func TestReferenceServer(t *testing.T) {
+	addr := serve(t)
+
+	// twice, to make sure runs don't trip over each other.
+	Run(t, addr)
+	Run(t, addr)
+}
+
+func TestReferenceServerStrict(t *testing.T) {
+	Run(t, serve(t, server.WithStrictProtocol()))
+}
+
+func TestMatches(t *testing.T) {
+	for _, c := range []struct {
+		want, got string
+		ok        bool
+	}{
+		{"1 ACK", "1 ACK", true},
+		{"1 ACK", "1 ACK ", false},
+		{"1 ERR", "1 ERR", true},
+		{"1 ERR", "1 ERR E_BADARG pos=3 token=abc", true},
+		{"1 ERR", "1 ERRATIC", false},
+		{"1 METRICS w level {ts}:1.00", "1 METRICS w level 1700000000:1.00", true},
+		{"1 METRICS w level {ts}:1.00", "1 METRICS w level -20:1.00", true},
+		{"1 METRICS w level {ts}:1.00", "1 METRICS w level soon:1.00", false},
+		{"1 METRICS * level LAST", "1 METRICS x level LAST", false},
+	} {
+		if ok := matches(c.want, c.got); ok != c.ok {
+			t.Errorf("matches(%q, %q) = %v, expected %v", c.want, c.got, ok, c.ok)
+		}
+	}
+}
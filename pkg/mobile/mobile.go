@@ -0,0 +1,195 @@
+// Package mobile binds the client for Android and iOS apps with gomobile, so
+// a field tech's app can list stations, look at their metrics, run their
+// functions and follow new points without speaking the line protocol itself:
+//
+//	gomobile bind -target=android ./pkg/mobile
+//	gomobile bind -target=ios ./pkg/mobile
+//
+// gomobile only binds simple types, so lists come back as types with Len
+// and Get, modifiers are passed as one space-separated string, timestamps
+// are unix seconds, and callbacks are interfaces the app implements. Every
+// call blocks until the server answers, so apps make them off their UI
+// thread.
+package mobile
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+
+	"github.com/silversupreme/drops/pkg/client"
+)
+
+// Client connects to a drops server over mTLS.
+type Client struct {
+	c *client.Client
+
+	// cancelled by Close, to end the calls and subscriptions in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewClient returns a client for the server at addr, which presents the
+// certificate and key in certPEM and keyPEM, and trusts servers whose
+// certificate is signed by the CA in caPEM. It connects once it's first
+// used.
+//
+// Unless environment is given, functions aren't run on servers that say
+// they're in prod; with it, they're only run on servers that say they're in
+// that environment.
+func NewClient(addr, environment string, caPEM, certPEM, keyPEM []byte) (*Client, error) {
+	config, err := client.ParseTLSConfig(caPEM, certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(addr, environment, config), nil
+}
+
+func newClient(addr, environment string, config *tls.Config) *Client {
+	var opts []client.Option
+	if environment != "" {
+		opts = append(opts, client.WithEnvironment(environment))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{c: client.New(addr, config, opts...), ctx: ctx, cancel: cancel}
+}
+
+// Close ends the client's subscriptions, fails the calls it has in flight
+// and closes its connection.
+func (c *Client) Close() error {
+	c.cancel()
+	return c.c.Close()
+}
+
+// Station is a station online on the server.
+type Station struct {
+	Name string
+	Type string
+	// Health is the station's health score, out of 100.
+	Health int
+	// Deviating is set if the station is out of line with its type.
+	Deviating bool
+	// Outdated is set if the station runs older firmware than the latest
+	// for its type.
+	Outdated bool
+}
+
+// Stations is a list of stations.
+type Stations struct {
+	stations []client.Station
+}
+
+// Len returns how many stations there are.
+func (s *Stations) Len() int {
+	return len(s.stations)
+}
+
+// Get returns the i-th station.
+func (s *Stations) Get(i int) *Station {
+	st := s.stations[i]
+	return &Station{Name: st.Name, Type: st.Type, Health: st.Health, Deviating: st.Deviating, Outdated: st.Outdated}
+}
+
+// List returns the stations online on the server.
+func (c *Client) List() (*Stations, error) {
+	stations, err := c.c.List(c.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Stations{stations: stations}, nil
+}
+
+// Point is one measurement of a station's metric.
+type Point struct {
+	Station string
+	Metric  string
+	// Ts is when it was measured, in unix seconds.
+	Ts    int64
+	Value float64
+	// Replay is set on points a subscription was sent from the history kept
+	// before it started.
+	Replay bool
+}
+
+func newPoint(p client.Point) *Point {
+	return &Point{Station: p.Station, Metric: p.Metric, Ts: p.Ts.Unix(), Value: p.Value, Replay: p.Replay}
+}
+
+// Points is a list of points.
+type Points struct {
+	points []client.Point
+}
+
+// Len returns how many points there are.
+func (p *Points) Len() int {
+	return len(p.points)
+}
+
+// Get returns the i-th point.
+func (p *Points) Get(i int) *Point {
+	return newPoint(p.points[i])
+}
+
+// Metrics returns the points the server kept of a station's metric, oldest
+// first. modifiers are METRICS modifiers, like "from=-1h LAST", or empty.
+func (c *Client) Metrics(station, metric, modifiers string) (*Points, error) {
+	points, err := c.c.Metrics(c.ctx, station, metric, strings.Fields(modifiers)...)
+	if err != nil {
+		return nil, err
+	}
+	return &Points{points: points}, nil
+}
+
+// ProgressHandler hears about a run's progress.
+type ProgressHandler interface {
+	OnProgress(progress string)
+}
+
+// Run runs a function on a station, and returns its result once the station
+// is done. Progress the station reports along the way is passed to
+// progress, if it isn't nil.
+func (c *Client) Run(station, fn, param string, progress ProgressHandler) (string, error) {
+	var onProgress func(string)
+	if progress != nil {
+		onProgress = progress.OnProgress
+	}
+	return c.c.Run(c.ctx, station, fn, param, onProgress)
+}
+
+// PointHandler hears about a subscription's points.
+type PointHandler interface {
+	OnPoint(p *Point)
+	// OnError is called if the subscription ends before it's cancelled,
+	// because the server rejected it or sent something that made no sense.
+	OnError(message string)
+}
+
+// Subscription is a stream of new points.
+type Subscription struct {
+	cancel context.CancelFunc
+}
+
+// Cancel ends the subscription.
+func (s *Subscription) Cancel() {
+	s.cancel()
+}
+
+// Subscribe passes each new point of a station's metric to handler, on a
+// goroutine of its own, until it's cancelled or the client is closed. The
+// station may be * for every station and the metric a pattern, and
+// modifiers are SUBSCRIBE modifiers, like "every=10s since=1h", or empty.
+// Like the client's subscriptions, it reconnects whenever its connection
+// drops.
+func (c *Client) Subscribe(station, metric, modifiers string, handler PointHandler) *Subscription {
+	ctx, cancel := context.WithCancel(c.ctx)
+	go func() {
+		err := c.c.Subscribe(ctx, station, metric, func(p client.Point) {
+			handler.OnPoint(newPoint(p))
+		}, strings.Fields(modifiers)...)
+		if ctx.Err() == nil {
+			handler.OnError(err.Error())
+		}
+	}()
+	return &Subscription{cancel: cancel}
+}
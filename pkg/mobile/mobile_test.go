@@ -0,0 +1,130 @@
+package mobile
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/silversupreme/drops/pkg/server"
+)
+
+type progressFunc func(string)
+
+func (f progressFunc) OnProgress(progress string) { f(progress) }
+
+type pointHandler struct {
+	points chan *Point
+	errors chan string
+}
+
+func (h pointHandler) OnPoint(p *Point)       { h.points <- p }
+func (h pointHandler) OnError(message string) { h.errors <- message }
+
+func TestClient(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.New(listener, 4, clock.NewMock()).Serve(context.Background())
+	addr := listener.Addr().String()
+
+	// a station that reports its level, and echoes runs with some progress
+	// first.
+	station, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	reader := bufio.NewReader(station)
+	fmt.Fprintf(station, "1 REGISTER water source\n2 METRIC level 1.5\n")
+	for _, want := range []string{"1 ACK\n", "2 ACK\n"} {
+		if resp, err := reader.ReadString('\n'); err != nil || resp != want {
+			t.Fatalf("setting up the station: got %q, %v", resp, err)
+		}
+	}
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			// [uid] RUN echo [param]
+			if fields := strings.Fields(line); len(fields) == 4 && fields[1] == "RUN" {
+				fmt.Fprintf(station, "%s PROGRESS half\n%s DONE %s\n", fields[0], fields[0], fields[3])
+			}
+		}
+	}()
+
+	c := newClient(addr, "", nil)
+	defer c.Close()
+
+	stations, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stations.Len() != 1 || *stations.Get(0) != (Station{Name: "water", Type: "source", Health: 100}) {
+		t.Fatalf("unexpected stations %+v", stations.stations)
+	}
+
+	points, err := c.Metrics("water", "level", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points.Len() != 1 || *points.Get(0) != (Point{Station: "water", Metric: "level", Value: 1.5}) {
+		t.Fatalf("unexpected points %+v", points.points)
+	}
+
+	var progress []string
+	result, err := c.Run("water", "echo", "hi", progressFunc(func(p string) { progress = append(progress, p) }))
+	if err != nil || result != "hi" || len(progress) != 1 || progress[0] != "half" {
+		t.Fatalf("unexpected run: %q, %v, progress %v", result, err, progress)
+	}
+
+	h := pointHandler{points: make(chan *Point, 10), errors: make(chan string, 1)}
+	sub := c.Subscribe("water", "level", "since=1h", h)
+	defer sub.Cancel()
+	select {
+	case p := <-h.points:
+		if !p.Replay || p.Value != 1.5 {
+			t.Fatalf("expected the kept point to be replayed, got %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no point was delivered")
+	}
+
+	bad := c.Subscribe("water", "level", "every=soon", h)
+	defer bad.Cancel()
+	select {
+	case <-h.errors:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the subscription to be rejected")
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	const dir = "../../ssl/insecure/"
+
+	var pems [3][]byte
+	for i, name := range []string{"ca.crt", "server.crt", "server.key"} {
+		var err error
+		if pems[i], err = os.ReadFile(dir + name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewClient("drops:19406", "", pems[0], pems[1], pems[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if _, err := NewClient("drops:19406", "", pems[0], pems[1], pems[1]); err == nil {
+		t.Fatal("expected a certificate without its key to be rejected")
+	}
+}
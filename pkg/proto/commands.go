@@ -0,0 +1,407 @@
+package proto
+
+// Commands are every command in the protocol, in the order PROTOCOL.md
+// introduces them.
+var Commands = []Command{
+	// stations
+	{
+		Name:      "REGISTER",
+		Summary:   "Register with the server as a station.",
+		Usage:     []string{"REGISTER [name] [type]", "REGISTER [name] [type] location=[lat],[lon] functions=[function],... firmware=[version]"},
+		MinArgs:   2,
+		MaxArgs:   5,
+		Writes:    true,
+		Responses: []string{"ACK"},
+		Forwards:  []string{"config CONFIG [version] [blob]"},
+	},
+	{
+		Name:      "UNREGISTER",
+		Summary:   "Unregister from the server, failing runs in flight.",
+		Usage:     []string{"UNREGISTER"},
+		Station:   true,
+		Writes:    true,
+		Responses: []string{"ACK"},
+		Forwards:  []string{"[run uid] ERR UNREGISTERED"},
+	},
+	{
+		Name:      "PING",
+		Summary:   "Keep alive.",
+		Usage:     []string{"PING"},
+		Responses: []string{"PONG"},
+	},
+	{
+		Name:      "DONE",
+		Summary:   "Return the result of a function call.",
+		Usage:     []string{"DONE [result]"},
+		MaxArgs:   1,
+		Station:   true,
+		Responses: []string{"ACK"},
+		Forwards:  []string{"[uid] DONE [result]"},
+	},
+	{
+		Name:      "ERR",
+		Summary:   "Return an error to the client of a function call.",
+		Usage:     []string{"ERR"},
+		Station:   true,
+		Responses: []string{"ACK"},
+		Forwards:  []string{"[uid] ERR"},
+	},
+	{
+		Name:      "PROGRESS",
+		Summary:   "Report progress on a long-running function call.",
+		Usage:     []string{"PROGRESS [progress]"},
+		MaxArgs:   1,
+		Station:   true,
+		Responses: []string{"ACK"},
+		Forwards:  []string{"[uid] PROGRESS [progress]"},
+	},
+	{
+		Name:      "LOG",
+		Summary:   "Log a message.",
+		Usage:     []string{"LOG [level] [message]"},
+		MinArgs:   2,
+		MaxArgs:   Many,
+		Station:   true,
+		Writes:    true,
+		Responses: []string{"ACK"},
+		Forwards:  []string{"[uid] LOG [name] [ts] [level] [message]"},
+	},
+	{
+		Name:      "METRIC",
+		Summary:   "Report a metric point, now or backfilled at [ts].",
+		Usage:     []string{"METRIC [name] [value]", "METRIC [name] [value] [ts]"},
+		MinArgs:   2,
+		MaxArgs:   3,
+		Station:   true,
+		Writes:    true,
+		Responses: []string{"ACK"},
+		Forwards:  []string{"[uid] METRIC [station] [metric] [ts]:[value]"},
+	},
+	{
+		Name:      "CONFIGURED",
+		Summary:   "Acknowledge applying a configuration version.",
+		Usage:     []string{"CONFIGURED [version]"},
+		MinArgs:   1,
+		MaxArgs:   1,
+		Station:   true,
+		Writes:    true,
+		Responses: []string{"ACK"},
+	},
+	{
+		Name:      "BEGIN",
+		Summary:   "Hold back the following commands until COMMIT.",
+		Usage:     []string{"BEGIN"},
+		Responses: []string{"ACK"},
+	},
+	{
+		Name:      "COMMIT",
+		Summary:   "Apply the commands since BEGIN all together, or none of them.",
+		Usage:     []string{"COMMIT"},
+		Responses: []string{"COMMIT [count]"},
+	},
+	{
+		Name:      "ABORT",
+		Summary:   "Drop the commands since BEGIN.",
+		Usage:     []string{"ABORT"},
+		Responses: []string{"ACK"},
+	},
+
+	// clients
+	{
+		Name:      "ENCODING",
+		Summary:   "Choose how measurements and events are sent.",
+		Usage:     []string{"ENCODING", "ENCODING text|jsonl"},
+		MaxArgs:   1,
+		Responses: []string{"ENCODING text|jsonl"},
+	},
+	{
+		Name:      "HELLO",
+		Summary:   "Ask which environment the server is part of.",
+		Usage:     []string{"HELLO"},
+		Responses: []string{"HELLO [environment]"},
+	},
+	{
+		Name:      "RUN",
+		Summary:   "Trigger a function of a connected station.",
+		Usage:     []string{"RUN [name] [function] [parameter]", "RUN idempotent=true [name] [function] [parameter]"},
+		MinArgs:   2,
+		MaxArgs:   4,
+		Writes:    true,
+		Responses: []string{"ACK", "PROGRESS [progress]", "DONE [result]", "ERR"},
+		Forwards:  []string{"[uid] RUN [function] [parameter]"},
+	},
+	{
+		Name:      "CANCEL",
+		Summary:   "Ask the station to cancel a function call started by this client.",
+		Usage:     []string{"CANCEL"},
+		Writes:    true,
+		Responses: []string{"ACK"},
+		Forwards:  []string{"[uid] CANCEL"},
+	},
+	{
+		Name:      "LIST",
+		Summary:   "Request a list of the current stations, optionally only those with some tags.",
+		Usage:     []string{"LIST", "LIST [key]=[value] ..."},
+		MaxArgs:   Many,
+		Responses: []string{"LIST [name]:[type][!][^]:[health] ..."},
+	},
+	{
+		Name:      "WATCH",
+		Summary:   "Stream stations joining and leaving.",
+		Usage:     []string{"WATCH"},
+		Responses: []string{"ACK", "JOINED [name] [type]", "LEFT [name]"},
+	},
+	{
+		Name:      "TAG",
+		Summary:   "Tag a station, as the station itself or an admin, or remove a tag.",
+		Usage:     []string{"TAG [key] [value]", "TAG [name] [key] [value]"},
+		MinArgs:   1,
+		MaxArgs:   3,
+		Writes:    true,
+		Responses: []string{"ACK"},
+	},
+	{
+		Name:      "LOGS",
+		Summary:   "Request a station's recent log lines, and optionally follow new ones.",
+		Usage:     []string{"LOGS [name]", "LOGS [name] -f"},
+		MinArgs:   1,
+		MaxArgs:   2,
+		Responses: []string{"LOG [name] [ts] [level] [message]", "LOGS [name] [count]"},
+	},
+	{
+		Name:      "NOTE",
+		Summary:   "Attach a note to a station, about now or a stretch of time.",
+		Usage:     []string{"NOTE [name] [text]", "NOTE [name] from=[time] to=[time] tz=[zone] [text]"},
+		MinArgs:   2,
+		MaxArgs:   Many,
+		Admin:     true,
+		Writes:    true,
+		Responses: []string{"ACK"},
+	},
+	{
+		Name:      "NOTES",
+		Summary:   "Request the notes on a station.",
+		Usage:     []string{"NOTES [name] from=[time] to=[time] tz=[zone]"},
+		MinArgs:   1,
+		MaxArgs:   4,
+		Responses: []string{"NOTE [name] [added] [from] [to] [text] ...", "NOTES [name] [count]"},
+	},
+	{
+		Name:      "EVENTS",
+		Summary:   "Request the event journal.",
+		Usage:     []string{"EVENTS", "EVENTS [station] [since]"},
+		MaxArgs:   2,
+		Responses: []string{"EVENT [seq] [ts] [kind] [station] [detail] ...", "EVENTS [count]"},
+	},
+	{
+		Name:      "SUBSCRIBE",
+		Summary:   "Stream new events or metric points.",
+		Usage:     []string{"SUBSCRIBE EVENTS [station]", "SUBSCRIBE ALERTS [station]", "SUBSCRIBE [station] [metric] every=[duration] delta>[float] since=[duration] durable=[name]"},
+		MinArgs:   1,
+		MaxArgs:   Many,
+		Responses: []string{"ACK", "EVENT [seq] [ts] [kind] [station] [detail] ...", "ALERT [id] [ts] [kind] [station] [message] ...", "METRIC [station] [metric] [ts]:[value]", "METRIC [station] [metric] [ts]:[value] [offset]", "REPLAY [station] [metric] [ts]:[value]"},
+	},
+	{
+		Name:      "UNSUBSCRIBE",
+		Summary:   "Stop a subscription, or every subscription to a metric.",
+		Usage:     []string{"UNSUBSCRIBE", "UNSUBSCRIBE [station] [metric]"},
+		MaxArgs:   2,
+		Responses: []string{"ACK", "UNSUBSCRIBE [count]"},
+	},
+	{
+		Name:      "CURSOR",
+		Summary:   "Commit, show or drop a durable subscription's offset.",
+		Usage:     []string{"CURSOR [name]", "CURSOR [name] [offset]", "CURSOR [name] DROP"},
+		MinArgs:   1,
+		MaxArgs:   2,
+		Responses: []string{"ACK", "CURSOR [name] [offset] [queued]"},
+	},
+	{
+		Name:      "INFO",
+		Summary:   "Request details about a station.",
+		Usage:     []string{"INFO [name]"},
+		MinArgs:   1,
+		MaxArgs:   1,
+		Responses: []string{"INFO [name] type=[type] health=[health] ..."},
+	},
+	{
+		Name:    "METRICS",
+		Summary: "Request a station's metrics, or measurements of one or more of them.",
+		Usage: []string{
+			"METRICS [name]",
+			"METRICS [name] [metric] from=[time] to=[time] tz=[zone] LAST unit=[unit]",
+			"METRICS [name] [pattern]",
+			"METRICS * [metric] LAST unit=[unit]",
+		},
+		MinArgs: 1,
+		MaxArgs: 7,
+		Responses: []string{
+			"METRICS [name] [metric] ...",
+			"METRICS [name] [metric] [ts]:[value] ...",
+			"METRIC [name] [metric] [ts]:[value] ...",
+			"METRICS [name] [pattern] [n]",
+			"METRICS * [metric] LAST unit=[unit] [name]:[ts]:[value] ...",
+		},
+	},
+	{
+		Name:      "TOP",
+		Summary:   "Find the stations with the lowest or highest value of a metric.",
+		Usage:     []string{"TOP [metric] [n] MIN|MAX"},
+		MinArgs:   3,
+		MaxArgs:   3,
+		Responses: []string{"TOP [metric] [n] MIN|MAX [name]:[ts]:[value] ..."},
+	},
+	{
+		Name:      "QUALITY",
+		Summary:   "Request a data quality report on a station.",
+		Usage:     []string{"QUALITY [name] from=[time] to=[time] tz=[zone]"},
+		MinArgs:   1,
+		MaxArgs:   4,
+		Responses: []string{"QUALITY [name] [metric]=points:[n],gaps:[n],rejected:[n],duplicates:[n],skew:[duration] ..."},
+	},
+	{
+		Name:      "ALERTS",
+		Summary:   "Request the open alerts, and who acknowledged them.",
+		Usage:     []string{"ALERTS", "ALERTS open|acked"},
+		MaxArgs:   1,
+		Responses: []string{"ALERT [id] [ts] [kind] [station] [message] ...", "ACKED [id] [owner] [ts] [note] ...", "ALERTS [count]"},
+	},
+	{
+		Name:      "ACKALERT",
+		Summary:   "Acknowledge an open alert, taking ownership of it.",
+		Usage:     []string{"ACKALERT [id] [note] ..."},
+		MinArgs:   1,
+		MaxArgs:   Many,
+		Admin:     true,
+		Writes:    true,
+		Responses: []string{"ACK"},
+	},
+	{
+		Name:      "THRESHOLDS",
+		Summary:   "Request the threshold alert rules, or (as an admin) set or delete one.",
+		Usage:     []string{"THRESHOLDS", "THRESHOLDS SET [name] [station].[metric] [op] [value] for [duration]", "THRESHOLDS DEL [name]"},
+		MaxArgs:   Many,
+		Writes:    true,
+		Responses: []string{"THRESHOLD [name] [station].[metric] [op] [value] for [duration] ...", "THRESHOLDS [count]", "ACK"},
+	},
+	{
+		Name:      "CONFIG",
+		Summary:   "Get a station's own configuration, or (as an admin) set, get or delete a target's.",
+		Usage:     []string{"CONFIG GET", "CONFIG SET [target] [blob]", "CONFIG GET [target]", "CONFIG DEL [target]"},
+		MinArgs:   1,
+		MaxArgs:   Many,
+		Writes:    true,
+		Responses: []string{"ACK", "CONFIG [target] [version]", "CONFIG [target] [version] [blob]"},
+		Forwards:  []string{"config CONFIG [version] [blob]"},
+	},
+	{
+		Name:      "FIRMWARE",
+		Summary:   "Request the firmware of every station, or the latest of every type, or (as an admin) set or delete a type's latest.",
+		Usage:     []string{"FIRMWARE", "FIRMWARE LATEST", "FIRMWARE SET [type] [version]", "FIRMWARE DEL [type]"},
+		MaxArgs:   3,
+		Writes:    true,
+		Responses: []string{"FIRMWARE [name]:[version][^] ...", "FIRMWARE LATEST [type]:[version] ...", "ACK"},
+	},
+
+	// admins
+	{
+		Name:      "BLOCK",
+		Summary:   "Block a client certificate.",
+		Usage:     []string{"BLOCK [fingerprint]"},
+		MinArgs:   1,
+		MaxArgs:   1,
+		Admin:     true,
+		Writes:    true,
+		Responses: []string{"ACK"},
+	},
+	{
+		Name:      "UNBLOCK",
+		Summary:   "Lift a block.",
+		Usage:     []string{"UNBLOCK [fingerprint]"},
+		MinArgs:   1,
+		MaxArgs:   1,
+		Admin:     true,
+		Writes:    true,
+		Responses: []string{"ACK"},
+	},
+	{
+		Name:      "BLOCKLIST",
+		Summary:   "List blocked fingerprints.",
+		Usage:     []string{"BLOCKLIST"},
+		Admin:     true,
+		Responses: []string{"BLOCKLIST [fingerprint] ..."},
+	},
+	{
+		Name:      "PROBES",
+		Summary:   "Show scanner telemetry.",
+		Usage:     []string{"PROBES"},
+		Admin:     true,
+		Responses: []string{"PROBES [ip]:handshake=[n],blocked=[n],protocol=[n] ... [ip]:denied=[ts] ..."},
+	},
+	{
+		Name:      "FORGET",
+		Summary:   "Forget an offline station.",
+		Usage:     []string{"FORGET [name]"},
+		MinArgs:   1,
+		MaxArgs:   1,
+		Admin:     true,
+		Writes:    true,
+		Responses: []string{"ACK"},
+	},
+	{
+		Name:      "PURGE",
+		Summary:   "Clear a metric's history.",
+		Usage:     []string{"PURGE [name] [metric]"},
+		MinArgs:   2,
+		MaxArgs:   2,
+		Admin:     true,
+		Writes:    true,
+		Responses: []string{"ACK"},
+	},
+	{
+		Name:      "RENAME",
+		Summary:   "Rename a station.",
+		Usage:     []string{"RENAME [old name] [new name]"},
+		MinArgs:   2,
+		MaxArgs:   2,
+		Admin:     true,
+		Writes:    true,
+		Responses: []string{"ACK"},
+	},
+	{
+		Name:      "DUMP",
+		Summary:   "Dump the server's state.",
+		Usage:     []string{"DUMP"},
+		Admin:     true,
+		Responses: []string{"STATE [json]", "DUMP [n]"},
+	},
+	{
+		Name:      "LOAD",
+		Summary:   "Load a dumped record.",
+		Usage:     []string{"LOAD [json]"},
+		MinArgs:   1,
+		MaxArgs:   Many,
+		Admin:     true,
+		Writes:    true,
+		Responses: []string{"ACK"},
+	},
+	{
+		Name:      "ADVANCE",
+		Summary:   "Move a simulated clock forward.",
+		Usage:     []string{"ADVANCE [duration]"},
+		MinArgs:   1,
+		MaxArgs:   1,
+		Admin:     true,
+		Writes:    true,
+		Responses: []string{"ADVANCE [ts]"},
+	},
+	{
+		Name:      "CHAOS",
+		Summary:   "List, inject or stop faults for a station or client, in chaos mode.",
+		Usage:     []string{"CHAOS", "CHAOS [target] [fault] ..."},
+		MaxArgs:   Many,
+		Admin:     true,
+		Writes:    true,
+		Responses: []string{"FAULT [target] latency=[duration] drop=[share] ...", "CHAOS [count]", "ACK"},
+	},
+}
@@ -0,0 +1,21 @@
+//go:build ignore
+
+// gen writes the protocol description out to protocol.json.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/silversupreme/drops/pkg/proto"
+)
+
+func main() {
+	b, err := proto.JSON()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("protocol.json", b, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
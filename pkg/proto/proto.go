@@ -0,0 +1,80 @@
+// Package proto describes the drops line protocol in a form programs can
+// use: its commands, how many arguments each takes, and the lines they're
+// answered with. The server checks commands against it before handling
+// them, and it's written out as protocol.json for tooling outside Go, so
+// neither can drift from the code.
+//
+// Lines are [uid] [COMMAND] [args...], separated by single spaces. Argument
+// counts don't include the uid or the command.
+//
+//go:generate go run gen.go
+package proto
+
+import (
+	"encoding/json"
+)
+
+// Many is a Command's MaxArgs when it takes any number of arguments.
+const Many = -1
+
+// Command is one of the protocol's commands.
+type Command struct {
+	Name    string `json:"name"`
+	Summary string `json:"summary"`
+
+	// Usage is each form the command is sent in, with placeholders in
+	// brackets.
+	Usage []string `json:"usage"`
+	// MinArgs and MaxArgs bound how many arguments the command takes
+	// (MaxArgs is Many if there's no bound).
+	MinArgs int `json:"min_args"`
+	MaxArgs int `json:"max_args"`
+
+	// Station is set for commands only registered stations may send, and
+	// Admin for ones only admins may.
+	Station bool `json:"station,omitempty"`
+	Admin   bool `json:"admin,omitempty"`
+	// Writes is set for commands that change something, as opposed to
+	// queries, which are safe to repeat.
+	Writes bool `json:"writes,omitempty"`
+
+	// Responses are the lines the command may be answered with, under its
+	// uid. Every command may also be answered with ERR.
+	Responses []string `json:"responses"`
+	// Forwards are lines the command has the server send to other
+	// connections.
+	Forwards []string `json:"forwards,omitempty"`
+}
+
+// Accepts reports whether the command takes n arguments.
+func (c Command) Accepts(n int) bool {
+	return n >= c.MinArgs && (c.MaxArgs == Many || n <= c.MaxArgs)
+}
+
+// Spec is the whole protocol, as written to protocol.json.
+type Spec struct {
+	Commands []Command `json:"commands"`
+}
+
+var byName = map[string]Command{}
+
+func init() {
+	for _, c := range Commands {
+		byName[c.Name] = c
+	}
+}
+
+// Lookup returns the command called name.
+func Lookup(name string) (Command, bool) {
+	c, ok := byName[name]
+	return c, ok
+}
+
+// JSON is the protocol description written to protocol.json.
+func JSON() ([]byte, error) {
+	b, err := json.MarshalIndent(Spec{Commands: Commands}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
@@ -0,0 +1,54 @@
+package proto
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// protocol.json is checked in, so it's a golden file: it has to be
+// regenerated, with go generate, whenever the protocol changes.
+func TestGolden(t *testing.T) {
+	expected, err := JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile("protocol.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatal("protocol.json is out of date; run go generate ./pkg/proto")
+	}
+}
+
+func TestCommands(t *testing.T) {
+	seen := map[string]bool{}
+	for _, c := range Commands {
+		if seen[c.Name] {
+			t.Errorf("%s is described twice", c.Name)
+		}
+		seen[c.Name] = true
+
+		if c.MinArgs < 0 || (c.MaxArgs != Many && c.MaxArgs < c.MinArgs) {
+			t.Errorf("%s takes between %d and %d args", c.Name, c.MinArgs, c.MaxArgs)
+		}
+		if len(c.Usage) == 0 || len(c.Responses) == 0 {
+			t.Errorf("%s has no usage or responses", c.Name)
+		}
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	run, _ := Lookup("RUN")
+	for n, ok := range map[int]bool{1: false, 2: true, 4: true, 5: false} {
+		if run.Accepts(n) != ok {
+			t.Errorf("expected RUN accepting %d args to be %v", n, ok)
+		}
+	}
+
+	log, _ := Lookup("LOG")
+	if !log.Accepts(100) {
+		t.Error("expected LOG to take any number of args")
+	}
+}
@@ -0,0 +1,27 @@
+// Package retry holds what clients of a drops server share when deciding
+// whether and when to try again: the error for commands the server refused,
+// which trying again won't fix, and how long to wait between connection
+// attempts. It only uses what TinyGo supports, so pkg/station can use it on
+// microcontrollers as well as pkg/client does.
+package retry
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRejected is returned when the server answers a command with ERR.
+var ErrRejected = errors.New("server rejected the command")
+
+// Backoff returns how long to wait after failing to connect, given how long
+// was waited last time: twice as long, between min and max.
+func Backoff(last, min, max time.Duration) time.Duration {
+	if last < min {
+		return min
+	}
+	if last*2 > max {
+		return max
+	}
+	return last * 2
+}
@@ -0,0 +1,15 @@
+package retry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	wait := time.Duration(0)
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if wait = Backoff(wait, time.Second, 5*time.Second); wait != want {
+			t.Fatalf("attempt %d: expected %v, got %v", i, want, wait)
+		}
+	}
+}
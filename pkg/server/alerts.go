@@ -0,0 +1,307 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Notifications that something's wrong (an SLO burning, the watchdog going
+// over a limit) open an alert, which stays open until the matching
+// notification that it's fine again. An operator can acknowledge an open
+// alert to say they own the incident: everyone else can see who, and, with
+// reminders on, the reminders about it stop.
+
+type alertKey struct {
+	// what's wrong, like the SLO that's burning.
+	name    string
+	station string
+}
+
+type alert struct {
+	id      int
+	kind    string
+	station string
+	message string
+	raised  time.Time
+
+	// when the alert was last notified about, for reminders.
+	notified time.Time
+
+	// who acknowledged the alert, when, and what they had to say, once
+	// someone has.
+	owner string
+	acked time.Time
+	note  string
+}
+
+type alertTable struct {
+	m     sync.Mutex
+	next  int
+	open  map[alertKey]*alert
+	every time.Duration
+
+	// clients streaming alerts as they're raised and resolved.
+	subscribers map[*eventSubscriber]struct{}
+}
+
+func newAlertTable() *alertTable {
+	return &alertTable{open: map[alertKey]*alert{}, subscribers: map[*eventSubscriber]struct{}{}}
+}
+
+// publish sends an alert being raised or resolved to its subscribers. a.m
+// must be held.
+func (a *alertTable) publish(id int, ts time.Time, kind, station, message string) {
+	if station == "" {
+		station = "-"
+	}
+	for sub := range a.subscribers {
+		if sub.station == "" || sub.station == station {
+			fmt.Fprintf(sub.conn, "%s ALERT %d %d %s %s %s\n", sub.uid, id, ts.Unix(), kind, station, message)
+		}
+	}
+}
+
+// list returns the open alerts, oldest first, optionally only those that
+// have (or haven't) been acknowledged. a.m must be held.
+func (a *alertTable) list(state string) []*alert {
+	var alerts []*alert
+	for _, al := range a.open {
+		acked := al.owner != ""
+		if (state == "acked" && !acked) || (state == "open" && acked) {
+			continue
+		}
+		alerts = append(alerts, al)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].id < alerts[j].id })
+	return alerts
+}
+
+// find returns the open alert with an id. a.m must be held.
+func (a *alertTable) find(id int) *alert {
+	for _, al := range a.open {
+		if al.id == id {
+			return al
+		}
+	}
+	return nil
+}
+
+func (a *alertTable) rename(from, to string) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	for key, al := range a.open {
+		if key.station != from {
+			continue
+		}
+		delete(a.open, key)
+		al.station = to
+		a.open[alertKey{key.name, to}] = al
+	}
+}
+
+// raise notifies that something's wrong, and opens an alert about it.
+func (s *Server) raise(name, kind, station, format string, args ...interface{}) {
+	now := s.Clock.Now()
+	message := fmt.Sprintf(format, args...)
+
+	s.alerts.m.Lock()
+	key := alertKey{name, station}
+	al, ok := s.alerts.open[key]
+	if ok {
+		al.kind, al.message = kind, message
+	} else {
+		s.alerts.next++
+		al = &alert{id: s.alerts.next, kind: kind, station: station, message: message, raised: now}
+		s.alerts.open[key] = al
+	}
+	// someone owns it already, so only the journal hears about it.
+	acked := al.owner != ""
+	if !acked {
+		al.notified = now
+	}
+	s.alerts.publish(al.id, now, kind, station, message)
+	s.alerts.m.Unlock()
+
+	if acked {
+		s.event(kind, station, "%s", message)
+		return
+	}
+	s.notify(kind, station, "%s", message)
+}
+
+// resolve notifies that something's fine again, and closes its alert.
+func (s *Server) resolve(name, kind, station, format string, args ...interface{}) {
+	s.alerts.m.Lock()
+	key := alertKey{name, station}
+	if al, ok := s.alerts.open[key]; ok {
+		delete(s.alerts.open, key)
+		s.alerts.publish(al.id, s.Clock.Now(), kind, station, fmt.Sprintf(format, args...))
+	}
+	s.alerts.m.Unlock()
+
+	s.notify(kind, station, format, args...)
+}
+
+// scheduleReminders notifies about open alerts nobody has acknowledged
+// again, every so often.
+func (s *Server) scheduleReminders(every time.Duration) {
+	s.Clock.AfterFunc(every, func() {
+		s.remind()
+		s.scheduleReminders(every)
+	})
+}
+
+// remind notifies about every open alert nobody has acknowledged that
+// hasn't been notified about for a while. Reminders go to the journal and
+// the sinks, but don't count towards reports as alerts fired.
+func (s *Server) remind() {
+	now := s.Clock.Now()
+
+	s.alerts.m.Lock()
+	var due []Notification
+	for _, al := range s.alerts.list("open") {
+		if now.Sub(al.notified) < s.alerts.every {
+			continue
+		}
+		al.notified = now
+		due = append(due, Notification{
+			Kind:    al.kind,
+			Station: al.station,
+			Message: fmt.Sprintf("%s (alert %d, open for %s)", al.message, al.id, now.Sub(al.raised)),
+			Time:    now,
+		})
+	}
+	s.alerts.m.Unlock()
+
+	for _, n := range due {
+		s.event(n.Kind, n.Station, "%s", n.Message)
+		for _, sink := range s.notifiers {
+			sink.Notify(n)
+		}
+	}
+}
+
+// owner returns who a connection acknowledges alerts as.
+func owner(conn *clientConn) string {
+	if conn.identity == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(conn.identity, " ", "_")
+}
+
+// ACKALERT cmd (admin only)
+// Expected args:
+//  - [id]
+//  - [note] (optional, may contain spaces)
+//
+// Acknowledging an alert someone else already has takes it over.
+func (s *Server) handleAckAlert(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 1 {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "", badArg(args[0], err)
+	}
+
+	s.alerts.m.Lock()
+	al := s.alerts.find(id)
+	if al == nil {
+		s.alerts.m.Unlock()
+		return "", badArgf(args[0], "no open alert %d", id)
+	}
+	al.owner = owner(conn)
+	al.acked = s.Clock.Now()
+	al.note = strings.Join(args[1:], " ")
+	station := al.station
+	detail := fmt.Sprintf("%d by %s", id, al.owner)
+	if al.note != "" {
+		detail += ": " + al.note
+	}
+	s.alerts.m.Unlock()
+
+	s.event("alert.ack", station, "%s", detail)
+	return "ACK", nil
+}
+
+// ALERTS cmd
+// Expected args:
+//  - open|acked (optional)
+//
+// Each open alert is sent as its own [uid] ALERT response, oldest first,
+// followed by an [uid] ACKED one if someone has acknowledged it, before the
+// final ALERTS one.
+func (s *Server) handleAlerts(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) > 1 {
+		return "", argCount(args)
+	}
+
+	state := ""
+	if len(args) == 1 {
+		state = args[0]
+		if state != "open" && state != "acked" {
+			return "", badArgf(state, "unknown alert state %s", state)
+		}
+	}
+
+	s.alerts.m.Lock()
+	defer s.alerts.m.Unlock()
+
+	alerts := s.alerts.list(state)
+	for _, al := range alerts {
+		station := al.station
+		if station == "" {
+			station = "-"
+		}
+		fmt.Fprintf(conn, "%s ALERT %d %d %s %s %s\n", uid, al.id, al.raised.Unix(), al.kind, station, al.message)
+		if al.owner == "" {
+			continue
+		}
+		fmt.Fprintf(conn, "%s ACKED %d %s %d", uid, al.id, al.owner, al.acked.Unix())
+		if al.note != "" {
+			fmt.Fprintf(conn, " %s", al.note)
+		}
+		fmt.Fprintf(conn, "\n")
+	}
+
+	return fmt.Sprintf("ALERTS %d", len(alerts)), nil
+}
+
+// subscribeAlerts streams alerts (optionally about one station) to conn
+// under uid as they're raised and resolved, until it's cancelled.
+func (s *Server) subscribeAlerts(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) > 1 {
+		return "", argCount(args)
+	}
+
+	sub := &eventSubscriber{conn: conn, encoding: conn.encoding, uid: uid}
+	if len(args) == 1 && args[0] != "*" {
+		sub.station = args[0]
+	}
+
+	s.alerts.m.Lock()
+	s.alerts.subscribers[sub] = struct{}{}
+	s.alerts.m.Unlock()
+
+	conn.stream(uid, func() {
+		s.alerts.m.Lock()
+		defer s.alerts.m.Unlock()
+
+		delete(s.alerts.subscribers, sub)
+	})
+
+	return "ACK", nil
+}
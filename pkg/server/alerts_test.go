@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestAlerts(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	mock.Set(time.Unix(3600, 0))
+	var notified []Notification
+	server := New(listener, 4, mock, TrustPlaintext(), WithAlertReminders(time.Minute), WithNotifier(NotifierFunc(func(n Notification) {
+		notified = append(notified, n)
+	})))
+	go server.Serve(context.Background())
+
+	server.raise("read_level", "slo.burn", "water", "read_level is burning")
+	server.raise("watchdog.gc", "watchdog.gc", "", "gc paused for 1s")
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	lines := bufio.NewReader(conn)
+	for _, in := range []struct {
+		send   string
+		expect []string
+	}{
+		{"1 ALERTS", []string{
+			"1 ALERT 1 3600 slo.burn water read_level is burning",
+			"1 ALERT 2 3600 watchdog.gc - gc paused for 1s",
+			"1 ALERTS 2",
+		}},
+		{"2 ACKALERT 1 draining the tank", []string{"2 ACK"}},
+		{"3 ACKALERT 9", []string{"3 ERR"}},
+		{"4 ALERTS acked", []string{
+			"4 ALERT 1 3600 slo.burn water read_level is burning",
+			"4 ACKED 1 - 3600 draining the tank",
+			"4 ALERTS 1",
+		}},
+		{"5 ALERTS open", []string{
+			"5 ALERT 2 3600 watchdog.gc - gc paused for 1s",
+			"5 ALERTS 1",
+		}},
+		{"6 ALERTS closed", []string{"6 ERR"}},
+	} {
+		fmt.Fprintf(conn, "%s\n", in.send)
+		if err := expectLines(lines, in.expect...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the alert nobody acknowledged is brought up again.
+	notified = nil
+	mock.Add(time.Minute)
+	if len(notified) != 1 || notified[0].Kind != "watchdog.gc" || notified[0].Message != "gc paused for 1s (alert 2, open for 1m0s)" {
+		t.Fatalf("expected a reminder about alert 2, got %+v", notified)
+	}
+
+	server.resolve("read_level", "slo.ok", "water", "read_level is fine")
+	fmt.Fprintf(conn, "7 ALERTS\n")
+	if err := expectLines(lines, "7 ALERT 2 3600 watchdog.gc - gc paused for 1s", "7 ALERTS 1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAlertsAckedQuiet(t *testing.T) {
+	var notified []Notification
+	server := New(nil, 4, clock.NewMock(), TrustPlaintext(), WithNotifier(NotifierFunc(func(n Notification) {
+		notified = append(notified, n)
+	})))
+
+	server.raise("read_level", "slo.burn", "water", "read_level is burning")
+	if _, err := server.handleAckAlert(context.Background(), &clientConn{}, "1", "1"); err != nil {
+		t.Fatal(err)
+	}
+	server.raise("read_level", "slo.burn", "water", "read_level is still burning")
+	if len(notified) != 1 {
+		t.Fatalf("expected an acknowledged alert to stay quiet, got %+v", notified)
+	}
+}
+
+func TestAlertsAdminOnly(t *testing.T) {
+	server := New(nil, 4, clock.NewMock())
+	server.raise("read_level", "slo.burn", "water", "read_level is burning")
+
+	if _, err := server.handleAckAlert(context.Background(), &clientConn{}, "1", "1"); err == nil {
+		t.Fatal("expected ACKALERT to be admin only")
+	}
+}
+
+func TestHTTPAlerts(t *testing.T) {
+	mock := clock.NewMock()
+	mock.Set(time.Unix(0, 0).UTC())
+	server := New(nil, 4, mock, TrustPlaintext())
+	server.raise("read_level", "slo.burn", "water", "read_level is burning")
+	server.raise("watchdog.gc", "watchdog.gc", "", "gc paused for 1s")
+	if _, err := server.handleAckAlert(context.Background(), &clientConn{}, "1", "2", "on", "it"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/alerts?state=acked", nil))
+
+	expected := `[{"id":2,"kind":"watchdog.gc","message":"gc paused for 1s","raised":"1970-01-01T00:00:00Z",` +
+		`"owner":"-","acked":"1970-01-01T00:00:00Z","note":"on it"}]`
+	if got := strings.TrimSpace(rec.Body.String()); got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+
+	rec = httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/alerts?state=closed", nil))
+	if rec.Code != 400 {
+		t.Fatalf("expected an unknown state to be rejected, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// For compliance, operators need a record of who did what to which station
+// that outlives the server's logs. With an auditor, every command the server
+// is sent, whether it succeeded or not, is handed to it as an entry: when,
+// from which certificate and address, the command and its arguments (with
+// payloads redacted, as in the logs) and how it went. A RUN and the DONE or
+// ERR answering it share a run id, so what happened to a run can be followed
+// from the client that asked for it to the station that carried it out.
+
+// Results of audited commands.
+const (
+	auditOK        = "ok"
+	auditError     = "error"
+	auditForbidden = "forbidden"
+	auditUnknown   = "unknown"
+	// put in a batch, to be applied and audited again on COMMIT.
+	auditBatched = "batched"
+	// answered from memory as a retry of a command already carried out.
+	auditReplayed = "replayed"
+)
+
+// AuditEntry is the record of a command.
+type AuditEntry struct {
+	Time time.Time `json:"ts"`
+	// Identity is the common name on the sender's certificate, if it had
+	// one.
+	Identity string `json:"identity,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+	// Station is the station the sender was registered as, if it was.
+	Station string   `json:"station,omitempty"`
+	UID     string   `json:"uid"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	// Result is ok, error, forbidden, unknown, batched or replayed.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+	// Run identifies the run a RUN started, or a DONE or ERR finished, as
+	// [station]/[uid].
+	Run string `json:"run,omitempty"`
+}
+
+// Auditor is a sink for audit entries. Audit is called as each command is
+// handled, holding up the connection it came from, so it should be quick.
+type Auditor interface {
+	Audit(AuditEntry) error
+}
+
+// AuditorFunc adapts a function to an Auditor.
+type AuditorFunc func(AuditEntry) error
+
+// Audit calls f(e).
+func (f AuditorFunc) Audit(e AuditEntry) error {
+	return f(e)
+}
+
+// AuditLog writes audit entries as JSON lines, e.g. to a LogFile.
+type AuditLog struct {
+	m   sync.Mutex
+	enc *json.Encoder
+}
+
+// NewAuditLog writes audit entries to w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{enc: json.NewEncoder(w)}
+}
+
+// Audit writes an entry.
+func (a *AuditLog) Audit(e AuditEntry) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	return a.enc.Encode(e)
+}
+
+// audits is where audit entries go, and whether the last one couldn't be
+// recorded.
+type audits struct {
+	auditor Auditor
+
+	m       sync.Mutex
+	failing bool
+}
+
+// audit records a command sent by a connection that was registered as
+// station when it sent it, raising an alert if it can't be recorded, or
+// closing it once entries are recorded again.
+func (s *Server) audit(conn *clientConn, station string, fields []string, result string, err error) {
+	if s.audits == nil {
+		return
+	}
+
+	e := AuditEntry{
+		Time:     s.Clock.Now(),
+		Identity: conn.identity,
+		Station:  station,
+		UID:      fields[0],
+		Command:  fields[1],
+		Args:     redactFields(fields)[2:],
+		Result:   result,
+		Run:      runID(station, fields),
+	}
+	if conn.Conn != nil && conn.RemoteAddr() != nil {
+		e.Remote = conn.RemoteAddr().String()
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	auditErr := s.audits.auditor.Audit(e)
+
+	s.audits.m.Lock()
+	defer s.audits.m.Unlock()
+	switch {
+	case auditErr != nil && !s.audits.failing:
+		s.audits.failing = true
+		s.raise("audit", "audit.failed", "", "couldn't record %s %s from %s: %v", e.UID, e.Command, describe(conn), auditErr)
+	case auditErr == nil && s.audits.failing:
+		s.audits.failing = false
+		s.resolve("audit", "audit.ok", "", "recording commands again")
+	}
+}
+
+// runID returns the run a command starts or finishes, if it does: a RUN by
+// the station it names, or a DONE or ERR by the station sending it.
+func runID(station string, fields []string) string {
+	uid, args := fields[0], fields[2:]
+	switch fields[1] {
+	case "RUN":
+		if len(args) > 0 && (args[0] == "idempotent=true" || args[0] == "idempotent=false") {
+			args = args[1:]
+		}
+		if len(args) > 0 {
+			return args[0] + "/" + uid
+		}
+	case "DONE", "ERR":
+		if station != "" {
+			return station + "/" + uid
+		}
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+)
+
+func TestAudit(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m sync.Mutex
+	var entries []AuditEntry
+	server := New(listener, 4, clock.NewMock(), WithAuditor(AuditorFunc(func(e AuditEntry) error {
+		m.Lock()
+		defer m.Unlock()
+		entries = append(entries, e)
+		return nil
+	})))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(client, "2 RUN water fill secret", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expect(station, "2 RUN fill secret"); err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []interaction{
+		{"2 DONE 0", "2 ACK"},
+		{"3 METRIC level bad", "3 ERR"},
+		{"4 FROBNICATE", "4 ERR UNRECOGNIZED CMD"},
+		{"5 UNREGISTER", "5 ACK"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	want := []struct {
+		station, command, result, run string
+	}{
+		{"", "REGISTER", auditOK, ""},
+		{"", "RUN", auditOK, "water/2"},
+		{"water", "DONE", auditOK, "water/2"},
+		{"water", "METRIC", auditError, ""},
+		{"water", "FROBNICATE", auditUnknown, ""},
+		// who unregistered, rather than who they are afterwards.
+		{"water", "UNREGISTER", auditOK, ""},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %+v", len(want), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Station != w.station || e.Command != w.command || e.Result != w.result || e.Run != w.run || e.Remote == "" {
+			t.Fatalf("expected entry %d to be %+v, got %+v", i, w, e)
+		}
+	}
+	if args := entries[1].Args; len(args) != 3 || args[2] != "***" {
+		t.Fatalf("expected the RUN's payload to be redacted, got %q", args)
+	}
+	if entries[3].Error == "" {
+		t.Fatal("expected the failed METRIC's error to be recorded")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	a := NewAuditLog(&buf)
+	for _, uid := range []string{"1", "2"} {
+		if err := a.Audit(AuditEntry{UID: uid, Command: "LIST", Result: auditOK}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dec := json.NewDecoder(&buf)
+	for _, uid := range []string{"1", "2"} {
+		var e AuditEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.UID != uid || e.Command != "LIST" {
+			t.Fatalf("unexpected entry %+v", e)
+		}
+	}
+}
+
+func TestAuditFailures(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m sync.Mutex
+	var notified []Notification
+	failing := true
+	server := New(listener, 4, clock.NewMock(),
+		WithAuditor(AuditorFunc(func(AuditEntry) error {
+			m.Lock()
+			defer m.Unlock()
+			if failing {
+				return errors.New("disk full")
+			}
+			return nil
+		})),
+		WithNotifier(NotifierFunc(func(n Notification) {
+			m.Lock()
+			defer m.Unlock()
+			notified = append(notified, n)
+		})))
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// commands are still carried out, but raise a single alert.
+	for _, in := range []interaction{
+		{"1 LIST", "1 LIST"},
+		{"2 LIST", "2 LIST"},
+	} {
+		if err := sendExpect(conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Lock()
+	if len(notified) != 1 || notified[0].Kind != "audit.failed" {
+		t.Fatalf("expected a single audit.failed alert, got %+v", notified)
+	}
+	failing = false
+	m.Unlock()
+
+	if err := sendExpect(conn, "3 LIST", "3 LIST"); err != nil {
+		t.Fatal(err)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if len(notified) != 2 || notified[1].Kind != "audit.ok" {
+		t.Fatalf("expected the alert to be resolved, got %+v", notified)
+	}
+}
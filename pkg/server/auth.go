@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errBlocked = errors.New("certificate is blocklisted")
+
+// fingerprint returns the hex encoded SHA-256 fingerprint of a certificate.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint accepts fingerprints the way openssl prints them
+// (AB:CD:...) as well as plain hex.
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(fp), ":", "", -1))
+}
+
+// identify completes the TLS handshake for TLS connections and records who
+// is on the other end. Plaintext connections are left anonymous, and CoAP
+// sessions are marked as such.
+func (s *Server) identify(conn *clientConn) error {
+	var state tls.ConnectionState
+	switch c := conn.Conn.(type) {
+	case *tls.Conn:
+		// the handshake would otherwise happen lazily on the first read,
+		// but we want to turn blocked clients away before they can send
+		// anything. Until it's done, the idle timeout doesn't apply, so it
+		// has a deadline of its own.
+		c.SetDeadline(time.Now().Add(s.handshakeTimeout))
+		err := c.Handshake()
+		c.SetDeadline(time.Time{})
+		if err != nil {
+			return errors.Wrap(err, "tls handshake")
+		}
+		state = c.ConnectionState()
+	case *wsConn:
+		// upgraded from an HTTP request, whose handshake is long done.
+		if c.tls == nil {
+			return nil
+		}
+		state = *c.tls
+	case coapConn:
+		conn.coap = true
+		return nil
+	default:
+		return nil
+	}
+	conn.tls = true
+
+	peers := state.PeerCertificates
+	if len(peers) == 0 {
+		return nil
+	}
+
+	conn.identity = peers[0].Subject.CommonName
+	conn.fingerprint = fingerprint(peers[0])
+	conn.peer = peers[0]
+	conn.names = append([]string{conn.identity}, peers[0].DNSNames...)
+	conn.role = s.roles.role(conn.identity, peers[0].Subject.OrganizationalUnit)
+
+	if s.isBlocked(conn.fingerprint) {
+		return errors.Wrapf(errBlocked, "%s (%s)", conn.fingerprint, conn.identity)
+	}
+	// for listeners that don't check revocations during the handshake.
+	if s.revocations != nil && s.revocations.IsRevoked(peers[0]) {
+		return errors.Wrapf(errRevoked, "serial %s (%s)", peers[0].SerialNumber, conn.identity)
+	}
+
+	return nil
+}
+
+// isAdmin reports whether a connection may run admin commands.
+func (s *Server) isAdmin(conn *clientConn) bool {
+	if !conn.tls {
+		return s.trusted(conn)
+	}
+	return s.admins[conn.identity]
+}
+
+// trusted reports whether a plaintext connection is trusted like an admin,
+// which CoAP sessions never are.
+func (s *Server) trusted(conn *clientConn) bool {
+	return !conn.tls && !conn.coap && s.trustPlaintext
+}
+
+// ParseNameGrants reads comma separated identity=pattern pairs, each
+// letting the certificate with that common name register as any station
+// whose name matches the pattern, as for path.Match, e.g.
+// gateway=greenhouse-*.
+func ParseNameGrants(spec string) (map[string][]string, error) {
+	grants := map[string][]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("bad name grant %q", pair)
+		}
+		if _, err := path.Match(kv[1], ""); err != nil {
+			return nil, errors.Wrapf(err, "bad name grant %q", pair)
+		}
+		grants[kv[0]] = append(grants[kv[0]], kv[1])
+	}
+	return grants, nil
+}
+
+// mayRegister checks that a connection's certificate lets it register as
+// name, when names are bound to certificates: the name has to be the
+// certificate's common name or one of its DNS names, or be granted to its
+// common name. Plaintext connections can only register if they're trusted,
+// so CoAP sessions can't.
+func (s *Server) mayRegister(conn *clientConn, name string) error {
+	if !s.bindNames {
+		return nil
+	}
+	if !conn.tls {
+		if s.trusted(conn) {
+			return nil
+		}
+		return errors.Errorf("plaintext clients can't register as %s without a certificate", name)
+	}
+
+	for _, n := range conn.names {
+		if n == name {
+			return nil
+		}
+	}
+	for _, pattern := range s.nameGrants[conn.identity] {
+		if ok, _ := path.Match(pattern, name); ok {
+			return nil
+		}
+	}
+	return errors.Errorf("%s isn't allowed to register as %s", conn.identity, name)
+}
+
+func (s *Server) isBlocked(fp string) bool {
+	s.blocklistM.Lock()
+	defer s.blocklistM.Unlock()
+
+	return s.blocklist[fp]
+}
+
+// BLOCK cmd (admin only)
+// Expected args:
+//  - [fingerprint]
+func (s *Server) handleBlock(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 1 {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	fp := normalizeFingerprint(args[0])
+
+	s.blocklistM.Lock()
+	s.blocklist[fp] = true
+	s.blocklistM.Unlock()
+
+	// kick anyone already connected with the certificate, too.
+	s.connsM.Lock()
+	defer s.connsM.Unlock()
+
+	for c := range s.conns {
+		if c.fingerprint == fp {
+			c.Close()
+		}
+	}
+
+	return "ACK", nil
+}
+
+// UNBLOCK cmd (admin only)
+// Expected args:
+//  - [fingerprint]
+func (s *Server) handleUnblock(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 1 {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	s.blocklistM.Lock()
+	defer s.blocklistM.Unlock()
+
+	delete(s.blocklist, normalizeFingerprint(args[0]))
+
+	return "ACK", nil
+}
+
+// BLOCKLIST cmd (admin only)
+// Expected args: none
+func (s *Server) handleBlocklist(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 0 {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	s.blocklistM.Lock()
+	defer s.blocklistM.Unlock()
+
+	fps := make([]string, 0, len(s.blocklist))
+	for fp := range s.blocklist {
+		fps = append(fps, fp)
+	}
+	sort.Strings(fps)
+
+	buf := bytes.NewBufferString("BLOCKLIST")
+	for _, fp := range fps {
+		buf.WriteString(" " + fp)
+	}
+
+	return buf.String(), nil
+}
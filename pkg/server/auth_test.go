@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// testPKI is a throwaway CA for tests that need real client certificates.
+type testPKI struct {
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	pool   *x509.CertPool
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	return &testPKI{ca: ca, caKey: key, pool: pool, serial: 1}
+}
+
+// issue signs a certificate for cn, usable as both a client and a server
+// certificate for localhost.
+func (p *testPKI) issue(t *testing.T, cn string) tls.Certificate {
+	return p.issueFor(t, pkix.Name{CommonName: cn})
+}
+
+// issueFor is issue for a full subject.
+func (p *testPKI) issueFor(t *testing.T, subject pkix.Name) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      subject,
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// serve starts a TLS server that requires client certificates from the CA.
+func (p *testPKI) serve(t *testing.T, opts ...Option) (*Server, string) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		Certificates: []tls.Certificate{p.issue(t, "server")},
+		ClientCAs:    p.pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock(), opts...)
+	go server.Serve(context.Background())
+
+	return server, listener.Addr().String()
+}
+
+func (p *testPKI) dial(t *testing.T, addr string, cert tls.Certificate) *tls.Conn {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      p.pool,
+		ServerName:   "localhost",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+// expectClosed checks that the server hangs up on conn.
+func expectClosed(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	// the write may or may not make it out before we notice the close.
+	fmt.Fprintf(conn, "1 LIST\n")
+
+	buf := make([]byte, 64)
+	if n, err := conn.Read(buf); err == nil {
+		return fmt.Errorf("expected connection to be closed, got %q", buf[:n])
+	}
+
+	return nil
+}
+
+func TestBlocklistRejectsAtHandshake(t *testing.T) {
+	pki := newTestPKI(t)
+	stolen := pki.issue(t, "water")
+
+	_, addr := pki.serve(t, WithBlocklist(fingerprint(stolen.Leaf)))
+
+	if err := expectClosed(pki.dial(t, addr, stolen)); err != nil {
+		t.Fatal(err)
+	}
+
+	// other certificates are unaffected.
+	if err := sendExpect(pki.dial(t, addr, pki.issue(t, "jasmine")), "1 LIST", "1 LIST"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockCommand(t *testing.T) {
+	pki := newTestPKI(t)
+	stolen := pki.issue(t, "water")
+
+	_, addr := pki.serve(t, WithAdmins("admin"))
+
+	station := pki.dial(t, addr, stolen)
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := pki.dial(t, addr, pki.issue(t, "dashboard"))
+	admin := pki.dial(t, addr, pki.issue(t, "admin"))
+
+	fp := fingerprint(stolen.Leaf)
+	if err := sendExpect(client, "2 BLOCK "+fp, "2 ERR"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(admin, "3 BLOCK "+fp, "3 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(admin, "4 BLOCKLIST", "4 BLOCKLIST "+fp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := expectClosed(station); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := expectClosed(pki.dial(t, addr, stolen)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(admin, "5 UNBLOCK "+fp, "5 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(pki.dial(t, addr, stolen), "6 METRICS nothing", "6 ERR"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoundNames(t *testing.T) {
+	pki := newTestPKI(t)
+	grants, err := ParseNameGrants("gateway=greenhouse-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := pki.serve(t, WithBoundNames(grants))
+
+	water := pki.dial(t, addr, pki.issue(t, "water"))
+	if err := sendExpect(water, "1 REGISTER jasmine plant", "1 ERR"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(water, "2 REGISTER water source", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := pki.dial(t, addr, pki.issue(t, "gateway"))
+	if err := sendExpect(gateway, "3 REGISTER greenhouse-1 sensor", "3 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	other := pki.dial(t, addr, pki.issue(t, "gateway"))
+	if err := sendExpect(other, "4 REGISTER shed sensor", "4 ERR"); err != nil {
+		t.Fatal(err)
+	}
+
+	// batched registrations are held to the same rule.
+	if err := sendExpect(other, "5 BEGIN", "5 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(other, "6 REGISTER shed sensor\n7 COMMIT\n")
+	if err := expectLines(bufio.NewReader(other), "6 ERR", "7 ERR"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoundNamesPlaintext(t *testing.T) {
+	for _, trusted := range []bool{false, true} {
+		opts := []Option{WithBoundNames(nil)}
+		if trusted {
+			opts = append(opts, TrustPlaintext())
+		}
+		server := New(nil, 4, clock.NewMock(), opts...)
+
+		_, err := server.handleRegister(context.Background(), &clientConn{}, "1", "water", "source")
+		if (err == nil) != trusted {
+			t.Errorf("trusted=%v: unexpected error %v", trusted, err)
+		}
+	}
+}
+
+func TestParseNameGrants(t *testing.T) {
+	for _, spec := range []string{"", "gateway", "=greenhouse-*", "gateway=[", "gateway=a,b"} {
+		if _, err := ParseNameGrants(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A backup nobody has tried restoring is only a hope. With backups on, the
+// server regularly writes its state, as DUMP would send it, and a copy of
+// its metric store to a sink, along with a manifest of checksums written
+// last. When the sink can be read back, every backup is checked against its
+// manifest right after it's written, and a backup that fails raises an
+// alert. drops-restore checks a backup the same way before restoring it.
+// Only so many backups are kept, if the sink can prune older ones.
+
+// The files of a backup, under a directory named after when it was taken.
+const (
+	// the server's state, one record per line.
+	backupState = "state.jsonl"
+	// a copy of the metric store, if it can make one.
+	backupStore = "store"
+	// a line per file: its SHA-256, size and name.
+	backupManifest = "MANIFEST"
+)
+
+// BackupStore is a MetricStore that can copy itself while in use.
+type BackupStore interface {
+	MetricStore
+	// Backup writes a consistent copy of the store to w, as a file the store
+	// can be opened from.
+	Backup(w io.Writer) error
+}
+
+// ReadableSink is an ExportSink that files can be read back from.
+type ReadableSink interface {
+	ExportSink
+	// Get returns the data stored under name.
+	Get(name string) ([]byte, error)
+}
+
+// StreamSink is an ExportSink that files can be streamed to and from, so
+// large ones, like a copy of the metric store, are never held in memory.
+type StreamSink interface {
+	ExportSink
+	// PutFrom stores what's read from r under name, like Put, or nothing if
+	// reading r fails.
+	PutFrom(name string, r io.Reader) error
+	// Open returns the file stored under name, to be read and closed.
+	Open(name string) (io.ReadCloser, error)
+}
+
+// PrunableSink is an ExportSink that old files can be removed from.
+type PrunableSink interface {
+	ExportSink
+	// List returns the names of the files and directories directly under
+	// dir, a slash separated path ("" for the top).
+	List(dir string) ([]string, error)
+	// Remove removes the file or directory stored under name, and
+	// everything in it.
+	Remove(name string) error
+}
+
+// backups is where backups go, and whether the last one failed.
+type backups struct {
+	sink    ExportSink
+	failing bool
+}
+
+// countWriter counts what's written through it.
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
+
+// backupLayout is how backups' directories are named, after when they were
+// taken.
+const backupLayout = "2006-01-02T150405Z"
+
+// backupName is the name of the directory a backup taken at t goes in.
+func backupName(t time.Time) string {
+	return t.UTC().Format(backupLayout)
+}
+
+// scheduleBackups takes a backup every interval.
+func (s *Server) scheduleBackups(every time.Duration) {
+	s.Clock.AfterFunc(every, func() {
+		s.runBackup()
+		s.scheduleBackups(every)
+	})
+}
+
+// runBackup takes a backup, and raises an alert if it failed, or closes the
+// one for the last backup once one succeeds again.
+func (s *Server) runBackup() {
+	name, err := s.backup()
+	switch {
+	case err != nil:
+		s.backups.failing = true
+		s.raise("backup", "backup.failed", "", "backup %s failed: %v", name, err)
+	case s.backups.failing:
+		s.backups.failing = false
+		s.resolve("backup", "backup.ok", "", "backup %s succeeded", name)
+	default:
+		s.log.Infof("backed up to %s", name)
+	}
+}
+
+// backup writes a backup to the sink, verifies it if it can, and returns its
+// name.
+func (s *Server) backup() (string, error) {
+	name := backupName(s.Clock.Now())
+
+	var manifest bytes.Buffer
+	put := func(file string, write func(w io.Writer) error) error {
+		sum, size, err := s.putBackupFile(name+"/"+file, write)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "%x %d %s\n", sum, size, file)
+		return nil
+	}
+
+	err := put(backupState, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, rec := range s.dump() {
+			if err := enc.Encode(rec); err != nil {
+				return errors.Wrap(err, "encoding state")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return name, err
+	}
+
+	if s.store != nil {
+		// a backup without the store would pass verification, and only
+		// turn out to be missing it when it's needed.
+		bs, ok := s.store.(BackupStore)
+		if !ok {
+			return name, errors.Errorf("the metric store can't be backed up")
+		}
+		if err := put(backupStore, func(w io.Writer) error {
+			return errors.Wrap(bs.Backup(w), "copying metric store")
+		}); err != nil {
+			return name, err
+		}
+	}
+
+	// a backup without a manifest is known to be incomplete.
+	if err := s.backups.sink.Put(name+"/"+backupManifest, manifest.Bytes()); err != nil {
+		return name, err
+	}
+
+	if rs, ok := s.backups.sink.(ReadableSink); ok {
+		if err := VerifyBackup(rs, name); err != nil {
+			return name, errors.Wrap(err, "verifying backup")
+		}
+	}
+
+	if err := s.pruneBackups(); err != nil {
+		s.log.Errorf("couldn't remove old backups: %v", err)
+	}
+	return name, nil
+}
+
+// putBackupFile stores what write writes under path, streaming it if the
+// sink can take it that way, and returns its SHA-256 and size.
+func (s *Server) putBackupFile(path string, write func(w io.Writer) error) ([]byte, int64, error) {
+	sum := sha256.New()
+	var size countWriter
+
+	ss, ok := s.backups.sink.(StreamSink)
+	if !ok {
+		var buf bytes.Buffer
+		if err := write(io.MultiWriter(&buf, sum, &size)); err != nil {
+			return nil, 0, err
+		}
+		return sum.Sum(nil), int64(size), s.backups.sink.Put(path, buf.Bytes())
+	}
+
+	r, w := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := write(io.MultiWriter(w, sum, &size))
+		w.CloseWithError(err)
+		written <- err
+	}()
+
+	err := ss.PutFrom(path, r)
+	// if the sink gave up early, so does write.
+	r.CloseWithError(errors.New("backup sink stopped reading"))
+	if werr := <-written; werr != nil {
+		return nil, 0, werr
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return sum.Sum(nil), int64(size), nil
+}
+
+// pruneBackups removes all but the newest backups, if only so many are
+// kept and the sink can remove them.
+func (s *Server) pruneBackups() error {
+	ps, ok := s.backups.sink.(PrunableSink)
+	if s.backupKeep <= 0 || !ok {
+		return nil
+	}
+
+	names, err := ps.List("")
+	if err != nil {
+		return err
+	}
+	var taken []string
+	for _, name := range names {
+		if _, err := time.Parse(backupLayout, name); err == nil {
+			taken = append(taken, name)
+		}
+	}
+	// names sort in the order backups were taken.
+	sort.Strings(taken)
+
+	for len(taken) > s.backupKeep {
+		if err := ps.Remove(taken[0]); err != nil {
+			return err
+		}
+		s.log.Infof("removed old backup %s", taken[0])
+		taken = taken[1:]
+	}
+	return nil
+}
+
+// VerifyBackup checks that every file of the backup named name is in sink
+// as it was written, and that its state can be read.
+func VerifyBackup(sink ReadableSink, name string) error {
+	manifest, err := sink.Get(name + "/" + backupManifest)
+	if err != nil {
+		return errors.Wrap(err, "reading manifest")
+	}
+
+	hasState := false
+	for _, line := range strings.Split(strings.TrimSpace(string(manifest)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return errors.Errorf("bad manifest line %q", line)
+		}
+		sum, file := fields[0], fields[2]
+		size, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return errors.Wrapf(err, "bad size in manifest line %q", line)
+		}
+
+		got, n, data, err := readBackupFile(sink, name+"/"+file, file == backupState)
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", file)
+		}
+		if n != int64(size) {
+			return errors.Errorf("%s is %d bytes, expected %d", file, n, size)
+		}
+		if got != sum {
+			return errors.Errorf("%s doesn't match its checksum", file)
+		}
+
+		if file == backupState {
+			hasState = true
+			if err := verifyState(data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !hasState {
+		return errors.Errorf("backup %s has no state", name)
+	}
+	return nil
+}
+
+// readBackupFile returns the SHA-256 and size of the file at path, streaming
+// it if the sink can, along with its data if keep is set.
+func readBackupFile(sink ReadableSink, path string, keep bool) (string, int64, []byte, error) {
+	ss, ok := sink.(StreamSink)
+	if keep || !ok {
+		data, err := sink.Get(path)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return fmt.Sprintf("%x", sha256.Sum256(data)), int64(len(data)), data, nil
+	}
+
+	f, err := ss.Open(path)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	n, err := io.Copy(sum, f)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return fmt.Sprintf("%x", sum.Sum(nil)), n, nil, nil
+}
+
+// verifyState checks that every line of a state backup is a record LOAD
+// would take.
+func verifyState(data []byte) error {
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var rec stateRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return errors.Wrapf(err, "bad state record on line %d", i+1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+)
+
+func TestBackup(t *testing.T) {
+	dir := filepath.Dir(tempPointLogPath(t))
+	store, err := OpenPointLog(filepath.Join(dir, "points"), 10, 1, time.Second, clock.NewMock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	mock := clock.NewMock()
+	sink := DirSink(filepath.Join(dir, "backups"))
+	server := New(nil, 4, mock, WithMetricStore(store), WithBackups(sink, time.Hour))
+
+	conn := &clientConn{}
+	if _, err := server.handleRegister(context.Background(), conn, "1", "water", "source"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.handleMetric(context.Background(), conn, "2", "level", "1.5"); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.Add(time.Hour)
+	name := backupName(mock.Now())
+	if err := VerifyBackup(sink, name); err != nil {
+		t.Fatal(err)
+	}
+
+	// the store can be opened from its copy.
+	copied := filepath.Join(dir, "restored")
+	data, err := sink.Get(name + "/" + backupStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(copied, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenPointLog(copied, 10, 1, time.Second, clock.NewMock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if level := restored.history("water")["level"]; len(level) != 1 || level[0].value != 1.5 {
+		t.Fatalf("unexpected restored history %v", level)
+	}
+
+	// so can the state.
+	state, err := sink.Get(name + "/" + backupState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// a backup that's been tampered with doesn't pass.
+	path := filepath.Join(string(sink), name, backupState)
+	if err := ioutil.WriteFile(path, append(state, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBackup(sink, name); err == nil {
+		t.Fatal("expected a changed backup to fail verification")
+	}
+	if err := os.Remove(filepath.Join(string(sink), name, backupManifest)); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBackup(sink, name); err == nil {
+		t.Fatal("expected a backup without a manifest to fail verification")
+	}
+}
+
+// failingSink refuses every file.
+type failingSink struct{}
+
+func (failingSink) Put(name string, data []byte) error {
+	return errors.Errorf("disk full")
+}
+
+func TestBackupFailed(t *testing.T) {
+	mock := clock.NewMock()
+	server := New(nil, 4, mock, WithBackups(failingSink{}, time.Hour))
+
+	mock.Add(time.Hour)
+	server.alerts.m.Lock()
+	open := server.alerts.list("open")
+	server.alerts.m.Unlock()
+	if len(open) != 1 || open[0].kind != "backup.failed" {
+		t.Fatalf("expected a failed backup to raise an alert, got %+v", open)
+	}
+}
+
+func TestBackupSQLite(t *testing.T) {
+	dir := filepath.Dir(tempPointLogPath(t))
+	store, err := OpenSQLiteStore(filepath.Join(dir, "drops.db"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	mock := clock.NewMock()
+	sink := DirSink(filepath.Join(dir, "backups"))
+	server := New(nil, 4, mock, WithMetricStore(store), WithBackups(sink, 24*time.Hour), WithBackupKeep(2))
+
+	conn := &clientConn{}
+	if _, err := server.handleRegister(context.Background(), conn, "1", "water", "source"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.handleMetric(context.Background(), conn, "2", "level", "1.5"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		mock.Add(time.Hour)
+		server.runBackup()
+	}
+	name := backupName(mock.Now())
+	if err := VerifyBackup(sink, name); err != nil {
+		t.Fatal(err)
+	}
+
+	// the database can be opened from its copy.
+	restored, err := OpenSQLiteStore(filepath.Join(string(sink), name, backupStore), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	points, err := restored.Query("water")
+	if err != nil || len(points) != 1 || points[0].Value != 1.5 {
+		t.Fatalf("unexpected restored points %+v, %v", points, err)
+	}
+
+	// only the newest backups are kept.
+	kept, err := sink.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 2 || kept[1] != name {
+		t.Fatalf("expected the 2 newest backups to be kept, got %v", kept)
+	}
+}
+
+// opaqueStore is a metric store that can't back itself up.
+type opaqueStore struct {
+	MetricStore
+}
+
+func TestBackupWithoutStoreCopy(t *testing.T) {
+	store, err := OpenPointLog(tempPointLogPath(t), 10, 1, time.Second, clock.NewMock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	mock := clock.NewMock()
+	sink := DirSink(filepath.Join(t.TempDir(), "backups"))
+	server := New(nil, 4, mock, WithMetricStore(opaqueStore{store}), WithBackups(sink, time.Hour))
+
+	// rather than a backup that passes without the store in it.
+	mock.Add(time.Hour)
+	if err := VerifyBackup(sink, backupName(mock.Now())); err == nil {
+		t.Fatal("expected no backup without the metric store")
+	}
+	server.alerts.m.Lock()
+	open := server.alerts.list("open")
+	server.alerts.m.Unlock()
+	if len(open) != 1 || open[0].kind != "backup.failed" {
+		t.Fatalf("expected the backup to fail, got %+v", open)
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestBanner(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock(), WithBanner("environment: staging", "maintenance at 22:00 UTC"))
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the banner comes first, before any command is answered.
+	lines := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "1 PING\n")
+	if err := expectLines(lines, "motd MOTD environment: staging", "motd MOTD maintenance at 22:00 UTC", "1 PONG"); err != nil {
+		t.Fatal(err)
+	}
+}
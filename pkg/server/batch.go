@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// A station starting up usually registers, says which configuration it has
+// and reports its first readings, and would rather not deal with only some
+// of that going through. Commands sent between BEGIN and COMMIT are held
+// back, checked together, and only applied if they would all succeed. No
+// other command is handled while a batch is applied, so no one sees it half
+// done.
+
+// maxBatch is how many commands a batch can hold.
+const maxBatch = 64
+
+// batch holds the commands sent since a BEGIN.
+type batch struct {
+	cmds [][]string
+	// whether more than maxBatch commands were sent.
+	overflowed bool
+}
+
+func (b *batch) add(fields []string) {
+	if len(b.cmds) == maxBatch {
+		b.overflowed = true
+		return
+	}
+	b.cmds = append(b.cmds, fields)
+}
+
+// BEGIN cmd
+// Expected args: none
+func (s *Server) handleBegin(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 0 {
+		return "", argCount(args)
+	}
+
+	// a BEGIN in a batch is held back like anything else, and fails the
+	// batch when it's checked.
+	conn.batch = &batch{}
+	return "ACK", nil
+}
+
+// ABORT cmd
+// Expected args: none
+func (s *Server) handleAbort(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 0 {
+		return "", argCount(args)
+	}
+
+	if conn.batch == nil {
+		return "", errors.Errorf("no batch begun")
+	}
+	conn.batch = nil
+	return "ACK", nil
+}
+
+// COMMIT cmd
+// Expected args: none
+//
+// Each command in the batch is answered under its own uid, in order, before
+// the final COMMIT response. If one of them wouldn't succeed, none are
+// applied: only that one is answered, with ERR, and so is the COMMIT.
+func (s *Server) handleCommit(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 0 {
+		return "", argCount(args)
+	}
+
+	b := conn.batch
+	if b == nil {
+		return "", errors.Errorf("no batch begun")
+	}
+	conn.batch = nil
+
+	if b.overflowed {
+		return "", errors.Errorf("batch has more than %d commands", maxBatch)
+	}
+
+	s.batchM.Lock()
+	defer s.batchM.Unlock()
+
+	if i, err := s.checkBatch(conn, b); err != nil {
+		fields := b.cmds[i]
+		s.writeErr(conn, fields[0], err, fields)
+		return "", errors.Errorf("command %d of the batch would fail: %v", i+1, err)
+	}
+	defer func() { conn.prepaid = 0 }()
+
+	for i, fields := range b.cmds {
+		station := conn.name
+		resp, err := s.handlerFor(fields[1])(ctx, conn, fields[0], fields[2:]...)
+		if err != nil {
+			// checked commands only fail if the server does, e.g. when
+			// writing to the point log.
+			s.audit(conn, station, fields, auditError, err)
+			s.writeErr(conn, fields[0], err, fields)
+			return "", errors.Errorf("command %d of the batch failed: %v", i+1, err)
+		}
+		s.audit(conn, station, fields, auditOK, nil)
+		s.respond(conn, fields[0], resp)
+	}
+
+	return fmt.Sprintf("COMMIT %d", len(b.cmds)), nil
+}
+
+// checkBatch checks that every command in a batch would succeed, in order,
+// and returns the index of the first that wouldn't. Must be called with
+// batchM held, so that nothing changes before the batch is applied.
+//
+// With rate limiting on, the batch's METRICs take their budget here, all at
+// once or not at all, rather than as they're applied.
+func (s *Server) checkBatch(conn *clientConn, b *batch) (int, error) {
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	now := s.Clock.Now()
+	station := conn.name
+	registering := map[string]bool{}
+	var metrics []int
+
+	for i, fields := range b.cmds {
+		args := fields[2:]
+
+		var err error
+		switch fields[1] {
+		case "REGISTER":
+			var r registration
+			if r, err = s.parseRegistration(args); err != nil {
+				break
+			}
+			if err = s.mayRegister(conn, args[0]); err != nil {
+				break
+			}
+			if _, present := s.stations[r.name]; present || registering[r.name] {
+				err = errors.Errorf("%s already registered", r.name)
+				break
+			}
+			registering[r.name] = true
+			station = r.name
+		case "METRIC":
+			_, _, err = parsePoint(args, now)
+			metrics = append(metrics, i)
+		case "LOG":
+			_, err = parseLogEntry(args, now)
+		case "CONFIGURED":
+			if len(args) != 1 {
+				err = argCount(args)
+				break
+			}
+			_, err = parseVersion(args[0])
+		default:
+			err = errors.Errorf("%s cannot be batched", fields[1])
+		}
+
+		if err == nil && station == "" {
+			err = errors.Errorf("client is not a station")
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+
+	if s.rateLimit != nil && len(metrics) > 0 {
+		if n := s.rateLimit.allowN(station, len(metrics), now); n < len(metrics) {
+			return metrics[n], errRateLimited
+		}
+		conn.prepaid = len(metrics)
+	}
+	return 0, nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestBatch(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	server := New(listener, 10, clock.NewMock())
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(station)
+
+	// nothing is answered until the COMMIT.
+	fmt.Fprintf(station, "1 BEGIN\n2 REGISTER water source\n3 METRIC level 1\n4 LOG info up\n5 CONFIGURED 0\n6 COMMIT\n")
+	if err := expectLines(reader, "1 ACK", "2 ACK", "3 ACK", "4 ACK", "5 ACK", "6 COMMIT 4"); err != nil {
+		t.Fatal(err)
+	}
+
+	series, _ := server.snapshot("water")
+	if got := len(series["level"]); got != 1 {
+		t.Fatalf("expected 1 point, got %d", got)
+	}
+
+	// an aborted batch is dropped.
+	fmt.Fprintf(station, "7 BEGIN\n8 METRIC level 2\n9 ABORT\n10 METRIC level 3\n")
+	if err := expectLines(reader, "7 ACK", "9 ACK", "10 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	series, _ = server.snapshot("water")
+	if got := len(series["level"]); got != 2 {
+		t.Fatalf("expected 2 points, got %d", got)
+	}
+}
+
+func TestBatchAllOrNothing(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	server := New(listener, 10, clock.NewMock(), WithStrictProtocol())
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(station)
+
+	for _, tc := range []struct {
+		batch  string
+		expect []string
+	}{
+		// only the failing command and the COMMIT are answered.
+		{"2 REGISTER water source\n3 METRIC level bad\n", []string{"3 ERR E_BADARG pos=3 token=bad", "4 ERR"}},
+		// points need a registration first, even in a batch.
+		{"2 METRIC level 1\n3 REGISTER water source\n", []string{"2 ERR", "4 ERR"}},
+		{"2 REGISTER water source\n3 REGISTER water source\n", []string{"3 ERR", "4 ERR"}},
+		{"2 REGISTER water source\n3 RUN water fill\n", []string{"3 ERR", "4 ERR"}},
+		{"2 REGISTER water source\n3 BEGIN\n", []string{"3 ERR", "4 ERR"}},
+	} {
+		fmt.Fprintf(station, "1 BEGIN\n%s4 COMMIT\n", tc.batch)
+		if err := expectLines(reader, append([]string{"1 ACK"}, tc.expect...)...); err != nil {
+			t.Fatal(err)
+		}
+
+		// nothing in the batch was applied.
+		server.stationsM.RLock()
+		registered := len(server.stations)
+		server.stationsM.RUnlock()
+		if registered != 0 {
+			t.Fatalf("expected no station registered after %q", tc.batch)
+		}
+	}
+
+	if err := sendExpect(station, "5 COMMIT", "5 ERR"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchRateLimit(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 10, clock.NewMock(), WithRateLimit(1, 2))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(station)
+
+	// the budget covers two points, so a batch of three is rejected whole,
+	// at the first point over it.
+	fmt.Fprintf(station, "1 BEGIN\n2 REGISTER water source\n3 METRIC level 1\n4 METRIC level 2\n5 METRIC level 3\n6 COMMIT\n")
+	if err := expectLines(reader, "1 ACK", "5 ERR RATE_LIMITED", "6 ERR"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.stationsM.RLock()
+	registered := len(server.stations)
+	server.stationsM.RUnlock()
+	if registered != 0 {
+		t.Fatal("expected no station registered after a rate limited batch")
+	}
+
+	// a batch the budget covers takes it all at once.
+	fmt.Fprintf(station, "7 BEGIN\n8 REGISTER water source\n9 METRIC level 1\n10 METRIC level 2\n11 COMMIT\n")
+	if err := expectLines(reader, "7 ACK", "8 ACK", "9 ACK", "10 ACK", "11 COMMIT 3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(station, "12 METRIC level 3", "12 ERR RATE_LIMITED"); err != nil {
+		t.Fatal(err)
+	}
+
+	series, _ := server.snapshot("water")
+	if got := len(series["level"]); got != 2 {
+		t.Fatalf("expected 2 points, got %d", got)
+	}
+}
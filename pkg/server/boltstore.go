@@ -0,0 +1,246 @@
+package server
+
+import (
+	byteorder "encoding/binary"
+	"io"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is a MetricStore backed by a BoltDB file. Unlike a PointLog, it
+// doesn't need to keep a copy of every series in memory, and keeps every
+// point it's given rather than just the most recent ones.
+//
+// Each station has a bucket, with a bucket in it for each metric, keyed by
+// the points' timestamps so a cursor walks them in order.
+type BoltStore struct {
+	db        *bolt.DB
+	maxPoints int
+}
+
+// OpenBoltStore opens (or creates) a BoltDB file at path. Queries return at
+// most maxPoints points per metric, the most recent ones.
+func OpenBoltStore(path string, maxPoints int) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "opening bolt store")
+	}
+	return &BoltStore{db: db, maxPoints: maxPoints}, nil
+}
+
+// pointKey is a point's key in its metric's bucket: its timestamp, so points
+// sort by time, then its value, so points at the same time don't overwrite
+// each other.
+func pointKey(ts time.Time, value float64) []byte {
+	key := make([]byte, 16)
+	byteorder.BigEndian.PutUint64(key, uint64(ts.UnixNano()))
+	byteorder.BigEndian.PutUint64(key[8:], math.Float64bits(value))
+	return key
+}
+
+func parsePointKey(key []byte) (time.Time, float64, error) {
+	if len(key) != 16 {
+		return time.Time{}, 0, errors.Errorf("bad point key %x", key)
+	}
+	ts := time.Unix(0, int64(byteorder.BigEndian.Uint64(key)))
+	return ts, math.Float64frombits(byteorder.BigEndian.Uint64(key[8:])), nil
+}
+
+// Append writes points. Appends from many goroutines at once share a single
+// transaction, and so a single fsync.
+func (b *BoltStore) Append(points ...StoredPoint) error {
+	err := b.db.Batch(func(tx *bolt.Tx) error {
+		for _, p := range points {
+			station, err := tx.CreateBucketIfNotExists([]byte(p.Station))
+			if err != nil {
+				return err
+			}
+			series, err := station.CreateBucketIfNotExists([]byte(p.Metric))
+			if err != nil {
+				return err
+			}
+			if err := series.Put(pointKey(p.Ts, p.Value), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "writing bolt store")
+}
+
+// Query returns the most recent points of each of a station's metrics.
+func (b *BoltStore) Query(station string) ([]StoredPoint, error) {
+	var points []StoredPoint
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(station))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEachBucket(func(name []byte) error {
+			var series []StoredPoint
+			c := bucket.Bucket(name).Cursor()
+			for k, _ := c.Last(); k != nil && len(series) < b.maxPoints; k, _ = c.Prev() {
+				ts, value, err := parsePointKey(k)
+				if err != nil {
+					return err
+				}
+				series = append(series, StoredPoint{Station: station, Metric: string(name), Ts: ts, Value: value})
+			}
+
+			for i := len(series) - 1; i >= 0; i-- {
+				points = append(points, series[i])
+			}
+			return nil
+		})
+	})
+	return points, errors.Wrap(err, "reading bolt store")
+}
+
+// Prune drops a station's points of metric, or of every metric if metric is
+// empty.
+func (b *BoltStore) Prune(station, metric string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if metric == "" {
+			return ignoreNotFound(tx.DeleteBucket([]byte(station)))
+		}
+
+		bucket := tx.Bucket([]byte(station))
+		if bucket == nil {
+			return nil
+		}
+		return ignoreNotFound(bucket.DeleteBucket([]byte(metric)))
+	})
+	return errors.Wrap(err, "pruning bolt store")
+}
+
+// Expire drops every point from before cutoff, and the buckets of any
+// station or metric left without points.
+func (b *BoltStore) Expire(cutoff time.Time) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var empty [][]byte
+		err := tx.ForEach(func(name []byte, station *bolt.Bucket) error {
+			var drained [][]byte
+			err := station.ForEachBucket(func(metric []byte) error {
+				series := station.Bucket(metric)
+
+				// deleting while walking a cursor skips keys, so the
+				// points to drop are gathered (copied, as keys are only
+				// valid until the bucket changes) first.
+				var old [][]byte
+				c := series.Cursor()
+				k, _ := c.First()
+				for ; k != nil; k, _ = c.Next() {
+					ts, _, err := parsePointKey(k)
+					if err != nil {
+						return err
+					}
+					if !ts.Before(cutoff) {
+						break
+					}
+					old = append(old, append([]byte(nil), k...))
+				}
+				for _, k := range old {
+					if err := series.Delete(k); err != nil {
+						return err
+					}
+				}
+
+				if k == nil {
+					drained = append(drained, append([]byte(nil), metric...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, metric := range drained {
+				if err := station.DeleteBucket(metric); err != nil {
+					return err
+				}
+			}
+			if k, _ := station.Cursor().First(); k == nil {
+				empty = append(empty, append([]byte(nil), name...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range empty {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "expiring points from bolt store")
+}
+
+func ignoreNotFound(err error) error {
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
+
+// Stations returns the name of every station with points in the store.
+func (b *BoltStore) Stations() ([]string, error) {
+	var names []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	return names, errors.Wrap(err, "reading bolt store")
+}
+
+// Rename moves a station's points to its new name, alongside any already
+// kept under it.
+func (b *BoltStore) Rename(from, to string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		old := tx.Bucket([]byte(from))
+		if old == nil {
+			return nil
+		}
+		renamed, err := tx.CreateBucketIfNotExists([]byte(to))
+		if err != nil {
+			return err
+		}
+
+		err = old.ForEachBucket(func(name []byte) error {
+			series, err := renamed.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+			return old.Bucket(name).ForEach(func(k, _ []byte) error {
+				return series.Put(k, nil)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte(from))
+	})
+	return errors.Wrap(err, "renaming in bolt store")
+}
+
+// Backup writes a copy of the file, as of a single read transaction.
+func (b *BoltStore) Backup(w io.Writer) error {
+	err := b.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	return errors.Wrap(err, "backing up bolt store")
+}
+
+// Close closes the file.
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
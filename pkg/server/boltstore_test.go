@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestBoltStore(t *testing.T) {
+	path := tempPointLogPath(t)
+
+	b, err := OpenBoltStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		if err := b.Append(StoredPoint{"water", "level", time.Unix(i, 0), float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Append(StoredPoint{"water", "flow", time.Unix(1, 0), 4}, StoredPoint{"jasmine", "moisture", time.Unix(1, 0), 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = OpenBoltStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// only the newest points are queried, oldest first.
+	points, err := b.Query("water")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []StoredPoint{
+		{"water", "flow", time.Unix(1, 0), 4},
+		{"water", "level", time.Unix(2, 0), 2},
+		{"water", "level", time.Unix(3, 0), 3},
+	}
+	if !reflect.DeepEqual(points, expected) {
+		t.Fatalf("expected %v, got %v", expected, points)
+	}
+
+	if err := b.Prune("water", "level"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Rename("water", "tank"); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := b.Stations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"jasmine", "tank"}) {
+		t.Fatalf("unexpected stations %v", names)
+	}
+
+	points, err = b.Query("tank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || points[0].Station != "tank" || points[0].Metric != "flow" || points[0].Value != 4 {
+		t.Fatalf("unexpected points after rename %v", points)
+	}
+}
+
+func TestServerRestoresFromBoltStore(t *testing.T) {
+	path := tempPointLogPath(t)
+
+	for i, interactions := range [][]interaction{
+		{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 METRIC level 1", "2 ACK"},
+			{"3 METRIC level 2", "3 ACK"},
+		},
+		{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 METRICS water level", "2 METRICS water level 0:1.00 0:2.00"},
+		},
+	} {
+		store, err := OpenBoltStore(path, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := New(listener, 4, clock.NewMock(), WithMetricStore(store))
+		go server.Serve(context.Background())
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, in := range interactions {
+			if err := sendExpect(conn, in.send, in.expect); err != nil {
+				t.Fatalf("run %d: %v", i, err)
+			}
+		}
+
+		conn.Close()
+		store.Close()
+	}
+}
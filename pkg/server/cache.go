@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// queryCache keeps the answers to fleet-wide queries for a short while, so
+// dashboards polling METRICS * LAST and TOP don't take every station's lock
+// on each refresh. Answers are dropped as soon as a station reports the
+// metric they're about, or a station comes or goes, so they're never staler
+// than the ingest path; the TTL only bounds how long an answer is kept.
+type queryCache struct {
+	ttl   time.Duration
+	clock clock.Clock
+
+	m       sync.Mutex
+	entries map[string]cacheEntry
+
+	// bumped on every invalidation, so an answer computed while its metric
+	// was being written isn't cached.
+	gens  map[string]uint64
+	epoch uint64
+
+	hits          uint64
+	misses        uint64
+	invalidations uint64
+}
+
+type cacheEntry struct {
+	values  []stationValue
+	expires time.Time
+}
+
+func newQueryCache(ttl time.Duration, clock clock.Clock) *queryCache {
+	return &queryCache{
+		ttl:     ttl,
+		clock:   clock,
+		entries: map[string]cacheEntry{},
+		gens:    map[string]uint64{},
+	}
+}
+
+// latest returns the latest values of metric, using compute on a miss.
+func (c *queryCache) latest(metric string, compute func(string) []stationValue) []stationValue {
+	c.m.Lock()
+	if e, ok := c.entries[metric]; ok && c.clock.Now().Before(e.expires) {
+		c.hits++
+		c.m.Unlock()
+		return append([]stationValue(nil), e.values...)
+	}
+	c.misses++
+	gen, epoch := c.gens[metric], c.epoch
+	c.m.Unlock()
+
+	values := compute(metric)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.gens[metric] == gen && c.epoch == epoch {
+		c.entries[metric] = cacheEntry{
+			values:  append([]stationValue(nil), values...),
+			expires: c.clock.Now().Add(c.ttl),
+		}
+	}
+	return values
+}
+
+// invalidate drops answers about metric, after a station reports it.
+func (c *queryCache) invalidate(metric string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.gens[metric]++
+	if _, ok := c.entries[metric]; ok {
+		delete(c.entries, metric)
+		c.invalidations++
+	}
+}
+
+// invalidateAll drops every answer, after a station comes or goes.
+func (c *queryCache) invalidateAll() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.epoch++
+	c.invalidations += uint64(len(c.entries))
+	c.entries = map[string]cacheEntry{}
+}
+
+// prune drops expired answers, and forgets the generations of metrics, which
+// would otherwise pile up for every metric ever reported. Bumping the epoch
+// keeps answers computed before the prune from being cached.
+func (c *queryCache) prune() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	now := c.clock.Now()
+	for metric, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, metric)
+		}
+	}
+
+	c.epoch++
+	c.gens = map[string]uint64{}
+}
+
+// writePrometheus renders the cache's hit rate in Prometheus' text
+// exposition format.
+func (c *queryCache) writePrometheus(w io.Writer) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	fmt.Fprintf(w, "# HELP drops_query_cache_hits_total Fleet-wide queries answered from the cache.\n")
+	fmt.Fprintf(w, "# TYPE drops_query_cache_hits_total counter\n")
+	fmt.Fprintf(w, "drops_query_cache_hits_total %d\n", c.hits)
+
+	fmt.Fprintf(w, "# HELP drops_query_cache_misses_total Fleet-wide queries that had to look at every station.\n")
+	fmt.Fprintf(w, "# TYPE drops_query_cache_misses_total counter\n")
+	fmt.Fprintf(w, "drops_query_cache_misses_total %d\n", c.misses)
+
+	fmt.Fprintf(w, "# HELP drops_query_cache_invalidations_total Cached answers dropped because their data changed.\n")
+	fmt.Fprintf(w, "# TYPE drops_query_cache_invalidations_total counter\n")
+	fmt.Fprintf(w, "drops_query_cache_invalidations_total %d\n", c.invalidations)
+}
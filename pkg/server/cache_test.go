@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestQueryCache(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	server := New(listener, 4, mock, WithQueryCache(time.Minute))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, step := range []struct {
+		conn net.Conn
+		interaction
+	}{
+		{station, interaction{"1 REGISTER water source", "1 ACK"}},
+		{station, interaction{"2 METRIC level 1", "2 ACK"}},
+
+		// a miss, and then a hit.
+		{client, interaction{"1 METRICS * level LAST", "1 METRICS * level LAST water:0:1.00"}},
+		{client, interaction{"2 TOP level 1 MAX", "2 TOP level 1 MAX water:0:1.00"}},
+
+		// reporting the metric drops the cached answer right away.
+		{station, interaction{"3 METRIC level 2", "3 ACK"}},
+		{client, interaction{"3 METRICS * level LAST", "3 METRICS * level LAST water:0:2.00"}},
+
+		// other metrics leave it be.
+		{station, interaction{"4 METRIC pressure 2", "4 ACK"}},
+		{client, interaction{"4 METRICS * level LAST", "4 METRICS * level LAST water:0:2.00"}},
+	} {
+		if err := sendExpect(step.conn, step.send, step.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// answers only last as long as the TTL.
+	mock.Add(time.Minute)
+	if err := sendExpect(client, "5 METRICS * level LAST", "5 METRICS * level LAST water:0:2.00"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range []string{
+		"drops_query_cache_hits_total 2",
+		"drops_query_cache_misses_total 3",
+		"drops_query_cache_invalidations_total 1",
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("expected %s in:\n%s", line, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A station that's been offline for a while comes back with a backlog of
+// points to backfill, and sends them as fast as it can. With catch-up
+// throttling on, backfilled points from every station share a budget of so
+// many points a second. A station over budget waits before its next point
+// is handled, which slows its connection down, while live points and
+// everything else go ahead as usual.
+
+// catchUpAge is how old a point's timestamp has to be for it to count as
+// backfilled.
+const catchUpAge = time.Minute
+
+// catchUp is the budget backfilled points share: a token bucket refilled at
+// rate points a second, holding up to a second's worth.
+type catchUp struct {
+	m      sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	// how many points had to wait, and for how long in all.
+	throttled int
+	waited    time.Duration
+}
+
+func newCatchUp(rate int) *catchUp {
+	return &catchUp{rate: float64(rate), tokens: float64(rate)}
+}
+
+// reserve takes a point's worth of the budget, and returns how long the
+// point has to wait for it.
+func (c *catchUp) reserve(now time.Time) time.Duration {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if now.After(c.last) {
+		if !c.last.IsZero() {
+			c.tokens = min(c.rate, c.tokens+now.Sub(c.last).Seconds()*c.rate)
+		}
+		c.last = now
+	}
+
+	// points keep reserving past an empty bucket, and so wait in turn.
+	c.tokens--
+	if c.tokens >= 0 {
+		return 0
+	}
+
+	wait := time.Duration(-c.tokens / c.rate * float64(time.Second))
+	c.throttled++
+	c.waited += wait
+	return wait
+}
+
+// throttle holds up a METRIC until the catch-up budget allows for it, if it
+// backfills a point, or until ctx is done.
+func (s *Server) throttle(ctx context.Context, args []string) {
+	if len(args) != 3 {
+		return
+	}
+	unix, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		// it'll be rejected anyway.
+		return
+	}
+
+	now := s.Clock.Now()
+	if now.Sub(time.Unix(unix, 0)) < catchUpAge {
+		return
+	}
+	if wait := s.catchUp.reserve(now); wait > 0 {
+		select {
+		case <-s.Clock.After(wait):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (c *catchUp) writePrometheus(w io.Writer) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	fmt.Fprintf(w, "# HELP drops_catchup_throttled_points_total Backfilled points that had to wait for the catch-up budget.\n")
+	fmt.Fprintf(w, "# TYPE drops_catchup_throttled_points_total counter\n")
+	fmt.Fprintf(w, "drops_catchup_throttled_points_total %d\n", c.throttled)
+	fmt.Fprintf(w, "# HELP drops_catchup_wait_seconds_total Time backfilled points waited for the catch-up budget.\n")
+	fmt.Fprintf(w, "# TYPE drops_catchup_wait_seconds_total counter\n")
+	fmt.Fprintf(w, "drops_catchup_wait_seconds_total %g\n", c.waited.Seconds())
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestCatchUpReserve(t *testing.T) {
+	c := newCatchUp(2)
+	now := time.Unix(0, 0)
+
+	for i, want := range []time.Duration{0, 0, 500 * time.Millisecond, time.Second} {
+		if got := c.reserve(now); got != want {
+			t.Fatalf("point %d: expected to wait %s, got %s", i, want, got)
+		}
+	}
+
+	// the bucket refills as time goes by, but only up to a second's worth.
+	now = now.Add(time.Minute)
+	for i, want := range []time.Duration{0, 0, 500 * time.Millisecond} {
+		if got := c.reserve(now); got != want {
+			t.Fatalf("point %d after a while: expected to wait %s, got %s", i, want, got)
+		}
+	}
+	if c.throttled != 3 {
+		t.Fatalf("expected 3 throttled points, got %d", c.throttled)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	mock.Add(time.Hour)
+	server := New(listener, 10, mock, WithCatchUp(1))
+	go server.Serve(context.Background())
+
+	returning, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(returning, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(live, "1 REGISTER air source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(returning)
+	fmt.Fprintf(returning, "2 METRIC level 1 60\n3 METRIC level 2 120\n")
+	if err := expectLines(reader, "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second backfilled point waits, but live points don't.
+	waitFor(t, "the backfill to be throttled", func() bool {
+		server.catchUp.m.Lock()
+		defer server.catchUp.m.Unlock()
+		return server.catchUp.throttled == 1
+	})
+	if err := sendExpect(live, "2 METRIC temp 20", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(live, "3 METRIC temp 21 3599", "3 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		lines <- line
+	}()
+	var got string
+	waitFor(t, "the backfill to go ahead", func() bool {
+		mock.Add(100 * time.Millisecond)
+		select {
+		case got = <-lines:
+			return true
+		default:
+			return false
+		}
+	})
+	if got != "3 ACK\n" {
+		t.Fatalf("expected 3 ACK, got %q", got)
+	}
+}
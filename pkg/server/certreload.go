@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+)
+
+// Certificates get rotated, and restarting the server to pick new ones up
+// drops every station. A CertReloader hands each new TLS handshake the
+// latest certificate and CA bundle instead, loaded again on Reload or when
+// their files change; connections already made carry on as they are. A
+// reload that fails, like when the certificate has been replaced but its key
+// not yet, keeps what was loaded before.
+
+// CertReloader keeps a server's certificate and the CA bundle its clients'
+// certificates are checked against, as loaded from their files.
+type CertReloader struct {
+	certFile, keyFile, caFile string
+	// what every config is made from, without its certificates or CAs.
+	base *tls.Config
+	log  logTo
+
+	m      sync.RWMutex
+	config *tls.Config
+}
+
+// NewCertReloader loads the certificate in certFile and keyFile and the CA
+// bundle in caFile, for configs like base.
+func NewCertReloader(base *tls.Config, certFile, keyFile, caFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		base:     base.Clone(),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetLogger logs reloads to l, rather than the standard logger.
+func (r *CertReloader) SetLogger(l Logger) {
+	r.log.set(l)
+}
+
+// TLSConfig returns a config for listeners, which gives each handshake the
+// certificate and CA bundle loaded last.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	config := r.base.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.m.RLock()
+		defer r.m.RUnlock()
+
+		return r.config, nil
+	}
+	return config
+}
+
+// Reload loads the certificate and CA bundle again, keeping the old ones if
+// they can't be loaded.
+func (r *CertReloader) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "loading key pair")
+	}
+	ca, err := os.ReadFile(r.caFile)
+	if err != nil {
+		return errors.Wrap(err, "reading CA bundle")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return errors.Errorf("no certificates in CA bundle %s", r.caFile)
+	}
+
+	config := r.base.Clone()
+	config.Certificates = []tls.Certificate{certificate}
+	config.ClientCAs = pool
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.config = config
+	return nil
+}
+
+// Watch checks the files every interval, and reloads them once they've
+// changed.
+func (r *CertReloader) Watch(clk clock.Clock, every time.Duration) {
+	watchFiles(clk, every, &r.log, "certificates", r.Reload, r.certFile, r.keyFile, r.caFile)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// writeCerts writes a server certificate from pki, and pki's CA, to dir.
+func writeCerts(t *testing.T, dir string, pki *testPKI, when time.Time) {
+	cert := pki.issue(t, "server")
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, block := range map[string]*pem.Block{
+		"server.crt": {Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		"server.key": {Type: "EC PRIVATE KEY", Bytes: key},
+		"ca.crt":     {Type: "CERTIFICATE", Bytes: pki.ca.Raw},
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, when, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// handshake connects to addr with a certificate from pki, trusting pki's
+// CA, returning the connection if the server accepted it.
+func handshake(t *testing.T, addr string, pki *testPKI) (*tls.Conn, error) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{pki.issue(t, "station")},
+		RootCAs:      pki.pool,
+		ServerName:   "localhost",
+	})
+	if err != nil {
+		return nil, err
+	}
+	// with TLS 1.3, a rejected client certificate only shows on reading.
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err != nil && !isTimeout(err) {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, nil
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(interface{ Timeout() bool })
+	return ok && ne.Timeout()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	old, rotated := newTestPKI(t), newTestPKI(t)
+	start := time.Now().Add(-time.Hour)
+	writeCerts(t, dir, old, start)
+
+	certs, err := NewCertReloader(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert},
+		filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := clock.NewMock()
+	certs.Watch(mock, time.Minute)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", certs.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// held open until the client hangs up.
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	addr := ln.Addr().String()
+
+	before, err := handshake(t, addr, old)
+	if err != nil {
+		t.Fatalf("expected the original certificates to work: %v", err)
+	}
+	defer before.Close()
+
+	// a key that doesn't match its certificate can't be loaded, and the old
+	// pair is kept.
+	other := rotated.issue(t, "server")
+	key, _ := x509.MarshalECPrivateKey(other.PrivateKey.(*ecdsa.PrivateKey))
+	os.WriteFile(filepath.Join(dir, "server.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	if err := certs.Reload(); err == nil {
+		t.Fatal("expected a mismatched key pair to fail to load")
+	}
+	if conn, err := handshake(t, addr, old); err != nil {
+		t.Fatalf("expected the old certificates to be kept: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	writeCerts(t, dir, rotated, start.Add(time.Minute))
+	mock.Add(time.Minute)
+
+	if conn, err := handshake(t, addr, rotated); err != nil {
+		t.Fatalf("expected the rotated certificates to be picked up: %v", err)
+	} else {
+		conn.Close()
+	}
+	if conn, err := handshake(t, addr, old); err == nil {
+		conn.Close()
+		t.Fatal("expected the old CA to no longer be trusted")
+	}
+
+	// connections made before the rotation carry on.
+	before.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := before.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("expected the connection from before to still be open, got %v", err)
+	}
+}
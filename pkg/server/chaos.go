@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Automations and dashboards are usually only ever seen working against a
+// healthy fleet. A server started in chaos mode lets admins make stations
+// and clients misbehave on purpose, by station name or certificate name:
+// their commands can be answered late, or not at all, and their connections
+// dropped, so operators can rehearse what happens when the network or a
+// station degrades. It's meant for test deployments only.
+
+// fault is what's done to a connection's commands.
+type fault struct {
+	// how long every command is held before it's handled.
+	latency time.Duration
+	// the share of answers that are never sent, from 0 to 1.
+	drop float64
+}
+
+func (f fault) String() string {
+	return fmt.Sprintf("latency=%s drop=%g", f.latency, f.drop)
+}
+
+// chaos keeps the faults being injected, by target.
+type chaos struct {
+	m      sync.Mutex
+	faults map[string]fault
+
+	// decides whether an answer is dropped; replaced in tests.
+	rand func() float64
+}
+
+func newChaos() *chaos {
+	return &chaos{faults: map[string]fault{}, rand: rand.Float64}
+}
+
+// get returns the fault for a connection: the one for its station, if any,
+// then its certificate's, then the one for everyone.
+func (c *chaos) get(conn *clientConn) (fault, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for _, target := range []string{conn.name, conn.identity, "*"} {
+		if target == "" {
+			continue
+		}
+		if f, ok := c.faults[target]; ok {
+			return f, true
+		}
+	}
+	return fault{}, false
+}
+
+// injectFault holds up a connection's command for as long as its fault
+// says to, or until ctx is done, and reports whether the answer to it
+// should be dropped.
+func (s *Server) injectFault(ctx context.Context, conn *clientConn) bool {
+	f, ok := s.chaos.get(conn)
+	if !ok {
+		return false
+	}
+
+	if f.latency > 0 {
+		select {
+		case <-s.Clock.After(f.latency):
+		case <-ctx.Done():
+		}
+	}
+	return f.drop > 0 && s.chaos.rand() < f.drop
+}
+
+// CHAOS cmd (admin only, in chaos mode)
+// Expected args:
+//  - none, to list the faults being injected
+//  - [target] [fault] ..., where target is a station or certificate name or
+//    *, and each fault is latency=[duration], drop=[share], disconnect, or
+//    off
+func (s *Server) handleChaos(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+	if s.chaos == nil {
+		return "", errors.New("the server isn't in chaos mode")
+	}
+
+	if len(args) == 0 {
+		return s.listFaults(conn, uid), nil
+	}
+	if len(args) < 2 {
+		return "", argCount(args)
+	}
+	target := args[0]
+
+	s.chaos.m.Lock()
+	f := s.chaos.faults[target]
+	s.chaos.m.Unlock()
+
+	disconnect, off := false, false
+	for _, arg := range args[1:] {
+		k, v, _ := strings.Cut(arg, "=")
+		switch k {
+		case "latency":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return "", badArgf(arg, "bad latency %s", v)
+			}
+			f.latency = d
+		case "drop":
+			p, err := strconv.ParseFloat(v, 64)
+			if err != nil || p < 0 || p > 1 {
+				return "", badArgf(arg, "drop should be between 0 and 1, got %s", v)
+			}
+			f.drop = p
+		case "disconnect":
+			disconnect = true
+		case "off":
+			off = true
+		default:
+			return "", badArgf(arg, "unknown fault %s", arg)
+		}
+	}
+
+	s.chaos.m.Lock()
+	if off || f == (fault{}) {
+		delete(s.chaos.faults, target)
+	} else {
+		s.chaos.faults[target] = f
+	}
+	s.chaos.m.Unlock()
+
+	s.log.Errorf("chaos: %s set %s on %s", describe(conn), args[1:], target)
+
+	if disconnect {
+		s.connsM.Lock()
+		for c := range s.conns {
+			if c != conn && (target == "*" || c.name == target || c.identity == target) {
+				c.Close()
+			}
+		}
+		s.connsM.Unlock()
+	}
+
+	return "ACK", nil
+}
+
+// listFaults writes a line for each fault being injected, and returns the
+// final response.
+func (s *Server) listFaults(conn *clientConn, uid string) string {
+	s.chaos.m.Lock()
+	defer s.chaos.m.Unlock()
+
+	targets := make([]string, 0, len(s.chaos.faults))
+	for target := range s.chaos.faults {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	var buf bytes.Buffer
+	for _, target := range targets {
+		fmt.Fprintf(&buf, "%s FAULT %s %s\n", uid, target, s.chaos.faults[target])
+	}
+	conn.Write(buf.Bytes())
+
+	return fmt.Sprintf("CHAOS %d", len(targets))
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestChaos(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	server := New(listener, 4, mock, TrustPlaintext(), WithChaos())
+	go server.Serve(context.Background())
+	addr := listener.Addr().String()
+
+	station, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	admin, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	stationLines, adminLines := bufio.NewReader(station), bufio.NewReader(admin)
+	exchange := func(conn net.Conn, lines *bufio.Reader, send string, expect ...string) {
+		t.Helper()
+		fmt.Fprintf(conn, "%s\n", send)
+		if err := expectLines(lines, expect...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exchange(station, stationLines, "1 REGISTER water source", "1 ACK")
+	exchange(admin, adminLines, "2 CHAOS water drop=1 latency=1s", "2 ACK")
+	exchange(admin, adminLines, "3 CHAOS", "3 FAULT water latency=1s drop=1", "3 CHAOS 1")
+
+	// the point is stored, but its answer is held up and then lost.
+	fmt.Fprintf(station, "4 METRIC level 1\n")
+	deadline := time.Now().Add(time.Second)
+	for {
+		// the METRIC is held up on the server's clock.
+		mock.Add(time.Second)
+		if ms, _ := server.snapshot("water"); len(ms["level"]) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the point to be stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	exchange(admin, adminLines, "5 CHAOS water off", "5 ACK")
+	exchange(station, stationLines, "6 PING", "6 PONG")
+
+	exchange(admin, adminLines, "7 CHAOS water disconnect", "7 ACK")
+	station.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stationLines.ReadString('\n'); err == nil {
+		t.Fatal("expected the station to be disconnected")
+	}
+
+	exchange(admin, adminLines, "8 CHAOS water drop=2", "8 ERR")
+	exchange(admin, adminLines, "9 CHAOS water explode", "9 ERR")
+}
+
+func TestChaosOff(t *testing.T) {
+	server := New(nil, 4, clock.NewMock(), TrustPlaintext())
+	if _, err := server.handleChaos(context.Background(), &clientConn{}, "1", "*", "drop=1"); err == nil {
+		t.Fatal("expected CHAOS to need chaos mode")
+	}
+
+	server = New(nil, 4, clock.NewMock(), WithChaos())
+	if _, err := server.handleChaos(context.Background(), &clientConn{tls: true}, "1", "*", "drop=1"); err == nil {
+		t.Fatal("expected CHAOS to be admin only")
+	}
+}
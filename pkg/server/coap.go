@@ -0,0 +1,239 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Just enough of CoAP (RFC 7252) and its observe extension (RFC 7641) for
+// the gateway: parsing requests and writing responses and notifications.
+// Blockwise transfers and the like aren't supported; devices this small
+// don't send anything that big.
+
+// CoAP message types.
+const (
+	coapCON = 0
+	coapNON = 1
+	coapACK = 2
+	coapRST = 3
+)
+
+// coapCode builds a CoAP code from its class and detail, as in 2.05.
+func coapCode(class, detail uint8) uint8 {
+	return class<<5 | detail
+}
+
+// CoAP codes the gateway understands or answers with.
+var (
+	coapEmpty = coapCode(0, 0)
+	coapGET   = coapCode(0, 1)
+	coapPOST  = coapCode(0, 2)
+
+	coapCreated = coapCode(2, 1)
+	coapDeleted = coapCode(2, 2)
+	coapChanged = coapCode(2, 4)
+	coapContent = coapCode(2, 5)
+
+	coapBadRequest       = coapCode(4, 0)
+	coapForbidden        = coapCode(4, 3)
+	coapNotFound         = coapCode(4, 4)
+	coapMethodNotAllowed = coapCode(4, 5)
+	coapTooManyRequests  = coapCode(4, 29)
+	coapUnavailable      = coapCode(5, 3)
+)
+
+// CoAP option numbers.
+const (
+	coapObserve  = 6
+	coapURIPath  = 11
+	coapURIQuery = 15
+)
+
+type coapOption struct {
+	num   uint16
+	value []byte
+}
+
+// coapMessage is a CoAP message, request or response.
+type coapMessage struct {
+	typ     uint8
+	code    uint8
+	id      uint16
+	token   []byte
+	options []coapOption
+	payload []byte
+}
+
+// option returns every value of an option, in order.
+func (m *coapMessage) option(num uint16) [][]byte {
+	var values [][]byte
+	for _, o := range m.options {
+		if o.num == num {
+			values = append(values, o.value)
+		}
+	}
+	return values
+}
+
+// path returns the request's Uri-Path segments.
+func (m *coapMessage) path() []string {
+	var segments []string
+	for _, v := range m.option(coapURIPath) {
+		segments = append(segments, string(v))
+	}
+	return segments
+}
+
+// query returns the request's Uri-Query options as key=value pairs.
+func (m *coapMessage) query() map[string]string {
+	q := map[string]string{}
+	for _, v := range m.option(coapURIQuery) {
+		kv := string(v)
+		for i := 0; i < len(kv); i++ {
+			if kv[i] == '=' {
+				q[kv[:i]] = kv[i+1:]
+				break
+			}
+		}
+	}
+	return q
+}
+
+// observe returns the request's Observe option, if it has one.
+func (m *coapMessage) observe() (uint32, bool) {
+	values := m.option(coapObserve)
+	if len(values) == 0 {
+		return 0, false
+	}
+	var n uint32
+	for _, b := range values[0] {
+		n = n<<8 | uint32(b)
+	}
+	return n, true
+}
+
+// uintOption encodes n as a CoAP uint option value, in as few bytes as it
+// takes.
+func uintOption(n uint32) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return b
+}
+
+// parseCoAP reads a CoAP message from a datagram.
+func parseCoAP(b []byte) (coapMessage, error) {
+	var m coapMessage
+	if len(b) < 4 {
+		return m, errors.New("coap message too short")
+	}
+	if b[0]>>6 != 1 {
+		return m, errors.Errorf("unknown coap version %d", b[0]>>6)
+	}
+
+	m.typ = b[0] >> 4 & 0x3
+	tkl := int(b[0] & 0xf)
+	m.code = b[1]
+	m.id = uint16(b[2])<<8 | uint16(b[3])
+	if tkl > 8 || len(b) < 4+tkl {
+		return m, errors.New("bad coap token")
+	}
+	m.token = append([]byte(nil), b[4:4+tkl]...)
+
+	b = b[4+tkl:]
+	num := 0
+	for len(b) > 0 {
+		if b[0] == 0xff {
+			if len(b) == 1 {
+				return m, errors.New("coap payload marker with no payload")
+			}
+			m.payload = append([]byte(nil), b[1:]...)
+			break
+		}
+
+		delta, length := int(b[0]>>4), int(b[0]&0xf)
+		b = b[1:]
+		var err error
+		if delta, b, err = coapExtended(delta, b); err != nil {
+			return m, err
+		}
+		if length, b, err = coapExtended(length, b); err != nil {
+			return m, err
+		}
+		if len(b) < length {
+			return m, errors.New("coap option overruns the message")
+		}
+
+		num += delta
+		if num > 0xffff {
+			return m, errors.New("coap option number out of range")
+		}
+		m.options = append(m.options, coapOption{num: uint16(num), value: append([]byte(nil), b[:length]...)})
+		b = b[length:]
+	}
+
+	return m, nil
+}
+
+// coapExtended reads an option delta or length's extended bytes, if it has
+// any.
+func coapExtended(n int, b []byte) (int, []byte, error) {
+	switch n {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errors.New("truncated coap option")
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errors.New("truncated coap option")
+		}
+		return (int(b[0])<<8 | int(b[1])) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errors.New("reserved coap option nibble")
+	}
+	return n, b, nil
+}
+
+// marshal writes a CoAP message as a datagram.
+func (m coapMessage) marshal() []byte {
+	b := []byte{1<<6 | m.typ<<4 | byte(len(m.token)), m.code, byte(m.id >> 8), byte(m.id)}
+	b = append(b, m.token...)
+
+	options := append([]coapOption(nil), m.options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].num < options[j].num })
+
+	last := 0
+	for _, o := range options {
+		delta, length := int(o.num)-last, len(o.value)
+		last = int(o.num)
+
+		dn, dext := coapNibble(delta)
+		ln, lext := coapNibble(length)
+		b = append(b, byte(dn<<4|ln))
+		b = append(b, dext...)
+		b = append(b, lext...)
+		b = append(b, o.value...)
+	}
+
+	if len(m.payload) > 0 {
+		b = append(b, 0xff)
+		b = append(b, m.payload...)
+	}
+	return b
+}
+
+// coapNibble encodes an option delta or length as its nibble and extended
+// bytes.
+func coapNibble(n int) (int, []byte) {
+	switch {
+	case n < 13:
+		return n, nil
+	case n < 269:
+		return 13, []byte{byte(n - 13)}
+	default:
+		return 14, []byte{byte((n - 269) >> 8), byte(n - 269)}
+	}
+}
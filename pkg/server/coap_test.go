@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestCoAPMessage(t *testing.T) {
+	m := coapMessage{
+		typ:   coapCON,
+		code:  coapPOST,
+		id:    0x1234,
+		token: []byte{1, 2, 3},
+		options: []coapOption{
+			{num: coapURIQuery, value: []byte("name=water")},
+			{num: coapURIPath, value: []byte("register")},
+			// long enough to need an extended length.
+			{num: coapURIQuery, value: []byte(strings.Repeat("x", 300))},
+			// far enough along to need an extended delta.
+			{num: 60, value: []byte{1}},
+		},
+		payload: []byte("hi"),
+	}
+
+	got, err := parseCoAP(m.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.typ != m.typ || got.code != m.code || got.id != m.id || !bytes.Equal(got.token, m.token) || string(got.payload) != "hi" {
+		t.Fatalf("header or payload didn't survive: %+v", got)
+	}
+	// options come out in order, with repeated ones in the order given.
+	want := []coapOption{m.options[1], m.options[0], m.options[2], m.options[3]}
+	if !reflect.DeepEqual(got.options, want) {
+		t.Fatalf("expected options %v, got %v", want, got.options)
+	}
+	if got.path()[0] != "register" || got.query()["name"] != "water" {
+		t.Fatalf("unexpected path %v or query %v", got.path(), got.query())
+	}
+
+	for _, bad := range [][]byte{
+		{0x40, 0x01},
+		// version 2.
+		{0x80, 0x01, 0, 0},
+		// a token longer than the message.
+		{0x44, 0x01, 0, 0, 1},
+		// a payload marker with nothing after it.
+		{0x40, 0x01, 0, 0, 0xff},
+		// an option longer than the message.
+		{0x40, 0x01, 0, 0, 0xb5, 'a'},
+	} {
+		if _, err := parseCoAP(bad); err == nil {
+			t.Fatalf("expected %x to be rejected", bad)
+		}
+	}
+}
+
+// coapStation is a CoAP station talking to a test server.
+type coapStation struct {
+	t    *testing.T
+	conn net.Conn
+	id   uint16
+}
+
+// request sends a confirmable request and returns its answer.
+func (c *coapStation) request(code uint8, path string, query []string, observe int, payload string) coapMessage {
+	c.id++
+	req := coapMessage{typ: coapCON, code: code, id: c.id, token: []byte{byte(c.id)}, payload: []byte(payload)}
+	for _, segment := range strings.Split(path, "/")[1:] {
+		req.options = append(req.options, coapOption{num: coapURIPath, value: []byte(segment)})
+	}
+	for _, q := range query {
+		req.options = append(req.options, coapOption{num: coapURIQuery, value: []byte(q)})
+	}
+	if observe >= 0 {
+		req.options = append(req.options, coapOption{num: coapObserve, value: uintOption(uint32(observe))})
+	}
+
+	if _, err := c.conn.Write(req.marshal()); err != nil {
+		c.t.Fatal(err)
+	}
+	resp := c.read()
+	if resp.typ != coapACK || resp.id != req.id || !bytes.Equal(resp.token, req.token) {
+		c.t.Fatalf("%s: expected a piggybacked answer, got %+v", path, resp)
+	}
+	return resp
+}
+
+func (c *coapStation) read() coapMessage {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, coapMaxMessage)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	m, err := parseCoAP(buf[:n])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+func TestCoAPGateway(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	server := New(listener, 10, mock, TrustPlaintext(), WithCoAP(time.Hour))
+	go server.Serve(context.Background())
+	go server.ServeCoAP(context.Background(), pc)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	station := &coapStation{t: t, conn: conn}
+
+	// pings are answered with resets, without starting a session.
+	conn.Write(coapMessage{typ: coapCON, id: 99}.marshal())
+	if resp := station.read(); resp.typ != coapRST || resp.id != 99 {
+		t.Fatalf("expected a reset, got %+v", resp)
+	}
+
+	if resp := station.request(coapPOST, "/register", []string{"name=water", "type=source"}, -1, ""); resp.code != coapCreated {
+		t.Fatalf("expected 2.01, got %d.%02d", resp.code>>5, resp.code&0x1f)
+	}
+	// arguments can't smuggle in more of them.
+	if resp := station.request(coapPOST, "/metric/level 1", nil, -1, "2"); resp.code != coapBadRequest {
+		t.Fatalf("expected 4.00, got %d.%02d", resp.code>>5, resp.code&0x1f)
+	}
+	if resp := station.request(coapGET, "/metric/level", nil, -1, ""); resp.code != coapMethodNotAllowed {
+		t.Fatalf("expected 4.05, got %d.%02d", resp.code>>5, resp.code&0x1f)
+	}
+	if resp := station.request(coapPOST, "/nowhere", nil, -1, ""); resp.code != coapNotFound {
+		t.Fatalf("expected 4.04, got %d.%02d", resp.code>>5, resp.code&0x1f)
+	}
+
+	if resp := station.request(coapPOST, "/metric/level", nil, -1, "2.5"); resp.code != coapChanged {
+		t.Fatalf("expected 2.04, got %d.%02d", resp.code>>5, resp.code&0x1f)
+	}
+	// a retransmission is answered again, without storing the point twice.
+	req := coapMessage{typ: coapCON, code: coapPOST, id: station.id, token: []byte{byte(station.id)}}
+	req.options = []coapOption{{num: coapURIPath, value: []byte("metric")}, {num: coapURIPath, value: []byte("level")}}
+	req.payload = []byte("2.5")
+	conn.Write(req.marshal())
+	if resp := station.read(); resp.code != coapChanged || resp.id != station.id {
+		t.Fatalf("expected the retransmission to be answered again, got %+v", resp)
+	}
+	server.stationsM.RLock()
+	water := server.stations["water"]
+	server.stationsM.RUnlock()
+	water.m.Lock()
+	n := len(water.metrics["level"])
+	water.m.Unlock()
+	if n != 1 {
+		t.Fatalf("expected a single point, got %d", n)
+	}
+
+	resp := station.request(coapGET, "/config", nil, 0, "")
+	if resp.code != coapContent || len(resp.option(coapObserve)) != 1 || len(resp.payload) != 0 {
+		t.Fatalf("expected an empty observed configuration, got %+v", resp)
+	}
+
+	admin, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if err := sendExpect(admin, "1 CONFIG SET water interval=60", "1 CONFIG water 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	notification := station.read()
+	if notification.typ != coapNON || notification.code != coapContent || string(notification.payload) != "1 interval=60" {
+		t.Fatalf("expected a notification of the new configuration, got %+v", notification)
+	}
+	if !bytes.Equal(notification.token, resp.token) {
+		t.Fatal("expected the notification to carry the observation's token")
+	}
+	if seq, _ := notification.observe(); seq != 1 {
+		t.Fatalf("expected the notification to be numbered 1, got %d", seq)
+	}
+
+	if resp := station.request(coapPOST, "/configured", nil, -1, "1"); resp.code != coapChanged {
+		t.Fatalf("expected 2.04, got %d.%02d", resp.code>>5, resp.code&0x1f)
+	}
+	if resp := station.request(coapPOST, "/unregister", nil, -1, ""); resp.code != coapDeleted {
+		t.Fatalf("expected 2.02, got %d.%02d", resp.code>>5, resp.code&0x1f)
+	}
+
+	// the next request starts a new session, which can register again.
+	if resp := station.request(coapPOST, "/register", []string{"name=water", "type=source"}, -1, ""); resp.code != coapCreated {
+		t.Fatalf("expected 2.01, got %d.%02d", resp.code>>5, resp.code&0x1f)
+	}
+
+	// and goes away once the station has been quiet for long enough.
+	mock.Add(time.Hour)
+	for i := 0; ; i++ {
+		server.stationsM.RLock()
+		_, online := server.stations["water"]
+		server.stationsM.RUnlock()
+		if !online {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected the quiet station's session to end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCoAPUntrusted(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// plaintext connections are trusted, but CoAP sessions still can't
+	// register without a certificate.
+	server := New(listener, 10, clock.NewMock(), TrustPlaintext(), WithBoundNames(nil), WithCoAP(time.Hour))
+	go server.Serve(context.Background())
+	go server.ServeCoAP(context.Background(), pc)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	station := &coapStation{t: t, conn: conn}
+	if resp := station.request(coapPOST, "/register", []string{"name=water", "type=source"}, -1, ""); resp.code != coapBadRequest {
+		t.Fatalf("expected 4.00, got %d.%02d", resp.code>>5, resp.code&0x1f)
+	}
+
+	// nor are they admins, or let past roles.
+	roles, err := ParseRoles(strings.NewReader(`{"roles": {"station": ["REGISTER"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = New(nil, 4, clock.NewMock(), TrustPlaintext(), WithRoles(roles))
+	session := &clientConn{Conn: coapConn{}}
+	if err := server.identify(session); err != nil {
+		t.Fatal(err)
+	}
+	if server.isAdmin(session) {
+		t.Fatal("expected a CoAP session not to be an admin")
+	}
+	if err := server.authorize(session, "REGISTER"); err == nil {
+		t.Fatal("expected a CoAP session without a role to be forbidden")
+	}
+	if err := server.authorize(&clientConn{}, "REGISTER"); err != nil {
+		t.Fatalf("expected trusted plaintext connections to be allowed: %v", err)
+	}
+}
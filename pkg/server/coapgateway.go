@@ -0,0 +1,493 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Stations on LPWAN links can't keep a TCP connection open, let alone do a
+// TLS handshake over one. The CoAP gateway lets them send CoAP requests over
+// UDP instead, or DTLS given a listener for it, and turns each into a
+// command on a line protocol session of their own, kept per source address.
+// Sessions are handled just like TCP connections, so everything from rate
+// limits to configuration pushes applies to them too; they end when the
+// station unregisters or goes quiet for too long.
+//
+// Resources:
+//  - POST /register?name=[name]&type=[type][&location=[lat],[lon]], as
+//    REGISTER, answered 2.01
+//  - POST /metric/[name] with [float] [ts] as its payload, as METRIC,
+//    answered 2.04
+//  - GET /config, answered 2.05 with [version] [blob]; with Observe 0, every
+//    new configuration is sent along too
+//  - POST /configured with [version] as its payload, as CONFIGURED,
+//    answered 2.04
+//  - POST /unregister, as UNREGISTER, answered 2.02
+
+const (
+	// the largest datagram read, as RFC 7252 recommends when the path's MTU
+	// is unknown.
+	coapMaxMessage = 1152
+
+	// how long a command has to be answered in before the station is told
+	// the server is unavailable.
+	coapAnswerTimeout = 10 * time.Second
+
+	// prefixes the uids of commands the gateway sends.
+	coapUID = "coap"
+)
+
+// coapGateway is every CoAP station's session, by address.
+type coapGateway struct {
+	timeout time.Duration
+
+	m        sync.Mutex
+	sessions map[string]*coapSession
+}
+
+// coapSession is a CoAP station's line protocol session.
+type coapSession struct {
+	s   *Server
+	key string
+	// the gateway's end of the session.
+	conn net.Conn
+	// sends a datagram to the station.
+	send func([]byte) error
+
+	// held for the whole of a request, so there's only ever one command in
+	// flight.
+	requestM sync.Mutex
+	seq      int
+	answers  chan coapAnswer
+
+	m        sync.Mutex
+	lastSeen time.Time
+	// the last confirmable request's id and answer, to answer
+	// retransmissions with.
+	lastID    uint16
+	lastReply []byte
+	nextID    uint16
+	// the latest configuration pushed, as [version] [blob].
+	config []byte
+	// the token of the station's GET /config observation, if it has one.
+	observer   []byte
+	observeSeq uint32
+}
+
+// coapAnswer is a line the server answered a command with.
+type coapAnswer struct {
+	uid, line string
+}
+
+// coapConn is the server's end of a session, which comes from the
+// station's address.
+type coapConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c coapConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// ServeCoAP answers CoAP requests arriving on pc until it fails or ctx is
+// cancelled. It needs WithCoAP.
+func (s *Server) ServeCoAP(ctx context.Context, pc net.PacketConn) error {
+	if s.coap == nil {
+		return errors.New("the CoAP gateway isn't enabled")
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		pc.Close()
+	})
+	defer stop()
+
+	buf := make([]byte, coapMaxMessage)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		b := append([]byte(nil), buf[:n]...)
+		go s.coapDatagram(ctx, addr, func(reply []byte) error {
+			_, err := pc.WriteTo(reply, addr)
+			return err
+		}, b)
+	}
+}
+
+// ServeCoAPConn answers CoAP requests from a single station on c, where each
+// Read returns a whole datagram, as DTLS connections do. It returns once c
+// fails or ctx is cancelled, ending the station's session.
+func (s *Server) ServeCoAPConn(ctx context.Context, c net.Conn) error {
+	if s.coap == nil {
+		return errors.New("the CoAP gateway isn't enabled")
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		c.Close()
+	})
+	defer stop()
+	defer s.coap.end(c.RemoteAddr().String())
+
+	buf := make([]byte, coapMaxMessage)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		s.coapDatagram(ctx, c.RemoteAddr(), func(reply []byte) error {
+			_, err := c.Write(reply)
+			return err
+		}, buf[:n])
+	}
+}
+
+// coapDatagram handles a datagram from a station.
+func (s *Server) coapDatagram(ctx context.Context, addr net.Addr, send func([]byte) error, b []byte) {
+	req, err := parseCoAP(b)
+	if err != nil {
+		// not logged: on UDP, anything can turn up.
+		return
+	}
+
+	switch {
+	case req.typ == coapRST:
+		// the station doesn't want any more notifications.
+		if sess := s.coap.lookup(addr.String()); sess != nil {
+			sess.unobserve()
+		}
+		return
+	case req.typ == coapACK:
+		return
+	case req.code == coapEmpty:
+		// a ping, which is answered with a reset.
+		if req.typ == coapCON {
+			send(coapMessage{typ: coapRST, id: req.id}.marshal())
+		}
+		return
+	}
+
+	sess, err := s.coapSession(ctx, addr, send)
+	if err != nil {
+		s.log.Errorf("turning away CoAP station %s: %v", addr, err)
+		resp := coapMessage{typ: coapACK, code: coapUnavailable, id: req.id, token: req.token}
+		if req.typ != coapCON {
+			resp.typ, resp.id = coapNON, uint16(rand.Intn(1<<16))
+		}
+		send(resp.marshal())
+		return
+	}
+	sess.serve(req)
+}
+
+// coapSession returns the session for a station's address, starting one if
+// it doesn't have one yet.
+func (s *Server) coapSession(ctx context.Context, addr net.Addr, send func([]byte) error) (*coapSession, error) {
+	g := s.coap
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	key := addr.String()
+	if sess, ok := g.sessions[key]; ok {
+		return sess, nil
+	}
+
+	s.connsM.Lock()
+	if s.closing {
+		s.connsM.Unlock()
+		return nil, ErrServerClosed
+	}
+	if !s.admit() {
+		s.refused++
+		s.connsM.Unlock()
+		return nil, errors.Errorf("already handling %d connections", s.maxConns)
+	}
+	s.handlers.Add(1)
+	s.connsM.Unlock()
+
+	ours, theirs := net.Pipe()
+	sess := &coapSession{
+		s:        s,
+		key:      key,
+		conn:     ours,
+		send:     send,
+		answers:  make(chan coapAnswer, 1),
+		lastSeen: s.Clock.Now(),
+		nextID:   uint16(rand.Intn(1 << 16)),
+	}
+	g.sessions[key] = sess
+
+	go func() {
+		defer s.handlers.Done()
+		defer s.release()
+		s.handle(ctx, coapConn{Conn: theirs, addr: addr})
+	}()
+	go sess.read()
+
+	return sess, nil
+}
+
+// lookup returns the session for an address, if there is one.
+func (g *coapGateway) lookup(key string) *coapSession {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	return g.sessions[key]
+}
+
+// end ends the session for an address, if there is one.
+func (g *coapGateway) end(key string) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	if sess, ok := g.sessions[key]; ok {
+		delete(g.sessions, key)
+		sess.conn.Close()
+	}
+}
+
+// forget drops a session that's over.
+func (g *coapGateway) forget(sess *coapSession) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	if g.sessions[sess.key] == sess {
+		delete(g.sessions, sess.key)
+	}
+}
+
+// expireCoAPSessions ends the sessions of stations that have gone quiet,
+// checking every timeout.
+func (s *Server) expireCoAPSessions() {
+	s.Clock.AfterFunc(s.coap.timeout, func() {
+		s.coap.expire(s.Clock.Now())
+		s.expireCoAPSessions()
+	})
+}
+
+// expire ends the sessions nothing has been heard on for the timeout.
+func (g *coapGateway) expire(now time.Time) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	for key, sess := range g.sessions {
+		sess.m.Lock()
+		quiet := now.Sub(sess.lastSeen)
+		sess.m.Unlock()
+
+		if quiet >= g.timeout {
+			sess.s.log.Infof("ending CoAP session for %s after %s without a request", key, quiet)
+			delete(g.sessions, key)
+			sess.conn.Close()
+		}
+	}
+}
+
+// read takes in what the server sends the session, until it ends.
+func (sess *coapSession) read() {
+	defer sess.s.coap.forget(sess)
+
+	scanner := bufio.NewScanner(sess.conn)
+	for scanner.Scan() {
+		uid, line, _ := strings.Cut(scanner.Text(), " ")
+		switch {
+		case uid == "config":
+			// config CONFIG [version] [blob]
+			sess.configure(strings.TrimPrefix(line, "CONFIG "))
+		case strings.HasPrefix(uid, coapUID):
+			sess.answers <- coapAnswer{uid: uid, line: line}
+		}
+		// anything else, like RUNs, can't be passed on to a CoAP station.
+	}
+}
+
+// configure keeps a configuration pushed to the station, and notifies it if
+// it's observing its configuration.
+func (sess *coapSession) configure(config string) {
+	sess.m.Lock()
+	defer sess.m.Unlock()
+
+	sess.config = []byte(config)
+	if sess.observer == nil {
+		return
+	}
+
+	sess.observeSeq++
+	sess.nextID++
+	sess.send(coapMessage{
+		typ:     coapNON,
+		code:    coapContent,
+		id:      sess.nextID,
+		token:   sess.observer,
+		options: []coapOption{{num: coapObserve, value: uintOption(sess.observeSeq)}},
+		payload: sess.config,
+	}.marshal())
+}
+
+// unobserve stops notifying the station of new configurations.
+func (sess *coapSession) unobserve() {
+	sess.m.Lock()
+	defer sess.m.Unlock()
+
+	sess.observer = nil
+}
+
+// serve answers a request from the station.
+func (sess *coapSession) serve(req coapMessage) {
+	sess.requestM.Lock()
+	defer sess.requestM.Unlock()
+
+	sess.m.Lock()
+	sess.lastSeen = sess.s.Clock.Now()
+	if req.typ == coapCON && sess.lastReply != nil && req.id == sess.lastID {
+		// a retransmission of a request whose answer got lost.
+		reply := sess.lastReply
+		sess.m.Unlock()
+		sess.send(reply)
+		return
+	}
+	sess.m.Unlock()
+
+	code, options, payload := sess.route(req)
+	resp := coapMessage{typ: coapACK, code: code, id: req.id, token: req.token, options: options, payload: payload}
+
+	sess.m.Lock()
+	if req.typ == coapCON {
+		sess.lastID, sess.lastReply = req.id, resp.marshal()
+	} else {
+		sess.nextID++
+		resp.typ, resp.id = coapNON, sess.nextID
+	}
+	sess.m.Unlock()
+
+	sess.send(resp.marshal())
+	// only UNREGISTER is answered with 2.02.
+	if code == coapDeleted {
+		sess.s.coap.end(sess.key)
+	}
+}
+
+// route answers a request with a code, options and payload.
+func (sess *coapSession) route(req coapMessage) (uint8, []coapOption, []byte) {
+	path := req.path()
+	if len(path) == 0 {
+		return coapNotFound, nil, nil
+	}
+
+	var cmd []string
+	success := coapChanged
+	switch {
+	case path[0] == "config" && len(path) == 1:
+		if req.code != coapGET {
+			return coapMethodNotAllowed, nil, nil
+		}
+		return sess.getConfig(req)
+
+	case path[0] == "register" && len(path) == 1:
+		q := req.query()
+		cmd = []string{"REGISTER", q["name"], q["type"]}
+		if location, ok := q["location"]; ok {
+			cmd = append(cmd, "location="+location)
+		}
+		success = coapCreated
+
+	case path[0] == "metric" && len(path) == 2:
+		cmd = append([]string{"METRIC", path[1]}, strings.Fields(string(req.payload))...)
+
+	case path[0] == "configured" && len(path) == 1:
+		cmd = append([]string{"CONFIGURED"}, strings.Fields(string(req.payload))...)
+
+	case path[0] == "unregister" && len(path) == 1:
+		cmd = []string{"UNREGISTER"}
+		success = coapDeleted
+
+	default:
+		return coapNotFound, nil, nil
+	}
+
+	if req.code != coapPOST {
+		return coapMethodNotAllowed, nil, nil
+	}
+	for _, arg := range cmd {
+		// arguments from paths and queries mustn't smuggle in more of them,
+		// or another command.
+		if arg == "" || strings.ContainsAny(arg, " \t\r\n") {
+			return coapBadRequest, nil, []byte("missing or bad argument")
+		}
+	}
+
+	answer, err := sess.command(strings.Join(cmd, " "))
+	switch {
+	case err != nil:
+		sess.s.log.Errorf("couldn't pass on CoAP request from %s: %v", sess.key, err)
+		return coapUnavailable, nil, nil
+	case answer == "ACK":
+		return success, nil, nil
+	case strings.HasPrefix(answer, "ERR "+codeRateLimited):
+		return coapTooManyRequests, nil, []byte(answer)
+	case strings.HasPrefix(answer, "ERR "+codeForbidden):
+		return coapForbidden, nil, []byte(answer)
+	default:
+		return coapBadRequest, nil, []byte(answer)
+	}
+}
+
+// getConfig answers GET /config, starting or stopping an observation if
+// it's asked to.
+func (sess *coapSession) getConfig(req coapMessage) (uint8, []coapOption, []byte) {
+	sess.m.Lock()
+	defer sess.m.Unlock()
+
+	observe, ok := req.observe()
+	switch {
+	case ok && observe == 0:
+		sess.observer = req.token
+		return coapContent, []coapOption{{num: coapObserve, value: uintOption(sess.observeSeq)}}, sess.config
+	case ok && observe == 1:
+		sess.observer = nil
+	}
+
+	if sess.config == nil {
+		return coapNotFound, nil, nil
+	}
+	return coapContent, nil, sess.config
+}
+
+// command sends a command on the session, and returns the server's answer.
+func (sess *coapSession) command(cmd string) (string, error) {
+	sess.seq++
+	uid := fmt.Sprintf("%s%d", coapUID, sess.seq)
+	if _, err := fmt.Fprintf(sess.conn, "%s %s\n", uid, cmd); err != nil {
+		return "", err
+	}
+
+	timeout := time.After(coapAnswerTimeout)
+	for {
+		select {
+		case a := <-sess.answers:
+			// answers to commands that timed out are of no use anymore.
+			if a.uid == uid {
+				return a.line, nil
+			}
+		case <-timeout:
+			return "", errors.Errorf("%s wasn't answered in %s", cmd, coapAnswerTimeout)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Configuration is kept centrally on the server, as blobs for a single
+// station or for every station of a type, and pushed to stations when they
+// register and whenever their blob changes. A station's own blob wins over
+// its type's. Versions come from a single server-wide counter, so a station
+// can tell a newer blob from an older one even when it moves between them.
+
+// typeTarget prefixes the configuration targets that are station types.
+const typeTarget = "type="
+
+// stationConfig is a configuration blob and its version.
+type stationConfig struct {
+	version int
+	blob    string
+}
+
+func validateConfigTarget(target string) error {
+	name := strings.TrimPrefix(target, typeTarget)
+	if name == "" || name == "*" || strings.Contains(name, "=") {
+		return errors.Errorf("bad config target %s", target)
+	}
+	return nil
+}
+
+// effectiveConfig returns the configuration a station should have. Must be
+// called with stationsM held.
+func (s *Server) effectiveConfig(name string, station *Station) (stationConfig, bool) {
+	if c, ok := s.configs[name]; ok {
+		return c, true
+	}
+	c, ok := s.configs[typeTarget+station.tipe]
+	return c, ok
+}
+
+// pushConfig sends a station its configuration, if it has any. Must be
+// called with stationsM held.
+func (s *Server) pushConfig(name string, station *Station) {
+	if station.virtual {
+		return
+	}
+	if c, ok := s.effectiveConfig(name, station); ok {
+		fmt.Fprintf(station.c, "config CONFIG %d %s\n", c.version, c.blob)
+	}
+}
+
+// targets reports whether a configuration target covers a station.
+func targets(target, name string, station *Station) bool {
+	return target == name || target == typeTarget+station.tipe
+}
+
+// setConfig stores a blob for a target at the given version, or the next one
+// if it's zero, and pushes it to the connected stations it applies to. Must
+// be called with stationsM held.
+func (s *Server) setConfig(target, blob string, version int) int {
+	if version == 0 {
+		version = s.configVersion + 1
+	}
+	if version > s.configVersion {
+		s.configVersion = version
+	}
+
+	s.configs[target] = stationConfig{version: version, blob: blob}
+	for name, station := range s.stations {
+		if c, _ := s.effectiveConfig(name, station); targets(target, name, station) && c.version == version {
+			s.pushConfig(name, station)
+		}
+	}
+
+	return version
+}
+
+// deleteConfig drops a target's blob, and pushes whatever applies instead to
+// the connected stations it applied to. Must be called with stationsM held.
+func (s *Server) deleteConfig(target string) bool {
+	old, ok := s.configs[target]
+	if !ok {
+		return false
+	}
+
+	var affected []string
+	for name, station := range s.stations {
+		if c, _ := s.effectiveConfig(name, station); targets(target, name, station) && c.version == old.version {
+			affected = append(affected, name)
+		}
+	}
+
+	delete(s.configs, target)
+	for _, name := range affected {
+		s.pushConfig(name, s.stations[name])
+	}
+
+	return true
+}
+
+// configTargets returns every target with a blob, sorted. Must be called with
+// stationsM held.
+func (s *Server) configTargets() []string {
+	targets := make([]string, 0, len(s.configs))
+	for target := range s.configs {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// CONFIG cmd
+// Expected args:
+//  - SET [target] [blob] (admin only)
+//  - GET [target] (admin only; stations may leave out the target to get
+//    their own configuration)
+//  - DEL [target] (admin only)
+//
+// Targets are a station name, or type=[type] for every station of a type.
+func (s *Server) handleConfig(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 1 {
+		return "", argCount(args)
+	}
+
+	if args[0] == "GET" && len(args) == 1 && conn.name != "" {
+		s.stationsM.RLock()
+		defer s.stationsM.RUnlock()
+
+		station, ok := s.stations[conn.name]
+		if !ok {
+			return "", errors.Errorf("station %s is somehow unknown to us", conn.name)
+		}
+		c, ok := s.effectiveConfig(conn.name, station)
+		if !ok {
+			return "", errors.Errorf("no config for %s", conn.name)
+		}
+		return fmt.Sprintf("CONFIG %s %d %s", conn.name, c.version, c.blob), nil
+	}
+
+	if len(args) < 2 || (args[0] != "SET" && len(args) != 2) {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	target := args[1]
+	if err := validateConfigTarget(target); err != nil {
+		return "", err
+	}
+
+	// events about a type's configuration aren't about any one station.
+	station := target
+	if strings.HasPrefix(target, typeTarget) {
+		station = ""
+	}
+
+	switch args[0] {
+	case "SET":
+		if len(args) < 3 {
+			return "", argCount(args)
+		}
+
+		s.stationsM.Lock()
+		version := s.setConfig(target, strings.Join(args[2:], " "), 0)
+		s.stationsM.Unlock()
+
+		s.event("config.set", station, "%s v%d", target, version)
+		return fmt.Sprintf("CONFIG %s %d", target, version), nil
+
+	case "GET":
+		s.stationsM.RLock()
+		defer s.stationsM.RUnlock()
+
+		c, ok := s.configs[target]
+		if !ok {
+			return "", errors.Errorf("no config for %s", target)
+		}
+		return fmt.Sprintf("CONFIG %s %d %s", target, c.version, c.blob), nil
+
+	case "DEL":
+		s.stationsM.Lock()
+		deleted := s.deleteConfig(target)
+		s.stationsM.Unlock()
+
+		if !deleted {
+			return "", errors.Errorf("no config for %s", target)
+		}
+
+		s.event("config.del", station, "%s", target)
+		return "ACK", nil
+	}
+
+	return "", errors.Errorf("unknown CONFIG command %s", args[0])
+}
+
+// parseVersion reads the configuration version a CONFIGURED reports.
+func parseVersion(arg string) (int, error) {
+	version, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, badArg(arg, errors.Wrapf(err, "bad version %s", arg))
+	}
+	return version, nil
+}
+
+// CONFIGURED cmd
+// Expected args:
+//  - [version] of the configuration the station has applied
+func (s *Server) handleConfigured(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 1 {
+		return "", argCount(args)
+	}
+
+	// client must have run REGISTER first
+	if conn.name == "" {
+		return "", errors.Errorf("client is not a station and has no config")
+	}
+
+	version, err := parseVersion(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	station, ok := s.stations[conn.name]
+	if !ok {
+		return "", errors.Errorf("station %s is somehow unknown to us", conn.name)
+	}
+
+	station.m.Lock()
+	station.configured = version
+	station.m.Unlock()
+
+	s.event("config.applied", conn.name, "v%d", version)
+	return "ACK", nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestConfig(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock(), TrustPlaintext())
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	admin, water, fire := dial(), dial(), dial()
+	defer admin.Close()
+	defer water.Close()
+	defer fire.Close()
+
+	for _, in := range []interaction{
+		{"1 CONFIG SET type=source interval=60 units=metric", "1 CONFIG type=source 1"},
+		{"2 CONFIG GET type=source", "2 CONFIG type=source 1 interval=60 units=metric"},
+		{"3 CONFIG GET water", "3 ERR"},
+		{"4 CONFIG SET bad=name x", "4 ERR"},
+		{"5 CONFIG PUT water x", "5 ERR"},
+	} {
+		if err := sendExpect(admin, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// stations get their type's configuration once they've registered.
+	waterLines, fireLines := bufio.NewReader(water), bufio.NewReader(fire)
+	fmt.Fprintf(water, "1 REGISTER water source\n")
+	if err := expectLines(waterLines, "1 ACK", "config CONFIG 1 interval=60 units=metric"); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(fire, "1 REGISTER fire source\n")
+	if err := expectLines(fireLines, "1 ACK", "config CONFIG 1 interval=60 units=metric"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a station's own configuration wins over its type's, and is pushed as
+	// soon as it's set.
+	if err := sendExpect(admin, "6 CONFIG SET water interval=5", "6 CONFIG water 2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectLines(waterLines, "config CONFIG 2 interval=5"); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(water, "2 CONFIGURED 2\n")
+	if err := expectLines(waterLines, "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(water, "3 CONFIG GET\n")
+	if err := expectLines(waterLines, "3 CONFIG water 2 interval=5"); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(water, "4 INFO water\n")
+	if err := expectLines(waterLines, "4 INFO water type=source health=100 config=2/2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// changing the type only reaches the stations without their own.
+	if err := sendExpect(admin, "7 CONFIG SET type=source interval=30", "7 CONFIG type=source 3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectLines(fireLines, "config CONFIG 3 interval=30"); err != nil {
+		t.Fatal(err)
+	}
+
+	// dropping a station's own configuration falls back to the type's.
+	if err := sendExpect(admin, "8 CONFIG DEL water", "8 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectLines(waterLines, "config CONFIG 3 interval=30"); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(water, "5 INFO water\n")
+	if err := expectLines(waterLines, "5 INFO water type=source health=100 config=2/3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(admin, "9 CONFIG DEL water", "9 ERR"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Every connection costs the server a goroutine and its buffers, so a flood
+// of them, from a misbehaving client or a scanner, can run it out of memory.
+// With a connection limit, connections past it are told the server is busy
+// and closed right away, so clients know to come back later rather than
+// taking it for a network problem.
+
+// busyTimeout is how long a connection turned away has to hear BUSY.
+const busyTimeout = 5 * time.Second
+
+// defaultHandshakeTimeout is how long a connection has to finish its TLS
+// handshake. Connections hold their place against the limit while they
+// handshake, so ones that never do mustn't get to hold it forever.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// admit counts a new connection against the limit, and reports whether it
+// can be handled. It's called under connsM.
+func (s *Server) admit() bool {
+	if s.maxConns > 0 && s.handling >= s.maxConns {
+		return false
+	}
+	s.handling++
+	return true
+}
+
+// release gives a connection's place back once it's been handled.
+func (s *Server) release() {
+	s.connsM.Lock()
+	defer s.connsM.Unlock()
+
+	s.handling--
+}
+
+// refuse tells a connection past the limit that the server is busy, and
+// closes it.
+func (s *Server) refuse(conn net.Conn) {
+	s.connsM.Lock()
+	s.refused++
+	// saying BUSY takes a TLS handshake, which a flood shouldn't get to tie
+	// up the server with either.
+	if s.refusing >= s.maxConns {
+		s.connsM.Unlock()
+		conn.Close()
+		return
+	}
+	s.refusing++
+	s.connsM.Unlock()
+
+	s.log.Errorf("turning away %s: already handling %d connections", conn.RemoteAddr(), s.maxConns)
+
+	go func() {
+		defer func() {
+			s.connsM.Lock()
+			s.refusing--
+			s.connsM.Unlock()
+		}()
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(busyTimeout))
+		fmt.Fprintf(conn, "busy BUSY\n")
+	}()
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestMaxConns(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock(), WithMaxConns(1))
+	go server.Serve(context.Background())
+	addr := listener.Addr().String()
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(first, "1 PING", "1 PONG"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second connection is turned away.
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(second)
+	if err := expectLines(reader, "busy BUSY"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+
+	// once the first one is gone, there's room again.
+	first.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		third, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		third.SetReadDeadline(time.Now().Add(time.Second))
+		err = sendExpect(third, "2 PING", "2 PONG")
+		third.Close()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a connection to be handled again: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.connsM.Lock()
+	refused := server.refused
+	server.connsM.Unlock()
+	if refused < 1 {
+		t.Fatal("expected the refused connection to be counted")
+	}
+}
+
+func TestMaxConnsHandshakeTimeout(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := pki.serve(t, WithMaxConns(2), WithHandshakeTimeout(200*time.Millisecond))
+
+	// connections that never start their handshake take every place...
+	for i := 0; i < 2; i++ {
+		silent, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer silent.Close()
+	}
+
+	// ...but only until they time out.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			Certificates: []tls.Certificate{pki.issue(t, "water")},
+			RootCAs:      pki.pool,
+			ServerName:   "localhost",
+		})
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			err = sendExpect(conn, "1 PING", "1 PONG")
+			conn.Close()
+		}
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a station to get in once the silent connections timed out: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Field deployments often have nowhere to send logs to. With crash reports
+// on, a panic while handling a connection leaves a report behind before the
+// server goes down: what panicked, the recent commands of every connection,
+// how many stations there were, and the stacks of every goroutine.
+
+// recentCommands is how many commands are kept per connection for crash
+// reports.
+const recentCommands = 16
+
+// commandRing keeps a connection's most recent commands, redacted.
+type commandRing struct {
+	m     sync.Mutex
+	lines []string
+	next  int
+}
+
+func (r *commandRing) add(line string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(r.lines) < recentCommands {
+		r.lines = append(r.lines, line)
+		return
+	}
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % recentCommands
+}
+
+// list returns the commands, oldest first.
+func (r *commandRing) list() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return append(append([]string(nil), r.lines[r.next:]...), r.lines[:r.next]...)
+}
+
+// reportCrash writes a crash report if the connection's handler panics, and
+// then lets the panic carry on. It must be deferred directly.
+func (s *Server) reportCrash(conn *clientConn) {
+	if s.crashDir == "" {
+		return
+	}
+
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	path, err := s.writeCrashReport(r, conn)
+	if err != nil {
+		s.log.Errorf("couldn't write crash report: %v", err)
+	} else {
+		s.log.Errorf("crash report written to %s", path)
+	}
+	s.log.flush()
+
+	panic(r)
+}
+
+// writeCrashReport writes a report on a panic in conn's handler to the crash
+// directory, and returns where.
+func (s *Server) writeCrashReport(r interface{}, conn *clientConn) (string, error) {
+	now := s.Clock.Now()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "drops crash report\n")
+	fmt.Fprintf(&buf, "time: %s\n", now.UTC().Format("2006-01-02T15:04:05Z"))
+	fmt.Fprintf(&buf, "panic: %v\n", r)
+
+	// the panic may have left locks held, so the report makes do without
+	// what's behind them.
+	fmt.Fprintf(&buf, "\nstations: ")
+	if s.stationsM.TryRLock() {
+		types := map[string]int{}
+		for _, station := range s.stations {
+			types[station.tipe]++
+		}
+		fmt.Fprintf(&buf, "%d online, %d offline\n", len(s.stations), len(s.lastSeen))
+
+		names := make([]string, 0, len(types))
+		for tipe := range types {
+			names = append(names, tipe)
+		}
+		sort.Strings(names)
+		for _, tipe := range names {
+			fmt.Fprintf(&buf, "  %s: %d\n", tipe, types[tipe])
+		}
+		s.stationsM.RUnlock()
+	} else {
+		fmt.Fprintf(&buf, "unknown, locked\n")
+	}
+
+	conns := []*clientConn{conn}
+	if s.connsM.TryLock() {
+		for c := range s.conns {
+			if c != conn {
+				conns = append(conns, c)
+			}
+		}
+		s.connsM.Unlock()
+	}
+	fmt.Fprintf(&buf, "\nrecent commands, on %d connections:\n", len(conns))
+	for i, c := range conns {
+		fmt.Fprintf(&buf, "%s", describe(c))
+		if i == 0 {
+			fmt.Fprintf(&buf, " (panicked)")
+		}
+		fmt.Fprintf(&buf, ":\n")
+		for _, line := range c.recent.list() {
+			fmt.Fprintf(&buf, "  %s\n", line)
+		}
+	}
+
+	stacks := make([]byte, 1<<20)
+	stacks = stacks[:runtime.Stack(stacks, true)]
+	fmt.Fprintf(&buf, "\ngoroutines:\n%s", stacks)
+
+	path := filepath.Join(s.crashDir, fmt.Sprintf("crash-%s.txt", now.UTC().Format("20060102T150405Z")))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", errors.Wrap(err, "creating crash report")
+	}
+	defer f.Close()
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return "", errors.Wrap(err, "writing crash report")
+	}
+	if err := f.Sync(); err != nil {
+		return "", errors.Wrap(err, "syncing crash report")
+	}
+	return path, f.Close()
+}
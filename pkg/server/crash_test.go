@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestCrashReport(t *testing.T) {
+	dir := t.TempDir()
+	server := New(nil, 4, clock.NewMock(), WithCrashReports(dir))
+
+	conn := &clientConn{name: "water"}
+	for i := 0; i < recentCommands+2; i++ {
+		conn.recent.add(fmt.Sprintf("%d METRIC level 1", i))
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("expected the panic to carry on, got %v", r)
+			}
+		}()
+		defer server.reportCrash(conn)
+		panic("boom")
+	}()
+
+	reports, err := filepath.Glob(filepath.Join(dir, "crash-*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("expected a crash report, got %v", reports)
+	}
+	report, err := os.ReadFile(reports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, part := range []string{
+		"panic: boom\n",
+		"stations: 0 online, 0 offline\n",
+		"station water (panicked):\n  2 METRIC level 1\n",
+		"  17 METRIC level 1\n",
+		"goroutine ",
+		"TestCrashReport",
+	} {
+		if !strings.Contains(string(report), part) {
+			t.Errorf("expected %q in:\n%s", part, report)
+		}
+	}
+	// only the most recent commands are kept.
+	if strings.Contains(string(report), "  1 METRIC level 1\n") {
+		t.Errorf("expected old commands to be dropped:\n%s", report)
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Stations going quiet one at a time is the reaper's business, but the
+// whole fleet going quiet at once usually means something's wrong with the
+// hub: its network, its disk, or the server itself. The dead man's switch
+// raises an alert when no metric point at all has come in for a while, and,
+// since alerts can't be trusted to get out of a server in that state, pings
+// an outside monitor like healthchecks.io while points are coming in and
+// tells it when they've stopped. A monitor that stops hearing from the
+// server altogether should alert on its own.
+
+// DeadMan is how long ingest can stop for, and who else should know.
+type DeadMan struct {
+	// Silence is how long the server can go without any new metric point.
+	Silence time.Duration
+	// Every is how often ingest is checked.
+	Every time.Duration
+	// URL is pinged on every check while points are coming in, and
+	// URL/fail once they've stopped, if set.
+	URL string
+}
+
+// ParseDeadMan reads the switch from comma separated key=value pairs, e.g.
+// silence=10m,url=https://hc-ping.com/[uuid]. every (default 1m) and url
+// are optional.
+func ParseDeadMan(spec string) (DeadMan, error) {
+	d := DeadMan{Every: time.Minute}
+
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return d, errors.Errorf("bad dead man's switch option %q", pair)
+		}
+
+		var err error
+		switch k, v := kv[0], kv[1]; k {
+		case "silence":
+			d.Silence, err = time.ParseDuration(v)
+		case "every":
+			d.Every, err = time.ParseDuration(v)
+		case "url":
+			d.URL = strings.TrimSuffix(v, "/")
+		default:
+			return d, errors.Errorf("unknown dead man's switch option %q", k)
+		}
+		if err != nil {
+			return d, errors.Wrapf(err, "bad dead man's switch option %q", pair)
+		}
+	}
+
+	switch {
+	case d.Silence <= 0:
+		return d, errors.Errorf("dead man's switch %q needs a silence", spec)
+	case d.Every <= 0:
+		return d, errors.Errorf("dead man's switch %q needs to check every so often", spec)
+	}
+
+	return d, nil
+}
+
+// deadMan tracks when the last point came in.
+type deadMan struct {
+	DeadMan
+	client *http.Client
+	log    *logTo
+
+	m      sync.Mutex
+	last   time.Time
+	silent bool
+
+	// pings the monitor; replaced in tests.
+	ping func(url string)
+}
+
+func newDeadMan(d DeadMan, now time.Time, log *logTo) *deadMan {
+	dm := &deadMan{DeadMan: d, client: &http.Client{Timeout: 10 * time.Second}, log: log, last: now}
+	dm.ping = dm.get
+	return dm
+}
+
+// ingested records that a point came in.
+func (d *deadMan) ingested(now time.Time) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if now.After(d.last) {
+		d.last = now
+	}
+}
+
+// check reports how long it's been since the last point, whether that's
+// too long, and whether that's news.
+func (d *deadMan) check(now time.Time) (time.Duration, bool, bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	quiet := now.Sub(d.last)
+	silent := quiet >= d.Silence
+	changed := silent != d.silent
+	d.silent = silent
+	return quiet, silent, changed
+}
+
+func (d *deadMan) get(url string) {
+	resp, err := d.client.Get(url)
+	if err != nil {
+		d.log.Errorf("couldn't ping %s: %v", url, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		d.log.Errorf("couldn't ping %s: monitor answered %s", url, resp.Status)
+	}
+}
+
+// scheduleDeadMan checks ingest every interval.
+func (s *Server) scheduleDeadMan(every time.Duration) {
+	s.Clock.AfterFunc(every, func() {
+		s.checkDeadMan()
+		s.scheduleDeadMan(every)
+	})
+}
+
+// checkDeadMan raises an alert when ingest has stopped, and closes it once
+// points come in again, pinging the monitor either way.
+func (s *Server) checkDeadMan() {
+	quiet, silent, changed := s.deadman.check(s.Clock.Now())
+
+	if s.deadman.URL != "" {
+		url := s.deadman.URL
+		if silent {
+			url += "/fail"
+		}
+		// the monitor may be slow or unreachable, which mustn't hold up
+		// the clock.
+		go s.deadman.ping(url)
+	}
+
+	switch {
+	case !changed:
+	case silent:
+		s.raise("deadman", "deadman.silent", "", "no metric points for %s", quiet.Truncate(time.Second))
+	default:
+		s.resolve("deadman", "deadman.ok", "", "metric points are coming in again")
+	}
+}
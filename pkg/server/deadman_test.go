@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestParseDeadMan(t *testing.T) {
+	d, err := ParseDeadMan("silence=10m,url=https://hc-ping.com/abc/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Silence != 10*time.Minute || d.Every != time.Minute || d.URL != "https://hc-ping.com/abc" {
+		t.Fatalf("unexpected switch %+v", d)
+	}
+
+	for _, spec := range []string{"", "every=1m", "silence=10m,every=0s", "silence=soon", "silence=10m,loud=1"} {
+		if _, err := ParseDeadMan(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestDeadMan(t *testing.T) {
+	notifications := make(chan Notification, 10)
+	mock := clock.NewMock()
+	server := New(nil, 4, mock,
+		WithDeadMan(DeadMan{Silence: 5 * time.Minute, Every: time.Minute, URL: "https://monitor"}),
+		WithNotifier(NotifierFunc(func(n Notification) { notifications <- n })),
+	)
+	pings := make(chan string, 10)
+	server.deadman.ping = func(url string) { pings <- url }
+
+	expectPings := func(url string, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			select {
+			case got := <-pings:
+				if got != url {
+					t.Fatalf("expected a ping to %s, got %s", url, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expected a ping to %s", url)
+			}
+		}
+	}
+	expect := func(kind, message string) {
+		t.Helper()
+		select {
+		case n := <-notifications:
+			if n.Kind != kind || n.Message != message {
+				t.Fatalf("expected %s: %s, got %s: %s", kind, message, n.Kind, n.Message)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s: %s", kind, message)
+		}
+	}
+
+	conn := &clientConn{}
+	if _, err := server.handleRegister(context.Background(), conn, "1", "water", "source"); err != nil {
+		t.Fatal(err)
+	}
+
+	// quiet, but not for long enough yet.
+	mock.Add(4 * time.Minute)
+	expectPings("https://monitor", 4)
+	if len(notifications) > 0 {
+		t.Fatalf("unexpected notification: %+v", <-notifications)
+	}
+
+	mock.Add(time.Minute)
+	expectPings("https://monitor/fail", 1)
+	expect("deadman.silent", "no metric points for 5m0s")
+
+	if _, err := server.handleMetric(context.Background(), conn, "2", "level", "1"); err != nil {
+		t.Fatal(err)
+	}
+	mock.Add(time.Minute)
+	expectPings("https://monitor", 1)
+	expect("deadman.ok", "metric points are coming in again")
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"time"
+)
+
+// Clients that time out waiting for an answer resend the command with the
+// same uid, which would otherwise apply it twice: a point stored twice, a
+// function run twice. With deduplication on, each connection remembers the
+// answers to its recent writes, and a command repeated word for word under
+// the same uid is answered from memory instead of being carried out again.
+// Only successful commands are remembered, so a retry after an ERR is tried
+// again for real.
+//
+// Only commands that change something (the ones the protocol spec marks as
+// writes) are worth not repeating. Queries are always answered afresh, as
+// clients may well poll with the same uid.
+
+// dedupEntries is how many answers each connection remembers.
+const dedupEntries = 256
+
+type dedupEntry struct {
+	line string
+	resp string
+	at   time.Time
+}
+
+// dedupCache remembers a connection's recent answers by uid. It's only used
+// by the connection's own goroutine.
+type dedupCache struct {
+	entries map[string]dedupEntry
+	// uids, oldest first, to forget the oldest when full.
+	order []string
+}
+
+// lookup returns the answer to line, if it was answered within window.
+func (d *dedupCache) lookup(uid, line string, now time.Time, window time.Duration) (string, bool) {
+	e, ok := d.entries[uid]
+	if !ok || e.line != line || now.Sub(e.at) >= window {
+		return "", false
+	}
+	return e.resp, true
+}
+
+// remember keeps the answer to a command.
+func (d *dedupCache) remember(uid, line, resp string, now time.Time) {
+	if d.entries == nil {
+		d.entries = map[string]dedupEntry{}
+	}
+
+	if _, ok := d.entries[uid]; !ok {
+		d.order = append(d.order, uid)
+	}
+	d.entries[uid] = dedupEntry{line: line, resp: resp, at: now}
+
+	if len(d.order) > dedupEntries {
+		delete(d.entries, d.order[0])
+		d.order = d.order[1:]
+	}
+}
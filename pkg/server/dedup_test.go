@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestDedup(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 10, mock, WithDedup(30*time.Second))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 METRIC level 1", "2 ACK"},
+		// a retry isn't stored again.
+		{"2 METRIC level 1", "2 ACK"},
+		// the same uid with another command is carried out.
+		{"2 METRIC level 2", "2 ACK"},
+		{"3 METRIC level bad", "3 ERR"},
+		{"3 METRIC level 3", "3 ACK"},
+		// retrying a registration doesn't fail because it worked.
+		{"1 REGISTER water source", "1 ACK"},
+	} {
+		// points carried out again would get a new timestamp.
+		mock.Add(time.Second)
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the answers are only remembered for a while.
+	mock.Add(time.Minute)
+	if err := sendExpect(station, "3 METRIC level 3", "3 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	series, _ := server.snapshot("water")
+	if got := len(series["level"]); got != 4 {
+		t.Fatalf("expected 4 points, got %d: %v", got, series["level"])
+	}
+}
+
+func TestDedupCacheForgetsOldest(t *testing.T) {
+	var d dedupCache
+	now := time.Unix(0, 0)
+	for i := 0; i <= dedupEntries; i++ {
+		d.remember(string(rune('a'+i%26))+string(rune('0'+i/26)), "line", "ACK", now)
+	}
+	if len(d.entries) != dedupEntries {
+		t.Fatalf("expected %d entries, got %d", dedupEntries, len(d.entries))
+	}
+	if _, ok := d.lookup("a0", "line", now, time.Minute); ok {
+		t.Fatalf("expected the oldest entry to be forgotten")
+	}
+	if _, ok := d.lookup("b0", "line", now, time.Minute); !ok {
+		t.Fatalf("expected the second oldest entry to be remembered")
+	}
+}
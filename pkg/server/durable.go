@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Durable subscriptions are named, and outlive the connections that consume
+// them. The server queues each point for them with an offset, whether or not
+// a consumer is attached, and drops points once the consumer commits a
+// cursor past them. A consumer attaching under the same name gets everything
+// it hasn't committed, so exporter-style consumers neither lose points while
+// they're away nor see any twice, as long as they don't fall more than the
+// backlog behind.
+
+// defaultDurableBacklog is how many uncommitted points a durable subscription
+// keeps by default.
+const defaultDurableBacklog = 10000
+
+type queuedPoint struct {
+	offset int64
+	key    seriesKey
+	m      metric
+}
+
+type durableSub struct {
+	name string
+
+	// "" for every station.
+	station string
+	pattern string
+
+	filter pointFilter
+	last   map[seriesKey]sent
+
+	// uncommitted points, oldest first.
+	queue     []queuedPoint
+	next      int64
+	committed int64
+
+	// the attached consumer, if there is one.
+	conn *clientConn
+	uid  string
+}
+
+func (d *durableSub) write(p queuedPoint) {
+	fmt.Fprintf(d.conn, "%s METRIC %s %s %d:%.2f %d\n", d.uid, p.key.station, p.key.metric, p.m.ts.Unix(), p.m.value, p.offset)
+}
+
+// enqueue queues a point for the subscription, and sends it to the consumer
+// if one is attached. Must be called with the subscribers' lock held.
+func (d *durableSub) enqueue(key seriesKey, m metric, now time.Time, backlog int) {
+	last, ok := d.last[key]
+	if !d.filter.admit(last, ok, m, now) {
+		return
+	}
+	d.last[key] = sent{at: now, m: m}
+
+	p := queuedPoint{offset: d.next, key: key, m: m}
+	d.next++
+
+	d.queue = append(d.queue, p)
+	if len(d.queue) > backlog {
+		// the consumer is too far behind, and misses the oldest points.
+		d.queue = append([]queuedPoint(nil), d.queue[len(d.queue)-backlog:]...)
+	}
+
+	if d.conn != nil {
+		d.write(p)
+	}
+}
+
+// commit drops the points up to and including offset.
+func (d *durableSub) commit(offset int64) error {
+	if offset >= d.next {
+		return errors.Errorf("offset %d hasn't been sent yet", offset)
+	}
+	if offset <= d.committed {
+		return nil
+	}
+
+	d.committed = offset
+	i := 0
+	for i < len(d.queue) && d.queue[i].offset <= offset {
+		i++
+	}
+	d.queue = d.queue[i:]
+	return nil
+}
+
+// subscribeDurable attaches conn to a durable subscription under uid,
+// creating the subscription if it doesn't exist yet.
+func (s *Server) subscribeDurable(conn *clientConn, uid, name, station, pattern string, filter pointFilter) (string, error) {
+	ms := s.subscribers
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	d, ok := ms.durables[name]
+	if !ok {
+		d = &durableSub{
+			name:    name,
+			station: station,
+			pattern: pattern,
+			filter:  filter,
+			last:    map[seriesKey]sent{},
+			next:    1,
+		}
+		ms.durables[name] = d
+	}
+
+	if d.station != station || d.pattern != pattern {
+		return "", errors.Errorf("durable subscription %s is for other metrics", name)
+	}
+	if d.conn != nil {
+		return "", errors.Errorf("durable subscription %s already has a consumer", name)
+	}
+
+	// until the ACK is out, points are only queued.
+	conn.after(func() {
+		ms.m.Lock()
+		defer ms.m.Unlock()
+
+		if ms.durables[name] != d || d.conn != nil {
+			return
+		}
+
+		d.conn, d.uid = conn, uid
+		for _, p := range d.queue {
+			d.write(p)
+		}
+	})
+
+	conn.stream(uid, func() {
+		ms.m.Lock()
+		defer ms.m.Unlock()
+
+		if d.conn == conn && d.uid == uid {
+			d.conn = nil
+		}
+	})
+
+	return "ACK", nil
+}
+
+// CURSOR cmd
+// Expected args:
+//  - [name] of a durable subscription
+//  - [offset] to commit, or DROP to delete the subscription (optional)
+func (s *Server) handleCursor(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", argCount(args)
+	}
+
+	ms := s.subscribers
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	name := args[0]
+	d, ok := ms.durables[name]
+	if !ok {
+		return "", errors.Errorf("no durable subscription %s", name)
+	}
+
+	if len(args) == 1 {
+		return fmt.Sprintf("CURSOR %s %d %d", name, d.committed, len(d.queue)), nil
+	}
+
+	if args[1] == "DROP" {
+		delete(ms.durables, name)
+		if d.conn != nil {
+			fmt.Fprintf(d.conn, "%s ERR DROPPED\n", d.uid)
+		}
+		return "ACK", nil
+	}
+
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return "", errors.Wrapf(err, "bad offset %s", args[1])
+	}
+	if err := d.commit(offset); err != nil {
+		return "", err
+	}
+
+	return "ACK", nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestDurableSubscription(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock(), WithDurableBacklog(3))
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	station, consumer := dial(), dial()
+	defer station.Close()
+
+	report := func(uid, value string) {
+		if err := sendExpect(station, uid+" METRIC level "+value, uid+" ACK"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bufio.NewReader(consumer)
+	fmt.Fprintf(consumer, "s SUBSCRIBE water level durable=export\n")
+	if err := expectLines(lines, "s ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	report("2", "1")
+	report("3", "2")
+	if err := expectLines(lines, "s METRIC water level 0:1.00 1", "s METRIC water level 0:2.00 2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the first point is committed before the consumer goes away...
+	fmt.Fprintf(consumer, "c CURSOR export 1\n")
+	if err := expectLines(lines, "c ACK"); err != nil {
+		t.Fatal(err)
+	}
+	consumer.Close()
+
+	report("4", "3")
+
+	// ...so it picks up from the second when it comes back, once the server
+	// has noticed the first connection is gone.
+	consumer = dial()
+	defer consumer.Close()
+
+	lines = bufio.NewReader(consumer)
+	for {
+		fmt.Fprintf(consumer, "s SUBSCRIBE water level durable=export\n")
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "s ACK\n" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := expectLines(lines,
+		"s METRIC water level 0:2.00 2",
+		"s METRIC water level 0:3.00 3",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []interaction{
+		{"c CURSOR export 3", "c ACK"},
+		{"c CURSOR export", "c CURSOR export 3 0"},
+		{"c CURSOR export 9", "c ERR"},
+		{"c CURSOR nothing 1", "c ERR"},
+		{"d SUBSCRIBE water level durable=export", "d ERR"},
+		{"d SUBSCRIBE water temp durable=other since=1h", "d ERR"},
+	} {
+		fmt.Fprintf(consumer, "%s\n", in.send)
+		if err := expectLines(lines, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// consumers that fall too far behind miss the oldest points.
+	fmt.Fprintf(consumer, "s CANCEL\n")
+	if err := expectLines(lines, "s ACK"); err != nil {
+		t.Fatal(err)
+	}
+	for i, value := range []string{"4", "5", "6", "7"} {
+		report(fmt.Sprint(i+5), value)
+	}
+
+	fmt.Fprintf(consumer, "s SUBSCRIBE water level durable=export\n")
+	if err := expectLines(lines,
+		"s ACK",
+		"s METRIC water level 0:5.00 5",
+		"s METRIC water level 0:6.00 6",
+		"s METRIC water level 0:7.00 7",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(consumer, "c CURSOR export DROP\n")
+	if err := expectLines(lines, "s ERR DROPPED", "c ACK"); err != nil {
+		t.Fatal(err)
+	}
+}
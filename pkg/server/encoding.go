@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Connections can ask for the points in METRICS responses and the events in
+// EVENTS ones to be sent as JSON Lines instead of the usual tokens, so that
+// programs reading them don't have to guess at rounding or parse ts:value
+// pairs, and new fields can be added without breaking them. Each point or
+// event is then sent as its own JSON object on its own line, before the
+// final response, which counts them.
+
+// encoding is how a connection wants points and events sent.
+type encoding int
+
+const (
+	// textEncoding sends them as tokens, like 1500000000:1.50.
+	textEncoding encoding = iota
+	// jsonlEncoding sends them as JSON objects, one per line.
+	jsonlEncoding
+)
+
+func (e encoding) String() string {
+	if e == jsonlEncoding {
+		return "jsonl"
+	}
+	return "text"
+}
+
+func parseEncoding(v string) (encoding, error) {
+	switch v {
+	case "text":
+		return textEncoding, nil
+	case "jsonl":
+		return jsonlEncoding, nil
+	}
+	return 0, errors.Errorf("unknown encoding %q", v)
+}
+
+// pointJSON is a point as sent to jsonl connections.
+type pointJSON struct {
+	UID     string  `json:"uid"`
+	Station string  `json:"station"`
+	Metric  string  `json:"metric"`
+	TS      int64   `json:"ts"`
+	Value   float64 `json:"value"`
+	Unit    string  `json:"unit,omitempty"`
+}
+
+// eventJSON is an event as sent to jsonl connections.
+type eventJSON struct {
+	UID     string `json:"uid"`
+	Seq     int    `json:"seq"`
+	TS      int64  `json:"ts"`
+	Kind    string `json:"kind"`
+	Station string `json:"station"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// writeJSONLine writes v as a line of JSON, in a single write so it doesn't
+// get interleaved with what other goroutines send the connection.
+func writeJSONLine(w io.Writer, v interface{}) {
+	// like any other write to a connection, one that fails shows up as the
+	// connection closing.
+	json.NewEncoder(w).Encode(v)
+}
+
+// writePointsJSON sends each of a station's points for a metric as a line of
+// JSON.
+func writePointsJSON(w io.Writer, uid, station, metric, unit string, ms []metric) {
+	for _, m := range ms {
+		writeJSONLine(w, pointJSON{
+			UID:     uid,
+			Station: station,
+			Metric:  metric,
+			TS:      m.ts.Unix(),
+			Value:   m.value,
+			Unit:    unit,
+		})
+	}
+}
+
+// ENCODING cmd
+// Expected args:
+//  - text or jsonl (optional, to only ask for the current one)
+func (s *Server) handleEncoding(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) > 1 {
+		return "", argCount(args)
+	}
+
+	if len(args) == 1 {
+		e, err := parseEncoding(args[0])
+		if err != nil {
+			return "", badArg(args[0], err)
+		}
+		conn.encoding = e
+	}
+
+	return fmt.Sprintf("ENCODING %s", conn.encoding), nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestEncodingJSONL(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock, WithStationTypes(StationType{
+		Name:    "source",
+		Metrics: map[string]string{"level": "m"},
+	}))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 METRIC level 1.5", "2 ACK"},
+		{"3 METRIC pump.rpm 1200", "3 ACK"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+
+	for _, in := range []struct {
+		send   string
+		expect []string
+	}{
+		{"1 ENCODING", []string{"1 ENCODING text"}},
+		{"2 METRICS water level", []string{"2 METRICS water level 0:1.50"}},
+		{"3 ENCODING xml", []string{"3 ERR"}},
+		{"4 ENCODING jsonl", []string{"4 ENCODING jsonl"}},
+		{"5 METRICS water level", []string{
+			`{"uid":"5","station":"water","metric":"level","ts":0,"value":1.5,"unit":"m"}`,
+			"5 METRICS water level 1",
+		}},
+		{"6 METRICS water level unit=cm", []string{
+			`{"uid":"6","station":"water","metric":"level","ts":0,"value":150,"unit":"cm"}`,
+			"6 METRICS water level 1",
+		}},
+		{"7 METRICS water pump.*", []string{
+			`{"uid":"7","station":"water","metric":"pump.rpm","ts":0,"value":1200}`,
+			"7 METRICS water pump.* 1",
+		}},
+		{"8 METRICS * level LAST", []string{
+			`{"uid":"8","station":"water","metric":"level","ts":0,"value":1.5,"unit":"m"}`,
+			"8 METRICS * level LAST 1",
+		}},
+		{"9 EVENTS water", []string{
+			`{"uid":"9","seq":1,"ts":0,"kind":"register","station":"water","detail":"source"}`,
+			"9 EVENTS 1",
+		}},
+	} {
+		fmt.Fprintf(client, "%s\n", in.send)
+		if err := expectLines(reader, in.expect...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
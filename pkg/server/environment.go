@@ -0,0 +1,22 @@
+package server
+
+import "context"
+
+// Servers can be labelled with the environment they're part of, like prod
+// or staging, so that the shell and client libraries can check where
+// they're connected before running functions on stations, rather than an
+// operator finding out the hard way.
+
+// HELLO cmd
+// Expected args: none
+func (s *Server) handleHello(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 0 {
+		return "", argCount(args)
+	}
+
+	env := s.environment
+	if env == "" {
+		env = "-"
+	}
+	return "HELLO " + env, nil
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// event is an entry in the server's journal of lifecycle events.
+type event struct {
+	seq     int
+	ts      time.Time
+	kind    string
+	station string
+	detail  string
+}
+
+func writeEvent(c *clientConn, enc encoding, uid string, e event) {
+	if enc == jsonlEncoding {
+		writeJSONLine(c, eventJSON{
+			UID:     uid,
+			Seq:     e.seq,
+			TS:      e.ts.Unix(),
+			Kind:    e.kind,
+			Station: e.station,
+			Detail:  e.detail,
+		})
+		return
+	}
+
+	fmt.Fprintf(c, "%s EVENT %d %d %s %s", uid, e.seq, e.ts.Unix(), e.kind, e.station)
+	if e.detail != "" {
+		fmt.Fprintf(c, " %s", e.detail)
+	}
+	fmt.Fprintf(c, "\n")
+}
+
+type eventSubscriber struct {
+	conn *clientConn
+	// the connection's encoding when it subscribed, as the connection may
+	// change it while events are being sent.
+	encoding encoding
+	uid      string
+	station  string
+}
+
+// journal keeps the most recent lifecycle events (registrations,
+// disconnects, run results, alerts), giving clients a single timeline.
+type journal struct {
+	m           sync.Mutex
+	events      []event
+	size        int
+	seq         int
+	subscribers map[*eventSubscriber]struct{}
+}
+
+func newJournal(size int) *journal {
+	return &journal{size: size, subscribers: map[*eventSubscriber]struct{}{}}
+}
+
+func (j *journal) record(e event) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	j.seq++
+	e.seq = j.seq
+
+	j.events = append(j.events, e)
+	if len(j.events) > j.size {
+		j.events = j.events[len(j.events)-j.size:]
+	}
+
+	for sub := range j.subscribers {
+		if sub.station == "" || sub.station == e.station {
+			writeEvent(sub.conn, sub.encoding, sub.uid, e)
+		}
+	}
+}
+
+// event journals something that happened to a station. Station-less events
+// use "-" as the station.
+func (s *Server) event(kind, station, format string, args ...interface{}) {
+	if station == "" {
+		station = "-"
+	}
+
+	e := event{
+		ts:      s.Clock.Now(),
+		kind:    kind,
+		station: station,
+		detail:  fmt.Sprintf(format, args...),
+	}
+	s.journal.record(e)
+
+	for _, en := range s.eventNotifiers {
+		if en.kinds[kind] {
+			en.n.Notify(Notification{Kind: kind, Station: station, Message: e.detail, Time: e.ts})
+		}
+	}
+}
+
+// EVENTS cmd
+// Expected args:
+//  - [station] (optional, * for every station)
+//  - [since] (optional, unix timestamp)
+//
+// Each matching event is sent as its own [uid] EVENT response (or line of
+// JSON, on jsonl connections) before the final EVENTS one.
+func (s *Server) handleEvents(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) > 2 {
+		return "", argCount(args)
+	}
+
+	station := ""
+	if len(args) > 0 && args[0] != "*" {
+		station = args[0]
+	}
+
+	var since time.Time
+	if len(args) == 2 {
+		ts, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return "", errors.Wrapf(err, "bad timestamp %s", args[1])
+		}
+		since = time.Unix(ts, 0)
+	}
+
+	s.journal.m.Lock()
+	defer s.journal.m.Unlock()
+
+	count := 0
+	for _, e := range s.journal.events {
+		if (station != "" && e.station != station) || e.ts.Before(since) {
+			continue
+		}
+
+		writeEvent(conn, conn.encoding, uid, e)
+		count++
+	}
+
+	return fmt.Sprintf("EVENTS %d", count), nil
+}
+
+// subscribeEvents streams new events (optionally for one station) to conn
+// under uid until it's cancelled.
+func (s *Server) subscribeEvents(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) > 1 {
+		return "", argCount(args)
+	}
+
+	sub := &eventSubscriber{conn: conn, encoding: conn.encoding, uid: uid}
+	if len(args) == 1 && args[0] != "*" {
+		sub.station = args[0]
+	}
+
+	s.journal.m.Lock()
+	s.journal.subscribers[sub] = struct{}{}
+	s.journal.m.Unlock()
+
+	conn.stream(uid, func() {
+		s.journal.m.Lock()
+		defer s.journal.m.Unlock()
+
+		delete(s.journal.subscribers, sub)
+	})
+
+	return "ACK", nil
+}
+
+// SUBSCRIBE cmd
+// Expected args, for events:
+//  - EVENTS
+//  - [station] (optional)
+//
+// For alerts:
+//  - ALERTS
+//  - [station] (optional)
+//
+// Or, for metric points:
+//  - [station], or * for every station
+//  - [metric] or pattern
+//  - every=[duration] and/or delta>[float] (optional)
+func (s *Server) handleSubscribe(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 1 {
+		return "", argCount(args)
+	}
+
+	if _, ok := conn.streams[uid]; ok {
+		return "", errors.Errorf("uid %s already in use", uid)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "EVENTS":
+		return s.subscribeEvents(ctx, conn, uid, args[1:]...)
+	case "ALERTS":
+		return s.subscribeAlerts(ctx, conn, uid, args[1:]...)
+	}
+
+	return s.subscribeMetrics(ctx, conn, uid, args...)
+}
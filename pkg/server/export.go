@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/parquet-go/parquet-go"
+	"github.com/pkg/errors"
+)
+
+// exportInterval is how often points are exported, and so how much each
+// exported file covers.
+const exportInterval = time.Hour
+
+// ExportSink is somewhere exported files are stored, such as a local
+// directory or an object store bucket.
+type ExportSink interface {
+	// Put stores data under name, a slash separated path like
+	// water/2020-06-01T13.parquet. Put may be retried with the same name if
+	// it fails.
+	Put(name string, data []byte) error
+}
+
+// DirSink stores exported files under a local directory.
+type DirSink string
+
+// Put writes data to a file under the directory, creating any parent
+// directories it needs. Files are written to the side and renamed into
+// place, so readers never see half of one.
+func (d DirSink) Put(name string, data []byte) error {
+	path := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "creating directory for %s", name)
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrapf(err, "writing %s", name)
+	}
+
+	return errors.Wrapf(os.Rename(tmp, path), "writing %s", name)
+}
+
+// Get reads the file stored under name.
+func (d DirSink) Get(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(string(d), filepath.FromSlash(name)))
+	return data, errors.Wrapf(err, "reading %s", name)
+}
+
+// PutFrom writes what's read from r to a file under the directory, like
+// Put, without holding it all in memory.
+func (d DirSink) PutFrom(name string, r io.Reader) error {
+	path := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "creating directory for %s", name)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "writing %s", name)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrapf(err, "writing %s", name)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "writing %s", name)
+	}
+
+	return errors.Wrapf(os.Rename(tmp, path), "writing %s", name)
+}
+
+// Open opens the file stored under name.
+func (d DirSink) Open(name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", name)
+	}
+	return f, nil
+}
+
+// List returns the names of the files and directories under dir.
+func (d DirSink) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(string(d), filepath.FromSlash(dir)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s", dir)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+// Remove removes the file or directory stored under name.
+func (d DirSink) Remove(name string) error {
+	return errors.Wrapf(os.RemoveAll(filepath.Join(string(d), filepath.FromSlash(name))), "removing %s", name)
+}
+
+// exportRow is the schema of exported files.
+type exportRow struct {
+	Timestamp int64             `parquet:"timestamp,timestamp(nanosecond)"`
+	Metric    string            `parquet:"metric,dict"`
+	Value     float64           `parquet:"value"`
+	Labels    map[string]string `parquet:"labels"`
+}
+
+type exportKey struct {
+	station string
+	hour    time.Time
+}
+
+// exporter collects every point stations report, and writes out a Parquet
+// file per station for each hour, so fleet history can be analyzed without
+// going through the server.
+type exporter struct {
+	sink  ExportSink
+	clock clock.Clock
+	log   *logTo
+
+	m sync.Mutex
+	// points by the station and hour they were received in.
+	pending map[exportKey][]exportRow
+}
+
+func newExporter(sink ExportSink, clock clock.Clock, log *logTo) *exporter {
+	e := &exporter{
+		sink:    sink,
+		clock:   clock,
+		log:     log,
+		pending: map[exportKey][]exportRow{},
+	}
+	e.schedule()
+
+	return e
+}
+
+// schedule arranges for an export at the top of the next hour.
+func (e *exporter) schedule() {
+	now := e.clock.Now()
+	next := now.Truncate(exportInterval).Add(exportInterval)
+
+	e.clock.AfterFunc(next.Sub(now), func() {
+		e.export(next)
+		e.schedule()
+	})
+}
+
+// add queues a point to be exported. Points are filed under the hour they
+// were received rather than their timestamp, so backfilled points still make
+// it into the next export.
+func (e *exporter) add(name string, station *Station, metricName string, m metric) {
+	labels := map[string]string{
+		"station": name,
+		"type":    station.tipe,
+	}
+	if station.location != nil {
+		labels["location"] = station.location.String()
+	}
+
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	key := exportKey{name, e.clock.Now().UTC().Truncate(exportInterval)}
+	e.pending[key] = append(e.pending[key], exportRow{
+		Timestamp: m.ts.UnixNano(),
+		Metric:    metricName,
+		Value:     m.value,
+		Labels:    labels,
+	})
+}
+
+// export writes out every hour that finished by before. Hours that fail to
+// export are kept and retried next time.
+func (e *exporter) export(before time.Time) {
+	e.m.Lock()
+	ready := map[exportKey][]exportRow{}
+	for key, rows := range e.pending {
+		if !key.hour.Before(before.Truncate(exportInterval)) {
+			continue
+		}
+		ready[key] = rows
+		delete(e.pending, key)
+	}
+	e.m.Unlock()
+
+	for key, rows := range ready {
+		err := e.write(key, rows)
+		if err == nil {
+			continue
+		}
+
+		e.log.Errorf("couldn't export %s: %v", exportName(key), err)
+
+		e.m.Lock()
+		e.pending[key] = append(rows, e.pending[key]...)
+		e.m.Unlock()
+	}
+}
+
+func (e *exporter) write(key exportKey, rows []exportRow) error {
+	return e.writeAs(exportName(key), rows)
+}
+
+func (e *exporter) writeAs(name string, rows []exportRow) error {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Timestamp < rows[j].Timestamp
+	})
+
+	var buf bytes.Buffer
+	if err := parquet.Write(&buf, rows); err != nil {
+		return errors.Wrap(err, "encoding parquet")
+	}
+
+	return e.sink.Put(name, buf.Bytes())
+}
+
+// exportName is where a station's points for an hour are stored, laid out
+// so that a glob like */*.parquet picks up the whole fleet.
+func exportName(key exportKey) string {
+	return fmt.Sprintf("%s/%s.parquet", key.station, key.hour.Format("2006-01-02T15"))
+}
+
+// partialExportName is where the points of an hour a shutdown cut short are
+// stored, so the rest of the hour, exported once the server is back, is
+// stored next to them rather than over them.
+func partialExportName(key exportKey, at time.Time) string {
+	return fmt.Sprintf("%s/%s.partial-%s.parquet", key.station, key.hour.Format("2006-01-02T15"), at.UTC().Format("150405"))
+}
+
+// flush writes out everything still pending, for when the server shuts
+// down: finished hours as export would, and the hour under way as a partial
+// one.
+func (e *exporter) flush() {
+	now := e.clock.Now()
+	e.export(now)
+
+	e.m.Lock()
+	pending := e.pending
+	e.pending = map[exportKey][]exportRow{}
+	e.m.Unlock()
+
+	for key, rows := range pending {
+		name := exportName(key)
+		if key.hour.Equal(now.UTC().Truncate(exportInterval)) {
+			name = partialExportName(key, now)
+		}
+		if err := e.writeAs(name, rows); err != nil {
+			e.log.Errorf("couldn't export %s, dropping %d points: %v", name, len(rows), err)
+		}
+	}
+}
+
+// forget drops a station's points of metric, or of every metric if metric is
+// empty, that haven't been exported yet.
+func (e *exporter) forget(station, metric string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	for key, rows := range e.pending {
+		if key.station != station {
+			continue
+		}
+		if metric == "" {
+			delete(e.pending, key)
+			continue
+		}
+
+		kept := rows[:0:0]
+		for _, row := range rows {
+			if row.Metric != metric {
+				kept = append(kept, row)
+			}
+		}
+		e.pending[key] = kept
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestHourlyExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	server := New(listener, 4, mock, WithExport(DirSink(dir)))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []interaction{
+		{"1 REGISTER water source location=45.5,-122.6", "1 ACK"},
+		{"2 METRIC level 2 5", "2 ACK"},
+		{"3 METRIC level 1", "3 ACK"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "water", "1970-01-01T00.parquet")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing exported before the hour is up, got %v", err)
+	}
+
+	mock.Add(time.Hour)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hour was never exported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rows, err := parquet.ReadFile[exportRow](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"station": "water", "type": "source", "location": "45.500000,-122.600000"}
+	want := []exportRow{
+		{Timestamp: 0, Metric: "level", Value: 1, Labels: labels},
+		{Timestamp: int64(5 * time.Second), Metric: "level", Value: 2, Labels: labels},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("expected %+v, got %+v", want, rows)
+	}
+}
+
+func TestExportFlushedOnShutdown(t *testing.T) {
+	dir := t.TempDir()
+	mock := clock.NewMock()
+	mock.Add(90 * time.Minute)
+	server := New(nil, 4, mock, WithExport(DirSink(dir)))
+
+	conn := &clientConn{}
+	if _, err := server.handleRegister(context.Background(), conn, "1", "water", "source"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.handleMetric(context.Background(), conn, "2", "level", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hour under way is written out, under a name the rest of it won't
+	// be written over with.
+	rows, err := parquet.ReadFile[exportRow](filepath.Join(dir, "water", "1970-01-01T01.partial-013000.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Value != 1 {
+		t.Fatalf("unexpected rows %+v", rows)
+	}
+}
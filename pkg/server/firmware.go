@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Stations can say which firmware they run when they REGISTER, and admins
+// keep a table of the latest firmware for each station type. Stations
+// running older firmware than their type's latest are flagged as outdated,
+// which is what over-the-air rollouts work through.
+
+// unknownFirmware stands in for the firmware of stations that didn't say.
+const unknownFirmware = "?"
+
+func validateFirmware(version string) error {
+	if version == "" || version == unknownFirmware || strings.ContainsAny(version, ":=") {
+		return errors.Errorf("bad firmware version %s", version)
+	}
+	return nil
+}
+
+// compareVersions compares dotted versions like 1.10.2 part by part, and
+// returns -1, 0 or 1. Parts are compared as numbers when they both are, so
+// 1.10 is newer than 1.9, and as strings otherwise.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr == nil && bErr == nil && an != bn:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case (aErr != nil || bErr != nil) && as[i] != bs[i]:
+			return strings.Compare(as[i], bs[i])
+		}
+	}
+
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+// outdated returns the latest firmware for a station's type, if the station
+// runs older firmware than it. Stations that don't say what they run aren't
+// outdated, as there's no telling. Must be called with stationsM held.
+func (s *Server) outdated(station *Station) (string, bool) {
+	latest, ok := s.firmware[station.tipe]
+	if !ok || station.firmware == "" {
+		return "", false
+	}
+	return latest, compareVersions(station.firmware, latest) < 0
+}
+
+// FIRMWARE cmd
+// Expected args:
+//  - none, for the firmware of every station online
+//  - LATEST, for the latest firmware of every type
+//  - SET [type] [version] (admin only)
+//  - DEL [type] (admin only)
+func (s *Server) handleFirmware(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) == 0 {
+		return s.firmwareInventory(), nil
+	}
+
+	switch args[0] {
+	case "LATEST":
+		if len(args) != 1 {
+			return "", argCount(args)
+		}
+		return s.latestFirmware(), nil
+	case "SET", "DEL":
+	default:
+		return "", badArgf(args[0], "unknown FIRMWARE subcommand %s", args[0])
+	}
+
+	if (args[0] == "SET" && len(args) != 3) || (args[0] == "DEL" && len(args) != 2) {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	tipe := args[1]
+	if strings.ContainsAny(tipe, ":=") {
+		return "", badArgf(tipe, "bad station type %s", tipe)
+	}
+
+	if args[0] == "DEL" {
+		s.stationsM.Lock()
+		delete(s.firmware, tipe)
+		s.stationsM.Unlock()
+
+		s.event("firmware.del", "", "%s", tipe)
+		return "ACK", nil
+	}
+
+	version := args[2]
+	if err := validateFirmware(version); err != nil {
+		return "", badArg(version, err)
+	}
+
+	s.stationsM.Lock()
+	outdated := s.setLatestFirmware(tipe, version)
+	s.stationsM.Unlock()
+
+	s.event("firmware.set", "", "%s %s", tipe, version)
+	for _, name := range outdated {
+		s.event("firmware.outdated", name, "latest %s", version)
+	}
+	return "ACK", nil
+}
+
+// setLatestFirmware records the latest firmware for a type, and returns the
+// stations online it makes outdated that weren't already. Must be called
+// with stationsM held.
+func (s *Server) setLatestFirmware(tipe, version string) []string {
+	var was map[string]bool
+	for name, station := range s.stations {
+		if _, ok := s.outdated(station); ok {
+			if was == nil {
+				was = map[string]bool{}
+			}
+			was[name] = true
+		}
+	}
+
+	s.firmware[tipe] = version
+
+	var outdated []string
+	for name, station := range s.stations {
+		if _, ok := s.outdated(station); ok && !was[name] {
+			outdated = append(outdated, name)
+		}
+	}
+	sort.Strings(outdated)
+	return outdated
+}
+
+// firmwareInventory lists the firmware of every station online, as
+// [name]:[version], with a ^ after stations that are outdated.
+func (s *Server) firmwareInventory() string {
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	names := make([]string, 0, len(s.stations))
+	for name, station := range s.stations {
+		if !station.virtual {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	buf := bytes.NewBufferString("FIRMWARE")
+	for _, name := range names {
+		station := s.stations[name]
+		version := station.firmware
+		if version == "" {
+			version = unknownFirmware
+		}
+		buf.WriteString(fmt.Sprintf(" %s:%s", name, version))
+		if _, ok := s.outdated(station); ok {
+			buf.WriteString("^")
+		}
+	}
+	return buf.String()
+}
+
+// latestFirmware lists the latest firmware of every type, as [type]:[version].
+func (s *Server) latestFirmware() string {
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	types := make([]string, 0, len(s.firmware))
+	for tipe := range s.firmware {
+		types = append(types, tipe)
+	}
+	sort.Strings(types)
+
+	buf := bytes.NewBufferString("FIRMWARE LATEST")
+	for _, tipe := range types {
+		buf.WriteString(fmt.Sprintf(" %s:%s", tipe, s.firmware[tipe]))
+	}
+	return buf.String()
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, c := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.2.0", "1.2.0", 0},
+		{"1.9", "1.10", -1},
+		{"2.0", "1.10.3", 1},
+		{"1.2", "1.2.1", -1},
+		{"1.2.0-rc1", "1.2.0-rc2", -1},
+		{"v3", "v2", 1},
+	} {
+		if got := compareVersions(c.a, c.b); got != c.expected {
+			t.Errorf("comparing %s to %s: expected %d, got %d", c.a, c.b, c.expected, got)
+		}
+	}
+}
+
+func TestFirmware(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock(), TrustPlaintext())
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	admin, water, fire := dial(), dial(), dial()
+	defer admin.Close()
+	defer water.Close()
+	defer fire.Close()
+
+	if err := sendExpect(water, "1 REGISTER water source firmware=1.9.0", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(fire, "1 REGISTER fire heater", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []interaction{
+		{"1 FIRMWARE SET source 1.10.0", "1 ACK"},
+		{"2 FIRMWARE SET heater bad:version", "2 ERR"},
+		{"3 FIRMWARE LATEST", "3 FIRMWARE LATEST source:1.10.0"},
+		{"4 FIRMWARE", "4 FIRMWARE fire:? water:1.9.0^"},
+		{"5 INFO water", "5 INFO water type=source health=100 firmware=1.9.0 outdated=1.10.0"},
+		{"6 FIRMWARE DEL source", "6 ACK"},
+		{"7 FIRMWARE", "7 FIRMWARE fire:? water:1.9.0"},
+		{"8 FIRMWARE PUSH source", "8 ERR"},
+	} {
+		if err := sendExpect(admin, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := sendExpect(fire, "2 REGISTER tank source firmware=a:b", "2 ERR"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFirmwareList(t *testing.T) {
+	server := New(nil, 4, clock.NewMock())
+
+	server.setLatestFirmware("source", "2.1")
+	conn := &clientConn{}
+	if _, err := server.handleRegister(context.Background(), conn, "1", "water", "source", "firmware=2.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// outdated stations are called out in the journal as they register.
+	events := server.journal.events
+	if last := events[len(events)-1]; last.kind != "firmware.outdated" || last.detail != "2.0, latest 2.1" {
+		t.Errorf("expected a firmware.outdated event, got %+v", last)
+	}
+
+	resp, err := server.handleList(context.Background(), conn, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "LIST water:source^:100"; resp != expected {
+		t.Errorf("expected %q, got %q", expected, resp)
+	}
+}
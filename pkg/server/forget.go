@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// forget removes everything the server knows about a station, disconnecting
+// it if it's online. It reports whether there was anything to remove.
+func (s *Server) forget(name string) bool {
+	known := false
+	for _, n := range s.knownStations() {
+		if n == name {
+			known = true
+		}
+	}
+
+	s.stationsM.Lock()
+	if station, ok := s.stations[name]; ok {
+		known = true
+
+		delete(s.stations, name)
+		s.watchers.left(name)
+		s.abandonRuns(name, station)
+		if s.reports != nil {
+			s.reports.down(name, s.Clock.Now())
+		}
+
+		// it's free to REGISTER again, as a brand new station.
+		station.c.Close()
+	}
+
+	if o, ok := s.orphans[name]; ok {
+		known = true
+
+		o.timer.Stop()
+		delete(s.orphans, name)
+		for uid, r := range o.runs {
+			fmt.Fprintf(r.client, "%s ERR DISCONNECTED\n", uid)
+		}
+	}
+
+	if _, ok := s.configs[name]; ok {
+		known = true
+		delete(s.configs, name)
+	}
+
+	delete(s.lastSeen, name)
+	delete(s.restored, name)
+	s.stationsM.Unlock()
+
+	if !known {
+		return false
+	}
+
+	s.reclaim(name)
+	if s.cache != nil {
+		s.cache.invalidateAll()
+	}
+
+	return true
+}
+
+// purge clears the history of one of a station's metrics. It reports whether
+// there was any.
+func (s *Server) purge(name, metric string) bool {
+	found := false
+
+	s.stationsM.Lock()
+	if station, ok := s.stations[name]; ok {
+		station.m.Lock()
+		if _, ok := station.metrics[metric]; ok {
+			found = true
+			delete(station.metrics, metric)
+		}
+		station.m.Unlock()
+	}
+	if r, ok := s.restored[name]; ok {
+		if _, ok := r.metrics[metric]; ok {
+			found = true
+			delete(r.metrics, metric)
+		}
+	}
+	s.stationsM.Unlock()
+
+	if s.store != nil {
+		if _, ok := s.history(name)[metric]; ok {
+			found = true
+			s.prune(name, metric)
+		}
+	}
+	if s.export != nil {
+		s.export.forget(name, metric)
+	}
+	if s.cache != nil {
+		s.cache.invalidate(metric)
+	}
+
+	return found
+}
+
+// FORGET cmd (admin only)
+// Expected args:
+//  - [name]
+func (s *Server) handleForget(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 1 {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	name := args[0]
+	if s.isVirtual(name) {
+		return "", errors.Errorf("station %s is virtual", name)
+	}
+	if !s.forget(name) {
+		return "", errors.Errorf("station %s is unknown to us", name)
+	}
+
+	s.event("forget", name, "")
+	return "ACK", nil
+}
+
+// PURGE cmd (admin only)
+// Expected args:
+//  - [name]
+//  - [metric]
+func (s *Server) handlePurge(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 2 {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	name, metric := args[0], args[1]
+	if !s.purge(name, metric) {
+		return "", errors.Errorf("no known metric %s on station %s", metric, name)
+	}
+
+	s.event("purge", name, "%s", metric)
+	return "ACK", nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestForgetAndPurge(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock(), TrustPlaintext())
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	station, admin := dial(), dial()
+	defer admin.Close()
+
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 LOG info hello", "2 ACK"},
+		{"3 METRIC level 1", "3 ACK"},
+		{"4 METRIC pressure 2", "4 ACK"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, in := range []interaction{
+		{"1 PURGE water level", "1 ACK"},
+		{"2 METRICS water", "2 METRICS water pressure"},
+		{"3 PURGE water level", "3 ERR"},
+		{"4 FORGET water", "4 ACK"},
+	} {
+		if err := sendExpect(admin, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// forgetting a station disconnects it.
+	if err := expectClosed(station); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []interaction{
+		{"5 LOGS water", "5 ERR"},
+		{"6 FORGET water", "6 ERR"},
+	} {
+		if err := sendExpect(admin, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// and it can come back as a brand new station.
+	station = dial()
+	defer station.Close()
+
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 METRICS water", "2 METRICS water"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestForgetAdminOnly(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock())
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 FORGET water", "2 ERR"},
+		{"3 PURGE water level", "3 ERR"},
+	} {
+		if err := sendExpect(conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -3,15 +3,20 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/benbjohnson/clock"
 	"github.com/pkg/errors"
+	"github.com/silversupreme/drops/pkg/proto"
 )
 
 type clientConn struct {
@@ -19,6 +24,55 @@ type clientConn struct {
 
 	// If the TCP client has REGISTERed, this will be filled in.
 	name string
+
+	// Filled in from the client certificate for TLS connections.
+	tls         bool
+	identity    string
+	fingerprint string
+	peer        *x509.Certificate
+	// the common name and DNS names, which it can REGISTER as.
+	names []string
+	// the role limiting which commands it can send, if any.
+	role string
+	// CoAP sessions, which anyone can start with a datagram, are never
+	// trusted like other plaintext connections can be.
+	coap bool
+
+	// How points and events are sent, as set with ENCODING.
+	encoding encoding
+
+	// The most recent commands, for crash reports.
+	recent commandRing
+
+	// Answers to recent writes, to answer retries with.
+	dedup dedupCache
+
+	// Commands waiting for COMMIT, if a batch was begun.
+	batch *batch
+	// METRICs in the batch being applied whose budget was already taken.
+	prepaid int
+
+	// Run after the response to the current command has been written.
+	afterResponse []func()
+
+	// Ongoing streams (LOGS -f and the like) started by this connection,
+	// by uid, with the function that stops each.
+	streams map[string]func()
+}
+
+// stream records an ongoing stream under uid, so that it can be stopped
+// with CANCEL or when the connection goes away.
+func (c *clientConn) stream(uid string, stop func()) {
+	if c.streams == nil {
+		c.streams = map[string]func(){}
+	}
+	c.streams[uid] = stop
+}
+
+// after arranges for fn to run once the response to the command currently
+// being handled has been sent.
+func (c *clientConn) after(fn func()) {
+	c.afterResponse = append(c.afterResponse, fn)
 }
 
 type metric struct {
@@ -31,8 +85,30 @@ type Station struct {
 	m       sync.Mutex
 	metrics map[string][]metric
 
-	c    *clientConn
-	tipe string
+	c        *clientConn
+	tipe     string
+	location *Location
+
+	// the functions the station said it can run, if it did.
+	functions []string
+
+	// the firmware the station said it runs, if it did.
+	firmware string
+
+	// what the station's tagged with, by key. Changed with stationsM held.
+	tags map[string]string
+
+	// the version of its configuration the station last said it applied.
+	configured int
+
+	// whether the server computes the station's metrics itself, and
+	// whether it does so by polling a device rather than from other
+	// stations' metrics.
+	virtual bool
+	polled  bool
+
+	// when the station was last heard from, by PING or METRIC.
+	heard time.Time
 
 	runs  map[string]*run
 	runsM sync.Mutex
@@ -41,53 +117,443 @@ type Station struct {
 type run struct {
 	client *clientConn
 	name   string
+
+	// the type of station it was run on, for objectives on the type.
+	tipe string
+
+	// Kept so the run can be delivered again.
+	fn         string
+	param      string
+	idempotent bool
+
+	started time.Time
+
+	// fails the run if the station doesn't answer in time, if runs time out.
+	timer *clock.Timer
+}
+
+// handlerFunc handles a command. ctx is done once the connection is closed,
+// or the server is.
+type handlerFunc func(context.Context, *clientConn, string, ...string) (string, error)
+
+// handlerFor returns the handler for a command, or nil if there's no such
+// command.
+func (s *Server) handlerFor(cmdName string) handlerFunc {
+	switch cmdName {
+	case "LIST":
+		return s.handleList
+	case "WATCH":
+		return s.handleWatch
+	case "TAG":
+		return s.handleTag
+	case "REGISTER":
+		return s.handleRegister
+	case "UNREGISTER":
+		return s.handleUnregister
+	case "PING":
+		return s.handlePing
+	case "HELLO":
+		return s.handleHello
+	case "QUALITY":
+		return s.handleQuality
+	case "INFO":
+		return s.handleInfo
+	case "METRIC":
+		return s.handleMetric
+	case "METRICS":
+		return s.handleMetrics
+	case "TOP":
+		return s.handleTop
+	case "RUN":
+		return s.handleRun
+	case "DONE":
+		return s.handleDone
+	case "ERR":
+		return s.handleError
+	case "PROGRESS":
+		return s.handleProgress
+	case "CANCEL":
+		return s.handleCancel
+	case "BLOCK":
+		return s.handleBlock
+	case "UNBLOCK":
+		return s.handleUnblock
+	case "BLOCKLIST":
+		return s.handleBlocklist
+	case "PROBES":
+		return s.handleProbes
+	case "LOG":
+		return s.handleLog
+	case "LOGS":
+		return s.handleLogs
+	case "NOTE":
+		return s.handleNote
+	case "NOTES":
+		return s.handleNotes
+	case "EVENTS":
+		return s.handleEvents
+	case "ALERTS":
+		return s.handleAlerts
+	case "ACKALERT":
+		return s.handleAckAlert
+	case "THRESHOLDS":
+		return s.handleThresholds
+	case "ENCODING":
+		return s.handleEncoding
+	case "FORGET":
+		return s.handleForget
+	case "PURGE":
+		return s.handlePurge
+	case "RENAME":
+		return s.handleRename
+	case "CONFIG":
+		return s.handleConfig
+	case "CONFIGURED":
+		return s.handleConfigured
+	case "FIRMWARE":
+		return s.handleFirmware
+	case "CURSOR":
+		return s.handleCursor
+	case "DUMP":
+		return s.handleDump
+	case "LOAD":
+		return s.handleLoad
+	case "SUBSCRIBE":
+		return s.handleSubscribe
+	case "UNSUBSCRIBE":
+		return s.handleUnsubscribe
+	case "BEGIN":
+		return s.handleBegin
+	case "COMMIT":
+		return s.handleCommit
+	case "ABORT":
+		return s.handleAbort
+	case "ADVANCE":
+		return s.handleAdvance
+	case "CHAOS":
+		return s.handleChaos
+	}
+	return nil
+}
+
+// respond writes the response to a command, and then runs what was waiting
+// for it to be sent.
+func (s *Server) respond(conn *clientConn, uid, resp string) {
+	fmt.Fprintln(conn, fmt.Sprintf("%s %s", uid, resp))
+	s.responded(conn)
 }
 
-type handlerFunc func(*clientConn, string, ...string) (string, error)
+// responded runs what was waiting for the response to the current command,
+// whether or not it was actually sent.
+func (s *Server) responded(conn *clientConn) {
+	for _, fn := range conn.afterResponse {
+		fn()
+	}
+	conn.afterResponse = nil
+}
+
+// writeErr tells the client a command failed, and how if the protocol is
+// strict or the command was rate limited.
+func (s *Server) writeErr(conn *clientConn, uid string, err error, fields []string) {
+	if detail := strictError(err, fields); detail != "" && (s.strict || detail == codeRateLimited) {
+		conn.Write([]byte(fmt.Sprintf("%s ERR %s\n", uid, detail)))
+	} else {
+		conn.Write([]byte(fmt.Sprintf("%s ERR\n", uid)))
+	}
+}
 
 // REGISTER cmd
 // Expected args:
 //  - [name]
 //  - [type]
-func (s *Server) handleRegister(conn *clientConn, uid string, args ...string) (string, error) {
-	if len(args) != 2 {
-		return "", errors.Errorf("bad arg count: %v", args)
-	}
-
+//  - location=[lat],[lon] (optional)
+//  - functions=[function],... (optional)
+func (s *Server) handleRegister(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
 	s.stationsM.Lock()
 	defer s.stationsM.Unlock()
 
-	name, tipe := args[0], args[1]
-	if _, present := s.stations[name]; present {
-		return "", errors.Errorf("%s already registered", name)
+	r, err := s.parseRegistration(args)
+	if err != nil {
+		return "", err
+	}
+	if err := s.mayRegister(conn, args[0]); err != nil {
+		return "", err
+	}
+	if _, present := s.stations[r.name]; present {
+		return "", errors.Errorf("%s already registered", r.name)
 	}
+	name := r.name
 
-	s.stations[name] = &Station{
-		metrics: map[string][]metric{},
+	metrics := map[string][]metric{}
+	var tags map[string]string
+	if s.store != nil {
+		// pick up where the station left off.
+		metrics = s.history(name)
+	}
+	if r, ok := s.restored[name]; ok {
+		for m, ms := range r.metrics {
+			for _, p := range ms {
+				metrics[m], _ = insertMetric(metrics[m], p, s.maxMetricPoints)
+			}
+		}
+		r.metrics = map[string][]metric{}
+		tags = copyTags(r.tags)
+	}
+
+	station := &Station{
+		metrics: metrics,
+
+		c:        conn,
+		tipe:     r.tipe,
+		location: r.location,
+
+		functions: r.functions,
+		firmware:  r.firmware,
+		tags:      tags,
 
-		c:    conn,
-		tipe: tipe,
+		heard: s.Clock.Now(),
 
 		runs: map[string]*run{},
 	}
+	s.stations[name] = station
 	conn.name = name
+	s.saveStation(name, station)
+	s.watchers.joined(name, r.tipe)
+
+	if s.cache != nil {
+		s.cache.invalidateAll()
+	}
+
+	s.redeliverRuns(name, station)
+
+	// once the station knows it's registered, it gets its configuration.
+	conn.after(func() {
+		s.stationsM.RLock()
+		defer s.stationsM.RUnlock()
+
+		if s.stations[name] == station {
+			s.pushConfig(name, station)
+		}
+	})
+	if s.reports != nil {
+		s.reports.up(name, s.Clock.Now())
+	}
+	s.event("register", name, "%s", r.tipe)
+	if latest, ok := s.outdated(station); ok {
+		s.event("firmware.outdated", name, "%s, latest %s", station.firmware, latest)
+	}
 
 	return "ACK", nil
 }
 
-// LIST cmd
+// UNREGISTER cmd
 // Expected args: none
-func (s *Server) handleList(conn *clientConn, uid string, args ...string) (string, error) {
+//
+// The connection stays open, and can carry on as a plain client or REGISTER
+// again.
+func (s *Server) handleUnregister(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
 	if len(args) != 0 {
-		return "", errors.Errorf("bad arg count: %v", args)
+		return "", argCount(args)
+	}
+
+	// client must have run REGISTER first
+	if conn.name == "" {
+		return "", errors.Errorf("client is not a station and cannot unregister")
 	}
 
 	s.stationsM.Lock()
 	defer s.stationsM.Unlock()
 
+	name := conn.name
+	station, ok := s.dropStation(conn)
+	if !ok {
+		return "", errors.Errorf("station %s is somehow unknown to us", name)
+	}
+	conn.name = ""
+
+	// the station is going away on purpose, so its runs aren't held for it.
+	station.runsM.Lock()
+	for uid, r := range station.runs {
+		s.failRun(name, uid, r, "UNREGISTERED")
+	}
+	station.runs = map[string]*run{}
+	station.runsM.Unlock()
+
+	s.event("unregister", name, "")
+	return "ACK", nil
+}
+
+// dropStation takes a connection's station offline, and returns it. Must be
+// called with stationsM held.
+func (s *Server) dropStation(conn *clientConn) (*Station, bool) {
+	// the station may have been forgotten and registered again since.
+	station, ok := s.stations[conn.name]
+	if !ok || station.c != conn {
+		return nil, false
+	}
+
+	delete(s.stations, conn.name)
+	s.lastSeen[conn.name] = s.Clock.Now()
+	s.watchers.left(conn.name)
+	if _, ok := s.restored[conn.name]; ok || len(station.tags) > 0 {
+		// for when it registers again, even if it's removed them all since
+		// it last did.
+		s.restoredStation(conn.name).tags = station.tags
+	}
+	if s.cache != nil {
+		s.cache.invalidateAll()
+	}
+	if s.reports != nil {
+		s.reports.down(conn.name, s.Clock.Now())
+	}
+	return station, true
+}
+
+// registration is what a REGISTER says about a station.
+type registration struct {
+	name      string
+	tipe      string
+	location  *Location
+	functions []string
+	firmware  string
+}
+
+// parseRegistration reads REGISTER's arguments, and checks the station could
+// register under its name unless it's already online. Must be called with
+// stationsM held.
+func (s *Server) parseRegistration(args []string) (registration, error) {
+	if len(args) < 2 || len(args) > 5 {
+		return registration{}, argCount(args)
+	}
+
+	var r registration
+	for _, arg := range args[2:] {
+		switch {
+		case strings.HasPrefix(arg, "location="):
+			l, err := ParseLocation(strings.TrimPrefix(arg, "location="))
+			if err != nil {
+				return registration{}, badArg(arg, err)
+			}
+			r.location = &l
+		case strings.HasPrefix(arg, "functions="):
+			r.functions = strings.Split(strings.TrimPrefix(arg, "functions="), ",")
+		case strings.HasPrefix(arg, "firmware="):
+			r.firmware = strings.TrimPrefix(arg, "firmware=")
+			if err := validateFirmware(r.firmware); err != nil {
+				return registration{}, badArg(arg, err)
+			}
+		default:
+			return registration{}, badArgf(arg, "unknown metadata %s", arg)
+		}
+	}
+
+	r.name, r.tipe = args[0], args[1]
+	if alias, ok := s.aliases[r.name]; ok {
+		// the station has been RENAMEd since it was set up.
+		r.name = alias
+	}
+
+	if _, known := s.types[r.tipe]; len(s.types) > 0 && !known {
+		return registration{}, badArgf(r.tipe, "unknown station type %s", r.tipe)
+	}
+
+	// RUN takes key=value options ahead of the station name.
+	if strings.Contains(r.name, "=") {
+		return registration{}, badArgf(args[0], "station names cannot contain =")
+	}
+
+	// METRICS * queries every station.
+	if r.name == "*" {
+		return registration{}, badArgf(args[0], "station cannot be named *")
+	}
+
+	return r, nil
+}
+
+// LIST cmd
+// Expected args:
+//  - [key]=[value] ... (optional, listing only stations with those tags)
+func (s *Server) handleList(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	filters, err := parseTagFilters(args)
+	if err != nil {
+		return "", err
+	}
+
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
 	buf := bytes.NewBufferString("LIST")
-	for name, s := range s.stations {
-		buf.WriteString(fmt.Sprintf(" %s:%s", name, s.tipe))
+	for name, station := range s.stations {
+		if !station.hasTags(filters) {
+			continue
+		}
+		buf.WriteString(fmt.Sprintf(" %s:%s", name, station.tipe))
+		if len(s.deviations(station)) > 0 {
+			buf.WriteString("!")
+		}
+		if _, ok := s.outdated(station); ok {
+			buf.WriteString("^")
+		}
+		health, _ := s.health(name, station)
+		buf.WriteString(fmt.Sprintf(":%d", health))
+	}
+
+	return buf.String(), nil
+}
+
+// INFO cmd
+// Expected args:
+//  - [name]
+func (s *Server) handleInfo(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 1 {
+		return "", argCount(args)
+	}
+
+	name := args[0]
+
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	station, ok := s.stations[name]
+	if !ok {
+		return "", errors.Errorf("station %s is somehow unknown to us", name)
+	}
+
+	health, stale := s.health(name, station)
+	buf := bytes.NewBufferString(fmt.Sprintf("INFO %s type=%s health=%d", name, station.tipe, health))
+	if len(stale) > 0 {
+		buf.WriteString(" stale=" + strings.Join(stale, ","))
+	}
+	if l, ok := s.location(name, station); ok {
+		buf.WriteString(fmt.Sprintf(" location=%s", l))
+	}
+	if t, ok := s.types[station.tipe]; ok {
+		if units := t.units(); len(units) > 0 {
+			buf.WriteString(" units=" + strings.Join(units, ","))
+		}
+	}
+	if c, ok := s.effectiveConfig(name, station); ok {
+		station.m.Lock()
+		buf.WriteString(fmt.Sprintf(" config=%d/%d", station.configured, c.version))
+		station.m.Unlock()
+	}
+	if devs := s.deviations(station); len(devs) > 0 {
+		buf.WriteString(" deviations=" + strings.Join(devs, ","))
+	}
+	if station.firmware != "" {
+		buf.WriteString(" firmware=" + station.firmware)
+		if latest, ok := s.outdated(station); ok {
+			buf.WriteString(" outdated=" + latest)
+		}
+	}
+	if n := s.notes.count(name); n > 0 {
+		buf.WriteString(fmt.Sprintf(" notes=%d", n))
+	}
+	for _, token := range station.tagTokens() {
+		buf.WriteString(" " + token)
+	}
+	for _, token := range s.runStats.info(name) {
+		buf.WriteString(" " + token)
 	}
 
 	return buf.String(), nil
@@ -97,97 +563,444 @@ func (s *Server) handleList(conn *clientConn, uid string, args ...string) (strin
 // Expected args:
 //  - [name]
 //  - [float]
-func (s *Server) handleMetric(conn *clientConn, uid string, args ...string) (string, error) {
-	if len(args) != 2 {
-		return "", errors.Errorf("bad arg count: %v", args)
+//  - [ts] (optional, unix timestamp for backfilled points)
+func (s *Server) handleMetric(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	now := s.Clock.Now()
+	if conn.prepaid > 0 {
+		conn.prepaid--
+	} else if s.rateLimit != nil && conn.name != "" && !s.rateLimit.allow(conn.name, now) {
+		return "", errRateLimited
+	}
+
+	name, m, err := parsePoint(args, now)
+	if err != nil {
+		if name != "" {
+			rejected := qualityEvent{at: now, kind: rejectedPoint}
+			if m.ts.After(now) {
+				rejected.ahead = m.ts.Sub(now)
+			}
+			s.quality.record(conn.name, name, rejected)
+		}
+		return "", err
+	}
+	if len(args) == 3 {
+		s.quality.record(conn.name, name, qualityEvent{at: now, kind: timestampedPoint, ahead: m.ts.Sub(now)})
+	}
+
+	kept, err := s.storeMetric(conn, name, m)
+	if err != nil {
+		return "", err
+	}
+	if kept {
+		s.updateVirtual(conn.name, name)
+		s.checkThresholds(conn.name, name, m.value)
+	}
+
+	// with persistence on, the station only hears back once the point is
+	// safely on disk.
+	if kept && s.store != nil {
+		if err := s.store.Append(storedPoint(conn.name, name, m)); err != nil {
+			return "", err
+		}
+	}
+
+	return "ACK", nil
+}
+
+// parsePoint reads METRIC's arguments into a point. If the point is
+// rejected, the metric's name is still returned once it's known to be
+// valid, along with the point's time if it was too far ahead.
+func parsePoint(args []string, now time.Time) (string, metric, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return "", metric{}, argCount(args)
 	}
 
 	name, stringValue := args[0], args[1]
+	if err := validateMetricName(name); err != nil {
+		return "", metric{}, badArg(name, err)
+	}
+
 	floatValue, err := strconv.ParseFloat(stringValue, 64)
 	if err != nil {
-		return "", err
+		return name, metric{}, badArg(stringValue, err)
 	}
 
-	s.stationsM.Lock()
-	defer s.stationsM.Unlock()
+	ts := now
+	if len(args) == 3 {
+		unix, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return name, metric{}, badArg(args[2], errors.Wrapf(err, "bad timestamp %s", args[2]))
+		}
+
+		ts = time.Unix(unix, 0)
+		if ts.After(now.Add(maxMetricSkew)) {
+			return name, metric{ts: ts}, badArgf(args[2], "timestamp %s is in the future", args[2])
+		}
+	}
+
+	return name, metric{ts: ts, value: floatValue}, nil
+}
+
+// storeMetric adds a point to a station's in-memory history, and reports
+// whether it was kept.
+func (s *Server) storeMetric(conn *clientConn, name string, m metric) (bool, error) {
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
 
 	// client must have run REGISTER first
 	if conn.name == "" {
-		return "", errors.Errorf("client is not a station and cannot report telemetry")
+		return false, errors.Errorf("client is not a station and cannot report telemetry")
 	}
 
 	station, ok := s.stations[conn.name]
 	if !ok {
-		return "", errors.Errorf("station %s is somehow unknown to us", conn.name)
+		return false, errors.Errorf("station %s is somehow unknown to us", conn.name)
 	}
 
 	station.m.Lock()
 	defer station.m.Unlock()
 
-	station.metrics[name] = append(station.metrics[name], metric{ts: s.Clock.Now(), value: floatValue})
-	// to conserve memory just a bit we only keep a certain number of metrics around.
-	if len(station.metrics[name]) > s.maxMetricPoints {
-		_, station.metrics[name] = station.metrics[name][0], station.metrics[name][1:]
+	station.heard = s.Clock.Now()
+	kept := s.keep(conn.name, station, name, m)
+	if !kept && hasMetric(station.metrics[name], m) {
+		s.quality.record(conn.name, name, qualityEvent{at: s.Clock.Now(), kind: duplicatePoint})
 	}
 
-	return "ACK", nil
+	return kept, nil
+}
+
+// keep adds a point to a station's series, and passes it on to exports,
+// caches and subscribers if it was kept. Must be called with stationsM and
+// the station's lock held.
+func (s *Server) keep(name string, station *Station, metric string, m metric) bool {
+	cutoff := s.cutoff()
+	if m.ts.Before(cutoff) {
+		// backfilled past retention.
+		return false
+	}
+
+	var kept bool
+	station.metrics[metric], kept = insertMetric(station.metrics[metric], m, s.maxMetricPoints)
+	if !kept {
+		return false
+	}
+	station.metrics[metric] = expired(station.metrics[metric], cutoff)
+
+	if s.deadman != nil {
+		s.deadman.ingested(s.Clock.Now())
+	}
+	if s.export != nil {
+		s.export.add(name, station, metric, m)
+	}
+	if s.cache != nil {
+		s.cache.invalidate(metric)
+	}
+	s.subscribers.publish(name, metric, m, s.Clock.Now())
+
+	return true
 }
 
 // METRICS cmd
 // Expected arguments:
-//  - [name]
+//  - [name], or * for every station
 //  - [metric] (optional)
-func (s *Server) handleMetrics(conn *clientConn, uid string, args ...string) (string, error) {
-	if len(args) < 1 || len(args) > 2 {
-		return "", errors.Errorf("bad arg count: %v", args)
+//  - LAST (optional, required with *)
+//  - unit=[unit] (optional)
+//  - from=[time], to=[time], tz=[zone] (optional)
+//
+// On jsonl connections, points are sent as their own lines of JSON before
+// the final METRICS response, which counts them.
+func (s *Server) handleMetrics(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) > 0 && args[0] == "*" {
+		return s.handleMetricsLast(ctx, conn, uid, args...)
+	}
+
+	if len(args) < 1 || len(args) > 7 {
+		return "", argCount(args)
 	}
 
 	name := args[0]
 
-	s.stationsM.Lock()
-	defer s.stationsM.Unlock()
+	var q metricsQuery
+	if len(args) > 2 {
+		if isMetricPattern(args[1]) {
+			return "", errors.Errorf("METRICS %s takes no modifiers", args[1])
+		}
 
-	station, ok := s.stations[name]
+		var err error
+		if q, err = parseMetricsQuery(args[2:], s.Clock.Now()); err != nil {
+			return "", err
+		}
+	}
+
+	// reads work on a snapshot of the station's series, so formatting a long
+	// response doesn't hold up the station's METRICs.
+	metrics, ok := s.snapshot(name)
 	if !ok {
 		return "", errors.Errorf("station %s is somehow unknown to us", name)
 	}
 
-	station.m.Lock()
-	defer station.m.Unlock()
-
 	buf := bytes.NewBufferString(fmt.Sprintf("METRICS %s", name))
 
 	switch len(args) {
 	case 1:
 		// METRICS [name] only lists the available metrics.
-		for name := range station.metrics {
+		for name := range metrics {
 			buf.WriteString(fmt.Sprintf(" %s", name))
 		}
-	case 2:
+	default:
+		if isMetricPattern(args[1]) {
+			return s.metricsMatching(conn, uid, name, metrics, args[1]), nil
+		}
+
 		// METRICS [name] [metric] lists all known values for the metric.
 		metric := args[1]
-		ms, ok := station.metrics[metric]
+		ms, ok := metrics[metric]
 		if !ok {
 			return "", errors.Errorf("no known metric %s on station %s", metric, name)
 		}
 
+		ms = q.window.filter(ms)
+		if q.last && len(ms) > 0 {
+			ms = ms[len(ms)-1:]
+		}
+		if q.unit != "" {
+			s.stationsM.RLock()
+			from := s.metricUnit(name, metric)
+			s.stationsM.RUnlock()
+
+			var err error
+			if ms, err = convertPoints(ms, from, q.unit); err != nil {
+				return "", errors.Wrapf(err, "%s on station %s", metric, name)
+			}
+		}
+
+		if conn.encoding == jsonlEncoding {
+			unit := q.unit
+			if unit == "" {
+				s.stationsM.RLock()
+				unit = s.metricUnit(name, metric)
+				s.stationsM.RUnlock()
+			}
+			writePointsJSON(conn, uid, name, metric, unit, ms)
+			return fmt.Sprintf("METRICS %s %s %d", name, metric, len(ms)), nil
+		}
+
 		buf.WriteString(fmt.Sprintf(" %s", metric))
-		for _, m := range ms {
-			buf.WriteString(fmt.Sprintf(" %d:%.2f", m.ts.Unix(), m.value))
+		writePoints(buf, ms)
+	}
+
+	return buf.String(), nil
+}
+
+// snapshot returns a station's series as they are now. Series are
+// copy-on-write (see insertMetric), so the snapshot can be read without any
+// locks while the station keeps reporting.
+func (s *Server) snapshot(name string) (map[string][]metric, bool) {
+	s.stationsM.RLock()
+	station, ok := s.stations[name]
+	s.stationsM.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	station.m.Lock()
+	defer station.m.Unlock()
+
+	metrics := make(map[string][]metric, len(station.metrics))
+	for name, ms := range station.metrics {
+		metrics[name] = ms
+	}
+	return metrics, true
+}
+
+// handleMetricsLast answers METRICS * [metric] LAST with the latest value of
+// the metric from every station that has it, so a dashboard can refresh in
+// one round trip. With unit=[unit], stations whose values can't be converted
+// to the unit are left out.
+func (s *Server) handleMetricsLast(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 3 || len(args) > 4 || args[2] != "LAST" {
+		return "", errors.Errorf("expected METRICS * [metric] LAST [unit=unit], got %v", args)
+	}
+	name := args[1]
+
+	q, err := parseMetricsQuery(args[2:], s.Clock.Now())
+	if err != nil {
+		return "", err
+	}
+	if q.window != (timeWindow{}) {
+		return "", errors.Errorf("METRICS * only has the latest values")
+	}
+
+	values := s.latest(name)
+	if q.unit != "" {
+		s.stationsM.RLock()
+		converted := make([]stationValue, 0, len(values))
+		for _, l := range values {
+			v, err := convert(l.value, s.metricUnit(l.station, name), q.unit)
+			if err != nil {
+				continue
+			}
+			converted = append(converted, stationValue{l.station, metric{ts: l.ts, value: v}})
+		}
+		s.stationsM.RUnlock()
+		values = converted
+	}
+
+	if conn.encoding == jsonlEncoding {
+		s.stationsM.RLock()
+		for _, l := range values {
+			unit := q.unit
+			if unit == "" {
+				unit = s.metricUnit(l.station, name)
+			}
+			writePointsJSON(conn, uid, l.station, name, unit, []metric{l.metric})
+		}
+		s.stationsM.RUnlock()
+		return fmt.Sprintf("METRICS * %s %d", strings.Join(args[1:], " "), len(values)), nil
+	}
+
+	buf := bytes.NewBufferString("METRICS * " + strings.Join(args[1:], " "))
+	for _, l := range values {
+		fmt.Fprintf(buf, " %s", l)
+	}
+
+	return buf.String(), nil
+}
+
+// stationValue is the latest value of a metric on one station.
+type stationValue struct {
+	station string
+	metric
+}
+
+func (v stationValue) String() string {
+	return fmt.Sprintf("%s:%d:%.2f", v.station, v.ts.Unix(), v.value)
+}
+
+// latest returns the latest value of a metric from every station that has
+// reported it, ordered by station name.
+func (s *Server) latest(metric string) []stationValue {
+	if s.cache != nil {
+		return s.cache.latest(metric, s.collectLatest)
+	}
+	return s.collectLatest(metric)
+}
+
+func (s *Server) collectLatest(metric string) []stationValue {
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	var values []stationValue
+	for name, station := range s.stations {
+		station.m.Lock()
+		if ms := station.metrics[metric]; len(ms) > 0 {
+			values = append(values, stationValue{name, ms[len(ms)-1]})
 		}
+		station.m.Unlock()
+	}
+
+	sort.Slice(values, func(i, j int) bool { return values[i].station < values[j].station })
+	return values
+}
+
+// TOP cmd
+// Expected arguments:
+//  - [metric]
+//  - [n]
+//  - MIN or MAX
+func (s *Server) handleTop(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 3 {
+		return "", argCount(args)
+	}
+
+	metric := args[0]
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 {
+		return "", errors.Errorf("bad count %s", args[1])
+	}
+
+	order := args[2]
+	if order != "MIN" && order != "MAX" {
+		return "", errors.Errorf("expected MIN or MAX, got %s", order)
+	}
+
+	values := s.latest(metric)
+	// stable, so ties stay in station name order.
+	sort.SliceStable(values, func(i, j int) bool {
+		if order == "MIN" {
+			return values[i].value < values[j].value
+		}
+		return values[i].value > values[j].value
+	})
+	if len(values) > n {
+		values = values[:n]
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf("TOP %s %d %s", metric, n, order))
+	for _, v := range values {
+		fmt.Fprintf(buf, " %s", v)
 	}
 
 	return buf.String(), nil
 }
 
+func writePoints(w io.Writer, ms []metric) {
+	for _, m := range ms {
+		fmt.Fprintf(w, " %d:%.2f", m.ts.Unix(), m.value)
+	}
+}
+
+// metricsMatching answers METRICS [name] [pattern], sending each matching
+// metric in a snapshot of the station as its own METRIC line.
+func (s *Server) metricsMatching(conn *clientConn, uid, name string, metrics map[string][]metric, pattern string) string {
+	var matches []string
+	for metric := range metrics {
+		if matchMetric(pattern, metric) {
+			matches = append(matches, metric)
+		}
+	}
+	sort.Strings(matches)
+
+	for _, metric := range matches {
+		if conn.encoding == jsonlEncoding {
+			s.stationsM.RLock()
+			unit := s.metricUnit(name, metric)
+			s.stationsM.RUnlock()
+			writePointsJSON(conn, uid, name, metric, unit, metrics[metric])
+			continue
+		}
+
+		buf := bytes.NewBufferString(fmt.Sprintf("%s METRIC %s %s", uid, name, metric))
+		writePoints(buf, metrics[metric])
+		buf.WriteString("\n")
+		conn.Write(buf.Bytes())
+	}
+
+	return fmt.Sprintf("METRICS %s %s %d", name, pattern, len(matches))
+}
+
 // RUN cmd
 // Expected arguments:
+//  - idempotent=true (optional)
 //  - [name]
 //  - [function]
 //  - [parameter] (optional)
-func (s *Server) handleRun(conn *clientConn, uid string, args ...string) (string, error) {
+func (s *Server) handleRun(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	idempotent := false
+	if len(args) > 0 && strings.Contains(args[0], "=") {
+		switch args[0] {
+		case "idempotent=true":
+			idempotent = true
+		case "idempotent=false":
+		default:
+			return "", errors.Errorf("unknown option %s", args[0])
+		}
+		args = args[1:]
+	}
+
 	if len(args) < 2 || len(args) > 3 {
-		return "", errors.Errorf("bad arg count: %v", args)
+		return "", argCount(args)
 	}
 
 	name, fn := args[0], args[1]
@@ -200,6 +1013,10 @@ func (s *Server) handleRun(conn *clientConn, uid string, args ...string) (string
 		return "", errors.Errorf("station %s is somehow unknown to us", name)
 	}
 
+	if station.virtual {
+		return "", errors.Errorf("station %s is virtual", name)
+	}
+
 	station.runsM.Lock()
 	defer station.runsM.Unlock()
 
@@ -207,32 +1024,41 @@ func (s *Server) handleRun(conn *clientConn, uid string, args ...string) (string
 		return "", errors.Errorf("uid %s already in use", uid)
 	}
 
-	// route the command to the proper station connection
-	fmt.Fprintf(station.c, "%s RUN %s", uid, fn)
+	// save the client connection so we can route back to it later.
+	r := &run{
+		client: conn,
+		name:   name,
+
+		tipe:       station.tipe,
+		fn:         fn,
+		idempotent: idempotent,
 
+		started: s.Clock.Now(),
+	}
 	if len(args) == 3 {
 		// include the parameter if the client specified it
-		fmt.Fprintf(station.c, " %s", args[2])
+		r.param = args[2]
 	}
-
-	// always include the needed newline
-	fmt.Fprintf(station.c, "\n")
-
-	// save the client connection so we can route back to it later.
-	station.runs[uid] = &run{
-		client: conn,
-		name:   name,
+	station.runs[uid] = r
+	s.runStats.started(name, fn)
+	if s.runTimeout > 0 {
+		r.timer = s.Clock.AfterFunc(s.runTimeout, func() {
+			s.expireRun(uid, r)
+		})
 	}
 
+	// route the command to the proper station connection
+	sendRun(station.c, uid, r)
+
 	return "ACK", nil
 }
 
 // DONE cmd
 // Expected arguments:
 //  - [result] (optional)
-func (s *Server) handleDone(conn *clientConn, uid string, args ...string) (string, error) {
+func (s *Server) handleDone(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
 	if len(args) > 1 {
-		return "", errors.Errorf("bad arg count: %v", args)
+		return "", argCount(args)
 	}
 
 	// client must have run REGISTER first
@@ -253,28 +1079,109 @@ func (s *Server) handleDone(conn *clientConn, uid string, args ...string) (strin
 
 	c, ok := station.runs[uid]
 	if !ok {
-		return "", errors.Errorf("unknown uid %s", uid)
+		return "", badUID(uid, "unknown uid %s", uid)
 	}
 
-	// route the command to the proper client connection
-	fmt.Fprintf(c.client, "%s DONE", uid)
+	// route the command to the proper client connection, as a single write
+	// so it can't be interleaved with the client's other responses.
+	line := fmt.Sprintf("%s DONE", uid)
 	if len(args) == 1 {
 		// include the parameter if the station specified it
-		fmt.Fprintf(c.client, " %s", args[0])
+		line += " " + args[0]
 	}
-
-	// always make sure we include the newline
-	fmt.Fprintf(c.client, "\n")
+	fmt.Fprintf(c.client, "%s\n", line)
 	delete(station.runs, uid)
+	s.finishRun(conn.name, c, true)
+	s.event("run.done", conn.name, "%s", c.fn)
+
+	return "ACK", nil
+}
+
+// PROGRESS cmd
+// Expected arguments:
+//  - [progress] (optional)
+func (s *Server) handleProgress(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) > 1 {
+		return "", argCount(args)
+	}
+
+	// client must have run REGISTER first
+	if conn.name == "" {
+		return "", errors.Errorf("client is not a station and cannot respond to RPCs")
+	}
+
+	s.stationsM.Lock()
+	defer s.stationsM.Unlock()
+
+	station, ok := s.stations[conn.name]
+	if !ok {
+		return "", errors.Errorf("station %s is somehow unknown to us", conn.name)
+	}
+
+	station.runsM.Lock()
+	defer station.runsM.Unlock()
+
+	c, ok := station.runs[uid]
+	if !ok {
+		return "", badUID(uid, "unknown uid %s", uid)
+	}
+
+	// route the update to the proper client connection, but keep the run
+	// around since the station isn't done with it yet.
+	line := fmt.Sprintf("%s PROGRESS", uid)
+	if len(args) == 1 {
+		line += " " + args[0]
+	}
+	fmt.Fprintf(c.client, "%s\n", line)
 
 	return "ACK", nil
 }
 
+// CANCEL cmd
+// Expected arguments: none
+func (s *Server) handleCancel(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 0 {
+		return "", argCount(args)
+	}
+
+	// streams are stopped by cancelling them, too.
+	if stop, ok := conn.streams[uid]; ok {
+		stop()
+		delete(conn.streams, uid)
+		return "ACK", nil
+	}
+
+	s.stationsM.Lock()
+	defer s.stationsM.Unlock()
+
+	for _, station := range s.stations {
+		station.runsM.Lock()
+		c, ok := station.runs[uid]
+		station.runsM.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		// only the client that started a run gets to cancel it.
+		if c.client != conn {
+			return "", errors.Errorf("uid %s belongs to another client", uid)
+		}
+
+		// the station still has to answer with DONE or ERR, which is how
+		// the client finds out whether the cancellation took.
+		fmt.Fprintf(station.c, "%s CANCEL\n", uid)
+		return "ACK", nil
+	}
+
+	return "", badUID(uid, "unknown uid %s", uid)
+}
+
 // ERR cmd
 // Expected arguments:
-func (s *Server) handleError(conn *clientConn, uid string, args ...string) (string, error) {
+func (s *Server) handleError(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
 	if len(args) != 0 {
-		return "", errors.Errorf("bad arg count: %v", args)
+		return "", argCount(args)
 	}
 
 	// client must have run REGISTER first
@@ -295,70 +1202,209 @@ func (s *Server) handleError(conn *clientConn, uid string, args ...string) (stri
 
 	c, ok := station.runs[uid]
 	if !ok {
-		return "", errors.Errorf("unknown uid %s", uid)
+		return "", badUID(uid, "unknown uid %s", uid)
 	}
 
 	// route the command to the proper client connection
 	fmt.Fprintf(c.client, "%s ERR\n", uid)
 	delete(station.runs, uid)
+	s.finishRun(conn.name, c, false)
+	s.event("run.err", conn.name, "%s", c.fn)
 
 	return "ACK", nil
 }
 
-// handle performs the actual line protocol client management.
-func (s *Server) handle(c net.Conn) {
+// handle performs the actual line protocol client management, until the
+// connection or ctx is closed.
+func (s *Server) handle(ctx context.Context, c net.Conn) {
 
 	// Wrap the net.Conn so we can tag more information on it.
 	conn := clientConn{
 		Conn: c,
 	}
+	defer s.reportCrash(&conn)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		c.Close()
+	})
+	defer stop()
+
+	ip := sourceIP(c.RemoteAddr())
+	if s.probes.isDenied(ip, s.Clock.Now()) {
+		return
+	}
+
+	if err := s.identify(&conn); err != nil {
+		s.log.Errorf("rejecting %s: %v", c.RemoteAddr(), err)
+
+		class := probeHandshake
+		if cause := errors.Cause(err); cause == errBlocked || cause == errRevoked {
+			class = probeBlocked
+		}
+		s.recordProbe(ip, class)
+		return
+	}
+
+	s.connsM.Lock()
+	if s.closing {
+		// accepted just before Shutdown, which didn't get to say BYE.
+		s.connsM.Unlock()
+		return
+	}
+	s.conns[&conn] = struct{}{}
+	s.connsM.Unlock()
+
+	for _, line := range s.banner {
+		fmt.Fprintf(&conn, "motd MOTD %s\n", line)
+	}
+
+	defer func() {
+		s.connsM.Lock()
+		delete(s.conns, &conn)
+		s.connsM.Unlock()
+
+		for _, stop := range conn.streams {
+			stop()
+		}
+	}()
+
+	// until a client manages to send a valid command, anything else it sends
+	// counts as probing.
+	authed := false
+
+	scanner := bufio.NewScanner(&conn)
+lines:
+	for {
+		s.extendDeadline(&conn)
+		if !scanner.Scan() {
+			break
+		}
 
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
 		scan := scanner.Text()
 		cmdParts := strings.Split(scan, " ")
 
-		var fn handlerFunc
-
 		if len(cmdParts) < 2 {
-			glog.Errorf("bad line received: %s", scan)
+			s.log.Errorf("bad line received: %s", scan)
 			conn.Write([]byte("FATAL\n"))
+			if !authed && s.recordProbe(ip, probeProtocol) {
+				break lines
+			}
 			continue
 		}
 
 		uid, cmdName := cmdParts[0], cmdParts[1]
-		switch cmdName {
-		case "LIST":
-			fn = s.handleList
-		case "REGISTER":
-			fn = s.handleRegister
-		case "METRIC":
-			fn = s.handleMetric
-		case "METRICS":
-			fn = s.handleMetrics
-		case "RUN":
-			fn = s.handleRun
-		case "DONE":
-			fn = s.handleDone
-		case "ERR":
-			fn = s.handleError
-		default:
-			glog.Errorf("no command %s known", cmdName)
-			conn.Write([]byte(fmt.Sprintf("%s ERR UNRECOGNIZED CMD\n", uid)))
+		if s.crashDir != "" {
+			conn.recent.add(redact(cmdParts))
+		}
+		spec, known := proto.Lookup(cmdName)
+		if known {
+			if err := s.authorize(&conn, cmdName); err != nil {
+				s.log.Errorf("refusing %s from %s: %v", cmdName, describe(&conn), err)
+				s.audit(&conn, conn.name, cmdParts, auditForbidden, err)
+				s.writeErr(&conn, uid, err, cmdParts)
+				continue
+			}
+		}
+
+		// in a batch, everything waits for the COMMIT.
+		if conn.batch != nil && cmdName != "COMMIT" && cmdName != "ABORT" {
+			conn.batch.add(cmdParts)
+			s.audit(&conn, conn.name, cmdParts, auditBatched, nil)
+			continue
+		}
+
+		fn := s.handlerFor(cmdName)
+		if !known || fn == nil {
+			s.log.Errorf("no command %s known", cmdName)
+			s.audit(&conn, conn.name, cmdParts, auditUnknown, nil)
+			if s.strict {
+				conn.Write([]byte(fmt.Sprintf("%s ERR %s\n", uid, unknownCmd(cmdParts))))
+			} else {
+				conn.Write([]byte(fmt.Sprintf("%s ERR UNRECOGNIZED CMD\n", uid)))
+			}
+			if !authed && s.recordProbe(ip, probeProtocol) {
+				break lines
+			}
+			continue
+		}
+		authed = true
+
+		if !spec.Accepts(len(cmdParts) - 2) {
+			s.log.Errorf("error processing %s: wrong number of args", cmdName)
+			s.audit(&conn, conn.name, cmdParts, auditError, argCount(cmdParts[2:]))
+			s.writeErr(&conn, uid, argCount(cmdParts[2:]), cmdParts)
 			continue
 		}
 
-		resp, err := fn(&conn, uid, cmdParts[2:]...)
+		dedup := s.dedupWindow > 0 && spec.Writes
+		if dedup {
+			if resp, ok := conn.dedup.lookup(uid, scan, s.Clock.Now(), s.dedupWindow); ok {
+				s.log.Infof("answering repeated %s %s from %s from memory", uid, cmdName, describe(&conn))
+				s.audit(&conn, conn.name, cmdParts, auditReplayed, nil)
+				fmt.Fprintln(&conn, fmt.Sprintf("%s %s", uid, resp))
+				continue
+			}
+		}
+
+		// backfilled points wait for their turn before anything is held.
+		if s.catchUp != nil && cmdName == "METRIC" {
+			s.throttle(ctx, cmdParts[2:])
+		}
+
+		// injected faults hold commands up or lose their answers, except for
+		// CHAOS itself, so they can always be turned off.
+		drop := false
+		if s.chaos != nil && cmdName != "CHAOS" {
+			drop = s.injectFault(ctx, &conn)
+		}
+
+		// who sent it, before it's handled, e.g. for UNREGISTER.
+		station := conn.name
+		start := s.Clock.Now()
+		var resp string
+		var err error
+		if cmdName == "COMMIT" {
+			// batches are applied with nothing else going on.
+			resp, err = fn(ctx, &conn, uid, cmdParts[2:]...)
+		} else {
+			s.batchM.RLock()
+			resp, err = fn(ctx, &conn, uid, cmdParts[2:]...)
+			s.batchM.RUnlock()
+		}
+		s.timed(&conn, cmdParts, s.Clock.Since(start))
 		if err != nil {
-			glog.Errorf("error processing %s: %v", cmdName, err)
-			conn.Write([]byte(fmt.Sprintf("%s ERR\n", uid)))
+			s.audit(&conn, station, cmdParts, auditError, err)
+			// the rate limiter logs stations going over on its own, rather
+			// than once per point.
+			if errors.Cause(err) != errRateLimited {
+				s.log.Errorf("error processing %s: %v", cmdName, err)
+			}
+			if !drop {
+				s.writeErr(&conn, uid, err, cmdParts)
+			}
 			continue
 		}
 
-		fmt.Fprintln(conn, fmt.Sprintf("%s %s", uid, resp))
+		s.audit(&conn, station, cmdParts, auditOK, nil)
+		if drop {
+			s.log.Infof("chaos: dropping the answer to %s %s from %s", uid, cmdName, describe(&conn))
+			s.responded(&conn)
+		} else {
+			s.respond(&conn, uid, resp)
+		}
+		if dedup {
+			conn.dedup.remember(uid, scan, resp, s.Clock.Now())
+		}
 	}
-	if err := scanner.Err(); err != nil {
-		glog.Errorf("reading standard input: %v", err)
+	if err := scanner.Err(); err != nil && !s.isClosing() {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			s.log.Infof("Closing idle connection from %s.", describe(&conn))
+		} else {
+			s.log.Errorf("reading standard input: %v", err)
+		}
 	}
 
 	// Disconnected registered connections need to be removed from the list
@@ -367,12 +1413,11 @@ func (s *Server) handle(c net.Conn) {
 		s.stationsM.Lock()
 		defer s.stationsM.Unlock()
 
-		if _, ok := s.stations[conn.name]; ok {
-			delete(s.stations, conn.name)
+		if station, ok := s.dropStation(&conn); ok {
+			s.abandonRuns(conn.name, station)
+			s.event("disconnect", conn.name, "")
 		}
 
-		glog.Infof("Client %s disconnected.", conn.name)
-
-		// TODO(silversupreme): alert somehow?
+		s.log.Infof("Client %s disconnected.", conn.name)
 	}
 }
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// A station's health is a score from 0 to 100 that folds everything an
+// operator would check about it into one number, so the fleet can be triaged
+// at a glance. Offline stations score 0. Online ones start at 100, and lose
+// points for metrics that have gone stale, for recent runs that failed, and
+// for objectives that are burning their error budget.
+
+// defaultStaleAfter is how long a metric can go without a new point by
+// default before it counts as stale.
+const defaultStaleAfter = 15 * time.Minute
+
+const (
+	// points lost when every metric is stale.
+	staleWeight = 40
+	// points lost when every recent run failed.
+	failureWeight = 30
+	// points lost when any objective is burning.
+	burningWeight = 30
+)
+
+// health scores a station, and returns the metrics that went stale. Must be
+// called with stationsM held.
+func (s *Server) health(name string, station *Station) (int, []string) {
+	now := s.Clock.Now()
+
+	station.m.Lock()
+	total := len(station.metrics)
+	var stale []string
+	for metric, ms := range station.metrics {
+		if len(ms) > 0 && now.Sub(ms[len(ms)-1].ts) >= s.staleAfter {
+			stale = append(stale, metric)
+		}
+	}
+	station.m.Unlock()
+	sort.Strings(stale)
+
+	score := 100.0
+	if total > 0 {
+		score -= staleWeight * float64(len(stale)) / float64(total)
+	}
+	if rate, ok := s.runStats.failureRate(name); ok {
+		score -= failureWeight * rate
+	}
+	if s.slos.burning(name) > 0 {
+		score -= burningWeight
+	}
+
+	return int(math.Round(score)), stale
+}
+
+// writeHealth renders every known station's health in Prometheus' text
+// exposition format.
+func (s *Server) writeHealth(w io.Writer) {
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	scores := map[string]int{}
+	for name := range s.lastSeen {
+		scores[name] = 0
+	}
+	for name, station := range s.stations {
+		scores[name], _ = s.health(name, station)
+	}
+
+	names := make([]string, 0, len(scores))
+	for name := range scores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "# HELP drops_station_health Station health from 0 to 100, or 0 when offline.\n")
+	fmt.Fprintf(w, "# TYPE drops_station_health gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "drops_station_health{station=%s} %d\n", promQuote(name), scores[name])
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestHealth(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock,
+		WithSLOs(SLO{Function: "read", Target: 0.9, Window: time.Hour, Burn: 1, Min: 1}),
+	)
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	health := func() string {
+		rec := httptest.NewRecorder()
+		server.HTTPHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if strings.HasPrefix(line, "drops_station_health{") {
+				return line
+			}
+		}
+		return ""
+	}
+
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 METRIC level 1", "2 ACK"},
+		{"3 METRIC temp 20", "3 ACK"},
+		{"4 INFO water", "4 INFO water type=source health=100"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a metric that stops reporting goes stale...
+	mock.Add(defaultStaleAfter)
+	if err := sendExpect(station, "5 METRIC temp 21", "5 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(client, "1 INFO water", "1 INFO water type=source health=80 stale=level"); err != nil {
+		t.Fatal(err)
+	}
+
+	// ...and failing runs and burning objectives take their toll too.
+	if err := doRun(client, station, mock, "r1", "read", time.Second, "ERR"); err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []interaction{
+		{"2 LIST", "2 LIST water:source:20"},
+		{"3 INFO water", "3 INFO water type=source health=20 stale=level runs.read=n:1,err:1,p50:1s,p90:1s,p99:1s"},
+	} {
+		if err := sendExpect(client, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := health(); got != `drops_station_health{station="water"} 20` {
+		t.Fatalf("unexpected health metric %q", got)
+	}
+
+	// offline stations are as unhealthy as it gets.
+	station.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for health() != `drops_station_health{station="water"} 0` {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected health metric %q", health())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
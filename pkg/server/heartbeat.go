@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A monitor can't tell the server is down by scraping it if it can't reach
+// it, as with a hub behind NAT. With a heartbeat, the server POSTs a short
+// status to a URL every so often instead, and the monitor alerts when the
+// heartbeats stop coming.
+
+// heartbeatStatus is what each heartbeat says about the server.
+type heartbeatStatus struct {
+	// stations online and offline.
+	Stations int `json:"stations"`
+	Offline  int `json:"offline"`
+	// alerts open, and how many of those are acknowledged.
+	Alerts int       `json:"alerts"`
+	Acked  int       `json:"acked"`
+	Time   time.Time `json:"time"`
+}
+
+// heartbeat posts the server's status to a URL.
+type heartbeat struct {
+	url    string
+	client *http.Client
+}
+
+func newHeartbeat(url string) *heartbeat {
+	return &heartbeat{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (h *heartbeat) post(status heartbeatStatus) error {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("monitor answered %s", resp.Status)
+	}
+	return nil
+}
+
+// status sums up the server for a heartbeat.
+func (s *Server) status() heartbeatStatus {
+	hs := heartbeatStatus{Time: s.Clock.Now()}
+
+	s.stationsM.RLock()
+	for _, station := range s.stations {
+		if !station.virtual {
+			hs.Stations++
+		}
+	}
+	hs.Offline = len(s.lastSeen)
+	s.stationsM.RUnlock()
+
+	s.alerts.m.Lock()
+	hs.Alerts = len(s.alerts.open)
+	hs.Acked = len(s.alerts.list("acked"))
+	s.alerts.m.Unlock()
+
+	return hs
+}
+
+// scheduleHeartbeats sends a heartbeat every interval.
+func (s *Server) scheduleHeartbeats(every time.Duration) {
+	s.Clock.AfterFunc(every, func() {
+		status := s.status()
+		// the monitor may be slow or unreachable, which mustn't hold up the
+		// clock.
+		go func() {
+			if err := s.heartbeat.post(status); err != nil {
+				s.log.Errorf("couldn't send heartbeat to %s: %v", s.heartbeat.url, err)
+			}
+		}()
+		s.scheduleHeartbeats(every)
+	})
+}
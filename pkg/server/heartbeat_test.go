@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestHeartbeat(t *testing.T) {
+	beats := make(chan heartbeatStatus, 10)
+	monitor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hs heartbeatStatus
+		if err := json.NewDecoder(r.Body).Decode(&hs); err != nil {
+			t.Error(err)
+		}
+		beats <- hs
+	}))
+	defer monitor.Close()
+
+	mock := clock.NewMock()
+	server := New(nil, 4, mock, TrustPlaintext(), WithHeartbeat(monitor.URL, time.Minute))
+
+	if _, err := server.handleRegister(context.Background(), &clientConn{}, "1", "water", "source"); err != nil {
+		t.Fatal(err)
+	}
+	server.raise("read_level", "slo.burn", "water", "read_level is burning")
+	server.raise("watchdog.gc", "watchdog.gc", "", "gc paused for 1s")
+	if _, err := server.handleAckAlert(context.Background(), &clientConn{}, "2", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.Add(time.Minute)
+	select {
+	case hs := <-beats:
+		if hs.Stations != 1 || hs.Offline != 0 || hs.Alerts != 2 || hs.Acked != 1 || !hs.Time.Equal(mock.Now()) {
+			t.Fatalf("unexpected heartbeat %+v", hs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a heartbeat")
+	}
+}
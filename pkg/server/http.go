@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// stationJSON is how a station is represented in the HTTP API.
+type stationJSON struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Location *Location `json:"location,omitempty"`
+
+	// what the station's tagged with, by key.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// how the station falls short of its type, if at all.
+	Deviations []string `json:"deviations,omitempty"`
+
+	// the firmware the station runs, and the latest for its type if it's
+	// older than that.
+	Firmware       string `json:"firmware,omitempty"`
+	LatestFirmware string `json:"latest_firmware,omitempty"`
+
+	Health int `json:"health"`
+}
+
+// alertJSON is how an open alert is represented in the HTTP API.
+type alertJSON struct {
+	ID      int       `json:"id"`
+	Kind    string    `json:"kind"`
+	Station string    `json:"station,omitempty"`
+	Message string    `json:"message"`
+	Raised  time.Time `json:"raised"`
+
+	// who acknowledged the alert, if anyone has.
+	Owner string     `json:"owner,omitempty"`
+	Acked *time.Time `json:"acked,omitempty"`
+	Note  string     `json:"note,omitempty"`
+}
+
+// HTTPHandler returns a JSON API over the server's state, for dashboards and
+// other tooling that would rather not speak the line protocol, which also
+// takes payloads from ingest sources.
+func (s *Server) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/stations", s.httpAuthorized("LIST", s.httpStations))
+	mux.HandleFunc("/api/alerts", s.httpAuthorized("ALERTS", s.httpAlerts))
+	mux.HandleFunc("/metrics", s.httpAuthorized("METRICS", s.httpMetrics))
+	mux.HandleFunc("/ws", s.httpWebSocket)
+	mux.HandleFunc("/api/ingest/", s.httpAuthorized("METRIC", s.httpIngest))
+	return mux
+}
+
+// httpAuthorized only serves requests whose certificate's role allows cmd,
+// which the route stands for, when there are roles.
+func (s *Server) httpAuthorized(cmd string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.authorizeRole(r.TLS == nil && s.trustPlaintext, httpRole(s.roles, r), cmd); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// httpRole returns the role of the certificate a request was made with, if
+// any.
+func httpRole(roles Roles, r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return roles.role("", nil)
+	}
+	subject := r.TLS.PeerCertificates[0].Subject
+	return roles.role(subject.CommonName, subject.OrganizationalUnit)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.Errorf("couldn't write http response: %v", err)
+	}
+}
+
+// GET /api/stations
+func (s *Server) httpStations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	stations := make([]stationJSON, 0, len(s.stations))
+	for name, station := range s.stations {
+		sj := stationJSON{Name: name, Type: station.tipe, Tags: station.tags, Deviations: s.deviations(station), Firmware: station.firmware}
+		sj.LatestFirmware, _ = s.outdated(station)
+		sj.Health, _ = s.health(name, station)
+		if l, ok := s.location(name, station); ok {
+			sj.Location = &l
+		}
+		stations = append(stations, sj)
+	}
+	sort.Slice(stations, func(i, j int) bool { return stations[i].Name < stations[j].Name })
+
+	s.writeJSON(w, stations)
+}
+
+// GET /api/alerts?state=open|acked
+func (s *Server) httpAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	if state != "" && state != "open" && state != "acked" {
+		http.Error(w, "unknown alert state "+state, http.StatusBadRequest)
+		return
+	}
+
+	s.alerts.m.Lock()
+	defer s.alerts.m.Unlock()
+
+	alerts := []alertJSON{}
+	for _, al := range s.alerts.list(state) {
+		aj := alertJSON{ID: al.id, Kind: al.kind, Station: al.station, Message: al.message, Raised: al.raised}
+		if al.owner != "" {
+			acked := al.acked
+			aj.Owner, aj.Acked, aj.Note = al.owner, &acked, al.note
+		}
+		alerts = append(alerts, aj)
+	}
+
+	s.writeJSON(w, alerts)
+}
+
+// GET /metrics, in Prometheus' text exposition format.
+func (s *Server) httpMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.writeLatest(w)
+	s.writeInternals(w)
+	s.runStats.writePrometheus(w)
+	s.commandStats.writePrometheus(w)
+	s.writeHealth(w)
+	if s.cache != nil {
+		s.cache.writePrometheus(w)
+	}
+	if s.catchUp != nil {
+		s.catchUp.writePrometheus(w)
+	}
+	if s.rateLimit != nil {
+		s.rateLimit.writePrometheus(w)
+	}
+	for _, n := range s.notifiers {
+		if wh, ok := n.(*Webhook); ok {
+			wh.writePrometheus(w)
+		}
+	}
+}
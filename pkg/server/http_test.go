@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestHTTPStations(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock, WithLocations(map[string]Location{
+		"jasmine": {Lat: 1, Lon: 2},
+	}))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(station, "1 REGISTER water source location=45.5,-122.6", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	plant, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// configured locations win over reported ones.
+	if err := sendExpect(plant, "2 REGISTER jasmine plant location=3,4", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/stations", nil))
+
+	expected := `[{"name":"jasmine","type":"plant","location":{"lat":1,"lon":2},"health":100},` +
+		`{"name":"water","type":"source","location":{"lat":45.5,"lon":-122.6},"health":100}]`
+	if got := strings.TrimSpace(rec.Body.String()); got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestHTTPMetricsRunStats(t *testing.T) {
+	server := New(nil, 4, clock.NewMock())
+	server.runStats.started("water", "read")
+	server.runStats.finished("water", "read", 1500*time.Millisecond, false)
+
+	rec := httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range []string{
+		`drops_runs_total{station="water",function="read"} 1`,
+		`drops_run_errors_total{station="water",function="read"} 1`,
+		`drops_run_latency_seconds{station="water",function="read",quantile="0.5"} 1.5`,
+		`drops_run_latency_seconds_count{station="water",function="read"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("expected %s in:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestHTTPMetricsLatest(t *testing.T) {
+	server := New(nil, 4, clock.NewMock())
+
+	conn := &clientConn{}
+	if _, err := server.handleRegister(context.Background(), conn, "1", "water", "source"); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"level", "1"}, {"level", "2.5"}, {"pressure", "40"}} {
+		if _, err := server.handleMetric(context.Background(), conn, "2", args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.conns[conn] = struct{}{}
+
+	// just /metrics, for Prometheus.
+	handler := server.MetricsHandler()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range []string{
+		`drops_metric{station="water",metric="level"} 2.5`,
+		`drops_metric{station="water",metric="pressure"} 40`,
+		`drops_connections 1`,
+		`drops_stations{state="online"} 1`,
+		`drops_runs_pending 0`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("expected %s in:\n%s", line, rec.Body.String())
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/stations", nil))
+	if rec.Code != 404 {
+		t.Errorf("expected the API to be left out, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import "time"
+
+// A client that connects and then says nothing holds on to a goroutine and
+// a file descriptor for as long as it likes. With idle timeouts, a
+// connection that sends nothing for long enough is closed. Stations get a
+// timeout of their own, since they're expected to sit quietly between
+// points, and clients following a stream (LOGS -f, SUBSCRIBE) aren't idle,
+// they're waiting on the server.
+
+// idleTimeout returns how long a connection can go without sending
+// anything, or 0 if it can go quiet for as long as it likes.
+func (s *Server) idleTimeout(conn *clientConn) time.Duration {
+	switch {
+	case len(conn.streams) > 0:
+		return 0
+	case conn.name != "":
+		return s.stationIdle
+	default:
+		return s.clientIdle
+	}
+}
+
+// extendDeadline gives a connection until its idle timeout runs out to send
+// its next line, unless the server is shutting down. Deadlines are on the
+// wall clock, whatever clock the server runs on, since the network doesn't
+// know about simulated ones.
+func (s *Server) extendDeadline(conn *clientConn) {
+	if s.clientIdle == 0 && s.stationIdle == 0 {
+		return
+	}
+
+	var deadline time.Time
+	if timeout := s.idleTimeout(conn); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	// Shutdown sets its own deadline once it's closing, which mustn't be
+	// pushed back.
+	s.connsM.Lock()
+	defer s.connsM.Unlock()
+	if !s.closing {
+		conn.SetReadDeadline(deadline)
+	}
+}
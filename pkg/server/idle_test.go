@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock(), WithIdleTimeout(100*time.Millisecond, 0))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := sendExpect(client, "1 PING", "1 PONG"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client is disconnected for going quiet.
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bufio.NewReader(client).ReadString('\n'); err == nil {
+		t.Fatal("expected the idle client to be disconnected")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("expected the idle client to be disconnected, but it's still connected")
+	}
+
+	// stations have no timeout here.
+	if err := sendExpect(station, "2 PING", "2 PONG"); err != nil {
+		t.Fatal(err)
+	}
+}
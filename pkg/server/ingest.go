@@ -0,0 +1,318 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Not every source of data worth watching is a station: weather services,
+// SCADA exports and the like can push JSON to a webhook, but won't speak
+// the line protocol. The HTTP API takes their payloads at
+// /api/ingest/[source], and maps values in them to the metrics of virtual
+// stations, so they're kept, queried and alerted on alongside stations' own.
+
+// ingestType is the type ingest stations are listed with, unless they're
+// given one.
+const ingestType = "ingest"
+
+// maxIngestBody is the largest payload a source can push at once.
+const maxIngestBody = 1 << 20
+
+// IngestSource is a third-party system pushing JSON to the HTTP API.
+type IngestSource struct {
+	Name string
+	// Token is a secret the source has to send as a bearer token, besides
+	// the client certificate the HTTP API always asks for.
+	Token    string
+	Stations []IngestStation
+}
+
+// IngestStation maps a source's payloads to a virtual station's metrics.
+type IngestStation struct {
+	Station string
+	Type    string
+	// Each is the path of an array in the payload, each element of which is
+	// mapped like a payload of its own, for sources pushing batches. Empty
+	// maps the payload itself.
+	Each string
+	// TS is the path of the points' time, as unix seconds or RFC 3339.
+	// Empty timestamps them as they arrive.
+	TS string
+	// Metrics are the path of each metric's value, by metric.
+	Metrics map[string]string
+}
+
+// ingestFile is how sources are written in an -ingest file.
+type ingestFile struct {
+	Sources []struct {
+		Name     string `json:"name"`
+		Token    string `json:"token"`
+		Stations []struct {
+			Station string            `json:"station"`
+			Type    string            `json:"type"`
+			Each    string            `json:"each"`
+			TS      string            `json:"ts"`
+			Metrics map[string]string `json:"metrics"`
+		} `json:"stations"`
+	} `json:"sources"`
+}
+
+// ParseIngest reads a JSON object of the sources pushing to the HTTP API,
+// e.g.
+//
+//	{"sources": [
+//		{"name": "weather", "token": "s3cret", "stations": [
+//			{"station": "weather", "ts": "dt", "metrics": {
+//				"air.temp": "main.temp", "air.humidity": "main.humidity"}}]}]}
+//
+// Every source needs a token. Paths are the keys leading to a value,
+// separated by dots, with array elements picked by index, like
+// readings.0.value.
+func ParseIngest(r io.Reader) ([]IngestSource, error) {
+	var file ingestFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, errors.Wrap(err, "bad ingest sources")
+	}
+
+	var sources []IngestSource
+	seen := map[string]bool{}
+	for _, src := range file.Sources {
+		if src.Name == "" || strings.ContainsAny(src.Name, "/ ") {
+			return nil, errors.Errorf("bad ingest source name %q", src.Name)
+		}
+		if src.Token == "" {
+			return nil, errors.Errorf("ingest source %s has no token", src.Name)
+		}
+
+		source := IngestSource{Name: src.Name, Token: src.Token}
+		for _, st := range src.Stations {
+			if st.Station == "" || strings.ContainsAny(st.Station, " =*") {
+				return nil, errors.Errorf("bad ingest station name %q", st.Station)
+			}
+			if seen[st.Station] {
+				return nil, errors.Errorf("ingest station %s is mapped twice", st.Station)
+			}
+			seen[st.Station] = true
+
+			if len(st.Metrics) == 0 {
+				return nil, errors.Errorf("ingest station %s has no metrics", st.Station)
+			}
+			for name, path := range st.Metrics {
+				if err := validateMetricName(name); err != nil {
+					return nil, errors.Wrapf(err, "ingest station %s", st.Station)
+				}
+				if path == "" {
+					return nil, errors.Errorf("ingest station %s has no path for %s", st.Station, name)
+				}
+			}
+
+			tipe := st.Type
+			if tipe == "" {
+				tipe = ingestType
+			}
+			source.Stations = append(source.Stations, IngestStation{
+				Station: st.Station,
+				Type:    tipe,
+				Each:    st.Each,
+				TS:      st.TS,
+				Metrics: st.Metrics,
+			})
+		}
+		if len(source.Stations) == 0 {
+			return nil, errors.Errorf("ingest source %s has no stations", src.Name)
+		}
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
+
+// lookupJSON returns the value at a path in a decoded payload.
+func lookupJSON(v interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = t[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			v = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// ingestValue reads a metric's value, which sources may send as a number, a
+// string holding one, or a boolean.
+func ingestValue(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case string:
+		return strconv.ParseFloat(t, 64)
+	case bool:
+		if t {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, errors.Errorf("%v isn't a number", v)
+}
+
+// ingestTime reads a point's time, as unix seconds or RFC 3339.
+func ingestTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case float64:
+		return time.Unix(0, int64(t*float64(time.Second))), nil
+	case string:
+		if ts, err := time.Parse(time.RFC3339, t); err == nil {
+			return ts, nil
+		}
+		secs, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return time.Time{}, errors.Errorf("bad timestamp %q", t)
+		}
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+	return time.Time{}, errors.Errorf("bad timestamp %v", v)
+}
+
+// ingestPoint is a point mapped from a payload.
+type ingestPoint struct {
+	station string
+	name    string
+	m       metric
+}
+
+// points maps a payload to the station's points. Metrics missing from the
+// payload are left out, as sources often only send what changed.
+func (st IngestStation) points(payload interface{}, now time.Time) ([]ingestPoint, error) {
+	items := []interface{}{payload}
+	if st.Each != "" {
+		v, _ := lookupJSON(payload, st.Each)
+		arr, ok := v.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("%s: no array at %s", st.Station, st.Each)
+		}
+		items = arr
+	}
+
+	var points []ingestPoint
+	for _, item := range items {
+		ts := now
+		if st.TS != "" {
+			v, ok := lookupJSON(item, st.TS)
+			if !ok {
+				return nil, errors.Errorf("%s: no timestamp at %s", st.Station, st.TS)
+			}
+			var err error
+			if ts, err = ingestTime(v); err != nil {
+				return nil, errors.Wrap(err, st.Station)
+			}
+			if ts.After(now.Add(maxMetricSkew)) {
+				return nil, errors.Errorf("%s: timestamp %v is in the future", st.Station, v)
+			}
+		}
+
+		for name, path := range st.Metrics {
+			v, ok := lookupJSON(item, path)
+			if !ok || v == nil {
+				continue
+			}
+			value, err := ingestValue(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s: %s at %s", st.Station, name, path)
+			}
+			points = append(points, ingestPoint{station: st.Station, name: name, m: metric{ts: ts, value: value}})
+		}
+	}
+	return points, nil
+}
+
+// ingest keeps points mapped from a payload like METRIC keeps a station's,
+// and returns how many were new. Like other virtual stations' points,
+// they're not persisted.
+func (s *Server) ingest(points []ingestPoint) int {
+	now := s.Clock.Now()
+
+	var kept []ingestPoint
+	s.stationsM.RLock()
+	for _, p := range points {
+		st, ok := s.stations[p.station]
+		if !ok {
+			continue
+		}
+		st.m.Lock()
+		st.heard = now
+		if s.keep(p.station, st, p.name, p.m) {
+			kept = append(kept, p)
+		}
+		st.m.Unlock()
+	}
+	s.stationsM.RUnlock()
+
+	for _, p := range kept {
+		s.updateVirtual(p.station, p.name)
+		s.checkThresholds(p.station, p.name, p.m.value)
+	}
+	return len(kept)
+}
+
+// POST /api/ingest/[source]
+func (s *Server) httpIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	src, ok := s.ingestSources[strings.TrimPrefix(r.URL.Path, "/api/ingest/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(src.Token)) != 1 {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+
+	var payload interface{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxIngestBody)).Decode(&payload); err != nil {
+		http.Error(w, "bad payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := s.Clock.Now()
+	var points []ingestPoint
+	for _, st := range src.Stations {
+		ps, err := st.points(payload, now)
+		if err != nil {
+			s.log.Errorf("rejecting payload from ingest source %s: %v", src.Name, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		points = append(points, ps...)
+	}
+	if len(points) == 0 {
+		http.Error(w, "no metrics in the payload", http.StatusBadRequest)
+		return
+	}
+
+	s.writeJSON(w, struct {
+		Kept int `json:"kept"`
+	}{s.ingest(points)})
+}
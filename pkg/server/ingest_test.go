@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestParseIngest(t *testing.T) {
+	sources, err := ParseIngest(strings.NewReader(`{"sources": [
+		{"name": "weather", "token": "s3cret", "stations": [
+			{"station": "weather", "ts": "dt", "metrics": {"air.temp": "main.temp"}}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || sources[0].Token != "s3cret" || len(sources[0].Stations) != 1 || sources[0].Stations[0].Type != ingestType {
+		t.Fatalf("unexpected sources %+v", sources)
+	}
+
+	for _, bad := range []string{
+		`{"sources": [{"name": "weather/api", "stations": [{"station": "weather", "metrics": {"temp": "main.temp"}}]}]}`,
+		`{"sources": [{"name": "weather", "token": "s3cret"}]}`,
+		`{"sources": [{"name": "weather", "stations": [{"station": "weather", "metrics": {"temp": "main.temp"}}]}]}`,
+		`{"sources": [{"name": "weather", "stations": [{"station": "weather *", "metrics": {"temp": "main.temp"}}]}]}`,
+		`{"sources": [{"name": "weather", "stations": [{"station": "weather"}]}]}`,
+		`{"sources": [{"name": "weather", "stations": [{"station": "weather", "metrics": {"temp": ""}}]}]}`,
+		`{"sources": [{"name": "weather", "stations": [{"station": "weather", "metrics": {"temp": "a"}}, {"station": "weather", "metrics": {"temp": "b"}}]}]}`,
+	} {
+		if _, err := ParseIngest(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+func TestIngest(t *testing.T) {
+	sources, err := ParseIngest(strings.NewReader(`{"sources": [
+		{"name": "weather", "token": "s3cret", "stations": [
+			{"station": "weather", "ts": "dt", "metrics": {"air.temp": "main.temp", "air.humidity": "main.humidity"}}]},
+		{"name": "scada", "token": "l3tmein", "stations": [
+			{"station": "plant", "type": "scada", "each": "readings", "ts": "time",
+			 "metrics": {"flow": "flow_m3h", "valve": "valve.open"}}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := clock.NewMock()
+	mock.Set(time.Unix(3600, 0))
+	server := New(nil, 4, mock, WithIngest(sources...))
+	handler := server.HTTPHandler()
+
+	for _, tt := range []struct {
+		path, token, body string
+		code              int
+		response          string
+	}{
+		{"/api/ingest/weather", "s3cret", `{"dt": 3000, "main": {"temp": 21.5, "humidity": "40"}}`, http.StatusOK, `{"kept":2}`},
+		// a point already kept isn't new.
+		{"/api/ingest/weather", "s3cret", `{"dt": 3000, "main": {"temp": 21.5}}`, http.StatusOK, `{"kept":0}`},
+		{"/api/ingest/weather", "wrong", `{"dt": 3000, "main": {"temp": 21.5}}`, http.StatusUnauthorized, ""},
+		{"/api/ingest/weather", "", `{"dt": 3000, "main": {"temp": 21.5}}`, http.StatusUnauthorized, ""},
+		{"/api/ingest/weather", "s3cret", `{"dt": 3000, "main": {"temp": "warm"}}`, http.StatusBadRequest, ""},
+		{"/api/ingest/weather", "s3cret", `{"dt": 9000, "main": {"temp": 21.5}}`, http.StatusBadRequest, ""},
+		{"/api/ingest/weather", "s3cret", `{"dt": 3000}`, http.StatusBadRequest, ""},
+		{"/api/ingest/nothing", "", `{}`, http.StatusNotFound, ""},
+		{"/api/ingest/scada", "l3tmein", `{"readings": [
+			{"time": "1970-01-01T00:50:00Z", "flow_m3h": 12, "valve": {"open": true}},
+			{"time": "3060", "flow_m3h": 13}]}`, http.StatusOK, `{"kept":3}`},
+	} {
+		r := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != tt.code {
+			t.Fatalf("%s %s: expected %d, got %d %s", tt.path, tt.body, tt.code, rec.Code, rec.Body)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); tt.response != "" && got != tt.response {
+			t.Fatalf("%s %s: expected %s, got %s", tt.path, tt.body, tt.response, got)
+		}
+	}
+
+	weather := server.stations["weather"]
+	if ms := weather.metrics["air.humidity"]; len(ms) != 1 || ms[0].value != 40 || ms[0].ts.Unix() != 3000 {
+		t.Fatalf("unexpected humidity %v", ms)
+	}
+	plant := server.stations["plant"]
+	if plant.tipe != "scada" {
+		t.Fatalf("expected plant to be a scada station, got %s", plant.tipe)
+	}
+	if ms := plant.metrics["flow"]; len(ms) != 2 || ms[0].value != 12 || ms[1].ts.Unix() != 3060 {
+		t.Fatalf("unexpected flow %v", ms)
+	}
+	if ms := plant.metrics["valve"]; len(ms) != 1 || ms[0].value != 1 {
+		t.Fatalf("unexpected valve %v", ms)
+	}
+}
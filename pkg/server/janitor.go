@@ -0,0 +1,143 @@
+package server
+
+import (
+	"time"
+)
+
+// The janitor reclaims what the server keeps about stations after they go
+// offline: their logs, run statistics, LOADed state and persisted history.
+// Without it, every station that ever registered stays in memory forever.
+
+// scheduleSweeps runs a sweep every interval.
+func (s *Server) scheduleSweeps(every time.Duration) {
+	s.Clock.AfterFunc(every, func() {
+		s.sweep(every)
+		s.scheduleSweeps(every)
+	})
+}
+
+// sweep reclaims stations that have been offline for longer than
+// reclaimAfter, and shrinks the buffers of series that haven't been written
+// to in the last interval.
+func (s *Server) sweep(interval time.Duration) {
+	now := s.Clock.Now()
+	names := s.knownStations()
+
+	s.stationsM.Lock()
+	var idle []string
+	for _, name := range names {
+		if _, online := s.stations[name]; online {
+			continue
+		}
+
+		// stations we've never seen go offline, like ones in the point log
+		// after a restart, are idle from when we first notice them.
+		seen, ok := s.lastSeen[name]
+		if !ok {
+			s.lastSeen[name] = now
+			continue
+		}
+
+		if now.Sub(seen) >= s.reclaimAfter {
+			idle = append(idle, name)
+			delete(s.lastSeen, name)
+			delete(s.restored, name)
+		}
+	}
+
+	for _, station := range s.stations {
+		station.m.Lock()
+		for name, ms := range station.metrics {
+			if len(ms) > 0 && cap(ms) > len(ms) && now.Sub(ms[len(ms)-1].ts) >= interval {
+				// series are copy-on-write, so readers keep the old one.
+				station.metrics[name] = append([]metric(nil), ms...)
+			}
+		}
+		station.m.Unlock()
+	}
+	s.stationsM.Unlock()
+
+	for _, name := range idle {
+		s.reclaim(name)
+		s.event("reclaim", name, "offline for %s", s.reclaimAfter)
+	}
+
+	if s.cache != nil {
+		s.cache.prune()
+	}
+}
+
+// knownStations returns the name of every station the server keeps anything
+// about outside of the connected stations themselves.
+func (s *Server) knownStations() []string {
+	seen := map[string]bool{}
+
+	s.stationsM.RLock()
+	for name := range s.lastSeen {
+		seen[name] = true
+	}
+	for name := range s.restored {
+		seen[name] = true
+	}
+	s.stationsM.RUnlock()
+
+	s.logs.m.Lock()
+	for name := range s.logs.logs {
+		seen[name] = true
+	}
+	s.logs.m.Unlock()
+
+	s.notes.m.Lock()
+	for name := range s.notes.notes {
+		seen[name] = true
+	}
+	s.notes.m.Unlock()
+
+	s.runStats.m.Lock()
+	for name := range s.runStats.stations {
+		seen[name] = true
+	}
+	s.runStats.m.Unlock()
+
+	if s.store != nil {
+		for _, name := range s.storedStations() {
+			seen[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	return names
+}
+
+// reclaim forgets everything kept by station name outside of the station
+// itself.
+func (s *Server) reclaim(name string) {
+	s.logs.m.Lock()
+	if sl, ok := s.logs.logs[name]; ok {
+		if len(sl.followers) == 0 {
+			delete(s.logs.logs, name)
+		} else {
+			// keep following the station's next lines, if it comes back.
+			sl.entries = nil
+		}
+	}
+	s.logs.m.Unlock()
+
+	s.notes.forget(name)
+
+	s.runStats.m.Lock()
+	delete(s.runStats.stations, name)
+	s.runStats.m.Unlock()
+
+	s.quality.forget(name)
+
+	if s.store != nil {
+		s.prune(name, "")
+	}
+	if s.export != nil {
+		s.export.forget(name, "")
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestJanitorReclaimsIdleStations(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	server := New(listener, 4, mock, WithJanitor(time.Hour, 24*time.Hour))
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	water, jasmine, client := dial(), dial(), dial()
+	defer jasmine.Close()
+	defer client.Close()
+
+	for _, station := range []struct {
+		conn net.Conn
+		name string
+	}{{water, "water"}, {jasmine, "jasmine"}} {
+		for _, in := range []interaction{
+			{"1 REGISTER " + station.name + " source", "1 ACK"},
+			{"2 LOG info hello", "2 ACK"},
+		} {
+			if err := sendExpect(station.conn, in.send, in.expect); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := doRun(client, water, mock, "r1", "read", time.Second, "DONE"); err != nil {
+		t.Fatal(err)
+	}
+
+	water.Close()
+	for {
+		server.stationsM.RLock()
+		_, offline := server.lastSeen["water"]
+		server.stationsM.RUnlock()
+		if offline {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// water hasn't been gone long enough yet.
+	server.sweep(time.Minute)
+
+	reader := bufio.NewReader(client)
+	fmt.Fprintf(client, "1 LOGS water\n")
+	if err := expectLines(reader, "1 LOG water 0 info hello", "1 LOGS water 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.Add(time.Hour)
+	server.sweep(time.Minute)
+
+	fmt.Fprintf(client, "2 LOGS water\n")
+	if err := expectLines(reader, "2 ERR"); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(client, "3 LOGS jasmine\n")
+	if err := expectLines(reader, "3 LOG jasmine 0 info hello", "3 LOGS jasmine 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.runStats.m.Lock()
+	_, kept := server.runStats.stations["water"]
+	server.runStats.m.Unlock()
+	if kept {
+		t.Error("expected water's run statistics to be reclaimed")
+	}
+}
+
+func TestJanitorShrinksIdleSeries(t *testing.T) {
+	mock := clock.NewMock()
+	server := New(nil, 64, mock)
+
+	conn := &clientConn{}
+	if _, err := server.handleRegister(context.Background(), conn, "1", "water", "source"); err != nil {
+		t.Fatal(err)
+	}
+
+	station := server.stations["water"]
+	station.metrics["level"] = append(make([]metric, 0, 64), metric{ts: mock.Now(), value: 1})
+	station.metrics["pressure"] = append(make([]metric, 0, 64), metric{ts: mock.Now().Add(time.Hour), value: 1})
+
+	mock.Add(time.Hour)
+	server.sweep(time.Minute)
+
+	if c := cap(station.metrics["level"]); c != 1 {
+		t.Errorf("expected idle series to be shrunk, got capacity %d", c)
+	}
+	if c := cap(station.metrics["pressure"]); c != 64 {
+		t.Errorf("expected active series to be left alone, got capacity %d", c)
+	}
+}
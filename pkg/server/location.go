@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Location is where a station physically is, in decimal degrees.
+type Location struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+func (l Location) String() string {
+	return fmt.Sprintf("%.6f,%.6f", l.Lat, l.Lon)
+}
+
+// ParseLocation reads a location in [lat],[lon] form.
+func ParseLocation(s string) (Location, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return Location{}, errors.Errorf("location %q is not [lat],[lon]", s)
+	}
+
+	lat, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return Location{}, errors.Wrapf(err, "bad latitude in %q", s)
+	}
+
+	lon, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return Location{}, errors.Wrapf(err, "bad longitude in %q", s)
+	}
+
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return Location{}, errors.Errorf("location %q is out of range", s)
+	}
+
+	return Location{Lat: lat, Lon: lon}, nil
+}
+
+// location returns where a station is, preferring the server's configured
+// locations over whatever the station reported about itself.
+func (s *Server) location(name string, station *Station) (Location, bool) {
+	if l, ok := s.locations[name]; ok {
+		return l, true
+	}
+
+	if station.location != nil {
+		return *station.location, true
+	}
+
+	// fall back to where a LOADed dump said it was.
+	if r, ok := s.restored[name]; ok && r.location != nil {
+		return *r.location, true
+	}
+
+	return Location{}, false
+}
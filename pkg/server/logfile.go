@@ -0,0 +1,217 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+)
+
+// Many drops hosts are small boxes without logrotate, so the server can
+// rotate its own log file: when it gets too big, or every so often, the file
+// is renamed with the time it was rotated at, optionally gzipped, and only
+// the most recent ones are kept.
+
+// LogRotation is when and how a LogFile is rotated.
+type LogRotation struct {
+	// MaxSize is how big the file can get, in bytes (0 for no limit).
+	MaxSize int64
+	// Every is how often the file is rotated regardless of its size (0 to
+	// only rotate by size).
+	Every time.Duration
+	// Keep is how many rotated files are kept (0 to keep them all).
+	Keep int
+	// Compress gzips rotated files.
+	Compress bool
+}
+
+// LogFile is a log file that rotates itself.
+type LogFile struct {
+	path     string
+	rotation LogRotation
+	clock    clock.Clock
+	log      logTo
+
+	m    sync.Mutex
+	f    *os.File
+	size int64
+	// when the file is next due to be rotated, if it's rotated by time.
+	due time.Time
+
+	// rotated files are compressed and pruned in the background, one
+	// rotation at a time.
+	tidying sync.WaitGroup
+	tidyM   sync.Mutex
+}
+
+// OpenLogFile opens (or creates) a log file to append to, and rotates it as
+// it's written to.
+func OpenLogFile(path string, rotation LogRotation, clock clock.Clock) (*LogFile, error) {
+	l := &LogFile{path: path, rotation: rotation, clock: clock}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetLogger logs failures to compress and prune rotated files to l, rather
+// than the standard logger.
+func (l *LogFile) SetLogger(lg Logger) {
+	l.log.set(lg)
+}
+
+// open opens the file and works out when it's due. Must be called with m
+// held, or before the file is shared.
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "opening log file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "opening log file")
+	}
+
+	l.f, l.size = f, info.Size()
+	if l.rotation.Every > 0 {
+		l.due = l.clock.Now().Truncate(l.rotation.Every).Add(l.rotation.Every)
+	}
+	return nil
+}
+
+// Write appends p to the file, rotating it first if it's due or p would
+// make it too big.
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.f == nil {
+		return 0, errors.New("log file is closed")
+	}
+
+	tooBig := l.rotation.MaxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.rotation.MaxSize
+	due := !l.due.IsZero() && !l.clock.Now().Before(l.due)
+	if tooBig || due {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one. Must be called
+// with m held.
+func (l *LogFile) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return errors.Wrap(err, "closing log file")
+	}
+
+	rotated := l.path + "." + l.clock.Now().UTC().Format("20060102T150405.000Z")
+	if err := os.Rename(l.path, rotated); err != nil {
+		return errors.Wrap(err, "rotating log file")
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	// the server's own logs may be what's being written, so anything that
+	// might log happens without m held.
+	l.tidying.Add(1)
+	go func() {
+		defer l.tidying.Done()
+
+		l.tidyM.Lock()
+		defer l.tidyM.Unlock()
+
+		if l.rotation.Compress {
+			if err := compressFile(rotated); err != nil {
+				l.log.Errorf("couldn't compress %s: %v", rotated, err)
+			}
+		}
+		l.prune()
+	}()
+	return nil
+}
+
+// compressFile gzips a file, replacing it with path.gz.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// prune removes the oldest rotated files beyond the ones to keep.
+func (l *LogFile) prune() {
+	if l.rotation.Keep <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		l.log.Errorf("couldn't list rotated log files: %v", err)
+		return
+	}
+
+	// the same file can briefly exist both plain and compressed.
+	var rotated []string
+	for _, m := range matches {
+		if _, err := os.Stat(m + ".gz"); err == nil && !strings.HasSuffix(m, ".gz") {
+			continue
+		}
+		rotated = append(rotated, m)
+	}
+
+	// rotation times sort like strings.
+	sort.Strings(rotated)
+	for _, old := range rotated[:max(0, len(rotated)-l.rotation.Keep)] {
+		if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+			l.log.Errorf("couldn't remove %s: %v", old, err)
+		}
+	}
+}
+
+// Close closes the file, once rotated files are done being compressed.
+func (l *LogFile) Close() error {
+	l.tidying.Wait()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestLogFileRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drops.log")
+	mock := clock.NewMock()
+
+	l, err := OpenLogFile(path, LogRotation{MaxSize: 9, Keep: 2, Compress: true}, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		mock.Add(time.Second)
+		if _, err := l.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "five\n" {
+		t.Fatalf("expected the current file to have the last line, got %q", current)
+	}
+
+	// one\ntwo\n, three\n and four\n were rotated, but only the last two
+	// are kept.
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("expected 2 rotated files, got %v", rotated)
+	}
+
+	var contents []string
+	for _, r := range rotated {
+		if !strings.HasSuffix(r, ".gz") {
+			t.Fatalf("expected %s to be compressed", r)
+		}
+		f, err := os.Open(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		contents = append(contents, string(b))
+	}
+	if strings.Join(contents, "") != "three\nfour\n" {
+		t.Fatalf("expected the newest rotated files to be kept, got %q", contents)
+	}
+}
+
+func TestLogFileRotatesByTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drops.log")
+	mock := clock.NewMock()
+
+	l, err := OpenLogFile(path, LogRotation{Every: time.Hour}, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	write := func(line string) {
+		if _, err := l.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("one\n")
+	mock.Add(30 * time.Minute)
+	write("two\n")
+	mock.Add(30 * time.Minute)
+	write("three\n")
+
+	l.tidying.Wait()
+	rotated, err := os.ReadFile(path + ".19700101T010000.000Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rotated) != "one\ntwo\n" {
+		t.Fatalf("expected the first hour's lines, got %q", rotated)
+	}
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "three\n" {
+		t.Fatalf("expected the second hour's lines, got %q", current)
+	}
+}
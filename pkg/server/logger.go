@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Logger is where the server logs what it's doing and what went wrong, so
+// that programs embedding it can send that wherever the rest of their logs
+// go (zap, slog, ...). It has to be safe to use from many goroutines at once.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// StdLogger logs to a logger from the standard library's log package.
+type StdLogger struct {
+	*log.Logger
+}
+
+// Infof logs an informational message.
+func (l StdLogger) Infof(format string, args ...interface{}) {
+	l.Output(2, "INFO: "+fmt.Sprintf(format, args...))
+}
+
+// Errorf logs an error.
+func (l StdLogger) Errorf(format string, args ...interface{}) {
+	l.Output(2, "ERROR: "+fmt.Sprintf(format, args...))
+}
+
+// logTo is a Logger that passes everything on to another, which can be set
+// after it's been handed out: options can come in any order, so parts of
+// the server set up before WithLogger still log to the Logger it sets. Until
+// one is set, it logs to the standard library's default logger.
+type logTo struct {
+	m sync.RWMutex
+	l Logger
+}
+
+func (t *logTo) set(l Logger) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.l = l
+}
+
+func (t *logTo) logger() Logger {
+	if t == nil {
+		return StdLogger{log.Default()}
+	}
+
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	if t.l == nil {
+		return StdLogger{log.Default()}
+	}
+	return t.l
+}
+
+func (t *logTo) Infof(format string, args ...interface{}) {
+	t.logger().Infof(format, args...)
+}
+
+func (t *logTo) Errorf(format string, args ...interface{}) {
+	t.logger().Errorf(format, args...)
+}
+
+// flush flushes the Logger, if it buffers what it logs, e.g. before the
+// server goes down.
+func (t *logTo) flush() {
+	if f, ok := t.logger().(interface{ Flush() }); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+// recordingLogger keeps what's logged to it.
+type recordingLogger struct {
+	m     sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.lines = append(l.lines, "I "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.lines = append(l.lines, "E "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) logged(prefix string) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWithLogger(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := &recordingLogger{}
+	// options set up before WithLogger log to it too.
+	server := New(listener, 4, clock.NewMock(), WithRateLimit(1, 1), WithLogger(logger))
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 METRIC level 1", "2 ACK"},
+		{"3 METRIC level 2", "3 ERR RATE_LIMITED"},
+		{"4 FROBNICATE", "4 ERR UNRECOGNIZED CMD"},
+	} {
+		if err := sendExpect(conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{
+		"E station water is sending points faster",
+		"E no command FROBNICATE known",
+	} {
+		if !logger.logged(want) {
+			t.Fatalf("expected %q to be logged, got %q", want, logger.lines)
+		}
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := StdLogger{log.New(&buf, "", 0)}
+	l.Infof("hello %s", "water")
+	l.Errorf("goodbye %s", "water")
+
+	if got, want := buf.String(), "INFO: hello water\nERROR: goodbye water\n"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
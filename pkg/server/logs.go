@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// logLevels are the levels a station may LOG at.
+var logLevels = map[string]bool{
+	"debug": true,
+	"info":  true,
+	"warn":  true,
+	"error": true,
+}
+
+type logEntry struct {
+	ts      time.Time
+	level   string
+	message string
+}
+
+// follower is a connection streaming a station's log with LOGS -f.
+type follower struct {
+	conn *clientConn
+	uid  string
+}
+
+// stationLog keeps a station's most recent log lines. It's kept by station
+// name rather than on the Station, so the lines leading up to a station
+// dropping off are still there to look at.
+type stationLog struct {
+	entries   []logEntry
+	followers map[*follower]struct{}
+}
+
+type stationLogs struct {
+	m     sync.Mutex
+	logs  map[string]*stationLog
+	lines int
+}
+
+func newStationLogs(lines int) *stationLogs {
+	return &stationLogs{logs: map[string]*stationLog{}, lines: lines}
+}
+
+func (l *stationLogs) get(name string) *stationLog {
+	sl, ok := l.logs[name]
+	if !ok {
+		sl = &stationLog{followers: map[*follower]struct{}{}}
+		l.logs[name] = sl
+	}
+	return sl
+}
+
+func writeLogEntry(c *clientConn, uid, name string, e logEntry) {
+	fmt.Fprintf(c, "%s LOG %s %d %s %s\n", uid, name, e.ts.Unix(), e.level, e.message)
+}
+
+// LOG cmd
+// Expected args:
+//  - [level]
+//  - [message] (may contain spaces)
+func (s *Server) handleLog(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 2 {
+		return "", argCount(args)
+	}
+
+	// client must have run REGISTER first
+	if conn.name == "" {
+		return "", errors.Errorf("client is not a station and cannot log")
+	}
+
+	entry, err := parseLogEntry(args, s.Clock.Now())
+	if err != nil {
+		return "", err
+	}
+
+	s.logs.m.Lock()
+	defer s.logs.m.Unlock()
+
+	sl := s.logs.get(conn.name)
+	sl.entries = append(sl.entries, entry)
+	if len(sl.entries) > s.logs.lines {
+		sl.entries = sl.entries[len(sl.entries)-s.logs.lines:]
+	}
+
+	for f := range sl.followers {
+		writeLogEntry(f.conn, f.uid, conn.name, entry)
+	}
+
+	return "ACK", nil
+}
+
+// parseLogEntry reads LOG's arguments into an entry.
+func parseLogEntry(args []string, now time.Time) (logEntry, error) {
+	if len(args) < 2 {
+		return logEntry{}, argCount(args)
+	}
+
+	level := args[0]
+	if !logLevels[level] {
+		return logEntry{}, badArgf(level, "unknown log level %s", level)
+	}
+
+	return logEntry{
+		ts:      now,
+		level:   level,
+		message: strings.Join(args[1:], " "),
+	}, nil
+}
+
+// LOGS cmd
+// Expected args:
+//  - [name]
+//  - -f (optional)
+//
+// Each kept line is sent as its own [uid] LOG response before the final
+// LOGS one. With -f, new lines keep coming under the same uid until the
+// client CANCELs it.
+func (s *Server) handleLogs(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", argCount(args)
+	}
+
+	name := args[0]
+	follow := false
+	if len(args) == 2 {
+		if args[1] != "-f" {
+			return "", errors.Errorf("unknown option %s", args[1])
+		}
+		follow = true
+	}
+
+	if _, ok := conn.streams[uid]; ok {
+		return "", errors.Errorf("uid %s already in use", uid)
+	}
+
+	s.logs.m.Lock()
+	defer s.logs.m.Unlock()
+
+	sl, ok := s.logs.logs[name]
+	if !ok && !follow {
+		return "", errors.Errorf("no logs from %s", name)
+	}
+	if !ok {
+		sl = s.logs.get(name)
+	}
+
+	for _, e := range sl.entries {
+		writeLogEntry(conn, uid, name, e)
+	}
+
+	if follow {
+		f := &follower{conn: conn, uid: uid}
+		sl.followers[f] = struct{}{}
+
+		conn.stream(uid, func() {
+			s.logs.m.Lock()
+			defer s.logs.m.Unlock()
+
+			delete(sl.followers, f)
+		})
+	}
+
+	return fmt.Sprintf("LOGS %s %d", name, len(sl.entries)), nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxMetricSkew is how far in the future a station's timestamps may be
+// before we decide its clock is wrong.
+const maxMetricSkew = time.Minute
+
+// insertMetric adds a point to a series kept in timestamp order, keeping at
+// most max points. Backfilled points are slotted in where they belong rather
+// than appended, and exact (ts, value) resubmissions, which happen when a
+// station retries a METRIC whose ACK it never saw, are dropped. It reports
+// whether the point was kept.
+//
+// Series are copy-on-write: the points in a returned series are never
+// changed afterwards, so readers can hold on to a series and use it without
+// a lock while new points come in. Appending only writes past the end of
+// what earlier readers can see; backfilling copies the series.
+func insertMetric(ms []metric, m metric, max int) ([]metric, bool) {
+	// find the first point after m; points with the same timestamp stay in
+	// the order they arrived.
+	i := sort.Search(len(ms), func(i int) bool { return ms[i].ts.After(m.ts) })
+
+	for j := i - 1; j >= 0 && ms[j].ts.Equal(m.ts); j-- {
+		if ms[j].value == m.value {
+			return ms, false
+		}
+	}
+
+	if i == len(ms) {
+		ms = append(ms, m)
+	} else {
+		backfilled := make([]metric, 0, len(ms)+1)
+		backfilled = append(backfilled, ms[:i]...)
+		backfilled = append(backfilled, m)
+		ms = append(backfilled, ms[i:]...)
+	}
+
+	// to conserve memory just a bit we only keep a certain number of
+	// metrics around, and the oldest go first.
+	if len(ms) > max {
+		dropped := len(ms) - max
+		ms = ms[dropped:]
+		return ms, i >= dropped
+	}
+
+	return ms, true
+}
+
+// hasMetric reports whether ms has a point with m's timestamp and value.
+func hasMetric(ms []metric, m metric) bool {
+	i := sort.Search(len(ms), func(i int) bool { return !ms[i].ts.Before(m.ts) })
+	for ; i < len(ms) && ms[i].ts.Equal(m.ts); i++ {
+		if ms[i].value == m.value {
+			return true
+		}
+	}
+	return false
+}
+
+// metricGlobChars are the characters that make a metric name a pattern.
+const metricGlobChars = "*?["
+
+// validateMetricName checks a metric name reported by a station. Names may be
+// dotted, like pump.motor.temp, to organize them into a hierarchy, but can't
+// contain empty segments or glob characters, so any metric can be queried.
+func validateMetricName(name string) error {
+	if strings.ContainsAny(name, metricGlobChars) {
+		return errors.Errorf("metric names cannot contain any of %s", metricGlobChars)
+	}
+	for _, segment := range strings.Split(name, ".") {
+		if segment == "" {
+			return errors.Errorf("metric name %s has an empty segment", name)
+		}
+	}
+	return nil
+}
+
+// isMetricPattern reports whether a METRICS query is a glob.
+func isMetricPattern(pattern string) bool {
+	return strings.ContainsAny(pattern, metricGlobChars)
+}
+
+// matchMetric reports whether a dotted metric name matches a glob pattern.
+// Each segment of the pattern is matched against one segment of the name
+// using path.Match rules, except that a final * segment matches everything
+// below it, so pump.* picks up both pump.rpm and pump.motor.temp.
+func matchMetric(pattern, name string) bool {
+	patterns := strings.Split(pattern, ".")
+	names := strings.Split(name, ".")
+
+	last := len(patterns) - 1
+	if patterns[last] == "*" && len(names) > last {
+		names = names[:last]
+		patterns = patterns[:last]
+	}
+
+	if len(patterns) != len(names) {
+		return false
+	}
+
+	for i := range patterns {
+		if ok, err := path.Match(patterns[i], names[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
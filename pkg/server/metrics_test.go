@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestInsertMetric(t *testing.T) {
+	at := func(sec int64, value float64) metric {
+		return metric{ts: time.Unix(sec, 0), value: value}
+	}
+
+	var insertCases = []struct {
+		name     string
+		series   []metric
+		insert   metric
+		max      int
+		expected []metric
+		kept     bool
+	}{
+		{
+			name:     "Append",
+			series:   []metric{at(1, 1), at(2, 2)},
+			insert:   at(3, 3),
+			max:      4,
+			expected: []metric{at(1, 1), at(2, 2), at(3, 3)},
+			kept:     true,
+		},
+		{
+			name:     "OutOfOrder",
+			series:   []metric{at(1, 1), at(3, 3)},
+			insert:   at(2, 2),
+			max:      4,
+			expected: []metric{at(1, 1), at(2, 2), at(3, 3)},
+			kept:     true,
+		},
+		{
+			name:     "Duplicate",
+			series:   []metric{at(1, 1), at(2, 2), at(3, 3)},
+			insert:   at(2, 2),
+			max:      4,
+			expected: []metric{at(1, 1), at(2, 2), at(3, 3)},
+			kept:     false,
+		},
+		{
+			name:     "SameTimestampDifferentValue",
+			series:   []metric{at(1, 1), at(2, 2)},
+			insert:   at(2, 5),
+			max:      4,
+			expected: []metric{at(1, 1), at(2, 2), at(2, 5)},
+			kept:     true,
+		},
+		{
+			name:     "FullDropsOldest",
+			series:   []metric{at(1, 1), at(2, 2)},
+			insert:   at(3, 3),
+			max:      2,
+			expected: []metric{at(2, 2), at(3, 3)},
+			kept:     true,
+		},
+		{
+			name:     "FullAndOlderThanEverything",
+			series:   []metric{at(2, 2), at(3, 3)},
+			insert:   at(1, 1),
+			max:      2,
+			expected: []metric{at(2, 2), at(3, 3)},
+			kept:     false,
+		},
+	}
+
+	for _, test := range insertCases {
+		t.Run(test.name, func(t *testing.T) {
+			got, kept := insertMetric(test.series, test.insert, test.max)
+			if kept != test.kept {
+				t.Errorf("expected kept=%v, got %v", test.kept, kept)
+			}
+
+			if len(got) != len(test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, got)
+			}
+			for i := range got {
+				if !got[i].ts.Equal(test.expected[i].ts) || got[i].value != test.expected[i].value {
+					t.Fatalf("expected %v, got %v", test.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchMetric(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"pump.*", "pump.rpm", true},
+		{"pump.*", "pump.motor.temp", true},
+		{"pump.*", "pump", false},
+		{"pump.*", "pumphouse.rpm", false},
+		{"*.temp", "pump.temp", true},
+		{"*.temp", "pump.motor.temp", false},
+		{"pump.*.temp", "pump.motor.temp", true},
+		{"pump.*.temp", "pump.motor.rpm", false},
+		{"pump.mo*.temp", "pump.motor.temp", true},
+		{"tank?.level", "tank2.level", true},
+		{"*", "level", true},
+		{"*", "pump.rpm", true},
+	} {
+		if got := matchMetric(c.pattern, c.name); got != c.match {
+			t.Errorf("matchMetric(%q, %q) = %v, expected %v", c.pattern, c.name, got, c.match)
+		}
+	}
+}
+
+func TestInsertMetricCopyOnWrite(t *testing.T) {
+	at := func(sec int64) metric { return metric{ts: time.Unix(sec, 0), value: float64(sec)} }
+
+	ms := make([]metric, 0, 8)
+	for _, sec := range []int64{1, 3, 5} {
+		ms, _ = insertMetric(ms, at(sec), 4)
+	}
+
+	snapshot := ms
+	want := append([]metric(nil), snapshot...)
+
+	// appends, backfills and trims must all leave the snapshot alone.
+	for _, sec := range []int64{6, 2, 4, 0, 7} {
+		ms, _ = insertMetric(ms, at(sec), 4)
+	}
+
+	if !reflect.DeepEqual(snapshot, want) {
+		t.Fatalf("snapshot changed to %v", snapshot)
+	}
+	if !reflect.DeepEqual(ms, []metric{at(4), at(5), at(6), at(7)}) {
+		t.Fatalf("unexpected series %v", ms)
+	}
+}
+
+// newBenchServer returns a server with one registered station, water, whose
+// level has a full history behind the present.
+func newBenchServer(tb testing.TB, points int) (*Server, *clientConn) {
+	s := New(nil, points, clock.New())
+
+	station := &clientConn{}
+	if _, err := s.handleRegister(context.Background(), station, "1", "water", "source"); err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < points; i++ {
+		if _, err := s.storeMetric(station, "level", metric{ts: time.Unix(int64(i), 0), value: 0.5}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return s, station
+}
+
+func TestReadsDuringIngest(t *testing.T) {
+	s, station := newBenchServer(t, 256)
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+
+			resp, err := s.handleMetrics(context.Background(), &clientConn{}, "1", "water", "level")
+			if err != nil {
+				done <- err
+				return
+			}
+
+			// every snapshot is a complete, ordered series.
+			fields := strings.Fields(resp)[3:]
+			if len(fields) != 256 {
+				done <- fmt.Errorf("expected 256 points, got %d", len(fields))
+				return
+			}
+			last := int64(-1)
+			for _, f := range fields {
+				ts, err := strconv.ParseInt(strings.Split(f, ":")[0], 10, 64)
+				if err != nil || ts < last {
+					done <- fmt.Errorf("points out of order: %v", fields)
+					return
+				}
+				last = ts
+			}
+		}
+	}()
+
+	for i := 0; i < 2000; i++ {
+		// a mix of appends and backfills.
+		ts := int64(1000 + i)
+		if i%3 == 0 {
+			ts = int64(1000 + i - 50)
+		}
+		if _, err := s.storeMetric(station, "level", metric{ts: time.Unix(ts, 0), value: float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkIngest measures METRIC on a station with a long history, both on
+// its own and while other clients continuously read that history back.
+// Reads work on snapshots, so they shouldn't slow ingest down.
+func BenchmarkIngest(b *testing.B) {
+	for _, readers := range []int{0, 4} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			s, station := newBenchServer(b, 10000)
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < readers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						s.handleMetrics(context.Background(), &clientConn{}, "1", "water", "level")
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.handleMetric(context.Background(), station, "2", "level", "0.5"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
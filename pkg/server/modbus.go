@@ -0,0 +1,426 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Legacy equipment like pump controllers speaks Modbus rather than the line
+// protocol. The server can poll such devices itself, reading registers on a
+// schedule and reporting them as metrics of a virtual station per device,
+// which are kept, queried and alerted on like any other station's. Devices
+// are reached over Modbus TCP, as RTU frames through a serial-to-TCP
+// gateway, or as RTU frames on a serial port set up beforehand (e.g. with
+// stty).
+
+// modbusType is the type Modbus stations are listed with.
+const modbusType = "modbus"
+
+// modbusTimeout is how long a device has to answer a request.
+const modbusTimeout = 5 * time.Second
+
+// Modbus function codes for reading registers.
+const (
+	modbusReadHolding = 3
+	modbusReadInput   = 4
+)
+
+// ModbusDevice is a device polled as a virtual station.
+type ModbusDevice struct {
+	Station string
+	// Address is tcp://host:port for Modbus TCP, rtu+tcp://host:port for RTU
+	// through a gateway, or rtu://[device] for RTU on a serial port.
+	Address string
+	// Unit is the device's unit (slave) id.
+	Unit  byte
+	Every time.Duration
+
+	Registers []ModbusRegister
+}
+
+// ModbusRegister is a metric read from a device's registers.
+type ModbusRegister struct {
+	Metric   string
+	Register uint16
+	// Input reads an input register, rather than a holding register.
+	Input bool
+	// Format is how the registers are read: uint16, int16, uint32, int32 or
+	// float32, the last three across two registers, high word first unless
+	// Swap is set.
+	Format string
+	Swap   bool
+	// Value is raw*Scale+Offset.
+	Scale  float64
+	Offset float64
+}
+
+// modbusFile is how devices are written in a -modbus file.
+type modbusFile struct {
+	Devices []struct {
+		Station   string `json:"station"`
+		Address   string `json:"address"`
+		Unit      byte   `json:"unit"`
+		Every     string `json:"every"`
+		Registers []struct {
+			Metric   string   `json:"metric"`
+			Register uint16   `json:"register"`
+			Input    bool     `json:"input"`
+			Format   string   `json:"format"`
+			Swap     bool     `json:"swap"`
+			Scale    *float64 `json:"scale"`
+			Offset   float64  `json:"offset"`
+		} `json:"registers"`
+	} `json:"devices"`
+}
+
+// ParseModbus reads a JSON object of the Modbus devices to poll, e.g.
+//
+//	{"devices": [
+//		{"station": "pump1", "address": "tcp://10.0.0.5:502", "unit": 1,
+//		 "every": "10s", "registers": [
+//			{"metric": "pressure", "register": 100, "scale": 0.1},
+//			{"metric": "flow", "register": 4, "input": true, "format": "float32"}]}]}
+//
+// Registers are read as uint16 unless given a format, and scaled by 1
+// unless given a scale.
+func ParseModbus(r io.Reader) ([]ModbusDevice, error) {
+	var file modbusFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, errors.Wrap(err, "bad modbus devices")
+	}
+
+	var devices []ModbusDevice
+	for _, d := range file.Devices {
+		if d.Station == "" || strings.ContainsAny(d.Station, " =*") {
+			return nil, errors.Errorf("bad modbus station name %q", d.Station)
+		}
+		if _, _, err := splitModbusAddress(d.Address); err != nil {
+			return nil, errors.Wrapf(err, "modbus station %s", d.Station)
+		}
+		every, err := time.ParseDuration(d.Every)
+		if err != nil || every <= 0 {
+			return nil, errors.Errorf("modbus station %s has a bad interval %q", d.Station, d.Every)
+		}
+
+		device := ModbusDevice{Station: d.Station, Address: d.Address, Unit: d.Unit, Every: every}
+		for _, reg := range d.Registers {
+			if err := validateMetricName(reg.Metric); err != nil {
+				return nil, errors.Wrapf(err, "modbus station %s", d.Station)
+			}
+			format := reg.Format
+			if format == "" {
+				format = "uint16"
+			}
+			if modbusWidth(format) == 0 {
+				return nil, errors.Errorf("modbus station %s has unknown format %s", d.Station, format)
+			}
+			scale := 1.0
+			if reg.Scale != nil {
+				scale = *reg.Scale
+			}
+
+			device.Registers = append(device.Registers, ModbusRegister{
+				Metric:   reg.Metric,
+				Register: reg.Register,
+				Input:    reg.Input,
+				Format:   format,
+				Swap:     reg.Swap,
+				Scale:    scale,
+				Offset:   reg.Offset,
+			})
+		}
+		if len(device.Registers) == 0 {
+			return nil, errors.Errorf("modbus station %s has no registers", d.Station)
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
+// splitModbusAddress splits an address into its framing, tcp or rtu, and
+// where to reach the device: over TCP, or on a serial port.
+func splitModbusAddress(address string) (string, string, error) {
+	scheme, rest, ok := strings.Cut(address, "://")
+	if !ok || rest == "" {
+		return "", "", errors.Errorf("bad modbus address %q", address)
+	}
+	switch scheme {
+	case "tcp", "rtu+tcp", "rtu":
+		return scheme, rest, nil
+	}
+	return "", "", errors.Errorf("unknown modbus scheme %s", scheme)
+}
+
+// modbusWidth returns how many registers a format takes up, or 0 if it's
+// unknown.
+func modbusWidth(format string) uint16 {
+	switch format {
+	case "uint16", "int16":
+		return 1
+	case "uint32", "int32", "float32":
+		return 2
+	}
+	return 0
+}
+
+// value decodes a register's raw words as a metric value.
+func (reg ModbusRegister) value(data []byte) float64 {
+	if reg.Swap && len(data) == 4 {
+		data = []byte{data[2], data[3], data[0], data[1]}
+	}
+
+	var raw float64
+	switch reg.Format {
+	case "uint16":
+		raw = float64(be16(data))
+	case "int16":
+		raw = float64(int16(be16(data)))
+	case "uint32":
+		raw = float64(be32(data))
+	case "int32":
+		raw = float64(int32(be32(data)))
+	case "float32":
+		raw = float64(math.Float32frombits(be32(data)))
+	}
+	return raw*reg.Scale + reg.Offset
+}
+
+// be16 and be32 read big-endian words, as Modbus sends them.
+func be16(b []byte) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func be32(b []byte) uint32 {
+	return uint32(be16(b))<<16 | uint32(be16(b[2:]))
+}
+
+// modbusConn is a connection to a device, framed for Modbus TCP or RTU.
+type modbusConn struct {
+	rw  io.ReadWriteCloser
+	rtu bool
+	// the last Modbus TCP transaction id.
+	tid uint16
+}
+
+// dialModbus connects to a device.
+func dialModbus(address string) (*modbusConn, error) {
+	scheme, where, err := splitModbusAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme == "rtu" {
+		f, err := os.OpenFile(where, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &modbusConn{rw: f, rtu: true}, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", where, modbusTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &modbusConn{rw: conn, rtu: scheme == "rtu+tcp"}, nil
+}
+
+func (c *modbusConn) Close() error {
+	return c.rw.Close()
+}
+
+// readRegisters reads count registers from addr on, returning their bytes.
+func (c *modbusConn) readRegisters(unit byte, input bool, addr, count uint16) ([]byte, error) {
+	fc := byte(modbusReadHolding)
+	if input {
+		fc = modbusReadInput
+	}
+	pdu := []byte{fc, byte(addr >> 8), byte(addr), byte(count >> 8), byte(count)}
+
+	if d, ok := c.rw.(interface{ SetDeadline(time.Time) error }); ok {
+		d.SetDeadline(time.Now().Add(modbusTimeout))
+	}
+
+	var resp []byte
+	var err error
+	if c.rtu {
+		resp, err = c.rtuRequest(unit, pdu)
+	} else {
+		resp, err = c.tcpRequest(unit, pdu)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(resp) >= 2 && resp[0] == fc|0x80:
+		return nil, errors.Errorf("device answered with exception %d", resp[1])
+	case len(resp) < 2 || resp[0] != fc || int(resp[1]) != 2*int(count) || len(resp) != 2+int(resp[1]):
+		return nil, errors.Errorf("malformed response % x", resp)
+	}
+	return resp[2:], nil
+}
+
+// tcpRequest sends a PDU with a Modbus TCP header, and returns the PDU it's
+// answered with.
+func (c *modbusConn) tcpRequest(unit byte, pdu []byte) ([]byte, error) {
+	c.tid++
+	n := 1 + len(pdu)
+	req := []byte{byte(c.tid >> 8), byte(c.tid), 0, 0, byte(n >> 8), byte(n), unit}
+	if _, err := c.rw.Write(append(req, pdu...)); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(c.rw, header); err != nil {
+		return nil, err
+	}
+	length := be16(header[4:])
+	if length < 2 || length > 256 {
+		return nil, errors.Errorf("bad response length %d", length)
+	}
+	resp := make([]byte, length-1)
+	if _, err := io.ReadFull(c.rw, resp); err != nil {
+		return nil, err
+	}
+	if tid := be16(header); tid != c.tid {
+		return nil, errors.Errorf("response to transaction %d, expected %d", tid, c.tid)
+	}
+	return resp, nil
+}
+
+// rtuRequest sends a PDU as an RTU frame, and returns the PDU it's answered
+// with.
+func (c *modbusConn) rtuRequest(unit byte, pdu []byte) ([]byte, error) {
+	frame := append([]byte{unit}, pdu...)
+	crc := modbusCRC(frame)
+	if _, err := c.rw.Write(append(frame, byte(crc), byte(crc>>8))); err != nil {
+		return nil, err
+	}
+
+	// the unit, the function code, and either the byte count or an
+	// exception code.
+	resp := make([]byte, 3, 3+256+2)
+	if _, err := io.ReadFull(c.rw, resp); err != nil {
+		return nil, err
+	}
+	rest := int(resp[2]) + 2
+	if resp[1]&0x80 != 0 {
+		rest = 2
+	}
+	resp = resp[:3+rest]
+	if _, err := io.ReadFull(c.rw, resp[3:]); err != nil {
+		return nil, err
+	}
+
+	n := len(resp) - 2
+	if crc := modbusCRC(resp[:n]); resp[n] != byte(crc) || resp[n+1] != byte(crc>>8) {
+		return nil, errors.New("bad CRC")
+	}
+	if resp[0] != unit {
+		return nil, errors.Errorf("response from unit %d, expected %d", resp[0], unit)
+	}
+	return resp[1:n], nil
+}
+
+// modbusCRC is the CRC-16 RTU frames end with, sent low byte first.
+func modbusCRC(b []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// modbusPoller polls a device, keeping its connection open between polls.
+type modbusPoller struct {
+	device  ModbusDevice
+	conn    *modbusConn
+	failing bool
+}
+
+// schedulePoll polls a device every interval.
+func (s *Server) schedulePoll(p *modbusPoller) {
+	s.Clock.AfterFunc(p.device.Every, func() {
+		s.poll(p)
+		s.schedulePoll(p)
+	})
+}
+
+// poll reads a device's registers and reports them as its station's
+// metrics, raising an alert if it can't, or closing it once it can again.
+func (s *Server) poll(p *modbusPoller) {
+	name := "modbus"
+	station := p.device.Station
+
+	values, err := p.read()
+	if err != nil {
+		if p.conn != nil {
+			p.conn.Close()
+			p.conn = nil
+		}
+		if !p.failing {
+			p.failing = true
+			s.raise(name, "modbus.failed", station, "couldn't poll %s: %v", p.device.Address, err)
+		}
+		return
+	}
+	if p.failing {
+		p.failing = false
+		s.resolve(name, "modbus.ok", station, "polling %s again", p.device.Address)
+	}
+
+	now := s.Clock.Now()
+	s.stationsM.RLock()
+	st, ok := s.stations[station]
+	if ok {
+		st.m.Lock()
+		st.heard = now
+		for i, reg := range p.device.Registers {
+			s.keep(station, st, reg.Metric, metric{ts: now, value: values[i]})
+		}
+		st.m.Unlock()
+	}
+	s.stationsM.RUnlock()
+
+	for i, reg := range p.device.Registers {
+		s.updateVirtual(station, reg.Metric)
+		s.checkThresholds(station, reg.Metric, values[i])
+	}
+}
+
+// read reads every register of the device, connecting to it first if need
+// be.
+func (p *modbusPoller) read() ([]float64, error) {
+	if p.conn == nil {
+		conn, err := dialModbus(p.device.Address)
+		if err != nil {
+			return nil, err
+		}
+		p.conn = conn
+	}
+
+	values := make([]float64, len(p.device.Registers))
+	for i, reg := range p.device.Registers {
+		data, err := p.conn.readRegisters(p.device.Unit, reg.Input, reg.Register, modbusWidth(reg.Format))
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s from register %d", reg.Metric, reg.Register)
+		}
+		values[i] = reg.value(data)
+	}
+	return values, nil
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// fakeModbus is a Modbus TCP device answering reads of its holding
+// registers.
+type fakeModbus struct {
+	listener net.Listener
+
+	m         sync.Mutex
+	registers map[uint16]uint16
+}
+
+func newFakeModbus(t *testing.T, registers map[uint16]uint16) *fakeModbus {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeModbus{listener: listener, registers: registers}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *fakeModbus) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		req := make([]byte, 12)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		fc, addr, count := req[7], be16(req[8:]), be16(req[10:])
+
+		pdu := []byte{fc, byte(2 * count)}
+		d.m.Lock()
+		for i := uint16(0); i < count; i++ {
+			v, ok := d.registers[addr+i]
+			if !ok || fc != modbusReadHolding {
+				// illegal data address.
+				pdu = []byte{fc | 0x80, 2}
+				break
+			}
+			pdu = append(pdu, byte(v>>8), byte(v))
+		}
+		d.m.Unlock()
+
+		length := 1 + len(pdu)
+		resp := append([]byte{req[0], req[1], 0, 0, byte(length >> 8), byte(length), req[6]}, pdu...)
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestParseModbus(t *testing.T) {
+	devices, err := ParseModbus(strings.NewReader(`{"devices": [
+		{"station": "pump1", "address": "tcp://10.0.0.5:502", "unit": 1, "every": "10s", "registers": [
+			{"metric": "pressure", "register": 100, "scale": 0.1},
+			{"metric": "flow", "register": 4, "input": true, "format": "float32", "swap": true}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].Every != 10*time.Second || len(devices[0].Registers) != 2 {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+	if reg := devices[0].Registers[0]; reg.Format != "uint16" || reg.Scale != 0.1 {
+		t.Fatalf("expected defaults to be filled in, got %+v", reg)
+	}
+	if reg := devices[0].Registers[1]; !reg.Input || !reg.Swap || reg.Scale != 1 {
+		t.Fatalf("unexpected register %+v", reg)
+	}
+
+	for _, bad := range []string{
+		`{"devices": [{"station": "pump1", "address": "udp://x:502", "every": "10s", "registers": [{"metric": "p"}]}]}`,
+		`{"devices": [{"station": "pump1", "address": "tcp://x:502", "every": "soon", "registers": [{"metric": "p"}]}]}`,
+		`{"devices": [{"station": "pump1", "address": "tcp://x:502", "every": "10s", "registers": [{"metric": "p", "format": "int8"}]}]}`,
+		`{"devices": [{"station": "pump1", "address": "tcp://x:502", "every": "10s"}]}`,
+		`{"devices": [{"station": "pump *", "address": "tcp://x:502", "every": "10s", "registers": [{"metric": "p"}]}]}`,
+	} {
+		if _, err := ParseModbus(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+func TestModbusValues(t *testing.T) {
+	f := math.Float32bits(12.5)
+	for _, tc := range []struct {
+		reg  ModbusRegister
+		data []byte
+		want float64
+	}{
+		{ModbusRegister{Format: "uint16", Scale: 0.1}, []byte{0x01, 0x00}, 25.6},
+		{ModbusRegister{Format: "int16", Scale: 1, Offset: 1}, []byte{0xff, 0xfe}, -1},
+		{ModbusRegister{Format: "uint32", Scale: 1}, []byte{0, 1, 0, 0}, 65536},
+		{ModbusRegister{Format: "uint32", Scale: 1, Swap: true}, []byte{0, 1, 0, 0}, 1},
+		{ModbusRegister{Format: "int32", Scale: 1}, []byte{0xff, 0xff, 0xff, 0xff}, -1},
+		{ModbusRegister{Format: "float32", Scale: 2}, []byte{byte(f >> 24), byte(f >> 16), byte(f >> 8), byte(f)}, 25},
+	} {
+		if got := tc.reg.value(tc.data); math.Abs(got-tc.want) > 1e-9 {
+			t.Fatalf("%+v of % x: expected %g, got %g", tc.reg, tc.data, tc.want, got)
+		}
+	}
+}
+
+func TestModbusRTU(t *testing.T) {
+	// the worked example from the Modbus serial line spec.
+	if crc := modbusCRC([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0a}); crc != 0xcdc5 {
+		t.Fatalf("expected CRC 0xcdc5, got %#x", crc)
+	}
+
+	ours, device := net.Pipe()
+	defer ours.Close()
+	go func() {
+		req := make([]byte, 8)
+		io.ReadFull(device, req)
+		resp := []byte{req[0], req[1], 2, 0x01, 0x2c}
+		crc := modbusCRC(resp)
+		device.Write(append(resp, byte(crc), byte(crc>>8)))
+	}()
+
+	conn := &modbusConn{rw: ours, rtu: true}
+	data, err := conn.readRegisters(7, false, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if be16(data) != 300 {
+		t.Fatalf("expected 300, got % x", data)
+	}
+}
+
+func TestModbusStations(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device := newFakeModbus(t, map[uint16]uint16{100: 42, 101: 0, 102: 7})
+	v, err := ParseVirtualMetric("plant.pressure = pump1.pressure * 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	var notified []Notification
+	server := New(listener, 4, mock,
+		WithModbus(ModbusDevice{
+			Station: "pump1",
+			Address: "tcp://" + device.listener.Addr().String(),
+			Unit:    1,
+			Every:   10 * time.Second,
+			Registers: []ModbusRegister{
+				{Metric: "pressure", Register: 100, Format: "uint16", Scale: 0.5},
+				{Metric: "flow", Register: 101, Format: "uint32", Scale: 1},
+			},
+		}),
+		WithVirtualMetrics(v),
+		WithNotifier(NotifierFunc(func(n Notification) {
+			notified = append(notified, n)
+		})))
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	server.stationsM.RLock()
+	if st := server.stations["pump1"]; st == nil || st.tipe != modbusType {
+		t.Fatalf("expected pump1 to be registered as a modbus station, got %+v", st)
+	}
+	server.stationsM.RUnlock()
+
+	mock.Add(10 * time.Second)
+	for _, in := range []interaction{
+		{"1 METRICS pump1 pressure", "1 METRICS pump1 pressure 10:21.00"},
+		{"2 METRICS pump1 flow", "2 METRICS pump1 flow 10:7.00"},
+		// polled stations can be inputs of virtual metrics.
+		{"3 METRICS plant pressure", "3 METRICS plant pressure 10:42.00"},
+		{"4 RUN pump1 stop", "4 ERR"},
+	} {
+		if err := sendExpect(conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a device that stops answering raises an alert, until it's back.
+	device.m.Lock()
+	delete(device.registers, 101)
+	device.m.Unlock()
+	mock.Add(10 * time.Second)
+	mock.Add(10 * time.Second)
+	if len(notified) != 1 || notified[0].Kind != "modbus.failed" || notified[0].Station != "pump1" {
+		t.Fatalf("expected a single modbus.failed alert, got %+v", notified)
+	}
+
+	device.m.Lock()
+	device.registers[101] = 0
+	device.m.Unlock()
+	mock.Add(10 * time.Second)
+	if len(notified) != 2 || notified[1].Kind != "modbus.ok" {
+		t.Fatalf("expected the alert to be resolved, got %+v", notified)
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Operators can annotate stations with notes ("replaced float sensor"), about
+// a moment or a stretch of time, so anyone looking at the data later knows
+// what was going on. Notes are kept by station name like logs, outlive the
+// station's connection, and go into the event journal as they're added.
+
+type note struct {
+	// when the note was added.
+	added time.Time
+	// the time the note is about, which is a single moment when from and to
+	// are the same.
+	from, to time.Time
+	text     string
+}
+
+// overlaps reports whether the time a note is about overlaps a window.
+func (n note) overlaps(w timeWindow) bool {
+	return (w.from.IsZero() || !n.to.Before(w.from)) && (w.to.IsZero() || !n.from.After(w.to))
+}
+
+type stationNotes struct {
+	m     sync.Mutex
+	notes map[string][]note
+}
+
+func newStationNotes() *stationNotes {
+	return &stationNotes{notes: map[string][]note{}}
+}
+
+// add keeps a note, in order of the time it's about.
+func (n *stationNotes) add(name string, nt note) {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	notes := n.notes[name]
+	i := len(notes)
+	for i > 0 && notes[i-1].from.After(nt.from) {
+		i--
+	}
+	notes = append(notes, note{})
+	copy(notes[i+1:], notes[i:])
+	notes[i] = nt
+	n.notes[name] = notes
+}
+
+func (n *stationNotes) count(name string) int {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	return len(n.notes[name])
+}
+
+func (n *stationNotes) forget(name string) {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	delete(n.notes, name)
+}
+
+func (n *stationNotes) rename(from, to string) {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	if notes, ok := n.notes[from]; ok {
+		delete(n.notes, from)
+		n.notes[to] = append(n.notes[to], notes...)
+	}
+}
+
+// NoteStore is a MetricStore that also keeps notes on stations. Pruning all
+// of a station's metrics drops its notes too, and renaming a station moves
+// them.
+type NoteStore interface {
+	MetricStore
+	// SaveNote records a note on a station.
+	SaveNote(note StoredNote) error
+	// LoadNotes returns every note recorded.
+	LoadNotes() ([]StoredNote, error)
+}
+
+// StoredNote is a note on a station, as kept by a NoteStore.
+type StoredNote struct {
+	Station string
+	Added   time.Time
+	From    time.Time
+	To      time.Time
+	Text    string
+}
+
+// saveNote records a note in the store, if it keeps them.
+func (s *Server) saveNote(name string, nt note) {
+	ns, ok := s.store.(NoteStore)
+	if !ok {
+		return
+	}
+	if err := ns.SaveNote(StoredNote{Station: name, Added: nt.added, From: nt.from, To: nt.to, Text: nt.text}); err != nil {
+		s.log.Errorf("couldn't save note on %s: %v", name, err)
+	}
+}
+
+// restoreNotes picks up the notes recorded in the store. Must be called
+// before serving.
+func (s *Server) restoreNotes() {
+	ns, ok := s.store.(NoteStore)
+	if !ok {
+		return
+	}
+	notes, err := ns.LoadNotes()
+	if err != nil {
+		s.log.Errorf("couldn't restore notes: %v", err)
+		return
+	}
+
+	for _, n := range notes {
+		s.notes.add(n.Station, note{added: n.Added, from: n.From, to: n.To, text: n.Text})
+	}
+}
+
+// describeNote is how a note reads in the event journal.
+func describeNote(nt note) string {
+	return fmt.Sprintf("from=%d to=%d %s", nt.from.Unix(), nt.to.Unix(), nt.text)
+}
+
+// NOTE cmd (admin only)
+// Expected args:
+//  - [name]
+//  - from=[time] to=[time] tz=[zone] (optional)
+//  - [text] (may contain spaces)
+//
+// A note is about the moment it's added, unless it says otherwise. A note
+// with only from= is about that moment.
+func (s *Server) handleNote(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 2 {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	name := args[0]
+	if name == "*" || strings.Contains(name, "=") {
+		return "", badArgf(name, "bad station name %s", name)
+	}
+
+	// the time modifiers come first, and everything after them is text.
+	i := 1
+	for i < len(args) && isWindowModifier(args[i]) {
+		i++
+	}
+	if i == len(args) {
+		return "", argCount(args)
+	}
+
+	now := s.Clock.Now()
+	w, _, err := parseTimeWindow(args[1:i], now)
+	if err != nil {
+		return "", err
+	}
+	nt := note{added: now, from: w.from, to: w.to, text: strings.Join(args[i:], " ")}
+	switch {
+	case nt.from.IsZero() && nt.to.IsZero():
+		nt.from, nt.to = now, now
+	case nt.from.IsZero():
+		return "", errors.Errorf("a note with to= needs a from=")
+	case nt.to.IsZero():
+		nt.to = nt.from
+	}
+
+	s.notes.add(name, nt)
+	s.saveNote(name, nt)
+	s.event("note", name, "%s", describeNote(nt))
+
+	return "ACK", nil
+}
+
+// isWindowModifier reports whether a token is one of parseTimeWindow's.
+func isWindowModifier(token string) bool {
+	return strings.HasPrefix(token, "from=") || strings.HasPrefix(token, "to=") || strings.HasPrefix(token, "tz=")
+}
+
+// NOTES cmd
+// Expected args:
+//  - [name]
+//  - from=[time] to=[time] tz=[zone] (optional)
+//
+// Each note about time in the window is sent as its own [uid] NOTE
+// response, in order of the time it's about, before the final NOTES one.
+func (s *Server) handleNotes(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 1 || len(args) > 4 {
+		return "", argCount(args)
+	}
+
+	name := args[0]
+	w, rest, err := parseTimeWindow(args[1:], s.Clock.Now())
+	if err != nil {
+		return "", err
+	}
+	if len(rest) > 0 {
+		return "", badArgf(rest[0], "unknown modifier %s", rest[0])
+	}
+
+	s.notes.m.Lock()
+	defer s.notes.m.Unlock()
+
+	sent := 0
+	for _, nt := range s.notes.notes[name] {
+		if !nt.overlaps(w) {
+			continue
+		}
+		fmt.Fprintf(conn, "%s NOTE %s %d %d %d %s\n", uid, name, nt.added.Unix(), nt.from.Unix(), nt.to.Unix(), nt.text)
+		sent++
+	}
+
+	return fmt.Sprintf("NOTES %s %d", name, sent), nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestNotes(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	mock.Set(time.Unix(7200, 0))
+	server := New(listener, 4, mock, TrustPlaintext())
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	lines := bufio.NewReader(conn)
+	for _, in := range []struct {
+		send   string
+		expect []string
+	}{
+		{"1 NOTE water replaced float sensor", []string{"1 ACK"}},
+		{"2 NOTE water from=3600 to=5400 tank drained for cleaning", []string{"2 ACK"}},
+		{"3 NOTE water from=5400 to=3600 backwards", []string{"3 ERR"}},
+		{"4 NOTE water to=3600 no start", []string{"4 ERR"}},
+		{"5 NOTE water from=1h", []string{"5 ERR"}},
+		{"6 NOTES water", []string{
+			"6 NOTE water 7200 3600 5400 tank drained for cleaning",
+			"6 NOTE water 7200 7200 7200 replaced float sensor",
+			"6 NOTES water 2",
+		}},
+		// only notes about time in the window.
+		{"7 NOTES water from=6000", []string{
+			"7 NOTE water 7200 7200 7200 replaced float sensor",
+			"7 NOTES water 1",
+		}},
+		{"8 NOTES fire", []string{"8 NOTES fire 0"}},
+		{"9 EVENTS water", []string{
+			"9 EVENT 1 7200 note water from=7200 to=7200 replaced float sensor",
+			"9 EVENT 2 7200 note water from=3600 to=5400 tank drained for cleaning",
+			"9 EVENTS 2",
+		}},
+	} {
+		fmt.Fprintf(conn, "%s\n", in.send)
+		if err := expectLines(lines, in.expect...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "a INFO water\n")
+	if err := expectLines(lines, "a INFO water type=source health=100 notes=2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotesAdminOnly(t *testing.T) {
+	server := New(nil, 4, clock.NewMock())
+
+	if _, err := server.handleNote(context.Background(), &clientConn{}, "1", "water", "hello"); err == nil {
+		t.Fatal("expected NOTE to be admin only")
+	}
+}
+
+func TestNotesSQLite(t *testing.T) {
+	path := tempPointLogPath(t)
+
+	q, err := OpenSQLiteStore(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := clock.NewMock()
+	server := New(nil, 4, mock, WithMetricStore(q), TrustPlaintext())
+	if _, err := server.handleNote(context.Background(), &clientConn{}, "1", "water", "replaced", "float"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// notes come back with the server.
+	q, err = OpenSQLiteStore(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	server = New(nil, 4, mock, WithMetricStore(q))
+	if n := server.notes.count("water"); n != 1 {
+		t.Fatalf("expected the note to be restored, got %d notes", n)
+	}
+
+	if err := server.rename("water", "tank"); err != nil {
+		t.Fatal(err)
+	}
+	notes, err := q.LoadNotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Station != "tank" || notes[0].Text != "replaced float" {
+		t.Fatalf("expected the note to move with the station, got %+v", notes)
+	}
+}
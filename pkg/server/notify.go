@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Notification is something operators should hear about.
+type Notification struct {
+	// Kind says what happened, e.g. "slo.burn".
+	Kind    string    `json:"kind"`
+	Station string    `json:"station"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+
+	// HTML is a richer rendering of Message for sinks that can show it, if
+	// there is one.
+	HTML string `json:"html,omitempty"`
+}
+
+// Notifier is a sink for notifications. Notify is called with server locks
+// held, so it must not block; sinks that do I/O should queue.
+type Notifier interface {
+	Notify(Notification)
+}
+
+// NotifierFunc adapts a function to a Notifier.
+type NotifierFunc func(Notification)
+
+// Notify calls f(n).
+func (f NotifierFunc) Notify(n Notification) {
+	f(n)
+}
+
+// eventNotifier is a sink for some kinds of journal events.
+type eventNotifier struct {
+	n     Notifier
+	kinds map[string]bool
+}
+
+// notify logs a notification and hands it to every configured sink.
+func (s *Server) notify(kind, station, format string, args ...interface{}) {
+	n := Notification{
+		Kind:    kind,
+		Station: station,
+		Message: fmt.Sprintf(format, args...),
+		Time:    s.Clock.Now(),
+	}
+
+	s.log.Infof("%s %s: %s", n.Kind, n.Station, n.Message)
+	if s.reports != nil {
+		s.reports.alert(n)
+	}
+	s.event(n.Kind, n.Station, "%s", n.Message)
+	for _, sink := range s.notifiers {
+		sink.Notify(n)
+	}
+}
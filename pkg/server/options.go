@@ -0,0 +1,536 @@
+package server
+
+import "time"
+
+// Option configures optional Server behaviour in New.
+type Option func(*Server)
+
+// WithAdmins allows clients presenting a certificate with one of these common
+// names to run admin commands.
+func WithAdmins(names ...string) Option {
+	return func(s *Server) {
+		for _, name := range names {
+			s.admins[name] = true
+		}
+	}
+}
+
+// WithRoles only lets certificates send the commands their role allows.
+// Admin commands still need an admin certificate too.
+func WithRoles(roles Roles) Option {
+	return func(s *Server) {
+		s.roles = roles
+	}
+}
+
+// WithBoundNames only lets stations REGISTER as the common name or a DNS
+// name on their certificate, or as a name grants (as read by
+// ParseNameGrants) lets their common name use, so one station can't pass
+// itself off as another. Plaintext clients can only register with
+// TrustPlaintext.
+func WithBoundNames(grants map[string][]string) Option {
+	return func(s *Server) {
+		s.bindNames = true
+		s.nameGrants = grants
+	}
+}
+
+// WithBlocklist rejects clients presenting a certificate with one of these
+// SHA-256 fingerprints right after the TLS handshake.
+func WithBlocklist(fingerprints ...string) Option {
+	return func(s *Server) {
+		for _, fp := range fingerprints {
+			s.blocklist[normalizeFingerprint(fp)] = true
+		}
+	}
+}
+
+// WithRevocations rejects clients presenting a certificate revoked by r
+// right after the TLS handshake, and closes connections made with one as
+// soon as r is reloaded with it revoked.
+func WithRevocations(r *Revocations) Option {
+	return func(s *Server) {
+		s.revocations = r
+		r.onReload(s.closeRevoked)
+	}
+}
+
+// TrustPlaintext treats clients on non-TLS listeners as admins. It only
+// exists for tests and local development, where there are no certificates
+// to identify anyone by.
+func TrustPlaintext() Option {
+	return func(s *Server) {
+		s.trustPlaintext = true
+	}
+}
+
+// WithWebSocketOrigins lets browser dashboards served from these origins,
+// like https://dashboard.example.com, open WebSockets to the HTTP API, as
+// well as pages served by the server itself.
+func WithWebSocketOrigins(origins ...string) Option {
+	return func(s *Server) {
+		s.wsOrigins = map[string]bool{}
+		for _, origin := range origins {
+			s.wsOrigins[origin] = true
+		}
+	}
+}
+
+// WithProbeDenylist temporarily denies source addresses that fail the TLS
+// handshake or send garbage before a valid command `after` times, for the
+// given duration.
+func WithProbeDenylist(after int, denyFor time.Duration) Option {
+	return func(s *Server) {
+		s.probes.denyAfter = after
+		s.probes.denyFor = denyFor
+	}
+}
+
+// WithLocations sets where stations are, by name. These take precedence over
+// locations stations report when they REGISTER.
+func WithLocations(locations map[string]Location) Option {
+	return func(s *Server) {
+		for name, l := range locations {
+			s.locations[name] = l
+		}
+	}
+}
+
+// WithStationTypes defines station types. Once any are defined, stations
+// can only REGISTER as one of them, and are flagged when they deviate from
+// it. The types' SLOs apply to each station of the type.
+func WithStationTypes(types ...StationType) Option {
+	return func(s *Server) {
+		for _, t := range types {
+			s.types[t.Name] = t
+			for _, o := range t.SLOs {
+				o.Type = t.Name
+				s.slos.slos = append(s.slos.slos, o)
+			}
+		}
+	}
+}
+
+// WithRedelivery keeps idempotent runs of a station whose connection drops
+// for up to window, and delivers them again if the station re-registers in
+// time. Runs that aren't idempotent are never delivered twice.
+func WithRedelivery(window time.Duration) Option {
+	return func(s *Server) {
+		s.redeliveryWindow = window
+	}
+}
+
+// WithRunTimeout fails runs the station hasn't answered within timeout,
+// whether it's still connected or they're held for redelivery.
+func WithRunTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.runTimeout = timeout
+	}
+}
+
+// WithNotifier adds a sink for notifications, such as SLO burn alerts.
+func WithNotifier(n Notifier) Option {
+	return func(s *Server) {
+		s.notifiers = append(s.notifiers, n)
+	}
+}
+
+// WithEventNotifier adds a sink for journal events of the given kinds, like
+// register, disconnect and run.err, which are handed to it as notifications
+// with the event's detail as the message.
+func WithEventNotifier(n Notifier, kinds ...string) Option {
+	return func(s *Server) {
+		en := eventNotifier{n: n, kinds: map[string]bool{}}
+		for _, kind := range kinds {
+			en.kinds[kind] = true
+		}
+		s.eventNotifiers = append(s.eventNotifiers, en)
+	}
+}
+
+// WithAlertReminders notifies again about alerts that are still open and
+// that nobody has acknowledged, every interval.
+func WithAlertReminders(every time.Duration) Option {
+	return func(s *Server) {
+		s.alerts.every = every
+		s.scheduleReminders(every)
+	}
+}
+
+// WithSLOs sets objectives on run success rates, which notify when they
+// burn through their error budget too quickly.
+func WithSLOs(slos ...SLO) Option {
+	return func(s *Server) {
+		s.slos.slos = append(s.slos.slos, slos...)
+	}
+}
+
+// WithDurableBacklog sets how many uncommitted points each durable
+// subscription keeps for its consumer.
+func WithDurableBacklog(points int) Option {
+	return func(s *Server) {
+		s.subscribers.backlog = points
+	}
+}
+
+// WithVirtualMetrics registers virtual stations, whose metrics are computed
+// from the metrics of other stations.
+func WithVirtualMetrics(vms ...VirtualMetric) Option {
+	return func(s *Server) {
+		for _, v := range vms {
+			if _, ok := s.stations[v.Station]; !ok {
+				s.stations[v.Station] = &Station{
+					metrics: map[string][]metric{},
+					tipe:    virtualType,
+					virtual: true,
+					runs:    map[string]*run{},
+				}
+			}
+			s.virtual = append(s.virtual, v)
+		}
+	}
+}
+
+// WithThresholds sets rules alerting on metrics past a value, which admins
+// can change with THRESHOLDS.
+func WithThresholds(ts ...Threshold) Option {
+	return func(s *Server) {
+		for _, t := range ts {
+			s.thresholds.rules[t.Name] = t
+		}
+	}
+}
+
+// WithModbus registers a virtual station for each device, whose registers
+// are polled for its metrics.
+func WithModbus(devices ...ModbusDevice) Option {
+	return func(s *Server) {
+		for _, d := range devices {
+			s.stations[d.Station] = &Station{
+				metrics: map[string][]metric{},
+				tipe:    modbusType,
+				virtual: true,
+				polled:  true,
+				runs:    map[string]*run{},
+			}
+
+			s.schedulePoll(&modbusPoller{device: d})
+		}
+	}
+}
+
+// WithIngest registers a virtual station for each station the sources map
+// payloads to, and takes their payloads at /api/ingest/[source] in the HTTP
+// API.
+func WithIngest(sources ...IngestSource) Option {
+	return func(s *Server) {
+		if s.ingestSources == nil {
+			s.ingestSources = map[string]IngestSource{}
+		}
+		for _, src := range sources {
+			s.ingestSources[src.Name] = src
+			for _, st := range src.Stations {
+				s.stations[st.Station] = &Station{
+					metrics: map[string][]metric{},
+					tipe:    st.Type,
+					virtual: true,
+					polled:  true,
+					runs:    map[string]*run{},
+				}
+			}
+		}
+	}
+}
+
+// WithTelemetry registers the _server station, which the server reports how
+// it's doing as every interval: how many stations are online and offline,
+// connections, commands handled a second, runs pending, goroutines and heap
+// bytes in use.
+func WithTelemetry(every time.Duration) Option {
+	return func(s *Server) {
+		s.stations[telemetryStation] = &Station{
+			metrics: map[string][]metric{},
+			tipe:    telemetryType,
+			virtual: true,
+			polled:  true,
+			runs:    map[string]*run{},
+		}
+
+		s.telemetry = &telemetry{every: every, at: s.Clock.Now()}
+		s.scheduleTelemetry()
+	}
+}
+
+// WithReports sends reports on the fleet through the notification sinks at
+// the end of each period, at midnight in loc.
+func WithReports(loc *time.Location, periods ...ReportPeriod) Option {
+	return func(s *Server) {
+		s.reports = newReporter(loc)
+		for _, p := range periods {
+			s.scheduleReport(p, s.Clock.Now())
+		}
+	}
+}
+
+// WithStaleAfter sets how long a metric can go without a new point before
+// it counts as stale, and drags its station's health down.
+func WithStaleAfter(d time.Duration) Option {
+	return func(s *Server) {
+		s.staleAfter = d
+	}
+}
+
+// WithLogLines sets how many LOG lines are kept for each station.
+func WithLogLines(lines int) Option {
+	return func(s *Server) {
+		s.logs.lines = lines
+	}
+}
+
+// WithJournalSize sets how many lifecycle events the journal keeps.
+func WithJournalSize(events int) Option {
+	return func(s *Server) {
+		s.journal.size = events
+	}
+}
+
+// WithMetricStore persists metric points to store, and restores a station's
+// history from it when the station registers.
+func WithMetricStore(store MetricStore) Option {
+	return func(s *Server) {
+		s.store = store
+	}
+}
+
+// WithExport writes every station's metric points to sink as hourly Parquet
+// files, for analysis with tools like DuckDB or Spark.
+func WithExport(sink ExportSink) Option {
+	return func(s *Server) {
+		s.export = newExporter(sink, s.Clock, &s.log)
+	}
+}
+
+// WithChaos lets admins inject faults with CHAOS: holding up commands,
+// dropping their answers and disconnecting stations and clients. It's only
+// meant for rehearsing failures on test deployments.
+func WithChaos() Option {
+	return func(s *Server) {
+		s.chaos = newChaos()
+	}
+}
+
+// WithBackups writes a backup of the server's state and metric store to sink
+// every interval, verifying it afterwards if sink is a ReadableSink.
+func WithBackups(sink ExportSink, every time.Duration) Option {
+	return func(s *Server) {
+		s.backups = &backups{sink: sink}
+		s.scheduleBackups(every)
+	}
+}
+
+// WithBackupKeep keeps only the n most recent backups, removing older ones
+// after each backup that succeeds, if the backup sink is a PrunableSink.
+func WithBackupKeep(n int) Option {
+	return func(s *Server) {
+		s.backupKeep = n
+	}
+}
+
+// WithQueryCache caches the answers to fleet-wide queries like
+// METRICS * [metric] LAST and TOP for up to ttl, or until a station reports
+// the metric, whichever comes first.
+func WithQueryCache(ttl time.Duration) Option {
+	return func(s *Server) {
+		s.cache = newQueryCache(ttl, s.Clock)
+	}
+}
+
+// WithJanitor sweeps every interval for stations that have been offline for
+// longer than reclaimAfter, and forgets their logs, run statistics and
+// history.
+func WithJanitor(reclaimAfter, every time.Duration) Option {
+	return func(s *Server) {
+		s.reclaimAfter = reclaimAfter
+		s.scheduleSweeps(every)
+	}
+}
+
+// WithReaper checks every interval for stations that haven't sent a PING or
+// METRIC for reapAfter, and takes them offline as if they'd disconnected.
+func WithReaper(reapAfter, every time.Duration) Option {
+	return func(s *Server) {
+		s.reapAfter = reapAfter
+		s.scheduleReaps(every)
+	}
+}
+
+// WithRetention drops metric points once they're older than retention, as
+// new points come in and by a sweep every interval, on top of keeping at
+// most maxMetricPoints of each series.
+func WithRetention(retention, every time.Duration) Option {
+	return func(s *Server) {
+		s.retention = retention
+		s.scheduleExpiry(every)
+	}
+}
+
+// WithStrictProtocol has the server say why it rejected a command, with an
+// error code and the offending token and its position, like
+// ERR E_BADARG pos=3 token=abc, instead of a bare ERR.
+func WithStrictProtocol() Option {
+	return func(s *Server) {
+		s.strict = true
+	}
+}
+
+// WithSlowCommands logs every command that takes threshold or longer to
+// handle, along with who sent it. Arguments that can carry payloads, like
+// run results and configuration, are left out.
+func WithSlowCommands(threshold time.Duration) Option {
+	return func(s *Server) {
+		s.slowCommand = threshold
+	}
+}
+
+// WithWatchdog samples the Go runtime every so often, and notifies when it
+// goes over the limits, saving a profile if asked to.
+func WithWatchdog(limits Watchdog) Option {
+	return func(s *Server) {
+		s.watchdog = newWatchdog(limits)
+		s.scheduleWatchdog(limits.Every)
+	}
+}
+
+// WithDeadMan raises an alert when no station has reported a metric point
+// for a while, and keeps an outside monitor posted, if given one.
+func WithDeadMan(d DeadMan) Option {
+	return func(s *Server) {
+		s.deadman = newDeadMan(d, s.Clock.Now(), &s.log)
+		s.scheduleDeadMan(d.Every)
+	}
+}
+
+// WithHeartbeat POSTs the server's status, as JSON with how many stations
+// are online and offline and how many alerts are open and acknowledged, to
+// url every interval, so a monitor can tell when the server goes down.
+func WithHeartbeat(url string, every time.Duration) Option {
+	return func(s *Server) {
+		s.heartbeat = newHeartbeat(url)
+		s.scheduleHeartbeats(every)
+	}
+}
+
+// WithIdleTimeout disconnects clients that send nothing for clients, and
+// registered stations that send nothing for stations. Either can be 0 to
+// let them stay quiet as long as they like. Clients following a stream are
+// never idle.
+func WithIdleTimeout(clients, stations time.Duration) Option {
+	return func(s *Server) {
+		s.clientIdle = clients
+		s.stationIdle = stations
+	}
+}
+
+// WithEnvironment labels the server with the environment it's part of,
+// like prod or staging, which clients learn with HELLO. The shell and
+// pkg/client refuse to RUN functions in prod or production unless told to.
+func WithEnvironment(name string) Option {
+	return func(s *Server) {
+		s.environment = name
+	}
+}
+
+// WithBanner sends every client these lines, like which environment the
+// server is or a maintenance notice, right after it connects, as
+// motd MOTD [line]. Libraries ignore them; the shell shows them.
+func WithBanner(lines ...string) Option {
+	return func(s *Server) {
+		s.banner = append(s.banner, lines...)
+	}
+}
+
+// WithMaxConns limits the server to handling n connections at once. Any
+// more are answered with busy BUSY and closed.
+func WithMaxConns(n int) Option {
+	return func(s *Server) {
+		s.maxConns = n
+	}
+}
+
+// WithHandshakeTimeout gives connections d to finish their TLS handshake,
+// instead of 10 seconds, before they're closed.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.handshakeTimeout = d
+	}
+}
+
+// WithCoAP enables the CoAP gateway, for ServeCoAP and ServeCoAPConn.
+// Stations' sessions end once they've sent nothing for sessionTimeout.
+func WithCoAP(sessionTimeout time.Duration) Option {
+	return func(s *Server) {
+		s.coap = &coapGateway{
+			timeout:  sessionTimeout,
+			sessions: map[string]*coapSession{},
+		}
+		s.expireCoAPSessions()
+	}
+}
+
+// WithBye tells connected clients the server is going away, with
+// bye BYE, when it's shut down.
+func WithBye() Option {
+	return func(s *Server) {
+		s.bye = true
+	}
+}
+
+// WithCrashReports writes a report to dir when handling a connection
+// panics, before the server goes down, with the recent commands of every
+// connection and the stacks of every goroutine.
+func WithCrashReports(dir string) Option {
+	return func(s *Server) {
+		s.crashDir = dir
+	}
+}
+
+// WithDedup has each connection remember its answers to writes like METRIC
+// and RUN for window, so a command resent word for word under the same uid,
+// say after a timeout, is answered again rather than carried out twice.
+func WithDedup(window time.Duration) Option {
+	return func(s *Server) {
+		s.dedupWindow = window
+	}
+}
+
+// WithRateLimit limits each station to rate METRICs a second, with bursts of
+// up to burst, rejecting the rest with ERR RATE_LIMITED.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(s *Server) {
+		s.rateLimit = newRateLimit(rate, burst)
+		s.rateLimit.log = &s.log
+	}
+}
+
+// WithCatchUp throttles stations backfilling points (timestamped more than a
+// minute ago) to rate points a second between them, so that stations coming
+// back with a backlog can't crowd out live traffic.
+func WithCatchUp(rate int) Option {
+	return func(s *Server) {
+		s.catchUp = newCatchUp(rate)
+	}
+}
+
+// WithAuditor records every command sent to the server with a.
+func WithAuditor(a Auditor) Option {
+	return func(s *Server) {
+		s.audits = &audits{auditor: a}
+	}
+}
+
+// WithLogger logs to l, rather than the standard logger.
+func WithLogger(l Logger) Option {
+	return func(s *Server) {
+		s.log.set(l)
+	}
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+)
+
+type seriesKey struct {
+	station string
+	metric  string
+}
+
+// PointLog is a MetricStore that persists metric points to an append-only
+// file, so station history survives server restarts.
+//
+// Writes are batched: points are buffered until either batch of them are
+// waiting or interval has passed since the first, and then written with a
+// single fsync that every waiting METRIC shares (group commit). A station
+// only gets its ACK once its point is on disk.
+type PointLog struct {
+	path      string
+	maxPoints int
+	batch     int
+	interval  time.Duration
+	clock     clock.Clock
+	log       logTo
+
+	m       sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	waiters []chan error
+	timer   *clock.Timer
+
+	// the last maxPoints points of every series, which is all that's
+	// needed to rewrite the file when it gets too long.
+	series  map[seriesKey][]metric
+	live    int
+	written int
+}
+
+// OpenPointLog opens (or creates) a point log at path, keeping at most
+// maxPoints points per series.
+func OpenPointLog(path string, maxPoints, batch int, interval time.Duration, clock clock.Clock) (*PointLog, error) {
+	p := &PointLog{
+		path:      path,
+		maxPoints: maxPoints,
+		batch:     batch,
+		interval:  interval,
+		clock:     clock,
+
+		series: map[seriesKey][]metric{},
+	}
+
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+
+	// start from a compact file, which also gets rid of any line that was
+	// half written when we last went down.
+	if err := p.compact(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// SetLogger logs failures to compact the log to l, rather than the standard
+// logger.
+func (p *PointLog) SetLogger(l Logger) {
+	p.log.set(l)
+}
+
+func (p *PointLog) load() error {
+	f, err := os.Open(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "opening point log")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, m, err := parsePointLine(scanner.Text())
+		if err != nil {
+			p.log.Errorf("skipping bad line in %s: %v", p.path, err)
+			continue
+		}
+		p.add(key, m)
+	}
+
+	return errors.Wrap(scanner.Err(), "reading point log")
+}
+
+func formatPointLine(key seriesKey, m metric) string {
+	return fmt.Sprintf("%s %s %d %s\n", key.station, key.metric, m.ts.UnixNano(),
+		strconv.FormatFloat(m.value, 'g', -1, 64))
+}
+
+func parsePointLine(line string) (seriesKey, metric, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return seriesKey{}, metric{}, errors.Errorf("expected 4 fields in %q", line)
+	}
+
+	ns, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return seriesKey{}, metric{}, errors.Wrapf(err, "bad timestamp in %q", line)
+	}
+
+	value, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return seriesKey{}, metric{}, errors.Wrapf(err, "bad value in %q", line)
+	}
+
+	return seriesKey{fields[0], fields[1]}, metric{ts: time.Unix(0, ns), value: value}, nil
+}
+
+// add keeps a point in the in-memory copy of the series.
+func (p *PointLog) add(key seriesKey, m metric) {
+	before := len(p.series[key])
+	p.series[key], _ = insertMetric(p.series[key], m, p.maxPoints)
+	p.live += len(p.series[key]) - before
+}
+
+// compact rewrites the file with only the points still being kept, and
+// reopens it for appending.
+func (p *PointLog) compact() error {
+	tmp := p.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "compacting point log")
+	}
+
+	w := bufio.NewWriter(f)
+	for key, ms := range p.series {
+		for _, m := range ms {
+			w.WriteString(formatPointLine(key, m))
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "compacting point log")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "compacting point log")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "compacting point log")
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		return errors.Wrap(err, "compacting point log")
+	}
+
+	if p.f != nil {
+		p.f.Close()
+	}
+
+	p.f, err = os.OpenFile(p.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "reopening point log")
+	}
+	p.w = bufio.NewWriter(p.f)
+	p.written = p.live
+
+	return nil
+}
+
+// append queues a point to be written. The returned channel receives the
+// outcome once the batch it's in has been synced to disk.
+func (p *PointLog) append(station, name string, m metric) <-chan error {
+	done := make(chan error, 1)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	key := seriesKey{station, name}
+	p.add(key, m)
+
+	if _, err := p.w.WriteString(formatPointLine(key, m)); err != nil {
+		done <- errors.Wrap(err, "writing point log")
+		return done
+	}
+	p.written++
+	p.waiters = append(p.waiters, done)
+
+	switch {
+	case len(p.waiters) >= p.batch:
+		p.flushLocked()
+	case p.timer == nil:
+		p.timer = p.clock.AfterFunc(p.interval, func() {
+			p.m.Lock()
+			defer p.m.Unlock()
+
+			p.flushLocked()
+		})
+	}
+
+	return done
+}
+
+// flushLocked writes out the current batch with one fsync and tells
+// everyone waiting on it how it went. Must be called with m held.
+func (p *PointLog) flushLocked() {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if len(p.waiters) == 0 {
+		return
+	}
+
+	err := p.w.Flush()
+	if err == nil {
+		err = p.f.Sync()
+	}
+	if err != nil {
+		err = errors.Wrap(err, "syncing point log")
+	}
+
+	for _, done := range p.waiters {
+		done <- err
+	}
+	p.waiters = nil
+
+	// the file only ever grows, so every so often it's rewritten with just
+	// the points still being kept.
+	if err == nil && p.written > 2*p.live+1024 {
+		if err := p.compact(); err != nil {
+			p.log.Errorf("couldn't compact point log: %v", err)
+		}
+	}
+}
+
+// Append writes points, and returns once they've been synced to disk.
+func (p *PointLog) Append(points ...StoredPoint) error {
+	waiting := make([]<-chan error, 0, len(points))
+	for _, point := range points {
+		waiting = append(waiting, p.append(point.Station, point.Metric, metric{ts: point.Ts, value: point.Value}))
+	}
+
+	var err error
+	for _, done := range waiting {
+		if e := <-done; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Query returns every point kept for a station.
+func (p *PointLog) Query(station string) ([]StoredPoint, error) {
+	var points []StoredPoint
+	for name, ms := range p.history(station) {
+		for _, m := range ms {
+			points = append(points, storedPoint(station, name, m))
+		}
+	}
+	return points, nil
+}
+
+// history returns copies of every series kept for a station.
+func (p *PointLog) history(station string) map[string][]metric {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	out := map[string][]metric{}
+	for key, ms := range p.series {
+		if key.station == station {
+			out[key.metric] = append([]metric(nil), ms...)
+		}
+	}
+	return out
+}
+
+// Backup writes the points still being kept, as a compacted log.
+func (p *PointLog) Backup(w io.Writer) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for key, ms := range p.series {
+		for _, m := range ms {
+			bw.WriteString(formatPointLine(key, m))
+		}
+	}
+	return errors.Wrap(bw.Flush(), "backing up point log")
+}
+
+// Close flushes anything pending and closes the file.
+func (p *PointLog) Close() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.flushLocked()
+	return p.f.Close()
+}
+
+// Stations returns the name of every station with history in the log.
+func (p *PointLog) Stations() ([]string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	seen := map[string]bool{}
+	var names []string
+	for key := range p.series {
+		if !seen[key.station] {
+			seen[key.station] = true
+			names = append(names, key.station)
+		}
+	}
+	return names, nil
+}
+
+// Prune drops a station's history of metric, or of every metric if metric
+// is empty. It's gone from the file the next time the log is compacted.
+func (p *PointLog) Prune(station, metric string) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for key, ms := range p.series {
+		if key.station == station && (metric == "" || key.metric == metric) {
+			p.live -= len(ms)
+			delete(p.series, key)
+		}
+	}
+	return nil
+}
+
+// Expire drops every point from before cutoff. They're gone from the file the
+// next time the log is compacted.
+func (p *PointLog) Expire(cutoff time.Time) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for key, ms := range p.series {
+		kept := expired(ms, cutoff)
+		p.live -= len(ms) - len(kept)
+		if len(kept) > 0 {
+			p.series[key] = kept
+		} else {
+			delete(p.series, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func tempPointLogPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "drops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return filepath.Join(dir, "points")
+}
+
+func ready(done <-chan error) (error, bool) {
+	select {
+	case err := <-done:
+		return err, true
+	default:
+		return nil, false
+	}
+}
+
+func TestPointLogGroupCommit(t *testing.T) {
+	mock := clock.NewMock()
+	p, err := OpenPointLog(tempPointLogPath(t), 10, 3, time.Second, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	at := func(sec int64) metric { return metric{ts: time.Unix(sec, 0), value: float64(sec)} }
+
+	var waiting []<-chan error
+	for i := int64(1); i <= 2; i++ {
+		waiting = append(waiting, p.append("water", "level", at(i)))
+	}
+	for _, done := range waiting {
+		if _, ok := ready(done); ok {
+			t.Fatal("point was synced before its batch filled up")
+		}
+	}
+
+	// the third point fills the batch, and everyone shares its fsync.
+	waiting = append(waiting, p.append("water", "level", at(3)))
+	for _, done := range waiting {
+		if err, ok := ready(done); !ok || err != nil {
+			t.Fatalf("expected batch to be synced, got ok=%v err=%v", ok, err)
+		}
+	}
+
+	// a partial batch is synced once the interval passes.
+	done := p.append("water", "level", at(4))
+	if _, ok := ready(done); ok {
+		t.Fatal("point was synced before the interval passed")
+	}
+	mock.Add(time.Second)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("point wasn't synced after the interval passed")
+	}
+}
+
+func TestPointLogRestore(t *testing.T) {
+	path := tempPointLogPath(t)
+
+	p, err := OpenPointLog(path, 10, 1, time.Second, clock.NewMock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		if err := <-p.append("water", "level", metric{ts: time.Unix(i, 0), value: 0.5}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-p.append("jasmine", "moisture", metric{ts: time.Unix(1, 0), value: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopening with a smaller limit only keeps the newest points.
+	p, err = OpenPointLog(path, 2, 1, time.Second, clock.NewMock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	level := p.history("water")["level"]
+	if len(level) != 2 || level[0].ts.Unix() != 2 || level[1].ts.Unix() != 3 || level[1].value != 0.5 {
+		t.Fatalf("unexpected history %v", level)
+	}
+	if _, ok := p.history("water")["moisture"]; ok {
+		t.Fatal("history leaked between stations")
+	}
+}
+
+func TestServerRestoresPersistedMetrics(t *testing.T) {
+	path := tempPointLogPath(t)
+
+	for i, interactions := range [][]interaction{
+		{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 METRIC level 1", "2 ACK"},
+			{"3 METRIC level 2", "3 ACK"},
+		},
+		{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 METRICS water level", "2 METRICS water level 0:1.00 0:2.00"},
+		},
+	} {
+		points, err := OpenPointLog(path, 4, 1, time.Second, clock.NewMock())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := New(listener, 4, clock.NewMock(), WithMetricStore(points))
+		go server.Serve(context.Background())
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, in := range interactions {
+			if err := sendExpect(conn, in.send, in.expect); err != nil {
+				t.Fatalf("run %d: %v", i, err)
+			}
+		}
+
+		conn.Close()
+		points.Close()
+	}
+}
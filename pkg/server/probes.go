@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxProbeSources bounds how many source addresses we keep counts for, and
+// how many we keep denied, so a scan from a large address range can't grow
+// either table without limit.
+const maxProbeSources = 1024
+
+// Failure classes tracked per source address.
+const (
+	probeHandshake = "handshake" // the TLS handshake failed
+	probeBlocked   = "blocked"   // the client presented a blocklisted or revoked certificate
+	probeProtocol  = "protocol"  // garbage sent before any valid command
+)
+
+type probeSource struct {
+	counts   map[string]int
+	total    int
+	lastSeen time.Time
+}
+
+// probeTracker counts failed handshakes and pre-auth protocol violations
+// per source IP, and optionally denies repeat offenders for a while.
+type probeTracker struct {
+	m       sync.Mutex
+	sources map[string]*probeSource
+	denied  map[string]time.Time
+
+	// denyAfter failures from the same address within the table's memory
+	// get it denied for denyFor. Zero disables denying.
+	denyAfter int
+	denyFor   time.Duration
+}
+
+func newProbeTracker() *probeTracker {
+	return &probeTracker{
+		sources: map[string]*probeSource{},
+		denied:  map[string]time.Time{},
+	}
+}
+
+// sourceIP strips the port from a remote address.
+func sourceIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// record counts a failure from ip, and returns whether it got ip denied.
+func (p *probeTracker) record(ip, class string, now time.Time) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	src, ok := p.sources[ip]
+	if !ok {
+		if len(p.sources) >= maxProbeSources {
+			p.evictOldest()
+		}
+
+		src = &probeSource{counts: map[string]int{}}
+		p.sources[ip] = src
+	}
+
+	src.counts[class]++
+	src.total++
+	src.lastSeen = now
+
+	if p.denyAfter > 0 && src.total >= p.denyAfter {
+		if _, ok := p.denied[ip]; !ok && len(p.denied) >= maxProbeSources {
+			p.evictDenied(now)
+		}
+		p.denied[ip] = now.Add(p.denyFor)
+
+		// start counting afresh once the denial runs out.
+		delete(p.sources, ip)
+		return true
+	}
+
+	return false
+}
+
+func (p *probeTracker) evictOldest() {
+	var oldest string
+	for ip, src := range p.sources {
+		if oldest == "" || src.lastSeen.Before(p.sources[oldest].lastSeen) {
+			oldest = ip
+		}
+	}
+	delete(p.sources, oldest)
+}
+
+// evictDenied drops every denial that's run out, or if none has, the one
+// closest to running out.
+func (p *probeTracker) evictDenied(now time.Time) {
+	for ip, until := range p.denied {
+		if !now.Before(until) {
+			delete(p.denied, ip)
+		}
+	}
+	if len(p.denied) < maxProbeSources {
+		return
+	}
+
+	var soonest string
+	for ip, until := range p.denied {
+		if soonest == "" || until.Before(p.denied[soonest]) {
+			soonest = ip
+		}
+	}
+	delete(p.denied, soonest)
+}
+
+// isDenied reports whether connections from ip should be dropped on accept.
+func (p *probeTracker) isDenied(ip string, now time.Time) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	until, ok := p.denied[ip]
+	if !ok {
+		return false
+	}
+
+	if !now.Before(until) {
+		delete(p.denied, ip)
+		return false
+	}
+
+	return true
+}
+
+// recordProbe counts a failure from ip, and returns whether the connection
+// should be dropped because ip is now denied.
+func (s *Server) recordProbe(ip, class string) bool {
+	if s.probes.record(ip, class, s.Clock.Now()) {
+		s.log.Infof("denying %s for %s after repeated %s failures", ip, s.probes.denyFor, class)
+		return true
+	}
+	return false
+}
+
+// PROBES cmd (admin only)
+// Expected args: none
+func (s *Server) handleProbes(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 0 {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	s.probes.m.Lock()
+	defer s.probes.m.Unlock()
+
+	ips := make([]string, 0, len(s.probes.sources))
+	for ip := range s.probes.sources {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	buf := bytes.NewBufferString("PROBES")
+	for _, ip := range ips {
+		src := s.probes.sources[ip]
+		buf.WriteString(fmt.Sprintf(" %s:%s=%d,%s=%d,%s=%d", ip,
+			probeHandshake, src.counts[probeHandshake],
+			probeBlocked, src.counts[probeBlocked],
+			probeProtocol, src.counts[probeProtocol]))
+	}
+
+	now := s.Clock.Now()
+	denied := make([]string, 0, len(s.probes.denied))
+	for ip, until := range s.probes.denied {
+		if now.Before(until) {
+			denied = append(denied, ip)
+		}
+	}
+	sort.Strings(denied)
+
+	for _, ip := range denied {
+		buf.WriteString(fmt.Sprintf(" %s:denied=%d", ip, s.probes.denied[ip].Unix()))
+	}
+
+	return buf.String(), nil
+}
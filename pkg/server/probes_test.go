@@ -0,0 +1,32 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestProbeDeniedBounded(t *testing.T) {
+	p := newProbeTracker()
+	p.denyAfter = 1
+	p.denyFor = time.Minute
+	now := time.Unix(0, 0)
+
+	for i := 0; i < 2*maxProbeSources; i++ {
+		p.record(fmt.Sprintf("2001:db8::%x", i), probeHandshake, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if len(p.denied) != maxProbeSources {
+		t.Fatalf("expected %d addresses denied, got %d", maxProbeSources, len(p.denied))
+	}
+	// the denials closest to running out made way for newer ones.
+	if p.isDenied("2001:db8::0", now) || !p.isDenied(fmt.Sprintf("2001:db8::%x", 2*maxProbeSources-1), now) {
+		t.Fatal("expected the oldest denials to be dropped first")
+	}
+
+	// once denials have run out, they're swept rather than the newest evicted.
+	later := now.Add(time.Hour)
+	p.record("192.0.2.1", probeHandshake, later)
+	if len(p.denied) != 1 || !p.isDenied("192.0.2.1", later) {
+		t.Fatalf("expected expired denials to be swept, got %d left", len(p.denied))
+	}
+}
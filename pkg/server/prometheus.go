@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// Prometheus can scrape the server for every station's latest readings, as
+// well as for how the server itself is doing. Scrapers often can't present
+// client certificates, so /metrics can also be served on a listener of its
+// own.
+
+// MetricsHandler returns a handler serving only /metrics, for listeners
+// Prometheus scrapes that shouldn't expose the rest of the HTTP API.
+func (s *Server) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.httpMetrics)
+	return mux
+}
+
+// writeLatest writes the latest value of every metric of every station
+// that's online.
+func (s *Server) writeLatest(w io.Writer) {
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	names := make([]string, 0, len(s.stations))
+	for name := range s.stations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "# HELP drops_metric The latest value of each metric of each station online.\n")
+	fmt.Fprintf(w, "# TYPE drops_metric gauge\n")
+	for _, name := range names {
+		station := s.stations[name]
+		station.m.Lock()
+		metrics := make([]string, 0, len(station.metrics))
+		for metric, ms := range station.metrics {
+			if len(ms) > 0 {
+				metrics = append(metrics, metric)
+			}
+		}
+		sort.Strings(metrics)
+		for _, metric := range metrics {
+			ms := station.metrics[metric]
+			fmt.Fprintf(w, "drops_metric{station=%s,metric=%s} %g\n", promQuote(name), promQuote(metric), ms[len(ms)-1].value)
+		}
+		station.m.Unlock()
+	}
+}
+
+// internals is how busy the server is.
+type internals struct {
+	conns, refused  int
+	online, offline int
+	// runs waiting on a station to finish them, or to come back and take
+	// them.
+	pending int
+}
+
+func (s *Server) internals() internals {
+	var in internals
+
+	s.connsM.Lock()
+	in.conns, in.refused = len(s.conns), s.refused
+	s.connsM.Unlock()
+
+	s.stationsM.RLock()
+	in.online, in.offline = len(s.stations), len(s.lastSeen)
+	for _, station := range s.stations {
+		station.runsM.Lock()
+		in.pending += len(station.runs)
+		station.runsM.Unlock()
+	}
+	for _, o := range s.orphans {
+		in.pending += len(o.runs)
+	}
+	s.stationsM.RUnlock()
+
+	return in
+}
+
+// writeInternals writes how busy the server is.
+func (s *Server) writeInternals(w io.Writer) {
+	in := s.internals()
+
+	fmt.Fprintf(w, "# HELP drops_connections Open connections, from stations and clients alike.\n")
+	fmt.Fprintf(w, "# TYPE drops_connections gauge\n")
+	fmt.Fprintf(w, "drops_connections %d\n", in.conns)
+
+	fmt.Fprintf(w, "# HELP drops_connections_refused_total Connections turned away for going over the connection limit.\n")
+	fmt.Fprintf(w, "# TYPE drops_connections_refused_total counter\n")
+	fmt.Fprintf(w, "drops_connections_refused_total %d\n", in.refused)
+
+	fmt.Fprintf(w, "# HELP drops_stations Stations known to the server, by whether they're online.\n")
+	fmt.Fprintf(w, "# TYPE drops_stations gauge\n")
+	fmt.Fprintf(w, "drops_stations{state=\"online\"} %d\n", in.online)
+	fmt.Fprintf(w, "drops_stations{state=\"offline\"} %d\n", in.offline)
+
+	fmt.Fprintf(w, "# HELP drops_runs_pending Runs waiting on a station to finish them, or to come back and take them.\n")
+	fmt.Fprintf(w, "# TYPE drops_runs_pending gauge\n")
+	fmt.Fprintf(w, "drops_runs_pending %d\n", in.pending)
+}
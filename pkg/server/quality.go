@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The server keeps track of how well each station's metrics are reported:
+// points it refused, points it already had, and how far ahead of the
+// server's clock the station's timestamps are. Together with gaps in the
+// series themselves, QUALITY sums these up, so field techs can tell which
+// sensor needs looking at.
+
+// qualityEvents is how many events are kept per metric.
+const qualityEvents = 1000
+
+type qualityKind int
+
+const (
+	// a point the server refused, like one with a bad value or a timestamp
+	// too far in the future.
+	rejectedPoint qualityKind = iota
+	// a point the server already had.
+	duplicatePoint
+	// a point with an explicit timestamp, which says something about the
+	// station's clock.
+	timestampedPoint
+)
+
+type qualityEvent struct {
+	at   time.Time
+	kind qualityKind
+	// how far the point's timestamp was ahead of the server's clock, for
+	// points with one.
+	ahead time.Duration
+}
+
+// qualityTracker keeps recent quality events per station and metric.
+type qualityTracker struct {
+	m        sync.Mutex
+	stations map[string]map[string][]qualityEvent
+}
+
+func newQualityTracker() *qualityTracker {
+	return &qualityTracker{stations: map[string]map[string][]qualityEvent{}}
+}
+
+// record keeps an event about one of a station's metrics.
+func (q *qualityTracker) record(station, metric string, e qualityEvent) {
+	if station == "" {
+		return
+	}
+
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	metrics, ok := q.stations[station]
+	if !ok {
+		metrics = map[string][]qualityEvent{}
+		q.stations[station] = metrics
+	}
+
+	events := append(metrics[metric], e)
+	if len(events) > qualityEvents {
+		events = append([]qualityEvent(nil), events[len(events)-qualityEvents:]...)
+	}
+	metrics[metric] = events
+}
+
+// events returns a station's events by metric.
+func (q *qualityTracker) events(station string) map[string][]qualityEvent {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	events := map[string][]qualityEvent{}
+	for metric, es := range q.stations[station] {
+		events[metric] = es
+	}
+	return events
+}
+
+func (q *qualityTracker) rename(from, to string) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if metrics, ok := q.stations[from]; ok {
+		delete(q.stations, from)
+		q.stations[to] = metrics
+	}
+}
+
+func (q *qualityTracker) forget(station string) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	delete(q.stations, station)
+}
+
+// metricQuality sums up how well a metric was reported over a window.
+type metricQuality struct {
+	points     int
+	gaps       int
+	rejected   int
+	duplicates int
+	// the furthest a timestamp was ahead of the server's clock.
+	ahead time.Duration
+}
+
+func (m metricQuality) String() string {
+	return fmt.Sprintf("points:%d,gaps:%d,rejected:%d,duplicates:%d,skew:%s",
+		m.points, m.gaps, m.rejected, m.duplicates, m.ahead)
+}
+
+// countGaps counts the intervals between points that are more than twice
+// as long as the median interval, so a sensor that reports every minute and
+// one that reports every hour are each held to their own cadence.
+func countGaps(ms []metric) int {
+	if len(ms) < 3 {
+		return 0
+	}
+
+	intervals := make([]time.Duration, 0, len(ms)-1)
+	for i := 1; i < len(ms); i++ {
+		intervals = append(intervals, ms[i].ts.Sub(ms[i-1].ts))
+	}
+
+	sorted := append([]time.Duration(nil), intervals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+
+	gaps := 0
+	for _, d := range intervals {
+		if d > 2*median {
+			gaps++
+		}
+	}
+	return gaps
+}
+
+// defaultQualityWindow is how far back QUALITY looks without a from=.
+const defaultQualityWindow = 24 * time.Hour
+
+// QUALITY cmd
+// Expected args:
+//  - [name]
+//  - from=[time], to=[time], tz=[zone] (optional, the last day by default)
+func (s *Server) handleQuality(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 1 || len(args) > 4 {
+		return "", argCount(args)
+	}
+
+	name := args[0]
+	now := s.Clock.Now()
+
+	w, rest, err := parseTimeWindow(args[1:], now)
+	if err != nil {
+		return "", err
+	}
+	if len(rest) > 0 {
+		return "", errors.Errorf("unknown modifiers %v", rest)
+	}
+	if w.from.IsZero() {
+		w.from = now.Add(-defaultQualityWindow)
+	}
+
+	series, ok := s.snapshot(name)
+	if !ok && s.store != nil {
+		series = s.history(name)
+	}
+	events := s.quality.events(name)
+	if len(series) == 0 && len(events) == 0 {
+		return "", errors.Errorf("station %s is unknown to us", name)
+	}
+
+	quality := map[string]*metricQuality{}
+	get := func(metric string) *metricQuality {
+		if _, ok := quality[metric]; !ok {
+			quality[metric] = &metricQuality{}
+		}
+		return quality[metric]
+	}
+
+	for metric, ms := range series {
+		ms = w.filter(ms)
+		q := get(metric)
+		q.points = len(ms)
+		q.gaps = countGaps(ms)
+	}
+	for metric, es := range events {
+		q := get(metric)
+		for _, e := range es {
+			if !w.contains(e.at) {
+				continue
+			}
+			switch e.kind {
+			case rejectedPoint:
+				q.rejected++
+			case duplicatePoint:
+				q.duplicates++
+			}
+			if e.ahead > q.ahead {
+				q.ahead = e.ahead
+			}
+		}
+	}
+
+	metrics := make([]string, 0, len(quality))
+	for metric := range quality {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	buf := bytes.NewBufferString(fmt.Sprintf("QUALITY %s", name))
+	for _, metric := range metrics {
+		fmt.Fprintf(buf, " %s=%s", metric, quality[metric])
+	}
+
+	return buf.String(), nil
+}
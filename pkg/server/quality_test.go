@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestQuality(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	mock.Set(now)
+	server := New(listener, 10, mock)
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	station, client := dial(), dial()
+
+	at := func(d time.Duration) int64 {
+		return now.Add(d).Unix()
+	}
+
+	for _, in := range []struct {
+		conn net.Conn
+		interaction
+	}{
+		{station, interaction{"1 REGISTER water source", "1 ACK"}},
+
+		// a point a minute, but for a gap of five.
+		{station, interaction{fmt.Sprintf("2 METRIC level 1 %d", at(-10*time.Minute)), "2 ACK"}},
+		{station, interaction{fmt.Sprintf("3 METRIC level 2 %d", at(-9*time.Minute)), "3 ACK"}},
+		{station, interaction{fmt.Sprintf("4 METRIC level 3 %d", at(-8*time.Minute)), "4 ACK"}},
+		{station, interaction{fmt.Sprintf("5 METRIC level 4 %d", at(-3*time.Minute)), "5 ACK"}},
+		{station, interaction{fmt.Sprintf("6 METRIC level 5 %d", at(-2*time.Minute)), "6 ACK"}},
+
+		// sent twice.
+		{station, interaction{fmt.Sprintf("7 METRIC level 2 %d", at(-9*time.Minute)), "7 ACK"}},
+
+		// refused.
+		{station, interaction{"8 METRIC level lots", "8 ERR"}},
+		{station, interaction{fmt.Sprintf("9 METRIC level 6 %d", at(2*time.Minute)), "9 ERR"}},
+
+		// a little ahead of the server.
+		{station, interaction{fmt.Sprintf("10 METRIC temp 20 %d", at(30*time.Second)), "10 ACK"}},
+
+		{client, interaction{"1 QUALITY water", "1 QUALITY water " +
+			"level=points:5,gaps:1,rejected:2,duplicates:1,skew:2m0s " +
+			"temp=points:1,gaps:0,rejected:0,duplicates:0,skew:30s"}},
+		{client, interaction{"2 QUALITY water from=1m", "2 QUALITY water " +
+			"level=points:0,gaps:0,rejected:2,duplicates:1,skew:2m0s " +
+			"temp=points:1,gaps:0,rejected:0,duplicates:0,skew:30s"}},
+		{client, interaction{"3 QUALITY water to=yesterday", "3 QUALITY water " +
+			"level=points:0,gaps:0,rejected:0,duplicates:0,skew:0s " +
+			"temp=points:0,gaps:0,rejected:0,duplicates:0,skew:0s"}},
+		{client, interaction{"4 QUALITY ghost", "4 ERR"}},
+		{client, interaction{"5 QUALITY water LAST", "5 ERR"}},
+	} {
+		if err := sendExpect(in.conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCountGaps(t *testing.T) {
+	var ms []metric
+	for _, s := range []int64{0, 10, 20, 30, 100, 110, 200} {
+		ms = append(ms, metric{ts: time.Unix(s, 0)})
+	}
+	if gaps := countGaps(ms); gaps != 2 {
+		t.Fatalf("expected 2 gaps, got %d", gaps)
+	}
+	if gaps := countGaps(ms[:2]); gaps != 0 {
+		t.Fatalf("expected no gaps in 2 points, got %d", gaps)
+	}
+}
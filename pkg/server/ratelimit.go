@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A station stuck in a loop can send METRICs as fast as its link allows,
+// which keeps the server busy storing points nobody needs and holds up
+// everyone else. With rate limiting on, each station gets a token bucket of
+// its own, refilled at so many points a second and holding up to a burst of
+// them; METRICs beyond that are rejected with ERR RATE_LIMITED rather than
+// stored, so the station can tell it should back off.
+
+// codeRateLimited is what a METRIC over its station's budget is answered
+// with, strict or not.
+const codeRateLimited = "RATE_LIMITED"
+
+// errRateLimited is the error for a METRIC over its station's budget.
+var errRateLimited = &protocolError{code: codeRateLimited, msg: "station is over its point budget"}
+
+// bucket is one station's budget.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// whether the station's last point was rejected, to only log when it
+	// starts going over.
+	limited bool
+}
+
+// rateLimit keeps a budget per station.
+type rateLimit struct {
+	rate  float64
+	burst float64
+	log   *logTo
+
+	m       sync.Mutex
+	buckets map[string]*bucket
+	// how many points each station had rejected.
+	rejected map[string]int
+}
+
+func newRateLimit(rate float64, burst int) *rateLimit {
+	return &rateLimit{
+		rate:     rate,
+		burst:    float64(burst),
+		buckets:  map[string]*bucket{},
+		rejected: map[string]int{},
+	}
+}
+
+// allow takes a point's worth of a station's budget, if there's any left.
+func (r *rateLimit) allow(station string, now time.Time) bool {
+	return r.allowN(station, 1, now) == 1
+}
+
+// allowN takes n points' worth of a station's budget if there's that much
+// left, and returns n. Otherwise it takes none, so a batch is either
+// covered or rejected whole, and returns how many points the budget covers.
+func (r *rateLimit) allowN(station string, n int, now time.Time) int {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	b, ok := r.buckets[station]
+	if !ok {
+		b = &bucket{tokens: r.burst, last: now}
+		r.buckets[station] = b
+	}
+	if now.After(b.last) {
+		b.tokens = min(r.burst, b.tokens+now.Sub(b.last).Seconds()*r.rate)
+		b.last = now
+	}
+
+	if b.tokens < float64(n) {
+		if !b.limited {
+			r.log.Errorf("station %s is sending points faster than %g a second, rejecting them", station, r.rate)
+		}
+		b.limited = true
+		r.rejected[station] += n
+		return int(b.tokens)
+	}
+
+	b.tokens -= float64(n)
+	b.limited = false
+	return n
+}
+
+// rename moves a station's budget and count along with it.
+func (r *rateLimit) rename(from, to string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if b, ok := r.buckets[from]; ok {
+		delete(r.buckets, from)
+		r.buckets[to] = b
+	}
+	if n, ok := r.rejected[from]; ok {
+		delete(r.rejected, from)
+		r.rejected[to] += n
+	}
+}
+
+func (r *rateLimit) writePrometheus(w io.Writer) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	stations := make([]string, 0, len(r.rejected))
+	for station := range r.rejected {
+		stations = append(stations, station)
+	}
+	sort.Strings(stations)
+
+	fmt.Fprintf(w, "# HELP drops_rate_limited_points_total Points rejected for going over their station's rate limit.\n")
+	fmt.Fprintf(w, "# TYPE drops_rate_limited_points_total counter\n")
+	for _, station := range stations {
+		fmt.Fprintf(w, "drops_rate_limited_points_total{station=%s} %d\n", promQuote(station), r.rejected[station])
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestRateLimitAllow(t *testing.T) {
+	r := newRateLimit(2, 3)
+	now := time.Unix(0, 0)
+
+	for i, want := range []bool{true, true, true, false, false} {
+		if got := r.allow("water", now); got != want {
+			t.Fatalf("point %d: expected %v, got %v", i, want, got)
+		}
+	}
+	// other stations have budgets of their own.
+	if !r.allow("air", now) {
+		t.Fatal("expected another station's point to be allowed")
+	}
+
+	// the bucket refills as time goes by, but only up to the burst.
+	now = now.Add(500 * time.Millisecond)
+	if !r.allow("water", now) || r.allow("water", now) {
+		t.Fatal("expected half a second to refill a single point")
+	}
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		if !r.allow("water", now) {
+			t.Fatalf("point %d after a while: expected to be allowed", i)
+		}
+	}
+	if r.allow("water", now) {
+		t.Fatal("expected the bucket to only hold the burst")
+	}
+	if r.rejected["water"] != 4 || r.rejected["air"] != 0 {
+		t.Fatalf("unexpected rejected counts %v", r.rejected)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	server := New(listener, 10, mock, WithRateLimit(1, 2))
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, in := range []struct{ send, expect string }{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 METRIC level 1", "2 ACK"},
+		{"3 METRIC level 2", "3 ACK"},
+		// the server isn't strict, but rate limiting is still spelled out.
+		{"4 METRIC level 3", "4 ERR RATE_LIMITED"},
+		// other commands aren't limited.
+		{"5 PING", "5 PONG"},
+	} {
+		if err := sendExpect(conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mock.Add(time.Second)
+	if err := sendExpect(conn, "6 METRIC level 4", "6 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	server.rateLimit.writePrometheus(&buf)
+	if !strings.Contains(buf.String(), `drops_rate_limited_points_total{station="water"} 1`) {
+		t.Fatalf("expected the rejected point to be counted, got\n%s", buf.String())
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// Stations on flaky links can die without their connection ever being
+// closed, and would linger in LIST forever. With the reaper on, stations
+// have to be heard from, by PING or METRIC, every so often: the ones that
+// go quiet for too long are taken offline as if they'd disconnected, and
+// their connection is closed.
+
+// PING cmd
+// Expected args: none
+func (s *Server) handlePing(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 0 {
+		return "", argCount(args)
+	}
+
+	// anyone can PING, but it only counts for stations.
+	if conn.name != "" {
+		s.heardFrom(conn)
+	}
+	return "PONG", nil
+}
+
+// heardFrom records that a connection's station is still there.
+func (s *Server) heardFrom(conn *clientConn) {
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	station, ok := s.stations[conn.name]
+	if !ok || station.c != conn {
+		return
+	}
+
+	station.m.Lock()
+	station.heard = s.Clock.Now()
+	station.m.Unlock()
+}
+
+// scheduleReaps runs the reaper every interval.
+func (s *Server) scheduleReaps(every time.Duration) {
+	s.Clock.AfterFunc(every, func() {
+		s.reap()
+		s.scheduleReaps(every)
+	})
+}
+
+// reap takes offline the stations that haven't been heard from for longer
+// than reapAfter.
+func (s *Server) reap() {
+	now := s.Clock.Now()
+
+	s.stationsM.Lock()
+	defer s.stationsM.Unlock()
+
+	for name, station := range s.stations {
+		station.m.Lock()
+		silent := now.Sub(station.heard)
+		station.m.Unlock()
+
+		// virtual stations have no connection to go quiet.
+		if station.virtual || silent < s.reapAfter {
+			continue
+		}
+
+		s.log.Infof("Reaping %s, silent for %s.", name, silent)
+		if _, ok := s.dropStation(station.c); !ok {
+			continue
+		}
+		s.abandonRuns(name, station)
+		s.event("reap", name, "silent for %s", silent)
+
+		// the connection's handler finds it closed, and the station gone.
+		station.c.Close()
+	}
+}
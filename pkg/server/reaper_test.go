@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestReaper(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 10, mock, WithReaper(30*time.Second, 10*time.Second))
+	go server.Serve(context.Background())
+
+	conns := map[string]net.Conn{}
+	for _, name := range []string{"pinging", "reporting", "silent"} {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sendExpect(conn, "1 REGISTER "+name+" source", "1 ACK"); err != nil {
+			t.Fatal(err)
+		}
+		conns[name] = conn
+	}
+
+	online := func() map[string]bool {
+		server.stationsM.RLock()
+		defer server.stationsM.RUnlock()
+
+		names := map[string]bool{}
+		for name := range server.stations {
+			names[name] = true
+		}
+		return names
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := sendExpect(conns["pinging"], "2 PING", "2 PONG"); err != nil {
+			t.Fatal(err)
+		}
+		if err := sendExpect(conns["reporting"], "3 METRIC level 1", "3 ACK"); err != nil {
+			t.Fatal(err)
+		}
+		mock.Add(10 * time.Second)
+	}
+
+	waitFor(t, "the silent station to be reaped", func() bool {
+		return len(online()) == 2
+	})
+	if names := online(); !names["pinging"] || !names["reporting"] {
+		t.Fatalf("expected the pinging and reporting stations to be online, got %v", names)
+	}
+
+	// its connection is closed.
+	if _, err := conns["silent"].Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the silent station's connection to be closed, got %v", err)
+	}
+
+	server.journal.m.Lock()
+	last := server.journal.events[len(server.journal.events)-1]
+	server.journal.m.Unlock()
+	if last.kind != "reap" || last.station != "silent" {
+		t.Fatalf("expected the silent station to be reaped, got %+v", last)
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/benbjohnson/clock"
+)
+
+// orphans are the in-flight runs of a station whose connection dropped,
+// held until it registers again or the redelivery window runs out.
+type orphans struct {
+	runs  map[string]*run
+	timer *clock.Timer
+}
+
+// sendRun routes a RUN to a station connection.
+func sendRun(c *clientConn, uid string, r *run) {
+	if r.param != "" {
+		fmt.Fprintf(c, "%s RUN %s %s\n", uid, r.fn, r.param)
+		return
+	}
+	fmt.Fprintf(c, "%s RUN %s\n", uid, r.fn)
+}
+
+// abandonRuns deals with the in-flight runs of a station that has just
+// disconnected. Runs that aren't idempotent fail right away, since we can't
+// know whether the station got to them. Idempotent runs are kept for
+// redelivery if the server allows it. Must be called with stationsM held.
+func (s *Server) abandonRuns(name string, station *Station) {
+	station.runsM.Lock()
+	defer station.runsM.Unlock()
+
+	kept := map[string]*run{}
+	for uid, r := range station.runs {
+		if r.idempotent && s.redeliveryWindow > 0 {
+			kept[uid] = r
+			continue
+		}
+
+		s.failRun(name, uid, r, "DISCONNECTED")
+	}
+	station.runs = map[string]*run{}
+
+	if len(kept) == 0 {
+		return
+	}
+
+	s.holdOrphans(name, &orphans{runs: kept})
+}
+
+// failRun tells the client of a run that the station won't be finishing it,
+// and why.
+func (s *Server) failRun(name, uid string, r *run, reason string) {
+	fmt.Fprintf(r.client, "%s ERR %s\n", uid, reason)
+	s.finishRun(name, r, false)
+	s.event("run.err", name, "%s %s", r.fn, reason)
+}
+
+// holdOrphans keeps a station's orphaned runs until it registers again, or
+// fails them when the redelivery window runs out. Must be called with
+// stationsM held.
+func (s *Server) holdOrphans(name string, o *orphans) {
+	o.timer = s.Clock.AfterFunc(s.redeliveryWindow, func() {
+		s.stationsM.Lock()
+		defer s.stationsM.Unlock()
+
+		// the station may have come back in the meantime.
+		if s.orphans[name] != o {
+			return
+		}
+		delete(s.orphans, name)
+
+		for uid, r := range o.runs {
+			s.failRun(name, uid, r, "DISCONNECTED")
+		}
+	})
+	s.orphans[name] = o
+}
+
+// redeliverRuns hands a station's orphaned runs to its new connection. Must
+// be called with stationsM held.
+func (s *Server) redeliverRuns(name string, station *Station) {
+	o, ok := s.orphans[name]
+	if !ok {
+		return
+	}
+	o.timer.Stop()
+	delete(s.orphans, name)
+
+	station.runsM.Lock()
+	defer station.runsM.Unlock()
+
+	for uid, r := range o.runs {
+		station.runs[uid] = r
+	}
+
+	s.log.Infof("Redelivering %d runs to %s.", len(o.runs), name)
+
+	// the station should see its REGISTER acknowledged before any RUNs.
+	station.c.after(func() {
+		for uid, r := range o.runs {
+			sendRun(station.c, uid, r)
+		}
+	})
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// rename moves everything the server knows about a station to a new name,
+// and makes the old name an alias of the new one, so a station still
+// registering under its old name shows up under the new one. A connected
+// station is disconnected so it comes back under its new name.
+func (s *Server) rename(from, to string) error {
+	if from == to {
+		return errors.Errorf("%s is already called that", from)
+	}
+	if strings.Contains(to, "=") || to == "*" {
+		return errors.Errorf("bad station name %s", to)
+	}
+
+	known := map[string]bool{}
+	for _, name := range s.knownStations() {
+		known[name] = true
+	}
+
+	s.stationsM.Lock()
+	if _, ok := s.stations[to]; ok || known[to] {
+		s.stationsM.Unlock()
+		return errors.Errorf("station %s already exists", to)
+	}
+
+	station, online := s.stations[from]
+	if !online && !known[from] {
+		s.stationsM.Unlock()
+		return errors.Errorf("station %s is unknown to us", from)
+	}
+	if online && station.virtual {
+		s.stationsM.Unlock()
+		return errors.Errorf("station %s is virtual", from)
+	}
+
+	if online {
+		delete(s.stations, from)
+		s.watchers.left(from)
+		s.abandonRuns(from, station)
+		if s.reports != nil {
+			s.reports.down(from, s.Clock.Now())
+		}
+		station.c.Close()
+		s.lastSeen[from] = s.Clock.Now()
+
+		// without a point log, the history would go with the connection, so
+		// it waits for the station to come back like LOADed state does.
+		r := s.restoredStation(from)
+		if r.tipe == "" {
+			r.tipe = station.tipe
+		}
+		r.tags = station.tags
+		if s.store == nil {
+			station.m.Lock()
+			for m, ms := range station.metrics {
+				r.metrics[m] = ms
+			}
+			station.m.Unlock()
+		}
+	}
+
+	if o, ok := s.orphans[from]; ok {
+		// the redelivery window starts over under the new name.
+		o.timer.Stop()
+		delete(s.orphans, from)
+		s.holdOrphans(to, o)
+	}
+	if r, ok := s.restored[from]; ok {
+		delete(s.restored, from)
+		s.restored[to] = r
+	}
+	if seen, ok := s.lastSeen[from]; ok {
+		delete(s.lastSeen, from)
+		s.lastSeen[to] = seen
+	}
+	if l, ok := s.locations[from]; ok {
+		delete(s.locations, from)
+		s.locations[to] = l
+	}
+	if c, ok := s.configs[from]; ok {
+		delete(s.configs, from)
+		s.configs[to] = c
+	}
+
+	// names that were already aliases of the old one follow it.
+	for alias, name := range s.aliases {
+		if name == from {
+			s.aliases[alias] = to
+		}
+	}
+	delete(s.aliases, to)
+	s.aliases[from] = to
+	s.stationsM.Unlock()
+
+	s.logs.m.Lock()
+	if sl, ok := s.logs.logs[from]; ok {
+		delete(s.logs.logs, from)
+		s.logs.logs[to] = sl
+	}
+	s.logs.m.Unlock()
+
+	s.notes.rename(from, to)
+	s.alerts.rename(from, to)
+	s.thresholds.rename(from, to)
+
+	s.runStats.m.Lock()
+	if fns, ok := s.runStats.stations[from]; ok {
+		delete(s.runStats.stations, from)
+		s.runStats.stations[to] = fns
+	}
+	s.runStats.m.Unlock()
+
+	s.slos.rename(from, to)
+	s.quality.rename(from, to)
+	if s.rateLimit != nil {
+		s.rateLimit.rename(from, to)
+	}
+	if s.reports != nil {
+		s.reports.rename(from, to)
+	}
+	s.journal.rename(from, to)
+	s.subscribers.rename(from, to)
+
+	if s.store != nil {
+		if err := s.store.Rename(from, to); err != nil {
+			return err
+		}
+	}
+	if s.export != nil {
+		s.export.rename(from, to)
+	}
+	if s.cache != nil {
+		s.cache.invalidateAll()
+	}
+
+	return nil
+}
+
+// rename moves a station's objective states to its new name.
+func (t *sloTracker) rename(from, to string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for key, st := range t.states {
+		i := strings.Index(key, "/")
+		if key[i+1:] == from {
+			delete(t.states, key)
+			t.states[key[:i+1]+to] = st
+		}
+	}
+}
+
+// rename points subscribers following a station at its new name.
+func (j *journal) rename(from, to string) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	for sub := range j.subscribers {
+		if sub.station == from {
+			sub.station = to
+		}
+	}
+}
+
+// Rename moves a station's history to its new name, and rewrites the file so
+// it's kept under the new name from now on.
+func (p *PointLog) Rename(from, to string) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	renamed := false
+	for key, ms := range p.series {
+		if key.station == from {
+			delete(p.series, key)
+			p.series[seriesKey{to, key.metric}] = ms
+			renamed = true
+		}
+	}
+	if !renamed {
+		return nil
+	}
+
+	// anything still waiting to be synced is rewritten by the compaction.
+	p.flushLocked()
+	return p.compact()
+}
+
+// rename files a station's points that haven't been exported yet under its
+// new name.
+func (e *exporter) rename(from, to string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	for key, rows := range e.pending {
+		if key.station != from {
+			continue
+		}
+
+		for i := range rows {
+			rows[i].Labels["station"] = to
+		}
+		delete(e.pending, key)
+
+		moved := exportKey{to, key.hour}
+		e.pending[moved] = append(e.pending[moved], rows...)
+	}
+}
+
+// RENAME cmd (admin only)
+// Expected args:
+//  - [old name]
+//  - [new name]
+func (s *Server) handleRename(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 2 {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	from, to := args[0], args[1]
+	if err := s.rename(from, to); err != nil {
+		return "", err
+	}
+
+	s.event("rename", to, "from %s", from)
+	return "ACK", nil
+}
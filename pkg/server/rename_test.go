@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestRename(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock(), TrustPlaintext())
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	station, follower, admin := dial(), dial(), dial()
+	defer follower.Close()
+	defer admin.Close()
+
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 METRIC level 1", "2 ACK"},
+		{"3 LOG info hello", "3 ACK"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logs := bufio.NewReader(follower)
+	fmt.Fprintf(follower, "f LOGS water -f\n")
+	if err := expectLines(logs, "f LOG water 0 info hello", "f LOGS water 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []interaction{
+		{"1 RENAME water tank", "1 ACK"},
+		{"2 RENAME water tank", "2 ERR"},
+		{"3 RENAME nothing else", "3 ERR"},
+	} {
+		if err := sendExpect(admin, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the station is disconnected, and comes back under its new name even
+	// though it still registers as water.
+	if err := expectClosed(station); err != nil {
+		t.Fatal(err)
+	}
+
+	station = dial()
+	defer station.Close()
+
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 METRICS tank level", "2 METRICS tank level 0:1.00"},
+		{"3 LIST", "3 LIST tank:source:100"},
+		{"4 LOG info renamed", "4 ACK"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// followers of the old name now follow the new one.
+	if err := expectLines(logs, "f LOG tank 0 info renamed"); err != nil {
+		t.Fatal(err)
+	}
+}
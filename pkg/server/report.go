@@ -0,0 +1,405 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Reports summarize a day or a week of the fleet: each station's uptime, the
+// min, max and average of each of its metrics, and the alerts it fired. They
+// go out through the notification sinks at midnight, as report.daily and
+// report.weekly notifications whose Message is plain text and HTML is, well,
+// HTML, for small utilities that would rather read a morning email than
+// watch a dashboard.
+
+// ReportPeriod is how much time a report covers.
+type ReportPeriod int
+
+const (
+	// Daily reports cover the day before, and go out at midnight.
+	Daily ReportPeriod = iota
+	// Weekly reports cover the week before, and go out at midnight on
+	// Mondays.
+	Weekly
+)
+
+func (p ReportPeriod) String() string {
+	if p == Weekly {
+		return "weekly"
+	}
+	return "daily"
+}
+
+// ParseReportPeriod reads daily or weekly.
+func ParseReportPeriod(v string) (ReportPeriod, error) {
+	switch v {
+	case "daily":
+		return Daily, nil
+	case "weekly":
+		return Weekly, nil
+	}
+	return 0, errors.Errorf("unknown report period %q", v)
+}
+
+// start returns when the period containing t started, in loc.
+func (p ReportPeriod) start(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	if p == Weekly {
+		// weeks start on Monday.
+		midnight = midnight.AddDate(0, 0, -(int(midnight.Weekday())+6)%7)
+	}
+	return midnight
+}
+
+// next returns when the period after the one containing t starts, in loc.
+func (p ReportPeriod) next(t time.Time, loc *time.Location) time.Time {
+	start := p.start(t, loc)
+	if p == Weekly {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// reportHistory is how long what reports need is kept for: a week, and some
+// slack for late reports.
+const reportHistory = 8 * 24 * time.Hour
+
+// session is a stretch of time a station was online. A zero end means it
+// still is.
+type session struct {
+	start, end time.Time
+}
+
+// reporter keeps what reports need beyond the stations' series.
+type reporter struct {
+	loc *time.Location
+
+	m        sync.Mutex
+	sessions map[string][]session
+	alerts   []Notification
+}
+
+func newReporter(loc *time.Location) *reporter {
+	return &reporter{loc: loc, sessions: map[string][]session{}}
+}
+
+// up records a station coming online.
+func (r *reporter) up(name string, now time.Time) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.sessions[name] = append(r.sessions[name], session{start: now})
+	r.prune(now)
+}
+
+// down records a station going offline.
+func (r *reporter) down(name string, now time.Time) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	ss := r.sessions[name]
+	if len(ss) > 0 && ss[len(ss)-1].end.IsZero() {
+		ss[len(ss)-1].end = now
+	}
+}
+
+// alert records a notification that fired.
+func (r *reporter) alert(n Notification) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.alerts = append(r.alerts, n)
+	r.prune(n.Time)
+}
+
+// prune drops what's too old to be in any report. Must be called with m
+// held.
+func (r *reporter) prune(now time.Time) {
+	cutoff := now.Add(-reportHistory)
+
+	for name, ss := range r.sessions {
+		i := 0
+		for i < len(ss) && !ss[i].end.IsZero() && ss[i].end.Before(cutoff) {
+			i++
+		}
+		if i == len(ss) {
+			delete(r.sessions, name)
+		} else if i > 0 {
+			r.sessions[name] = append([]session(nil), ss[i:]...)
+		}
+	}
+
+	i := 0
+	for i < len(r.alerts) && r.alerts[i].Time.Before(cutoff) {
+		i++
+	}
+	if i > 0 {
+		r.alerts = append([]Notification(nil), r.alerts[i:]...)
+	}
+}
+
+// rename moves a station's sessions and alerts to its new name.
+func (r *reporter) rename(from, to string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if ss, ok := r.sessions[from]; ok {
+		delete(r.sessions, from)
+		r.sessions[to] = append(r.sessions[to], ss...)
+	}
+	for i := range r.alerts {
+		if r.alerts[i].Station == from {
+			r.alerts[i].Station = to
+		}
+	}
+}
+
+// uptime returns how long each station that was online at all between from
+// and to was online for.
+func (r *reporter) uptime(from, to time.Time) map[string]time.Duration {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	up := map[string]time.Duration{}
+	for name, ss := range r.sessions {
+		for _, s := range ss {
+			start, end := s.start, s.end
+			if end.IsZero() || end.After(to) {
+				end = to
+			}
+			if start.Before(from) {
+				start = from
+			}
+			if end.After(start) {
+				up[name] += end.Sub(start)
+			}
+		}
+	}
+	return up
+}
+
+// fired returns the alerts that fired between from and to, by station.
+func (r *reporter) fired(from, to time.Time) map[string][]Notification {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	fired := map[string][]Notification{}
+	for _, n := range r.alerts {
+		if !n.Time.Before(from) && n.Time.Before(to) {
+			fired[n.Station] = append(fired[n.Station], n)
+		}
+	}
+	return fired
+}
+
+// metricSummary sums up a metric's points over a report's period.
+type metricSummary struct {
+	Name          string
+	Min, Max, Avg float64
+	Points        int
+}
+
+// alertSummary counts the alerts of one kind a station fired.
+type alertSummary struct {
+	Kind  string
+	Count int
+}
+
+// stationSummary is a station's part of a report.
+type stationSummary struct {
+	Name    string
+	Type    string
+	Uptime  float64
+	Metrics []metricSummary
+	Alerts  []alertSummary
+}
+
+// report is the summary of the fleet over a period.
+type report struct {
+	Period   ReportPeriod
+	From, To time.Time
+	Stations []stationSummary
+	Alerts   int
+}
+
+// summarize sums up the fleet between from and to.
+func (s *Server) summarize(p ReportPeriod, from, to time.Time) report {
+	rep := report{Period: p, From: from, To: to}
+
+	up := s.reports.uptime(from, to)
+	fired := s.reports.fired(from, to)
+
+	names := map[string]bool{}
+	for name := range up {
+		names[name] = true
+	}
+	for name := range fired {
+		if name != "" {
+			names[name] = true
+		}
+	}
+
+	s.stationsM.RLock()
+	types := map[string]string{}
+	virtual := map[string]bool{}
+	for name, station := range s.stations {
+		if station.virtual {
+			names[name] = true
+			virtual[name] = true
+		}
+		types[name] = station.tipe
+	}
+	s.stationsM.RUnlock()
+
+	for name := range names {
+		ss := stationSummary{Name: name, Type: types[name]}
+		ss.Uptime = float64(up[name]) / float64(to.Sub(from))
+		if virtual[name] {
+			ss.Uptime = 1
+		}
+
+		series, ok := s.snapshot(name)
+		if !ok && s.store != nil {
+			series = s.history(name)
+		}
+		for metric, ms := range series {
+			sum := metricSummary{Name: metric, Min: math.Inf(1), Max: math.Inf(-1)}
+			total := 0.0
+			for _, m := range ms {
+				if m.ts.Before(from) || !m.ts.Before(to) {
+					continue
+				}
+				sum.Points++
+				total += m.value
+				sum.Min = math.Min(sum.Min, m.value)
+				sum.Max = math.Max(sum.Max, m.value)
+			}
+			if sum.Points > 0 {
+				sum.Avg = total / float64(sum.Points)
+				ss.Metrics = append(ss.Metrics, sum)
+			}
+		}
+		sort.Slice(ss.Metrics, func(i, j int) bool { return ss.Metrics[i].Name < ss.Metrics[j].Name })
+
+		counts := map[string]int{}
+		for _, n := range fired[name] {
+			counts[n.Kind]++
+			rep.Alerts++
+		}
+		for kind, count := range counts {
+			ss.Alerts = append(ss.Alerts, alertSummary{Kind: kind, Count: count})
+		}
+		sort.Slice(ss.Alerts, func(i, j int) bool { return ss.Alerts[i].Kind < ss.Alerts[j].Kind })
+
+		rep.Stations = append(rep.Stations, ss)
+	}
+	sort.Slice(rep.Stations, func(i, j int) bool { return rep.Stations[i].Name < rep.Stations[j].Name })
+
+	// alerts about the server itself.
+	rep.Alerts += len(fired[""])
+
+	return rep
+}
+
+// title names the report, like "Daily report for 2024-06-01".
+func (r report) title() string {
+	if r.Period == Weekly {
+		return fmt.Sprintf("Weekly report for %s to %s", r.From.Format("2006-01-02"), r.To.AddDate(0, 0, -1).Format("2006-01-02"))
+	}
+	return fmt.Sprintf("Daily report for %s", r.From.Format("2006-01-02"))
+}
+
+// text renders the report as plain text.
+func (r report) text() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s (%s)\n", r.title(), r.From.Location())
+	fmt.Fprintf(&buf, "%d stations, %d alerts fired\n", len(r.Stations), r.Alerts)
+
+	for _, st := range r.Stations {
+		name := st.Name
+		if st.Type != "" {
+			name += " (" + st.Type + ")"
+		}
+		fmt.Fprintf(&buf, "\n%s: up %.1f%%\n", name, st.Uptime*100)
+		for _, m := range st.Metrics {
+			fmt.Fprintf(&buf, "  %s: min %.2f, max %.2f, avg %.2f (%d points)\n", m.Name, m.Min, m.Max, m.Avg, m.Points)
+		}
+		if len(st.Alerts) > 0 {
+			var alerts []string
+			for _, a := range st.Alerts {
+				alerts = append(alerts, fmt.Sprintf("%s x%d", a.Kind, a.Count))
+			}
+			fmt.Fprintf(&buf, "  alerts: %s\n", strings.Join(alerts, ", "))
+		}
+	}
+
+	return buf.String()
+}
+
+var reportHTML = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+	"value":   func(f float64) string { return fmt.Sprintf("%.2f", f) },
+}).Parse(`<html><body>
+<h1>{{.Title}}</h1>
+<p>{{len .Stations}} stations, {{.Alerts}} alerts fired ({{.Zone}})</p>
+{{range .Stations}}<h2>{{.Name}}{{if .Type}} ({{.Type}}){{end}}</h2>
+<p>Up {{percent .Uptime}}{{range $i, $a := .Alerts}}{{if eq $i 0}}; alerts: {{else}}, {{end}}{{$a.Kind}} x{{$a.Count}}{{end}}</p>
+{{if .Metrics}}<table>
+<tr><th>Metric</th><th>Min</th><th>Max</th><th>Avg</th><th>Points</th></tr>
+{{range .Metrics}}<tr><td>{{.Name}}</td><td>{{value .Min}}</td><td>{{value .Max}}</td><td>{{value .Avg}}</td><td>{{.Points}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}</body></html>
+`))
+
+// html renders the report as an HTML document.
+func (r report) html() (string, error) {
+	var buf bytes.Buffer
+	err := reportHTML.Execute(&buf, struct {
+		report
+		Title string
+		Zone  string
+	}{r, r.title(), r.From.Location().String()})
+	return buf.String(), err
+}
+
+// scheduleReport sends a report when the period after the one containing
+// after ends, and schedules the one after that.
+func (s *Server) scheduleReport(p ReportPeriod, after time.Time) {
+	next := p.next(after, s.reports.loc)
+	s.Clock.AfterFunc(next.Sub(s.Clock.Now()), func() {
+		s.sendReport(p, next)
+		s.scheduleReport(p, next)
+	})
+}
+
+// sendReport hands the report on the period that ended at end to every
+// notification sink.
+func (s *Server) sendReport(p ReportPeriod, end time.Time) {
+	from := p.start(end.Add(-time.Nanosecond), s.reports.loc)
+	r := s.summarize(p, from, end)
+
+	html, err := r.html()
+	if err != nil {
+		s.log.Errorf("couldn't render report: %v", err)
+	}
+	n := Notification{
+		Kind:    "report." + p.String(),
+		Message: r.text(),
+		HTML:    html,
+		Time:    s.Clock.Now(),
+	}
+
+	s.log.Infof("sending %s", r.title())
+	for _, sink := range s.notifiers {
+		sink.Notify(n)
+	}
+}
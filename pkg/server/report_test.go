@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestReportPeriods(t *testing.T) {
+	// a Saturday afternoon.
+	now := time.Date(2024, 6, 1, 15, 0, 0, 0, time.UTC)
+
+	for _, c := range []struct {
+		p           ReportPeriod
+		start, next time.Time
+	}{
+		{Daily, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)},
+		{Weekly, time.Date(2024, 5, 27, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)},
+	} {
+		if got := c.p.start(now, time.UTC); !got.Equal(c.start) {
+			t.Errorf("%s: expected the period to start at %s, got %s", c.p, c.start, got)
+		}
+		if got := c.p.next(now, time.UTC); !got.Equal(c.next) {
+			t.Errorf("%s: expected the next period to start at %s, got %s", c.p, c.next, got)
+		}
+	}
+
+	if _, err := ParseReportPeriod("hourly"); err == nil {
+		t.Error("expected an error parsing hourly")
+	}
+}
+
+func TestDailyReport(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notifications := make(chan Notification, 10)
+
+	mock := clock.NewMock()
+	mock.Set(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	server := New(listener, 4, mock,
+		WithReports(time.UTC, Daily),
+		WithSLOs(SLO{Function: "read", Target: 0.9, Window: time.Hour, Burn: 1, Min: 1}),
+		WithNotifier(NotifierFunc(func(n Notification) { notifications <- n })),
+	)
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	water, tank, client := dial(), dial(), dial()
+
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 METRIC level 1", "2 ACK"},
+		{"3 METRIC temp 20", "3 ACK"},
+	} {
+		if err := sendExpect(water, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mock.Add(6 * time.Hour)
+	if err := sendExpect(water, "4 METRIC level 3", "4 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := doRun(client, water, mock, "r1", "read", time.Second, "ERR"); err != nil {
+		t.Fatal(err)
+	}
+
+	// tank is only up for the second half of the day.
+	mock.Add(6*time.Hour - time.Second)
+	if err := sendExpect(tank, "1 REGISTER tank source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.Add(12 * time.Hour)
+
+	var report Notification
+	for report.Kind == "" {
+		select {
+		case n := <-notifications:
+			if strings.HasPrefix(n.Kind, "report.") {
+				report = n
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no report was sent")
+		}
+	}
+
+	expected := `Daily report for 2024-06-01 (UTC)
+2 stations, 1 alerts fired
+
+tank (source): up 50.0%
+
+water (source): up 100.0%
+  level: min 1.00, max 3.00, avg 2.00 (2 points)
+  temp: min 20.00, max 20.00, avg 20.00 (1 points)
+  alerts: slo.burn x1
+`
+	if report.Kind != "report.daily" || report.Message != expected {
+		t.Fatalf("expected a daily report like\n%s\ngot %s:\n%s", expected, report.Kind, report.Message)
+	}
+	if !strings.Contains(report.HTML, "<h2>water (source)</h2>") || !strings.Contains(report.HTML, "<td>level</td><td>1.00</td><td>3.00</td><td>2.00</td><td>2</td>") {
+		t.Fatalf("unexpected html report:\n%s", report.HTML)
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// Besides keeping at most maxMetricPoints points of each series, the server
+// can keep points for a retention window: points older than that are
+// dropped as new ones come in, and by a sweep every so often for series
+// that have gone quiet and for the metric store. The two work independently,
+// so a point goes once it's either too old or one too many.
+
+// expired returns a series without the points from before cutoff. The
+// series' points aren't changed, so readers of the old one are unaffected.
+func expired(ms []metric, cutoff time.Time) []metric {
+	i := sort.Search(len(ms), func(i int) bool { return !ms[i].ts.Before(cutoff) })
+	if i == 0 {
+		return ms
+	}
+	return ms[i:]
+}
+
+// cutoff is the time points from before which are past retention, or the
+// zero time if points are kept regardless of age.
+func (s *Server) cutoff() time.Time {
+	if s.retention <= 0 {
+		return time.Time{}
+	}
+	return s.Clock.Now().Add(-s.retention)
+}
+
+// scheduleExpiry drops points past retention every interval.
+func (s *Server) scheduleExpiry(every time.Duration) {
+	s.Clock.AfterFunc(every, func() {
+		s.expire()
+		s.scheduleExpiry(every)
+	})
+}
+
+// expire drops every point past retention, in memory and in the store.
+func (s *Server) expire() {
+	cutoff := s.cutoff()
+
+	s.stationsM.Lock()
+	for _, station := range s.stations {
+		station.m.Lock()
+		for name, ms := range station.metrics {
+			if ms = expired(ms, cutoff); len(ms) > 0 {
+				station.metrics[name] = ms
+			} else {
+				delete(station.metrics, name)
+			}
+		}
+		station.m.Unlock()
+	}
+	for _, r := range s.restored {
+		for name, ms := range r.metrics {
+			if ms = expired(ms, cutoff); len(ms) > 0 {
+				r.metrics[name] = ms
+			} else {
+				delete(r.metrics, name)
+			}
+		}
+	}
+	s.stationsM.Unlock()
+
+	if s.cache != nil {
+		s.cache.invalidateAll()
+	}
+
+	if es, ok := s.store.(ExpiringStore); ok {
+		if err := es.Expire(cutoff); err != nil {
+			s.log.Errorf("couldn't expire points from the metric store: %v", err)
+		}
+	}
+}
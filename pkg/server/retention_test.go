@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestRetention(t *testing.T) {
+	mock := clock.NewMock()
+	mock.Set(time.Unix(10000, 0))
+	server := New(nil, 64, mock, WithRetention(time.Hour, time.Minute))
+
+	conn := &clientConn{}
+	if _, err := server.handleRegister(context.Background(), conn, "1", "water", "source"); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"level", "1"},
+		{"pressure", "2"},
+		// backfilled from before the window.
+		{"level", "3", "5000"},
+	} {
+		if _, err := server.handleMetric(context.Background(), conn, "2", args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	station := server.stations["water"]
+	if ms := station.metrics["level"]; len(ms) != 1 || ms[0].value != 1 {
+		t.Fatalf("expected the backfilled point to be dropped, got %v", ms)
+	}
+
+	// new points push out the ones past retention on their own.
+	mock.Add(45 * time.Minute)
+	if _, err := server.handleMetric(context.Background(), conn, "3", "level", "4"); err != nil {
+		t.Fatal(err)
+	}
+	mock.Add(30 * time.Minute)
+	if _, err := server.handleMetric(context.Background(), conn, "4", "level", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if ms := station.metrics["level"]; len(ms) != 2 || ms[0].value != 4 {
+		t.Fatalf("expected only the points in the last hour, got %v", ms)
+	}
+
+	// and the sweep drops series that have gone quiet.
+	waitFor(t, "the quiet series to expire", func() bool {
+		station.m.Lock()
+		defer station.m.Unlock()
+		_, ok := station.metrics["pressure"]
+		return !ok
+	})
+}
+
+func TestExpireStores(t *testing.T) {
+	for name, open := range map[string]func(path string) (ExpiringStore, error){
+		"pointLog": func(path string) (ExpiringStore, error) {
+			return OpenPointLog(path, 64, 1, time.Second, clock.New())
+		},
+		"bolt": func(path string) (ExpiringStore, error) {
+			return OpenBoltStore(path, 64)
+		},
+		"sqlite": func(path string) (ExpiringStore, error) {
+			return OpenSQLiteStore(path, 64)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store, err := open(tempPointLogPath(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			if err := store.Append(
+				StoredPoint{"water", "level", time.Unix(1, 0), 1},
+				StoredPoint{"water", "level", time.Unix(3, 0), 3},
+				StoredPoint{"jasmine", "moisture", time.Unix(2, 0), 20},
+			); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.Expire(time.Unix(3, 0)); err != nil {
+				t.Fatal(err)
+			}
+
+			points, err := store.Query("water")
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []StoredPoint{{"water", "level", time.Unix(3, 0), 3}}
+			if !reflect.DeepEqual(points, expected) {
+				t.Errorf("expected %v, got %v", expected, points)
+			}
+
+			names, err := store.Stations()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, []string{"water"}) {
+				t.Errorf("expected only water to have points left, got %v", names)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+)
+
+// A compromised station certificate shouldn't take rolling the CA to lock
+// out. With a certificate revocation list, certificates the CA has revoked
+// are rejected during the TLS handshake, and connections already made with
+// them are closed as soon as a list revoking them is loaded. Lists have to
+// be signed by a CA in the bundle clients are checked against, and are
+// loaded again on Reload or when their file changes. OCSP isn't checked:
+// Go's TLS stack doesn't let clients staple responses for their own
+// certificates.
+
+var errRevoked = errors.New("certificate is revoked")
+
+// Revocations keeps the certificates revoked by a file of CRLs, in PEM or
+// DER.
+type Revocations struct {
+	crlFile, caFile string
+	log             logTo
+
+	m sync.RWMutex
+	// by issuer and serial number.
+	revoked map[string]bool
+	// called after every reload.
+	reloaded []func()
+}
+
+// NewRevocations loads the CRLs in crlFile, each of which has to be signed
+// by a CA in caFile.
+func NewRevocations(crlFile, caFile string) (*Revocations, error) {
+	r := &Revocations{crlFile: crlFile, caFile: caFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetLogger logs reloads and stale CRLs to l, rather than the standard
+// logger.
+func (r *Revocations) SetLogger(l Logger) {
+	r.log.set(l)
+}
+
+// revocationKey identifies a certificate by who issued it and its serial
+// number, as CRLs do.
+func revocationKey(rawIssuer []byte, serial string) string {
+	return string(rawIssuer) + "/" + serial
+}
+
+// Reload loads the CRLs again, keeping the old ones if they can't be loaded.
+func (r *Revocations) Reload() error {
+	cas, err := readCertificates(r.caFile)
+	if err != nil {
+		return errors.Wrap(err, "reading CA bundle")
+	}
+	data, err := os.ReadFile(r.crlFile)
+	if err != nil {
+		return errors.Wrap(err, "reading CRLs")
+	}
+
+	var ders [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		// not PEM, so a single CRL in DER.
+		ders = [][]byte{data}
+	}
+
+	revoked := map[string]bool{}
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return errors.Wrap(err, "parsing CRL")
+		}
+		if err := checkCRL(crl, cas); err != nil {
+			return err
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			r.log.Errorf("CRL from %s was due to be replaced at %s", crl.Issuer, crl.NextUpdate)
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[revocationKey(crl.RawIssuer, entry.SerialNumber.String())] = true
+		}
+	}
+
+	r.m.Lock()
+	r.revoked = revoked
+	reloaded := r.reloaded
+	r.m.Unlock()
+
+	for _, fn := range reloaded {
+		fn()
+	}
+	return nil
+}
+
+// checkCRL checks that a CRL was signed by one of cas.
+func checkCRL(crl *x509.RevocationList, cas []*x509.Certificate) error {
+	for _, ca := range cas {
+		if string(ca.RawSubject) != string(crl.RawIssuer) {
+			continue
+		}
+		if err := crl.CheckSignatureFrom(ca); err == nil {
+			return nil
+		}
+	}
+	return errors.Errorf("CRL from %s isn't signed by a known CA", crl.Issuer)
+}
+
+// readCertificates reads every certificate in a PEM file.
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// IsRevoked reports whether a certificate has been revoked.
+func (r *Revocations) IsRevoked(cert *x509.Certificate) bool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	return r.revoked[revocationKey(cert.RawIssuer, cert.SerialNumber.String())]
+}
+
+// VerifyPeerCertificate rejects revoked certificates, for
+// tls.Config.VerifyPeerCertificate. It needs the certificates to have been
+// verified already, as they are with tls.RequireAndVerifyClientCert.
+func (r *Revocations) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if r.IsRevoked(cert) {
+				return errors.Wrapf(errRevoked, "%s (serial %s)", cert.Subject, cert.SerialNumber)
+			}
+		}
+	}
+	return nil
+}
+
+// onReload calls fn after every reload.
+func (r *Revocations) onReload(fn func()) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.reloaded = append(r.reloaded, fn)
+}
+
+// Watch checks the CRL and CA files every interval, and reloads them once
+// they've changed.
+func (r *Revocations) Watch(clk clock.Clock, every time.Duration) {
+	watchFiles(clk, every, &r.log, "CRLs", r.Reload, r.crlFile, r.caFile)
+}
+
+// closeRevoked closes the connections of clients whose certificates have
+// been revoked.
+func (s *Server) closeRevoked() {
+	s.connsM.Lock()
+	defer s.connsM.Unlock()
+
+	for c := range s.conns {
+		if c.peer != nil && s.revocations.IsRevoked(c.peer) {
+			s.log.Errorf("closing %s: its certificate has been revoked", describe(c))
+			c.Close()
+		}
+	}
+}
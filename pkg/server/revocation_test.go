@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCRL writes a CRL from pki revoking certs, and pki's CA, to dir,
+// returning their paths.
+func writeCRL(t *testing.T, dir string, pki *testPKI, number int64, certs ...tls.Certificate) (string, string) {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, cert := range certs {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   cert.Leaf.SerialNumber,
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, pki.ca, pki.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crlPath, caPath := filepath.Join(dir, "ca.crl"), filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(crlPath, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.ca.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return crlPath, caPath
+}
+
+func TestRevocations(t *testing.T) {
+	pki := newTestPKI(t)
+	stolen, fine := pki.issue(t, "water"), pki.issue(t, "fire")
+
+	r, err := NewRevocations(writeCRL(t, t.TempDir(), pki, 1, stolen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.IsRevoked(stolen.Leaf) || r.IsRevoked(fine.Leaf) {
+		t.Fatal("expected only the revoked certificate to be revoked")
+	}
+	if err := r.VerifyPeerCertificate(nil, [][]*x509.Certificate{{stolen.Leaf, pki.ca}}); err == nil {
+		t.Fatal("expected the revoked certificate to fail verification")
+	}
+	if err := r.VerifyPeerCertificate(nil, [][]*x509.Certificate{{fine.Leaf, pki.ca}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a CRL from another CA can't revoke anything.
+	dir := t.TempDir()
+	crlPath, _ := writeCRL(t, dir, newTestPKI(t), 1, stolen)
+	os.WriteFile(filepath.Join(dir, "ca.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.ca.Raw}), 0600)
+	if _, err := NewRevocations(crlPath, filepath.Join(dir, "ca.crt")); err == nil {
+		t.Fatal("expected a CRL signed by an unknown CA to be rejected")
+	}
+}
+
+func TestRevokedCertificatesDisconnected(t *testing.T) {
+	pki := newTestPKI(t)
+	stolen := pki.issue(t, "water")
+
+	dir := t.TempDir()
+	r, err := NewRevocations(writeCRL(t, dir, pki, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := pki.serve(t, WithRevocations(r))
+
+	station := pki.dial(t, addr, stolen)
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeCRL(t, dir, pki, 2, stolen)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectClosed(station); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectClosed(pki.dial(t, addr, stolen)); err != nil {
+		t.Fatal(err)
+	}
+
+	// other certificates are unaffected.
+	if err := sendExpect(pki.dial(t, addr, pki.issue(t, "fire")), "1 LIST", "1 LIST"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/silversupreme/drops/pkg/proto"
+)
+
+// Every certificate the CA signs can otherwise send every command that isn't
+// admin only, so a dashboard's certificate can RUN functions, and a
+// station's can read the whole fleet. With roles, each certificate is only
+// allowed the commands of its role, which comes from the roles file or else
+// from the certificate's organizational unit (OU), and certificates without
+// one are allowed nothing. The HTTP API's routes are allowed like the
+// commands they stand for.
+
+// codeForbidden is the strict error code for a command the client's role
+// doesn't allow.
+const codeForbidden = "E_FORBIDDEN"
+
+// anyCommand in a role's commands allows every command.
+const anyCommand = "*"
+
+// defaultRole is the role of certificates that aren't given one, if it's
+// defined. Otherwise they can't send any command.
+const defaultRole = "default"
+
+// Roles are the commands each role may send, and which certificates have
+// which role.
+type Roles struct {
+	// Commands allowed to each role, by name.
+	Commands map[string]map[string]bool
+	// Identities gives certificates roles by common name, ahead of their OU.
+	Identities map[string]string
+}
+
+// rolesFile is how roles are written in a -roles file.
+type rolesFile struct {
+	Roles      map[string][]string `json:"roles"`
+	Identities map[string]string   `json:"identities"`
+}
+
+// ParseRoles reads a JSON object of the commands each role may send, and
+// optionally the role of certificates by common name, e.g.
+//
+//	{"roles": {
+//		"dashboard": ["LIST", "INFO", "METRICS", "SUBSCRIBE"],
+//		"station": ["REGISTER", "PING", "METRIC", "DONE", "ERR"],
+//		"operator": ["*"]},
+//	 "identities": {"grafana": "dashboard"}}
+//
+// Certificates not named in identities have the role named by their OU, if
+// there is one, or else the role called default, if there is one. Those
+// without a role can't send anything.
+func ParseRoles(r io.Reader) (Roles, error) {
+	var file rolesFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return Roles{}, errors.Wrap(err, "bad roles")
+	}
+
+	roles := Roles{Commands: map[string]map[string]bool{}, Identities: file.Identities}
+	for role, cmds := range file.Roles {
+		allowed := map[string]bool{}
+		for _, cmd := range cmds {
+			if _, known := proto.Lookup(cmd); !known && cmd != anyCommand {
+				return Roles{}, errors.Errorf("role %s allows unknown command %s", role, cmd)
+			}
+			allowed[cmd] = true
+		}
+		roles.Commands[role] = allowed
+	}
+	for identity, role := range file.Identities {
+		if _, ok := roles.Commands[role]; !ok {
+			return Roles{}, errors.Errorf("%s has unknown role %s", identity, role)
+		}
+	}
+
+	return roles, nil
+}
+
+// role returns the role of a certificate, or "" if it has none.
+func (r Roles) role(identity string, units []string) string {
+	if role, ok := r.Identities[identity]; ok {
+		return role
+	}
+	for _, unit := range units {
+		if _, ok := r.Commands[unit]; ok {
+			return unit
+		}
+	}
+	if _, ok := r.Commands[defaultRole]; ok {
+		return defaultRole
+	}
+	return ""
+}
+
+// authorize checks that a connection's role allows cmd. Trusted plaintext
+// connections can send anything, and untrusted ones have the default role.
+func (s *Server) authorize(conn *clientConn, cmd string) error {
+	role := conn.role
+	if !conn.tls {
+		role = s.roles.role("", nil)
+	}
+	return s.authorizeRole(s.trusted(conn), role, cmd)
+}
+
+// authorizeRole checks that role allows cmd, unless the client is trusted.
+func (s *Server) authorizeRole(trusted bool, role, cmd string) error {
+	if s.roles.Commands == nil || trusted {
+		return nil
+	}
+
+	if role == "" {
+		return &protocolError{code: codeForbidden, token: cmd, pos: 1, msg: fmt.Sprintf("no role allows %s", cmd)}
+	}
+
+	allowed := s.roles.Commands[role]
+	if allowed[cmd] || allowed[anyCommand] {
+		return nil
+	}
+	return &protocolError{code: codeForbidden, token: cmd, pos: 1, msg: fmt.Sprintf("role %s can't send %s", role, cmd)}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+const testRoles = `{
+	"roles": {
+		"dashboard": ["LIST", "METRICS"],
+		"station": ["REGISTER", "METRIC", "BEGIN", "COMMIT"],
+		"operator": ["*"]
+	},
+	"identities": {"grafana": "dashboard"}
+}`
+
+func TestRoles(t *testing.T) {
+	roles, err := ParseRoles(strings.NewReader(testRoles))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pki := newTestPKI(t)
+	_, addr := pki.serve(t, WithRoles(roles), WithStrictProtocol())
+
+	// roles come from the certificate's OU...
+	station := pki.dial(t, addr, pki.issueFor(t, pkix.Name{CommonName: "water", OrganizationalUnit: []string{"station"}}))
+	for _, in := range []struct{ send, expect string }{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 METRIC level 1", "2 ACK"},
+		{"3 LIST", "3 ERR E_FORBIDDEN pos=1 token=LIST"},
+		// batched commands are checked as they're sent.
+		{"4 BEGIN", "4 ACK"},
+		{"5 LOG info hello", "5 ERR E_FORBIDDEN pos=1 token=LOG"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ...or the file, by common name.
+	dashboard := pki.dial(t, addr, pki.issue(t, "grafana"))
+	for _, in := range []struct{ send, expect string }{
+		{"6 LIST", "6 LIST water:source:100"},
+		{"7 RUN water read_level", "7 ERR E_FORBIDDEN pos=1 token=RUN"},
+	} {
+		if err := sendExpect(dashboard, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// certificates without a role can't send anything when there's no
+	// default.
+	other := pki.dial(t, addr, pki.issue(t, "laptop"))
+	if err := sendExpect(other, "8 LIST", "8 ERR E_FORBIDDEN pos=1 token=LIST"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRolesDefault(t *testing.T) {
+	roles, err := ParseRoles(strings.NewReader(`{"roles": {"default": ["LIST"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(nil, 4, clock.NewMock(), WithRoles(roles))
+	if err := server.authorize(&clientConn{tls: true, role: server.roles.role("laptop", nil)}, "RUN"); err == nil {
+		t.Fatal("expected the default role to apply")
+	}
+	if err := server.authorize(&clientConn{}, "RUN"); err == nil {
+		t.Fatal("expected untrusted plaintext clients to get the default role")
+	}
+
+	server = New(nil, 4, clock.NewMock(), WithRoles(roles), TrustPlaintext())
+	if err := server.authorize(&clientConn{}, "RUN"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRolesHTTP(t *testing.T) {
+	roles, err := ParseRoles(strings.NewReader(testRoles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(nil, 4, clock.NewMock(), WithRoles(roles))
+
+	for _, in := range []struct {
+		path    string
+		subject *pkix.Name
+		status  int
+	}{
+		{"/api/stations", &pkix.Name{CommonName: "grafana"}, http.StatusOK},
+		{"/metrics", &pkix.Name{CommonName: "grafana"}, http.StatusOK},
+		{"/api/alerts", &pkix.Name{CommonName: "grafana"}, http.StatusForbidden},
+		{"/api/alerts", &pkix.Name{CommonName: "ops", OrganizationalUnit: []string{"operator"}}, http.StatusOK},
+		{"/api/stations", &pkix.Name{CommonName: "water", OrganizationalUnit: []string{"station"}}, http.StatusForbidden},
+		// certificates without a role, and plaintext requests, get nothing.
+		{"/api/stations", &pkix.Name{CommonName: "laptop"}, http.StatusForbidden},
+		{"/metrics", nil, http.StatusForbidden},
+		// ingest sources need a role that can send METRIC.
+		{"/api/ingest/weather", &pkix.Name{CommonName: "grafana"}, http.StatusForbidden},
+		{"/api/ingest/weather", &pkix.Name{CommonName: "proxy", OrganizationalUnit: []string{"station"}}, http.StatusNotFound},
+	} {
+		method := "GET"
+		if strings.HasPrefix(in.path, "/api/ingest/") {
+			method = "POST"
+		}
+		req := httptest.NewRequest(method, in.path, nil)
+		if in.subject != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: *in.subject}}}
+		}
+		rec := httptest.NewRecorder()
+		server.HTTPHandler().ServeHTTP(rec, req)
+		if rec.Code != in.status {
+			t.Errorf("expected %s from %v to get %d, got %d", in.path, in.subject, in.status, rec.Code)
+		}
+	}
+
+	// trusted plaintext requests can still get anything.
+	server = New(nil, 4, clock.NewMock(), WithRoles(roles), TrustPlaintext())
+	rec := httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/alerts", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected a trusted plaintext request to be served, got %d", rec.Code)
+	}
+}
+
+func TestParseRolesBad(t *testing.T) {
+	for _, spec := range []string{
+		`{"roles": {"dashboard": ["LIST", "EXPLODE"]}}`,
+		`{"roles": {"dashboard": ["LIST"]}, "identities": {"grafana": "admin"}}`,
+		`{"roles": `,
+	} {
+		if _, err := ParseRoles(strings.NewReader(spec)); err == nil {
+			t.Errorf("expected %s to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencySamples is how many recent latencies are kept per function to
+// compute percentiles from.
+const latencySamples = 128
+
+// fnStats are the execution statistics of one function on one station.
+type fnStats struct {
+	count     int
+	completed int
+	errors    int
+
+	// ring buffer of the most recent latencies.
+	latencies []time.Duration
+	next      int
+	total     time.Duration
+
+	// ring buffer of whether the most recent runs failed.
+	failed     []bool
+	nextFailed int
+}
+
+func (f *fnStats) observe(latency time.Duration, ok bool) {
+	f.completed++
+	if !ok {
+		f.errors++
+	}
+	f.total += latency
+	f.sample(latency)
+
+	if len(f.failed) < latencySamples {
+		f.failed = append(f.failed, !ok)
+		return
+	}
+	f.failed[f.nextFailed] = !ok
+	f.nextFailed = (f.nextFailed + 1) % latencySamples
+}
+
+// sample keeps latency as one of the most recent ones.
+func (f *fnStats) sample(latency time.Duration) {
+	if len(f.latencies) < latencySamples {
+		f.latencies = append(f.latencies, latency)
+		return
+	}
+	f.latencies[f.next] = latency
+	f.next = (f.next + 1) % latencySamples
+}
+
+// percentile returns the p-th percentile (0-1) of recent latencies.
+func (f *fnStats) percentile(p float64) time.Duration {
+	if len(f.latencies) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration(nil), f.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// runStats tracks function execution statistics per station name, so they
+// outlive any one connection of the station.
+type runStats struct {
+	m        sync.Mutex
+	stations map[string]map[string]*fnStats
+}
+
+func newRunStats() *runStats {
+	return &runStats{stations: map[string]map[string]*fnStats{}}
+}
+
+func (r *runStats) get(station, fn string) *fnStats {
+	fns, ok := r.stations[station]
+	if !ok {
+		fns = map[string]*fnStats{}
+		r.stations[station] = fns
+	}
+
+	f, ok := fns[fn]
+	if !ok {
+		f = &fnStats{}
+		fns[fn] = f
+	}
+	return f
+}
+
+// started counts an invocation of fn on station.
+func (r *runStats) started(station, fn string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.get(station, fn).count++
+}
+
+// finished records how a run of fn on station went.
+func (r *runStats) finished(station, fn string, latency time.Duration, ok bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.get(station, fn).observe(latency, ok)
+}
+
+// info renders a station's statistics as INFO tokens, one per function:
+// runs.[function]=n:[count],err:[errors],p50:[latency],p90:[latency],p99:[latency]
+func (r *runStats) info(station string) []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	fns := r.stations[station]
+	names := make([]string, 0, len(fns))
+	for name := range fns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tokens := make([]string, 0, len(names))
+	for _, name := range names {
+		f := fns[name]
+		tokens = append(tokens, fmt.Sprintf("runs.%s=n:%d,err:%d,p50:%s,p90:%s,p99:%s",
+			name, f.count, f.errors,
+			f.percentile(0.5).Round(time.Millisecond),
+			f.percentile(0.9).Round(time.Millisecond),
+			f.percentile(0.99).Round(time.Millisecond)))
+	}
+
+	return tokens
+}
+
+// failureRate returns the fraction of a station's recent runs that failed,
+// across all of its functions, and whether it has any recent runs.
+func (r *runStats) failureRate(station string) (float64, bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	runs, failures := 0, 0
+	for _, f := range r.stations[station] {
+		for _, failed := range f.failed {
+			runs++
+			if failed {
+				failures++
+			}
+		}
+	}
+
+	if runs == 0 {
+		return 0, false
+	}
+	return float64(failures) / float64(runs), true
+}
+
+// writePrometheus renders the statistics in Prometheus' text exposition
+// format.
+func (r *runStats) writePrometheus(w io.Writer) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	type key struct{ station, fn string }
+	var keys []key
+	for station, fns := range r.stations {
+		for fn := range fns {
+			keys = append(keys, key{station, fn})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].station != keys[j].station {
+			return keys[i].station < keys[j].station
+		}
+		return keys[i].fn < keys[j].fn
+	})
+
+	labels := func(k key) string {
+		return fmt.Sprintf("station=%s,function=%s", promQuote(k.station), promQuote(k.fn))
+	}
+
+	fmt.Fprintf(w, "# HELP drops_runs_total Runs started, per station and function.\n")
+	fmt.Fprintf(w, "# TYPE drops_runs_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "drops_runs_total{%s} %d\n", labels(k), r.stations[k.station][k.fn].count)
+	}
+
+	fmt.Fprintf(w, "# HELP drops_run_errors_total Runs that ended in ERR, per station and function.\n")
+	fmt.Fprintf(w, "# TYPE drops_run_errors_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "drops_run_errors_total{%s} %d\n", labels(k), r.stations[k.station][k.fn].errors)
+	}
+
+	fmt.Fprintf(w, "# HELP drops_run_latency_seconds Time from RUN to DONE or ERR, per station and function.\n")
+	fmt.Fprintf(w, "# TYPE drops_run_latency_seconds summary\n")
+	for _, k := range keys {
+		f := r.stations[k.station][k.fn]
+		for _, q := range []float64{0.5, 0.9, 0.99} {
+			fmt.Fprintf(w, "drops_run_latency_seconds{%s,quantile=\"%g\"} %g\n", labels(k), q, f.percentile(q).Seconds())
+		}
+		fmt.Fprintf(w, "drops_run_latency_seconds_sum{%s} %g\n", labels(k), f.total.Seconds())
+		fmt.Fprintf(w, "drops_run_latency_seconds_count{%s} %d\n", labels(k), f.completed)
+	}
+}
+
+// promQuote quotes a Prometheus label value.
+func promQuote(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
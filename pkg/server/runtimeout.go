@@ -0,0 +1,36 @@
+package server
+
+// Stations can hang on to a RUN without ever answering it, leaving the
+// client that sent it waiting forever. With a run timeout, runs the station
+// hasn't answered in time fail with ERR TIMEOUT, and the station's late
+// answer is turned away like any other for an unknown uid.
+
+// expireRun fails a run that has gone unanswered for too long, wherever
+// it's waiting: with its station, or held for redelivery. Stations are
+// searched for it, since it may have been renamed since it was sent.
+func (s *Server) expireRun(uid string, r *run) {
+	s.stationsM.Lock()
+	defer s.stationsM.Unlock()
+
+	for name, station := range s.stations {
+		station.runsM.Lock()
+		pending := station.runs[uid] == r
+		if pending {
+			delete(station.runs, uid)
+		}
+		station.runsM.Unlock()
+
+		if pending {
+			s.failRun(name, uid, r, "TIMEOUT")
+			return
+		}
+	}
+
+	for name, o := range s.orphans {
+		if o.runs[uid] == r {
+			delete(o.runs, uid)
+			s.failRun(name, uid, r, "TIMEOUT")
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestRunTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock, WithRunTimeout(time.Minute))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	// runs answered in time aren't affected.
+	if err := sendExpect(client, "2 RUN water read", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expect(station, "2 RUN read"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(station, "2 DONE 10", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expect(client, "2 DONE 10"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(client, "3 RUN water fill 60", "3 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expect(station, "3 RUN fill 60"); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.Add(time.Minute)
+	if err := expect(client, "3 ERR TIMEOUT"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the station is too late to answer.
+	if err := sendExpect(station, "3 DONE", "3 ERR"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.stationsM.RLock()
+	pending := len(server.stations["water"].runs)
+	server.stationsM.RUnlock()
+	if pending != 0 {
+		t.Fatalf("expected the run to be deleted, got %d pending", pending)
+	}
+}
@@ -1,11 +1,12 @@
 package server
 
 import (
+	"context"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/benbjohnson/clock"
-	"github.com/golang/glog"
 )
 
 // Server handles accepting connections and keeping state.
@@ -17,32 +18,301 @@ type Server struct {
 	stations  map[string]*Station
 	stationsM sync.RWMutex
 
+	// held to handle a command, and exclusively to COMMIT a batch.
+	batchM sync.RWMutex
+
+	conns  map[*clientConn]struct{}
+	connsM sync.Mutex
+
+	// set once Shutdown is called, under connsM, and the connections still
+	// being handled.
+	closing  bool
+	handlers sync.WaitGroup
+
+	// how many connections can be handled at once (0 for no limit), how
+	// many are, how many more are being told BUSY, and how many were in
+	// all, under connsM.
+	maxConns int
+	handling int
+	refusing int
+	refused  int
+	// how long connections have to finish their TLS handshake.
+	handshakeTimeout time.Duration
+
+	// whether clients are told BYE on Shutdown.
+	bye bool
+
+	// lines every client is sent as soon as it connects.
+	banner []string
+
+	// the environment the server is part of, like prod, if it's labelled.
+	environment string
+
+	// how long clients and stations can go without sending anything before
+	// they're disconnected (0 to never disconnect them).
+	clientIdle  time.Duration
+	stationIdle time.Duration
+
+	admins         map[string]bool
+	trustPlaintext bool
+
+	// the pages besides the server's own that browsers may open WebSockets
+	// to it from.
+	wsOrigins map[string]bool
+
+	// third-party systems pushing to the HTTP API, by name.
+	ingestSources map[string]IngestSource
+
+	// the commands certificates are allowed, by role, if they're limited.
+	roles Roles
+
+	// whether stations can only register as the names on their
+	// certificates, and the names each common name is granted besides.
+	bindNames  bool
+	nameGrants map[string][]string
+
+	// whether ERR responses say what was wrong with the command.
+	strict bool
+
+	// how long connections remember their answers to writes for, to answer
+	// retries with (0 to not remember them).
+	dedupWindow time.Duration
+
+	blocklist  map[string]bool
+	blocklistM sync.Mutex
+
+	// the certificates revoked by the CA, if they're checked.
+	revocations *Revocations
+
+	probes *probeTracker
+
+	locations map[string]Location
+
+	// the contracts stations are held to, by type name.
+	types map[string]StationType
+
+	// configuration pushed to stations, by station name or type=[type].
+	configs       map[string]stationConfig
+	configVersion int
+
+	// the latest firmware for each station type, by type name.
+	firmware map[string]string
+
+	// idempotent runs of disconnected stations, by station name.
+	orphans          map[string]*orphans
+	redeliveryWindow time.Duration
+
+	// how long a station has to answer a RUN before it fails (0 to wait
+	// forever).
+	runTimeout time.Duration
+
+	runStats *runStats
+	slos     *sloTracker
+	quality  *qualityTracker
+
+	// how long commands take to handle, and how long is too long to not
+	// log (0 to never log).
+	commandStats *commandStats
+	slowCommand  time.Duration
+
+	notifiers []Notifier
+	// sinks for journal events, like stations registering.
+	eventNotifiers []eventNotifier
+
+	// what's wrong until it's fine again, and who's on it.
+	alerts *alertTable
+	// rules opening alerts on metrics past a value.
+	thresholds *thresholds
+
+	logs    *stationLogs
+	notes   *stationNotes
+	journal *journal
+
+	// clients streaming new metric points.
+	subscribers *metricSubscribers
+	// clients hearing about stations joining and leaving.
+	watchers *stationWatchers
+
+	// persists metric points, if enabled.
+	store MetricStore
+
+	// state LOADed for stations, by station name.
+	restored map[string]*restoredStation
+
+	// metrics of virtual stations, computed from other stations'.
+	virtual []VirtualMetric
+
+	// old station names RENAMEd to new ones.
+	aliases map[string]string
+
+	// when stations went offline, for the janitor.
+	lastSeen     map[string]time.Time
+	reclaimAfter time.Duration
+
+	// how long stations can go unheard from before they're reaped (0 to
+	// never reap them).
+	reapAfter time.Duration
+
+	// how long metric points are kept for (0 to keep them regardless of
+	// age).
+	retention time.Duration
+
+	// how long a metric can go without a new point before it's stale.
+	staleAfter time.Duration
+
+	// caches fleet-wide queries, if enabled.
+	cache *queryCache
+
+	// keeps what's needed for scheduled reports, if enabled.
+	reports *reporter
+
+	// exports metric points for analytics, if enabled.
+	export *exporter
+
+	// keeps an eye on the server's own runtime, if enabled.
+	watchdog *watchdog
+
+	// notices when no points at all are coming in, if enabled.
+	deadman *deadMan
+
+	// lets a monitor know the server is up, if enabled.
+	heartbeat *heartbeat
+
+	// where to write crash reports to, if anywhere.
+	crashDir string
+
+	// the sessions of stations using CoAP, if the gateway is enabled.
+	coap *coapGateway
+
+	// the faults being injected, in chaos mode.
+	chaos *chaos
+
+	// where backups are written to, if they're taken.
+	backups *backups
+	// how many backups to keep, or 0 to keep them all.
+	backupKeep int
+
+	// the budget backfilled points share, if they're throttled.
+	catchUp *catchUp
+
+	// each station's METRIC budget, if they're rate limited.
+	rateLimit *rateLimit
+
+	// what the server last reported on itself, if it does.
+	telemetry *telemetry
+
+	// where every command is recorded, if it's audited.
+	audits *audits
+
+	// where the server logs to.
+	log logTo
+
 	// Exposed for mocking purposes.
 	Clock clock.Clock
 }
 
 // New constructs and returns a Server.
-func New(listener net.Listener, maxMetricPoints int, clock clock.Clock) *Server {
-	return &Server{
+func New(listener net.Listener, maxMetricPoints int, clock clock.Clock, opts ...Option) *Server {
+	s := &Server{
 		listener:        listener,
 		maxMetricPoints: maxMetricPoints,
 
 		stations:  map[string]*Station{},
 		stationsM: sync.RWMutex{},
 
+		conns: map[*clientConn]struct{}{},
+
+		admins:    map[string]bool{},
+		blocklist: map[string]bool{},
+
+		probes: newProbeTracker(),
+
+		locations: map[string]Location{},
+		types:     map[string]StationType{},
+		configs:   map[string]stationConfig{},
+		firmware:  map[string]string{},
+
+		orphans: map[string]*orphans{},
+
+		restored: map[string]*restoredStation{},
+		lastSeen: map[string]time.Time{},
+		aliases:  map[string]string{},
+
+		staleAfter: defaultStaleAfter,
+
+		runStats: newRunStats(),
+		slos:     newSLOTracker(),
+		quality:  newQualityTracker(),
+
+		commandStats: newCommandStats(),
+
+		alerts:     newAlertTable(),
+		thresholds: newThresholds(),
+
+		logs:    newStationLogs(100),
+		notes:   newStationNotes(),
+		journal: newJournal(1000),
+
+		handshakeTimeout: defaultHandshakeTimeout,
+
+		subscribers: newMetricSubscribers(),
+		watchers:    newStationWatchers(),
+
 		Clock: clock,
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.restoreStations()
+	s.restoreNotes()
+
+	return s
 }
 
-// Serve is the main acceptor loop.
-func (s *Server) Serve() {
+// Serve is the main acceptor loop. It returns ErrServerClosed once Shutdown
+// has been called. Cancelling ctx stops it too, returning ctx's error, and
+// closes every connection without waiting for them like Shutdown does.
+func (s *Server) Serve(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		s.connsM.Lock()
+		s.closing = true
+		s.connsM.Unlock()
+		s.listener.Close()
+	})
+	defer stop()
+
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
-			glog.Errorf("couldn't accept connection: %v", err)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			s.log.Errorf("couldn't accept connection: %v", err)
+			continue
+		}
+
+		s.connsM.Lock()
+		if s.closing {
+			s.connsM.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		if !s.admit() {
+			s.connsM.Unlock()
+			s.refuse(conn)
 			continue
 		}
+		s.handlers.Add(1)
+		s.connsM.Unlock()
 
-		go s.handle(conn)
+		go func() {
+			defer s.handlers.Done()
+			defer s.release()
+			s.handle(ctx, conn)
+		}()
 	}
 }
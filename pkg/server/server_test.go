@@ -2,12 +2,18 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/benbjohnson/clock"
+	"github.com/silversupreme/drops/pkg/proto"
 )
 
 type interaction struct {
@@ -36,7 +42,52 @@ var simpleCmdTestCases = []struct {
 		name: "RegisterListCmd",
 		interactions: []interaction{
 			{"1 REGISTER water source", "1 ACK"},
-			{"2 LIST", "2 LIST water:source"},
+			{"2 LIST", "2 LIST water:source:100"},
+		},
+	},
+	{
+		name: "MetricNameValidation",
+		interactions: []interaction{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 METRIC pump.* 1", "2 ERR"},
+			{"3 METRIC pump..rpm 1", "3 ERR"},
+			{"4 METRIC pump.motor.temp 1", "4 ACK"},
+			{"5 METRICS water pump.motor.temp", "5 METRICS water pump.motor.temp 0:1.00"},
+			{"6 METRICS water tank.*", "6 METRICS water tank.* 0"},
+		},
+	},
+	{
+		name: "MetricsLastAcrossStations",
+		interactions: []interaction{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 METRIC level 1", "2 ACK"},
+			{"3 METRIC level 2", "3 ACK"},
+			{"4 METRICS * level LAST", "4 METRICS * level LAST water:0:2.00"},
+			{"5 METRICS * pressure LAST", "5 METRICS * pressure LAST"},
+			{"6 METRICS * level", "6 ERR"},
+			{"7 REGISTER * source", "7 ERR"},
+		},
+	},
+	{
+		name: "RegisterWithLocation",
+		interactions: []interaction{
+			{"1 REGISTER water source location=45.5,-122.6", "1 ACK"},
+			{"2 INFO water", "2 INFO water type=source health=100 location=45.500000,-122.600000"},
+		},
+	},
+	{
+		name: "RegisterBadLocation",
+		interactions: []interaction{
+			{"1 REGISTER water source location=91,0", "1 ERR"},
+			{"2 REGISTER water source somewhere", "2 ERR"},
+		},
+	},
+	{
+		name: "InfoWithoutLocation",
+		interactions: []interaction{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 INFO water", "2 INFO water type=source health=100"},
+			{"3 INFO jasmine", "3 ERR"},
 		},
 	},
 	{
@@ -102,6 +153,49 @@ var simpleCmdTestCases = []struct {
 			{"7 METRICS water level", "7 METRICS water level 0:2.00 0:3.00 0:4.00 0:5.00"},
 		},
 	},
+	{
+		name: "LogRequiresRegistration",
+		interactions: []interaction{
+			{"1 LOG info hello", "1 ERR"},
+		},
+	},
+	{
+		name: "LogRequiresLevel",
+		interactions: []interaction{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 LOG loud hello", "2 ERR"},
+			{"3 LOG info", "3 ERR"},
+			{"4 LOGS water", "4 ERR"},
+		},
+	},
+	{
+		name: "MetricBackfill",
+		interactions: []interaction{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 METRIC level 3", "2 ACK"},
+			{"3 METRIC level 1 -20", "3 ACK"},
+			{"4 METRIC level 2 -10", "4 ACK"},
+			{"5 METRICS water level", "5 METRICS water level -20:1.00 -10:2.00 0:3.00"},
+		},
+	},
+	{
+		name: "MetricResubmissionDeduplicated",
+		interactions: []interaction{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 METRIC level 1 -10", "2 ACK"},
+			{"2 METRIC level 1 -10", "2 ACK"},
+			{"3 METRIC level 2 -10", "3 ACK"},
+			{"4 METRICS water level", "4 METRICS water level -10:1.00 -10:2.00"},
+		},
+	},
+	{
+		name: "MetricRejectsFutureAndBadTimestamps",
+		interactions: []interaction{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 METRIC level 1 3600", "2 ERR"},
+			{"3 METRIC level 1 soon", "3 ERR"},
+		},
+	},
 	{
 		name: "UnknownCommand",
 		interactions: []interaction{
@@ -128,7 +222,7 @@ func TestSimpleCmds(t *testing.T) {
 			addr := listener.Addr()
 			mock := clock.NewMock()
 			server := New(listener, 4, mock)
-			go server.Serve()
+			go server.Serve(context.Background())
 
 			conn, err := net.Dial("tcp", addr.String())
 			if err != nil {
@@ -192,7 +286,7 @@ func TestRpcSuccess(t *testing.T) {
 	addr := listener.Addr()
 	mock := clock.NewMock()
 	server := New(listener, 4, mock)
-	go server.Serve()
+	go server.Serve(context.Background())
 
 	station, err := net.Dial("tcp", addr.String())
 	if err != nil {
@@ -208,7 +302,7 @@ func TestRpcSuccess(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := sendExpect(client, "2 LIST", "2 LIST water:source"); err != nil {
+	if err := sendExpect(client, "2 LIST", "2 LIST water:source:100"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -240,7 +334,7 @@ func TestRpcFailure(t *testing.T) {
 	addr := listener.Addr()
 	mock := clock.NewMock()
 	server := New(listener, 4, mock)
-	go server.Serve()
+	go server.Serve(context.Background())
 
 	station, err := net.Dial("tcp", addr.String())
 	if err != nil {
@@ -256,7 +350,7 @@ func TestRpcFailure(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := sendExpect(client, "2 LIST", "2 LIST water:source"); err != nil {
+	if err := sendExpect(client, "2 LIST", "2 LIST water:source:100"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -288,7 +382,7 @@ func TestComplexRpcInteraction(t *testing.T) {
 	addr := listener.Addr()
 	mock := clock.NewMock()
 	server := New(listener, 4, mock)
-	go server.Serve()
+	go server.Serve(context.Background())
 
 	station, err := net.Dial("tcp", addr.String())
 	if err != nil {
@@ -346,3 +440,725 @@ func TestComplexRpcInteraction(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRpcProgressAndCancel(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock)
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(client, "2 RUN water fill 60", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := expect(station, "2 RUN fill 60"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "2 PROGRESS 50%", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := expect(client, "2 PROGRESS 50%"); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the client that started the run can cancel it.
+	if err := sendExpect(other, "2 CANCEL", "2 ERR"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(client, "2 CANCEL", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := expect(station, "2 CANCEL"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "2 ERR", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := expect(client, "2 ERR"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(client, "2 CANCEL", "2 ERR"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProbeDenylist(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock, TrustPlaintext(), WithProbeDenylist(2, time.Minute))
+	go server.Serve(context.Background())
+
+	admin, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a valid first command means later garbage isn't counted.
+	if err := sendExpect(admin, "1 LIST", "1 LIST"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(admin, "2 DOODLE", "2 ERR UNRECOGNIZED CMD"); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(scanner, "GET / HTTP/1.1", "GET ERR UNRECOGNIZED CMD"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(admin, "3 PROBES", "3 PROBES 127.0.0.1:handshake=0,blocked=0,protocol=1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second strike gets the address denied and the connection dropped.
+	if err := sendExpect(scanner, "", "FATAL"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectClosed(scanner); err != nil {
+		t.Fatal(err)
+	}
+
+	denied, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := expectClosed(denied); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.Add(2 * time.Minute)
+
+	allowed, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(allowed, "4 LIST", "4 LIST"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunRedelivery(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock, WithRedelivery(time.Minute))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(client, "2 RUN idempotent=true water read", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expect(station, "2 RUN read"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(client, "3 RUN water fill 60", "3 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expect(station, "3 RUN fill 60"); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the run that isn't idempotent fails when the station drops.
+	station.Close()
+	if err := expect(client, "3 ERR DISCONNECTED"); err != nil {
+		t.Fatal(err)
+	}
+
+	station, err = net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(station)
+	if _, err := station.Write([]byte("4 REGISTER water source\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"4 ACK\n", "2 RUN read\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected {
+			t.Fatalf("expected %q, got %q", expected, line)
+		}
+	}
+
+	if err := sendExpect(station, "2 DONE 10", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expect(client, "2 DONE 10"); err != nil {
+		t.Fatal(err)
+	}
+
+	// once the window runs out, idempotent runs fail too.
+	if err := sendExpect(client, "5 RUN idempotent=true water read", "5 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expect(station, "5 RUN read"); err != nil {
+		t.Fatal(err)
+	}
+
+	station.Close()
+
+	// wait for the server to notice the disconnect before moving the clock.
+	for {
+		if err := sendExpect(client, "6 INFO water", "6 ERR"); err == nil {
+			break
+		}
+	}
+
+	mock.Add(time.Minute)
+	if err := expect(client, "5 ERR DISCONNECTED"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunStats(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock)
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, outcome := range []struct {
+		latency time.Duration
+		result  string
+	}{
+		{2 * time.Second, "DONE"},
+		{time.Second, "ERR"},
+	} {
+		uid := fmt.Sprintf("r%d", i)
+		if err := sendExpect(client, uid+" RUN water read", uid+" ACK"); err != nil {
+			t.Fatal(err)
+		}
+		if err := expect(station, uid+" RUN read"); err != nil {
+			t.Fatal(err)
+		}
+
+		mock.Add(outcome.latency)
+
+		if err := sendExpect(station, uid+" "+outcome.result, uid+" ACK"); err != nil {
+			t.Fatal(err)
+		}
+		if err := expect(client, uid+" "+outcome.result); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := sendExpect(client, "2 INFO water", "2 INFO water type=source health=85 runs.read=n:2,err:1,p50:1s,p90:2s,p99:2s"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// doRun has client RUN fn on station, which takes latency to answer with
+// result (DONE or ERR).
+func doRun(client, station net.Conn, mock *clock.Mock, uid, fn string, latency time.Duration, result string) error {
+	if err := sendExpect(client, fmt.Sprintf("%s RUN water %s", uid, fn), uid+" ACK"); err != nil {
+		return err
+	}
+	if err := expect(station, fmt.Sprintf("%s RUN %s", uid, fn)); err != nil {
+		return err
+	}
+
+	mock.Add(latency)
+
+	if err := sendExpect(station, uid+" "+result, uid+" ACK"); err != nil {
+		return err
+	}
+	return expect(client, uid+" "+result)
+}
+
+func TestSLOBurn(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notifications := make(chan Notification, 10)
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock,
+		WithSLOs(SLO{Function: "read", Target: 0.9, Within: time.Second, Window: time.Hour, Burn: 1, Min: 2}),
+		WithNotifier(NotifierFunc(func(n Notification) { notifications <- n })),
+	)
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	// other functions don't count.
+	if err := doRun(client, station, mock, "2", "fill", time.Minute, "ERR"); err != nil {
+		t.Fatal(err)
+	}
+	if err := doRun(client, station, mock, "3", "read", 100*time.Millisecond, "DONE"); err != nil {
+		t.Fatal(err)
+	}
+
+	// too slow is as bad as an error.
+	if err := doRun(client, station, mock, "4", "read", 2*time.Second, "DONE"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case n := <-notifications:
+		if n.Kind != "slo.burn" || n.Station != "water" {
+			t.Fatalf("unexpected notification %+v", n)
+		}
+	default:
+		t.Fatal("expected an slo.burn notification")
+	}
+
+	// once the bad run falls out of the window, the objective recovers.
+	mock.Add(2 * time.Hour)
+	for i, uid := range []string{"5", "6"} {
+		if err := doRun(client, station, mock, uid, "read", 0, "DONE"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case n := <-notifications:
+			if i == 0 || n.Kind != "slo.ok" {
+				t.Fatalf("unexpected notification %+v", n)
+			}
+		default:
+			if i == 1 {
+				t.Fatal("expected an slo.ok notification")
+			}
+		}
+	}
+}
+
+// expectLines reads several lines from a reader that's kept across calls,
+// for responses that span more than one line.
+func expectLines(reader *bufio.Reader, lines ...string) error {
+	for _, line := range lines {
+		output, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if output != line+"\n" {
+			return fmt.Errorf("expected %s, got %s", line, output)
+		}
+	}
+
+	return nil
+}
+
+func TestLogs(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock, WithLogLines(2))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, line := range []string{"booting", "pump primed", "float switch stuck"} {
+		uid := fmt.Sprintf("l%d", i)
+		if err := sendExpect(station, fmt.Sprintf("%s LOG info %s", uid, line), uid+" ACK"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the last two lines are kept.
+	fmt.Fprintf(client, "2 LOGS water -f\n")
+	if err := expectLines(reader,
+		"2 LOG water 0 info pump primed",
+		"2 LOG water 0 info float switch stuck",
+		"2 LOGS water 2",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "3 LOG error tank empty", "3 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectLines(reader, "2 LOG water 0 error tank empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(client, "2 CANCEL\n")
+	if err := expectLines(reader, "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "4 LOG debug quiet", "4 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the log outlives the station's connection.
+	station.Close()
+	fmt.Fprintf(client, "5 LOGS water\n")
+	if err := expectLines(reader,
+		"5 LOG water 0 error tank empty",
+		"5 LOG water 0 debug quiet",
+		"5 LOGS water 2",
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock)
+	go server.Serve(context.Background())
+
+	subscriber, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := bufio.NewReader(subscriber)
+
+	fmt.Fprintf(subscriber, "1 SUBSCRIBE EVENTS water\n")
+	if err := expectLines(events, "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+
+	if err := sendExpect(station, "2 REGISTER water source", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectLines(events, "1 EVENT 1 0 register water source"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := doRun(client, station, mock, "3", "read", time.Second, "DONE"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectLines(events, "1 EVENT 2 1 run.done water read"); err != nil {
+		t.Fatal(err)
+	}
+
+	station.Close()
+	if err := expectLines(events, "1 EVENT 3 1 disconnect water"); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(client, "4 EVENTS water 1\n")
+	if err := expectLines(reader,
+		"4 EVENT 2 1 run.done water read",
+		"4 EVENT 3 1 disconnect water",
+		"4 EVENTS 2",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(client, "5 EVENTS jasmine\n")
+	if err := expectLines(reader, "5 EVENTS 0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetricsGlob(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock())
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+
+	for i, send := range []string{
+		"REGISTER water source",
+		"METRIC pump.rpm 1200",
+		"METRIC pump.motor.temp 41",
+		"METRIC pump.motor.temp 42",
+		"METRIC level 0.5",
+	} {
+		fmt.Fprintf(conn, "%d %s\n", i, send)
+		if err := expectLines(reader, fmt.Sprintf("%d ACK", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fmt.Fprintf(conn, "q METRICS water pump.*\n")
+	if err := expectLines(reader,
+		"q METRIC water pump.motor.temp 0:41.00 0:42.00",
+		"q METRIC water pump.rpm 0:1200.00",
+		"q METRICS water pump.* 2",
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFleetQueries(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	server := New(listener, 4, mock)
+	go server.Serve(context.Background())
+
+	// stations stay registered only as long as their connections are open.
+	var stations []net.Conn
+	defer func() {
+		for _, conn := range stations {
+			conn.Close()
+		}
+	}()
+
+	for _, station := range []struct {
+		name  string
+		level string
+	}{
+		{"water", "0.5"},
+		{"jasmine", "0.25"},
+		{"basil", ""},
+	} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		stations = append(stations, conn)
+
+		if err := sendExpect(conn, "1 REGISTER "+station.name+" source", "1 ACK"); err != nil {
+			t.Fatal(err)
+		}
+		if station.level == "" {
+			continue
+		}
+		if err := sendExpect(conn, "2 METRIC level 0.1", "2 ACK"); err != nil {
+			t.Fatal(err)
+		}
+		mock.Add(time.Second)
+		if err := sendExpect(conn, "3 METRIC level "+station.level, "3 ACK"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(client, "1 METRICS * level LAST", "1 METRICS * level LAST jasmine:2:0.25 water:1:0.50"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []interaction{
+		{"2 TOP level 1 MIN", "2 TOP level 1 MIN jasmine:2:0.25"},
+		{"3 TOP level 10 MAX", "3 TOP level 10 MAX water:1:0.50 jasmine:2:0.25"},
+		{"4 TOP pressure 10 MAX", "4 TOP pressure 10 MAX"},
+		{"5 TOP level 0 MAX", "5 ERR"},
+		{"6 TOP level 1 MEDIAN", "6 ERR"},
+	} {
+		if err := sendExpect(client, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	server := New(listener, 4, clock.NewMock(), WithRedelivery(time.Minute))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "1 UNREGISTER", "1 ERR"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(station, "2 REGISTER water source", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	// even idempotent runs fail straight away.
+	if err := sendExpect(client, "r1 RUN idempotent=true water read", "r1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expect(station, "r1 RUN read"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(station, "3 UNREGISTER", "3 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expect(client, "r1 ERR UNREGISTERED"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection carries on as a client, and can register again.
+	for _, in := range []interaction{
+		{"4 LIST", "4 LIST"},
+		{"5 METRIC level 1", "5 ERR"},
+		{"6 REGISTER water source", "6 ACK"},
+		{"7 LIST", "7 LIST water:source:70"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandlersMatchSpec(t *testing.T) {
+	server := New(nil, 4, clock.NewMock())
+
+	for _, c := range proto.Commands {
+		if server.handlerFor(c.Name) == nil {
+			t.Errorf("%s is in the protocol spec, but has no handler", c.Name)
+		}
+	}
+
+	// and every command handlerFor knows of is in the spec, or the
+	// dispatcher turns it away as unknown.
+	src, err := os.ReadFile("handler.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := bytes.Index(src, []byte("func (s *Server) handlerFor("))
+	end := start + bytes.Index(src[start:], []byte("\n}\n"))
+	for _, m := range regexp.MustCompile(`case "([A-Z]+)":`).FindAllSubmatch(src[start:end], -1) {
+		if _, ok := proto.Lookup(string(m[1])); !ok {
+			t.Errorf("%s has a handler, but isn't in the protocol spec", m[1])
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrServerClosed is returned by Serve once Shutdown has been called.
+var ErrServerClosed = errors.New("server closed")
+
+// Shutdown stops the server gracefully: it stops accepting connections,
+// says BYE to the clients that are connected if the server was asked to,
+// lets the commands they're in the middle of finish, and waits for their
+// connections to be cleaned up, as if they'd disconnected. If ctx is done
+// first, the remaining connections are closed outright and ctx's error is
+// returned. Either way, points waiting to be exported are written out.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connsM.Lock()
+	s.closing = true
+	conns := make([]*clientConn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.connsM.Unlock()
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	for _, conn := range conns {
+		if s.bye {
+			fmt.Fprintf(conn, "bye BYE\n")
+		}
+		// reads give up right away, but the command being handled can
+		// still be answered.
+		conn.SetReadDeadline(time.Now())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		for _, conn := range conns {
+			conn.Close()
+		}
+		err = ctx.Err()
+	}
+
+	if s.export != nil {
+		s.export.flush()
+	}
+	return err
+}
+
+// isClosing reports whether Shutdown has been called.
+func (s *Server) isClosing() bool {
+	s.connsM.Lock()
+	defer s.connsM.Unlock()
+
+	return s.closing
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock(), WithBye())
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(context.Background()) }()
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bufio.NewReader(station)
+	if err := expectLines(lines, "bye BYE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lines.ReadString('\n'); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Fatalf("expected Serve to return ErrServerClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve to return")
+	}
+
+	// the station was cleaned up as if it had disconnected.
+	server.stationsM.RLock()
+	defer server.stationsM.RUnlock()
+	if _, ok := server.stations["water"]; ok {
+		t.Fatal("expected the station to be gone")
+	}
+
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Fatal("expected the server to stop accepting connections")
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock())
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx) }()
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != context.Canceled {
+			t.Fatalf("expected Serve to return context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve to return")
+	}
+
+	// connections go with it.
+	if _, err := bufio.NewReader(station).ReadString('\n'); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
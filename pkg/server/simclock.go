@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+)
+
+// Everything the server does over time (janitors, reapers, timeouts,
+// reports, SLO windows, batching) goes by its clock. A server running on a
+// simulated clock only moves on when told to, so integration tests can
+// drive time-based behaviour deterministically, and skip hours ahead in
+// moments.
+
+// ADVANCE cmd (admin only, on a simulated clock)
+// Expected args:
+//  - [duration]
+func (s *Server) handleAdvance(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 1 {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	mock, ok := s.Clock.(*clock.Mock)
+	if !ok {
+		return "", errors.New("the server isn't running on a simulated clock")
+	}
+
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		return "", badArg(args[0], err)
+	}
+	if d < 0 {
+		return "", badArgf(args[0], "the clock can't go backwards")
+	}
+
+	// timers due along the way fire in order, as they would have in real
+	// time.
+	mock.Add(d)
+	return fmt.Sprintf("ADVANCE %d", mock.Now().Unix()), nil
+}
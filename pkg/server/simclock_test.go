@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestAdvance(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock(), TrustPlaintext(), WithReaper(30*time.Second, 10*time.Second))
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	admin, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []interaction{
+		{"1 ADVANCE -1s", "1 ERR"},
+		{"2 ADVANCE 20s", "2 ADVANCE 20"},
+		{"3 LIST", "3 LIST water:source:100"},
+		// the reaper gets its turn on the way.
+		{"4 ADVANCE 1h", "4 ADVANCE 3620"},
+	} {
+		if err := sendExpect(admin, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, "the station to be reaped", func() bool {
+		server.stationsM.RLock()
+		defer server.stationsM.RUnlock()
+		return len(server.stations) == 0
+	})
+}
+
+func TestAdvanceRealClock(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.New(), TrustPlaintext())
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := sendExpect(conn, "1 ADVANCE 1h", "1 ERR"); err != nil {
+		t.Fatal(err)
+	}
+}
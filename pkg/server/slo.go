@@ -0,0 +1,210 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SLO is a service level objective on the runs of a function, e.g. "99% of
+// read_level runs succeed within 5s over 1h".
+type SLO struct {
+	// Function the objective applies to.
+	Function string
+	// Station limits the objective to a single station. Empty applies it to
+	// every station, each tracked separately.
+	Station string
+	// Type limits the objective to stations of a single type.
+	Type string
+	// Target is the fraction of runs (0-1) that should be good.
+	Target float64
+	// Within is how quickly a run must finish with DONE to count as good.
+	// Zero accepts any latency.
+	Within time.Duration
+	// Window is how far back runs are considered.
+	Window time.Duration
+	// Burn is the rate at which the error budget may be spent before
+	// alerting; 1 alerts as soon as the window's budget is used up.
+	Burn float64
+	// Min is how many runs the window needs before it's judged at all, so
+	// one early failure doesn't page anyone.
+	Min int
+}
+
+func (o SLO) String() string {
+	s := fmt.Sprintf("%g%% of %s runs", o.Target*100, o.Function)
+	if o.Within > 0 {
+		s += fmt.Sprintf(" within %s", o.Within)
+	}
+	return s + fmt.Sprintf(" over %s", o.Window)
+}
+
+// ParseSLO reads an objective from comma separated key=value pairs, e.g.
+// fn=read_level,target=99,within=5s,window=1h. station, burn (default 1) and
+// min (default 10) are optional. target is a percentage.
+func ParseSLO(spec string) (SLO, error) {
+	o := SLO{Burn: 1, Min: 10}
+
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return o, errors.Errorf("bad slo option %q", pair)
+		}
+
+		var err error
+		switch k, v := kv[0], kv[1]; k {
+		case "fn":
+			o.Function = v
+		case "station":
+			o.Station = v
+		case "target":
+			o.Target, err = strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+			o.Target /= 100
+		case "within":
+			o.Within, err = time.ParseDuration(v)
+		case "window":
+			o.Window, err = time.ParseDuration(v)
+		case "burn":
+			o.Burn, err = strconv.ParseFloat(v, 64)
+		case "min":
+			o.Min, err = strconv.Atoi(v)
+		default:
+			return o, errors.Errorf("unknown slo option %q", k)
+		}
+		if err != nil {
+			return o, errors.Wrapf(err, "bad slo option %q", pair)
+		}
+	}
+
+	switch {
+	case o.Function == "":
+		return o, errors.Errorf("slo %q needs a fn", spec)
+	case o.Target <= 0 || o.Target >= 1:
+		return o, errors.Errorf("slo %q needs a target between 0 and 100%%", spec)
+	case o.Window <= 0:
+		return o, errors.Errorf("slo %q needs a window", spec)
+	case o.Burn <= 0:
+		return o, errors.Errorf("slo %q needs a positive burn rate", spec)
+	}
+
+	return o, nil
+}
+
+type sloEvent struct {
+	ts   time.Time
+	good bool
+}
+
+// sloState tracks one objective on one station.
+type sloState struct {
+	events []sloEvent
+	firing bool
+}
+
+// sloTracker evaluates objectives as runs finish.
+type sloTracker struct {
+	m      sync.Mutex
+	slos   []SLO
+	states map[string]*sloState
+}
+
+func newSLOTracker() *sloTracker {
+	return &sloTracker{states: map[string]*sloState{}}
+}
+
+// sloChange is an objective starting or stopping burning on a station.
+type sloChange struct {
+	slo     SLO
+	station string
+	firing  bool
+	burn    float64
+}
+
+// observe records a finished run and returns any objectives whose alert
+// state changed because of it.
+func (t *sloTracker) observe(station, tipe, fn string, latency time.Duration, ok bool, now time.Time) []sloChange {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	var changes []sloChange
+	for i, o := range t.slos {
+		if o.Function != fn || (o.Station != "" && o.Station != station) || (o.Type != "" && o.Type != tipe) {
+			continue
+		}
+
+		key := fmt.Sprintf("%d/%s", i, station)
+		st, exists := t.states[key]
+		if !exists {
+			st = &sloState{}
+			t.states[key] = st
+		}
+
+		good := ok && (o.Within == 0 || latency <= o.Within)
+		st.events = append(st.events, sloEvent{ts: now, good: good})
+
+		cutoff := now.Add(-o.Window)
+		for len(st.events) > 0 && st.events[0].ts.Before(cutoff) {
+			st.events = st.events[1:]
+		}
+
+		if len(st.events) < o.Min {
+			continue
+		}
+
+		bad := 0
+		for _, e := range st.events {
+			if !e.good {
+				bad++
+			}
+		}
+
+		// the burn rate is how fast the error budget is being spent,
+		// relative to spending exactly all of it over the window.
+		burn := float64(bad) / float64(len(st.events)) / (1 - o.Target)
+		firing := burn >= o.Burn
+		if firing != st.firing {
+			st.firing = firing
+			changes = append(changes, sloChange{slo: o, station: station, firing: firing, burn: burn})
+		}
+	}
+
+	return changes
+}
+
+// burning returns how many objectives are burning their error budget on a
+// station.
+func (t *sloTracker) burning(station string) int {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	n := 0
+	for key, st := range t.states {
+		if key[strings.Index(key, "/")+1:] == station && st.firing {
+			n++
+		}
+	}
+	return n
+}
+
+// finishRun records the outcome of a run in the statistics and objectives.
+func (s *Server) finishRun(station string, r *run, ok bool) {
+	now := s.Clock.Now()
+	latency := now.Sub(r.started)
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+
+	s.runStats.finished(station, r.fn, latency, ok)
+
+	for _, c := range s.slos.observe(station, r.tipe, r.fn, latency, ok, now) {
+		if c.firing {
+			s.raise(c.slo.String(), "slo.burn", station, "%s is burning its error budget at %.1fx", c.slo, c.burn)
+		} else {
+			s.resolve(c.slo.String(), "slo.ok", station, "%s is back within its error budget", c.slo)
+		}
+	}
+}
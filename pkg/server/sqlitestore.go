@@ -0,0 +1,337 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// SQLiteStore is a StationStore backed by a SQLite database, for small
+// deployments that want durable history without running anything else. It
+// keeps every point it's given, along with what every station registered
+// as, so the server knows of them as soon as it starts, and the notes on
+// them.
+type SQLiteStore struct {
+	db        *sql.DB
+	path      string
+	maxPoints int
+}
+
+// sqliteMigrations bring a database's schema up to date, in order. The
+// database's user_version is how many of them it's had, so new ones are
+// only ever added to the end.
+var sqliteMigrations = []string{
+	`CREATE TABLE stations (
+		name TEXT PRIMARY KEY,
+		type TEXT NOT NULL,
+		lat  REAL,
+		lon  REAL
+	);
+	CREATE TABLE points (
+		station TEXT NOT NULL,
+		metric  TEXT NOT NULL,
+		ts      INTEGER NOT NULL,
+		value   REAL NOT NULL,
+		PRIMARY KEY (station, metric, ts, value)
+	) WITHOUT ROWID;`,
+	// for expiring points by age.
+	`CREATE INDEX points_ts ON points (ts);`,
+	`CREATE TABLE notes (
+		station TEXT NOT NULL,
+		added   INTEGER NOT NULL,
+		from_ts INTEGER NOT NULL,
+		to_ts   INTEGER NOT NULL,
+		text    TEXT NOT NULL
+	);
+	CREATE INDEX notes_station ON notes (station, from_ts);`,
+	// a station's tags, as a JSON object.
+	`ALTER TABLE stations ADD COLUMN tags TEXT NOT NULL DEFAULT '{}';`,
+}
+
+// OpenSQLiteStore opens (or creates) a SQLite database at path, migrating
+// its schema if it's from an older server. Queries return at most maxPoints
+// points per metric, the most recent ones.
+func OpenSQLiteStore(path string, maxPoints int) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_synchronous=FULL&_busy_timeout=5000")
+	if err != nil {
+		return nil, errors.Wrap(err, "opening sqlite store")
+	}
+	// SQLite only has one writer at a time anyway.
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db, path: path, maxPoints: maxPoints}, nil
+}
+
+// migrateSQLite applies the migrations the database hasn't had yet, each in a
+// transaction of its own.
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return errors.Wrap(err, "reading sqlite store version")
+	}
+	if version > len(sqliteMigrations) {
+		return errors.Errorf("sqlite store is from a newer server (version %d, expected at most %d)", version, len(sqliteMigrations))
+	}
+
+	for v := version; v < len(sqliteMigrations); v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return errors.Wrap(err, "migrating sqlite store")
+		}
+		if _, err := tx.Exec(sqliteMigrations[v]); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "migrating sqlite store to version %d", v+1)
+		}
+		// PRAGMA doesn't take parameters.
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, v+1)); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "migrating sqlite store to version %d", v+1)
+		}
+		if err := tx.Commit(); err != nil {
+			return errors.Wrapf(err, "migrating sqlite store to version %d", v+1)
+		}
+	}
+	return nil
+}
+
+// Append writes points in a single transaction.
+func (q *SQLiteStore) Append(points ...StoredPoint) error {
+	err := q.update(func(tx *sql.Tx) error {
+		insert, err := tx.Prepare(`INSERT OR IGNORE INTO points (station, metric, ts, value) VALUES (?, ?, ?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer insert.Close()
+
+		for _, p := range points {
+			if _, err := insert.Exec(p.Station, p.Metric, p.Ts.UnixNano(), p.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "writing sqlite store")
+}
+
+// Query returns the most recent points of each of a station's metrics.
+func (q *SQLiteStore) Query(station string) ([]StoredPoint, error) {
+	rows, err := q.db.Query(`
+		SELECT metric, ts, value FROM (
+			SELECT metric, ts, value, ROW_NUMBER() OVER (PARTITION BY metric ORDER BY ts DESC, value DESC) AS n
+			FROM points WHERE station = ?
+		)
+		WHERE n <= ?
+		ORDER BY metric, ts, value`, station, q.maxPoints)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading sqlite store")
+	}
+	defer rows.Close()
+
+	var points []StoredPoint
+	for rows.Next() {
+		p := StoredPoint{Station: station}
+		var ts int64
+		if err := rows.Scan(&p.Metric, &ts, &p.Value); err != nil {
+			return nil, errors.Wrap(err, "reading sqlite store")
+		}
+		p.Ts = time.Unix(0, ts)
+		points = append(points, p)
+	}
+	return points, errors.Wrap(rows.Err(), "reading sqlite store")
+}
+
+// Prune drops a station's points of metric. If metric is empty, it drops
+// all of them, and forgets the station and its notes altogether.
+func (q *SQLiteStore) Prune(station, metric string) error {
+	if metric != "" {
+		_, err := q.db.Exec(`DELETE FROM points WHERE station = ? AND metric = ?`, station, metric)
+		return errors.Wrap(err, "pruning sqlite store")
+	}
+
+	err := q.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM points WHERE station = ?`, station); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM notes WHERE station = ?`, station); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM stations WHERE name = ?`, station)
+		return err
+	})
+	return errors.Wrap(err, "pruning sqlite store")
+}
+
+// Expire drops every point from before cutoff.
+func (q *SQLiteStore) Expire(cutoff time.Time) error {
+	_, err := q.db.Exec(`DELETE FROM points WHERE ts < ?`, cutoff.UnixNano())
+	return errors.Wrap(err, "expiring points from sqlite store")
+}
+
+// Stations returns the name of every station with points in the store.
+func (q *SQLiteStore) Stations() ([]string, error) {
+	rows, err := q.db.Query(`SELECT DISTINCT station FROM points`)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading sqlite store")
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, errors.Wrap(err, "reading sqlite store")
+		}
+		names = append(names, name)
+	}
+	return names, errors.Wrap(rows.Err(), "reading sqlite store")
+}
+
+// Rename moves a station, and its points and notes, to its new name.
+func (q *SQLiteStore) Rename(from, to string) error {
+	err := q.update(func(tx *sql.Tx) error {
+		for _, stmt := range []string{
+			`INSERT OR IGNORE INTO points (station, metric, ts, value) SELECT ?2, metric, ts, value FROM points WHERE station = ?1`,
+			`DELETE FROM points WHERE station = ?1`,
+			`INSERT OR REPLACE INTO stations (name, type, lat, lon, tags) SELECT ?2, type, lat, lon, tags FROM stations WHERE name = ?1`,
+			`DELETE FROM stations WHERE name = ?1`,
+			`UPDATE notes SET station = ?2 WHERE station = ?1`,
+		} {
+			if _, err := tx.Exec(stmt, from, to); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "renaming in sqlite store")
+}
+
+// update runs fn in a transaction, which is committed if fn succeeds.
+func (q *SQLiteStore) update(fn func(tx *sql.Tx) error) error {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SaveStation records what a station registered as.
+func (q *SQLiteStore) SaveStation(station StoredStation) error {
+	var lat, lon sql.NullFloat64
+	if l := station.Location; l != nil {
+		lat = sql.NullFloat64{Float64: l.Lat, Valid: true}
+		lon = sql.NullFloat64{Float64: l.Lon, Valid: true}
+	}
+
+	tags, err := json.Marshal(station.Tags)
+	if err != nil || station.Tags == nil {
+		tags = []byte("{}")
+	}
+
+	_, err = q.db.Exec(`INSERT OR REPLACE INTO stations (name, type, lat, lon, tags) VALUES (?, ?, ?, ?, ?)`, station.Name, station.Type, lat, lon, string(tags))
+	return errors.Wrap(err, "writing sqlite store")
+}
+
+// LoadStations returns every station recorded.
+func (q *SQLiteStore) LoadStations() ([]StoredStation, error) {
+	rows, err := q.db.Query(`SELECT name, type, lat, lon, tags FROM stations ORDER BY name`)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading sqlite store")
+	}
+	defer rows.Close()
+
+	var stations []StoredStation
+	for rows.Next() {
+		var station StoredStation
+		var lat, lon sql.NullFloat64
+		var tags string
+		if err := rows.Scan(&station.Name, &station.Type, &lat, &lon, &tags); err != nil {
+			return nil, errors.Wrap(err, "reading sqlite store")
+		}
+		if lat.Valid && lon.Valid {
+			station.Location = &Location{Lat: lat.Float64, Lon: lon.Float64}
+		}
+		if err := json.Unmarshal([]byte(tags), &station.Tags); err != nil {
+			return nil, errors.Wrapf(err, "reading %s's tags from sqlite store", station.Name)
+		}
+		if len(station.Tags) == 0 {
+			station.Tags = nil
+		}
+		stations = append(stations, station)
+	}
+	return stations, errors.Wrap(rows.Err(), "reading sqlite store")
+}
+
+// SaveNote records a note on a station.
+func (q *SQLiteStore) SaveNote(note StoredNote) error {
+	_, err := q.db.Exec(`INSERT INTO notes (station, added, from_ts, to_ts, text) VALUES (?, ?, ?, ?, ?)`,
+		note.Station, note.Added.UnixNano(), note.From.UnixNano(), note.To.UnixNano(), note.Text)
+	return errors.Wrap(err, "writing sqlite store")
+}
+
+// LoadNotes returns every note recorded.
+func (q *SQLiteStore) LoadNotes() ([]StoredNote, error) {
+	rows, err := q.db.Query(`SELECT station, added, from_ts, to_ts, text FROM notes ORDER BY station, from_ts`)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading sqlite store")
+	}
+	defer rows.Close()
+
+	var notes []StoredNote
+	for rows.Next() {
+		var note StoredNote
+		var added, from, to int64
+		if err := rows.Scan(&note.Station, &added, &from, &to, &note.Text); err != nil {
+			return nil, errors.Wrap(err, "reading sqlite store")
+		}
+		note.Added, note.From, note.To = time.Unix(0, added), time.Unix(0, from), time.Unix(0, to)
+		notes = append(notes, note)
+	}
+	return notes, errors.Wrap(rows.Err(), "reading sqlite store")
+}
+
+// Backup writes a copy of the database, as of a single transaction. SQLite
+// writes it to a file next to the database first, which is then streamed to
+// w and removed.
+func (q *SQLiteStore) Backup(w io.Writer) error {
+	f, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".backup-*")
+	if err != nil {
+		return errors.Wrap(err, "backing up sqlite store")
+	}
+	tmp := f.Name()
+	f.Close()
+	defer os.Remove(tmp)
+
+	// VACUUM INTO takes an empty file as one that doesn't exist.
+	if _, err := q.db.Exec(`VACUUM INTO ?`, tmp); err != nil {
+		return errors.Wrap(err, "backing up sqlite store")
+	}
+
+	f, err = os.Open(tmp)
+	if err != nil {
+		return errors.Wrap(err, "backing up sqlite store")
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return errors.Wrap(err, "backing up sqlite store")
+}
+
+// Close closes the database.
+func (q *SQLiteStore) Close() error {
+	return q.db.Close()
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	path := tempPointLogPath(t)
+
+	q, err := OpenSQLiteStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		if err := q.Append(StoredPoint{"water", "level", time.Unix(i, 0), float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Append(StoredPoint{"water", "flow", time.Unix(1, 0), 4}, StoredPoint{"jasmine", "moisture", time.Unix(1, 0), 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SaveStation(StoredStation{Name: "water", Type: "source", Location: &Location{Lat: 45.5, Lon: -122.6}, Tags: map[string]string{"owner": "ops"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopening doesn't migrate again.
+	q, err = OpenSQLiteStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// only the newest points are queried, oldest first.
+	points, err := q.Query("water")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []StoredPoint{
+		{"water", "flow", time.Unix(1, 0), 4},
+		{"water", "level", time.Unix(2, 0), 2},
+		{"water", "level", time.Unix(3, 0), 3},
+	}
+	if !reflect.DeepEqual(points, expected) {
+		t.Fatalf("expected %v, got %v", expected, points)
+	}
+
+	if err := q.Prune("water", "level"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Rename("water", "tank"); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := q.Stations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"jasmine", "tank"}) {
+		t.Fatalf("unexpected stations %v", names)
+	}
+
+	points, err = q.Query("tank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || points[0].Station != "tank" || points[0].Metric != "flow" || points[0].Value != 4 {
+		t.Fatalf("unexpected points after rename %v", points)
+	}
+
+	stations, err := q.LoadStations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stations) != 1 || stations[0].Name != "tank" || stations[0].Type != "source" || *stations[0].Location != (Location{Lat: 45.5, Lon: -122.6}) || stations[0].Tags["owner"] != "ops" {
+		t.Fatalf("unexpected stations after rename %+v", stations)
+	}
+
+	// forgetting a station takes it out of the store altogether.
+	if err := q.Prune("tank", ""); err != nil {
+		t.Fatal(err)
+	}
+	if stations, err := q.LoadStations(); err != nil || len(stations) != 0 {
+		t.Fatalf("expected no stations, got %+v, %v", stations, err)
+	}
+}
+
+func TestSQLiteStoreFromNewerServer(t *testing.T) {
+	path := tempPointLogPath(t)
+
+	q, err := OpenSQLiteStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.db.Exec(`PRAGMA user_version = 1000`); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	if _, err := OpenSQLiteStore(path, 2); err == nil {
+		t.Fatal("expected a store from a newer server to be refused")
+	}
+}
+
+func TestServerRestoresFromSQLiteStore(t *testing.T) {
+	path := tempPointLogPath(t)
+
+	for i, interactions := range [][]interaction{
+		{
+			{"1 REGISTER water source location=45.5,-122.6", "1 ACK"},
+			{"2 METRIC level 1", "2 ACK"},
+			{"3 METRIC level 2", "3 ACK"},
+		},
+		{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 METRICS water level", "2 METRICS water level 0:1.00 0:2.00"},
+			{"3 INFO water", "3 INFO water type=source health=100 location=45.500000,-122.600000"},
+		},
+		// registering without a location doesn't lose the one it had.
+		{
+			{"1 REGISTER water source", "1 ACK"},
+			{"2 INFO water", "2 INFO water type=source health=100 location=45.500000,-122.600000"},
+		},
+	} {
+		store, err := OpenSQLiteStore(path, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := New(listener, 4, clock.NewMock(), WithMetricStore(store))
+		go server.Serve(context.Background())
+
+		// the station is known from the start, before it registers again.
+		if i > 0 {
+			server.stationsM.RLock()
+			r, restored := server.restored["water"]
+			_, offline := server.lastSeen["water"]
+			server.stationsM.RUnlock()
+			if !restored || !offline || r.tipe != "source" {
+				t.Fatalf("expected water to be known as an offline source, got %+v", r)
+			}
+		}
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, in := range interactions {
+			if err := sendExpect(conn, in.send, in.expect); err != nil {
+				t.Fatalf("run %d: %v", i, err)
+			}
+		}
+
+		conn.Close()
+		store.Close()
+	}
+}
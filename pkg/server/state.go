@@ -0,0 +1,414 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dumpChunk is the most metric points put in one state record, to keep
+// records comfortably inside a protocol line.
+const dumpChunk = 256
+
+// stateRecord is one line of a state dump. Dumps are a station record for
+// each station, followed by records of its metric history, notes and run
+// statistics,
+// and finally a record for each configuration blob and for the latest
+// firmware of each type.
+type stateRecord struct {
+	Kind    string `json:"kind"`
+	Station string `json:"station"`
+
+	// kind station
+	Type     string            `json:"type,omitempty"`
+	Location *Location         `json:"location,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+
+	// kind metric
+	Metric string       `json:"metric,omitempty"`
+	Points []statePoint `json:"points,omitempty"`
+
+	// kind note
+	Added int64  `json:"added_ns,omitempty"`
+	From  int64  `json:"from_ns,omitempty"`
+	To    int64  `json:"to_ns,omitempty"`
+	Text  string `json:"text,omitempty"`
+
+	// kind runs
+	Function  string  `json:"function,omitempty"`
+	Count     int     `json:"count,omitempty"`
+	Completed int     `json:"completed,omitempty"`
+	Errors    int     `json:"errors,omitempty"`
+	Total     int64   `json:"total_ns,omitempty"`
+	Latencies []int64 `json:"latencies_ns,omitempty"`
+
+	// kind config, for a station or (with Type, and no Station) a type
+	Version int    `json:"version,omitempty"`
+	Config  string `json:"config,omitempty"`
+
+	// kind firmware, for a type (with Type, and no Station)
+	Firmware string `json:"firmware,omitempty"`
+}
+
+type statePoint struct {
+	TS    int64   `json:"ts_ns"`
+	Value float64 `json:"value"`
+}
+
+// restoredStation is what's known about a station from a LOAD, kept until
+// (and, for its metadata, after) the station registers.
+type restoredStation struct {
+	tipe     string
+	location *Location
+	tags     map[string]string
+	metrics  map[string][]metric
+}
+
+// restoredStation returns the restored state for a station, creating it if needed.
+// Must be called with stationsM held.
+func (s *Server) restoredStation(name string) *restoredStation {
+	r, ok := s.restored[name]
+	if !ok {
+		r = &restoredStation{metrics: map[string][]metric{}}
+		s.restored[name] = r
+	}
+	return r
+}
+
+// dump collects the state of every station the server knows about, whether
+// or not it's connected.
+func (s *Server) dump() []stateRecord {
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	names := map[string]bool{}
+	for name := range s.stations {
+		names[name] = true
+	}
+	for name := range s.restored {
+		names[name] = true
+	}
+	for name := range s.locations {
+		names[name] = true
+	}
+	if s.store != nil {
+		for _, name := range s.storedStations() {
+			names[name] = true
+		}
+	}
+
+	s.notes.m.Lock()
+	for name := range s.notes.notes {
+		names[name] = true
+	}
+	s.notes.m.Unlock()
+
+	s.runStats.m.Lock()
+	for name := range s.runStats.stations {
+		names[name] = true
+	}
+	s.runStats.m.Unlock()
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var records []stateRecord
+	for _, name := range sorted {
+		records = append(records, s.dumpStation(name)...)
+	}
+
+	for _, target := range s.configTargets() {
+		c := s.configs[target]
+		rec := stateRecord{Kind: "config", Station: target, Version: c.version, Config: c.blob}
+		if strings.HasPrefix(target, typeTarget) {
+			rec.Station, rec.Type = "", strings.TrimPrefix(target, typeTarget)
+		}
+		records = append(records, rec)
+	}
+
+	types := make([]string, 0, len(s.firmware))
+	for tipe := range s.firmware {
+		types = append(types, tipe)
+	}
+	sort.Strings(types)
+	for _, tipe := range types {
+		records = append(records, stateRecord{Kind: "firmware", Type: tipe, Firmware: s.firmware[tipe]})
+	}
+	return records
+}
+
+// dumpStation must be called with stationsM held for reading.
+func (s *Server) dumpStation(name string) []stateRecord {
+	station := &Station{}
+	var metrics map[string][]metric
+
+	if connected, ok := s.stations[name]; ok {
+		station = connected
+
+		// series are copy-on-write, so a copy of the map is a snapshot.
+		connected.m.Lock()
+		metrics = make(map[string][]metric, len(connected.metrics))
+		for m, ms := range connected.metrics {
+			metrics[m] = ms
+		}
+		connected.m.Unlock()
+	} else if r, ok := s.restored[name]; ok && s.store == nil {
+		metrics = r.metrics
+	} else if s.store != nil {
+		metrics = s.history(name)
+	}
+
+	header := stateRecord{Kind: "station", Station: name, Type: station.tipe, Tags: copyTags(station.tags)}
+	if r, ok := s.restored[name]; ok && header.Type == "" {
+		header.Type = r.tipe
+		header.Tags = copyTags(r.tags)
+	}
+	if l, ok := s.location(name, station); ok {
+		header.Location = &l
+	}
+	records := []stateRecord{header}
+
+	metricNames := make([]string, 0, len(metrics))
+	for m := range metrics {
+		metricNames = append(metricNames, m)
+	}
+	sort.Strings(metricNames)
+
+	for _, m := range metricNames {
+		ms := metrics[m]
+		for len(ms) > 0 {
+			n := len(ms)
+			if n > dumpChunk {
+				n = dumpChunk
+			}
+
+			rec := stateRecord{Kind: "metric", Station: name, Metric: m}
+			for _, p := range ms[:n] {
+				rec.Points = append(rec.Points, statePoint{TS: p.ts.UnixNano(), Value: p.value})
+			}
+			records = append(records, rec)
+			ms = ms[n:]
+		}
+	}
+
+	s.notes.m.Lock()
+	for _, nt := range s.notes.notes[name] {
+		records = append(records, stateRecord{
+			Kind:    "note",
+			Station: name,
+			Added:   nt.added.UnixNano(),
+			From:    nt.from.UnixNano(),
+			To:      nt.to.UnixNano(),
+			Text:    nt.text,
+		})
+	}
+	s.notes.m.Unlock()
+
+	s.runStats.m.Lock()
+	defer s.runStats.m.Unlock()
+
+	fns := s.runStats.stations[name]
+	fnNames := make([]string, 0, len(fns))
+	for fn := range fns {
+		fnNames = append(fnNames, fn)
+	}
+	sort.Strings(fnNames)
+
+	for _, fn := range fnNames {
+		f := fns[fn]
+		rec := stateRecord{
+			Kind:      "runs",
+			Station:   name,
+			Function:  fn,
+			Count:     f.count,
+			Completed: f.completed,
+			Errors:    f.errors,
+			Total:     int64(f.total),
+		}
+
+		// oldest first, so loading them keeps the same ring order.
+		for i := range f.latencies {
+			rec.Latencies = append(rec.Latencies, int64(f.latencies[(f.next+i)%len(f.latencies)]))
+		}
+		records = append(records, rec)
+	}
+
+	return records
+}
+
+// load merges a state record into the server.
+func (s *Server) load(rec stateRecord) error {
+	if (rec.Kind == "config" || rec.Kind == "firmware") && rec.Station == "" {
+		if rec.Type == "" || strings.ContainsAny(rec.Type, " =") {
+			return errors.Errorf("bad station type %q", rec.Type)
+		}
+	} else if rec.Station == "" || strings.ContainsAny(rec.Station, " =") {
+		return errors.Errorf("bad station name %q", rec.Station)
+	}
+
+	switch rec.Kind {
+	case "station":
+		s.stationsM.Lock()
+		defer s.stationsM.Unlock()
+
+		r := s.restoredStation(rec.Station)
+		r.tipe = rec.Type
+		r.location = rec.Location
+		r.tags = copyTags(rec.Tags)
+
+	case "metric":
+		if rec.Metric == "" || strings.Contains(rec.Metric, " ") {
+			return errors.Errorf("bad metric name %q", rec.Metric)
+		}
+		if err := validateMetricName(rec.Metric); err != nil {
+			return err
+		}
+
+		var stored []StoredPoint
+		s.stationsM.Lock()
+		for _, p := range rec.Points {
+			m := metric{ts: time.Unix(0, p.TS), value: p.Value}
+
+			if station, ok := s.stations[rec.Station]; ok {
+				station.m.Lock()
+				station.metrics[rec.Metric], _ = insertMetric(station.metrics[rec.Metric], m, s.maxMetricPoints)
+				station.m.Unlock()
+
+				if s.cache != nil {
+					s.cache.invalidate(rec.Metric)
+				}
+			} else if s.store == nil {
+				r := s.restoredStation(rec.Station)
+				r.metrics[rec.Metric], _ = insertMetric(r.metrics[rec.Metric], m, s.maxMetricPoints)
+			}
+
+			if s.store != nil {
+				stored = append(stored, storedPoint(rec.Station, rec.Metric, m))
+			}
+		}
+		s.stationsM.Unlock()
+
+		if len(stored) > 0 {
+			if err := s.store.Append(stored...); err != nil {
+				return err
+			}
+		}
+
+	case "note":
+		if rec.Text == "" || rec.To < rec.From {
+			return errors.Errorf("bad note on %s", rec.Station)
+		}
+
+		nt := note{added: time.Unix(0, rec.Added), from: time.Unix(0, rec.From), to: time.Unix(0, rec.To), text: rec.Text}
+		s.notes.add(rec.Station, nt)
+		s.saveNote(rec.Station, nt)
+
+	case "runs":
+		if rec.Function == "" {
+			return errors.Errorf("runs record without a function")
+		}
+
+		s.runStats.m.Lock()
+		defer s.runStats.m.Unlock()
+
+		f := s.runStats.get(rec.Station, rec.Function)
+		f.count += rec.Count
+		f.completed += rec.Completed
+		f.errors += rec.Errors
+		f.total += time.Duration(rec.Total)
+		for _, l := range rec.Latencies {
+			f.sample(time.Duration(l))
+		}
+
+	case "config":
+		if rec.Version <= 0 {
+			return errors.Errorf("config record without a version")
+		}
+
+		target := rec.Station
+		if target == "" {
+			target = typeTarget + rec.Type
+		}
+
+		s.stationsM.Lock()
+		defer s.stationsM.Unlock()
+
+		s.setConfig(target, rec.Config, rec.Version)
+
+	case "firmware":
+		if rec.Station != "" || strings.Contains(rec.Type, ":") {
+			return errors.Errorf("firmware record without a station type")
+		}
+		if err := validateFirmware(rec.Firmware); err != nil {
+			return err
+		}
+
+		s.stationsM.Lock()
+		defer s.stationsM.Unlock()
+
+		s.setLatestFirmware(rec.Type, rec.Firmware)
+
+	default:
+		return errors.Errorf("unknown record kind %q", rec.Kind)
+	}
+
+	return nil
+}
+
+// DUMP cmd (admin only)
+// Expected args: none
+//
+// Each record of the server's state is sent as its own [uid] STATE [json]
+// response before the final DUMP one.
+func (s *Server) handleDump(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 0 {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	records := s.dump()
+	for _, rec := range records {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return "", errors.Wrap(err, "encoding state")
+		}
+		fmt.Fprintf(conn, "%s STATE %s\n", uid, b)
+	}
+
+	return fmt.Sprintf("DUMP %d", len(records)), nil
+}
+
+// LOAD cmd (admin only)
+// Expected args:
+//  - [json] a record as sent by DUMP
+func (s *Server) handleLoad(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 1 {
+		return "", argCount(args)
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	var rec stateRecord
+	if err := json.Unmarshal([]byte(strings.Join(args, " ")), &rec); err != nil {
+		return "", errors.Wrap(err, "bad state record")
+	}
+
+	if err := s.load(rec); err != nil {
+		return "", err
+	}
+
+	return "ACK", nil
+}
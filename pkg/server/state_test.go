@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestDumpLoad(t *testing.T) {
+	serve := func(opts ...Option) (string, *clock.Mock) {
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock := clock.NewMock()
+		server := New(listener, 4, mock, opts...)
+		go server.Serve(context.Background())
+
+		return listener.Addr().String(), mock
+	}
+
+	dial := func(addr string) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	from, mock := serve(TrustPlaintext())
+	station, client := dial(from), dial(from)
+
+	for _, in := range []interaction{
+		{"1 REGISTER water source location=45.5,-122.6", "1 ACK"},
+		{"2 METRIC level 1", "2 ACK"},
+		{"3 METRIC level 2", "3 ACK"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := doRun(client, station, mock, "r1", "read", 2*time.Second, "DONE"); err != nil {
+		t.Fatal(err)
+	}
+
+	// dump everything from the first server...
+	admin := dial(from)
+	if err := sendExpect(admin, "0 CONFIG SET type=heater target=20", "0 CONFIG type=heater 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(admin, "0 FIRMWARE SET source 1.1", "0 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(admin, "1 DUMP\n")
+
+	var records []string
+	reader := bufio.NewReader(admin)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "1 STATE ") {
+			records = append(records, strings.TrimPrefix(line, "1 STATE "))
+			continue
+		}
+		if line != "1 DUMP 5" {
+			t.Fatalf("expected 1 DUMP 5, got %q", line)
+		}
+		break
+	}
+
+	// ...load it into a second...
+	to, _ := serve(TrustPlaintext())
+	admin = dial(to)
+	for i, rec := range records {
+		uid := fmt.Sprint(i + 1)
+		if err := sendExpect(admin, uid+" LOAD "+rec, uid+" ACK"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sendExpect(admin, "c CONFIG GET type=heater", "c CONFIG type=heater 1 target=20"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(admin, "f FIRMWARE LATEST", "f FIRMWARE LATEST source:1.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// ...and the station picks up where it left off.
+	station = dial(to)
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 METRICS water level", "2 METRICS water level 0:1.00 0:2.00"},
+		{"3 INFO water", "3 INFO water type=source health=100 location=45.500000,-122.600000 runs.read=n:1,err:0,p50:2s,p90:2s,p99:2s"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDumpLoadAdminOnly(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock())
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(conn, "1 DUMP", "1 ERR"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(conn, `2 LOAD {"kind":"station","station":"water"}`, "2 ERR"); err != nil {
+		t.Fatal(err)
+	}
+}
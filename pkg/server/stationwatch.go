@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Dashboards want to hear about stations coming and going as it happens,
+// rather than diffing LIST responses. Watchers are sent a JOINED line when
+// a station registers, and a LEFT one when it drops off the station list
+// for any reason: unregistering, disconnecting, being forgotten or being
+// renamed.
+
+// stationWatchers are the connections hearing about stations joining and
+// leaving.
+type stationWatchers struct {
+	m           sync.Mutex
+	subscribers map[*eventSubscriber]struct{}
+}
+
+func newStationWatchers() *stationWatchers {
+	return &stationWatchers{subscribers: map[*eventSubscriber]struct{}{}}
+}
+
+// joined tells watchers a station registered.
+func (w *stationWatchers) joined(name, tipe string) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	for sub := range w.subscribers {
+		fmt.Fprintf(sub.conn, "%s JOINED %s %s\n", sub.uid, name, tipe)
+	}
+}
+
+// left tells watchers a station is no longer on the station list.
+func (w *stationWatchers) left(name string) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	for sub := range w.subscribers {
+		fmt.Fprintf(sub.conn, "%s LEFT %s\n", sub.uid, name)
+	}
+}
+
+// WATCH cmd
+// Expected args: none
+//
+// Stations joining and leaving are sent under the same uid as [uid] JOINED
+// [name] [type] and [uid] LEFT [name], until the client cancels.
+func (s *Server) handleWatch(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) != 0 {
+		return "", argCount(args)
+	}
+	if _, ok := conn.streams[uid]; ok {
+		return "", errors.Errorf("uid %s already in use", uid)
+	}
+
+	sub := &eventSubscriber{conn: conn, uid: uid}
+
+	s.watchers.m.Lock()
+	s.watchers.subscribers[sub] = struct{}{}
+	s.watchers.m.Unlock()
+
+	conn.stream(uid, func() {
+		s.watchers.m.Lock()
+		defer s.watchers.m.Unlock()
+
+		delete(s.watchers.subscribers, sub)
+	})
+
+	return "ACK", nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestWatch(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(listener, 4, clock.NewMock(), TrustPlaintext())
+	go server.Serve(context.Background())
+
+	watcher, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	lines := bufio.NewReader(watcher)
+	fmt.Fprintf(watcher, "1 WATCH\n")
+	if err := expectLines(lines, "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectLines(lines, "1 JOINED water source"); err != nil {
+		t.Fatal(err)
+	}
+
+	station.Close()
+	if err := expectLines(lines, "1 LEFT water"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []struct {
+		send   string
+		expect []string
+	}{
+		{"1 WATCH", []string{"1 ERR"}},
+		{"2 WATCH everything", []string{"2 ERR"}},
+		{"1 CANCEL", []string{"1 ACK"}},
+	} {
+		fmt.Fprintf(watcher, "%s\n", in.send)
+		if err := expectLines(lines, in.expect...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// once cancelled, stations come and go unannounced.
+	station, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	if err := sendExpect(station, "2 REGISTER water source", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(watcher, "3 PING\n")
+	if err := expectLines(lines, "3 PONG"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"time"
+)
+
+// The server keeps the most recent points of every station in memory, which
+// is all there is by default: a station's history goes with it when it
+// disconnects, and everything goes when the server restarts. A MetricStore
+// keeps points beyond that, and gives a station its history back when it
+// registers again.
+
+// MetricStore persists metric points. Stores are used from many goroutines
+// at once.
+type MetricStore interface {
+	// Append stores points, and returns once they're safely kept.
+	Append(points ...StoredPoint) error
+	// Query returns the points kept for a station, oldest first for each
+	// metric.
+	Query(station string) ([]StoredPoint, error)
+	// Prune drops the points kept for a station's metric, or for all of its
+	// metrics if metric is "".
+	Prune(station, metric string) error
+	// Stations returns the name of every station with points kept.
+	Stations() ([]string, error)
+	// Rename moves the points kept for a station to a new name.
+	Rename(from, to string) error
+	// Close closes the store, once everything appended is safely kept.
+	Close() error
+}
+
+// StationStore is a MetricStore that also keeps what stations registered
+// as, so the server knows of them from the moment it starts rather than once
+// they register again. Pruning all of a station's metrics forgets the
+// station too.
+type StationStore interface {
+	MetricStore
+	// SaveStation records a station's registration.
+	SaveStation(station StoredStation) error
+	// LoadStations returns every station recorded.
+	LoadStations() ([]StoredStation, error)
+}
+
+// StoredStation is what a station registered as, as kept by a StationStore.
+type StoredStation struct {
+	Name     string
+	Type     string
+	Location *Location
+	// what the station's tagged with, by key.
+	Tags map[string]string
+}
+
+// ExpiringStore is a MetricStore that can drop points by age, for servers
+// with a retention window. Points past retention in other stores are still
+// left out of a station's history.
+type ExpiringStore interface {
+	MetricStore
+	// Expire drops every point from before cutoff.
+	Expire(cutoff time.Time) error
+}
+
+// StoredPoint is a metric point, as kept by a MetricStore.
+type StoredPoint struct {
+	Station string
+	Metric  string
+	Ts      time.Time
+	Value   float64
+}
+
+func storedPoint(station, name string, m metric) StoredPoint {
+	return StoredPoint{Station: station, Metric: name, Ts: m.ts, Value: m.value}
+}
+
+// history returns the series kept in the store for a station, holding on to
+// the most recent points of each like a station in memory does.
+func (s *Server) history(station string) map[string][]metric {
+	points, err := s.store.Query(station)
+	if err != nil {
+		s.log.Errorf("couldn't get %s's history: %v", station, err)
+	}
+
+	cutoff := s.cutoff()
+	series := map[string][]metric{}
+	for _, p := range points {
+		if p.Ts.Before(cutoff) {
+			continue
+		}
+		series[p.Metric], _ = insertMetric(series[p.Metric], metric{ts: p.Ts, value: p.Value}, s.maxMetricPoints)
+	}
+	return series
+}
+
+// storedStations returns the stations with points in the store.
+func (s *Server) storedStations() []string {
+	names, err := s.store.Stations()
+	if err != nil {
+		s.log.Errorf("couldn't list stations in the metric store: %v", err)
+	}
+	return names
+}
+
+// saveStation records a station's registration, if the store keeps them.
+// Must be called with stationsM held.
+func (s *Server) saveStation(name string, station *Station) {
+	ss, ok := s.store.(StationStore)
+	if !ok {
+		return
+	}
+	// a station that doesn't report its location keeps the one it had.
+	location := station.location
+	if r, ok := s.restored[name]; ok && location == nil {
+		location = r.location
+	}
+	if err := ss.SaveStation(StoredStation{Name: name, Type: station.tipe, Location: location, Tags: copyTags(station.tags)}); err != nil {
+		s.log.Errorf("couldn't save station %s: %v", name, err)
+	}
+}
+
+// restoreStations makes the stations recorded in the store known to the
+// server, as offline since it started. Must be called before serving.
+func (s *Server) restoreStations() {
+	ss, ok := s.store.(StationStore)
+	if !ok {
+		return
+	}
+	stations, err := ss.LoadStations()
+	if err != nil {
+		s.log.Errorf("couldn't restore stations: %v", err)
+		return
+	}
+
+	now := s.Clock.Now()
+	for _, station := range stations {
+		r := s.restoredStation(station.Name)
+		r.tipe, r.location, r.tags = station.Type, station.Location, station.Tags
+		s.lastSeen[station.Name] = now
+	}
+}
+
+// prune drops points from the store, or logs why it couldn't.
+func (s *Server) prune(station, metric string) {
+	if err := s.store.Prune(station, metric); err != nil {
+		s.log.Errorf("couldn't prune %s %s from the metric store: %v", station, metric, err)
+	}
+}
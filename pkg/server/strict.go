@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// In strict mode, the server tells clients why it rejected a command, rather
+// than answering with a bare ERR: a code, and for errors about a particular
+// token, the token and its position in the line (the uid being at 0), like
+// ERR E_BADARG pos=3 token=abc. This is meant for people writing station
+// firmware, who otherwise have to dig through the server's logs.
+
+// Error codes strict mode answers with.
+const (
+	// a token the command can't make sense of.
+	codeBadArg = "E_BADARG"
+	// the command was given too few or too many tokens.
+	codeArgCount = "E_ARGCOUNT"
+	// there's no such command.
+	codeUnknownCmd = "E_UNKNOWNCMD"
+)
+
+// protocolError is an error about what a client sent, as opposed to what the
+// server could do with it.
+type protocolError struct {
+	code string
+	// the offending token, if the error is about one, and its position, or
+	// -1 to look for it among the command's tokens.
+	token string
+	pos   int
+	msg   string
+}
+
+func (e *protocolError) Error() string {
+	return e.msg
+}
+
+// badArg marks err as being about one of the command's tokens.
+func badArg(token string, err error) error {
+	return &protocolError{code: codeBadArg, token: token, pos: -1, msg: err.Error()}
+}
+
+// badArgf is badArg with a formatted message.
+func badArgf(token, format string, args ...interface{}) error {
+	return &protocolError{code: codeBadArg, token: token, pos: -1, msg: fmt.Sprintf(format, args...)}
+}
+
+// badUID is the error for a uid that doesn't belong to anything, like a DONE
+// for a run the station was never sent.
+func badUID(uid, format string, args ...interface{}) error {
+	return &protocolError{code: codeBadArg, token: uid, pos: 0, msg: fmt.Sprintf(format, args...)}
+}
+
+// argCount is the error for a command given a wrong number of tokens.
+func argCount(args []string) error {
+	return &protocolError{code: codeArgCount, msg: fmt.Sprintf("bad arg count: %v", args)}
+}
+
+// strictError describes err the way strict mode answers with it, after ERR,
+// given the fields of the line that caused it. Errors that aren't about what
+// the client sent get no description.
+func strictError(err error, fields []string) string {
+	pe, ok := errors.Cause(err).(*protocolError)
+	if !ok {
+		return ""
+	}
+
+	switch pe.code {
+	case codeBadArg:
+		if pe.pos >= 0 {
+			return fmt.Sprintf("%s pos=%d token=%s", pe.code, pe.pos, pe.token)
+		}
+		// the command's own tokens come after its uid and name.
+		for i := 2; i < len(fields); i++ {
+			if fields[i] == pe.token {
+				return fmt.Sprintf("%s pos=%d token=%s", pe.code, i, pe.token)
+			}
+		}
+		return fmt.Sprintf("%s token=%s", pe.code, pe.token)
+	case codeArgCount:
+		return fmt.Sprintf("%s count=%d", pe.code, len(fields)-2)
+	case codeForbidden:
+		return fmt.Sprintf("%s pos=%d token=%s", pe.code, pe.pos, pe.token)
+	}
+	return pe.code
+}
+
+// unknownCmd describes an unknown command the way strict mode answers with
+// it.
+func unknownCmd(fields []string) string {
+	return fmt.Sprintf("%s pos=1 token=%s", codeUnknownCmd, fields[1])
+}
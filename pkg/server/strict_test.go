@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestStrictProtocol(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock, WithStrictProtocol())
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []interaction{
+		{"1 REGISTER water", "1 ERR E_ARGCOUNT count=1"},
+		{"2 REGISTER water source colour=blue", "2 ERR E_BADARG pos=4 token=colour=blue"},
+		{"3 REGISTER water source location=north", "3 ERR E_BADARG pos=4 token=location=north"},
+		{"4 REGISTER water source", "4 ACK"},
+		{"5 METRIC level abc", "5 ERR E_BADARG pos=3 token=abc"},
+		{"6 METRIC level 1 yesterday", "6 ERR E_BADARG pos=4 token=yesterday"},
+		{"7 METRIC level..low 1", "7 ERR E_BADARG pos=2 token=level..low"},
+		{"8 LOG loud hello", "8 ERR E_BADARG pos=2 token=loud"},
+		{"9 DONE", "9 ERR E_BADARG pos=0 token=9"},
+		{"10 FROB", "10 ERR E_UNKNOWNCMD pos=1 token=FROB"},
+		// errors that aren't about the command itself stay bare.
+		{"11 INFO ghost", "11 ERR"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pointFilter thins out the points a subscriber is sent, for clients on slow
+// links that don't need every raw point from a chatty station. Each series
+// is filtered on its own.
+type pointFilter struct {
+	// at most one point per series this often, by the server's clock.
+	every time.Duration
+	// only points that moved more than this from the last one sent.
+	delta    float64
+	hasDelta bool
+}
+
+// parsePointFilter reads modifiers like every=10s and delta>0.5.
+func parsePointFilter(args ...string) (pointFilter, error) {
+	var f pointFilter
+
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "every="):
+			every, err := time.ParseDuration(strings.TrimPrefix(arg, "every="))
+			if err != nil || every <= 0 {
+				return f, errors.Errorf("bad sampling interval %s", arg)
+			}
+			f.every = every
+
+		case strings.HasPrefix(arg, "delta>"):
+			delta, err := strconv.ParseFloat(strings.TrimPrefix(arg, "delta>"), 64)
+			if err != nil || delta < 0 {
+				return f, errors.Errorf("bad delta %s", arg)
+			}
+			f.delta, f.hasDelta = delta, true
+
+		default:
+			return f, errors.Errorf("unknown modifier %s", arg)
+		}
+	}
+
+	return f, nil
+}
+
+// parseSince reads how far back to replay: a duration before now, like 1h,
+// a unix timestamp, or any other time resolveTime takes, in UTC.
+func parseSince(v string, now time.Time) (time.Time, error) {
+	t, err := resolveTime(v, now, time.UTC)
+	if err != nil {
+		return time.Time{}, errors.Errorf("bad since %s", v)
+	}
+	return t, nil
+}
+
+// sent is the last point sent to a subscriber for a series.
+type sent struct {
+	at time.Time
+	m  metric
+}
+
+// admit reports whether m should be sent, given the last point sent for the
+// series, if there was one.
+func (f pointFilter) admit(last sent, ok bool, m metric, now time.Time) bool {
+	if !ok {
+		return true
+	}
+	if f.every > 0 && now.Sub(last.at) < f.every {
+		return false
+	}
+	if f.hasDelta && math.Abs(m.value-last.m.value) <= f.delta {
+		return false
+	}
+	return true
+}
+
+type metricSubscriber struct {
+	conn *clientConn
+	uid  string
+
+	// "" for every station.
+	station string
+	pattern string
+
+	filter pointFilter
+	last   map[seriesKey]sent
+
+	// new points are held back while history is being replayed, so they
+	// aren't sent out of order.
+	replaying bool
+	held      []heldPoint
+}
+
+type heldPoint struct {
+	seriesKey
+	m metric
+}
+
+// send writes a point to the subscriber if its filter lets it through. Must
+// be called with the subscribers' lock held, or before the subscriber is
+// added.
+func (sub *metricSubscriber) send(verb string, key seriesKey, m metric, now time.Time) {
+	last, ok := sub.last[key]
+	if !sub.filter.admit(last, ok, m, now) {
+		return
+	}
+	sub.last[key] = sent{at: now, m: m}
+
+	fmt.Fprintf(sub.conn, "%s %s %s %s %d:%.2f\n", sub.uid, verb, key.station, key.metric, m.ts.Unix(), m.value)
+}
+
+// matches reports whether the subscriber wants points of a series.
+func (sub *metricSubscriber) matches(station, name string) bool {
+	return subscribed(sub.station, sub.pattern, station, name)
+}
+
+// subscribed reports whether a subscription to a station ("" for all of
+// them) and metric pattern covers a series.
+func subscribed(station, pattern, seriesStation, seriesMetric string) bool {
+	return (station == "" || station == seriesStation) && matchMetric(pattern, seriesMetric)
+}
+
+// metricSubscribers streams new metric points to the clients that asked for
+// them.
+type metricSubscribers struct {
+	m           sync.Mutex
+	subscribers map[*metricSubscriber]struct{}
+
+	// durable subscriptions by name, and how many uncommitted points each
+	// keeps.
+	durables map[string]*durableSub
+	backlog  int
+}
+
+func newMetricSubscribers() *metricSubscribers {
+	return &metricSubscribers{
+		subscribers: map[*metricSubscriber]struct{}{},
+		durables:    map[string]*durableSub{},
+		backlog:     defaultDurableBacklog,
+	}
+}
+
+// publish sends a newly stored point to the subscribers interested in it.
+func (ms *metricSubscribers) publish(station, name string, m metric, now time.Time) {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	key := seriesKey{station, name}
+	for sub := range ms.subscribers {
+		if !sub.matches(station, name) {
+			continue
+		}
+
+		if sub.replaying {
+			sub.held = append(sub.held, heldPoint{key, m})
+			continue
+		}
+		sub.send("METRIC", key, m, now)
+	}
+
+	for _, d := range ms.durables {
+		if subscribed(d.station, d.pattern, station, name) {
+			d.enqueue(key, m, now, ms.backlog)
+		}
+	}
+}
+
+// rename points subscribers following a station at its new name.
+func (ms *metricSubscribers) rename(from, to string) {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	for sub := range ms.subscribers {
+		if sub.station == from {
+			sub.station = to
+		}
+	}
+	for _, d := range ms.durables {
+		if d.station == from {
+			d.station = to
+		}
+	}
+}
+
+// replay sends a subscriber the points its stations have kept since a
+// time, and then the new points held back in the meantime.
+func (s *Server) replay(sub *metricSubscriber, since time.Time) {
+	var names []string
+	s.stationsM.RLock()
+	for name := range s.stations {
+		if sub.station == "" || sub.station == name {
+			names = append(names, name)
+		}
+	}
+	s.stationsM.RUnlock()
+	sort.Strings(names)
+
+	replayed := map[heldPoint]bool{}
+	for _, name := range names {
+		metrics, ok := s.snapshot(name)
+		if !ok {
+			continue
+		}
+
+		series := make([]string, 0, len(metrics))
+		for metric := range metrics {
+			if sub.matches(name, metric) {
+				series = append(series, metric)
+			}
+		}
+		sort.Strings(series)
+
+		for _, metric := range series {
+			key := seriesKey{name, metric}
+			for _, m := range metrics[metric] {
+				if m.ts.Before(since) {
+					continue
+				}
+
+				// thinned by when points were measured, since they're all
+				// being sent now.
+				sub.send("REPLAY", key, m, m.ts)
+				replayed[heldPoint{key, m}] = true
+			}
+		}
+	}
+
+	s.subscribers.m.Lock()
+	defer s.subscribers.m.Unlock()
+
+	now := s.Clock.Now()
+	for _, p := range sub.held {
+		if !replayed[p] {
+			sub.send("METRIC", p.seriesKey, p.m, now)
+		}
+	}
+	sub.held = nil
+	sub.replaying = false
+}
+
+// subscribeMetrics streams new points of a station's metrics to conn under
+// uid until it's cancelled, after replaying the ones since a time if asked
+// to.
+func (s *Server) subscribeMetrics(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 2 {
+		return "", argCount(args)
+	}
+
+	station, pattern := args[0], args[1]
+	if station == "*" {
+		station = ""
+	}
+
+	var since time.Time
+	var durable string
+	var modifiers []string
+	for _, arg := range args[2:] {
+		switch {
+		case strings.HasPrefix(arg, "since="):
+			t, err := parseSince(strings.TrimPrefix(arg, "since="), s.Clock.Now())
+			if err != nil {
+				return "", err
+			}
+			since = t
+		case strings.HasPrefix(arg, "durable="):
+			durable = strings.TrimPrefix(arg, "durable=")
+			if durable == "" {
+				return "", errors.Errorf("durable subscriptions need a name")
+			}
+		default:
+			modifiers = append(modifiers, arg)
+		}
+	}
+
+	filter, err := parsePointFilter(modifiers...)
+	if err != nil {
+		return "", err
+	}
+
+	if durable != "" {
+		if !since.IsZero() {
+			return "", errors.Errorf("durable subscriptions resume from their cursor, not since=")
+		}
+		return s.subscribeDurable(conn, uid, durable, station, pattern, filter)
+	}
+
+	sub := &metricSubscriber{
+		conn:    conn,
+		uid:     uid,
+		station: station,
+		pattern: pattern,
+		filter:  filter,
+		last:    map[seriesKey]sent{},
+
+		replaying: !since.IsZero(),
+	}
+
+	s.subscribers.m.Lock()
+	s.subscribers.subscribers[sub] = struct{}{}
+	s.subscribers.m.Unlock()
+
+	conn.stream(uid, func() {
+		s.subscribers.m.Lock()
+		defer s.subscribers.m.Unlock()
+
+		delete(s.subscribers.subscribers, sub)
+	})
+
+	if sub.replaying {
+		conn.after(func() { s.replay(sub, since) })
+	}
+
+	return "ACK", nil
+}
+
+// UNSUBSCRIBE cmd
+// Expected args:
+//  - [station] (optional, with [metric])
+//  - [metric] (optional, with [station])
+//
+// Without arguments, it stops the subscription started under the same uid.
+// With a station and metric, it stops every subscription this client has to
+// exactly those.
+func (s *Server) handleUnsubscribe(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	switch len(args) {
+	case 0:
+		if !s.subscribedUnder(conn, uid) {
+			return "", badUID(uid, "no subscription %s", uid)
+		}
+		conn.streams[uid]()
+		delete(conn.streams, uid)
+		return "ACK", nil
+	case 2:
+	default:
+		return "", argCount(args)
+	}
+
+	station, pattern := args[0], args[1]
+	if station == "*" {
+		station = ""
+	}
+
+	var uids []string
+	s.subscribers.m.Lock()
+	for sub := range s.subscribers.subscribers {
+		if sub.conn == conn && sub.station == station && sub.pattern == pattern {
+			uids = append(uids, sub.uid)
+		}
+	}
+	for _, d := range s.subscribers.durables {
+		if d.conn == conn && d.station == station && d.pattern == pattern {
+			uids = append(uids, d.uid)
+		}
+	}
+	s.subscribers.m.Unlock()
+
+	// stopping a stream takes the subscribers' lock.
+	for _, uid := range uids {
+		conn.streams[uid]()
+		delete(conn.streams, uid)
+	}
+	return fmt.Sprintf("UNSUBSCRIBE %d", len(uids)), nil
+}
+
+// subscribedUnder reports whether conn has a metric subscription under uid.
+func (s *Server) subscribedUnder(conn *clientConn, uid string) bool {
+	s.subscribers.m.Lock()
+	defer s.subscribers.m.Unlock()
+
+	for sub := range s.subscribers.subscribers {
+		if sub.conn == conn && sub.uid == uid {
+			return true
+		}
+	}
+	for _, d := range s.subscribers.durables {
+		if d.conn == conn && d.uid == uid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestParsePointFilter(t *testing.T) {
+	f, err := parsePointFilter("every=10s", "delta>0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.every != 10*time.Second || !f.hasDelta || f.delta != 0.5 {
+		t.Fatalf("unexpected filter %+v", f)
+	}
+
+	for _, bad := range []string{"every=0s", "every=soon", "delta>-1", "delta<1", "since=1h"} {
+		if _, err := parsePointFilter(bad); err == nil {
+			t.Errorf("expected an error parsing %s", bad)
+		}
+	}
+}
+
+func TestSubscribeMetrics(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	server := New(listener, 4, mock)
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	station, raw, sampled, changed := dial(), dial(), dial(), dial()
+	defer station.Close()
+	defer raw.Close()
+	defer sampled.Close()
+	defer changed.Close()
+
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	subscribe := func(conn net.Conn, line string) *bufio.Reader {
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "s SUBSCRIBE %s\n", line)
+		if err := expectLines(reader, "s ACK"); err != nil {
+			t.Fatal(err)
+		}
+		return reader
+	}
+	rawLines := subscribe(raw, "* level")
+	sampledLines := subscribe(sampled, "water level every=10s")
+	changedLines := subscribe(changed, "water * delta>0.5")
+
+	for i, value := range []string{"1", "1.2", "2", "2.1"} {
+		if err := sendExpect(station, fmt.Sprintf("%d METRIC level %s", i+2, value), fmt.Sprintf("%d ACK", i+2)); err != nil {
+			t.Fatal(err)
+		}
+		mock.Add(4 * time.Second)
+	}
+	if err := sendExpect(station, "6 METRIC temp 20", "6 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	// raw subscribers get every point of the metric.
+	if err := expectLines(rawLines,
+		"s METRIC water level 0:1.00",
+		"s METRIC water level 4:1.20",
+		"s METRIC water level 8:2.00",
+		"s METRIC water level 12:2.10",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// sampled ones get the first point, and then one at least 10s later.
+	if err := expectLines(sampledLines,
+		"s METRIC water level 0:1.00",
+		"s METRIC water level 12:2.10",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// and the others only get points that moved, for each series.
+	if err := expectLines(changedLines,
+		"s METRIC water level 0:1.00",
+		"s METRIC water level 8:2.00",
+		"s METRIC water temp 16:20.00",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// CANCEL stops the stream.
+	fmt.Fprintf(raw, "s CANCEL\n")
+	if err := expectLines(rawLines, "s ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.Add(10 * time.Second)
+	if err := sendExpect(station, "7 METRIC level 3", "7 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectLines(sampledLines, "s METRIC water level 26:3.00"); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(raw, "l LIST\n")
+	if err := expectLines(rawLines, "l LIST water:source:100"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscribeReplay(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	server := New(listener, 4, mock)
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	station, recent, everything := dial(), dial(), dial()
+	defer station.Close()
+	defer recent.Close()
+	defer everything.Close()
+
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	for i, value := range []string{"1", "2", "3"} {
+		if err := sendExpect(station, fmt.Sprintf("%d METRIC level %s", i+2, value), fmt.Sprintf("%d ACK", i+2)); err != nil {
+			t.Fatal(err)
+		}
+		mock.Add(40 * time.Minute)
+	}
+
+	// history since the given time comes first, marked as a replay, and then
+	// new points.
+	recentLines := bufio.NewReader(recent)
+	fmt.Fprintf(recent, "s SUBSCRIBE water level since=90m\n")
+	if err := expectLines(recentLines,
+		"s ACK",
+		"s REPLAY water level 2400:2.00",
+		"s REPLAY water level 4800:3.00",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	everythingLines := bufio.NewReader(everything)
+	fmt.Fprintf(everything, "s SUBSCRIBE * * since=0 delta>1.5\n")
+	if err := expectLines(everythingLines,
+		"s ACK",
+		"s REPLAY water level 0:1.00",
+		"s REPLAY water level 4800:3.00",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "5 METRIC level 5", "5 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectLines(recentLines, "s METRIC water level 7200:5.00"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectLines(everythingLines, "s METRIC water level 7200:5.00"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(recent, "b SUBSCRIBE water level since=someday", "b ERR"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscribeMetricsBadFilter(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock())
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, in := range []interaction{
+		{"1 SUBSCRIBE water", "1 ERR"},
+		{"2 SUBSCRIBE water level every=never", "2 ERR"},
+		{"3 SUBSCRIBE water level sometimes", "3 ERR"},
+	} {
+		if err := sendExpect(conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock())
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bufio.NewReader(client)
+	fmt.Fprintf(client, "a SUBSCRIBE water level\nb SUBSCRIBE * level\nc SUBSCRIBE * level\nd SUBSCRIBE water temp\n")
+	if err := expectLines(lines, "a ACK", "b ACK", "c ACK", "d ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(client, "a UNSUBSCRIBE\nu UNSUBSCRIBE * level\nv UNSUBSCRIBE * level\nw UNSUBSCRIBE\n")
+	if err := expectLines(lines, "a ACK", "u UNSUBSCRIBE 2", "v UNSUBSCRIBE 0", "w ERR"); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the subscription to temp is left.
+	if err := sendExpect(station, "2 METRIC level 1", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(station, "3 METRIC temp 20", "3 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectLines(lines, "d METRIC water temp 0:20.00"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// A summary of the server's state is a zero-setup diagnostic for servers
+// that look hung: it's sent to the log on SIGUSR1. It can't assume the
+// server is healthy, so anything behind a lock that stays taken is reported
+// as such rather than waited on forever.
+
+// lockPatience is how long the summary waits on each lock.
+const lockPatience = time.Second
+
+// acquire tries to take a lock for up to lockPatience. It goes by the wall
+// clock, since a mocked one may never move.
+func acquire(try func() bool) bool {
+	deadline := time.Now().Add(lockPatience)
+	for !try() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// WriteSummary writes a human-readable summary of the server's state:
+// stations and their in-flight runs, subscriptions and followers, and how
+// much is waiting in the server's queues.
+func (s *Server) WriteSummary(w io.Writer) {
+	now := s.Clock.Now()
+	fmt.Fprintf(w, "server state at %s\n", now.UTC().Format(time.RFC3339))
+
+	if acquire(s.connsM.TryLock) {
+		fmt.Fprintf(w, "connections: %d\n", len(s.conns))
+		s.connsM.Unlock()
+	} else {
+		fmt.Fprintf(w, "connections: locked\n")
+	}
+
+	s.summarizeStations(w, now)
+	s.summarizeStreams(w)
+	s.summarizeQueues(w, now)
+}
+
+func (s *Server) summarizeStations(w io.Writer, now time.Time) {
+	if !acquire(s.stationsM.TryRLock) {
+		fmt.Fprintf(w, "stations: locked\n")
+		return
+	}
+	defer s.stationsM.RUnlock()
+
+	fmt.Fprintf(w, "stations: %d online, %d offline\n", len(s.stations), len(s.lastSeen))
+
+	names := make([]string, 0, len(s.stations))
+	for name := range s.stations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		station := s.stations[name]
+		fmt.Fprintf(w, "  %s (%s)", name, station.tipe)
+		if station.c != nil && station.c.Conn != nil {
+			fmt.Fprintf(w, " from %s", station.c.RemoteAddr())
+		}
+
+		if acquire(station.m.TryLock) {
+			fmt.Fprintf(w, ", %d metrics", len(station.metrics))
+			station.m.Unlock()
+		} else {
+			fmt.Fprintf(w, ", metrics locked")
+		}
+
+		if !acquire(station.runsM.TryLock) {
+			fmt.Fprintf(w, ", runs locked\n")
+			continue
+		}
+		fmt.Fprintf(w, ", %d runs in flight\n", len(station.runs))
+		writeRuns(w, station.runs, now)
+		station.runsM.Unlock()
+	}
+
+	orphaned := make([]string, 0, len(s.orphans))
+	for name := range s.orphans {
+		orphaned = append(orphaned, name)
+	}
+	sort.Strings(orphaned)
+	for _, name := range orphaned {
+		fmt.Fprintf(w, "  %s (offline), %d runs awaiting redelivery\n", name, len(s.orphans[name].runs))
+		writeRuns(w, s.orphans[name].runs, now)
+	}
+}
+
+// writeRuns lists runs, oldest first.
+func writeRuns(w io.Writer, runs map[string]*run, now time.Time) {
+	uids := make([]string, 0, len(runs))
+	for uid := range runs {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool {
+		return runs[uids[i]].started.Before(runs[uids[j]].started)
+	})
+
+	for _, uid := range uids {
+		r := runs[uid]
+		fmt.Fprintf(w, "    %s %s, running for %s", uid, r.fn, now.Sub(r.started))
+		if r.client != nil {
+			fmt.Fprintf(w, ", for %s", describe(r.client))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+func (s *Server) summarizeStreams(w io.Writer) {
+	ms := s.subscribers
+	if acquire(ms.m.TryLock) {
+		fmt.Fprintf(w, "metric subscriptions: %d, durable: %d\n", len(ms.subscribers), len(ms.durables))
+
+		names := make([]string, 0, len(ms.durables))
+		for name := range ms.durables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			d := ms.durables[name]
+			state := "detached"
+			if d.conn != nil {
+				state = "attached to " + describe(d.conn)
+			}
+			fmt.Fprintf(w, "  %s: %d uncommitted (committed up to %d), %s\n", name, len(d.queue), d.committed, state)
+		}
+		ms.m.Unlock()
+	} else {
+		fmt.Fprintf(w, "metric subscriptions: locked\n")
+	}
+
+	if acquire(s.journal.m.TryLock) {
+		fmt.Fprintf(w, "event subscriptions: %d\n", len(s.journal.subscribers))
+		s.journal.m.Unlock()
+	} else {
+		fmt.Fprintf(w, "event subscriptions: locked\n")
+	}
+
+	if acquire(s.logs.m.TryLock) {
+		followers := 0
+		for _, sl := range s.logs.logs {
+			followers += len(sl.followers)
+		}
+		fmt.Fprintf(w, "log followers: %d\n", followers)
+		s.logs.m.Unlock()
+	} else {
+		fmt.Fprintf(w, "log followers: locked\n")
+	}
+}
+
+func (s *Server) summarizeQueues(w io.Writer, now time.Time) {
+	if p, ok := s.store.(*PointLog); ok {
+		if acquire(p.m.TryLock) {
+			fmt.Fprintf(w, "point log: %d points waiting to be synced\n", len(p.waiters))
+			p.m.Unlock()
+		} else {
+			fmt.Fprintf(w, "point log: locked\n")
+		}
+	}
+
+	if e := s.export; e != nil {
+		if acquire(e.m.TryLock) {
+			rows := 0
+			for _, rs := range e.pending {
+				rows += len(rs)
+			}
+			fmt.Fprintf(w, "export: %d points waiting to be written\n", rows)
+			e.m.Unlock()
+		} else {
+			fmt.Fprintf(w, "export: locked\n")
+		}
+	}
+
+	for _, n := range s.notifiers {
+		wh, ok := n.(*Webhook)
+		if !ok {
+			continue
+		}
+		if !acquire(wh.m.TryLock) {
+			fmt.Fprintf(w, "webhook %s: locked\n", wh.url)
+			continue
+		}
+		fmt.Fprintf(w, "webhook %s: %d notifications queued", wh.url, len(wh.pending))
+		if len(wh.pending) > 0 {
+			fmt.Fprintf(w, ", oldest from %s ago", now.Sub(wh.pending[0].Time))
+		}
+		fmt.Fprintf(w, "\n")
+		wh.m.Unlock()
+	}
+}
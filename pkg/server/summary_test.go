@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestWriteSummary(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	mock := clock.NewMock()
+	server := New(listener, 4, mock)
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []struct {
+		conn net.Conn
+		interaction
+	}{
+		{station, interaction{"1 REGISTER water source", "1 ACK"}},
+		{station, interaction{"2 METRIC level 1", "2 ACK"}},
+		{client, interaction{"3 SUBSCRIBE water level", "3 ACK"}},
+		{client, interaction{"4 RUN water read", "4 ACK"}},
+	} {
+		if err := sendExpect(in.conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := expect(station, "4 RUN read"); err != nil {
+		t.Fatal(err)
+	}
+	mock.Add(3 * time.Second)
+
+	var buf bytes.Buffer
+	server.WriteSummary(&buf)
+	summary := buf.String()
+
+	for _, part := range []string{
+		"connections: 2\n",
+		"stations: 1 online, 0 offline\n",
+		"  water (source) from ",
+		", 1 metrics, 1 runs in flight\n    4 read, running for 3s, for ",
+		"metric subscriptions: 1, durable: 0\n",
+		"event subscriptions: 0\n",
+	} {
+		if !strings.Contains(summary, part) {
+			t.Errorf("expected %q in:\n%s", part, summary)
+		}
+	}
+
+	// a stuck lock doesn't hang the summary.
+	server.stationsM.Lock()
+	buf.Reset()
+	server.WriteSummary(&buf)
+	server.stationsM.Unlock()
+	if !strings.Contains(buf.String(), "stations: locked\n") {
+		t.Errorf("expected stations to be reported locked:\n%s", buf.String())
+	}
+}
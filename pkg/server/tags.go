@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Stations only say what they're called and what type they are; tags record
+// the rest, like where a station is, its hardware revision or who owns it.
+// A station can tag itself, and admins can tag any station online. Tags
+// outlive the station's connection, are kept by stores that keep stations,
+// show up in INFO and the HTTP API, and LIST can pick stations by them.
+
+const (
+	// how many tags a station can have, and how long their keys and values
+	// can be, so stations can't hold on to arbitrary amounts of memory.
+	maxTags        = 64
+	maxTagKeyLen   = 64
+	maxTagValueLen = 256
+)
+
+// checkTag checks a tag could be set, or a LIST filter could match one.
+func checkTag(key, value string) error {
+	if key == "" || len(key) > maxTagKeyLen || strings.Contains(key, "=") {
+		return badArgf(key, "tag keys must be 1 to %d characters, without =", maxTagKeyLen)
+	}
+	if len(value) > maxTagValueLen {
+		return badArgf(value, "tag values must be at most %d characters", maxTagValueLen)
+	}
+	return nil
+}
+
+// parseTagFilters reads LIST's [key]=[value] arguments.
+func parseTagFilters(args []string) (map[string]string, error) {
+	filters := map[string]string{}
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, badArgf(arg, "LIST filters are [key]=[value], got %s", arg)
+		}
+		if err := checkTag(key, value); err != nil {
+			return nil, err
+		}
+		filters[key] = value
+	}
+	return filters, nil
+}
+
+// hasTags reports whether a station has every tag in filters. Must be
+// called with stationsM held.
+func (st *Station) hasTags(filters map[string]string) bool {
+	for key, value := range filters {
+		if v, ok := st.tags[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// tagTokens returns a station's tags as INFO tokens, like tag.owner=alice,
+// sorted by key. Must be called with stationsM held.
+func (st *Station) tagTokens() []string {
+	tokens := make([]string, 0, len(st.tags))
+	for key, value := range st.tags {
+		tokens = append(tokens, "tag."+key+"="+value)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// copyTags returns a copy of tags, or nil if there aren't any.
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(tags))
+	for key, value := range tags {
+		c[key] = value
+	}
+	return c
+}
+
+// TAG cmd
+// Expected args, from a station tagging itself:
+//  - [key]
+//  - [value] (optional, removing the tag if omitted)
+//
+// Or, as an admin, to tag a station online:
+//  - [name]
+//  - [key]
+//  - [value] (optional, removing the tag if omitted)
+func (s *Server) handleTag(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return "", argCount(args)
+	}
+
+	var name string
+	if conn.name != "" && len(args) <= 2 {
+		name = conn.name
+	} else {
+		if len(args) < 2 {
+			return "", argCount(args)
+		}
+		if !s.isAdmin(conn) {
+			return "", errors.Errorf("%s is not an admin", conn.identity)
+		}
+		name, args = args[0], args[1:]
+	}
+
+	key, value, remove := args[0], "", len(args) == 1
+	if !remove {
+		value = args[1]
+	}
+	if err := checkTag(key, value); err != nil {
+		return "", err
+	}
+
+	s.stationsM.Lock()
+	defer s.stationsM.Unlock()
+
+	station, ok := s.stations[name]
+	if !ok {
+		return "", badArgf(name, "station %s isn't online", name)
+	}
+	if station.virtual {
+		return "", badArgf(name, "station %s is virtual", name)
+	}
+
+	if remove {
+		if _, ok := station.tags[key]; !ok {
+			return "", badArgf(key, "%s has no tag %s", name, key)
+		}
+		delete(station.tags, key)
+	} else {
+		if _, ok := station.tags[key]; !ok && len(station.tags) >= maxTags {
+			return "", errors.Errorf("%s already has %d tags", name, maxTags)
+		}
+		if station.tags == nil {
+			station.tags = map[string]string{}
+		}
+		station.tags[key] = value
+	}
+	s.saveStation(name, station)
+
+	if remove {
+		s.event("untag", name, "%s", key)
+	} else {
+		s.event("tag", name, "%s=%s", key, value)
+	}
+	return "ACK", nil
+}
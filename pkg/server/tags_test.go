@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestTags(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(listener, 4, clock.NewMock(), TrustPlaintext())
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 TAG rev b2", "2 ACK"},
+		{"3 TAG owner ops", "3 ACK"},
+		{"4 TAG a=b c", "4 ERR"},
+		{"5 TAG missing", "5 ERR"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pump, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pump.Close()
+	if err := sendExpect(pump, "1 REGISTER pump1 pump", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	lines := bufio.NewReader(admin)
+	for _, in := range []struct {
+		send   string
+		expect []string
+	}{
+		{"1 TAG water owner field", []string{"1 ACK"}},
+		{"2 TAG water rev", []string{"2 ACK"}},
+		{"3 TAG nothing owner ops", []string{"3 ERR"}},
+		{"4 INFO water", []string{"4 INFO water type=source health=100 tag.owner=field"}},
+		{"5 LIST owner=field", []string{"5 LIST water:source:100"}},
+		{"6 LIST owner=field rev=b2", []string{"6 LIST"}},
+		{"7 LIST owner", []string{"7 ERR"}},
+	} {
+		fmt.Fprintf(admin, "%s\n", in.send)
+		if err := expectLines(lines, in.expect...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// tags outlive the station's connection.
+	station.Close()
+	station, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	waitFor(t, "water to register again", func() bool {
+		return sendExpect(station, "6 REGISTER water source", "6 ACK") == nil
+	})
+	if err := sendExpect(station, "7 INFO water", "7 INFO water type=source health=100 tag.owner=field"); err != nil {
+		t.Fatal(err)
+	}
+
+	// and so does having removed them.
+	if err := sendExpect(station, "8 TAG owner", "8 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	station.Close()
+	station, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	waitFor(t, "water to register a third time", func() bool {
+		return sendExpect(station, "9 REGISTER water source", "9 ACK") == nil
+	})
+	if err := sendExpect(station, "10 INFO water", "10 INFO water type=source health=100"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTagsAdminOnly(t *testing.T) {
+	server := New(nil, 4, clock.NewMock())
+
+	if _, err := server.handleTag(context.Background(), &clientConn{}, "1", "water", "owner", "ops"); err == nil {
+		t.Fatal("expected tagging another station to be admin only")
+	}
+}
+
+func TestTagsSQLite(t *testing.T) {
+	path := tempPointLogPath(t)
+
+	q, err := OpenSQLiteStore(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(nil, 4, clock.NewMock(), WithMetricStore(q))
+
+	conn := &clientConn{}
+	if _, err := server.handleRegister(context.Background(), conn, "1", "water", "source"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.handleTag(context.Background(), conn, "2", "owner", "ops"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new server knows of the station, tags and all, before it registers.
+	q, err = OpenSQLiteStore(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	server = New(nil, 4, clock.NewMock(), WithMetricStore(q))
+	if tags := server.restored["water"].tags; tags["owner"] != "ops" {
+		t.Fatalf("expected the tags to be restored, got %v", tags)
+	}
+}
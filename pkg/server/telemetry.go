@@ -0,0 +1,80 @@
+package server
+
+import (
+	"runtime"
+	"time"
+)
+
+// Operators already watch their stations with LIST, METRICS, alerts and
+// dashboards; with telemetry, they can watch the server the same way. It
+// reports how it's doing as the metrics of a station of its own, _server,
+// which is kept and queried like any other station's, and can feed virtual
+// metrics.
+
+// telemetryStation is the station the server reports on itself as.
+const telemetryStation = "_server"
+
+// telemetryType is the type it's listed with.
+const telemetryType = "server"
+
+// telemetry is what the last report was worked out from.
+type telemetry struct {
+	every time.Duration
+	// how many commands had been handled, and when.
+	commands int
+	at       time.Time
+}
+
+// scheduleTelemetry reports on the server every interval.
+func (s *Server) scheduleTelemetry() {
+	s.Clock.AfterFunc(s.telemetry.every, func() {
+		s.reportTelemetry()
+		s.scheduleTelemetry()
+	})
+}
+
+// reportTelemetry stores the server's own metrics as _server's.
+func (s *Server) reportTelemetry() {
+	now := s.Clock.Now()
+	in := s.internals()
+
+	commands := s.commandStats.total()
+	rate := 0.0
+	if d := now.Sub(s.telemetry.at).Seconds(); d > 0 {
+		rate = float64(commands-s.telemetry.commands) / d
+	}
+	s.telemetry.commands, s.telemetry.at = commands, now
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	values := []struct {
+		metric string
+		value  float64
+	}{
+		{"stations.online", float64(in.online)},
+		{"stations.offline", float64(in.offline)},
+		{"connections", float64(in.conns)},
+		{"commands.rate", rate},
+		{"runs.pending", float64(in.pending)},
+		{"goroutines", float64(runtime.NumGoroutine())},
+		{"memory.heap", float64(mem.HeapAlloc)},
+	}
+
+	s.stationsM.RLock()
+	st, ok := s.stations[telemetryStation]
+	if ok {
+		st.m.Lock()
+		st.heard = now
+		for _, v := range values {
+			s.keep(telemetryStation, st, v.metric, metric{ts: now, value: v.value})
+		}
+		st.m.Unlock()
+	}
+	s.stationsM.RUnlock()
+
+	for _, v := range values {
+		s.updateVirtual(telemetryStation, v.metric)
+		s.checkThresholds(telemetryStation, v.metric, v.value)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestTelemetry(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := ParseVirtualMetric("fleet.load = _server.commands.rate * 60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := clock.NewMock()
+	server := New(listener, 4, mock, WithTelemetry(10*time.Second), WithVirtualMetrics(v))
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 5 commands in the first 10s.
+	for _, in := range []interaction{
+		{"1 REGISTER water source", "1 ACK"},
+		{"2 METRIC level 1", "2 ACK"},
+		{"3 METRIC level 2", "3 ACK"},
+		{"4 METRIC level 3", "4 ACK"},
+		{"5 METRIC level 4", "5 ACK"},
+	} {
+		if err := sendExpect(conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mock.Add(10 * time.Second)
+
+	for _, in := range []interaction{
+		{"6 METRICS _server connections", "6 METRICS _server connections 10:1.00"},
+		{"7 METRICS _server commands.rate", "7 METRICS _server commands.rate 10:0.50"},
+		// water, _server and fleet.
+		{"8 METRICS _server stations.online", "8 METRICS _server stations.online 10:3.00"},
+		{"9 METRICS fleet load", "9 METRICS fleet load 10:30.00"},
+		{"10 RUN _server restart", "10 ERR"},
+	} {
+		if err := sendExpect(conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// it can't be impersonated.
+	impostor, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impostor.Close()
+	if err := sendExpect(impostor, "1 REGISTER _server server", "1 ERR"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.stationsM.RLock()
+	st := server.stations[telemetryStation]
+	server.stationsM.RUnlock()
+	st.m.Lock()
+	defer st.m.Unlock()
+	for _, metric := range []string{"goroutines", "memory.heap", "runs.pending", "stations.offline"} {
+		if len(st.metrics[metric]) != 1 {
+			t.Fatalf("expected a point of %s, got %v", metric, st.metrics[metric])
+		}
+	}
+	if g := st.metrics["goroutines"][0].value; g < 1 {
+		t.Fatalf("expected goroutines to be counted, got %g", g)
+	}
+}
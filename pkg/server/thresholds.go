@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+)
+
+// What operators usually want to hear about a station's metrics is one of
+// them crossing a line and staying there, like a tank running low:
+// *.water.level < 10 for 5m. Threshold rules are checked as points arrive,
+// separately for each station and metric they match. A breach that lasts as
+// long as its rule asks for opens an alert, like any other, which is
+// resolved by the first point back within the rule.
+
+// Threshold is a rule alerting on a metric past a value.
+type Threshold struct {
+	Name string
+	// Station is a glob, and Metric a pattern, as in virtual metrics.
+	Station string
+	Metric  string
+	// Op is <, <=, >, >=, == or !=.
+	Op    string
+	Value float64
+	// For is how long the metric has to stay past the value before the
+	// alert opens; 0 opens it on the first point past it.
+	For time.Duration
+}
+
+// rule returns the rule as written after its name.
+func (t Threshold) rule() string {
+	r := fmt.Sprintf("%s.%s %s %g", t.Station, t.Metric, t.Op, t.Value)
+	if t.For > 0 {
+		r += " for " + t.For.String()
+	}
+	return r
+}
+
+func (t Threshold) String() string {
+	return t.Name + " = " + t.rule()
+}
+
+var thresholdOps = map[string]func(v, limit float64) bool{
+	"<":  func(v, limit float64) bool { return v < limit },
+	"<=": func(v, limit float64) bool { return v <= limit },
+	">":  func(v, limit float64) bool { return v > limit },
+	">=": func(v, limit float64) bool { return v >= limit },
+	"==": func(v, limit float64) bool { return v == limit },
+	"!=": func(v, limit float64) bool { return v != limit },
+}
+
+// ParseThreshold reads a named rule like
+// low_water = *.water.level < 10 for 5m. The station is a glob and the
+// metric a pattern, so one rule can cover a whole fleet; without the for
+// clause, the first point past the value opens the alert.
+func ParseThreshold(spec string) (Threshold, error) {
+	name, rule, ok := strings.Cut(spec, "=")
+	if !ok {
+		return Threshold{}, errors.Errorf("threshold %q needs a name, an = and a rule", spec)
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return Threshold{}, errors.Errorf("bad threshold name %q", name)
+	}
+
+	fields := strings.Fields(rule)
+	if len(fields) != 3 && (len(fields) != 5 || fields[3] != "for") {
+		return Threshold{}, errors.Errorf("threshold %s should be like [station].[metric] < [value] for [duration], got %q", name, strings.TrimSpace(rule))
+	}
+
+	sel, err := parseSelector(fields[0])
+	if err != nil {
+		return Threshold{}, errors.Wrapf(err, "bad threshold %s", name)
+	}
+	if _, ok := thresholdOps[fields[1]]; !ok {
+		return Threshold{}, errors.Errorf("threshold %s has an unknown operator %s", name, fields[1])
+	}
+	value, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return Threshold{}, errors.Wrapf(err, "bad value in threshold %s", name)
+	}
+
+	t := Threshold{Name: name, Station: sel.station, Metric: sel.metric, Op: fields[1], Value: value}
+	if len(fields) == 5 {
+		if t.For, err = time.ParseDuration(fields[4]); err != nil || t.For < 0 {
+			return Threshold{}, errors.Errorf("bad duration %q in threshold %s", fields[4], name)
+		}
+	}
+	return t, nil
+}
+
+type thresholdKey struct {
+	rule    string
+	station string
+	metric  string
+}
+
+// breach is a metric past a rule's value.
+type breach struct {
+	// the latest point past it.
+	value float64
+	// fires the alert once the breach has lasted long enough.
+	timer *clock.Timer
+	// whether it has.
+	firing bool
+}
+
+type thresholds struct {
+	m        sync.Mutex
+	rules    map[string]Threshold
+	breaches map[thresholdKey]*breach
+}
+
+func newThresholds() *thresholds {
+	return &thresholds{rules: map[string]Threshold{}, breaches: map[thresholdKey]*breach{}}
+}
+
+func (t *thresholds) rename(from, to string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for key, b := range t.breaches {
+		if key.station != from {
+			continue
+		}
+		delete(t.breaches, key)
+		key.station = to
+		t.breaches[key] = b
+	}
+}
+
+// alertName is what a breach's alert is opened under.
+func (key thresholdKey) alertName() string {
+	return "threshold:" + key.rule + ":" + key.metric
+}
+
+// checkThresholds checks a station's new point against every rule matching
+// it, starting, firing or resolving breaches.
+func (s *Server) checkThresholds(station, name string, value float64) {
+	s.thresholds.m.Lock()
+	defer s.thresholds.m.Unlock()
+
+	for _, t := range s.thresholds.rules {
+		if !(selector{station: t.Station, metric: t.Metric}).uses(station, name) {
+			continue
+		}
+
+		key := thresholdKey{t.Name, station, name}
+		b, ok := s.thresholds.breaches[key]
+		if !thresholdOps[t.Op](value, t.Value) {
+			if ok {
+				s.endBreach(key, b, "%s is back at %g (%s)", name, value, t.Name)
+			}
+			continue
+		}
+
+		if ok {
+			b.value = value
+			continue
+		}
+
+		b = &breach{value: value}
+		s.thresholds.breaches[key] = b
+		if t.For == 0 {
+			s.fireBreach(t, key, b)
+			continue
+		}
+		b.timer = s.Clock.AfterFunc(t.For, func() {
+			s.thresholds.m.Lock()
+			defer s.thresholds.m.Unlock()
+
+			// the breach may have ended, or its rule changed, since.
+			if s.thresholds.breaches[key] == b {
+				s.fireBreach(s.thresholds.rules[key.rule], key, b)
+			}
+		})
+	}
+}
+
+// fireBreach opens a breach's alert. s.thresholds.m must be held.
+func (s *Server) fireBreach(t Threshold, key thresholdKey, b *breach) {
+	b.firing = true
+	msg := fmt.Sprintf("%s is %g, %s %g", key.metric, b.value, t.Op, t.Value)
+	if t.For > 0 {
+		msg += " for " + t.For.String()
+	}
+	s.raise(key.alertName(), "threshold.breach", key.station, "%s (%s)", msg, t.Name)
+}
+
+// endBreach forgets a breach, resolving its alert if it fired.
+// s.thresholds.m must be held.
+func (s *Server) endBreach(key thresholdKey, b *breach, format string, args ...interface{}) {
+	delete(s.thresholds.breaches, key)
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if b.firing {
+		s.resolve(key.alertName(), "threshold.ok", key.station, format, args...)
+	}
+}
+
+// dropThreshold removes a rule, ending its breaches. s.thresholds.m must be
+// held.
+func (s *Server) dropThreshold(name, why string) {
+	delete(s.thresholds.rules, name)
+	for key, b := range s.thresholds.breaches {
+		if key.rule == name {
+			s.endBreach(key, b, "%s %s", name, why)
+		}
+	}
+}
+
+// THRESHOLDS cmd
+// Expected args, to list the rules:
+//  - none
+//
+// Or, as an admin, to add or replace a rule:
+//  - SET
+//  - [name]
+//  - [station].[metric] [op] [value] for [duration] (the for clause optional)
+//
+// Or to delete one:
+//  - DEL
+//  - [name]
+//
+// Each rule is listed as its own [uid] THRESHOLD response, by name, before
+// the final THRESHOLDS one.
+func (s *Server) handleThresholds(ctx context.Context, conn *clientConn, uid string, args ...string) (string, error) {
+	if len(args) == 0 {
+		s.thresholds.m.Lock()
+		defer s.thresholds.m.Unlock()
+
+		names := make([]string, 0, len(s.thresholds.rules))
+		for name := range s.thresholds.rules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(conn, "%s THRESHOLD %s %s\n", uid, name, s.thresholds.rules[name].rule())
+		}
+		return fmt.Sprintf("THRESHOLDS %d", len(names)), nil
+	}
+
+	switch args[0] {
+	case "SET":
+		if len(args) < 5 {
+			return "", argCount(args)
+		}
+	case "DEL":
+		if len(args) != 2 {
+			return "", argCount(args)
+		}
+	default:
+		return "", badArgf(args[0], "unknown THRESHOLDS subcommand %s", args[0])
+	}
+
+	if !s.isAdmin(conn) {
+		return "", errors.Errorf("%s is not an admin", conn.identity)
+	}
+
+	name := args[1]
+	if args[0] == "DEL" {
+		s.thresholds.m.Lock()
+		_, ok := s.thresholds.rules[name]
+		if ok {
+			s.dropThreshold(name, "was deleted")
+		}
+		s.thresholds.m.Unlock()
+
+		if !ok {
+			return "", badArgf(name, "no threshold %s", name)
+		}
+		s.event("threshold.del", "", "%s", name)
+		return "ACK", nil
+	}
+
+	t, err := ParseThreshold(name + "=" + strings.Join(args[2:], " "))
+	if err != nil {
+		return "", badArg(name, err)
+	}
+
+	s.thresholds.m.Lock()
+	if _, ok := s.thresholds.rules[name]; ok {
+		s.dropThreshold(name, "was changed")
+	}
+	s.thresholds.rules[name] = t
+	s.thresholds.m.Unlock()
+
+	s.event("threshold.set", "", "%s", t)
+	return "ACK", nil
+}
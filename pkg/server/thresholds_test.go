@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestParseThreshold(t *testing.T) {
+	for _, tt := range []struct {
+		spec     string
+		expected Threshold
+	}{
+		{"low_water = *.water.level < 10 for 5m", Threshold{Name: "low_water", Station: "*", Metric: "water.level", Op: "<", Value: 10, For: 5 * time.Minute}},
+		{"hot=pump*.motor.temp >= 80.5", Threshold{Name: "hot", Station: "pump*", Metric: "motor.temp", Op: ">=", Value: 80.5}},
+		{"open = gate.switch != 0 for 30s", Threshold{Name: "open", Station: "gate", Metric: "switch", Op: "!=", Value: 0, For: 30 * time.Second}},
+	} {
+		got, err := ParseThreshold(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.spec, err)
+		}
+		if got != tt.expected {
+			t.Fatalf("%s: expected %+v, got %+v", tt.spec, tt.expected, got)
+		}
+	}
+
+	for _, spec := range []string{
+		"*.water.level < 10",
+		"low water = *.water.level < 10",
+		"low_water = water < 10",
+		"low_water = *.water.level ~ 10",
+		"low_water = *.water.level < ten",
+		"low_water = *.water.level < 10 for",
+		"low_water = *.water.level < 10 within 5m",
+		"low_water = *.water.level < 10 for -5m",
+	} {
+		if _, err := ParseThreshold(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestThresholds(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	low, err := ParseThreshold("low_water = *.water.level < 10 for 5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := clock.NewMock()
+	mock.Set(time.Unix(3600, 0))
+	server := New(listener, 4, mock, TrustPlaintext(), WithThresholds(low))
+	go server.Serve(context.Background())
+
+	watcher, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	alerts := bufio.NewReader(watcher)
+	fmt.Fprintf(watcher, "1 SUBSCRIBE ALERTS tank1\n")
+	if err := expectLines(alerts, "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	for _, in := range []interaction{
+		{"1 REGISTER tank1 source", "1 ACK"},
+		{"2 METRIC water.level 8", "2 ACK"},
+		{"3 METRIC water.level 7", "3 ACK"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mock.Add(5 * time.Minute)
+	if err := expectLines(alerts, "1 ALERT 1 3900 threshold.breach tank1 water.level is 7, < 10 for 5m0s (low_water)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendExpect(station, "4 METRIC water.level 12", "4 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectLines(alerts, "1 ALERT 1 3900 threshold.ok tank1 water.level is back at 12 (low_water)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a breach that doesn't last doesn't alert.
+	if err := sendExpect(station, "5 METRIC water.level 5", "5 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	mock.Add(4 * time.Minute)
+	if err := sendExpect(station, "6 METRIC water.level 11", "6 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	mock.Add(time.Minute)
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	lines := bufio.NewReader(client)
+	for _, in := range []struct {
+		send   string
+		expect []string
+	}{
+		{"1 ALERTS", []string{"1 ALERTS 0"}},
+		{"2 THRESHOLDS SET hot pump*.temp > 80", []string{"2 ACK"}},
+		{"3 THRESHOLDS SET broken pump*.temp ~ 80", []string{"3 ERR"}},
+		{"4 THRESHOLDS", []string{
+			"4 THRESHOLD hot pump*.temp > 80",
+			"4 THRESHOLD low_water *.water.level < 10 for 5m0s",
+			"4 THRESHOLDS 2",
+		}},
+		{"5 THRESHOLDS DEL nothing", []string{"5 ERR"}},
+		{"6 THRESHOLDS RENAME hot", []string{"6 ERR"}},
+	} {
+		fmt.Fprintf(client, "%s\n", in.send)
+		if err := expectLines(lines, in.expect...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// without a for, the first point past the value alerts, and deleting the
+	// rule resolves it.
+	pump, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pump.Close()
+	for _, in := range []interaction{
+		{"1 REGISTER pump1 pump", "1 ACK"},
+		{"2 METRIC temp 85", "2 ACK"},
+	} {
+		if err := sendExpect(pump, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, in := range []struct {
+		send   string
+		expect []string
+	}{
+		{"7 ALERTS", []string{"7 ALERT 2 4200 threshold.breach pump1 temp is 85, > 80 (hot)", "7 ALERTS 1"}},
+		{"8 THRESHOLDS DEL hot", []string{"8 ACK"}},
+		{"9 ALERTS", []string{"9 ALERTS 0"}},
+	} {
+		fmt.Fprintf(client, "%s\n", in.send)
+		if err := expectLines(lines, in.expect...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestThresholdsAdminOnly(t *testing.T) {
+	server := New(nil, 4, clock.NewMock())
+
+	if _, err := server.handleThresholds(context.Background(), &clientConn{}, "1", "SET", "hot", "pump*.temp", ">", "80"); err == nil {
+		t.Fatal("expected THRESHOLDS SET to be admin only")
+	}
+	if _, err := server.handleThresholds(context.Background(), &clientConn{}, "1"); err != nil {
+		t.Fatalf("expected anyone to list thresholds, got %v", err)
+	}
+}
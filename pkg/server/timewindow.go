@@ -0,0 +1,135 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	// so tz= works on hosts without a zoneinfo database.
+	_ "time/tzdata"
+
+	"github.com/pkg/errors"
+)
+
+// Queries can be limited to a window of time, like from=today to=now
+// tz=America/Denver, resolved by the server so clients don't all have to do
+// the calendar math themselves.
+
+// resolveTime reads a point in time, in loc:
+//  - now, today or yesterday (at midnight),
+//  - a unix timestamp,
+//  - a date like 2024-06-01, or a date and time like 2024-06-01T08:00,
+//  - a duration, meaning that long ago, like 1h,
+// optionally followed by an offset like +6h or -30m.
+func resolveTime(v string, now time.Time, loc *time.Location) (time.Time, error) {
+	if t, ok := resolveBase(v, now, loc); ok {
+		return t, nil
+	}
+
+	if i := strings.LastIndexAny(v, "+-"); i > 0 {
+		if t, ok := resolveBase(v[:i], now, loc); ok {
+			if d, err := time.ParseDuration(v[i:]); err == nil {
+				return t.Add(d), nil
+			}
+		}
+	}
+
+	return time.Time{}, errors.Errorf("bad time %s", v)
+}
+
+func resolveBase(v string, now time.Time, loc *time.Location) (time.Time, bool) {
+	now = now.In(loc)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+	switch v {
+	case "now":
+		return now, true
+	case "today":
+		return midnight, true
+	case "yesterday":
+		return midnight.AddDate(0, 0, -1), true
+	}
+
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(ts, 0), true
+	}
+
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, v, loc); err == nil {
+			return t, true
+		}
+	}
+
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		return now.Add(-d), true
+	}
+
+	return time.Time{}, false
+}
+
+// timeWindow limits a query to points from one time to another. Zero times
+// leave the window open on that side.
+type timeWindow struct {
+	from, to time.Time
+}
+
+// parseTimeWindow resolves from=, to= and tz= modifiers, in any order. Other
+// modifiers are returned as is.
+func parseTimeWindow(modifiers []string, now time.Time) (timeWindow, []string, error) {
+	var w timeWindow
+	var from, to, rest []string
+	loc := time.UTC
+
+	for _, mod := range modifiers {
+		switch {
+		case strings.HasPrefix(mod, "from=") && from == nil:
+			from = []string{strings.TrimPrefix(mod, "from=")}
+		case strings.HasPrefix(mod, "to=") && to == nil:
+			to = []string{strings.TrimPrefix(mod, "to=")}
+		case strings.HasPrefix(mod, "tz="):
+			var err error
+			if loc, err = time.LoadLocation(strings.TrimPrefix(mod, "tz=")); err != nil {
+				return w, nil, errors.Wrapf(err, "bad %s", mod)
+			}
+		default:
+			rest = append(rest, mod)
+		}
+	}
+
+	var err error
+	if from != nil {
+		if w.from, err = resolveTime(from[0], now, loc); err != nil {
+			return w, nil, err
+		}
+	}
+	if to != nil {
+		if w.to, err = resolveTime(to[0], now, loc); err != nil {
+			return w, nil, err
+		}
+	}
+	if !w.from.IsZero() && !w.to.IsZero() && w.to.Before(w.from) {
+		return w, nil, errors.Errorf("window ends before it starts")
+	}
+
+	return w, rest, nil
+}
+
+// contains reports whether t is in the window.
+func (w timeWindow) contains(t time.Time) bool {
+	return (w.from.IsZero() || !t.Before(w.from)) && (w.to.IsZero() || !t.After(w.to))
+}
+
+// filter returns the points in ms that are in the window.
+func (w timeWindow) filter(ms []metric) []metric {
+	if w.from.IsZero() && w.to.IsZero() {
+		return ms
+	}
+
+	var in []metric
+	for _, m := range ms {
+		if w.contains(m.ts) {
+			in = append(in, m)
+		}
+	}
+	return in
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestResolveTime(t *testing.T) {
+	denver, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2024-06-02 04:30 UTC is still June 1st in Denver.
+	now := time.Date(2024, 6, 2, 4, 30, 0, 0, time.UTC)
+
+	for _, c := range []struct {
+		v    string
+		loc  *time.Location
+		want time.Time
+	}{
+		{"now", time.UTC, now},
+		{"today", time.UTC, time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)},
+		{"today", denver, time.Date(2024, 6, 1, 6, 0, 0, 0, time.UTC)},
+		{"yesterday", denver, time.Date(2024, 5, 31, 6, 0, 0, 0, time.UTC)},
+		{"today+6h", denver, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)},
+		{"1h", denver, now.Add(-time.Hour)},
+		{"now-30m", time.UTC, now.Add(-30 * time.Minute)},
+		{"1717200000", denver, time.Unix(1717200000, 0)},
+		{"2024-06-01", denver, time.Date(2024, 6, 1, 6, 0, 0, 0, time.UTC)},
+		{"2024-06-01T08:00", time.UTC, time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)},
+		{"2024-06-01-1h", time.UTC, time.Date(2024, 5, 31, 23, 0, 0, 0, time.UTC)},
+	} {
+		got, err := resolveTime(c.v, now, c.loc)
+		if err != nil {
+			t.Errorf("%s in %s: %v", c.v, c.loc, err)
+			continue
+		}
+		if !got.Equal(c.want) {
+			t.Errorf("%s in %s: expected %s, got %s", c.v, c.loc, c.want, got.UTC())
+		}
+	}
+
+	for _, bad := range []string{"", "tomorrow", "-1h", "today+", "today+soon", "2024-13-01"} {
+		if _, err := resolveTime(bad, now, time.UTC); err == nil {
+			t.Errorf("expected an error resolving %q", bad)
+		}
+	}
+}
+
+func TestMetricsWindow(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock()
+	mock.Set(time.Date(2024, 6, 2, 4, 30, 0, 0, time.UTC))
+	server := New(listener, 10, mock)
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	station, client := dial(), dial()
+
+	for _, in := range []struct {
+		conn net.Conn
+		interaction
+	}{
+		{station, interaction{"1 REGISTER water source", "1 ACK"}},
+		// May 31st 23:00, June 1st 05:00 and 07:00, and June 2nd 04:00 UTC.
+		{station, interaction{"2 METRIC level 1 1717196400", "2 ACK"}},
+		{station, interaction{"3 METRIC level 2 1717218000", "3 ACK"}},
+		{station, interaction{"4 METRIC level 3 1717225200", "4 ACK"}},
+		{station, interaction{"5 METRIC level 4 1717300800", "5 ACK"}},
+
+		{client, interaction{"1 METRICS water level from=today", "1 METRICS water level 1717300800:4.00"}},
+		{client, interaction{"2 METRICS water level from=today tz=America/Denver", "2 METRICS water level 1717225200:3.00 1717300800:4.00"}},
+		{client, interaction{"3 METRICS water level tz=America/Denver from=yesterday to=today", "3 METRICS water level 1717196400:1.00 1717218000:2.00"}},
+		{client, interaction{"4 METRICS water level from=2024-06-01 to=2024-06-01T06:00 LAST", "4 METRICS water level 1717218000:2.00"}},
+		{client, interaction{"5 METRICS water level from=1h", "5 METRICS water level 1717300800:4.00"}},
+		{client, interaction{"6 METRICS water level from=now", "6 METRICS water level"}},
+
+		{client, interaction{"7 METRICS water level from=soon", "7 ERR"}},
+		{client, interaction{"8 METRICS water level tz=Mars/Olympus", "8 ERR"}},
+		{client, interaction{"9 METRICS water level from=now to=today", "9 ERR"}},
+		{client, interaction{"10 METRICS * level LAST from=today", "10 ERR"}},
+	} {
+		if err := sendExpect(in.conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
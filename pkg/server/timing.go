@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server times how long it takes to handle each command, to find the
+// pathological queries in production: the times are exposed as histograms
+// per command, and with WithSlowCommands, commands that take longer than a
+// threshold are logged along with who sent them.
+
+// commandBuckets are the upper bounds of the command duration histograms'
+// buckets, in seconds.
+var commandBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// commandHistogram counts how long a command took to handle.
+type commandHistogram struct {
+	// counts per bucket, not cumulative; the last one is for anything over
+	// the largest bound.
+	buckets []int
+	count   int
+	sum     time.Duration
+}
+
+func (h *commandHistogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(commandBuckets, d.Seconds())
+	h.buckets[i]++
+	h.count++
+	h.sum += d
+}
+
+// commandStats keeps a histogram per command.
+type commandStats struct {
+	m    sync.Mutex
+	cmds map[string]*commandHistogram
+}
+
+func newCommandStats() *commandStats {
+	return &commandStats{cmds: map[string]*commandHistogram{}}
+}
+
+func (c *commandStats) observe(cmd string, d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	h, ok := c.cmds[cmd]
+	if !ok {
+		h = &commandHistogram{buckets: make([]int, len(commandBuckets)+1)}
+		c.cmds[cmd] = h
+	}
+	h.observe(d)
+}
+
+// total returns how many commands have been handled.
+func (c *commandStats) total() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	total := 0
+	for _, h := range c.cmds {
+		total += h.count
+	}
+	return total
+}
+
+// writePrometheus renders the histograms in Prometheus' text exposition
+// format.
+func (c *commandStats) writePrometheus(w io.Writer) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	cmds := make([]string, 0, len(c.cmds))
+	for cmd := range c.cmds {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+
+	fmt.Fprintf(w, "# HELP drops_command_duration_seconds Time taken to handle a command, per command.\n")
+	fmt.Fprintf(w, "# TYPE drops_command_duration_seconds histogram\n")
+	for _, cmd := range cmds {
+		h := c.cmds[cmd]
+		label := fmt.Sprintf("command=%s", promQuote(cmd))
+
+		cumulative := 0
+		for i, le := range commandBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(w, "drops_command_duration_seconds_bucket{%s,le=\"%g\"} %d\n", label, le, cumulative)
+		}
+		fmt.Fprintf(w, "drops_command_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "drops_command_duration_seconds_sum{%s} %g\n", label, h.sum.Seconds())
+		fmt.Fprintf(w, "drops_command_duration_seconds_count{%s} %d\n", label, h.count)
+	}
+}
+
+// redactedArgs is how many of a command's arguments can be logged as they
+// are; the rest can carry payloads (run results, configuration, log
+// messages) that don't belong in the server's logs. Commands not listed
+// here only take names and query modifiers.
+var redactedArgs = map[string]int{
+	"RUN":      2,
+	"DONE":     0,
+	"ERR":      0,
+	"PROGRESS": 0,
+	"LOG":      1,
+	"CONFIG":   2,
+	"LOAD":     0,
+}
+
+// redact returns a command line with the arguments that may carry payloads
+// replaced by ***.
+func redact(fields []string) string {
+	return strings.Join(redactFields(fields), " ")
+}
+
+// redactFields returns a command's fields with the arguments that may carry
+// payloads replaced by ***.
+func redactFields(fields []string) []string {
+	keep, ok := redactedArgs[fields[1]]
+	if !ok {
+		return fields
+	}
+
+	redacted := append([]string(nil), fields...)
+	for i := 2 + keep; i < len(redacted); i++ {
+		redacted[i] = "***"
+	}
+	return redacted
+}
+
+// describe names a connection for the logs: the station it registered as,
+// if any, the name on its certificate, if any, and its address.
+func describe(conn *clientConn) string {
+	var who []string
+	if conn.name != "" {
+		who = append(who, "station "+conn.name)
+	}
+	if conn.identity != "" {
+		who = append(who, conn.identity)
+	}
+	if conn.Conn != nil && conn.RemoteAddr() != nil {
+		who = append(who, conn.RemoteAddr().String())
+	}
+	return strings.Join(who, ", ")
+}
+
+// timed records how long a command took to handle, and logs it if it took
+// too long.
+func (s *Server) timed(conn *clientConn, fields []string, d time.Duration) {
+	s.commandStats.observe(fields[1], d)
+
+	if s.slowCommand > 0 && d >= s.slowCommand {
+		s.log.Errorf("slow command from %s took %s: %s", describe(conn), d, redact(fields))
+	}
+}
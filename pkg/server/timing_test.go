@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestCommandTiming(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr()
+	server := New(listener, 4, clock.NewMock())
+	go server.Serve(context.Background())
+
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(client, "1 LIST", "1 LIST"); err != nil {
+		t.Fatal(err)
+	}
+	server.commandStats.observe("LIST", 30*time.Millisecond)
+	server.commandStats.observe("LIST", 2*time.Second)
+
+	rec := httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range []string{
+		`drops_command_duration_seconds_bucket{command="LIST",le="0.0001"} 1`,
+		`drops_command_duration_seconds_bucket{command="LIST",le="0.01"} 1`,
+		`drops_command_duration_seconds_bucket{command="LIST",le="0.05"} 2`,
+		`drops_command_duration_seconds_bucket{command="LIST",le="5"} 3`,
+		`drops_command_duration_seconds_bucket{command="LIST",le="+Inf"} 3`,
+		`drops_command_duration_seconds_sum{command="LIST"} 2.03`,
+		`drops_command_duration_seconds_count{command="LIST"} 3`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("expected %s in:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for _, tc := range []struct {
+		line, expected string
+	}{
+		{"1 METRICS water level from=today", "1 METRICS water level from=today"},
+		{"2 RUN water fill 20l", "2 RUN water fill ***"},
+		{"3 DONE 42", "3 DONE ***"},
+		{"4 LOG info pump at 80%", "4 LOG info *** *** ***"},
+		{"5 CONFIG SET water {\"pin\":1234}", "5 CONFIG SET water ***"},
+	} {
+		if got := redact(strings.Split(tc.line, " ")); got != tc.expected {
+			t.Errorf("expected %s, got %s", tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// StationType is the contract for every station of a type: the metrics it
+// should report, the functions it should be able to run, and the objectives
+// its runs are held to. Stations that don't keep to it are still served, but
+// are flagged as deviating in LIST and INFO.
+type StationType struct {
+	Name string
+	// Metrics the station should report, with their units ("" for none).
+	Metrics map[string]string
+	// Functions the station should be able to RUN.
+	Functions []string
+	// SLOs applied to each station of the type.
+	SLOs []SLO
+}
+
+// stationTypeFile is how a type is written in a -stationTypes file.
+type stationTypeFile struct {
+	Metrics   map[string]string `json:"metrics"`
+	Functions []string          `json:"functions"`
+	SLOs      []string          `json:"slos"`
+}
+
+// ParseStationTypes reads a JSON object of types by name, e.g.
+//
+//	{"watersource": {
+//		"metrics": {"level": "m", "flow": "l/s"},
+//		"functions": ["read_level"],
+//		"slos": ["fn=read_level,target=99,within=5s,window=1h"]}}
+//
+// slos are in the form read by ParseSLO.
+func ParseStationTypes(r io.Reader) ([]StationType, error) {
+	var file map[string]stationTypeFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, errors.Wrap(err, "bad station types")
+	}
+
+	names := make([]string, 0, len(file))
+	for name := range file {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var types []StationType
+	for _, name := range names {
+		f := file[name]
+		if name == "" || strings.ContainsAny(name, " :!") {
+			return nil, errors.Errorf("bad station type name %q", name)
+		}
+
+		t := StationType{Name: name, Metrics: f.Metrics, Functions: f.Functions}
+		for m := range t.Metrics {
+			if err := validateMetricName(m); err != nil {
+				return nil, errors.Wrapf(err, "station type %s", name)
+			}
+		}
+
+		for _, spec := range f.SLOs {
+			o, err := ParseSLO(spec)
+			if err != nil {
+				return nil, errors.Wrapf(err, "station type %s", name)
+			}
+			t.SLOs = append(t.SLOs, o)
+		}
+		types = append(types, t)
+	}
+
+	return types, nil
+}
+
+// deviations lists how a station falls short of its type's contract, as
+// [kind]:[name] tokens. Stations of types that weren't defined have none.
+// Must be called with stationsM held.
+func (s *Server) deviations(station *Station) []string {
+	t, ok := s.types[station.tipe]
+	if !ok {
+		return nil
+	}
+
+	var devs []string
+
+	station.m.Lock()
+	for m := range t.Metrics {
+		if _, ok := station.metrics[m]; !ok {
+			devs = append(devs, "missing_metric:"+m)
+		}
+	}
+	for m := range station.metrics {
+		if _, ok := t.Metrics[m]; !ok {
+			devs = append(devs, "unexpected_metric:"+m)
+		}
+	}
+	station.m.Unlock()
+
+	// only stations that say what they can run are held to the functions.
+	if station.functions != nil {
+		offered := map[string]bool{}
+		for _, fn := range station.functions {
+			offered[fn] = true
+		}
+		for _, fn := range t.Functions {
+			if !offered[fn] {
+				devs = append(devs, "missing_function:"+fn)
+			}
+		}
+	}
+
+	sort.Strings(devs)
+	return devs
+}
+
+// units renders the units of a type's metrics as [metric]:[unit] tokens.
+func (t StationType) units() []string {
+	var units []string
+	for m, unit := range t.Metrics {
+		if unit != "" {
+			units = append(units, m+":"+unit)
+		}
+	}
+	sort.Strings(units)
+	return units
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestParseStationTypes(t *testing.T) {
+	types, err := ParseStationTypes(strings.NewReader(`{
+		"watersource": {
+			"metrics": {"level": "m", "flow": ""},
+			"functions": ["read_level"],
+			"slos": ["fn=read_level,target=99,window=1h"]
+		},
+		"heater": {}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(types) != 2 || types[0].Name != "heater" || types[1].Name != "watersource" {
+		t.Fatalf("unexpected types %+v", types)
+	}
+	if ws := types[1]; len(ws.Metrics) != 2 || len(ws.Functions) != 1 || len(ws.SLOs) != 1 || ws.SLOs[0].Target != 0.99 {
+		t.Fatalf("unexpected watersource type %+v", ws)
+	}
+	if units := types[1].units(); len(units) != 1 || units[0] != "level:m" {
+		t.Fatalf("unexpected units %v", units)
+	}
+
+	for _, bad := range []string{
+		`[]`,
+		`{"bad name": {}}`,
+		`{"source": {"metrics": {"pump.*": ""}}}`,
+		`{"source": {"slos": ["fn=read"]}}`,
+	} {
+		if _, err := ParseStationTypes(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error parsing %s", bad)
+		}
+	}
+}
+
+func TestStationTypes(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notifications := make(chan Notification, 10)
+
+	mock := clock.NewMock()
+	server := New(listener, 4, mock,
+		WithStationTypes(StationType{
+			Name:      "source",
+			Metrics:   map[string]string{"level": "m", "flow": ""},
+			Functions: []string{"read", "fill"},
+			SLOs:      []SLO{{Function: "read", Target: 0.9, Window: time.Hour, Burn: 1, Min: 1}},
+		}, StationType{Name: "heater"}),
+		WithNotifier(NotifierFunc(func(n Notification) { notifications <- n })),
+	)
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, in := range []interaction{
+		{"1 REGISTER water pump", "1 ERR"},
+		{"2 REGISTER water source functions=read", "2 ACK"},
+		{"3 METRIC level 1", "3 ACK"},
+		{"4 METRIC temp 20", "4 ACK"},
+		{"5 LIST", "5 LIST water:source!:100"},
+		{"6 INFO water", "6 INFO water type=source health=100 units=level:m deviations=missing_function:fill,missing_metric:flow,unexpected_metric:temp"},
+	} {
+		if err := sendExpect(station, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the type's objective applies to the station.
+	if err := doRun(client, station, mock, "7", "read", 0, "ERR"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-notifications:
+		if n.Kind != "slo.burn" || n.Station != "water" {
+			t.Fatalf("unexpected notification %+v", n)
+		}
+	default:
+		t.Fatal("expected an slo.burn notification")
+	}
+
+	heater, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer heater.Close()
+
+	for _, in := range []interaction{
+		{"1 REGISTER boiler heater", "1 ACK"},
+		{"2 INFO boiler", "2 INFO boiler type=heater health=100"},
+	} {
+		if err := sendExpect(heater, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Metrics are converted between units of the same dimension through the
+// dimension's base unit: base = value*scale + offset.
+type unit struct {
+	dimension string
+	scale     float64
+	offset    float64
+}
+
+const (
+	gallon     = 0.003785411784 // m3
+	cubicFoot  = 0.028316846592 // m3
+	fahrenheit = 5.0 / 9        // K
+)
+
+// units are the units METRICS can convert between, by symbol.
+var units = map[string]unit{
+	// length, in m.
+	"mm": {"length", 0.001, 0},
+	"cm": {"length", 0.01, 0},
+	"m":  {"length", 1, 0},
+	"km": {"length", 1000, 0},
+	"in": {"length", 0.0254, 0},
+	"ft": {"length", 0.3048, 0},
+	"yd": {"length", 0.9144, 0},
+	"mi": {"length", 1609.344, 0},
+
+	// temperature, in K.
+	"K": {"temperature", 1, 0},
+	"C": {"temperature", 1, 273.15},
+	"F": {"temperature", fahrenheit, 459.67 * fahrenheit},
+
+	// volume, in m3.
+	"ml":  {"volume", 1e-6, 0},
+	"l":   {"volume", 0.001, 0},
+	"m3":  {"volume", 1, 0},
+	"gal": {"volume", gallon, 0},
+	"ft3": {"volume", cubicFoot, 0},
+
+	// flow, in m3/s.
+	"l/s":   {"flow", 0.001, 0},
+	"l/min": {"flow", 0.001 / 60, 0},
+	"m3/s":  {"flow", 1, 0},
+	"m3/h":  {"flow", 1.0 / 3600, 0},
+	"gpm":   {"flow", gallon / 60, 0},
+	"cfs":   {"flow", cubicFoot, 0},
+}
+
+// convert converts a value from one unit to another of the same dimension.
+func convert(value float64, from, to string) (float64, error) {
+	if from == to {
+		return value, nil
+	}
+
+	f, ok := units[from]
+	if !ok {
+		return 0, errors.Errorf("can't convert from unknown unit %q", from)
+	}
+	t, ok := units[to]
+	if !ok {
+		return 0, errors.Errorf("can't convert to unknown unit %q", to)
+	}
+	if f.dimension != t.dimension {
+		return 0, errors.Errorf("can't convert %s (%s) to %s (%s)", from, f.dimension, to, t.dimension)
+	}
+
+	return (value*f.scale + f.offset - t.offset) / t.scale, nil
+}
+
+// convertPoints returns a copy of ms converted from one unit to another.
+func convertPoints(ms []metric, from, to string) ([]metric, error) {
+	converted := make([]metric, len(ms))
+	for i, m := range ms {
+		v, err := convert(m.value, from, to)
+		if err != nil {
+			return nil, err
+		}
+		converted[i] = metric{ts: m.ts, value: v}
+	}
+	return converted, nil
+}
+
+// metricUnit returns the unit a station's metric is in, according to the
+// station's type, or "" if it isn't known. Must be called with stationsM
+// held.
+func (s *Server) metricUnit(name, metric string) string {
+	station, ok := s.stations[name]
+	if !ok {
+		return ""
+	}
+	return s.types[station.tipe].Metrics[metric]
+}
+
+// metricsQuery is how METRICS should present a metric's points.
+type metricsQuery struct {
+	// the points to consider.
+	window timeWindow
+	// only the latest point.
+	last bool
+	// the unit to convert to, if any.
+	unit string
+}
+
+// parseMetricsQuery reads the LAST, unit=[unit] and time window modifiers of
+// METRICS.
+func parseMetricsQuery(modifiers []string, now time.Time) (metricsQuery, error) {
+	var q metricsQuery
+
+	var err error
+	if q.window, modifiers, err = parseTimeWindow(modifiers, now); err != nil {
+		return q, err
+	}
+
+	for _, mod := range modifiers {
+		switch {
+		case mod == "LAST" && !q.last:
+			q.last = true
+		case strings.HasPrefix(mod, "unit=") && q.unit == "":
+			q.unit = strings.TrimPrefix(mod, "unit=")
+			if _, ok := units[q.unit]; !ok {
+				return q, errors.Errorf("unknown unit %q", q.unit)
+			}
+		default:
+			return q, errors.Errorf("bad METRICS modifier %s", mod)
+		}
+	}
+	return q, nil
+}
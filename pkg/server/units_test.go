@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestConvert(t *testing.T) {
+	for _, c := range []struct {
+		value    float64
+		from, to string
+		want     float64
+	}{
+		{1, "ft", "in", 12},
+		{1, "mi", "km", 1.609344},
+		{100, "C", "F", 212},
+		{32, "F", "K", 273.15},
+		{-40, "F", "C", -40},
+		{1, "m3", "l", 1000},
+		{1, "gal", "l", 3.785411784},
+		{1, "cfs", "l/s", 28.316846592},
+		{60, "l/min", "l/s", 1},
+		{5, "m", "m", 5},
+	} {
+		got, err := convert(c.value, c.from, c.to)
+		if err != nil {
+			t.Errorf("%g %s to %s: %v", c.value, c.from, c.to, err)
+			continue
+		}
+		if math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("%g %s to %s: expected %g, got %g", c.value, c.from, c.to, c.want, got)
+		}
+	}
+
+	for _, bad := range [][2]string{{"m", "C"}, {"furlong", "m"}, {"m", "furlong"}, {"", "m"}} {
+		if _, err := convert(1, bad[0], bad[1]); err == nil {
+			t.Errorf("expected an error converting %s to %s", bad[0], bad[1])
+		}
+	}
+}
+
+func TestMetricsUnit(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(listener, 4, clock.NewMock(),
+		WithStationTypes(
+			StationType{Name: "metric", Metrics: map[string]string{"level": "m", "temp": "C"}},
+			StationType{Name: "imperial", Metrics: map[string]string{"level": "ft", "temp": "F"}},
+			StationType{Name: "unknown", Metrics: map[string]string{"level": ""}},
+		),
+	)
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	water, well, pond, client := dial(), dial(), dial(), dial()
+
+	for _, in := range []struct {
+		conn net.Conn
+		interaction
+	}{
+		{water, interaction{"1 REGISTER water metric", "1 ACK"}},
+		{well, interaction{"1 REGISTER well imperial", "1 ACK"}},
+		{pond, interaction{"1 REGISTER pond unknown", "1 ACK"}},
+		{water, interaction{"2 METRIC level 3", "2 ACK"}},
+		{water, interaction{"3 METRIC level 3.048", "3 ACK"}},
+		{water, interaction{"4 METRIC temp 100", "4 ACK"}},
+		{well, interaction{"2 METRIC level 20", "2 ACK"}},
+		{pond, interaction{"2 METRIC level 1", "2 ACK"}},
+
+		{client, interaction{"1 METRICS water level LAST", "1 METRICS water level 0:3.05"}},
+		{client, interaction{"2 METRICS water level LAST unit=ft", "2 METRICS water level 0:10.00"}},
+		{client, interaction{"3 METRICS water level unit=cm", "3 METRICS water level 0:300.00 0:304.80"}},
+		{client, interaction{"4 METRICS water temp unit=F", "4 METRICS water temp 0:212.00"}},
+		{client, interaction{"5 METRICS * level LAST unit=m", "5 METRICS * level LAST unit=m water:0:3.05 well:0:6.10"}},
+
+		{client, interaction{"6 METRICS water temp unit=m", "6 ERR"}},
+		{client, interaction{"7 METRICS pond level unit=m", "7 ERR"}},
+		{client, interaction{"8 METRICS water level unit=furlong", "8 ERR"}},
+		{client, interaction{"9 METRICS water level LAST LAST", "9 ERR"}},
+		{client, interaction{"10 METRICS water * unit=m", "10 ERR"}},
+		{client, interaction{"11 METRICS * level unit=m", "11 ERR"}},
+	} {
+		if err := sendExpect(in.conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Virtual stations are registered by the server itself, and their metrics
+// are expressions over the metrics of physical stations, like
+// reservoir_total.level = sum(tank*.level). A virtual metric is recomputed
+// from the latest points of its inputs whenever one of them gets a new
+// point, and kept like any other, so it can be queried, subscribed to and
+// exported the same way. Virtual stations can't RUN anything.
+
+// virtualType is the type virtual stations are listed with.
+const virtualType = "virtual"
+
+// VirtualMetric is one metric of a virtual station.
+type VirtualMetric struct {
+	Station string
+	Metric  string
+	// Expr is the expression as written.
+	Expr string
+
+	expr expr
+}
+
+func (v VirtualMetric) String() string {
+	return fmt.Sprintf("%s.%s = %s", v.Station, v.Metric, v.Expr)
+}
+
+// ParseVirtualMetric reads a virtual metric like
+// reservoir_total.level = sum(tank*.level). Expressions combine numbers,
+// single series like tank1.level, and aggregates over every series matching
+// a station glob and a metric pattern (sum, avg, min, max and count) with
+// + - * / and parentheses.
+func ParseVirtualMetric(spec string) (VirtualMetric, error) {
+	target, e, ok := strings.Cut(spec, "=")
+	if !ok {
+		return VirtualMetric{}, errors.Errorf("virtual metric %q needs an = and an expression", spec)
+	}
+
+	sel, err := parseSelector(strings.TrimSpace(target))
+	if err != nil {
+		return VirtualMetric{}, errors.Wrapf(err, "bad virtual metric %q", spec)
+	}
+	if sel.station == "*" || strings.ContainsAny(sel.station, "=") {
+		return VirtualMetric{}, errors.Errorf("bad virtual station name %s", sel.station)
+	}
+	if err := validateMetricName(sel.metric); err != nil {
+		return VirtualMetric{}, err
+	}
+
+	v := VirtualMetric{Station: sel.station, Metric: sel.metric, Expr: strings.TrimSpace(e)}
+
+	p := &exprParser{s: v.Expr}
+	v.expr, err = p.expr()
+	if err == nil && p.peek() != 0 {
+		err = errors.Errorf("unexpected %q at %d", p.s[p.i:], p.i)
+	}
+	if err != nil {
+		return VirtualMetric{}, errors.Wrapf(err, "bad expression in virtual metric %q", spec)
+	}
+
+	return v, nil
+}
+
+// expr is a parsed virtual metric expression.
+type expr interface {
+	// eval computes the expression from the latest values of the series
+	// matching each selector, and reports whether it could.
+	eval(latest func(selector) []float64) (float64, bool)
+	// uses reports whether a series is one of the expression's inputs.
+	uses(station, metric string) bool
+}
+
+type number float64
+
+func (n number) eval(func(selector) []float64) (float64, bool) { return float64(n), true }
+func (n number) uses(string, string) bool                       { return false }
+
+// selector picks series by station glob and metric pattern. Outside of
+// aggregates, it names a single series.
+type selector struct {
+	station string
+	metric  string
+}
+
+func parseSelector(s string) (selector, error) {
+	station, metric, ok := strings.Cut(s, ".")
+	if !ok || station == "" || metric == "" {
+		return selector{}, errors.Errorf("expected [station].[metric], got %q", s)
+	}
+	return selector{station: station, metric: metric}, nil
+}
+
+func (sel selector) eval(latest func(selector) []float64) (float64, bool) {
+	values := latest(sel)
+	if len(values) != 1 {
+		return 0, false
+	}
+	return values[0], true
+}
+
+func (sel selector) uses(station, metric string) bool {
+	ok, err := path.Match(sel.station, station)
+	return err == nil && ok && matchMetric(sel.metric, metric)
+}
+
+var aggregates = map[string]func([]float64) (float64, bool){
+	"sum": func(vs []float64) (float64, bool) {
+		total := 0.0
+		for _, v := range vs {
+			total += v
+		}
+		return total, true
+	},
+	"avg": func(vs []float64) (float64, bool) {
+		if len(vs) == 0 {
+			return 0, false
+		}
+		total := 0.0
+		for _, v := range vs {
+			total += v
+		}
+		return total / float64(len(vs)), true
+	},
+	"min": func(vs []float64) (float64, bool) {
+		if len(vs) == 0 {
+			return 0, false
+		}
+		min := vs[0]
+		for _, v := range vs[1:] {
+			min = math.Min(min, v)
+		}
+		return min, true
+	},
+	"max": func(vs []float64) (float64, bool) {
+		if len(vs) == 0 {
+			return 0, false
+		}
+		max := vs[0]
+		for _, v := range vs[1:] {
+			max = math.Max(max, v)
+		}
+		return max, true
+	},
+	"count": func(vs []float64) (float64, bool) {
+		return float64(len(vs)), true
+	},
+}
+
+type aggregate struct {
+	fn  string
+	sel selector
+}
+
+func (a aggregate) eval(latest func(selector) []float64) (float64, bool) {
+	return aggregates[a.fn](latest(a.sel))
+}
+
+func (a aggregate) uses(station, metric string) bool {
+	return a.sel.uses(station, metric)
+}
+
+type negate struct {
+	e expr
+}
+
+func (n negate) eval(latest func(selector) []float64) (float64, bool) {
+	v, ok := n.e.eval(latest)
+	return -v, ok
+}
+
+func (n negate) uses(station, metric string) bool {
+	return n.e.uses(station, metric)
+}
+
+type binary struct {
+	op   byte
+	l, r expr
+}
+
+func (b binary) eval(latest func(selector) []float64) (float64, bool) {
+	l, ok := b.l.eval(latest)
+	if !ok {
+		return 0, false
+	}
+	r, ok := b.r.eval(latest)
+	if !ok {
+		return 0, false
+	}
+
+	switch b.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	default:
+		if r == 0 {
+			return 0, false
+		}
+		return l / r, true
+	}
+}
+
+func (b binary) uses(station, metric string) bool {
+	return b.l.uses(station, metric) || b.r.uses(station, metric)
+}
+
+// exprParser is a recursive descent parser for virtual metric expressions.
+type exprParser struct {
+	s string
+	i int
+}
+
+// peek returns the next non-space character, or 0 at the end.
+func (p *exprParser) peek() byte {
+	for p.i < len(p.s) && p.s[p.i] == ' ' {
+		p.i++
+	}
+	if p.i >= len(p.s) {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+// expr := term (('+' | '-') term)*
+func (p *exprParser) expr() (expr, error) {
+	l, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.i++
+		r, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+// term := factor (('*' | '/') factor)*
+func (p *exprParser) term() (expr, error) {
+	l, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.i++
+		r, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+// factor := number | '-' factor | '(' expr ')' | aggregate '(' selector ')' | selector
+func (p *exprParser) factor() (expr, error) {
+	switch p.peek() {
+	case 0:
+		return nil, errors.New("unexpected end of expression")
+	case '(':
+		p.i++
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, errors.Errorf("missing ) at %d", p.i)
+		}
+		p.i++
+		return e, nil
+	case '-':
+		p.i++
+		e, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return negate{e}, nil
+	}
+
+	start := p.i
+	for p.i < len(p.s) && isWordChar(p.s[p.i]) {
+		p.i++
+	}
+	word := p.s[start:p.i]
+	if word == "" {
+		return nil, errors.Errorf("unexpected %q at %d", p.s[p.i:p.i+1], p.i)
+	}
+
+	if v, err := strconv.ParseFloat(word, 64); err == nil {
+		return number(v), nil
+	}
+
+	if p.peek() != '(' {
+		sel, err := parseSelector(word)
+		if err != nil {
+			return nil, err
+		}
+		return sel, nil
+	}
+
+	// aggregates take globs, whose * isn't a multiplication.
+	if _, ok := aggregates[word]; !ok {
+		return nil, errors.Errorf("unknown function %s", word)
+	}
+	p.i++
+	end := strings.IndexByte(p.s[p.i:], ')')
+	if end < 0 {
+		return nil, errors.Errorf("missing ) after %s(", word)
+	}
+	sel, err := parseSelector(strings.TrimSpace(p.s[p.i : p.i+end]))
+	if err != nil {
+		return nil, err
+	}
+	p.i += end + 1
+
+	return aggregate{fn: word, sel: sel}, nil
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// inputs returns the latest value of every physical or polled series sel
+// matches. Must
+// be called with stationsM held.
+func (s *Server) inputs(sel selector) []float64 {
+	var values []float64
+	for name, station := range s.stations {
+		if station.virtual && !station.polled {
+			continue
+		}
+		if ok, err := path.Match(sel.station, name); err != nil || !ok {
+			continue
+		}
+
+		station.m.Lock()
+		for metric, ms := range station.metrics {
+			if len(ms) > 0 && matchMetric(sel.metric, metric) {
+				values = append(values, ms[len(ms)-1].value)
+			}
+		}
+		station.m.Unlock()
+	}
+	return values
+}
+
+// updateVirtual recomputes the virtual metrics that a station's metric is an
+// input of.
+func (s *Server) updateVirtual(station, name string) {
+	if len(s.virtual) == 0 {
+		return
+	}
+
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	if st, ok := s.stations[station]; !ok || st.virtual && !st.polled {
+		return
+	}
+
+	now := s.Clock.Now()
+	for _, v := range s.virtual {
+		if !v.expr.uses(station, name) {
+			continue
+		}
+
+		value, ok := v.expr.eval(s.inputs)
+		if !ok {
+			continue
+		}
+
+		vs := s.stations[v.Station]
+		vs.m.Lock()
+		s.keep(v.Station, vs, v.Metric, metric{ts: now, value: value})
+		vs.m.Unlock()
+	}
+}
+
+// isVirtual reports whether a station is virtual.
+func (s *Server) isVirtual(name string) bool {
+	s.stationsM.RLock()
+	defer s.stationsM.RUnlock()
+
+	station, ok := s.stations[name]
+	return ok && station.virtual
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestParseVirtualMetric(t *testing.T) {
+	for spec, want := range map[string]string{
+		"reservoir.level = sum(tank*.level)":             "reservoir.level = sum(tank*.level)",
+		"plant.efficiency=(out.flow - in.flow)/in.flow": "plant.efficiency = (out.flow - in.flow)/in.flow",
+		"fleet.hottest = max(*.temp) * -1.5 + 2":        "fleet.hottest = max(*.temp) * -1.5 + 2",
+	} {
+		v, err := ParseVirtualMetric(spec)
+		if err != nil {
+			t.Errorf("%s: %v", spec, err)
+			continue
+		}
+		if v.String() != want {
+			t.Errorf("%s: expected %s, got %s", spec, want, v)
+		}
+	}
+
+	for _, bad := range []string{
+		"reservoir.level",
+		"reservoir = sum(tank*.level)",
+		"*.level = sum(tank*.level)",
+		"reservoir.lev*el = 1",
+		"reservoir.level = median(tank*.level)",
+		"reservoir.level = sum(tank*.level",
+		"reservoir.level = (1 + 2",
+		"reservoir.level = 1 +",
+		"reservoir.level = tank",
+		"reservoir.level = 1 2",
+	} {
+		if _, err := ParseVirtualMetric(bad); err == nil {
+			t.Errorf("expected an error parsing %s", bad)
+		}
+	}
+}
+
+func TestVirtualStations(t *testing.T) {
+	// Listen on a random port for each test.
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vms []VirtualMetric
+	for _, spec := range []string{
+		"reservoir.level = sum(tank*.level)",
+		"reservoir.spread = max(tank*.level) - min(tank*.level)",
+		"reservoir.share = tank1.level / reservoir.level",
+	} {
+		v, err := ParseVirtualMetric(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vms = append(vms, v)
+	}
+
+	addr := listener.Addr()
+	server := New(listener, 4, clock.NewMock(), WithVirtualMetrics(vms...))
+	go server.Serve(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	tank1, tank2, client := dial(), dial(), dial()
+
+	for _, in := range []struct {
+		conn net.Conn
+		interaction
+	}{
+		{client, interaction{"1 LIST", "1 LIST reservoir:virtual:100"}},
+		{client, interaction{"2 METRICS reservoir", "2 METRICS reservoir"}},
+		{tank1, interaction{"1 REGISTER tank1 tank", "1 ACK"}},
+		{tank2, interaction{"1 REGISTER tank2 tank", "1 ACK"}},
+		{tank1, interaction{"2 METRIC level 3", "2 ACK"}},
+		{client, interaction{"3 METRICS reservoir level", "3 METRICS reservoir level 0:3.00"}},
+		{tank2, interaction{"2 METRIC level 5", "2 ACK"}},
+		{client, interaction{"4 METRICS reservoir level", "4 METRICS reservoir level 0:3.00 0:8.00"}},
+		{client, interaction{"5 METRICS reservoir spread", "5 METRICS reservoir spread 0:0.00 0:2.00"}},
+		{tank2, interaction{"3 METRIC temp 5", "3 ACK"}},
+		{client, interaction{"6 METRICS reservoir level", "6 METRICS reservoir level 0:3.00 0:8.00"}},
+
+		// virtual stations aren't inputs to each other, and can't be
+		// taken over or told to do anything.
+		{client, interaction{"7 METRICS reservoir share", "7 ERR"}},
+		{client, interaction{"8 RUN reservoir fill", "8 ERR"}},
+		{client, interaction{"9 REGISTER reservoir tank", "9 ERR"}},
+	} {
+		if err := sendExpect(in.conn, in.send, in.expect); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
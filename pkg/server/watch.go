@@ -0,0 +1,48 @@
+package server
+
+import (
+	"os"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// watchFiles checks when paths were last changed every interval, and calls
+// reload once any of them has, logging how that went to log. A reload that fails is tried again at the
+// next check, so files caught halfway through being replaced are picked up
+// once they're whole.
+func watchFiles(clk clock.Clock, every time.Duration, log Logger, what string, reload func() error, paths ...string) {
+	last, _ := modTimes(paths)
+
+	var check func()
+	check = func() {
+		defer clk.AfterFunc(every, check)
+
+		current, err := modTimes(paths)
+		if err != nil || current == last {
+			// a file missing is most likely mid-rotation; the next check
+			// will tell.
+			return
+		}
+		if err := reload(); err != nil {
+			log.Errorf("couldn't reload %s, keeping the old ones: %v", what, err)
+			return
+		}
+		log.Infof("reloaded %s", what)
+		last = current
+	}
+	clk.AfterFunc(every, check)
+}
+
+// modTimes returns when each file was last changed, strung together.
+func modTimes(paths []string) (string, error) {
+	var s string
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		s += fi.ModTime().String() + "\n"
+	}
+	return s, nil
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/metrics"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The watchdog keeps an eye on the server itself, for hubs that run
+// unattended for months: every so often it samples the Go runtime, and when
+// goroutines pile up, goroutines spend too long waiting on locks, or the
+// garbage collector stops the world for too long, it sends a notification
+// and, optionally, saves a profile to look at later. Another notification
+// goes out once things are back under their limits.
+
+// Watchdog is what the watchdog considers too much. Zero limits aren't
+// checked.
+type Watchdog struct {
+	// Goroutines is how many goroutines are too many.
+	Goroutines int
+	// MutexWait is how long goroutines can spend waiting on locks, in
+	// total, between two samples.
+	MutexWait time.Duration
+	// GCPause is how long a single garbage collection pause can be.
+	GCPause time.Duration
+
+	// Every is how often the runtime is sampled.
+	Every time.Duration
+	// Profiles is a directory to save a profile to when a limit is exceeded,
+	// if set: a goroutine profile for goroutines, a mutex profile for lock
+	// contention, and a heap profile for GC pauses.
+	Profiles string
+}
+
+// ParseWatchdog reads limits from comma separated key=value pairs, e.g.
+// goroutines=10000,mutexWait=1s,gcPause=100ms. every (default 30s) and
+// profiles are optional.
+func ParseWatchdog(spec string) (Watchdog, error) {
+	w := Watchdog{Every: 30 * time.Second}
+
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return w, errors.Errorf("bad watchdog option %q", pair)
+		}
+
+		var err error
+		switch k, v := kv[0], kv[1]; k {
+		case "goroutines":
+			w.Goroutines, err = strconv.Atoi(v)
+		case "mutexWait":
+			w.MutexWait, err = time.ParseDuration(v)
+		case "gcPause":
+			w.GCPause, err = time.ParseDuration(v)
+		case "every":
+			w.Every, err = time.ParseDuration(v)
+		case "profiles":
+			w.Profiles = v
+		default:
+			return w, errors.Errorf("unknown watchdog option %q", k)
+		}
+		if err != nil {
+			return w, errors.Wrapf(err, "bad watchdog option %q", pair)
+		}
+	}
+
+	switch {
+	case w.Goroutines <= 0 && w.MutexWait <= 0 && w.GCPause <= 0:
+		return w, errors.Errorf("watchdog %q needs goroutines, mutexWait or gcPause", spec)
+	case w.Every <= 0:
+		return w, errors.Errorf("watchdog %q needs to sample every so often", spec)
+	}
+
+	return w, nil
+}
+
+// runtimeSample is what the watchdog reads off the runtime. Mutex waits and
+// GC pauses are totals since the process started.
+type runtimeSample struct {
+	goroutines int
+	mutexWait  time.Duration
+	// GC pause counts per bucket, and the buckets' boundaries, in seconds.
+	pauses []uint64
+	bounds []float64
+}
+
+var runtimeMetrics = []string{
+	"/sched/goroutines:goroutines",
+	"/sync/mutex/wait/total:seconds",
+	"/sched/pauses/total/gc:seconds",
+}
+
+func readRuntime() runtimeSample {
+	samples := make([]metrics.Sample, len(runtimeMetrics))
+	for i, name := range runtimeMetrics {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+
+	var rs runtimeSample
+	if v := samples[0].Value; v.Kind() == metrics.KindUint64 {
+		rs.goroutines = int(v.Uint64())
+	}
+	if v := samples[1].Value; v.Kind() == metrics.KindFloat64 {
+		rs.mutexWait = time.Duration(v.Float64() * float64(time.Second))
+	}
+	if v := samples[2].Value; v.Kind() == metrics.KindFloat64Histogram {
+		h := v.Float64Histogram()
+		rs.pauses, rs.bounds = h.Counts, h.Buckets
+	}
+	return rs
+}
+
+// longestPause returns a lower bound on the longest GC pause between two
+// samples.
+func longestPause(prev, cur runtimeSample) time.Duration {
+	for i := len(cur.pauses) - 1; i >= 0; i-- {
+		var before uint64
+		if i < len(prev.pauses) {
+			before = prev.pauses[i]
+		}
+		if cur.pauses[i] > before {
+			return time.Duration(cur.bounds[i] * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// watchdog tracks which limits are exceeded between samples.
+type watchdog struct {
+	limits Watchdog
+	read   func() runtimeSample
+
+	last   runtimeSample
+	firing map[string]bool
+}
+
+// watchdogCheck is one of the limits, as checked against a sample.
+type watchdogCheck struct {
+	name     string
+	profile  string
+	exceeded bool
+	message  string
+}
+
+// check samples the runtime and checks it against the limits.
+func (w *watchdog) check() []watchdogCheck {
+	cur := w.read()
+	prev := w.last
+	w.last = cur
+
+	var checks []watchdogCheck
+	if w.limits.Goroutines > 0 {
+		checks = append(checks, watchdogCheck{
+			name:     "goroutines",
+			profile:  "goroutine",
+			exceeded: cur.goroutines >= w.limits.Goroutines,
+			message:  fmt.Sprintf("%d goroutines running (limit %d)", cur.goroutines, w.limits.Goroutines),
+		})
+	}
+	if w.limits.MutexWait > 0 {
+		wait := cur.mutexWait - prev.mutexWait
+		checks = append(checks, watchdogCheck{
+			name:     "mutex",
+			profile:  "mutex",
+			exceeded: wait >= w.limits.MutexWait,
+			message:  fmt.Sprintf("goroutines waited %s on locks in %s (limit %s)", wait, w.limits.Every, w.limits.MutexWait),
+		})
+	}
+	if w.limits.GCPause > 0 {
+		pause := longestPause(prev, cur)
+		checks = append(checks, watchdogCheck{
+			name:     "gc",
+			profile:  "heap",
+			exceeded: pause >= w.limits.GCPause,
+			message:  fmt.Sprintf("GC paused for at least %s (limit %s)", pause, w.limits.GCPause),
+		})
+	}
+
+	// only changes are worth telling anyone about.
+	var changed []watchdogCheck
+	for _, c := range checks {
+		if c.exceeded != w.firing[c.name] {
+			w.firing[c.name] = c.exceeded
+			changed = append(changed, c)
+		}
+	}
+	return changed
+}
+
+// scheduleWatchdog samples the runtime every interval.
+func (s *Server) scheduleWatchdog(every time.Duration) {
+	s.Clock.AfterFunc(every, func() {
+		s.checkWatchdog()
+		s.scheduleWatchdog(every)
+	})
+}
+
+// checkWatchdog samples the runtime, and notifies about limits that were
+// exceeded or are back to normal since the last sample.
+func (s *Server) checkWatchdog() {
+	for _, c := range s.watchdog.check() {
+		if !c.exceeded {
+			s.resolve("watchdog."+c.name, "watchdog.ok", "", "%s back under the limit: %s", c.name, c.message)
+			continue
+		}
+
+		msg := c.message
+		if s.watchdog.limits.Profiles != "" {
+			path, err := s.saveProfile(c.profile)
+			if err != nil {
+				s.log.Errorf("couldn't save %s profile: %v", c.profile, err)
+			} else {
+				msg += ", profile saved to " + path
+			}
+		}
+		s.raise("watchdog."+c.name, "watchdog."+c.name, "", "%s", msg)
+	}
+}
+
+// saveProfile writes one of the runtime's profiles to the watchdog's
+// profile directory, and returns where.
+func (s *Server) saveProfile(name string) (string, error) {
+	p := pprof.Lookup(name)
+	if p == nil {
+		return "", errors.Errorf("no %s profile", name)
+	}
+
+	path := filepath.Join(s.watchdog.limits.Profiles,
+		fmt.Sprintf("%s-%s.pprof", name, s.Clock.Now().UTC().Format("20060102T150405Z")))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", errors.Wrap(err, "creating profile")
+	}
+	defer f.Close()
+
+	if err := p.WriteTo(f, 0); err != nil {
+		return "", errors.Wrap(err, "writing profile")
+	}
+	return path, f.Close()
+}
+
+// mutexProfileRate is the fraction (1/n) of lock contention events recorded
+// in mutex profiles, when the watchdog saves them.
+const mutexProfileRate = 100
+
+func newWatchdog(limits Watchdog) *watchdog {
+	if limits.MutexWait > 0 && limits.Profiles != "" {
+		runtime.SetMutexProfileFraction(mutexProfileRate)
+	}
+
+	w := &watchdog{limits: limits, read: readRuntime, firing: map[string]bool{}}
+	w.last = w.read()
+	return w
+}
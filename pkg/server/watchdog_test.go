@@ -0,0 +1,89 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestWatchdog(t *testing.T) {
+	notifications := make(chan Notification, 10)
+	dir := t.TempDir()
+
+	server := New(nil, 4, clock.NewMock(),
+		WithWatchdog(Watchdog{Goroutines: 100, MutexWait: time.Second, GCPause: 10 * time.Millisecond, Every: time.Minute, Profiles: dir}),
+		WithNotifier(NotifierFunc(func(n Notification) { notifications <- n })),
+	)
+
+	bounds := []float64{0, 0.001, 0.01, 0.1}
+	sample := runtimeSample{goroutines: 10, pauses: []uint64{5, 0, 0}, bounds: bounds}
+	server.watchdog.read = func() runtimeSample { return sample }
+	server.watchdog.last = sample
+
+	expect := func(kind, message string) {
+		t.Helper()
+		select {
+		case n := <-notifications:
+			if n.Kind != kind || !strings.HasPrefix(n.Message, message) {
+				t.Fatalf("expected %s: %s..., got %s: %s", kind, message, n.Kind, n.Message)
+			}
+		default:
+			t.Fatalf("expected %s: %s...", kind, message)
+		}
+	}
+
+	// all is well.
+	server.checkWatchdog()
+	if len(notifications) > 0 {
+		t.Fatalf("unexpected notification: %+v", <-notifications)
+	}
+
+	sample = runtimeSample{goroutines: 150, mutexWait: 2 * time.Second, pauses: []uint64{6, 0, 1}, bounds: bounds}
+	server.checkWatchdog()
+	expect("watchdog.goroutines", "150 goroutines running (limit 100), profile saved to ")
+	expect("watchdog.mutex", "goroutines waited 2s on locks in 1m0s (limit 1s)")
+	expect("watchdog.gc", "GC paused for at least 10ms (limit 10ms)")
+
+	// still over: nothing new to say.
+	sample = runtimeSample{goroutines: 200, mutexWait: 4 * time.Second, pauses: []uint64{6, 0, 2}, bounds: bounds}
+	server.checkWatchdog()
+	if len(notifications) > 0 {
+		t.Fatalf("unexpected notification: %+v", <-notifications)
+	}
+
+	sample = runtimeSample{goroutines: 50, mutexWait: 4 * time.Second, pauses: []uint64{7, 0, 2}, bounds: bounds}
+	server.checkWatchdog()
+	expect("watchdog.ok", "goroutines back under the limit")
+	expect("watchdog.ok", "mutex back under the limit")
+	expect("watchdog.ok", "gc back under the limit")
+	if len(notifications) > 0 {
+		t.Fatalf("unexpected notification: %+v", <-notifications)
+	}
+
+	profiles, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 3 {
+		t.Fatalf("expected 3 profiles, got %d", len(profiles))
+	}
+}
+
+func TestParseWatchdog(t *testing.T) {
+	w, err := ParseWatchdog("goroutines=10000,gcPause=100ms,every=1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Goroutines != 10000 || w.GCPause != 100*time.Millisecond || w.Every != time.Minute {
+		t.Fatalf("unexpected watchdog %+v", w)
+	}
+
+	for _, spec := range []string{"", "every=1m", "goroutines=lots", "threads=10"} {
+		if _, err := ParseWatchdog(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
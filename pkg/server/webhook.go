@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+)
+
+// Webhook is a Notifier that POSTs each notification as JSON to a URL.
+//
+// Delivery is at least once: notifications are queued (on disk, if the
+// webhook has a queue file) before Notify returns, and only leave the queue
+// once the receiver answers with a 2xx status. Failed deliveries are retried
+// in order, with exponential backoff, so a flapping receiver gets every
+// alarm late rather than not at all. The queue is bounded, so a receiver
+// that's down for good can't take the server's memory (or disk) with it:
+// once it's full, the oldest notifications are dropped to make room.
+type Webhook struct {
+	url    string
+	path   string
+	client *http.Client
+	clock  clock.Clock
+	log    logTo
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	m         sync.Mutex
+	pending   []Notification
+	maxQueued int
+	// whether the oldest pending notification is being posted.
+	posting bool
+	wake    chan struct{}
+	done    chan struct{}
+
+	delivered uint64
+	failures  uint64
+	dropped   uint64
+	lastLag   time.Duration
+}
+
+// defaultWebhookQueue is how many notifications a webhook queues, unless
+// it's told otherwise.
+const defaultWebhookQueue = 10000
+
+// NewWebhook starts delivering notifications to url. With a queue path,
+// notifications waiting to be delivered are kept in that file, and picked
+// up again after a restart; with none, they're only kept in memory.
+func NewWebhook(url, queue string, clock clock.Clock) (*Webhook, error) {
+	w := &Webhook{
+		url:    url,
+		path:   queue,
+		client: &http.Client{Timeout: 10 * time.Second},
+		clock:  clock,
+
+		minBackoff: time.Second,
+		maxBackoff: 5 * time.Minute,
+		maxQueued:  defaultWebhookQueue,
+
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+
+	if queue != "" {
+		if err := w.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	go w.deliver()
+	return w, nil
+}
+
+// SetLogger logs failed deliveries to l, rather than the standard logger.
+func (w *Webhook) SetLogger(l Logger) {
+	w.log.set(l)
+}
+
+// SetMaxQueued sets how many notifications are queued for delivery at most,
+// 10000 by default.
+func (w *Webhook) SetMaxQueued(n int) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.maxQueued = n
+}
+
+// load reads the notifications left in the queue file.
+func (w *Webhook) load() error {
+	f, err := os.Open(w.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "opening webhook queue")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var n Notification
+		if err := json.Unmarshal(scanner.Bytes(), &n); err != nil {
+			w.log.Errorf("skipping bad line in %s: %v", w.path, err)
+			continue
+		}
+		w.pending = append(w.pending, n)
+	}
+
+	return errors.Wrap(scanner.Err(), "reading webhook queue")
+}
+
+// Notify queues n for delivery, dropping the oldest notification that isn't
+// being delivered if the queue is full.
+func (w *Webhook) Notify(n Notification) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.pending = append(w.pending, n)
+	full := w.maxQueued > 0 && len(w.pending) > w.maxQueued
+	if full {
+		i := 0
+		if w.posting {
+			i = 1
+		}
+		w.log.Errorf("webhook queue for %s is full, dropping a %s notification from %s", w.url, w.pending[i].Kind, w.pending[i].Time)
+		w.pending = append(w.pending[:i], w.pending[i+1:]...)
+		w.dropped++
+	}
+
+	if w.path != "" {
+		var err error
+		if full {
+			err = w.rewrite()
+		} else {
+			err = w.append(n)
+		}
+		if err != nil {
+			// still deliver it, if the server stays up long enough.
+			w.log.Errorf("couldn't queue webhook notification on disk: %v", err)
+		}
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// append adds a notification to the queue file. Must be called with m held.
+func (w *Webhook) append(n Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// rewrite replaces the queue file with what's still pending. Must be called
+// with m held.
+func (w *Webhook) rewrite() error {
+	var buf bytes.Buffer
+	for _, n := range w.pending {
+		b, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+	}
+
+	tmp := w.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.path)
+}
+
+// deliver sends queued notifications one at a time, oldest first, until the
+// webhook is closed.
+func (w *Webhook) deliver() {
+	var backoff time.Duration
+	for {
+		w.m.Lock()
+		queued := len(w.pending) > 0
+		var next Notification
+		if queued {
+			next = w.pending[0]
+		}
+		w.posting = queued
+		w.m.Unlock()
+
+		if !queued {
+			select {
+			case <-w.wake:
+				continue
+			case <-w.done:
+				return
+			}
+		}
+
+		if err := w.post(next); err != nil {
+			w.log.Errorf("webhook delivery to %s failed: %v", w.url, err)
+
+			backoff *= 2
+			if backoff < w.minBackoff {
+				backoff = w.minBackoff
+			}
+			if backoff > w.maxBackoff {
+				backoff = w.maxBackoff
+			}
+
+			w.m.Lock()
+			w.failures++
+			w.posting = false
+			w.m.Unlock()
+
+			select {
+			case <-w.clock.After(backoff):
+			case <-w.done:
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		w.m.Lock()
+		w.delivered++
+		w.lastLag = w.clock.Now().Sub(w.pending[0].Time)
+		w.pending = w.pending[1:]
+		w.posting = false
+		if w.path != "" {
+			if err := w.rewrite(); err != nil {
+				w.log.Errorf("couldn't update webhook queue: %v", err)
+			}
+		}
+		w.m.Unlock()
+	}
+}
+
+func (w *Webhook) post(n Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops delivering notifications. Ones still queued on disk are
+// delivered after the next start.
+func (w *Webhook) Close() {
+	close(w.done)
+}
+
+// writePrometheus renders the webhook's delivery statistics in Prometheus'
+// text exposition format.
+func (w *Webhook) writePrometheus(out io.Writer) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	var oldest time.Duration
+	if len(w.pending) > 0 {
+		oldest = w.clock.Now().Sub(w.pending[0].Time)
+	}
+
+	fmt.Fprintf(out, "# HELP drops_webhook_queued Notifications waiting to be delivered to a webhook.\n")
+	fmt.Fprintf(out, "# TYPE drops_webhook_queued gauge\n")
+	fmt.Fprintf(out, "drops_webhook_queued{url=%q} %d\n", w.url, len(w.pending))
+
+	fmt.Fprintf(out, "# HELP drops_webhook_oldest_queued_seconds How long the oldest notification waiting for a webhook has waited.\n")
+	fmt.Fprintf(out, "# TYPE drops_webhook_oldest_queued_seconds gauge\n")
+	fmt.Fprintf(out, "drops_webhook_oldest_queued_seconds{url=%q} %g\n", w.url, oldest.Seconds())
+
+	fmt.Fprintf(out, "# HELP drops_webhook_delivery_lag_seconds How long the last notification delivered to a webhook took to get there.\n")
+	fmt.Fprintf(out, "# TYPE drops_webhook_delivery_lag_seconds gauge\n")
+	fmt.Fprintf(out, "drops_webhook_delivery_lag_seconds{url=%q} %g\n", w.url, w.lastLag.Seconds())
+
+	fmt.Fprintf(out, "# HELP drops_webhook_deliveries_total Notifications delivered to a webhook.\n")
+	fmt.Fprintf(out, "# TYPE drops_webhook_deliveries_total counter\n")
+	fmt.Fprintf(out, "drops_webhook_deliveries_total{url=%q} %d\n", w.url, w.delivered)
+
+	fmt.Fprintf(out, "# HELP drops_webhook_dropped_total Notifications dropped because a webhook's queue was full.\n")
+	fmt.Fprintf(out, "# TYPE drops_webhook_dropped_total counter\n")
+	fmt.Fprintf(out, "drops_webhook_dropped_total{url=%q} %d\n", w.url, w.dropped)
+
+	fmt.Fprintf(out, "# HELP drops_webhook_failures_total Failed attempts to deliver to a webhook.\n")
+	fmt.Fprintf(out, "# TYPE drops_webhook_failures_total counter\n")
+	fmt.Fprintf(out, "drops_webhook_failures_total{url=%q} %d\n", w.url, w.failures)
+}
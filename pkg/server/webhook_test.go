@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// receiver records the notifications POSTed to it, failing while it's down.
+type receiver struct {
+	m     sync.Mutex
+	down  bool
+	got   []Notification
+	calls int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.calls++
+	if r.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var n Notification
+	if err := json.NewDecoder(req.Body).Decode(&n); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.got = append(r.got, n)
+}
+
+func (r *receiver) state() (int, []string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	var kinds []string
+	for _, n := range r.got {
+		kinds = append(kinds, n.Kind)
+	}
+	return r.calls, kinds
+}
+
+// waitFor polls until cond holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	r := &receiver{down: true}
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	queue := filepath.Join(t.TempDir(), "queue")
+	w, err := NewWebhook(ts.URL, queue, clock.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.minBackoff = time.Millisecond
+
+	w.Notify(Notification{Kind: "slo.burn", Station: "water"})
+	w.Notify(Notification{Kind: "slo.ok", Station: "water"})
+
+	// nothing is lost while the receiver is down...
+	waitFor(t, "delivery attempts", func() bool {
+		calls, _ := r.state()
+		return calls >= 3
+	})
+	w.Close()
+
+	var out bytes.Buffer
+	w.writePrometheus(&out)
+	for _, want := range []string{
+		"drops_webhook_queued{url=\"" + ts.URL + "\"} 2\n",
+		"drops_webhook_deliveries_total{url=\"" + ts.URL + "\"} 0\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, out.String())
+		}
+	}
+
+	// ...including over a restart, and everything arrives in order once it's
+	// back up.
+	r.m.Lock()
+	r.down = false
+	r.m.Unlock()
+
+	w, err = NewWebhook(ts.URL, queue, clock.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Notify(Notification{Kind: "slo.burn", Station: "air"})
+	waitFor(t, "deliveries", func() bool {
+		_, kinds := r.state()
+		return len(kinds) == 3
+	})
+
+	_, kinds := r.state()
+	if strings.Join(kinds, " ") != "slo.burn slo.ok slo.burn" {
+		t.Fatalf("unexpected deliveries %v", kinds)
+	}
+
+	// the queue file is emptied once everything is delivered.
+	waitFor(t, "the queue to drain", func() bool {
+		var out bytes.Buffer
+		w.writePrometheus(&out)
+		return strings.Contains(out.String(), "drops_webhook_deliveries_total{url=\""+ts.URL+"\"} 3\n")
+	})
+	w.Close()
+	w, err = NewWebhook(ts.URL, queue, clock.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if len(w.pending) != 0 {
+		t.Fatalf("expected an empty queue, got %v", w.pending)
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	r := &receiver{down: true}
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	mock := clock.NewMock()
+	queue := filepath.Join(t.TempDir(), "queue")
+	w, err := NewWebhook(ts.URL, queue, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetMaxQueued(2)
+	failed := func(w *Webhook) func() bool {
+		return func() bool {
+			w.m.Lock()
+			defer w.m.Unlock()
+			return w.failures > 0 && !w.posting
+		}
+	}
+
+	w.Notify(Notification{Kind: "a"})
+	waitFor(t, "a failed delivery", failed(w))
+	w.Notify(Notification{Kind: "b"})
+	w.Notify(Notification{Kind: "c"})
+
+	var out bytes.Buffer
+	w.writePrometheus(&out)
+	if want := "drops_webhook_dropped_total{url=\"" + ts.URL + "\"} 1\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("expected %q in:\n%s", want, out.String())
+	}
+	w.Close()
+
+	// the oldest was dropped from the queue file too.
+	w, err = NewWebhook(ts.URL, queue, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	waitFor(t, "a failed delivery", failed(w))
+
+	r.m.Lock()
+	r.down = false
+	r.m.Unlock()
+	mock.Add(time.Second)
+	waitFor(t, "deliveries", func() bool {
+		_, kinds := r.state()
+		return len(kinds) == 2
+	})
+	if _, kinds := r.state(); strings.Join(kinds, " ") != "b c" {
+		t.Fatalf("unexpected deliveries %v", kinds)
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	r := &receiver{}
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	w, err := NewWebhook(ts.URL, "", clock.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(listener, 4, clock.NewMock(), WithNotifier(w), WithEventNotifier(w, "register", "disconnect"))
+	go server.Serve(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(conn, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(conn, "2 METRIC level 1", "2 ACK"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	waitFor(t, "deliveries", func() bool {
+		_, kinds := r.state()
+		return len(kinds) == 2
+	})
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.got[0].Kind != "register" || r.got[0].Station != "water" || r.got[0].Message != "source" || r.got[1].Kind != "disconnect" {
+		t.Fatalf("unexpected deliveries %+v", r.got)
+	}
+}
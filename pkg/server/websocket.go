@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Browser dashboards can't open TCP connections, so the HTTP API also
+// serves the line protocol over a WebSocket (RFC 6455) at /ws, for the
+// client library built to WebAssembly. The messages on it are just a
+// transport: what the browser sends is read as one stream of commands, so
+// a command can span messages or share one, and what the server writes is
+// sent back as binary messages the same way. Connections are identified by
+// the certificate presented to the HTTP listener, and otherwise handled
+// just like TCP ones.
+
+const (
+	// hashed with the client's key to prove the server speaks WebSocket.
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// the largest frame read; commands are far shorter.
+	wsMaxFrame = 1 << 20
+)
+
+// frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsConn is a WebSocket, as a net.Conn carrying the line protocol.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// the TLS state of the request it was upgraded from, if it was over TLS.
+	tls *tls.ConnectionState
+
+	// what's left of the last frame read.
+	pending []byte
+
+	// frames are written whole, by whichever goroutine is answering.
+	writeM sync.Mutex
+	// whether the close frame has been sent, after which nothing else can
+	// be.
+	closed bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case wsContinuation, wsText, wsBinary:
+			c.pending = payload
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return 0, err
+			}
+		case wsPong:
+		case wsClose:
+			// echo the status code, if there was one.
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsClose, payload)
+			return 0, io.EOF
+		default:
+			return 0, errors.Errorf("unknown websocket opcode %#x", op)
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readFrame reads a frame from the client, and unmasks its payload.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	fin, op := head[0]&0x80 != 0, head[0]&0x0f
+	if head[0]&0x70 != 0 {
+		return 0, nil, errors.New("websocket frame uses an extension")
+	}
+	if head[1]&0x80 == 0 {
+		return 0, nil, errors.New("websocket frame from the client isn't masked")
+	}
+
+	n := uint64(head[1] & 0x7f)
+	if n >= 126 {
+		ext := make([]byte, 2)
+		if n == 127 {
+			ext = make([]byte, 8)
+		}
+		if _, err := io.ReadFull(c.r, ext); err != nil {
+			return 0, nil, err
+		}
+		n = 0
+		for _, b := range ext {
+			n = n<<8 | uint64(b)
+		}
+	}
+	if op >= wsClose && (n > 125 || !fin) {
+		return 0, nil, errors.Errorf("bad websocket control frame %#x", op)
+	}
+	if n > wsMaxFrame {
+		return 0, nil, errors.Errorf("websocket frame of %d bytes is over %d", n, wsMaxFrame)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+// writeFrame sends a frame, unmasked as frames from servers are.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	if op == wsClose {
+		c.closed = true
+	}
+
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|op)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n < 1<<16:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 127)
+		for shift := 56; shift >= 0; shift -= 8 {
+			frame = append(frame, byte(uint64(n)>>shift))
+		}
+	}
+	frame = append(frame, payload...)
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close says goodbye with a close frame, unless a write is stuck on a
+// client that isn't reading, and closes the connection.
+func (c *wsConn) Close() error {
+	if c.writeM.TryLock() {
+		if !c.closed {
+			c.closed = true
+			c.Conn.Write([]byte{0x80 | wsClose, 0})
+		}
+		c.writeM.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+// headerHas reports whether one of a header's comma-separated values is
+// token, as Connection: keep-alive, Upgrade has upgrade.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsOriginAllowed reports whether a WebSocket may be opened from the page a
+// request came from. Browsers present their client certificate whatever
+// page asks, so without this any site an operator visited could send
+// commands as them.
+func (s *Server) wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// not from a browser.
+		return true
+	}
+	if s.wsOrigins[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// GET /ws
+func (s *Server) httpWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "expected a websocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	if !s.wsOriginAllowed(r) {
+		http.Error(w, "websockets aren't allowed from "+r.Header.Get("Origin"), http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websockets aren't supported here", http.StatusInternalServerError)
+		return
+	}
+	c, rw, err := hijacker.Hijack()
+	if err != nil {
+		s.log.Errorf("couldn't take over http connection from %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		c.Close()
+		return
+	}
+	conn := &wsConn{Conn: c, r: rw.Reader, tls: r.TLS}
+
+	s.connsM.Lock()
+	if s.closing {
+		s.connsM.Unlock()
+		conn.Close()
+		return
+	}
+	if !s.admit() {
+		s.connsM.Unlock()
+		s.refuse(conn)
+		return
+	}
+	s.handlers.Add(1)
+	s.connsM.Unlock()
+
+	defer s.handlers.Done()
+	defer s.release()
+	// the request's context lasts until we return, hijacked or not.
+	s.handle(r.Context(), conn)
+}
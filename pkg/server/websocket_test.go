@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+)
+
+// wsClient speaks just enough WebSocket to test the server with: it sends
+// masked frames, and reads the payloads of the ones sent back.
+type wsClient struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, url string) *wsClient {
+	addr := strings.TrimPrefix(url, "http://")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", addr)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the accept key for the RFC's sample nonce.
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected handshake response %s %v", resp.Status, resp.Header)
+	}
+	return &wsClient{Conn: conn, r: r}
+}
+
+func (c *wsClient) writeFrame(op byte, payload []byte) error {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *wsClient) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(head[1] & 0x7f)
+	if n == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = int(ext[0])<<8 | int(ext[1])
+	}
+	payload := make([]byte, n)
+	_, err := io.ReadFull(c.r, payload)
+	return head[0] & 0x0f, payload, err
+}
+
+func (c *wsClient) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsClient) Read(p []byte) (int, error) {
+	op, payload, err := c.readFrame()
+	if err != nil {
+		return 0, err
+	}
+	if op != wsBinary {
+		return 0, fmt.Errorf("expected a binary frame, got %#x", op)
+	}
+	return copy(p, payload), nil
+}
+
+func TestWebSocket(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(listener, 4, clock.NewMock(), TrustPlaintext())
+	go server.Serve(context.Background())
+
+	station, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	if err := sendExpect(station, "1 REGISTER water source", "1 ACK"); err != nil {
+		t.Fatal(err)
+	}
+
+	web := httptest.NewServer(server.HTTPHandler())
+	defer web.Close()
+	ws := dialWebSocket(t, web.URL)
+
+	if err := sendExpect(ws, "1 LIST", "1 LIST water:source:100"); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages are only a transport: a command can span them.
+	if err := ws.writeFrame(wsText, []byte("2 LI")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendExpect(ws, "ST", "2 LIST water:source:100"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ws.writeFrame(wsPing, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if op, payload, err := ws.readFrame(); err != nil || op != wsPong || string(payload) != "hi" {
+		t.Fatalf("expected a pong, got %#x %q, %v", op, payload, err)
+	}
+
+	if err := ws.writeFrame(wsClose, []byte{0x03, 0xe8}); err != nil {
+		t.Fatal(err)
+	}
+	if op, _, err := ws.readFrame(); err != nil || op != wsClose {
+		t.Fatalf("expected the close to be echoed, got %#x, %v", op, err)
+	}
+}
+
+func TestWebSocketOrigins(t *testing.T) {
+	server := New(nil, 4, clock.NewMock(), WithWebSocketOrigins("https://dashboard.example.com"))
+
+	for _, tt := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://drops.example.com:8443", true},
+		{"https://dashboard.example.com", true},
+		{"https://evil.example.com", false},
+		{"https://drops.example.com", false},
+	} {
+		r := httptest.NewRequest("GET", "https://drops.example.com:8443/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := server.wsOriginAllowed(r); got != tt.allowed {
+			t.Fatalf("origin %q: expected allowed %v, got %v", tt.origin, tt.allowed, got)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Origin", "https://evil.example.com")
+	rec := httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(rec, r)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a websocket from another site to be forbidden, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,268 @@
+package station
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A lot of sensors can't speak the line protocol, or run any code at all:
+// they just print readings on a serial port (RS-232, or RS-485 through an
+// adapter), and take commands on it. A Bridge lets something small like a
+// Raspberry Pi front such a sensor as a station: it splits what the sensor
+// prints into frames, reports fields of them as metrics, and passes RUNs of
+// the functions it's configured with on to the sensor as commands.
+//
+// The port is anything that can be read and written, usually the serial
+// device opened with os.OpenFile, with its baud rate and framing set up
+// beforehand (e.g. with stty), or on a microcontroller, its UART.
+
+// defaultCommandTimeout is how long a command waits for the sensor's reply,
+// unless it's configured otherwise.
+const defaultCommandTimeout = 5 * time.Second
+
+// BridgeConfig says how to read a sensor's frames and what commands to pass
+// on to it.
+type BridgeConfig struct {
+	// Delimiter ends each frame the sensor sends, and each command sent to
+	// it.
+	Delimiter string
+	// Prefix, if set, is what frames of readings start with; other frames
+	// are ignored.
+	Prefix string
+	// Separator splits a frame into fields. Empty splits on whitespace.
+	Separator string
+
+	Fields   []BridgeField
+	Commands []BridgeCommand
+}
+
+// BridgeField is a metric read from a field of each frame.
+type BridgeField struct {
+	Metric string
+	// Field is the field's position in the frame, counting from 1 (with the
+	// prefix, if there is one, as part of the first), or 0 to find it by
+	// Key instead, as the field key=value.
+	Field int
+	Key   string
+	// Value is raw*Scale+Offset.
+	Scale  float64
+	Offset float64
+}
+
+// BridgeCommand is a function of the station that sends a command to the
+// sensor.
+type BridgeCommand struct {
+	Function string
+	// Send is what's sent to the sensor, with {param} replaced by the RUN's
+	// parameter: just {param} passes the parameter through raw.
+	Send string
+	// Reply, if set, is what the sensor's answer to the command starts with,
+	// which the run waits for and returns, escaped so it's a single token.
+	// Without it, the run is done once the command has been sent.
+	Reply string
+	// Timeout is how long to wait for the reply, 5s if it's 0.
+	Timeout time.Duration
+}
+
+// Bridge reports a sensor's readings as a station's metrics, and passes its
+// functions on to the sensor.
+type Bridge struct {
+	station *Station
+	port    io.ReadWriter
+	config  BridgeConfig
+
+	// held to send a command and wait for its reply, so commands aren't
+	// interleaved and replies can't be mixed up.
+	commandM sync.Mutex
+
+	m sync.Mutex
+	// the reply the command in flight is waiting for, and where to send it.
+	reply   string
+	replies chan string
+}
+
+// NewBridge bridges the sensor on port to s, which handles a function for
+// each of the config's commands from then on; so that they're advertised,
+// the bridge should be made before s connects.
+func NewBridge(s *Station, port io.ReadWriter, config BridgeConfig) *Bridge {
+	b := &Bridge{station: s, port: port, config: config}
+	for _, c := range config.Commands {
+		c := c
+		s.Handle(c.Function, func(ctx context.Context, param string) (string, error) {
+			return b.command(ctx, c, param)
+		})
+	}
+	return b
+}
+
+// Run reads frames from the sensor and reports their readings, until ctx is
+// done, reading the port fails or the station can't report them. Frames
+// that can't be read, or fields that aren't numbers, are skipped. Reading
+// the port can't be interrupted, so it should be closed once Run returns.
+func (b *Bridge) Run(ctx context.Context) error {
+	frames := make(chan string)
+	failed := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		scanner := bufio.NewScanner(b.port)
+		scanner.Split(splitOn([]byte(b.config.Delimiter)))
+		for scanner.Scan() {
+			select {
+			case frames <- strings.TrimSpace(scanner.Text()):
+			case <-stop:
+				return
+			}
+		}
+		err := scanner.Err()
+		if err == nil {
+			err = io.EOF
+		}
+		failed <- errors.Wrap(err, "reading from the sensor")
+	}()
+
+	for {
+		select {
+		case frame := <-frames:
+			if b.answer(frame) {
+				continue
+			}
+			for _, r := range b.config.readings(frame) {
+				err := b.station.Gauge(r.metric, r.value)
+				if err != nil && errors.Cause(err) != ErrRejected {
+					return err
+				}
+			}
+		case err := <-failed:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// answer hands frame to the command waiting for it, if there is one, and
+// reports whether there was.
+func (b *Bridge) answer(frame string) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.replies == nil || !strings.HasPrefix(frame, b.reply) {
+		return false
+	}
+	b.replies <- frame
+	b.replies = nil
+	return true
+}
+
+// command sends a command to the sensor, and waits for its reply if it has
+// one.
+func (b *Bridge) command(ctx context.Context, c BridgeCommand, param string) (string, error) {
+	b.commandM.Lock()
+	defer b.commandM.Unlock()
+
+	var replies chan string
+	if c.Reply != "" {
+		replies = make(chan string, 1)
+		b.m.Lock()
+		b.reply, b.replies = c.Reply, replies
+		b.m.Unlock()
+
+		defer func() {
+			b.m.Lock()
+			b.replies = nil
+			b.m.Unlock()
+		}()
+	}
+
+	line := strings.ReplaceAll(c.Send, "{param}", param) + b.config.Delimiter
+	if _, err := io.WriteString(b.port, line); err != nil {
+		return "", errors.Wrap(err, "writing to the sensor")
+	}
+	if replies == nil {
+		return "", nil
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+	timer := b.station.clock.Timer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-replies:
+		return url.PathEscape(reply), nil
+	case <-timer.C:
+		return "", errors.Errorf("no reply to %s from the sensor", c.Function)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// reading is a metric's value read from a frame.
+type reading struct {
+	metric string
+	value  float64
+}
+
+// readings returns the metrics in a frame, in the order they're configured
+// in, if it's a frame of readings.
+func (c BridgeConfig) readings(frame string) []reading {
+	if !strings.HasPrefix(frame, c.Prefix) {
+		return nil
+	}
+
+	var fields []string
+	if c.Separator == "" {
+		fields = strings.Fields(frame)
+	} else {
+		fields = strings.Split(frame, c.Separator)
+	}
+
+	var readings []reading
+	for _, f := range c.Fields {
+		var raw string
+		if f.Field > 0 {
+			if f.Field > len(fields) {
+				continue
+			}
+			raw = fields[f.Field-1]
+		} else {
+			for _, field := range fields {
+				if k, v, ok := strings.Cut(strings.TrimSpace(field), "="); ok && k == f.Key {
+					raw = v
+					break
+				}
+			}
+		}
+
+		v, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			continue
+		}
+		readings = append(readings, reading{f.Metric, v*f.Scale + f.Offset})
+	}
+	return readings
+}
+
+// splitOn is a bufio.SplitFunc for frames ending in delim.
+func splitOn(delim []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, delim); i >= 0 {
+			return i + len(delim), data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
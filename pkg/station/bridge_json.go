@@ -0,0 +1,113 @@
+//go:build !tinygo
+
+package station
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Bridges are usually configured from a file. Decoding it takes
+// encoding/json, which is too heavy for TinyGo, so on a microcontroller the
+// BridgeConfig is written out in code instead.
+
+// bridgeFile is how a bridge is written in JSON.
+type bridgeFile struct {
+	Delimiter *string `json:"delimiter"`
+	Prefix    string  `json:"prefix"`
+	Separator *string `json:"separator"`
+	Fields    []struct {
+		Metric string   `json:"metric"`
+		Field  int      `json:"field"`
+		Key    string   `json:"key"`
+		Scale  *float64 `json:"scale"`
+		Offset float64  `json:"offset"`
+	} `json:"fields"`
+	Commands []struct {
+		Function string `json:"function"`
+		Send     string `json:"send"`
+		Reply    string `json:"reply"`
+		Timeout  string `json:"timeout"`
+	} `json:"commands"`
+}
+
+// ParseBridge reads a JSON object describing a sensor, e.g.
+//
+//	{"prefix": "$WX", "separator": ",", "fields": [
+//		{"metric": "temperature", "field": 2, "scale": 0.1},
+//		{"metric": "humidity", "key": "RH"}],
+//	 "commands": [
+//		{"function": "raw", "send": "{param}"},
+//		{"function": "calibrate", "send": "CAL {param}", "reply": "$CAL", "timeout": "10s"}]}
+//
+// Frames end in a newline and fields are split on commas unless a delimiter
+// and separator are given, values are scaled by 1 unless given a scale, and
+// commands wait 5s for their reply unless given a timeout.
+func ParseBridge(r io.Reader) (BridgeConfig, error) {
+	var file bridgeFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return BridgeConfig{}, errors.Wrap(err, "bad bridge")
+	}
+
+	config := BridgeConfig{Delimiter: "\n", Prefix: file.Prefix, Separator: ","}
+	if file.Delimiter != nil {
+		config.Delimiter = *file.Delimiter
+	}
+	if config.Delimiter == "" {
+		return BridgeConfig{}, errors.New("bridge has an empty delimiter")
+	}
+	if file.Separator != nil {
+		config.Separator = *file.Separator
+	}
+
+	for _, f := range file.Fields {
+		if f.Metric == "" || strings.ContainsAny(f.Metric, " *") {
+			return BridgeConfig{}, errors.Errorf("bad bridge metric name %q", f.Metric)
+		}
+		if (f.Field > 0) == (f.Key != "") || f.Field < 0 {
+			return BridgeConfig{}, errors.Errorf("bridge metric %s needs either a field or a key", f.Metric)
+		}
+		scale := 1.0
+		if f.Scale != nil {
+			scale = *f.Scale
+		}
+		config.Fields = append(config.Fields, BridgeField{
+			Metric: f.Metric,
+			Field:  f.Field,
+			Key:    f.Key,
+			Scale:  scale,
+			Offset: f.Offset,
+		})
+	}
+
+	for _, c := range file.Commands {
+		if c.Function == "" || strings.ContainsAny(c.Function, " ,") {
+			return BridgeConfig{}, errors.Errorf("bad bridge function name %q", c.Function)
+		}
+		if c.Send == "" {
+			return BridgeConfig{}, errors.Errorf("bridge function %s sends nothing", c.Function)
+		}
+		timeout := defaultCommandTimeout
+		if c.Timeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(c.Timeout); err != nil || timeout <= 0 {
+				return BridgeConfig{}, errors.Errorf("bridge function %s has a bad timeout %q", c.Function, c.Timeout)
+			}
+		}
+		config.Commands = append(config.Commands, BridgeCommand{
+			Function: c.Function,
+			Send:     c.Send,
+			Reply:    c.Reply,
+			Timeout:  timeout,
+		})
+	}
+
+	if len(config.Fields) == 0 && len(config.Commands) == 0 {
+		return BridgeConfig{}, errors.New("bridge has no fields or commands")
+	}
+	return config, nil
+}
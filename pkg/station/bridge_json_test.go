@@ -0,0 +1,44 @@
+//go:build !tinygo
+
+package station
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBridge(t *testing.T) {
+	config, err := ParseBridge(strings.NewReader(`{"prefix": "$WX", "fields": [
+		{"metric": "temperature", "field": 2, "scale": 0.1},
+		{"metric": "humidity", "key": "RH"}],
+	 "commands": [{"function": "calibrate", "send": "CAL {param}", "reply": "$CAL", "timeout": "10s"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Delimiter != "\n" || config.Separator != "," || config.Fields[1].Scale != 1 || config.Commands[0].Timeout != 10*time.Second {
+		t.Fatalf("expected defaults to be filled in, got %+v", config)
+	}
+
+	readings := config.readings("$WX,215, RH=40.5 ")
+	if len(readings) != 2 || readings[0] != (reading{"temperature", 21.5}) || readings[1] != (reading{"humidity", 40.5}) {
+		t.Fatalf("unexpected readings %+v", readings)
+	}
+	if readings := config.readings("$GPS,1,2"); len(readings) != 0 {
+		t.Fatalf("expected frames without the prefix to be ignored, got %+v", readings)
+	}
+
+	for _, bad := range []string{
+		`{}`,
+		`{"fields": [{"metric": "temperature"}]}`,
+		`{"fields": [{"metric": "temperature", "field": 1, "key": "T"}]}`,
+		`{"fields": [{"metric": "bad name", "field": 1}]}`,
+		`{"delimiter": "", "fields": [{"metric": "temperature", "field": 1}]}`,
+		`{"commands": [{"function": "raw"}]}`,
+		`{"commands": [{"function": "raw", "send": "{param}", "timeout": "soon"}]}`,
+	} {
+		if _, err := ParseBridge(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected %s to be rejected", bad)
+		}
+	}
+}
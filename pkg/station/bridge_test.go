@@ -0,0 +1,88 @@
+package station
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+	"github.com/silversupreme/drops/pkg/client"
+)
+
+func TestBridge(t *testing.T) {
+	addr := serve(t, clock.NewMock())
+	// written out in code, as on a microcontroller.
+	config := BridgeConfig{
+		Delimiter: "\r\n",
+		Prefix:    "$WX",
+		Separator: ",",
+		Fields:    []BridgeField{{Metric: "temperature", Field: 2, Scale: 0.1}},
+		Commands: []BridgeCommand{
+			{Function: "raw", Send: "{param}"},
+			{Function: "calibrate", Send: "CAL {param}", Reply: "$CAL"},
+		},
+	}
+
+	// the sensor prints a reading, and answers CAL with a reading and then
+	// its reply.
+	port, sensor := net.Pipe()
+	defer sensor.Close()
+	sent := make(chan string, 10)
+	go func() {
+		fmt.Fprint(sensor, "$WX,215\r\n")
+		scanner := bufio.NewScanner(sensor)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			sent <- line
+			if strings.HasPrefix(line, "CAL ") {
+				fmt.Fprint(sensor, "$WX,220\r\n$CAL OK "+strings.TrimPrefix(line, "CAL ")+"\r\n")
+			}
+		}
+	}()
+
+	s := New("weather", "sensor")
+	b := NewBridge(s, port, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Connect(ctx, addr, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ran := make(chan error, 1)
+	go func() {
+		ran <- b.Run(ctx)
+	}()
+
+	c := client.New(addr, nil)
+	defer c.Close()
+
+	if result, err := c.Run(ctx, "weather", "calibrate", "5", nil); err != nil || result != url.PathEscape("$CAL OK 5") {
+		t.Fatalf("expected the sensor's reply, got %q, %v", result, err)
+	}
+	if _, err := c.Run(ctx, "weather", "raw", "RESET", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"CAL 5", "RESET"} {
+		if got := <-sent; got != want {
+			t.Fatalf("expected the sensor to be sent %q, got %q", want, got)
+		}
+	}
+
+	points, err := c.Metrics(ctx, "weather", "temperature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || points[0].Value != 21.5 || points[1].Value != 22 {
+		t.Fatalf("expected both readings, got %+v", points)
+	}
+
+	cancel()
+	if err := <-ran; errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected Run to stop once cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+package station
+
+import (
+	"context"
+	"net"
+)
+
+// DialFunc opens a network connection, like net.Dialer's DialContext. A
+// client.DialFunc is one too.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// WithDialer has the station open its connection with dial, like
+// client.WithDialer. Under TinyGo, where the board's network co-processor
+// does TLS itself, it can only be used for connections without TLS.
+func WithDialer(dial DialFunc) Option {
+	return func(s *Station) {
+		s.dialer.custom = dial
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !tinygo
+
+package station
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+
+	"github.com/silversupreme/drops/pkg/client"
+)
+
+// dialer opens the station's connections the way clients do, through a
+// proxy if there is one.
+type dialer struct {
+	opts []client.Option
+	// set with WithDialer.
+	custom DialFunc
+}
+
+func (d dialer) dial(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	opts := d.opts
+	if d.custom != nil {
+		opts = append(opts[:len(opts):len(opts)], client.WithDialer(client.DialFunc(d.custom)))
+	}
+	return client.New(addr, config, opts...).Dial(ctx)
+}
+
+// WithProxy has the station connect through an HTTP or SOCKS5 proxy, like
+// client.WithProxy. Without it, the station goes through the proxy set in
+// the environment, if any.
+func WithProxy(proxy *url.URL) Option {
+	return func(s *Station) {
+		s.dialer.opts = append(s.dialer.opts, client.WithProxy(proxy))
+	}
+}
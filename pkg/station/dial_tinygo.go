@@ -0,0 +1,42 @@
+//go:build tinygo
+
+package station
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// dialer opens the station's connections with TinyGo's net and crypto/tls,
+// which hand TCP and TLS to the board's network co-processor (an ESP32
+// running its AT firmware, a WiFiNINA, ...) through its netdev driver. There
+// are no proxies on a microcontroller, and nothing to pull in net/http for.
+type dialer struct {
+	// set with WithDialer.
+	custom DialFunc
+}
+
+func (d dialer) dial(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if d.custom != nil {
+		// the co-processor opens TLS connections itself, so there's no
+		// connection of ours to run TLS over.
+		if config != nil {
+			return nil, errors.New("stations built with TinyGo can't use WithDialer with TLS")
+		}
+		return d.custom(ctx, "tcp", addr)
+	}
+	if config == nil {
+		return net.Dial("tcp", addr)
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,140 @@
+package station
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+	"github.com/silversupreme/drops/pkg/retry"
+)
+
+// Field stations lose their connection all the time. Stations made
+// WithReconnect connect again with exponential backoff and register again,
+// keeping the metrics reported in the meantime to send once they're back,
+// with the time they were reported at.
+
+// WithReconnect has the station connect again whenever its connection drops,
+// waiting between attempts from min up to max, twice as long each time.
+func WithReconnect(min, max time.Duration) Option {
+	return func(s *Station) {
+		s.reconnect = true
+		s.minBackoff = min
+		s.maxBackoff = max
+	}
+}
+
+// WithBuffer sets how many points a reconnecting station keeps while it's
+// offline, 1000 by default. Once it has that many, the oldest are dropped to
+// make room.
+func WithBuffer(points int) Option {
+	return func(s *Station) {
+		s.maxBuffered = points
+	}
+}
+
+// WithClock has the station timestamp its points and wait between attempts
+// to reconnect by clk, rather than the system clock. It's for tests that
+// drive the station and the server through time with the same mock clock.
+func WithClock(clk clock.Clock) Option {
+	return func(s *Station) {
+		s.clock = clk
+	}
+}
+
+// point is a metric point waiting to be sent.
+type point struct {
+	seq   uint64
+	name  string
+	value float64
+	ts    time.Time
+}
+
+// line returns the point's METRIC command.
+func (p point) line() string {
+	return fmt.Sprintf("METRIC %s %s %d", p.name, strconv.FormatFloat(p.value, 'g', -1, 64), p.ts.Unix())
+}
+
+// keep buffers a point, dropping the oldest if there are too many. s.m must
+// be held.
+func (s *Station) keep(p point) {
+	s.seq++
+	p.seq = s.seq
+	s.buffered = append(s.buffered, p)
+	if len(s.buffered) > s.maxBuffered {
+		s.buffered = s.buffered[len(s.buffered)-s.maxBuffered:]
+	}
+}
+
+// keepConnected connects again each time the connection is lost, until stop
+// is closed, and then closes done.
+func (s *Station) keepConnected(addr string, config *tls.Config, lost, stop, done chan struct{}) {
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-lost:
+		case <-stop:
+			// Close closed the connection; wait for it to be gone.
+			<-lost
+			return
+		}
+
+		var wait time.Duration
+		for {
+			wait = retry.Backoff(wait, s.minBackoff, s.maxBackoff)
+			select {
+			case <-stop:
+				return
+			case <-s.clock.After(wait):
+			}
+
+			if l, err := s.connect(ctx, addr, config, stop); err == nil {
+				lost = l
+				break
+			}
+		}
+
+		s.flush(ctx)
+	}
+}
+
+// flush sends the points kept while the station was offline, oldest first,
+// until they've all been sent or the connection goes away again. Points the
+// server rejects are dropped.
+func (s *Station) flush(ctx context.Context) {
+	for {
+		s.m.Lock()
+		if len(s.buffered) == 0 {
+			s.m.Unlock()
+			return
+		}
+		p := s.buffered[0]
+		s.m.Unlock()
+
+		err := s.do(ctx, p.line())
+		if err != nil && errors.Cause(err) != ErrRejected {
+			return
+		}
+
+		s.m.Lock()
+		// the point may have been dropped to make room meanwhile.
+		if len(s.buffered) > 0 && s.buffered[0].seq == p.seq {
+			s.buffered = s.buffered[1:]
+		}
+		s.m.Unlock()
+	}
+}
@@ -0,0 +1,123 @@
+package station
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+	"github.com/silversupreme/drops/pkg/client"
+)
+
+// eventually advances clk until cond holds, so timers waiting on it fire.
+func eventually(t *testing.T, clk *clock.Mock, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		clk.Add(time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	mock := clock.NewMock()
+	addr := serve(t, mock)
+
+	// the network can be cut, which drops the station's connection and
+	// fails attempts to connect again.
+	var offline int32
+	var last atomic.Value
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if atomic.LoadInt32(&offline) == 1 {
+			return nil, errors.New("network is down")
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err == nil {
+			last.Store(conn)
+		}
+		return conn, err
+	}
+	s := New("water", "source", WithReconnect(time.Second, 4*time.Second), WithClock(mock), WithDialer(dial))
+	ctx := context.Background()
+	if err := s.Connect(ctx, addr, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []client.Point
+	gauge := func(value float64) {
+		expected = append(expected, client.Point{Station: "water", Metric: "level", Ts: mock.Now(), Value: value})
+		if err := s.Gauge("level", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gauge(1)
+
+	atomic.StoreInt32(&offline, 1)
+	last.Load().(net.Conn).Close()
+	online := func() bool {
+		s.m.Lock()
+		defer s.m.Unlock()
+		return s.conn != nil
+	}
+	eventually(t, mock, func() bool { return !online() })
+	// without a metric store, the server forgets the station's history when
+	// it goes offline.
+	expected = nil
+
+	// points reported while offline are kept, with the time they were
+	// reported at.
+	gauge(2)
+	mock.Add(10 * time.Second)
+	gauge(3)
+
+	atomic.StoreInt32(&offline, 0)
+	eventually(t, mock, func() bool {
+		s.m.Lock()
+		defer s.m.Unlock()
+		return s.conn != nil && len(s.buffered) == 0
+	})
+	gauge(4)
+
+	c := client.New(addr, nil)
+	defer c.Close()
+	points, err := c.Metrics(ctx, "water", "level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, points)
+	}
+	for i, p := range points {
+		if !p.Ts.Equal(expected[i].Ts.Truncate(time.Second)) || p.Value != expected[i].Value {
+			t.Fatalf("expected %+v, got %+v", expected, points)
+		}
+	}
+
+	// once closed, the station stays offline.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Wait(); err == nil {
+		t.Fatal("expected the connection to be gone")
+	}
+	if err := s.Gauge("level", 5); errors.Cause(err) != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	s := New("water", "source", WithReconnect(time.Second, time.Second), WithBuffer(2))
+	for i := 0; i < 3; i++ {
+		s.keep(point{name: "level", value: float64(i)})
+	}
+
+	if len(s.buffered) != 2 || s.buffered[0].value != 1 || s.buffered[1].value != 2 {
+		t.Fatalf("expected the oldest point to be dropped, got %+v", s.buffered)
+	}
+}
@@ -0,0 +1,198 @@
+package station
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Most field stations are a Raspberry Pi-class board with a sensor or two
+// wired to it. These helpers read the common ones through the kernel's own
+// drivers, so there's nothing else to install: DS18B20 temperature sensors on
+// the 1-Wire bus (with the w1-gpio overlay enabled), and switches, like
+// float switches, on GPIO pins. Report polls any of them into a metric.
+
+// Where the kernel exposes 1-Wire devices and GPIO pins; replaced in tests.
+var (
+	w1Root   = "/sys/bus/w1/devices"
+	gpioRoot = "/sys/class/gpio"
+)
+
+// Sensor reads a metric's current value.
+type Sensor func() (float64, error)
+
+// Report reads sensor and reports its value as metric every interval, until
+// ctx is done or the station can't report it. Readings that fail, as cheap
+// sensors' sometimes do, are skipped. It's meant to be run in a goroutine
+// per sensor.
+func (s *Station) Report(ctx context.Context, metric string, every time.Duration, sensor Sensor) error {
+	ticker := s.clock.Ticker(every)
+	defer ticker.Stop()
+
+	for {
+		if v, err := sensor(); err == nil {
+			err := s.Gauge(metric, v)
+			if err != nil && errors.Cause(err) != ErrRejected {
+				return err
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// DS18B20 is a 1-Wire temperature sensor.
+type DS18B20 struct {
+	// ID is the sensor's 1-Wire address, like 28-0316a2795bff.
+	ID string
+}
+
+// FindDS18B20s returns the DS18B20s on the 1-Wire bus, in order of their
+// IDs.
+func FindDS18B20s() ([]DS18B20, error) {
+	// family code 28 is the DS18B20.
+	paths, err := filepath.Glob(filepath.Join(w1Root, "28-*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	sensors := make([]DS18B20, 0, len(paths))
+	for _, path := range paths {
+		sensors = append(sensors, DS18B20{ID: filepath.Base(path)})
+	}
+	return sensors, nil
+}
+
+// Read returns the temperature in °C. It's a Sensor, and takes most of a
+// second, which is how long the sensor takes to convert.
+func (d DS18B20) Read() (float64, error) {
+	data, err := os.ReadFile(filepath.Join(w1Root, d.ID, "w1_slave"))
+	if err != nil {
+		return 0, errors.Wrapf(err, "reading %s", d.ID)
+	}
+
+	// e.g.
+	//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+	//	72 01 4b 46 7f ff 0e 10 57 t=23125
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "YES") {
+		return 0, errors.Errorf("%s answered with a bad CRC", d.ID)
+	}
+	_, raw, ok := strings.Cut(lines[1], "t=")
+	if !ok {
+		return 0, errors.Errorf("%s answered without a temperature", d.ID)
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil {
+		return 0, errors.Wrapf(err, "reading %s", d.ID)
+	}
+	// 85°C is what the sensor reads before its first conversion, which is
+	// what it answers when it's browned out.
+	if milli == 85000 {
+		return 0, errors.Errorf("%s hasn't converted a temperature", d.ID)
+	}
+	return float64(milli) / 1000, nil
+}
+
+// GPIOInput is a GPIO pin read as an input, like a float switch.
+type GPIOInput struct {
+	dir string
+}
+
+// piGPIOChips are the labels of the GPIO chips driving a Raspberry Pi's
+// header: the SoC's own up to the Pi 4, and the RP1's on the Pi 5.
+var piGPIOChips = []string{"pinctrl-bcm2", "pinctrl-rp1"}
+
+// gpioBase returns the number the kernel gives the first pin of the chip
+// driving a Raspberry Pi's header, which newer kernels (6.6 and on) no longer
+// start at 0, or 0 if there's no such chip.
+func gpioBase() (int, error) {
+	chips, err := filepath.Glob(filepath.Join(gpioRoot, "gpiochip*"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(chips)
+	for _, chip := range chips {
+		label, err := os.ReadFile(filepath.Join(chip, "label"))
+		if err != nil {
+			continue
+		}
+		for _, prefix := range piGPIOChips {
+			if !strings.HasPrefix(strings.TrimSpace(string(label)), prefix) {
+				continue
+			}
+			base, err := os.ReadFile(filepath.Join(chip, "base"))
+			if err != nil {
+				return 0, err
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(string(base)))
+			return n, errors.Wrapf(err, "reading %s's base", chip)
+		}
+	}
+	return 0, nil
+}
+
+// OpenGPIOInput sets pin up as an input. On a Raspberry Pi, pin is its BCM
+// number, whichever number the kernel gives it; elsewhere, it's numbered as
+// the kernel numbers it. With activeLow, the pin reads as 1 when it's pulled
+// low, as a switch to ground does when it's closed.
+func OpenGPIOInput(pin int, activeLow bool) (*GPIOInput, error) {
+	base, err := gpioBase()
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding GPIO %d", pin)
+	}
+	line := strconv.Itoa(base + pin)
+
+	dir := filepath.Join(gpioRoot, "gpio"+line)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.WriteFile(filepath.Join(gpioRoot, "export"), []byte(line), 0644); err != nil {
+			return nil, errors.Wrapf(err, "exporting GPIO %d", pin)
+		}
+	}
+
+	low := "0"
+	if activeLow {
+		low = "1"
+	}
+	// udev takes a moment to give a freshly exported pin's files their
+	// permissions.
+	for i := 0; i < 20; i++ {
+		if err = os.WriteFile(filepath.Join(dir, "direction"), []byte("in"), 0644); err == nil {
+			err = os.WriteFile(filepath.Join(dir, "active_low"), []byte(low), 0644)
+		}
+		if !os.IsPermission(err) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "setting up GPIO %d", pin)
+	}
+	return &GPIOInput{dir: dir}, nil
+}
+
+// Read returns 1 if the pin is active, and 0 if it isn't. It's a Sensor.
+func (g *GPIOInput) Read() (float64, error) {
+	data, err := os.ReadFile(filepath.Join(g.dir, "value"))
+	if err != nil {
+		return 0, err
+	}
+	switch strings.TrimSpace(string(data)) {
+	case "1":
+		return 1, nil
+	case "0":
+		return 0, nil
+	}
+	return 0, errors.Errorf("bad GPIO value %q", data)
+}
@@ -0,0 +1,145 @@
+package station
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+	"github.com/silversupreme/drops/pkg/client"
+)
+
+func TestDS18B20(t *testing.T) {
+	w1Root = t.TempDir()
+	defer func() { w1Root = "/sys/bus/w1/devices" }()
+
+	for id, reading := range map[string]string{
+		"28-0316a2795bff": "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n",
+		"28-0316a2795c00": "72 01 4b 46 7f ff 0e 10 57 : crc=00 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n",
+		"28-0316a2795c01": "50 05 4b 46 7f ff 0c 10 1c : crc=1c YES\n50 05 4b 46 7f ff 0c 10 1c t=85000\n",
+		// not a DS18B20.
+		"10-000802b4a1f3": "",
+	} {
+		os.Mkdir(filepath.Join(w1Root, id), 0700)
+		os.WriteFile(filepath.Join(w1Root, id, "w1_slave"), []byte(reading), 0600)
+	}
+
+	sensors, err := FindDS18B20s()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sensors) != 3 || sensors[0].ID != "28-0316a2795bff" {
+		t.Fatalf("unexpected sensors %+v", sensors)
+	}
+	if v, err := sensors[0].Read(); err != nil || v != 23.125 {
+		t.Fatalf("expected 23.125, got %g, %v", v, err)
+	}
+	// bad CRCs and power-on readings are errors, not temperatures.
+	for _, d := range sensors[1:] {
+		if v, err := d.Read(); err == nil {
+			t.Fatalf("expected %s to fail, got %g", d.ID, v)
+		}
+	}
+}
+
+func TestGPIOInput(t *testing.T) {
+	gpioRoot = t.TempDir()
+	defer func() { gpioRoot = "/sys/class/gpio" }()
+
+	// the kernel makes the pin's directory when it's exported.
+	dir := filepath.Join(gpioRoot, "gpio17")
+	os.Mkdir(dir, 0700)
+	os.WriteFile(filepath.Join(dir, "value"), []byte("1\n"), 0600)
+
+	g, err := OpenGPIOInput(17, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{"direction": "in", "active_low": "1"} {
+		if got, _ := os.ReadFile(filepath.Join(dir, file)); string(got) != want {
+			t.Fatalf("expected %s to be %q, got %q", file, want, got)
+		}
+	}
+	if v, err := g.Read(); err != nil || v != 1 {
+		t.Fatalf("expected 1, got %g, %v", v, err)
+	}
+
+	// pins that aren't there yet are exported.
+	if _, err := OpenGPIOInput(27, false); err == nil {
+		t.Fatal("expected a pin that never shows up to fail")
+	}
+	if got, _ := os.ReadFile(filepath.Join(gpioRoot, "export")); string(got) != "27" {
+		t.Fatalf("expected pin 27 to be exported, got %q", got)
+	}
+}
+
+func TestGPIOInputBase(t *testing.T) {
+	gpioRoot = t.TempDir()
+	defer func() { gpioRoot = "/sys/class/gpio" }()
+
+	// newer kernels number a Pi's header pins from the chip's base.
+	for chip, label := range map[string]string{"gpiochip0": "raspberrypi-exp-gpio\n", "gpiochip512": "pinctrl-bcm2711\n"} {
+		os.Mkdir(filepath.Join(gpioRoot, chip), 0700)
+		os.WriteFile(filepath.Join(gpioRoot, chip, "label"), []byte(label), 0600)
+		os.WriteFile(filepath.Join(gpioRoot, chip, "base"), []byte(strings.TrimPrefix(chip, "gpiochip")+"\n"), 0600)
+	}
+	dir := filepath.Join(gpioRoot, "gpio529")
+	os.Mkdir(dir, 0700)
+	os.WriteFile(filepath.Join(dir, "value"), []byte("0\n"), 0600)
+
+	g, err := OpenGPIOInput(17, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := g.Read(); err != nil || v != 0 {
+		t.Fatalf("expected 0, got %g, %v", v, err)
+	}
+}
+
+func TestReport(t *testing.T) {
+	mock := clock.NewMock()
+	addr := serve(t, mock)
+
+	s := New("tank", "sensor", WithClock(mock))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Connect(ctx, addr, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var reads int64
+	reported := make(chan error, 1)
+	go func() {
+		reported <- s.Report(ctx, "level", time.Minute, func() (float64, error) {
+			n := atomic.AddInt64(&reads, 1)
+			if n == 2 {
+				return 0, errors.New("glitch")
+			}
+			return float64(n), nil
+		})
+	}()
+
+	c := client.New(addr, nil)
+	defer c.Close()
+	var points []client.Point
+	eventually(t, mock, func() bool {
+		var err error
+		points, err = c.Metrics(ctx, "tank", "level")
+		return err == nil && len(points) >= 2
+	})
+	// the failed reading was skipped.
+	if points[0].Value != 1 || points[1].Value != 3 {
+		t.Fatalf("unexpected points %+v", points)
+	}
+
+	cancel()
+	if err := <-reported; err != context.Canceled {
+		t.Fatalf("expected Report to stop once cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,458 @@
+// Package station is for writing drops stations in Go. A Station registers
+// with the server, answers RUNs with the handlers it's given and reports
+// metrics, so agents don't have to speak the line protocol themselves.
+package station
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+	"github.com/silversupreme/drops/pkg/retry"
+)
+
+// ErrRejected is returned when the server answers a command with ERR, and
+// is the same error as client.ErrRejected.
+var ErrRejected = retry.ErrRejected
+
+// ErrNotConnected is returned for commands sent before Connect, or after the
+// connection has gone away (or, for stations that reconnect, after Close).
+var ErrNotConnected = errors.New("not connected")
+
+// Handler runs a function of the station for a RUN, and returns its result.
+// Results are sent as a single token, so they can't contain spaces; runs
+// whose results do are answered with ERR, like runs that fail. ctx is
+// cancelled when the client that started the run CANCELs it, or the
+// station's connection goes away.
+type Handler func(ctx context.Context, param string) (string, error)
+
+// Station is a station's connection to a drops server.
+//
+// A Station is safe for concurrent use: metrics can be reported from any
+// number of goroutines, and each RUN is handled in a goroutine of its own.
+type Station struct {
+	name string
+	tipe string
+
+	// metadata for REGISTER.
+	firmware string
+	location string
+
+	// how to reach the server.
+	dialer dialer
+
+	// whether to connect again when the connection drops, and how long to
+	// wait between attempts, by clock.
+	reconnect  bool
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	clock      clock.Clock
+	// how many points to keep while offline.
+	maxBuffered int
+
+	handlersM sync.Mutex
+	handlers  map[string]Handler
+
+	uids uint64
+
+	// held to write a line, so lines aren't interleaved.
+	writeM sync.Mutex
+
+	m    sync.Mutex
+	conn net.Conn
+	// commands waiting on their response, by uid.
+	pending map[string]chan string
+	// runs in flight, by uid.
+	runs map[string]context.CancelFunc
+	// closed when the current connection goes away.
+	lost chan struct{}
+	// points reported while offline, oldest first, and the sequence number
+	// of the next one.
+	buffered []point
+	seq      uint64
+	// why the connection is done, once it is.
+	err error
+	// closed when the station is done: when its connection goes away or,
+	// for stations that reconnect, once it's closed.
+	done chan struct{}
+	// closed by Close, to stop a station from reconnecting.
+	stop chan struct{}
+}
+
+// Option configures a Station.
+type Option func(*Station)
+
+// WithFirmware has the station say which firmware it runs when it registers.
+func WithFirmware(version string) Option {
+	return func(s *Station) {
+		s.firmware = version
+	}
+}
+
+// WithLocation has the station say where it is when it registers, in decimal
+// degrees.
+func WithLocation(lat, lon float64) Option {
+	return func(s *Station) {
+		s.location = strconv.FormatFloat(lat, 'f', -1, 64) + "," + strconv.FormatFloat(lon, 'f', -1, 64)
+	}
+}
+
+// New returns a station that registers as name, of type tipe.
+func New(name, tipe string, opts ...Option) *Station {
+	s := &Station{
+		name:     name,
+		tipe:     tipe,
+		handlers: map[string]Handler{},
+
+		minBackoff:  100 * time.Millisecond,
+		maxBackoff:  30 * time.Second,
+		clock:       clock.New(),
+		maxBuffered: 1000,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Handle has the station answer RUNs of fn with h. The functions handled
+// when the station connects are the ones it tells the server it can run;
+// ones added afterwards are still run, but not advertised. RUNs of functions
+// without a handler are answered with ERR.
+func (s *Station) Handle(fn string, h Handler) {
+	s.handlersM.Lock()
+	defer s.handlersM.Unlock()
+
+	s.handlers[fn] = h
+}
+
+// Connect connects to the server at addr and registers. A nil config
+// connects over plain TCP, which is only useful against servers in tests and
+// local development.
+//
+// Stations made WithReconnect keep connecting again from then on, whenever
+// their connection drops, until they're closed.
+func (s *Station) Connect(ctx context.Context, addr string, config *tls.Config) error {
+	var stop chan struct{}
+	if s.reconnect {
+		s.m.Lock()
+		if s.stop != nil {
+			s.m.Unlock()
+			return errors.New("already connected")
+		}
+		stop = make(chan struct{})
+		s.stop = stop
+		s.m.Unlock()
+	}
+
+	lost, err := s.connect(ctx, addr, config, stop)
+	if err != nil {
+		s.m.Lock()
+		if s.stop == stop {
+			s.stop = nil
+		}
+		s.m.Unlock()
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.reconnect {
+		s.done = lost
+		return nil
+	}
+	done := make(chan struct{})
+	s.done = done
+	go s.keepConnected(addr, config, lost, stop, done)
+	return nil
+}
+
+// connect opens a connection and registers on it, and returns a channel
+// that's closed when the connection goes away. stop is the reconnecting
+// station's, which must not have been closed.
+func (s *Station) connect(ctx context.Context, addr string, config *tls.Config, stop chan struct{}) (chan struct{}, error) {
+	conn, err := s.dialer.dial(ctx, addr, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting")
+	}
+
+	s.m.Lock()
+	if s.conn != nil || s.stop != stop {
+		s.m.Unlock()
+		conn.Close()
+		if s.stop != stop {
+			return nil, ErrNotConnected
+		}
+		return nil, errors.New("already connected")
+	}
+	s.conn = conn
+	s.pending = map[string]chan string{}
+	s.runs = map[string]context.CancelFunc{}
+	s.err = nil
+	lost := make(chan struct{})
+	s.lost = lost
+	s.m.Unlock()
+
+	go s.read(conn, lost)
+
+	if err := s.do(ctx, s.registration()); err != nil {
+		conn.Close()
+		<-lost
+		return nil, errors.Wrap(err, "registering")
+	}
+	return lost, nil
+}
+
+// registration returns the station's REGISTER command.
+func (s *Station) registration() string {
+	line := fmt.Sprintf("REGISTER %s %s", s.name, s.tipe)
+	if s.location != "" {
+		line += " location=" + s.location
+	}
+
+	s.handlersM.Lock()
+	fns := make([]string, 0, len(s.handlers))
+	for fn := range s.handlers {
+		fns = append(fns, fn)
+	}
+	s.handlersM.Unlock()
+	if len(fns) > 0 {
+		sort.Strings(fns)
+		line += " functions=" + strings.Join(fns, ",")
+	}
+
+	if s.firmware != "" {
+		line += " firmware=" + s.firmware
+	}
+	return line
+}
+
+// Gauge reports the current value of a metric, and returns once the server
+// has stored it.
+//
+// Stations made WithReconnect timestamp the points themselves. Points
+// reported while the station is offline are kept, and Gauge returns right
+// away; they're sent once it's connected again, along with ones reported
+// before they've all been sent, so the server gets them in order.
+func (s *Station) Gauge(name string, value float64) error {
+	if !s.reconnect {
+		return s.do(context.Background(), fmt.Sprintf("METRIC %s %s", name, strconv.FormatFloat(value, 'g', -1, 64)))
+	}
+
+	p := point{name: name, value: value, ts: s.clock.Now()}
+	s.m.Lock()
+	switch {
+	case s.stop == nil:
+		s.m.Unlock()
+		return ErrNotConnected
+	case s.conn == nil || len(s.buffered) > 0:
+		s.keep(p)
+		s.m.Unlock()
+		return nil
+	}
+	s.m.Unlock()
+
+	err := s.do(context.Background(), p.line())
+	if err != nil && errors.Cause(err) != ErrRejected {
+		// the connection went away before the point was acknowledged. It's
+		// sent again with the same timestamp, which the server won't store
+		// twice.
+		s.m.Lock()
+		if s.stop != nil {
+			s.keep(p)
+			err = nil
+		}
+		s.m.Unlock()
+	}
+	return err
+}
+
+// Wait blocks until the station's connection goes away (or, for stations
+// that reconnect, until it's closed), and returns why.
+func (s *Station) Wait() error {
+	s.m.Lock()
+	done := s.done
+	s.m.Unlock()
+
+	if done == nil {
+		return ErrNotConnected
+	}
+	<-done
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.err
+}
+
+// Close closes the station's connection, which takes it offline. Runs in
+// flight have their contexts cancelled. Stations that reconnect stop doing
+// so, and drop the points they were keeping.
+func (s *Station) Close() error {
+	s.m.Lock()
+	conn := s.conn
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+		s.buffered = nil
+	}
+	s.m.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// uid returns a uid no other command from this station uses.
+func (s *Station) uid() string {
+	return fmt.Sprintf("s%d", atomic.AddUint64(&s.uids, 1))
+}
+
+// write sends a line to the server.
+func (s *Station) write(line string) error {
+	s.m.Lock()
+	conn := s.conn
+	s.m.Unlock()
+
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	s.writeM.Lock()
+	defer s.writeM.Unlock()
+
+	_, err := fmt.Fprintf(conn, "%s\n", line)
+	return err
+}
+
+// do sends a command, and waits for it to be answered.
+func (s *Station) do(ctx context.Context, line string) error {
+	uid := s.uid()
+	resp := make(chan string, 1)
+
+	s.m.Lock()
+	if s.conn == nil {
+		s.m.Unlock()
+		return ErrNotConnected
+	}
+	s.pending[uid] = resp
+	lost := s.lost
+	s.m.Unlock()
+
+	defer func() {
+		s.m.Lock()
+		delete(s.pending, uid)
+		s.m.Unlock()
+	}()
+
+	if err := s.write(uid + " " + line); err != nil {
+		return err
+	}
+
+	select {
+	case r := <-resp:
+		if r == "ERR" || strings.HasPrefix(r, "ERR ") {
+			return errors.Wrap(ErrRejected, line)
+		}
+		return nil
+	case <-lost:
+		return errors.Wrap(ErrNotConnected, line)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// read handles each line from the server, until the connection drops.
+func (s *Station) read(conn net.Conn, lost chan struct{}) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		uid, rest, _ := strings.Cut(scanner.Text(), " ")
+		cmd, args, _ := strings.Cut(rest, " ")
+
+		switch cmd {
+		case "RUN":
+			fn, param, _ := strings.Cut(args, " ")
+			s.run(uid, fn, param)
+		case "CANCEL":
+			s.m.Lock()
+			if cancel, ok := s.runs[uid]; ok {
+				cancel()
+			}
+			s.m.Unlock()
+		default:
+			// a response to one of the station's commands, or
+			// something it has no use for, like configuration.
+			s.m.Lock()
+			if resp, ok := s.pending[uid]; ok {
+				resp <- rest
+				delete(s.pending, uid)
+			}
+			s.m.Unlock()
+		}
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = errors.New("connection closed")
+	}
+	conn.Close()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.conn == conn {
+		for _, cancel := range s.runs {
+			cancel()
+		}
+		s.conn = nil
+		s.err = err
+	}
+	close(lost)
+}
+
+// run handles a RUN in a goroutine of its own, and answers it.
+func (s *Station) run(uid, fn, param string) {
+	s.handlersM.Lock()
+	h, ok := s.handlers[fn]
+	s.handlersM.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.m.Lock()
+	s.runs[uid] = cancel
+	s.m.Unlock()
+
+	go func() {
+		defer func() {
+			s.m.Lock()
+			delete(s.runs, uid)
+			s.m.Unlock()
+			cancel()
+		}()
+
+		if !ok {
+			s.write(uid + " ERR")
+			return
+		}
+
+		result, err := h(ctx, param)
+		switch {
+		case err != nil, strings.ContainsAny(result, " \n"):
+			s.write(uid + " ERR")
+		case result == "":
+			s.write(uid + " DONE")
+		default:
+			s.write(uid + " DONE " + result)
+		}
+	}()
+}
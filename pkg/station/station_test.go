@@ -0,0 +1,115 @@
+package station
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/pkg/errors"
+	"github.com/silversupreme/drops/pkg/client"
+	"github.com/silversupreme/drops/pkg/server"
+)
+
+func serve(t *testing.T, clk clock.Clock) string {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.New(listener, 4, clk)
+	go s.Serve(context.Background())
+
+	return listener.Addr().String()
+}
+
+func TestStation(t *testing.T) {
+	addr := serve(t, clock.NewMock())
+
+	cancelled := make(chan struct{})
+	s := New("water", "source", WithFirmware("1.2"), WithLocation(45.5, -122.6))
+	s.Handle("echo", func(ctx context.Context, param string) (string, error) {
+		return param, nil
+	})
+	s.Handle("fail", func(ctx context.Context, param string) (string, error) {
+		return "", errors.New("no water")
+	})
+	s.Handle("wait", func(ctx context.Context, param string) (string, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return "", ctx.Err()
+	})
+
+	ctx := context.Background()
+	if err := s.Connect(ctx, addr, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Gauge("level", 1.5); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Gauge("bad*name", 1); errors.Cause(err) != ErrRejected {
+		t.Fatalf("expected ErrRejected, got %v", err)
+	}
+
+	c := client.New(addr, nil)
+	defer c.Close()
+
+	stations, err := c.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stations) != 1 || stations[0].Name != "water" || stations[0].Type != "source" {
+		t.Fatalf("unexpected stations %+v", stations)
+	}
+
+	points, err := c.Metrics(ctx, "water", "level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || points[0].Value != 1.5 {
+		t.Fatalf("unexpected points %+v", points)
+	}
+
+	if result, err := c.Run(ctx, "water", "echo", "hello", nil); err != nil || result != "hello" {
+		t.Fatalf("expected hello, got %q, %v", result, err)
+	}
+	for _, fn := range []string{"fail", "missing"} {
+		if _, err := c.Run(ctx, "water", fn, "", nil); errors.Cause(err) != client.ErrRunFailed {
+			t.Fatalf("running %s: expected ErrRunFailed, got %v", fn, err)
+		}
+	}
+
+	// cancelling the run cancels the handler's context.
+	runCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.Run(runCtx, "water", "wait", "", nil); err == nil {
+		t.Fatal("expected the run to be cancelled")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the handler to be cancelled")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Wait(); err == nil {
+		t.Fatal("expected the connection to be gone")
+	}
+	if err := s.Gauge("level", 2); errors.Cause(err) != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	s := New("water", "source", WithFirmware("1.2"), WithLocation(45.5, -122.6))
+	s.Handle("read", nil)
+	s.Handle("fill", nil)
+
+	expected := "REGISTER water source location=45.5,-122.6 functions=fill,read firmware=1.2"
+	if got := s.registration(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}